@@ -21,7 +21,9 @@ if config.config_file_name is not None:
 from database import Base
 from db_models import (
     MetricsModel, DockerEventsModel, ContainerLogsModel, 
-    AlertsModel, EmailNotificationsModel
+    AlertsModel, EmailNotificationsModel, ReceivedPayloadsModel, AgentsModel,
+    MetricsHourlyModel, EnrollmentTokensModel, AgentCredentialsModel, RuleFindingsModel,
+    AlertGroupsModel, AlertSilencesModel
 )
 
 target_metadata = Base.metadata
@@ -0,0 +1,32 @@
+"""Add received_payloads for payload ID deduplication
+
+Revision ID: 3b7d2e9c41a8
+Revises: fcc606ae3910
+Create Date: 2026-10-16 19:40:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '3b7d2e9c41a8'
+down_revision = 'fcc606ae3910'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('received_payloads',
+    sa.Column('payload_id', sa.String(length=64), nullable=False),
+    sa.Column('host', sa.String(length=255), nullable=True),
+    sa.Column('server_id', sa.String(length=255), nullable=True),
+    sa.Column('received_at', sa.DateTime(timezone=True), nullable=False),
+    sa.PrimaryKeyConstraint('payload_id')
+    )
+    op.create_index('idx_received_payloads_received_at', 'received_payloads', ['received_at'], unique=False)
+
+
+def downgrade() -> None:
+    op.drop_index('idx_received_payloads_received_at', table_name='received_payloads')
+    op.drop_table('received_payloads')
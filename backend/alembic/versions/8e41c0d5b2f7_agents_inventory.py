@@ -0,0 +1,52 @@
+"""Add agents inventory and host columns
+
+Revision ID: 8e41c0d5b2f7
+Revises: 3b7d2e9c41a8
+Create Date: 2026-10-16 20:05:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = '8e41c0d5b2f7'
+down_revision = '3b7d2e9c41a8'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('agents',
+    sa.Column('agent_key', sa.String(length=255), nullable=False),
+    sa.Column('host', sa.String(length=255), nullable=False),
+    sa.Column('server_id', sa.String(length=255), nullable=True),
+    sa.Column('machine_id', sa.String(length=255), nullable=True),
+    sa.Column('agent_version', sa.String(length=64), nullable=True),
+    sa.Column('env', sa.String(length=64), nullable=True),
+    sa.Column('owner_team', sa.String(length=255), nullable=True),
+    sa.Column('first_seen', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('last_seen', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('last_payload_id', sa.String(length=64), nullable=True),
+    sa.Column('last_score', sa.Numeric(precision=6, scale=2), nullable=True),
+    sa.PrimaryKeyConstraint('agent_key')
+    )
+    op.create_index('idx_agents_env', 'agents', ['env'], unique=False)
+    op.create_index('idx_agents_last_seen', 'agents', ['last_seen'], unique=False)
+
+    op.add_column('metrics', sa.Column('host', sa.String(length=255), nullable=True))
+    op.add_column('metrics', sa.Column('server_id', sa.String(length=255), nullable=True))
+    op.create_index('idx_metrics_host_timestamp', 'metrics', ['host', 'timestamp'], unique=False)
+    op.add_column('docker_events', sa.Column('host', sa.String(length=255), nullable=True))
+    op.add_column('container_logs', sa.Column('host', sa.String(length=255), nullable=True))
+
+
+def downgrade() -> None:
+    op.drop_column('container_logs', 'host')
+    op.drop_column('docker_events', 'host')
+    op.drop_index('idx_metrics_host_timestamp', table_name='metrics')
+    op.drop_column('metrics', 'server_id')
+    op.drop_column('metrics', 'host')
+    op.drop_index('idx_agents_last_seen', table_name='agents')
+    op.drop_index('idx_agents_env', table_name='agents')
+    op.drop_table('agents')
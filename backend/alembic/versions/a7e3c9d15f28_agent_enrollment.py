@@ -0,0 +1,55 @@
+"""Add agent enrollment tokens and credentials
+
+Revision ID: a7e3c9d15f28
+Revises: d2f8a61b9e04
+Create Date: 2026-10-16 23:10:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'a7e3c9d15f28'
+down_revision = 'd2f8a61b9e04'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('enrollment_tokens',
+    sa.Column('token_hash', sa.String(length=64), nullable=False),
+    sa.Column('tenant', sa.String(length=255), nullable=True),
+    sa.Column('env', sa.String(length=64), nullable=True),
+    sa.Column('owner_team', sa.String(length=255), nullable=True),
+    sa.Column('created_at', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('expires_at', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('used_at', sa.DateTime(timezone=True), nullable=True),
+    sa.Column('key_id', sa.String(length=64), nullable=True),
+    sa.PrimaryKeyConstraint('token_hash')
+    )
+    op.create_index('idx_enrollment_tokens_expires_at', 'enrollment_tokens', ['expires_at'], unique=False)
+    op.create_table('agent_credentials',
+    sa.Column('key_id', sa.String(length=64), nullable=False),
+    sa.Column('secret', sa.String(length=128), nullable=False),
+    sa.Column('server_id', sa.String(length=255), nullable=False),
+    sa.Column('machine_id', sa.String(length=255), nullable=True),
+    sa.Column('host', sa.String(length=255), nullable=False),
+    sa.Column('agent_version', sa.String(length=64), nullable=True),
+    sa.Column('tenant', sa.String(length=255), nullable=True),
+    sa.Column('env', sa.String(length=64), nullable=True),
+    sa.Column('owner_team', sa.String(length=255), nullable=True),
+    sa.Column('enrolled_at', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('revoked_at', sa.DateTime(timezone=True), nullable=True),
+    sa.PrimaryKeyConstraint('key_id')
+    )
+    op.create_index('idx_agent_credentials_server_id', 'agent_credentials', ['server_id'], unique=False)
+    op.create_index('idx_agent_credentials_machine_id', 'agent_credentials', ['machine_id'], unique=False)
+
+
+def downgrade() -> None:
+    op.drop_index('idx_agent_credentials_machine_id', table_name='agent_credentials')
+    op.drop_index('idx_agent_credentials_server_id', table_name='agent_credentials')
+    op.drop_table('agent_credentials')
+    op.drop_index('idx_enrollment_tokens_expires_at', table_name='enrollment_tokens')
+    op.drop_table('enrollment_tokens')
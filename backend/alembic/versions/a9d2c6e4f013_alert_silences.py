@@ -0,0 +1,34 @@
+"""Add alert silences set from chat commands
+
+Revision ID: a9d2c6e4f013
+Revises: f1c4a8e2d957
+Create Date: 2026-10-20 14:15:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'a9d2c6e4f013'
+down_revision = 'f1c4a8e2d957'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('alert_silences',
+    sa.Column('id', sa.String(length=12), nullable=False),
+    sa.Column('alert_type', sa.String(length=100), nullable=False),
+    sa.Column('host', sa.String(length=255), nullable=True),
+    sa.Column('created_by', sa.String(length=255), nullable=False),
+    sa.Column('created_at', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('expires_at', sa.DateTime(timezone=True), nullable=False),
+    sa.PrimaryKeyConstraint('id')
+    )
+    op.create_index('idx_alert_silences_expires_at', 'alert_silences', ['expires_at'], unique=False)
+
+
+def downgrade() -> None:
+    op.drop_index('idx_alert_silences_expires_at', table_name='alert_silences')
+    op.drop_table('alert_silences')
@@ -0,0 +1,26 @@
+"""Record agent heartbeats
+
+Revision ID: b5e9a3c7d184
+Revises: d7b3e5f1a826
+Create Date: 2026-10-22 09:15:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'b5e9a3c7d184'
+down_revision = 'd7b3e5f1a826'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.add_column('agents', sa.Column('last_heartbeat', sa.DateTime(timezone=True), nullable=True))
+    op.add_column('agents', sa.Column('heartbeat_interval', sa.Integer(), nullable=True))
+
+
+def downgrade() -> None:
+    op.drop_column('agents', 'heartbeat_interval')
+    op.drop_column('agents', 'last_heartbeat')
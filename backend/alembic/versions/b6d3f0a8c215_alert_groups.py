@@ -0,0 +1,43 @@
+"""Keep open alert groups in the database for multiple replicas
+
+Revision ID: b6d3f0a8c215
+Revises: e4b8d7c2a913
+Create Date: 2026-10-18 10:05:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'b6d3f0a8c215'
+down_revision = 'e4b8d7c2a913'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('alert_groups',
+    sa.Column('id', sa.String(length=12), nullable=False),
+    sa.Column('group_key', sa.Text(), nullable=False),
+    sa.Column('route', sa.String(length=255), nullable=False),
+    sa.Column('alert_type', sa.String(length=100), nullable=False),
+    sa.Column('env', sa.String(length=100), nullable=True),
+    sa.Column('owner_team', sa.String(length=100), nullable=True),
+    sa.Column('first_seen', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('last_seen', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('notified_at', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('count', sa.Integer(), nullable=False),
+    sa.Column('pending', sa.Integer(), nullable=False),
+    sa.Column('hosts', sa.Text(), nullable=False),
+    sa.Column('alerts', sa.Text(), nullable=False),
+    sa.Column('escalation_level', sa.Integer(), nullable=False),
+    sa.Column('acknowledged', sa.Boolean(), nullable=False),
+    sa.PrimaryKeyConstraint('id')
+    )
+    op.create_index('uq_alert_groups_group_key', 'alert_groups', ['group_key'], unique=True)
+
+
+def downgrade() -> None:
+    op.drop_index('uq_alert_groups_group_key', table_name='alert_groups')
+    op.drop_table('alert_groups')
@@ -0,0 +1,30 @@
+"""Add queue depth, score trend and silence tracking to agents
+
+Revision ID: c5a19f3e7d62
+Revises: 8e41c0d5b2f7
+Create Date: 2026-10-16 21:40:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'c5a19f3e7d62'
+down_revision = '8e41c0d5b2f7'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.add_column('agents', sa.Column('score_avg', sa.Numeric(precision=6, scale=2), nullable=True))
+    op.add_column('agents', sa.Column('queue_depth', sa.Integer(), nullable=True))
+    op.add_column('agents', sa.Column('silent_since', sa.DateTime(timezone=True), nullable=True))
+    op.add_column('agents', sa.Column('silent_alert_id', sa.BigInteger(), nullable=True))
+
+
+def downgrade() -> None:
+    op.drop_column('agents', 'silent_alert_id')
+    op.drop_column('agents', 'silent_since')
+    op.drop_column('agents', 'queue_depth')
+    op.drop_column('agents', 'score_avg')
@@ -0,0 +1,41 @@
+"""Add hourly metric rollups
+
+Revision ID: d2f8a61b9e04
+Revises: c5a19f3e7d62
+Create Date: 2026-10-16 22:30:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'd2f8a61b9e04'
+down_revision = 'c5a19f3e7d62'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('metrics_hourly',
+    sa.Column('host', sa.String(length=255), nullable=False),
+    sa.Column('bucket', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('samples', sa.Integer(), nullable=False),
+    sa.Column('cpu_avg', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('cpu_max', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('memory_avg', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('memory_max', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('disk_avg', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('disk_max', sa.Numeric(precision=5, scale=2), nullable=True),
+    sa.Column('network_rx_avg', sa.BigInteger(), nullable=True),
+    sa.Column('network_tx_avg', sa.BigInteger(), nullable=True),
+    sa.Column('tcp_connections_avg', sa.Integer(), nullable=True),
+    sa.Column('tcp_connections_max', sa.Integer(), nullable=True),
+    sa.PrimaryKeyConstraint('host', 'bucket')
+    )
+    op.create_index('idx_metrics_hourly_bucket', 'metrics_hourly', ['bucket'], unique=False)
+
+
+def downgrade() -> None:
+    op.drop_index('idx_metrics_hourly_bucket', table_name='metrics_hourly')
+    op.drop_table('metrics_hourly')
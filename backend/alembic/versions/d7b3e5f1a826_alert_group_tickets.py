@@ -0,0 +1,24 @@
+"""Keep the tickets opened for each alert group
+
+Revision ID: d7b3e5f1a826
+Revises: a9d2c6e4f013
+Create Date: 2026-10-21 11:30:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'd7b3e5f1a826'
+down_revision = 'a9d2c6e4f013'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.add_column('alert_groups', sa.Column('tickets', sa.Text(), server_default='{}', nullable=False))
+
+
+def downgrade() -> None:
+    op.drop_column('alert_groups', 'tickets')
@@ -0,0 +1,38 @@
+"""Add findings of server-side rule evaluation
+
+Revision ID: e4b8d7c2a913
+Revises: a7e3c9d15f28
+Create Date: 2026-10-17 09:20:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'e4b8d7c2a913'
+down_revision = 'a7e3c9d15f28'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.create_table('rule_findings',
+    sa.Column('id', sa.BigInteger(), autoincrement=True, nullable=False),
+    sa.Column('host', sa.String(length=255), nullable=False),
+    sa.Column('alert', sa.String(length=255), nullable=False),
+    sa.Column('timestamp', sa.DateTime(timezone=True), nullable=False),
+    sa.Column('details', sa.Text(), nullable=True),
+    sa.Column('alert_id', sa.BigInteger(), nullable=True),
+    sa.Column('created_at', sa.DateTime(timezone=True), nullable=False),
+    sa.ForeignKeyConstraint(['alert_id'], ['alerts.id'], ondelete='SET NULL'),
+    sa.PrimaryKeyConstraint('id')
+    )
+    op.create_index('uq_rule_findings_host_alert_timestamp', 'rule_findings', ['host', 'alert', 'timestamp'], unique=True)
+    op.create_index('idx_rule_findings_created_at', 'rule_findings', ['created_at'], unique=False)
+
+
+def downgrade() -> None:
+    op.drop_index('idx_rule_findings_created_at', table_name='rule_findings')
+    op.drop_index('uq_rule_findings_host_alert_timestamp', table_name='rule_findings')
+    op.drop_table('rule_findings')
@@ -0,0 +1,24 @@
+"""Keep the highest payload score of each alert group
+
+Revision ID: f1c4a8e2d957
+Revises: b6d3f0a8c215
+Create Date: 2026-10-19 09:40:00.000000
+
+"""
+from alembic import op
+import sqlalchemy as sa
+
+
+# revision identifiers, used by Alembic.
+revision = 'f1c4a8e2d957'
+down_revision = 'b6d3f0a8c215'
+branch_labels = None
+depends_on = None
+
+
+def upgrade() -> None:
+    op.add_column('alert_groups', sa.Column('score', sa.Numeric(precision=6, scale=2), server_default='0', nullable=False))
+
+
+def downgrade() -> None:
+    op.drop_column('alert_groups', 'score')
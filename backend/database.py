@@ -113,7 +113,9 @@ async def init_db():
         # Import all models to ensure they are registered with Base
         from db_models import (
             MetricsModel, DockerEventsModel, ContainerLogsModel, 
-            AlertsModel, EmailNotificationsModel
+            AlertsModel, EmailNotificationsModel, ReceivedPayloadsModel, AgentsModel,
+            MetricsHourlyModel, EnrollmentTokensModel, AgentCredentialsModel, RuleFindingsModel,
+            AlertGroupsModel, AlertSilencesModel
         )
         
         # Create all tables (this will skip existing tables)
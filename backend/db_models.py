@@ -14,6 +14,8 @@ class MetricsModel(Base):
     __tablename__ = "metrics"
     
     id = Column(BigInteger, primary_key=True, autoincrement=True)
+    host = Column(String(255))
+    server_id = Column(String(255))
     timestamp = Column(DateTime(timezone=True), nullable=False, index=True)
     cpu_usage = Column(Numeric(5, 2))
     memory_usage = Column(Numeric(5, 2))
@@ -25,6 +27,31 @@ class MetricsModel(Base):
     # Index for efficient time-based queries
     __table_args__ = (
         Index('idx_metrics_timestamp_desc', 'timestamp', postgresql_using='btree'),
+        Index('idx_metrics_host_timestamp', 'host', 'timestamp'),
+    )
+
+
+class MetricsHourlyModel(Base):
+    """SQLAlchemy model for hourly metric rollups, kept longer than raw metrics."""
+    
+    __tablename__ = "metrics_hourly"
+    
+    host = Column(String(255), primary_key=True)  # empty for metrics stored before hosts were recorded
+    bucket = Column(DateTime(timezone=True), primary_key=True)  # start of the hour
+    samples = Column(Integer, nullable=False)
+    cpu_avg = Column(Numeric(5, 2))
+    cpu_max = Column(Numeric(5, 2))
+    memory_avg = Column(Numeric(5, 2))
+    memory_max = Column(Numeric(5, 2))
+    disk_avg = Column(Numeric(5, 2))
+    disk_max = Column(Numeric(5, 2))
+    network_rx_avg = Column(BigInteger)
+    network_tx_avg = Column(BigInteger)
+    tcp_connections_avg = Column(Integer)
+    tcp_connections_max = Column(Integer)
+    
+    __table_args__ = (
+        Index('idx_metrics_hourly_bucket', 'bucket'),
     )
 
 
@@ -34,6 +61,7 @@ class DockerEventsModel(Base):
     __tablename__ = "docker_events"
     
     id = Column(BigInteger, primary_key=True, autoincrement=True)
+    host = Column(String(255))
     timestamp = Column(DateTime(timezone=True), nullable=False, index=True)
     type = Column(String(255))
     action = Column(Text)
@@ -53,6 +81,7 @@ class ContainerLogsModel(Base):
     __tablename__ = "container_logs"
     
     id = Column(BigInteger, primary_key=True, autoincrement=True)
+    host = Column(String(255))
     container = Column(String(255), index=True)
     timestamp = Column(DateTime(timezone=True), nullable=False, index=True)
     message = Column(Text)
@@ -124,4 +153,157 @@ class EmailNotificationsModel(Base):
         Index('idx_email_notifications_alert_id', 'alert_id'),
         Index('idx_email_notifications_sent_at', 'sent_at'),
         Index('idx_email_notifications_status', 'status'),
-    )
\ No newline at end of file
+    )
+
+
+class ReceivedPayloadsModel(Base):
+    """SQLAlchemy model recording ingested payload IDs for deduplication."""
+    
+    __tablename__ = "received_payloads"
+    
+    payload_id = Column(String(64), primary_key=True)
+    host = Column(String(255))
+    server_id = Column(String(255))
+    received_at = Column(DateTime(timezone=True), default=lambda: datetime.now(timezone.utc), nullable=False)
+    
+    # Index for pruning old entries
+    __table_args__ = (
+        Index('idx_received_payloads_received_at', 'received_at'),
+    )
+
+
+class AgentsModel(Base):
+    """SQLAlchemy model for the agent inventory, one row per reporting agent."""
+    
+    __tablename__ = "agents"
+    
+    agent_key = Column(String(255), primary_key=True)  # server_id, or host for agents without one
+    host = Column(String(255), nullable=False)
+    server_id = Column(String(255))
+    machine_id = Column(String(255))
+    agent_version = Column(String(64))
+    env = Column(String(64))
+    owner_team = Column(String(255))
+    first_seen = Column(DateTime(timezone=True), nullable=False)
+    last_seen = Column(DateTime(timezone=True), nullable=False)
+    last_payload_id = Column(String(64))
+    last_score = Column(Numeric(6, 2))
+    score_avg = Column(Numeric(6, 2))  # moving average of recent scores, for the trend
+    queue_depth = Column(Integer)  # payloads queued on the agent when it last reported
+    silent_since = Column(DateTime(timezone=True))  # set while an AGENT_SILENT alert is open
+    silent_alert_id = Column(BigInteger)
+    last_heartbeat = Column(DateTime(timezone=True))
+    heartbeat_interval = Column(Integer)  # seconds between the agent's heartbeats, if it sends them
+    
+    __table_args__ = (
+        Index('idx_agents_last_seen', 'last_seen'),
+        Index('idx_agents_env', 'env'),
+    )
+
+
+class EnrollmentTokensModel(Base):
+    """SQLAlchemy model for one-time agent enrollment tokens."""
+    
+    __tablename__ = "enrollment_tokens"
+    
+    token_hash = Column(String(64), primary_key=True)  # SHA-256 of the token, which is never stored
+    tenant = Column(String(255))
+    env = Column(String(64))  # when set, agents enrolled with the token may only submit for it
+    owner_team = Column(String(255))
+    created_at = Column(DateTime(timezone=True), default=lambda: datetime.now(timezone.utc), nullable=False)
+    expires_at = Column(DateTime(timezone=True), nullable=False)
+    used_at = Column(DateTime(timezone=True))
+    key_id = Column(String(64))  # credentials issued for the token
+    
+    __table_args__ = (
+        Index('idx_enrollment_tokens_expires_at', 'expires_at'),
+    )
+
+
+class AgentCredentialsModel(Base):
+    """SQLAlchemy model for API keys issued to agents at enrollment."""
+    
+    __tablename__ = "agent_credentials"
+    
+    key_id = Column(String(64), primary_key=True)
+    secret = Column(String(128), nullable=False)  # HMAC key, so kept as issued
+    server_id = Column(String(255), nullable=False)
+    machine_id = Column(String(255))
+    host = Column(String(255), nullable=False)
+    agent_version = Column(String(64))
+    tenant = Column(String(255))
+    env = Column(String(64))
+    owner_team = Column(String(255))
+    enrolled_at = Column(DateTime(timezone=True), default=lambda: datetime.now(timezone.utc), nullable=False)
+    revoked_at = Column(DateTime(timezone=True))
+    
+    __table_args__ = (
+        Index('idx_agent_credentials_server_id', 'server_id'),
+        Index('idx_agent_credentials_machine_id', 'machine_id'),
+    )
+
+
+class RuleFindingsModel(Base):
+    """SQLAlchemy model for alerts raised by server-side rule evaluation."""
+    
+    __tablename__ = "rule_findings"
+    
+    id = Column(BigInteger, primary_key=True, autoincrement=True)
+    host = Column(String(255), nullable=False)
+    alert = Column(String(255), nullable=False)  # as the agent would raise it, e.g. SECRET_IN_LOGS:web
+    timestamp = Column(DateTime(timezone=True), nullable=False)  # of the data that matched
+    details = Column(Text)
+    alert_id = Column(BigInteger, ForeignKey('alerts.id', ondelete='SET NULL'))
+    created_at = Column(DateTime(timezone=True), default=lambda: datetime.now(timezone.utc), nullable=False)
+    
+    # A finding is raised once, however often its data is re-evaluated
+    __table_args__ = (
+        Index('uq_rule_findings_host_alert_timestamp', 'host', 'alert', 'timestamp', unique=True),
+        Index('idx_rule_findings_created_at', 'created_at'),
+    )
+
+
+class AlertGroupsModel(Base):
+    """SQLAlchemy model for open alert groups, shared by all backend replicas."""
+    
+    __tablename__ = "alert_groups"
+    
+    id = Column(String(12), primary_key=True)
+    group_key = Column(Text, nullable=False)  # JSON of route, alert type, env and owner team
+    route = Column(String(255), nullable=False)
+    alert_type = Column(String(100), nullable=False)
+    env = Column(String(100))
+    owner_team = Column(String(100))
+    first_seen = Column(DateTime(timezone=True), nullable=False)
+    last_seen = Column(DateTime(timezone=True), nullable=False)
+    notified_at = Column(DateTime(timezone=True), nullable=False)
+    score = Column(Numeric(6, 2), nullable=False, server_default='0')  # highest payload score seen
+    count = Column(Integer, nullable=False)
+    pending = Column(Integer, nullable=False)  # occurrences since the last notification
+    hosts = Column(Text, nullable=False)  # JSON object of host -> occurrences
+    alerts = Column(Text, nullable=False)  # JSON object of alert -> occurrences
+    escalation_level = Column(Integer, nullable=False)
+    acknowledged = Column(Boolean, nullable=False)
+    tickets = Column(Text, nullable=False, server_default='{}')  # JSON object of channel -> ticket key and URL
+    
+    # One open group per key, however many replicas see its alerts
+    __table_args__ = (
+        Index('uq_alert_groups_group_key', 'group_key', unique=True),
+    )
+
+
+class AlertSilencesModel(Base):
+    """SQLAlchemy model for alert silences, which stop matching alerts from being routed."""
+    
+    __tablename__ = "alert_silences"
+    
+    id = Column(String(12), primary_key=True)
+    alert_type = Column(String(100), nullable=False)
+    host = Column(String(255))  # None silences the alert type on every host
+    created_by = Column(String(255), nullable=False)
+    created_at = Column(DateTime(timezone=True), default=lambda: datetime.now(timezone.utc), nullable=False)
+    expires_at = Column(DateTime(timezone=True), nullable=False)
+    
+    __table_args__ = (
+        Index('idx_alert_silences_expires_at', 'expires_at'),
+    )
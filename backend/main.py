@@ -1,41 +1,73 @@
+import asyncio
 import json
 import logging
 import os
 import hmac
 import hashlib
+import ssl
 import time
-from datetime import datetime, timezone
+from datetime import datetime, timedelta, timezone
 from pathlib import Path
 from typing import Dict, Any, List, Optional
+from urllib.parse import parse_qs
 
 import uvicorn
-from fastapi import FastAPI, HTTPException, Request, Header, Depends, Query
-from fastapi.responses import JSONResponse
+from fastapi import FastAPI, HTTPException, Request, Header, Cookie, Depends, Query
+from fastapi.responses import JSONResponse, FileResponse, RedirectResponse
 from fastapi.middleware.cors import CORSMiddleware
 from fastapi.middleware.trustedhost import TrustedHostMiddleware
 from sqlalchemy.ext.asyncio import AsyncSession
 from sqlalchemy import select, desc, func, or_
 from sqlalchemy.orm import selectinload
 
-from models import Payload
-from services.alerts import should_send_email, get_alert_severity, format_alert_summary
+from pydantic import ValidationError
+
+from models import (
+    Payload, Heartbeat, EnrollmentTokenRequest, EnrollRequest, EnrollResponse, RuleEvaluationRequest, AgentCommandRequest,
+    GrafanaQueryRequest
+)
+from services.alerts import get_alert_severity, format_alert_summary
 from services.email import send_alert_email, format_alert_email_content
+from services.routing import AlertRouter
+from services.chatops import ChatOps, ChatOpsError, verify_slack_signature
+from services.fleet import check_silent_agents, record_heartbeat
+from services.locks import exclusive
+from services.detection import RuleSet, Finding, evaluate, record_findings, agent_scopes
+from services.tenants import (
+    tenants, oidc, get_principal, get_tenant, require_admin, require_role, tenant_allows, tenant_hosts, scope_query,
+    Principal, Tenant, Scope, APIKey
+)
+from services.oidc import SESSION_COOKIE, LOGIN_COOKIE, LOGIN_TIMEOUT_SECONDS, OIDCError
+from services.enrollment import (
+    EnrollmentError, ENROLLMENT_TOKEN_TTL_HOURS, create_enrollment_token, enroll, lookup_key, revoke_key
+)
+from services.agent_stream import AgentStreamServer
+from services.compression import DecompressionMiddleware
+from services.metrics_query import (
+    METRICS, AGGREGATIONS, DEFAULT_POINTS, QueryError, plan_query, parse_target, run_query, default_range
+)
 from services.rules import process_log_entry, get_alerts, add_alert
 from services.anomaly_detection import AnomalyDetectionService
 from rules_engine import analyze_request, get_stored_alerts
-from database import get_db_session, init_db, close_db
+from database import get_db_session, init_db, close_db, async_session_maker
+from storage import create_storage
+from storage.postgres import prune_received_payloads
+from storage.retention import RetentionPolicy
 from performance_config import perf_config
 from db_models import (
     MetricsModel, DockerEventsModel, ContainerLogsModel, 
-    AlertsModel, EmailNotificationsModel
+    AlertsModel, EmailNotificationsModel, AgentsModel
 )
 from routes import router as api_router
 from api.nlp_endpoints import nlp_router
 from api.analytics_endpoints import analytics_router
 
-# Create logs directory if it doesn't exist
+# Log files are written to logs/ unless LOG_FILES=false, e.g. for replicas
+# whose output is collected from the console
+LOG_FILES = os.environ.get("LOG_FILES", "true").lower() == "true"
 logs_dir = Path("logs")
-logs_dir.mkdir(exist_ok=True)
+if LOG_FILES:
+    logs_dir.mkdir(exist_ok=True)
 
 # Get secret from environment variable
 SECRET = os.environ.get("INGEST_SECRET", "")
@@ -50,7 +82,7 @@ logging.basicConfig(
     format="%(asctime)s - %(name)s - %(levelname)s - %(message)s",
     handlers=[
         logging.StreamHandler(),  # Console output
-        logging.FileHandler(logs_dir / "ingest.log", mode="a")  # File output
+        *([logging.FileHandler(logs_dir / "ingest.log", mode="a")] if LOG_FILES else [])  # File output
     ]
 )
 
@@ -59,11 +91,63 @@ logger = logging.getLogger("monitoring-backend")
 # Configure dedicated alerts logger for structured JSON logging
 alerts_logger = logging.getLogger("alerts")
 alerts_logger.setLevel(logging.INFO)
-alerts_handler = logging.FileHandler(logs_dir / "alerts.log", mode="a")
+alerts_handler = logging.FileHandler(logs_dir / "alerts.log", mode="a") if LOG_FILES else logging.StreamHandler()
 alerts_handler.setFormatter(logging.Formatter("%(message)s"))  # JSON only, no extra formatting
 alerts_logger.addHandler(alerts_handler)
 alerts_logger.propagate = False  # Don't propagate to root logger
 
+# Embedded web dashboard served at /ui
+DASHBOARD_PAGE = Path(__file__).parent / "dashboard" / "index.html"
+
+# Payload storage selected by STORAGE_BACKEND
+storage = create_storage()
+
+# Alert routing configured by ALERT_ROUTING_CONFIG, and how often grouped
+# repeats and escalations are checked
+alert_router = AlertRouter.from_environment()
+
+# Slack and Telegram commands, enabled by SLACK_SIGNING_SECRET and
+# TELEGRAM_WEBHOOK_SECRET
+chatops = ChatOps.from_environment(alert_router)
+ROUTING_TICK_SECONDS = 30
+
+# How often agents are checked for having gone silent; agents sending
+# heartbeats are noticed no sooner than this
+SILENCE_CHECK_SECONDS = int(os.environ.get("SILENCE_CHECK_SECONDS", "15"))
+
+# How long received payload IDs are kept to reject duplicates and replays.
+# Must exceed the 24 hour limit on request timestamps, or a captured request
+# could be replayed once its ID is forgotten.
+RECEIVED_PAYLOADS_RETENTION_HOURS = int(os.environ.get("RECEIVED_PAYLOADS_RETENTION_HOURS", "72"))
+
+# How long metrics, rollups, logs and events are kept, and how often
+# rollups and expiry run
+retention_policy = RetentionPolicy.from_environment()
+RETENTION_INTERVAL_SECONDS = 3600
+
+# Server-side detection rules from RULES_CONFIG, run every interval over the
+# data received in the lookback (which covers payloads delayed in agent queues)
+rule_set = RuleSet.from_environment()
+RULES_INTERVAL_SECONDS = 60
+RULES_LOOKBACK_MINUTES = int(os.environ.get("RULES_LOOKBACK_MINUTES", "15"))
+
+# gRPC port for agents streaming with --grpc-addr (0 disables), with TLS if
+# a certificate and key are set
+GRPC_PORT = int(os.environ.get("GRPC_PORT", "0"))
+GRPC_TLS_CERT = os.environ.get("GRPC_TLS_CERT")
+GRPC_TLS_KEY = os.environ.get("GRPC_TLS_KEY")
+# Streamed payloads processed at once before agents are asked to pause for
+# GRPC_THROTTLE_MS (0 for no limit)
+GRPC_MAX_INFLIGHT = int(os.environ.get("GRPC_MAX_INFLIGHT", "32"))
+GRPC_THROTTLE_MS = int(os.environ.get("GRPC_THROTTLE_MS", "5000"))
+
+# TLS for the HTTP API when run with python main.py; with a client CA, agents
+# (and every other client) must present a certificate it issued (mutual TLS),
+# which also applies to the gRPC stream
+TLS_CERT = os.environ.get("TLS_CERT")
+TLS_KEY = os.environ.get("TLS_KEY")
+TLS_CLIENT_CA = os.environ.get("TLS_CLIENT_CA")
+
 # Create FastAPI app
 app = FastAPI(
     title="Monitoring Backend API",
@@ -80,6 +164,10 @@ app.add_middleware(
     allowed_hosts=["*"]  # Configure with specific hosts in production
 )
 
+# Decode gzip and zstd bodies from agents started with --compression before
+# routes verify their signatures
+app.add_middleware(DecompressionMiddleware)
+
 # Add CORS middleware for frontend integration
 app.add_middleware(
     CORSMiddleware,
@@ -91,8 +179,9 @@ app.add_middleware(
 
 # Include API routes
 app.include_router(api_router)
-app.include_router(nlp_router)
-app.include_router(analytics_router)
+# Fleet-wide analytics are limited to admin tenants
+app.include_router(nlp_router, dependencies=[Depends(require_admin)])
+app.include_router(analytics_router, dependencies=[Depends(require_admin)])
 
 
 @app.exception_handler(Exception)
@@ -113,20 +202,127 @@ async def global_exception_handler(request: Request, exc: Exception):
 async def startup_event():
     """Initialize database on application startup."""
     logger.info("Initializing database...")
-    await init_db()
+    # Replicas starting together migrate one after the other
+    async with exclusive("migrate", wait=True):
+        await init_db()
+        await storage.migrate()
     logger.info("Database initialized successfully")
+    asyncio.create_task(notification_loop())
+    asyncio.create_task(silence_loop())
+    asyncio.create_task(retention_loop())
+    asyncio.create_task(rules_loop())
+    if GRPC_PORT:
+        await agent_stream.start(GRPC_PORT, GRPC_TLS_CERT, GRPC_TLS_KEY, TLS_CLIENT_CA)
+
+
+async def notification_loop():
+    """Send grouped alert summaries and escalations as they come due."""
+    while True:
+        await asyncio.sleep(ROUTING_TICK_SECONDS)
+        try:
+            async with exclusive("notifications") as held:
+                if held:
+                    await alert_router.dispatch(await alert_router.tick())
+        except Exception as e:
+            logger.error(f"Alert routing tick failed: {str(e)}")
+
+
+async def silence_loop():
+    """Raise AGENT_SILENT alerts for agents that stopped reporting."""
+    while True:
+        await asyncio.sleep(SILENCE_CHECK_SECONDS)
+        try:
+            async with exclusive("silence") as held:
+                if not held:
+                    continue
+                for agent in await check_silent_agents():
+                    notifications = await alert_router.route(
+                        host=agent.host,
+                        alerts=["AGENT_SILENT"],
+                        env=agent.env,
+                        owner_team=agent.owner_team,
+                        score=float(agent.last_score or 0)
+                    )
+                    await alert_router.dispatch(notifications)
+        except Exception as e:
+            logger.error(f"Agent silence check failed: {str(e)}")
+
+
+async def retention_loop():
+    """Roll up metrics and expire data and received payload IDs past their retention."""
+    while True:
+        try:
+            async with exclusive("retention") as held:
+                if held:
+                    await run_retention()
+        except Exception as e:
+            logger.error(f"Retention lock failed: {str(e)}")
+        await asyncio.sleep(RETENTION_INTERVAL_SECONDS)
+
+
+async def run_retention():
+    """Prune received payload IDs and compact storage once."""
+    try:
+        before = datetime.now(timezone.utc) - timedelta(hours=RECEIVED_PAYLOADS_RETENTION_HOURS)
+        removed = await prune_received_payloads(before)
+        if removed:
+            logger.info(f"Pruned {removed} received payload IDs older than {RECEIVED_PAYLOADS_RETENTION_HOURS}h")
+    except Exception as e:
+        logger.error(f"Pruning received payload IDs failed: {str(e)}")
+    try:
+        started = time.monotonic()
+        counts = await storage.compact(retention_policy)
+        if any(counts.values()):
+            summary = ", ".join(f"{table}: {n}" for table, n in counts.items())
+            logger.info(f"Retention compaction finished in {time.monotonic() - started:.1f}s ({summary})")
+    except Exception as e:
+        logger.error(f"Retention compaction failed: {str(e)}")
+
+
+async def route_findings(findings: List[Finding]) -> None:
+    """Route alerts raised by server-side rules like the agents' own."""
+    agents = await agent_scopes(f.host for f in findings)
+    for finding in findings:
+        agent = agents.get(finding.host)
+        notifications = await alert_router.route(
+            host=finding.host,
+            alerts=[finding.alert],
+            env=agent.env if agent else None,
+            owner_team=agent.owner_team if agent else None,
+            score=float(agent.last_score or 0) if agent else 0.0
+        )
+        await alert_router.dispatch(notifications)
+
+
+async def rules_loop():
+    """Run the server-side detection rules over recently received data."""
+    while True:
+        await asyncio.sleep(RULES_INTERVAL_SECONDS)
+        if rule_set is None:
+            continue
+        try:
+            async with exclusive("rules") as held:
+                if not held:
+                    continue
+                end = datetime.now(timezone.utc)
+                findings = await evaluate(rule_set, storage, end - timedelta(minutes=RULES_LOOKBACK_MINUTES), end)
+                await route_findings(await record_findings(findings))
+        except Exception as e:
+            logger.error(f"Server-side rule evaluation failed: {str(e)}")
 
 
 @app.on_event("shutdown")
 async def shutdown_event():
     """Clean up database connections on application shutdown."""
+    await agent_stream.stop()
     logger.info("Closing database connections...")
+    await storage.close()
     await close_db()
     logger.info("Database connections closed")
 
 
 # Fixed: HMAC signature and timestamp verification function
-def verify_hmac_signature(signature: str, timestamp: str, body: bytes) -> None:
+def verify_hmac_signature(signature: str, timestamp: str, body: bytes, secret: str) -> None:
     """
     Verify HMAC signature and timestamp for request authentication.
     
@@ -134,11 +330,12 @@ def verify_hmac_signature(signature: str, timestamp: str, body: bytes) -> None:
         signature: The X-Agent-Signature header value
         timestamp: The X-Agent-Timestamp header value  
         body: Raw request body bytes
+        secret: INGEST_SECRET, or the secret of the agent's API key
         
     Raises:
         HTTPException: If timestamp is stale or signature is invalid
     """
-    if not SECRET:
+    if not secret:
         raise HTTPException(status_code=500, detail="Server configuration error")
     
     # Check if timestamp validation is enabled (can be disabled for production environments with clock sync issues)
@@ -175,7 +372,7 @@ def verify_hmac_signature(signature: str, timestamp: str, body: bytes) -> None:
     
     # Compute expected HMAC signature
     message = f"{timestamp}.{body.decode()}".encode()
-    expected_signature = hmac.new(SECRET.encode(), message, hashlib.sha256).hexdigest()
+    expected_signature = hmac.new(secret.encode(), message, hashlib.sha256).hexdigest()
     
     # Remove 'sha256=' prefix if present and compare
     provided_signature = signature.replace("sha256=", "")
@@ -183,16 +380,53 @@ def verify_hmac_signature(signature: str, timestamp: str, body: bytes) -> None:
         raise HTTPException(status_code=401, detail="Invalid signature")
 
 
+async def resolve_api_key(key_id: Optional[str]) -> Optional[APIKey]:
+    """
+    Find the API key an agent signs with, configured or issued at enrollment.
+    
+    Returns:
+        The key, or None for agents signing with INGEST_SECRET
+        
+    Raises:
+        HTTPException: If the key ID is unknown or revoked
+    """
+    if key_id is None:
+        return None
+    api_key = tenants.keys.get(key_id) or await lookup_key(key_id)
+    if api_key is None:
+        raise HTTPException(status_code=401, detail="Unknown API key")
+    return api_key
+
+
+def sign_ack(payload_id: str, status: str, secret: str) -> Dict[str, str]:
+    """
+    Build the receipt an agent waits for before dropping a queued payload,
+    signed with the secret the payload was signed with.
+    
+    Args:
+        payload_id: ID of the received payload
+        status: "stored", or "duplicate" if it had been stored before
+        secret: The agent's HMAC secret
+        
+    Returns:
+        The ack, with an HMAC-SHA256 signature over "ack.<payload_id>.<status>"
+    """
+    signature = hmac.new(secret.encode(), f"ack.{payload_id}.{status}".encode(), hashlib.sha256).hexdigest()
+    return {"payload_id": payload_id, "status": status, "signature": f"sha256={signature}"}
+
+
 @app.post("/ingest")
 async def ingest_monitoring_data(
     request: Request,
     payload: Payload,
     db: AsyncSession = Depends(get_db_session),
     x_agent_signature: str = Header(..., alias="X-Agent-Signature"),
-    x_agent_timestamp: str = Header(..., alias="X-Agent-Timestamp")
-) -> Dict[str, str]:
+    x_agent_timestamp: str = Header(..., alias="X-Agent-Timestamp"),
+    x_agent_payload_id: Optional[str] = Header(None, alias="X-Agent-Payload-Id"),
+    x_agent_key_id: Optional[str] = Header(None, alias="X-Agent-Key-Id")
+) -> Dict[str, Any]:
     """
-    Receive monitoring data from Go agent, persist to database, and log it.
+    Receive monitoring data from Go agent, persist to storage, and log it.
     
     Args:
         payload: The monitoring payload from the Go agent
@@ -201,56 +435,143 @@ async def ingest_monitoring_data(
     Returns:
         Success message with timestamp
     """
+    raw_body = await request.body()
+    client_ip = request.client.host if request.client else "unknown"
+    return await process_payload(payload, raw_body, x_agent_signature, x_agent_timestamp,
+                                 x_agent_payload_id, x_agent_key_id, client_ip, db)
+
+
+@app.post("/ingest/batch")
+async def ingest_monitoring_batch(
+    request: Request,
+    db: AsyncSession = Depends(get_db_session),
+    x_agent_signature: str = Header(..., alias="X-Agent-Signature"),
+    x_agent_timestamp: str = Header(..., alias="X-Agent-Timestamp"),
+    x_agent_key_id: Optional[str] = Header(None, alias="X-Agent-Key-Id")
+) -> Dict[str, Any]:
+    """
+    Receive the payloads of several intervals from an agent with --batch-size,
+    one per line (NDJSON) and signed as a whole.
+
+    Each payload is processed like a POST to /ingest; one that is rejected
+    does not fail the others. Payloads in a batch must carry a payload_id,
+    which the per-payload acks and deduplication rely on.
+
+    Returns:
+        Status, an ack or rejection for each payload in order, and timestamp
+    """
+    raw_body = await request.body()
+    client_ip = request.client.host if request.client else "unknown"
+
+    # Check the batch as a whole first, so nothing in a forged batch is parsed
+    api_key = await resolve_api_key(x_agent_key_id)
+    verify_hmac_signature(x_agent_signature, x_agent_timestamp, raw_body, api_key.secret if api_key else SECRET)
+
+    acks: List[Dict[str, str]] = []
+    for line in raw_body.splitlines():
+        if not line.strip():
+            continue
+        try:
+            payload = Payload.model_validate_json(line)
+            if not payload.payload_id:
+                raise HTTPException(status_code=400, detail="Batched payloads must have a payload_id")
+            response = await process_payload(payload, raw_body, x_agent_signature, x_agent_timestamp,
+                                             payload.payload_id, x_agent_key_id, client_ip, db)
+            acks.append(response["ack"])
+        except HTTPException as e:
+            payload_id = payload.payload_id or ""
+            logger.warning(f"Rejected batched payload {payload_id} from {client_ip}: {e.detail}")
+            acks.append({"payload_id": payload_id, "status": "rejected", "error": str(e.detail)})
+        except ValidationError as e:
+            acks.append({"payload_id": "", "status": "rejected", "error": f"Invalid payload: {e}"})
+
+    logger.info(f"Processed batch of {len(acks)} payloads from {client_ip}")
+    return {
+        "status": "success",
+        "acks": acks,
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+async def process_payload(
+    payload: Payload,
+    raw_body: bytes,
+    signature: str,
+    timestamp: str,
+    payload_id: Optional[str],
+    key_id: Optional[str],
+    client_ip: str,
+    db: AsyncSession
+) -> Dict[str, Any]:
+    """
+    Authenticate, store and analyze a payload received over HTTP or the gRPC
+    stream.
+    
+    Payloads are deduplicated by payload_id, or by request signature for
+    agents too old to send one: an agent retrying a payload that already
+    landed, or anyone replaying a captured request, gets a "duplicate" success
+    response and nothing is stored or alerted twice.
+    
+    Both responses carry a signed ack, sent only once the payload is stored;
+    agents keep a payload queued until they receive one.
+    
+    Args:
+        payload: The parsed payload
+        raw_body: The payload as signed
+        signature: The X-Agent-Signature value
+        timestamp: The X-Agent-Timestamp value
+        payload_id: The X-Agent-Payload-Id value, if sent
+        key_id: The X-Agent-Key-Id value, if sent
+        client_ip: Address of the agent
+        db: Database session
+        
+    Returns:
+        Success message with timestamp and ack
+        
+    Raises:
+        HTTPException: If the payload is rejected or can't be processed
+    """
     try:
+        # Agents with an API key, configured or issued at enrollment, sign
+        # with its secret and may only submit within its scope; others sign
+        # with the shared INGEST_SECRET
+        api_key = await resolve_api_key(key_id)
+        
         # Verify HMAC signature and timestamp before processing
-        raw_body = await request.body()
-        verify_hmac_signature(x_agent_signature, x_agent_timestamp, raw_body)
+        secret = api_key.secret if api_key else SECRET
+        verify_hmac_signature(signature, timestamp, raw_body, secret)
+        if api_key and not api_key.allows(payload.env, payload.owner_team, payload.server_id):
+            logger.warning(f"API key {api_key.id} may not submit env={payload.env} owner_team={payload.owner_team} server_id={payload.server_id}")
+            raise HTTPException(status_code=403, detail=f"API key {api_key.id} may not submit for this env, owner team or server ID")
+        if payload_id is not None and payload_id != payload.payload_id:
+            raise HTTPException(status_code=400, detail="X-Agent-Payload-Id does not match payload_id")
+        
+        # Persist metrics, docker events and container logs, once per payload
+        # ID; the verified signature is unique per request, so it stands in
+        # for the ID of agents that don't send one
+        dedupe_id = payload.payload_id or signature.replace("sha256=", "")
+        if not await storage.store_payload(payload, dedupe_id):
+            logger.info(f"Duplicate or replayed payload {dedupe_id} from {payload.host} ignored")
+            return {
+                "status": "duplicate",
+                "message": f"Payload {dedupe_id} already received",
+                "ack": sign_ack(dedupe_id, "duplicate", secret),
+                "timestamp": datetime.now(timezone.utc).isoformat()
+            }
         
         # Convert payload to dict for logging
         payload_dict = payload.model_dump()
-        
-        # Persist system metrics to database
-        metrics_record = MetricsModel(
-            timestamp=payload.timestamp,
-            cpu_usage=payload.metrics.cpu_usage,
-            memory_usage=payload.metrics.memory_usage,
-            disk_usage=payload.metrics.disk_usage,
-            network_rx=payload.metrics.network_rx_bytes_per_sec,
-            network_tx=payload.metrics.network_tx_bytes_per_sec,
-            tcp_connections=payload.metrics.tcp_connections
-        )
-        db.add(metrics_record)
-        
-        # Persist docker events to database
-        for event in payload.docker_events:
-            docker_event_record = DockerEventsModel(
-                timestamp=event.timestamp,
-                type=event.type,
-                action=event.action,
-                container=event.container,
-                image=event.image
-            )
-            db.add(docker_event_record)
-        
-        # Persist container logs to database
-        for log_entry in payload.logs:
-            container_log_record = ContainerLogsModel(
-                container=log_entry.container,
-                timestamp=log_entry.timestamp,
-                message=log_entry.message
-            )
-            db.add(container_log_record)
-        
-        # Commit database changes
-        await db.commit()
 
         # Run anomaly detection on the newly stored metrics
         anomaly_service = AnomalyDetectionService()
         detected_anomalies = []
         try:
-            # Detect metric spikes (CPU, memory, disk, TCP connections)
-            metric_anomalies = await anomaly_service.detect_metric_spikes(db, lookback_hours=1)
-            detected_anomalies.extend(metric_anomalies)
+            # Detect metric spikes (CPU, memory, disk, TCP connections); a
+            # backfill payload's metrics are from an outage, not the host's
+            # current status
+            if not payload.backfill:
+                metric_anomalies = await anomaly_service.detect_metric_spikes(db, lookback_hours=1)
+                detected_anomalies.extend(metric_anomalies)
             
             # Log detected anomalies
             if detected_anomalies:
@@ -317,11 +638,12 @@ RichardOps Monitoring System
         print("\n" + "="*80)
         print(f"📊 MONITORING DATA RECEIVED - {datetime.now(timezone.utc).isoformat()}")
         print("="*80)
+        print(f"🆔 Payload ID: {payload.payload_id or 'N/A'}")
         print(f"🖥️  Host: {payload.host}")
         print(f"🆔 Server ID: {payload.server_id or 'N/A'}")
         print(f"🌍 Environment: {payload.env or 'N/A'}")
         print(f"👥 Owner Team: {payload.owner_team or 'N/A'}")
-        print(f"⏰ Timestamp: {payload.timestamp}")
+        print(f"⏰ Timestamp: {payload.timestamp}{' (backfill)' if payload.backfill else ''}")
         print(f"📈 Score: {payload.score}")
         
         # System Metrics
@@ -396,7 +718,7 @@ RichardOps Monitoring System
                     "network_tx_bytes_per_sec": payload.metrics.network_tx_bytes_per_sec,
                     "tcp_connections": payload.metrics.tcp_connections
                 } if payload.metrics else {},
-                "ip": request.client.host if hasattr(request, 'client') and request.client else "unknown"
+                "ip": client_ip
             }
             
             # Analyze the event for attacks
@@ -498,33 +820,23 @@ RichardOps Monitoring System
             except Exception as e:
                 logger.error(f"Failed to send HIGH severity alert email: {str(e)}")
         
-        # Check if email alert should be sent
-        if should_send_email(payload.local_alerts):
-            try:
-                # Get recipient email from environment variable
-                alert_email = os.environ.get("ALERT_EMAIL")
-                if alert_email:
-                    # Build email content
-                    subject = f"🚨 Server {payload.host} Alert"
-                    content = format_alert_email_content(
-                        host=payload.host,
-                        server_id=payload.server_id,
-                        env=payload.env,
-                        alerts=payload.local_alerts,
-                        score=payload.score
-                    )
-                    
-                    # Send the alert email
-                    send_alert_email(subject, content, alert_email)
-                    logger.info(f"Alert email sent to {alert_email} for {payload.host}")
-                else:
-                    logger.warning("ALERT_EMAIL environment variable not set, skipping email notification")
-            except Exception as e:
-                logger.error(f"Failed to send alert email: {str(e)}")
+        # Route agent alerts to the owning team's notification channels
+        try:
+            notifications = await alert_router.route(
+                host=payload.host,
+                alerts=payload.local_alerts,
+                env=payload.env,
+                owner_team=payload.owner_team,
+                score=payload.score
+            )
+            await alert_router.dispatch(notifications)
+        except Exception as e:
+            logger.error(f"Failed to route alerts: {str(e)}")
         
         return {
             "status": "success",
             "message": f"Monitoring data received from {payload.host}",
+            "ack": sign_ack(dedupe_id, "stored", secret),
             "timestamp": datetime.now(timezone.utc).isoformat()
         }
         
@@ -536,7 +848,232 @@ RichardOps Monitoring System
         raise HTTPException(status_code=500, detail=f"Error processing monitoring data: {str(e)}")
 
 
-@app.get("/alerts")
+@app.post("/heartbeat")
+async def receive_heartbeat(
+    request: Request,
+    heartbeat: Heartbeat,
+    x_agent_signature: str = Header(..., alias="X-Agent-Signature"),
+    x_agent_timestamp: str = Header(..., alias="X-Agent-Timestamp"),
+    x_agent_key_id: Optional[str] = Header(None, alias="X-Agent-Key-Id")
+) -> Dict[str, Any]:
+    """
+    Receive an agent heartbeat, signed like a payload, and note that the
+    agent is alive. Heartbeats are not stored or deduplicated; a replayed one
+    at most delays an AGENT_SILENT alert within the timestamp tolerance.
+    
+    Args:
+        heartbeat: Host, timestamp, score and heartbeat interval
+        
+    Returns:
+        Status and timestamp
+    """
+    api_key = await resolve_api_key(x_agent_key_id)
+    secret = api_key.secret if api_key else SECRET
+    verify_hmac_signature(x_agent_signature, x_agent_timestamp, await request.body(), secret)
+    if api_key and not api_key.allows(heartbeat.env, heartbeat.owner_team, heartbeat.server_id):
+        raise HTTPException(status_code=403, detail=f"API key {api_key.id} may not submit for this env, owner team or server ID")
+    
+    try:
+        await record_heartbeat(heartbeat)
+    except Exception as e:
+        logger.error(f"Failed to record heartbeat from {heartbeat.host}: {str(e)}")
+        raise HTTPException(status_code=500, detail="Failed to record heartbeat")
+    return {"status": "ok", "timestamp": datetime.now(timezone.utc).isoformat()}
+
+
+async def ingest_stream_frame(frame: Dict[str, Any], peer: str) -> Dict[str, str]:
+    """
+    Process a payload streamed over gRPC like a POST to /ingest.
+    
+    Returns:
+        The PayloadAck: the same signed ack, or "rejected" with the reason
+    """
+    payload_id = frame["payload_id"] or None
+    try:
+        payload = Payload.model_validate_json(frame["body"])
+        async with async_session_maker() as db:
+            response = await process_payload(payload, frame["body"], frame["signature"], frame["timestamp"],
+                                             payload_id, frame["key_id"] or None, peer, db)
+        return response["ack"]
+    except HTTPException as e:
+        logger.warning(f"Rejected streamed payload {payload_id} from {peer}: {e.detail}")
+        return {"payload_id": frame["payload_id"], "status": "rejected", "error": str(e.detail)}
+    except ValidationError as e:
+        return {"payload_id": frame["payload_id"], "status": "rejected", "error": f"Invalid payload: {e}"}
+
+
+async def authenticate_stream(key_id: Optional[str], server_id: str, timestamp: str, signature: str) -> str:
+    """
+    Check a command subscription, signed over "<timestamp>.commands.<server_id>".
+    
+    Returns:
+        The secret the agent signs with, which its commands are signed with
+        
+    Raises:
+        HTTPException: If the key or signature is invalid or the key may not
+            act for server_id
+    """
+    api_key = await resolve_api_key(key_id)
+    secret = api_key.secret if api_key else SECRET
+    verify_hmac_signature(signature, timestamp, f"commands.{server_id}".encode(), secret)
+    if api_key and not all(Scope(server_ids=scope.server_ids).allows(None, None, server_id)
+                           for scope in (api_key.tenant.scope, api_key.scope)):
+        raise HTTPException(status_code=403, detail=f"API key {api_key.id} may not act for server ID {server_id}")
+    return secret
+
+
+# Streaming transport for agents with --grpc-addr, served on GRPC_PORT
+agent_stream = AgentStreamServer(ingest_stream_frame, authenticate_stream, GRPC_MAX_INFLIGHT, GRPC_THROTTLE_MS)
+
+
+@app.post("/agents/{server_id}/commands", dependencies=[Depends(require_admin), Depends(require_role("operator"))])
+async def push_agent_command(server_id: str, request: AgentCommandRequest) -> Dict[str, Any]:
+    """
+    Push a remote command to an agent connected over the gRPC stream and
+    wait for its result.
+    
+    Args:
+        server_id: The agent's server ID
+        request: The command and how long to wait for its result
+        
+    Returns:
+        The command ID, and its status and output once the agent answered
+        ("pending" if it didn't in time)
+    """
+    try:
+        command_id = agent_stream.push(server_id, request.command, request.settings)
+    except ValueError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    except KeyError:
+        raise HTTPException(status_code=404, detail=f"Agent {server_id} is not connected over gRPC")
+    
+    result = await agent_stream.wait(command_id, request.wait_seconds)
+    return {
+        "command_id": command_id,
+        "server_id": server_id,
+        "command": request.command,
+        "status": result["status"] if result else "pending",
+        "output": result["output"] if result else None,
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+async def query_hosts(tenant: Optional[Tenant], requested: List[str]) -> Optional[List[str]]:
+    """The requested hosts the tenant may see; all of its hosts if none were requested."""
+    allowed = await tenant_hosts(tenant)
+    if not requested:
+        return allowed
+    return requested if allowed is None else [host for host in requested if host in allowed]
+
+
+@app.get("/metrics/query")
+async def query_metrics(
+    metric: str = Query(..., description=f"One of {', '.join(METRICS)}"),
+    agg: str = Query(default="avg", description=f"One of {', '.join(AGGREGATIONS)}"),
+    start: Optional[datetime] = Query(default=None, description="Start of the range, default an hour before end"),
+    end: Optional[datetime] = Query(default=None, description="End of the range, default now"),
+    step: Optional[int] = Query(default=None, description="Bucket width in seconds, default about 500 points"),
+    host: List[str] = Query(default=[], description="Only these hosts; repeat for several"),
+    tenant: Optional[Tenant] = Depends(get_tenant)
+) -> Dict[str, Any]:
+    """
+    Aggregate a metric per host over a time range. Steps of whole hours are
+    read from the hourly rollups, so they reach back further than raw metrics.
+    
+    Returns:
+        The metric, aggregation, step and source, and one series per host
+        with its points as [timestamp, value]
+    """
+    default_start, default_end = default_range(end)
+    try:
+        query = plan_query(metric, agg, start or default_start, end or default_end, step)
+    except QueryError as e:
+        raise HTTPException(status_code=400, detail=str(e))
+    
+    series = await run_query(storage, query, await query_hosts(tenant, host))
+    return {
+        "metric": query.metric,
+        "aggregation": query.aggregation,
+        "start": query.start.isoformat(),
+        "end": query.end.isoformat(),
+        "step": query.step,
+        "source": "rollups" if query.uses_rollups else "raw",
+        "series": [
+            {"host": s["host"], "points": [[bucket.isoformat(), value] for bucket, value in s["points"]]}
+            for s in series
+        ]
+    }
+
+
+# Grafana JSON datasource (simple-json / Infinity "JSON API" style): point a
+# datasource at <server>/grafana, with the bearer token as a header for tenants
+
+@app.get("/grafana/")
+async def grafana_test(tenant: Optional[Tenant] = Depends(get_tenant)) -> Dict[str, str]:
+    """Connection test of the Grafana datasource."""
+    return {"status": "ok"}
+
+
+@app.post("/grafana/search")
+async def grafana_search(tenant: Optional[Tenant] = Depends(get_tenant)) -> List[str]:
+    """List the queryable targets, "metric.aggregation"."""
+    return [f"{metric}.{aggregation}" for metric in METRICS for aggregation in AGGREGATIONS]
+
+
+@app.post("/grafana/query")
+async def grafana_query(request: GrafanaQueryRequest, tenant: Optional[Tenant] = Depends(get_tenant)) -> List[Dict[str, Any]]:
+    """
+    Answer a Grafana panel's targets as time series, one per host. Ad hoc
+    filters and target payloads of the form host=<name> select hosts.
+    
+    Returns:
+        Series of {"target": "<host> <target>", "datapoints": [[value, epoch ms]]}
+    """
+    filtered = [f.value for f in request.adhocFilters if f.key == "host" and f.operator == "="]
+    # Grafana's interval can be finer than agents report; the step is then picked
+    step = request.intervalMs // 1000 if request.intervalMs and request.intervalMs >= 60000 else None
+    
+    response = []
+    for target in request.targets:
+        if not target.target:
+            continue
+        metric, aggregation = parse_target(target.target)
+        requested = filtered + ([target.payload["host"]] if target.payload and target.payload.get("host") else [])
+        try:
+            query = plan_query(metric, aggregation, request.range.start, request.range.end,
+                               step, request.maxDataPoints or DEFAULT_POINTS)
+        except QueryError as e:
+            raise HTTPException(status_code=400, detail=str(e))
+        
+        for s in await run_query(storage, query, await query_hosts(tenant, requested)):
+            response.append({
+                "target": f"{s['host']} {target.target}" if s["host"] else target.target,
+                "datapoints": [[value, int(bucket.timestamp() * 1000)] for bucket, value in s["points"]]
+            })
+    return response
+
+
+@app.post("/grafana/tag-keys")
+async def grafana_tag_keys(tenant: Optional[Tenant] = Depends(get_tenant)) -> List[Dict[str, str]]:
+    """Keys for Grafana ad hoc filters."""
+    return [{"type": "string", "text": "host"}]
+
+
+@app.post("/grafana/tag-values")
+async def grafana_tag_values(
+    request: Dict[str, Any],
+    tenant: Optional[Tenant] = Depends(get_tenant),
+    db: AsyncSession = Depends(get_db_session)
+) -> List[Dict[str, str]]:
+    """Values of an ad hoc filter key: the hosts in the agent inventory."""
+    if request.get("key") != "host":
+        return []
+    query = scope_query(select(AgentsModel.host).distinct(), AgentsModel, tenant).order_by(AgentsModel.host)
+    result = await db.execute(query)
+    return [{"text": host} for host in result.scalars() if host]
+
+
+@app.get("/alerts", dependencies=[Depends(require_admin)])
 async def get_current_alerts(db: AsyncSession = Depends(get_db_session)) -> Dict[str, Any]:
     """
     Get current alerts from both the rules engine, attack detection system, and database.
@@ -630,6 +1167,396 @@ async def get_current_alerts(db: AsyncSession = Depends(get_db_session)) -> Dict
         raise HTTPException(status_code=500, detail=f"Error retrieving alerts: {str(e)}")
 
 
+@app.get("/alerts/groups")
+async def get_alert_groups(tenant: Optional[Tenant] = Depends(get_tenant)) -> Dict[str, Any]:
+    """
+    Get open alert groups from the alert router.
+    
+    Returns:
+        JSON response with grouped agent alerts and their escalation state
+    """
+    groups = [g for g in await alert_router.list_groups() if tenant_allows(tenant, g["env"], g["owner_team"])]
+    return {
+        "status": "success",
+        "count": len(groups),
+        "groups": groups,
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+@app.post("/alerts/groups/{group_id}/ack", dependencies=[Depends(require_role("operator"))])
+async def acknowledge_alert_group(group_id: str, tenant: Optional[Tenant] = Depends(get_tenant)) -> Dict[str, Any]:
+    """
+    Acknowledge an alert group so it stops escalating.
+    
+    Args:
+        group_id: ID of the alert group
+        
+    Returns:
+        JSON response confirming the acknowledgement
+    """
+    visible = any(g["id"] == group_id and tenant_allows(tenant, g["env"], g["owner_team"])
+                  for g in await alert_router.list_groups())
+    if not visible or not await alert_router.acknowledge(group_id):
+        raise HTTPException(status_code=404, detail=f"Alert group {group_id} not found")
+    return {
+        "status": "success",
+        "message": f"Alert group {group_id} acknowledged",
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+async def enrollment_admin(
+    authorization: Optional[str] = Header(None),
+    session: Optional[str] = Cookie(None, alias=SESSION_COOKIE)
+) -> Optional[Tenant]:
+    """
+    FastAPI dependency for managing enrollment: a tenant's query token or an
+    OIDC admin, or without tenants a bearer INGEST_SECRET, since the query
+    API may be open then.
+    """
+    scheme, _, token = (authorization or "").partition(" ")
+    if not tenants.enabled and SECRET and scheme.lower() == "bearer" and hmac.compare_digest(token, SECRET):
+        return None
+    if not tenants.enabled and not oidc.enabled:
+        raise HTTPException(status_code=401, detail="Bearer INGEST_SECRET required",
+                            headers={"WWW-Authenticate": "Bearer"})
+    principal = await require_role("admin")(await get_principal(authorization, session))
+    return principal.tenant
+
+
+@app.post("/enrollment-tokens")
+async def create_agent_enrollment_token(
+    request: EnrollmentTokenRequest,
+    tenant: Optional[Tenant] = Depends(enrollment_admin)
+) -> Dict[str, Any]:
+    """
+    Create a one-time token a new agent exchanges for its own credentials.
+    
+    Args:
+        request: Tenant (admins only), env and owner team the agent is
+            limited to, and hours until the token expires
+        
+    Returns:
+        JSON response with the token, which is shown only once
+    """
+    name = None
+    if tenant is not None:
+        name = request.tenant or tenant.name
+        if name != tenant.name and not tenant.admin:
+            raise HTTPException(status_code=403, detail=f"Tenant {tenant.name} may only enroll its own agents")
+        target = tenants.by_name(name)
+        if target is None:
+            raise HTTPException(status_code=404, detail=f"Tenant {name} not found")
+        scope = target.scope
+        if (request.env and scope.envs and request.env not in scope.envs) or \
+                (request.owner_team and scope.owner_teams and request.owner_team not in scope.owner_teams):
+            raise HTTPException(status_code=403, detail=f"Tenant {name} does not own this env or owner team")
+    ttl_hours = request.ttl_hours or ENROLLMENT_TOKEN_TTL_HOURS
+    if not 0 < ttl_hours <= 720:
+        raise HTTPException(status_code=400, detail="ttl_hours must be between 1 and 720")
+    
+    token, expires_at = await create_enrollment_token(name, request.env, request.owner_team, ttl_hours)
+    logger.info(f"Enrollment token created for tenant={name} env={request.env} owner_team={request.owner_team}, expires {expires_at.isoformat()}")
+    return {
+        "status": "success",
+        "token": token,
+        "tenant": name,
+        "env": request.env,
+        "owner_team": request.owner_team,
+        "expires_at": expires_at.isoformat(),
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+@app.post("/enroll", response_model=EnrollResponse)
+async def enroll_agent(request: EnrollRequest) -> EnrollResponse:
+    """
+    Exchange a one-time enrollment token for an agent's own API key and
+    canonical server_id.
+    
+    Args:
+        request: The token and the agent's host, machine ID, version, env
+            and owner team
+        
+    Returns:
+        The key ID, secret and server ID the agent signs and reports with
+        
+    Raises:
+        HTTPException: 401 if the token is invalid, expired, used or doesn't
+            fit the agent, or a re-enrolling agent's signature is invalid
+    """
+    def proves(secret: str) -> bool:
+        try:
+            verify_hmac_signature(request.signature or "", request.timestamp or "", f"enroll.{request.token}".encode(), secret)
+        except HTTPException:
+            return False
+        return True
+
+    try:
+        credentials = await enroll(request.token, request.host, request.machine_id, request.agent_version,
+                                   request.env, request.owner_team, request.key_id, proves)
+    except EnrollmentError as e:
+        logger.warning(f"Enrollment of {request.host} rejected: {str(e)}")
+        raise HTTPException(status_code=401, detail=str(e))
+    return EnrollResponse(key_id=credentials.key_id, secret=credentials.secret, server_id=credentials.server_id)
+
+
+@app.post("/agent-keys/{key_id}/revoke")
+async def revoke_agent_key(key_id: str, tenant: Optional[Tenant] = Depends(enrollment_admin)) -> Dict[str, Any]:
+    """
+    Revoke an enrolled agent's API key; its payloads are rejected from then on.
+    
+    Args:
+        key_id: ID of the key issued at enrollment
+        
+    Returns:
+        JSON response confirming the revocation
+    """
+    owner = tenant.name if tenant is not None and not tenant.admin else None
+    if not await revoke_key(key_id, owner):
+        raise HTTPException(status_code=404, detail=f"Agent key {key_id} not found")
+    return {
+        "status": "success",
+        "message": f"Agent key {key_id} revoked",
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+@app.get("/rules", dependencies=[Depends(require_admin)])
+async def get_rules() -> Dict[str, Any]:
+    """
+    Get the server-side detection rules in effect.
+    
+    Returns:
+        JSON response with the thresholds and masking rule names, or
+        enabled false without RULES_CONFIG
+    """
+    return {
+        "status": "success",
+        "enabled": rule_set is not None,
+        "rules": rule_set.describe() if rule_set else None,
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+@app.post("/rules/reload", dependencies=[Depends(require_admin), Depends(require_role("admin"))])
+async def reload_rules() -> Dict[str, Any]:
+    """
+    Re-read RULES_CONFIG, so tuned rules apply without a restart.
+    
+    Returns:
+        JSON response with the rules now in effect
+        
+    Raises:
+        HTTPException: 400 if the file can't be loaded; the previous rules stay in effect
+    """
+    global rule_set
+    try:
+        rule_set = RuleSet.from_environment()
+    except Exception as e:
+        raise HTTPException(status_code=400, detail=f"Failed to load RULES_CONFIG: {str(e)}")
+    return await get_rules()
+
+
+@app.post("/rules/evaluate", dependencies=[Depends(require_admin), Depends(require_role("operator"))])
+async def evaluate_rules(request: RuleEvaluationRequest) -> Dict[str, Any]:
+    """
+    Run the server-side rules over data already received, e.g. after adding
+    or tuning a rule.
+    
+    Args:
+        request: Time range, whether to store the findings (dry_run) and
+            whether to route them to notification channels (notify)
+        
+    Returns:
+        JSON response with the findings, and how many of them are new
+    """
+    if rule_set is None:
+        raise HTTPException(status_code=409, detail="Server-side rules are disabled (set RULES_CONFIG)")
+    # Timestamps without a zone are taken as UTC
+    start = request.start if request.start.tzinfo else request.start.replace(tzinfo=timezone.utc)
+    end = request.end or datetime.now(timezone.utc)
+    end = end if end.tzinfo else end.replace(tzinfo=timezone.utc)
+    if start >= end:
+        raise HTTPException(status_code=400, detail="start must be before end")
+    
+    findings = await evaluate(rule_set, storage, start, end)
+    new = []
+    if not request.dry_run:
+        new = await record_findings(findings)
+        if request.notify:
+            await route_findings(new)
+    logger.info(f"Evaluated rules over {start.isoformat()} - {end.isoformat()}: {len(findings)} findings, {len(new)} new")
+    return {
+        "status": "success",
+        "count": len(findings),
+        "new": len(new),
+        "findings": [
+            {"host": f.host, "alert": f.alert, "timestamp": f.timestamp.isoformat(), "details": f.details, "new": f in new}
+            for f in findings
+        ],
+        "timestamp": datetime.now(timezone.utc).isoformat()
+    }
+
+
+@app.post("/chatops/slack", include_in_schema=False)
+async def chatops_slack(
+    request: Request,
+    x_slack_request_timestamp: Optional[str] = Header(None),
+    x_slack_signature: Optional[str] = Header(None)
+) -> Dict[str, Any]:
+    """
+    Answer the /richardops Slack slash command.
+    
+    Returns:
+        The reply, visible to the channel, or only to the sender for errors
+    """
+    if not chatops.slack_signing_secret:
+        raise HTTPException(status_code=404, detail="Slack commands are not enabled")
+    body = await request.body()
+    if not verify_slack_signature(chatops.slack_signing_secret, x_slack_request_timestamp or "", body,
+                                  x_slack_signature or ""):
+        raise HTTPException(status_code=401, detail="Invalid Slack signature")
+    form = {key: values[0] for key, values in parse_qs(body.decode()).items()}
+    try:
+        reply = await chatops.handle(form.get("text", ""), f"slack:{form.get('user_id', '')}",
+                                     form.get("user_name", "slack user"))
+    except ChatOpsError as e:
+        return {"response_type": "ephemeral", "text": str(e)}
+    logger.info(f"Slack command from {form.get('user_name')}: {form.get('text', '')}")
+    return {"response_type": "in_channel", "text": reply}
+
+
+@app.post("/chatops/telegram", include_in_schema=False)
+async def chatops_telegram(
+    request: Request,
+    x_telegram_bot_api_secret_token: Optional[str] = Header(None)
+) -> Dict[str, Any]:
+    """
+    Answer commands sent to the Telegram bot, whose webhook is set with
+    TELEGRAM_WEBHOOK_SECRET as its secret token.
+    
+    Returns:
+        A sendMessage call answering the command, which Telegram makes on
+        the bot's behalf, or nothing for other updates
+    """
+    if not chatops.telegram_secret:
+        raise HTTPException(status_code=404, detail="Telegram commands are not enabled")
+    if not hmac.compare_digest(x_telegram_bot_api_secret_token or "", chatops.telegram_secret):
+        raise HTTPException(status_code=401, detail="Invalid Telegram secret token")
+    update = await request.json()
+    message = update.get("message") or {}
+    text = message.get("text", "")
+    chat_id = (message.get("chat") or {}).get("id")
+    if not text.startswith("/") or chat_id is None:
+        return {}
+    if not chatops.telegram_chat_allowed(chat_id):
+        logger.warning(f"Ignored Telegram command from chat {chat_id}, not in TELEGRAM_ALLOWED_CHATS")
+        return {}
+    sender = message.get("from") or {}
+    try:
+        reply = await chatops.handle(text, f"telegram:{sender.get('id', '')}",
+                                     sender.get("username") or sender.get("first_name") or "telegram user")
+        logger.info(f"Telegram command from {sender.get('username')}: {text}")
+    except ChatOpsError as e:
+        reply = str(e)
+    return {"method": "sendMessage", "chat_id": chat_id, "text": reply,
+            "reply_to_message_id": message.get("message_id")}
+
+
+@app.get("/ui", include_in_schema=False)
+async def dashboard(session: Optional[str] = Cookie(None, alias=SESSION_COOKIE)):
+    """
+    Serve the embedded web dashboard.
+    
+    Returns:
+        The dashboard page, which reads the JSON API from the same origin,
+        or with OIDC a redirect to the login when not signed in
+    """
+    if oidc.enabled and oidc.read_session(session) is None:
+        return RedirectResponse("/auth/login?next=/ui")
+    return FileResponse(DASHBOARD_PAGE)
+
+
+def callback_url(request: Request) -> str:
+    """The redirect URI registered with the identity provider."""
+    return oidc.redirect_url or str(request.url_for("oidc_callback"))
+
+
+@app.get("/auth/login", include_in_schema=False)
+async def oidc_login(request: Request, next: str = "/ui") -> RedirectResponse:
+    """Send the browser to the identity provider to sign in."""
+    if not oidc.enabled:
+        raise HTTPException(status_code=404, detail="OIDC login is not configured")
+    # Only return to pages of this server
+    if not next.startswith("/") or next.startswith("//"):
+        next = "/ui"
+    try:
+        url, cookie = await oidc.login_redirect(callback_url(request), next)
+    except Exception as e:
+        logger.error(f"OIDC discovery failed: {str(e)}")
+        raise HTTPException(status_code=502, detail="Identity provider unavailable")
+    response = RedirectResponse(url)
+    response.set_cookie(LOGIN_COOKIE, cookie, max_age=LOGIN_TIMEOUT_SECONDS, httponly=True, samesite="lax",
+                        secure=request.url.scheme == "https")
+    return response
+
+
+@app.get("/auth/callback", include_in_schema=False)
+async def oidc_callback(
+    request: Request,
+    code: Optional[str] = None,
+    state: str = "",
+    error: Optional[str] = None,
+    login: Optional[str] = Cookie(None, alias=LOGIN_COOKIE)
+) -> RedirectResponse:
+    """Finish a login: exchange the code, map the user's groups to a role and start a session."""
+    if error or not code:
+        raise HTTPException(status_code=401, detail=f"Login failed: {error or 'no authorization code'}")
+    try:
+        user, next_path = await oidc.complete(code, state, login, callback_url(request))
+    except OIDCError as e:
+        logger.warning(f"OIDC login rejected: {str(e)}")
+        raise HTTPException(status_code=403, detail=f"Login rejected: {str(e)}")
+    except Exception as e:
+        logger.error(f"OIDC login failed: {str(e)}")
+        raise HTTPException(status_code=502, detail="Identity provider unavailable")
+    
+    logger.info(f"{user.name} signed in as {user.role}{f' of tenant {user.tenant}' if user.tenant else ''}")
+    response = RedirectResponse(next_path)
+    response.delete_cookie(LOGIN_COOKIE)
+    response.set_cookie(SESSION_COOKIE, oidc.session_cookie(user), max_age=oidc.session_seconds, httponly=True,
+                        samesite="lax", secure=request.url.scheme == "https")
+    return response
+
+
+@app.get("/auth/logout", include_in_schema=False)
+async def oidc_logout() -> RedirectResponse:
+    """End the session; the provider's own session is left alone."""
+    response = RedirectResponse("/")
+    response.delete_cookie(SESSION_COOKIE)
+    return response
+
+
+@app.get("/auth/me")
+async def current_user(principal: Optional[Principal] = Depends(get_principal)) -> Dict[str, Any]:
+    """
+    Who the caller is, so the dashboard can show the user and their role.
+    
+    Returns:
+        The name, role and tenant, or role admin for the open API
+    """
+    if principal is None:
+        return {"name": None, "role": "admin", "tenant": None, "oidc": False}
+    return {
+        "name": principal.name,
+        "role": principal.role,
+        "tenant": principal.tenant.name if principal.tenant else None,
+        "oidc": oidc.enabled
+    }
+
+
 @app.get("/healthz")
 async def health_check(db: AsyncSession = Depends(get_db_session)) -> Dict[str, Any]:
     """
@@ -666,7 +1593,7 @@ async def health_check(db: AsyncSession = Depends(get_db_session)) -> Dict[str,
     
     # Environment checks
     health_status["checks"]["environment"] = {
-        "secret_configured": bool(SECRET),
+        "secret_configured": bool(SECRET or tenants.keys),
         "logs_directory": logs_dir.exists()
     }
     
@@ -686,7 +1613,7 @@ async def readiness_check(db: AsyncSession = Depends(get_db_session)) -> Dict[st
         await db.execute(select(func.now()))
         
         # Check critical configuration
-        if not SECRET:
+        if not SECRET and not tenants.keys:
             raise HTTPException(status_code=503, detail="Missing required configuration")
             
         return {
@@ -712,13 +1639,15 @@ async def root() -> Dict[str, str]:
         "version": "1.0.0",
         "endpoints": {
             "ingest": "POST /ingest - Receive monitoring data",
+            "ingest_batch": "POST /ingest/batch - Receive batched monitoring data",
+            "heartbeat": "POST /heartbeat - Receive agent heartbeats",
             "alerts": "GET /alerts - Get current alerts",
             "health": "GET /healthz - Health check"
         }
     }
 
 
-@app.get("/debug/metrics")
+@app.get("/debug/metrics", dependencies=[Depends(require_admin)])
 async def debug_metrics(
     limit: int = Query(default=10, le=50, description="Number of recent metrics to check"),
     db: AsyncSession = Depends(get_db_session)
@@ -794,7 +1723,11 @@ async def root() -> Dict[str, str]:
             "health": "/healthz",
             "readiness": "/readiness", 
             "ingest": "/ingest",
+            "ingest_batch": "/ingest/batch",
+            "heartbeat": "/heartbeat",
+            "dashboard": "/ui",
             "alerts": "/alerts",
+            "agents": "/agents",
             "metrics_recent": "/metrics/recent",
             "metrics_range": "/metrics/range",
             "events_recent": "/events/recent",
@@ -805,10 +1738,16 @@ async def root() -> Dict[str, str]:
 
 
 if __name__ == "__main__":
+    tls_options: Dict[str, Any] = {}
+    if TLS_CERT and TLS_KEY:
+        tls_options = {"ssl_certfile": TLS_CERT, "ssl_keyfile": TLS_KEY}
+        if TLS_CLIENT_CA:
+            tls_options.update(ssl_ca_certs=TLS_CLIENT_CA, ssl_cert_reqs=ssl.CERT_REQUIRED)
     uvicorn.run(
         "main:app",
         host="0.0.0.0",
         port=8000,
         reload=False,      # для продакшена обычно False
-        log_level="info"
+        log_level="info",
+        **tls_options
     )
@@ -1,6 +1,6 @@
 from datetime import datetime
-from typing import List, Optional
-from pydantic import BaseModel, ConfigDict
+from typing import Any, Dict, List, Optional
+from pydantic import BaseModel, ConfigDict, Field
 
 
 class SystemMetrics(BaseModel):
@@ -43,11 +43,15 @@ class Payload(BaseModel):
     Complete monitoring payload matching Go agent's Payload struct.
     
     This model mirrors exactly the Go struct:
+    - ID: string (payload_id, unique per payload and kept across retries)
+    - AgentVersion: string (optional)
     - Host: string (required)
     - ServerID: string (optional)
+    - MachineID: string (optional)
     - Env: string (optional) 
     - OwnerTeam: string (optional)
     - Timestamp: time.Time (required)
+    - Backfill: bool (optional, set on payloads delivered from the agent's queue)
     - Metrics: SystemMetrics (required)
     - DockerEvents: []DockerEvent (required, can be empty)
     - Logs: []LogEntry (required, can be empty)
@@ -57,11 +61,15 @@ class Payload(BaseModel):
     
     model_config = ConfigDict(extra="allow")
     
+    payload_id: Optional[str] = None
+    agent_version: Optional[str] = None
     host: str
     server_id: Optional[str] = None
+    machine_id: Optional[str] = None
     env: Optional[str] = None
     owner_team: Optional[str] = None
     timestamp: datetime
+    backfill: bool = False
     metrics: SystemMetrics
     docker_events: List[DockerEvent] = []
     logs: List[LogEntry] = []
@@ -69,6 +77,25 @@ class Payload(BaseModel):
     score: float
 
 
+class Heartbeat(BaseModel):
+    """
+    Small signed liveness message the Go agent sends between payloads,
+    matching its Heartbeat struct.
+    """
+    
+    model_config = ConfigDict(extra="allow")
+    
+    agent_version: Optional[str] = None
+    host: str
+    server_id: Optional[str] = None
+    machine_id: Optional[str] = None
+    env: Optional[str] = None
+    owner_team: Optional[str] = None
+    timestamp: datetime
+    score: float
+    interval: int = Field(gt=0)  # seconds until the next heartbeat
+
+
 class HealthStatus(BaseModel):
     """Health status response model."""
     
@@ -82,4 +109,96 @@ class IngestResponse(BaseModel):
     
     status: str
     message: str
-    timestamp: str
\ No newline at end of file
+    ack: Optional[Dict[str, str]] = None  # signed receipt, see sign_ack in main.py
+    timestamp: str
+
+
+class EnrollmentTokenRequest(BaseModel):
+    """Request model for creating an agent enrollment token."""
+    
+    tenant: Optional[str] = None
+    env: Optional[str] = None
+    owner_team: Optional[str] = None
+    ttl_hours: Optional[int] = None
+
+
+class EnrollRequest(BaseModel):
+    """Request model for the /enroll endpoint, sent by a new agent."""
+    
+    token: str
+    host: str
+    machine_id: Optional[str] = None
+    agent_version: Optional[str] = None
+    env: Optional[str] = None
+    owner_team: Optional[str] = None
+    # Set when re-enrolling: the current key, and a signature with it over
+    # "<timestamp>.enroll.<token>"
+    key_id: Optional[str] = None
+    timestamp: Optional[str] = None
+    signature: Optional[str] = None
+
+
+class EnrollResponse(BaseModel):
+    """Credentials issued to an enrolled agent."""
+    
+    key_id: str
+    secret: str
+    server_id: str
+
+
+class AgentCommandRequest(BaseModel):
+    """Request model for pushing a remote command to an agent."""
+    
+    command: str  # ping, send, flush_queue or set_config
+    settings: Optional[Dict[str, Any]] = None  # agent flags for set_config, e.g. {"interval": 60}
+    wait_seconds: float = Field(10, ge=0, le=60)
+
+
+class RuleEvaluationRequest(BaseModel):
+    """Request model for re-running the server-side rules over stored data."""
+    
+    start: datetime
+    end: Optional[datetime] = None
+    dry_run: bool = False
+    notify: bool = False
+
+
+class GrafanaRange(BaseModel):
+    """Time range of a Grafana panel."""
+    
+    model_config = ConfigDict(extra="allow", populate_by_name=True)
+    
+    start: datetime = Field(alias="from")
+    end: datetime = Field(alias="to")
+
+
+class GrafanaTarget(BaseModel):
+    """A query of a Grafana panel: "metric" or "metric.aggregation"."""
+    
+    model_config = ConfigDict(extra="allow")
+    
+    target: str = ""
+    refId: Optional[str] = None
+    payload: Optional[Dict[str, str]] = None  # e.g. {"host": "web-01"}
+
+
+class GrafanaFilter(BaseModel):
+    """An ad hoc filter set on a Grafana dashboard."""
+    
+    model_config = ConfigDict(extra="allow")
+    
+    key: str
+    operator: str = "="
+    value: str
+
+
+class GrafanaQueryRequest(BaseModel):
+    """Request model for the Grafana JSON datasource query endpoint."""
+    
+    model_config = ConfigDict(extra="allow")
+    
+    range: GrafanaRange
+    intervalMs: Optional[int] = None
+    maxDataPoints: Optional[int] = None
+    targets: List[GrafanaTarget] = []
+    adhocFilters: List[GrafanaFilter] = []
@@ -7,8 +7,10 @@ from pydantic import BaseModel, Field
 import os
 
 from database import get_db_session
+from services.fleet import agent_status, score_trend
+from services.tenants import Tenant, get_tenant, require_admin, scope_query
 from db_models import (
-    MetricsModel, DockerEventsModel, ContainerLogsModel, AlertsModel
+    MetricsModel, DockerEventsModel, ContainerLogsModel, AlertsModel, AgentsModel
 )
 
 # Pydantic response models
@@ -31,6 +33,7 @@ class DockerEventResponse(BaseModel):
 class LogEntryResponse(BaseModel):
     id: int
     timestamp: str
+    host: Optional[str]
     container: Optional[str]
     message: Optional[str]
 
@@ -43,6 +46,24 @@ class AlertResponse(BaseModel):
     score: Optional[float]
     resolved: bool
 
+class AgentResponse(BaseModel):
+    host: str
+    server_id: Optional[str]
+    agent_version: Optional[str]
+    env: Optional[str]
+    owner_team: Optional[str]
+    first_seen: str
+    last_seen: str
+    seconds_since_seen: int
+    last_heartbeat: Optional[str]
+    heartbeat_interval: Optional[int]
+    status: str
+    silent_since: Optional[str]
+    queue_depth: Optional[int]
+    last_score: Optional[float]
+    score_avg: Optional[float]
+    score_trend: Optional[str]
+
 class ContainerResponse(BaseModel):
     container: str
     last_event_time: str
@@ -57,15 +78,21 @@ router = APIRouter()
 @router.get("/metrics/recent", response_model=List[MetricResponse])
 async def get_recent_metrics(
     limit: int = Query(default=50, le=1000, description="Number of recent metrics to return"),
+    host: Optional[str] = Query(default=None, description="Filter metrics by host"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[MetricResponse]:
     """
     Returns the last N metrics (default 50).
     Order by timestamp descending, then reverse in the response so newest is last.
+    Optionally filter by host.
     """
     try:
         # Query metrics ordered by timestamp descending
-        query = select(MetricsModel).order_by(desc(MetricsModel.timestamp)).limit(limit)
+        query = scope_query(select(MetricsModel), MetricsModel, tenant)
+        if host:
+            query = query.where(MetricsModel.host == host)
+        query = query.order_by(desc(MetricsModel.timestamp)).limit(limit)
         result = await db.execute(query)
         metrics = result.scalars().all()
         
@@ -90,6 +117,8 @@ async def get_recent_metrics(
 @router.get("/metrics/range", response_model=List[MetricResponse])
 async def get_metrics_range(
     period: str = Query(default="1h", description="Time period: 1h, 6h, or 12h"),
+    host: Optional[str] = Query(default=None, description="Filter metrics by host"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[MetricResponse]:
     """
@@ -98,6 +127,7 @@ async def get_metrics_range(
     - ?period=6h → last 6 hours  
     - ?period=12h → last 12 hours
     Default period is 1h if not specified.
+    Optionally filter by host.
     """
     try:
         # Parse period and calculate time threshold
@@ -114,9 +144,12 @@ async def get_metrics_range(
         time_threshold = datetime.utcnow() - timedelta(hours=hours)
         
         # Query metrics within the time range
-        query = select(MetricsModel).where(
+        query = scope_query(select(MetricsModel), MetricsModel, tenant).where(
             MetricsModel.timestamp >= time_threshold
-        ).order_by(MetricsModel.timestamp)
+        )
+        if host:
+            query = query.where(MetricsModel.host == host)
+        query = query.order_by(MetricsModel.timestamp)
         
         result = await db.execute(query)
         metrics = result.scalars().all()
@@ -144,6 +177,7 @@ async def get_metrics_range(
 @router.get("/events/recent", response_model=List[DockerEventResponse])
 async def get_recent_events(
     limit: int = Query(default=50, le=1000, description="Number of recent events to return"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[DockerEventResponse]:
     """
@@ -152,7 +186,8 @@ async def get_recent_events(
     """
     try:
         # Query events ordered by timestamp descending
-        query = select(DockerEventsModel).order_by(desc(DockerEventsModel.timestamp)).limit(limit)
+        query = scope_query(select(DockerEventsModel), DockerEventsModel, tenant)
+        query = query.order_by(desc(DockerEventsModel.timestamp)).limit(limit)
         result = await db.execute(query)
         events = result.scalars().all()
         
@@ -176,18 +211,24 @@ async def get_recent_events(
 async def search_logs(
     q: str = Query(..., description="Search query for log messages"),
     limit: int = Query(default=50, le=1000, description="Number of results to return"),
+    host: Optional[str] = Query(default=None, description="Filter logs by host"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[LogEntryResponse]:
     """
-    GET /logs/search?q=error&limit=50
+    GET /logs/search?q=error&limit=50&host=web-1
     Performs case-insensitive LIKE search in container_logs.message.
     Return last N results ordered by timestamp descending.
+    Optionally filter by host.
     """
     try:
         # Build query with case-insensitive search
-        query = select(ContainerLogsModel).where(
+        query = scope_query(select(ContainerLogsModel), ContainerLogsModel, tenant).where(
             ContainerLogsModel.message.ilike(f"%{q}%")
-        ).order_by(desc(ContainerLogsModel.timestamp)).limit(limit)
+        )
+        if host:
+            query = query.where(ContainerLogsModel.host == host)
+        query = query.order_by(desc(ContainerLogsModel.timestamp)).limit(limit)
         
         result = await db.execute(query)
         logs = result.scalars().all()
@@ -198,6 +239,7 @@ async def search_logs(
             logs_list.append(LogEntryResponse(
                 id=log.id,
                 timestamp=log.timestamp.isoformat(),
+                host=log.host,
                 container=log.container,
                 message=log.message
             ))
@@ -211,6 +253,7 @@ async def search_logs(
 async def get_recent_logs(
     limit: int = Query(default=50, le=500, description="Number of recent log entries to return"),
     container: Optional[str] = Query(default=None, description="Filter logs by container name"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[LogEntryResponse]:
     """
@@ -220,7 +263,7 @@ async def get_recent_logs(
     """
     try:
         # Build base query
-        query = select(ContainerLogsModel)
+        query = scope_query(select(ContainerLogsModel), ContainerLogsModel, tenant)
         
         # Apply container filter if provided
         if container:
@@ -238,6 +281,7 @@ async def get_recent_logs(
             logs_list.append(LogEntryResponse(
                 id=log.id,
                 timestamp=log.timestamp.isoformat(),
+                host=log.host,
                 container=log.container,
                 message=log.message
             ))
@@ -247,7 +291,7 @@ async def get_recent_logs(
     except Exception as e:
         raise HTTPException(status_code=500, detail=f"Error retrieving recent logs: {str(e)}")
 
-@router.get("/alerts", response_model=List[AlertResponse])
+@router.get("/alerts", response_model=List[AlertResponse], dependencies=[Depends(require_admin)])
 async def get_alerts(
     limit: int = Query(default=50, le=1000, description="Number of alerts to return"),
     db: AsyncSession = Depends(get_db_session)
@@ -280,8 +324,62 @@ async def get_alerts(
     except Exception as e:
         raise HTTPException(status_code=500, detail=f"Error retrieving alerts: {str(e)}")
 
+@router.get("/agents", response_model=List[AgentResponse])
+async def get_agents(
+    env: Optional[str] = Query(default=None, description="Filter agents by env"),
+    owner_team: Optional[str] = Query(default=None, description="Filter agents by owner team"),
+    status: Optional[str] = Query(default=None, description="Filter agents by status: ok or silent"),
+    tenant: Optional[Tenant] = Depends(get_tenant),
+    db: AsyncSession = Depends(get_db_session)
+) -> List[AgentResponse]:
+    """
+    GET /agents?env=prod&status=silent
+    Returns the agent inventory, most recently seen first, with each agent's
+    status, queue depth and score trend.
+    """
+    try:
+        query = scope_query(select(AgentsModel), AgentsModel, tenant)
+        if env:
+            query = query.where(AgentsModel.env == env)
+        if owner_team:
+            query = query.where(AgentsModel.owner_team == owner_team)
+        query = query.order_by(desc(AgentsModel.last_seen))
+        result = await db.execute(query)
+        agents = result.scalars().all()
+        
+        now = datetime.now(timezone.utc)
+        agents_list = []
+        for agent in agents:
+            agent_state = agent_status(agent, now)
+            if status and agent_state != status:
+                continue
+            agents_list.append(AgentResponse(
+                host=agent.host,
+                server_id=agent.server_id,
+                agent_version=agent.agent_version,
+                env=agent.env,
+                owner_team=agent.owner_team,
+                first_seen=agent.first_seen.isoformat(),
+                last_seen=agent.last_seen.isoformat(),
+                seconds_since_seen=int((now - agent.last_seen).total_seconds()),
+                last_heartbeat=agent.last_heartbeat.isoformat() if agent.last_heartbeat else None,
+                heartbeat_interval=agent.heartbeat_interval,
+                status=agent_state,
+                silent_since=agent.silent_since.isoformat() if agent.silent_since else None,
+                queue_depth=agent.queue_depth,
+                last_score=float(agent.last_score) if agent.last_score is not None else None,
+                score_avg=float(agent.score_avg) if agent.score_avg is not None else None,
+                score_trend=score_trend(agent)
+            ))
+        
+        return agents_list
+        
+    except Exception as e:
+        raise HTTPException(status_code=500, detail=f"Error retrieving agents: {str(e)}")
+
 @router.get("/containers", response_model=List[ContainerResponse])
 async def get_containers(
+    tenant: Optional[Tenant] = Depends(get_tenant),
     db: AsyncSession = Depends(get_db_session)
 ) -> List[ContainerResponse]:
     """
@@ -291,14 +389,14 @@ async def get_containers(
     """
     try:
         # First, get all distinct containers from both tables
-        distinct_containers_query = select(
+        distinct_containers_query = scope_query(select(
             DockerEventsModel.container.label('container')
-        ).where(
+        ), DockerEventsModel, tenant).where(
             DockerEventsModel.container.isnot(None)
         ).union(
-            select(
+            scope_query(select(
                 ContainerLogsModel.container.label('container')
-            ).where(
+            ), ContainerLogsModel, tenant).where(
                 ContainerLogsModel.container.isnot(None)
             )
         ).distinct().order_by('container')
@@ -311,10 +409,10 @@ async def get_containers(
         for container_name in all_containers:
             # Get the latest event for this container
             latest_event_query = (
-                select(
+                scope_query(select(
                     DockerEventsModel.timestamp,
                     DockerEventsModel.action
-                )
+                ), DockerEventsModel, tenant)
                 .where(DockerEventsModel.container == container_name)
                 .order_by(desc(DockerEventsModel.timestamp))
                 .limit(1)
@@ -0,0 +1,307 @@
+"""
+gRPC streaming transport for agents.
+
+Implements the AgentStream service of go_client/proto/agent_stream.proto:
+agents started with --grpc-addr stream payloads over StreamPayloads and get
+the same signed acks as from POST /ingest, receive remote commands on
+PushCommands and report their results on AckStream, all over one HTTP/2
+connection. Messages are encoded by hand, like in the agent, so neither side
+needs generated code.
+"""
+
+import asyncio
+import hashlib
+import hmac
+import json
+import logging
+import uuid
+from dataclasses import dataclass
+from typing import Any, AsyncIterator, Awaitable, Callable, Dict, Optional, Tuple
+
+import grpc
+
+logger = logging.getLogger("monitoring-backend")
+
+SERVICE = "richardops.agent.v1.AgentStream"
+
+# Remote commands the agent carries out
+COMMANDS = ("ping", "send", "flush_queue", "set_config")
+
+# Results of commands nobody waited for are dropped beyond this many
+MAX_PENDING_COMMANDS = 1000
+
+# Message schemas: field number -> (name, type)
+PAYLOAD_FRAME = {1: ("payload_id", str), 2: ("key_id", str), 3: ("timestamp", str), 4: ("signature", str), 5: ("body", bytes)}
+PAYLOAD_ACK = {1: ("payload_id", str), 2: ("status", str), 3: ("signature", str), 4: ("error", str),
+               5: ("throttle_ms", int)}
+COMMAND_SUBSCRIPTION = {1: ("server_id", str), 2: ("key_id", str), 3: ("timestamp", str), 4: ("signature", str)}
+COMMAND = {1: ("id", str), 2: ("name", str), 3: ("signature", str), 4: ("settings", str)}
+COMMAND_RESULT = {1: ("command_id", str), 2: ("key_id", str), 3: ("status", str), 4: ("output", str), 5: ("signature", str)}
+COMMAND_RESULTS_RECEIVED = {1: ("count", int)}
+
+
+def _encode_varint(value: int) -> bytes:
+    out = bytearray()
+    while True:
+        bits = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(bits | 0x80)
+        else:
+            out.append(bits)
+            return bytes(out)
+
+
+def _decode_varint(data: bytes, pos: int) -> Tuple[int, int]:
+    value, shift = 0, 0
+    while True:
+        if pos >= len(data):
+            raise ValueError("truncated varint")
+        byte = data[pos]
+        pos += 1
+        value |= (byte & 0x7F) << shift
+        if not byte & 0x80:
+            return value, pos
+        shift += 7
+
+
+def encode(schema: Dict[int, Tuple[str, type]], message: Dict[str, Any]) -> bytes:
+    """Encode a message dict in protobuf wire format, omitting empty fields."""
+    out = bytearray()
+    for number, (name, kind) in schema.items():
+        value = message.get(name)
+        if not value:
+            continue
+        if kind is int:
+            out += _encode_varint(number << 3) + _encode_varint(value)
+        else:
+            raw = value.encode() if isinstance(value, str) else value
+            out += _encode_varint(number << 3 | 2) + _encode_varint(len(raw)) + raw
+    return bytes(out)
+
+
+def decode(schema: Dict[int, Tuple[str, type]], data: bytes) -> Dict[str, Any]:
+    """Decode protobuf wire format into a message dict, skipping unknown fields."""
+    message = {name: kind() for name, kind in schema.values()}
+    pos = 0
+    while pos < len(data):
+        tag, pos = _decode_varint(data, pos)
+        number, wire_type = tag >> 3, tag & 7
+        if wire_type == 0:
+            value, pos = _decode_varint(data, pos)
+        elif wire_type == 2:
+            length, pos = _decode_varint(data, pos)
+            value, pos = data[pos:pos + length], pos + length
+        elif wire_type in (1, 5):
+            size = 8 if wire_type == 1 else 4
+            value, pos = data[pos:pos + size], pos + size
+        else:
+            raise ValueError(f"unsupported wire type {wire_type}")
+        if number not in schema:
+            continue
+        name, kind = schema[number]
+        if (kind is int) != (wire_type == 0):
+            continue
+        message[name] = value.decode() if kind is str else value
+    return message
+
+
+def sign_fields(secret: str, *fields: str) -> str:
+    """Sign dot-joined fields the way acks and stream messages are signed."""
+    signature = hmac.new(secret.encode(), ".".join(fields).encode(), hashlib.sha256).hexdigest()
+    return f"sha256={signature}"
+
+
+@dataclass
+class PendingCommand:
+    server_id: str
+    name: str
+    secret: str
+    result: "asyncio.Future[Dict[str, str]]"
+
+
+# ingest(frame, peer) returns the PayloadAck for a PayloadFrame
+IngestFunc = Callable[[Dict[str, Any], str], Awaitable[Dict[str, str]]]
+# authenticate(key_id, server_id, timestamp, signature) returns the agent's
+# secret, raising if the subscription isn't signed with it
+AuthenticateFunc = Callable[[Optional[str], str, str, str], Awaitable[str]]
+
+
+class AgentStreamServer:
+    """Serves AgentStream and tracks which agents are subscribed to commands."""
+
+    def __init__(self, ingest: IngestFunc, authenticate: AuthenticateFunc,
+                 max_inflight: int = 0, throttle_ms: int = 5000):
+        """
+        Args:
+            ingest: Processes a PayloadFrame into its PayloadAck
+            authenticate: Checks command subscriptions
+            max_inflight: Payloads processed at once across all streams before
+                further ones are answered "throttled" (0 for no limit)
+            throttle_ms: How long a throttled agent is asked to pause
+        """
+        self.ingest = ingest
+        self.authenticate = authenticate
+        self.max_inflight = max_inflight
+        self.throttle_ms = throttle_ms
+        self.inflight = 0
+        self.subscribers: Dict[str, Tuple[asyncio.Queue, str]] = {}
+        self.pending: Dict[str, PendingCommand] = {}
+        self.server: Optional[grpc.aio.Server] = None
+
+    async def start(self, port: int, cert_file: Optional[str] = None, key_file: Optional[str] = None,
+                    client_ca_file: Optional[str] = None) -> None:
+        """
+        Listen on port, with TLS if a certificate and key are given. With a
+        client CA, agents must also present a certificate it issued.
+        """
+        def handler(factory, method, request_schema, response_schema):
+            return factory(
+                method,
+                request_deserializer=lambda data: decode(request_schema, data),
+                response_serializer=lambda message: encode(response_schema, message),
+            )
+
+        handlers = {
+            "StreamPayloads": handler(grpc.stream_stream_rpc_method_handler, self._stream_payloads,
+                                      PAYLOAD_FRAME, PAYLOAD_ACK),
+            "PushCommands": handler(grpc.unary_stream_rpc_method_handler, self._push_commands,
+                                    COMMAND_SUBSCRIPTION, COMMAND),
+            "AckStream": handler(grpc.stream_unary_rpc_method_handler, self._ack_stream,
+                                 COMMAND_RESULT, COMMAND_RESULTS_RECEIVED),
+        }
+        self.server = grpc.aio.server()
+        self.server.add_generic_rpc_handlers((grpc.method_handlers_generic_handler(SERVICE, handlers),))
+        address = f"[::]:{port}"
+        if cert_file and key_file:
+            with open(key_file, "rb") as key, open(cert_file, "rb") as cert:
+                key_pair = (key.read(), cert.read())
+            client_ca = None
+            if client_ca_file:
+                with open(client_ca_file, "rb") as ca:
+                    client_ca = ca.read()
+            credentials = grpc.ssl_server_credentials([key_pair], root_certificates=client_ca,
+                                                      require_client_auth=client_ca is not None)
+            self.server.add_secure_port(address, credentials)
+        else:
+            self.server.add_insecure_port(address)
+        await self.server.start()
+        security = ""
+        if cert_file:
+            security = " with mutual TLS" if client_ca_file else " with TLS"
+        logger.info(f"Agent gRPC stream listening on port {port}{security}")
+
+    async def stop(self) -> None:
+        if self.server is not None:
+            await self.server.stop(grace=5)
+
+    async def _stream_payloads(self, frames: AsyncIterator[Dict[str, Any]], context) -> AsyncIterator[Dict[str, Any]]:
+        async for frame in frames:
+            # Backpressure: a busy server asks the agent to pause and keep
+            # the payload queued instead of piling up work
+            if self.max_inflight and self.inflight >= self.max_inflight:
+                logger.info(f"Throttled payload {frame['payload_id']} from {context.peer()}: "
+                            f"{self.inflight} payloads in flight")
+                yield {"payload_id": frame["payload_id"], "status": "throttled",
+                       "error": "server busy", "throttle_ms": self.throttle_ms}
+                continue
+            self.inflight += 1
+            try:
+                ack = await self.ingest(frame, context.peer())
+            finally:
+                self.inflight -= 1
+            yield ack
+
+    async def _push_commands(self, subscription: Dict[str, str], context) -> AsyncIterator[Dict[str, str]]:
+        server_id = subscription["server_id"]
+        try:
+            secret = await self.authenticate(subscription["key_id"] or None, server_id,
+                                             subscription["timestamp"], subscription["signature"])
+        except Exception as e:
+            logger.warning(f"Rejected command subscription of {server_id} from {context.peer()}: {e}")
+            await context.abort(grpc.StatusCode.UNAUTHENTICATED, "invalid subscription")
+            return
+
+        queue: asyncio.Queue = asyncio.Queue()
+        entry = (queue, secret)
+        self.subscribers[server_id] = entry
+        logger.info(f"Agent {server_id} subscribed to commands from {context.peer()}")
+        try:
+            while True:
+                yield await queue.get()
+        finally:
+            # A reconnected agent may have replaced this subscription already
+            if self.subscribers.get(server_id) is entry:
+                del self.subscribers[server_id]
+
+    async def _ack_stream(self, results: AsyncIterator[Dict[str, str]], context) -> Dict[str, int]:
+        count = 0
+        async for result in results:
+            pending = self.pending.get(result["command_id"])
+            if pending is None or pending.result.done():
+                logger.warning(f"Result for unknown command {result['command_id']} from {context.peer()}")
+                continue
+            expected = sign_fields(pending.secret, "result", result["command_id"], result["status"], result["output"])
+            if not hmac.compare_digest(result["signature"], expected):
+                logger.warning(f"Rejected result of command {result['command_id']}: signature mismatch")
+                continue
+            count += 1
+            logger.info(f"Command {pending.name} {result['command_id']} on {pending.server_id}: "
+                        f"{result['status']} {result['output']}")
+            pending.result.set_result({"status": result["status"], "output": result["output"]})
+        return {"count": count}
+
+    def connected(self, server_id: str) -> bool:
+        return server_id in self.subscribers
+
+    def push(self, server_id: str, name: str, settings: Optional[Dict[str, Any]] = None) -> str:
+        """
+        Push a command to a subscribed agent.
+
+        Args:
+            server_id: The agent's server ID
+            name: The command
+            settings: Agent flag names and values, for set_config only
+
+        Returns:
+            The command ID
+
+        Raises:
+            KeyError: If the agent isn't subscribed to commands
+            ValueError: If the command is unknown, or settings don't go with it
+        """
+        if name not in COMMANDS:
+            raise ValueError(f"Unknown command {name} (available: {', '.join(COMMANDS)})")
+        if (name == "set_config") != bool(settings):
+            raise ValueError("set_config takes settings, other commands don't")
+        queue, secret = self.subscribers[server_id]
+        command_id = str(uuid.uuid4())
+        if len(self.pending) >= MAX_PENDING_COMMANDS:
+            self.pending.pop(next(iter(self.pending)))
+        self.pending[command_id] = PendingCommand(server_id, name, secret, asyncio.get_running_loop().create_future())
+        command = {"id": command_id, "name": name}
+        fields = ["command", command_id, name]
+        if settings:
+            # Signed as sent, so the agent checks exactly these bytes
+            command["settings"] = json.dumps(settings, separators=(",", ":"), sort_keys=True)
+            fields.append(command["settings"])
+        command["signature"] = sign_fields(secret, *fields)
+        queue.put_nowait(command)
+        return command_id
+
+    async def wait(self, command_id: str, timeout: float) -> Optional[Dict[str, str]]:
+        """
+        Wait for a command's result. A result arriving later is still logged.
+
+        Returns:
+            The result's status and output, or None if it didn't arrive in time
+        """
+        pending = self.pending.get(command_id)
+        if pending is None:
+            return None
+        try:
+            result = await asyncio.wait_for(asyncio.shield(pending.result), timeout)
+        except asyncio.TimeoutError:
+            return None
+        self.pending.pop(command_id, None)
+        return result
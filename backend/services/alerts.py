@@ -8,7 +8,8 @@ from typing import List
 CRITICAL_ALERTS = [
     "CPU_SPIKE",
     "BRUTE_FORCE", 
-    "SHELL_IN_CONTAINER"
+    "SHELL_IN_CONTAINER",
+    "AGENT_SILENT"
 ]
 
 
@@ -0,0 +1,58 @@
+"""
+Message formats of the chat channels of the alert router.
+
+Discord gets an embed and Microsoft Teams an Adaptive Card, both showing the
+group's subject and summary, colored by severity, with its hosts, env, owner
+team and score alongside.
+"""
+
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Tuple
+
+# Discord embed side bar colors per severity
+DISCORD_COLORS = {"critical": 0xE01E5A, "warning": 0xF2C744}
+
+# Adaptive Card text colors per severity
+TEAMS_COLORS = {"critical": "Attention", "warning": "Warning"}
+
+
+def _facts(group: Dict[str, Any]) -> List[Tuple[str, str]]:
+    facts = [("Hosts", ", ".join(sorted(group["hosts"])))]
+    facts += [(name, group[key]) for name, key in (("Env", "env"), ("Team", "owner_team")) if group[key]]
+    return facts + [("Score", f"{group['score']:.2f}")]
+
+
+def discord_message(channel: Dict[str, Any], subject: str, message: str, severity: str,
+                    group: Dict[str, Any]) -> Dict[str, Any]:
+    """A Discord webhook message with one embed; channel username names the poster."""
+    return {
+        "username": channel.get("username", "RichardOps"),
+        "embeds": [{
+            "title": subject[:256],
+            "description": message[:4096],
+            "color": DISCORD_COLORS[severity],
+            "fields": [{"name": name, "value": value[:1024], "inline": name != "Hosts"}
+                       for name, value in _facts(group)],
+            "timestamp": datetime.fromtimestamp(group["last_seen"], timezone.utc).isoformat(),
+        }],
+    }
+
+
+def teams_message(channel: Dict[str, Any], subject: str, message: str, severity: str,
+                  group: Dict[str, Any]) -> Dict[str, Any]:
+    """A Teams incoming webhook or Workflows message with one Adaptive Card."""
+    card = {
+        "$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+        "type": "AdaptiveCard",
+        "version": "1.4",
+        "body": [
+            {"type": "TextBlock", "text": subject, "size": "Large", "weight": "Bolder",
+             "color": TEAMS_COLORS[severity], "wrap": True},
+            {"type": "TextBlock", "text": message.replace("\n", "\n\n"), "wrap": True},
+            {"type": "FactSet", "facts": [{"title": name, "value": value} for name, value in _facts(group)]},
+        ],
+    }
+    return {
+        "type": "message",
+        "attachments": [{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}],
+    }
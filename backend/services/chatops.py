@@ -0,0 +1,216 @@
+"""
+ChatOps commands from Slack and Telegram.
+
+A Slack slash command (/richardops) and a Telegram bot post the text typed
+in chat to the backend, which answers in the same chat:
+
+- status [host]: fleet summary, or one agent's state and open alert groups
+- alerts: open alert groups
+- ack <group>: stop a group from escalating
+- silence <ALERT_TYPE> <duration> [host]: stop routing an alert type
+- silences: active silences
+- unsilence <id | ALERT_TYPE>: end silences early
+- help
+
+Anyone in the workspace or allowed Telegram chats may read; ack, silence and
+unsilence are limited to the users in CHATOPS_OPERATORS.
+"""
+
+import hashlib
+import hmac
+import os
+import time
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional, Set, Tuple
+
+from sqlalchemy import desc, or_, select
+
+from database import async_session_maker
+from db_models import AgentsModel
+from services.fleet import agent_status, score_trend
+from services.routing import AlertRouter
+from services.silences import active_silences, add_silence, parse_duration, remove_silences
+
+# Slack requests older than this are rejected as replays
+SLACK_MAX_AGE_SECONDS = 300
+
+COMMAND_NAME = "richardops"
+
+HELP = """Commands:
+status [host] - fleet summary, or one agent's state and alerts
+alerts - open alert groups
+ack <group> - stop an alert group from escalating
+silence <ALERT_TYPE> <duration> [host] - stop routing an alert, e.g. silence BRUTE_FORCE 1h
+silences - active silences
+unsilence <id | ALERT_TYPE> - end silences early"""
+
+# Commands that change state, limited to operators
+OPERATOR_COMMANDS = ("ack", "silence", "unsilence")
+
+
+class ChatOpsError(Exception):
+    """A command that can't be run; the message is shown only to its sender."""
+
+
+def verify_slack_signature(secret: str, timestamp: str, body: bytes, signature: str) -> bool:
+    """Check Slack's X-Slack-Signature over v0:<timestamp>:<body>."""
+    try:
+        if abs(time.time() - int(timestamp)) > SLACK_MAX_AGE_SECONDS:
+            return False
+    except ValueError:
+        return False
+    expected = "v0=" + hmac.new(secret.encode(), f"v0:{timestamp}:".encode() + body, hashlib.sha256).hexdigest()
+    return hmac.compare_digest(expected, signature)
+
+
+def parse_command(text: str) -> Tuple[str, List[str]]:
+    """
+    Split chat text into a command and its arguments. The leading
+    /richardops (with Telegram's @bot suffix) is optional, and Telegram's
+    /status is read as status.
+    """
+    words = text.strip().split()
+    if words and words[0].lstrip("/").split("@")[0].lower() == COMMAND_NAME:
+        words = words[1:]
+    if not words:
+        return "help", []
+    return words[0].lstrip("/").split("@")[0].lower(), words[1:]
+
+
+def _ago(moment: datetime, now: datetime) -> str:
+    seconds = int((now - moment).total_seconds())
+    for unit, size in (("d", 86400), ("h", 3600), ("m", 60)):
+        if seconds >= size:
+            return f"{seconds // size}{unit} ago"
+    return f"{seconds}s ago"
+
+
+class ChatOps:
+    """Runs chat commands against the agent inventory and alert router."""
+
+    def __init__(self, router: AlertRouter, operators: Set[str]):
+        self.router = router
+        self.operators = operators
+        self.slack_signing_secret = os.environ.get("SLACK_SIGNING_SECRET")
+        self.telegram_secret = os.environ.get("TELEGRAM_WEBHOOK_SECRET")
+        self.telegram_chats = {c.strip() for c in os.environ.get("TELEGRAM_ALLOWED_CHATS", "").split(",") if c.strip()}
+
+    @classmethod
+    def from_environment(cls, router: AlertRouter) -> "ChatOps":
+        """Operators are CHATOPS_OPERATORS entries like slack:U024BE7LH or telegram:123456."""
+        operators = {o.strip() for o in os.environ.get("CHATOPS_OPERATORS", "").split(",") if o.strip()}
+        return cls(router, operators)
+
+    def telegram_chat_allowed(self, chat_id: Any) -> bool:
+        return not self.telegram_chats or str(chat_id) in self.telegram_chats
+
+    async def handle(self, text: str, user: str, user_name: str) -> str:
+        """
+        Run a command for a user.
+
+        Args:
+            text: The chat text
+            user: The user's ID, prefixed with slack: or telegram:
+            user_name: Name recorded on silences
+
+        Raises:
+            ChatOpsError: If the command is unknown, malformed or not allowed
+        """
+        command, args = parse_command(text)
+        if command in OPERATOR_COMMANDS and user not in self.operators:
+            raise ChatOpsError(f"{command} is limited to operators (ask an admin to add {user} to CHATOPS_OPERATORS)")
+        if command == "help":
+            return HELP
+        if command == "status":
+            return await self.status(args[0] if args else None)
+        if command == "alerts":
+            return await self.alerts()
+        if command == "ack":
+            if len(args) != 1:
+                raise ChatOpsError("usage: ack <group>")
+            if not await self.router.acknowledge(args[0]):
+                raise ChatOpsError(f"no open alert group {args[0]}")
+            return f"Alert group {args[0]} acknowledged by {user_name}"
+        if command == "silence":
+            return await self.silence(args, user_name)
+        if command == "silences":
+            return await self.silences()
+        if command == "unsilence":
+            if len(args) != 1:
+                raise ChatOpsError("usage: unsilence <id | ALERT_TYPE>")
+            removed = await remove_silences(args[0])
+            if not removed:
+                raise ChatOpsError(f"no silence {args[0]}")
+            return f"Removed {removed} silence(s) of {args[0]}"
+        raise ChatOpsError(f"unknown command {command}\n{HELP}")
+
+    async def status(self, host: Optional[str]) -> str:
+        now = datetime.now(timezone.utc)
+        groups = await self.router.list_groups()
+        async with async_session_maker() as session:
+            query = select(AgentsModel).order_by(desc(AgentsModel.last_seen))
+            if host:
+                query = query.where(or_(AgentsModel.host == host, AgentsModel.server_id == host))
+            agents = (await session.execute(query)).scalars().all()
+
+        if host is None:
+            silent = [a.host for a in agents if agent_status(a, now) == "silent"]
+            lines = [f"{len(agents)} agents, {len(agents) - len(silent)} ok, {len(silent)} silent"]
+            if silent:
+                lines.append(f"Silent: {', '.join(sorted(silent)[:20])}")
+            lines.append(f"{len(groups)} open alert group(s), {len(await active_silences())} active silence(s)")
+            return "\n".join(lines)
+
+        if not agents:
+            raise ChatOpsError(f"no agent {host}")
+        lines = []
+        for agent in agents:
+            scope = " / ".join(x for x in (agent.env, agent.owner_team) if x) or "no env"
+            score = f"{float(agent.last_score):.2f}" if agent.last_score is not None else "n/a"
+            trend = score_trend(agent)
+            lines.append(
+                f"{agent.host} ({scope}, agent {agent.agent_version or 'unknown'}): {agent_status(agent, now)}, "
+                f"last seen {_ago(agent.last_seen, now)}, score {score}{f' {trend}' if trend else ''}, "
+                f"queue {agent.queue_depth or 0}"
+            )
+        hosts = {agent.host for agent in agents}
+        for group in groups:
+            if hosts & set(group["hosts"]):
+                lines.append(self._group_line(group))
+        return "\n".join(lines)
+
+    async def alerts(self) -> str:
+        groups = await self.router.list_groups()
+        if not groups:
+            return "No open alert groups"
+        return "\n".join(self._group_line(group) for group in groups[:20])
+
+    @staticmethod
+    def _group_line(group: Dict[str, Any]) -> str:
+        scope = " / ".join(x for x in (group["env"], group["owner_team"]) if x) or "all"
+        state = "acknowledged" if group["acknowledged"] else f"escalation level {group['escalation_level']}"
+        tickets = "".join(f" {t['key']} {t['url']}" for t in group["tickets"].values())
+        return (f"[{group['id']}] {group['alert_type']} [{scope}] x{group['count']} on "
+                f"{', '.join(sorted(group['hosts']))} ({state}){tickets}")
+
+    async def silence(self, args: List[str], user_name: str) -> str:
+        if len(args) not in (2, 3):
+            raise ChatOpsError("usage: silence <ALERT_TYPE> <duration> [host]")
+        try:
+            duration = parse_duration(args[1])
+        except ValueError as e:
+            raise ChatOpsError(str(e))
+        silence = await add_silence(args[0], duration, user_name, args[2] if len(args) == 3 else None)
+        where = f" on {silence.host}" if silence.host else ""
+        return (f"Silenced {silence.alert_type}{where} until {silence.expires_at:%Y-%m-%d %H:%M} UTC "
+                f"(id {silence.id})")
+
+    async def silences(self) -> str:
+        silences = await active_silences()
+        if not silences:
+            return "No active silences"
+        return "\n".join(
+            f"[{s.id}] {s.alert_type}{f' on {s.host}' if s.host else ''} until "
+            f"{s.expires_at.astimezone(timezone.utc):%Y-%m-%d %H:%M} UTC, by {s.created_by}"
+            for s in silences
+        )
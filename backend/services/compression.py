@@ -0,0 +1,135 @@
+"""
+Decoding of compressed agent request bodies.
+
+Agents started with --compression send payloads gzip or zstd encoded with a
+matching Content-Encoding. The HMAC signature covers the uncompressed JSON,
+so bodies are decoded before any route reads them and signature checks and
+payload parsing work unchanged.
+"""
+
+import json
+import os
+import zlib
+from typing import Awaitable, Callable, Dict, Any
+
+try:
+    import zstandard
+except ImportError:  # zstd bodies are refused without the package
+    zstandard = None
+
+# Largest body a compressed request may expand to
+MAX_DECOMPRESSED_BYTES = int(os.environ.get("MAX_DECOMPRESSED_BYTES", str(32 << 20)))
+
+
+class DecompressionError(ValueError):
+    """A compressed body that can't or may not be decoded."""
+
+    def __init__(self, status: int, detail: str):
+        super().__init__(detail)
+        self.status = status
+        self.detail = detail
+
+
+def decompress_body(encoding: str, body: bytes, limit: int = MAX_DECOMPRESSED_BYTES) -> bytes:
+    """
+    Decode a request body by its Content-Encoding.
+
+    Args:
+        encoding: The Content-Encoding header value
+        body: The body as received
+        limit: Largest decoded size accepted, against compression bombs
+
+    Returns:
+        The decoded body
+
+    Raises:
+        DecompressionError: For unsupported encodings, corrupt or oversized bodies
+    """
+    encoding = encoding.strip().lower()
+    if encoding in ("", "identity"):
+        return body
+    if encoding == "gzip":
+        decoder = zlib.decompressobj(16 + zlib.MAX_WBITS)
+        try:
+            decoded = decoder.decompress(body, limit + 1)
+        except zlib.error as e:
+            raise DecompressionError(400, f"Invalid gzip body: {e}") from e
+        truncated = not decoder.eof
+    elif encoding == "zstd":
+        if zstandard is None:
+            raise DecompressionError(415, "zstd bodies need the zstandard package")
+        try:
+            decoded = zstandard.ZstdDecompressor().stream_reader(body).read(limit + 1)
+        except zstandard.ZstdError as e:
+            raise DecompressionError(400, f"Invalid zstd body: {e}") from e
+        truncated = False
+    else:
+        raise DecompressionError(415, f"Unsupported Content-Encoding {encoding!r}")
+
+    if len(decoded) > limit:
+        raise DecompressionError(413, f"{encoding} body expands beyond {limit} bytes")
+    if truncated:
+        raise DecompressionError(400, f"Invalid {encoding} body: truncated")
+    return decoded
+
+
+ASGIApp = Callable[[Dict[str, Any], Callable, Callable], Awaitable[None]]
+
+
+class DecompressionMiddleware:
+    """ASGI middleware replacing compressed request bodies with decoded ones."""
+
+    def __init__(self, app: ASGIApp):
+        self.app = app
+
+    async def __call__(self, scope: Dict[str, Any], receive: Callable, send: Callable) -> None:
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+        headers = dict(scope["headers"])
+        encoding = headers.get(b"content-encoding", b"").decode("latin-1")
+        if encoding.strip().lower() in ("", "identity"):
+            await self.app(scope, receive, send)
+            return
+
+        chunks = []
+        more = True
+        while more:
+            message = await receive()
+            if message["type"] == "http.disconnect":
+                return
+            chunks.append(message.get("body", b""))
+            more = message.get("more_body", False)
+        try:
+            body = decompress_body(encoding, b"".join(chunks))
+        except DecompressionError as e:
+            await send_error(send, e.status, e.detail)
+            return
+
+        scope = dict(scope)
+        scope["headers"] = [
+            (name, value) for name, value in scope["headers"]
+            if name not in (b"content-encoding", b"content-length")
+        ] + [(b"content-length", str(len(body)).encode())]
+
+        sent = False
+
+        async def receive_decoded() -> Dict[str, Any]:
+            nonlocal sent
+            if sent:
+                return await receive()
+            sent = True
+            return {"type": "http.request", "body": body, "more_body": False}
+
+        await self.app(scope, receive_decoded, send)
+
+
+async def send_error(send: Callable, status: int, detail: str) -> None:
+    """Answer a request with a JSON error like FastAPI's HTTPException."""
+    body = json.dumps({"detail": detail}).encode()
+    await send({
+        "type": "http.response.start",
+        "status": status,
+        "headers": [(b"content-type", b"application/json"), (b"content-length", str(len(body)).encode())],
+    })
+    await send({"type": "http.response.body", "body": body})
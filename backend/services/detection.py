@@ -0,0 +1,305 @@
+"""
+Server-side re-evaluation of the agent's detection rules.
+
+RULES_CONFIG names a JSON file in the agent's own formats: thresholds use the
+agent's config keys (cpu_spike_pct, baseline_samples), and log rules are an
+agent --mask-rules-file document, inline under "mask_rules" or by path under
+"mask_rules_file". The rules are run over ingested metrics, Docker events and
+container logs, so a rule added or tuned here applies to the whole fleet, and
+to data already received, before any agent is reconfigured.
+
+Detections mirror the agent's:
+- CPU_SPIKE: cpu_usage at or above cpu_spike_pct and 3 standard deviations
+  above the host's previous baseline_samples samples
+- SHELL_IN_CONTAINER: an exec_create event running a shell
+- SECRET_IN_LOGS:<container>: a log line a masking rule matches, other than
+  values the agent already masked
+
+Each alert is raised at most once per host and hour, however often that
+hour's data is evaluated.
+"""
+
+import json
+import logging
+import math
+import os
+import re
+from collections import defaultdict, deque
+from dataclasses import dataclass, field
+from datetime import datetime, timedelta
+from pathlib import Path
+from typing import Any, Deque, Dict, Iterable, List, Optional, Tuple
+
+from sqlalchemy import select
+from sqlalchemy.dialects.postgresql import insert as pg_insert
+
+from database import async_session_maker
+from db_models import AgentsModel, AlertsModel, RuleFindingsModel
+from services.alerts import get_alert_severity
+from services.routing import alert_type
+from storage.base import PayloadStorage
+
+logger = logging.getLogger("monitoring-backend")
+
+# Findings of one alert on one host are keyed to the start of their hour
+FINDING_BUCKET = timedelta(hours=1)
+
+# Raw data is read in slices of this length to bound memory
+SCAN_SLICE = timedelta(hours=1)
+
+# Metrics read before the evaluated range to fill the CPU baselines
+BASELINE_PREROLL = timedelta(minutes=30)
+
+# Same as the agent's shellCommands
+SHELL_COMMANDS = ["bash", "sh", "cmd.exe", "powershell", "pwsh"]
+
+# Replacements the agent writes over masked values: [REDACTED], [HASH:...], [EMAIL], ...
+MASKED_VALUE = re.compile(r"^\[[A-Z_]+(?::[0-9a-f]+)?\]$")
+
+
+@dataclass
+class MaskRule:
+    """An agent masking rule; a match of its value group is a leaked secret."""
+    name: str
+    pattern: re.Pattern
+    replacement: str = "[REDACTED]"
+    keywords: List[str] = field(default_factory=list)
+
+    def matches(self, message: str) -> bool:
+        lowered = message.lower()
+        if self.keywords and not any(k in lowered for k in self.keywords):
+            return False
+        for match in self.pattern.finditer(message):
+            value = match.group("value") if "value" in self.pattern.groupindex else match.group(0)
+            if value and value != self.replacement and not MASKED_VALUE.match(value):
+                return True
+        return False
+
+
+def _mask_rule(spec: Dict[str, Any]) -> MaskRule:
+    try:
+        pattern = re.compile(spec["pattern"])
+    except re.error as e:
+        raise ValueError(f"masking rule {spec.get('name')!r}: {e}")
+    return MaskRule(
+        name=spec["name"],
+        pattern=pattern,
+        replacement=spec.get("replacement") or "[REDACTED]",
+        keywords=[k.lower() for k in spec.get("keywords", [])],
+    )
+
+
+# The agent's built-in masking rules (defaultMaskRules in go_client/masking.go)
+DEFAULT_MASK_RULES = [
+    {"name": "key_value", "pattern": r"(?i)(?:password|token|secret|key|auth)=(?P<value>[^\s&]+)",
+     "keywords": ["password=", "token=", "secret=", "key=", "auth="]},
+    {"name": "json_field", "pattern": r'(?i)"(?:password|token|secret|key|auth)"\s*:\s*"(?P<value>[^"]*)"',
+     "keywords": ['password"', 'token"', 'secret"', 'key"', 'auth"']},
+    {"name": "authorization_header",
+     "pattern": r"(?i)authorization\s*[:=]\s*(?:(?:bearer|basic|digest|token|negotiate)\s+)?(?P<value>[^\s,;\"']+)",
+     "keywords": ["authorization"]},
+    {"name": "cookie", "pattern": r"(?i)(?:set-)?cookie\s*:\s*(?P<value>[^\r\n\"]+)", "keywords": ["cookie"]},
+    {"name": "jwt", "pattern": r"eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*"},
+    {"name": "connection_string", "pattern": r"(?i)\b[a-z][a-z0-9+.-]*://[^:/\s@]+:(?P<value>[^@\s/]+)@",
+     "keywords": ["://"]},
+]
+
+
+@dataclass
+class Finding:
+    """An alert the rules raise for a host from its stored data."""
+    host: str
+    alert: str
+    timestamp: datetime  # start of the FINDING_BUCKET the matching data fell in
+    details: str
+
+
+def _bucket(timestamp: datetime) -> datetime:
+    return timestamp.replace(minute=0, second=0, microsecond=0)
+
+
+class RuleSet:
+    """The agent's detection rules, applied to rows read back from storage."""
+
+    def __init__(self, cpu_spike_pct: float = 85.0, baseline_samples: int = 12,
+                 mask_rules: Optional[List[MaskRule]] = None,
+                 containers: Optional[Dict[str, Tuple[List[str], List[MaskRule]]]] = None):
+        self.cpu_spike_pct = cpu_spike_pct
+        self.baseline_samples = baseline_samples
+        self.mask_rules = mask_rules or []
+        self.containers = containers or {}  # container name -> (disabled rule names, extra rules)
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any], base_dir: Path = Path(".")) -> "RuleSet":
+        """
+        Build a rule set from a config dict of the form
+        {"cpu_spike_pct", "baseline_samples", "mask_rules" | "mask_rules_file"}.
+
+        Raises:
+            ValueError: If a masking rule's pattern doesn't compile
+        """
+        masking = config.get("mask_rules", {})
+        if config.get("mask_rules_file"):
+            with open(base_dir / config["mask_rules_file"]) as f:
+                masking = json.load(f)
+
+        specs = ([] if masking.get("disable_defaults") else DEFAULT_MASK_RULES) + masking.get("rules", [])
+        containers = {
+            name: (override.get("disable", []), [_mask_rule(r) for r in override.get("rules", [])])
+            for name, override in masking.get("containers", {}).items()
+        }
+        return cls(
+            cpu_spike_pct=float(config.get("cpu_spike_pct", 85.0)),
+            baseline_samples=int(config.get("baseline_samples", 12)),
+            mask_rules=[_mask_rule(spec) for spec in specs],
+            containers=containers,
+        )
+
+    @classmethod
+    def from_environment(cls) -> Optional["RuleSet"]:
+        """Load RULES_CONFIG, or return None when server-side rules are off."""
+        path = os.environ.get("RULES_CONFIG")
+        if not path:
+            return None
+        with open(path) as f:
+            rules = cls.from_config(json.load(f), Path(path).parent)
+        logger.info(f"Loaded server-side rules from {path}: {len(rules.mask_rules)} masking rules, "
+                    f"CPU spike at {rules.cpu_spike_pct}%")
+        return rules
+
+    def describe(self) -> Dict[str, Any]:
+        return {
+            "cpu_spike_pct": self.cpu_spike_pct,
+            "baseline_samples": self.baseline_samples,
+            "mask_rules": [rule.name for rule in self.mask_rules],
+            "containers": {
+                name: {"disable": disabled, "rules": [rule.name for rule in extra]}
+                for name, (disabled, extra) in self.containers.items()
+            },
+        }
+
+    def check_metrics(self, rows: Iterable[Dict[str, Any]], baselines: Dict[str, Deque[float]]) -> List[Finding]:
+        """Score each sample against the host's baseline before adding it, like the agent."""
+        findings = []
+        for row in rows:
+            if row["cpu_usage"] is None:
+                continue
+            cpu = float(row["cpu_usage"])
+            samples = baselines[row["host"]]
+            if len(samples) >= 3:
+                mean = sum(samples) / len(samples)
+                std_dev = math.sqrt(max(sum(s * s for s in samples) / len(samples) - mean * mean, 0))
+                if std_dev > 0 and cpu >= self.cpu_spike_pct and (cpu - mean) / std_dev >= 3.0:
+                    findings.append(Finding(
+                        host=row["host"], alert="CPU_SPIKE", timestamp=_bucket(row["timestamp"]),
+                        details=f"{cpu:.2f}% at {row['timestamp'].isoformat()} (z-score: {(cpu - mean) / std_dev:.2f})",
+                    ))
+            samples.append(cpu)
+        return findings
+
+    def check_events(self, rows: Iterable[Dict[str, Any]]) -> List[Finding]:
+        findings = []
+        for row in rows:
+            action = row["action"] or ""
+            if not action.startswith("exec_create"):
+                continue
+            command = action.partition(":")[2].strip().lower()
+            if any(shell in command for shell in SHELL_COMMANDS):
+                findings.append(Finding(
+                    host=row["host"], alert="SHELL_IN_CONTAINER", timestamp=_bucket(row["timestamp"]),
+                    details=f"{command} in {row['container']} at {row['timestamp'].isoformat()}",
+                ))
+        return findings
+
+    def rules_for(self, container: str) -> List[MaskRule]:
+        disabled, extra = self.containers.get(container, ([], []))
+        return [rule for rule in self.mask_rules if rule.name not in disabled] + extra
+
+    def check_logs(self, rows: Iterable[Dict[str, Any]]) -> List[Finding]:
+        """Count rule hits per host, container and hour, as the agent's alert details do per payload."""
+        hits: Dict[Tuple[str, str, datetime], Dict[str, int]] = defaultdict(lambda: defaultdict(int))
+        for row in rows:
+            for rule in self.rules_for(row["container"]):
+                if rule.matches(row["message"] or ""):
+                    hits[(row["host"], row["container"], _bucket(row["timestamp"]))][rule.name] += 1
+        return [
+            Finding(
+                host=host, alert=f"SECRET_IN_LOGS:{container}", timestamp=bucket,
+                details=", ".join(f"{name}={count}" for name, count in sorted(counts.items())),
+            )
+            for (host, container, bucket), counts in hits.items()
+        ]
+
+
+async def evaluate(rules: RuleSet, storage: PayloadStorage, start: datetime, end: datetime) -> List[Finding]:
+    """
+    Run the rules over the raw data stored between start and end.
+
+    Returns:
+        Findings, one per host, alert and hour (the first found)
+    """
+    findings: Dict[Tuple[str, str, datetime], Finding] = {}
+    baselines: Dict[str, Deque[float]] = defaultdict(lambda: deque(maxlen=rules.baseline_samples))
+    rules.check_metrics(await storage.read_window("metrics", start - BASELINE_PREROLL, start), baselines)
+
+    slice_start = start
+    while slice_start < end:
+        slice_end = min(slice_start + SCAN_SLICE, end)
+        found = (
+            rules.check_metrics(await storage.read_window("metrics", slice_start, slice_end), baselines)
+            + rules.check_events(await storage.read_window("docker_events", slice_start, slice_end))
+            + rules.check_logs(await storage.read_window("container_logs", slice_start, slice_end))
+        )
+        for finding in found:
+            findings.setdefault((finding.host, finding.alert, finding.timestamp), finding)
+        slice_start = slice_end
+    return list(findings.values())
+
+
+async def record_findings(findings: List[Finding]) -> List[Finding]:
+    """
+    Store findings not raised before, each with an alert.
+
+    Returns:
+        The findings that are new
+    """
+    new = []
+    async with async_session_maker() as session:
+        async with session.begin():
+            for finding in findings:
+                result = await session.execute(
+                    pg_insert(RuleFindingsModel)
+                    .values(host=finding.host, alert=finding.alert, timestamp=finding.timestamp, details=finding.details)
+                    .on_conflict_do_nothing(index_elements=["host", "alert", "timestamp"])
+                    .returning(RuleFindingsModel.id)
+                )
+                finding_id = result.scalar()
+                if finding_id is None:
+                    continue
+                alert = AlertsModel(
+                    timestamp=finding.timestamp,
+                    severity=get_alert_severity([alert_type(finding.alert)]),
+                    type=alert_type(finding.alert),
+                    message=f"{finding.alert} on {finding.host} (server-side rules): {finding.details}",
+                    resolved=False
+                )
+                session.add(alert)
+                await session.flush()
+                await session.execute(
+                    RuleFindingsModel.__table__.update()
+                    .where(RuleFindingsModel.id == finding_id)
+                    .values(alert_id=alert.id)
+                )
+                new.append(finding)
+    if new:
+        logger.warning(f"Server-side rules raised {len(new)} new alerts: {sorted({f.alert for f in new})}")
+    return new
+
+
+async def agent_scopes(hosts: Iterable[str]) -> Dict[str, AgentsModel]:
+    """The most recently seen inventory row per host, for routing findings."""
+    async with async_session_maker() as session:
+        result = await session.execute(
+            select(AgentsModel).where(AgentsModel.host.in_(list(set(hosts)))).order_by(AgentsModel.last_seen)
+        )
+        return {agent.host: agent for agent in result.scalars().all()}
@@ -0,0 +1,197 @@
+"""
+Agent enrollment.
+
+Operators create one-time enrollment tokens; a new agent presents one to
+POST /enroll and is issued its own API key (key ID and HMAC secret) and a
+canonical server_id, which it keeps and signs with from then on. Issued keys
+are stored in agent_credentials and accepted at ingest alongside the keys in
+TENANTS_CONFIG. Each may only submit for its own server_id, within its
+tenant's envs and owner teams and the env and owner team the token names.
+"""
+
+import hashlib
+import logging
+import os
+import secrets
+import uuid
+from datetime import datetime, timedelta, timezone
+from typing import Callable, Optional, Tuple
+
+from sqlalchemy import update
+
+from database import async_session_maker
+from db_models import AgentCredentialsModel, EnrollmentTokensModel
+from services.tenants import APIKey, Scope, Tenant, tenant_allows, tenants
+
+logger = logging.getLogger("monitoring-backend")
+
+# Hours an enrollment token stays valid unless the request says otherwise
+ENROLLMENT_TOKEN_TTL_HOURS = int(os.environ.get("ENROLLMENT_TOKEN_TTL_HOURS", "24"))
+
+
+class EnrollmentError(ValueError):
+    """An enrollment token that is unknown, spent or doesn't fit the agent."""
+
+
+def hash_token(token: str) -> str:
+    return hashlib.sha256(token.encode()).hexdigest()
+
+
+async def create_enrollment_token(tenant: Optional[str], env: Optional[str], owner_team: Optional[str],
+                                  ttl_hours: int = ENROLLMENT_TOKEN_TTL_HOURS) -> Tuple[str, datetime]:
+    """
+    Create a one-time enrollment token.
+
+    Args:
+        tenant: Tenant the enrolled agent will belong to, None without tenants
+        env: Env the agent may submit for, None for any
+        owner_team: Owner team the agent may submit for, None for any
+        ttl_hours: Hours until the token expires
+
+    Returns:
+        The token, which is only stored hashed, and its expiry
+    """
+    token = "et_" + secrets.token_urlsafe(24)
+    expires_at = datetime.now(timezone.utc) + timedelta(hours=ttl_hours)
+    async with async_session_maker() as session:
+        async with session.begin():
+            session.add(EnrollmentTokensModel(
+                token_hash=hash_token(token), tenant=tenant, env=env, owner_team=owner_team, expires_at=expires_at,
+            ))
+    return token, expires_at
+
+
+async def enroll(token: str, host: str, machine_id: Optional[str], agent_version: Optional[str],
+                 env: Optional[str], owner_team: Optional[str], previous_key_id: Optional[str] = None,
+                 proves: Optional[Callable[[str], bool]] = None) -> AgentCredentialsModel:
+    """
+    Spend an enrollment token and issue the agent its credentials. An agent
+    re-enrolling keeps its server_id only if it names its current key and
+    proves(secret) confirms the request is signed with it; its keys are then
+    revoked. Otherwise it gets a new server_id and nothing is revoked: the
+    machine ID is no proof, since it appears in every payload.
+
+    Returns:
+        The issued credentials
+
+    Raises:
+        EnrollmentError: If the token is invalid, expired or already used, the
+            agent's env or owner team is outside the token's, or it names a
+            key it can't prove it holds
+    """
+    now = datetime.now(timezone.utc)
+    async with async_session_maker() as session:
+        async with session.begin():
+            # Spending the token in one statement keeps concurrent uses from both succeeding
+            result = await session.execute(
+                update(EnrollmentTokensModel)
+                .where(
+                    EnrollmentTokensModel.token_hash == hash_token(token),
+                    EnrollmentTokensModel.used_at.is_(None),
+                    EnrollmentTokensModel.expires_at > now,
+                )
+                .values(used_at=now)
+                .returning(EnrollmentTokensModel)
+            )
+            grant = result.scalar_one_or_none()
+            if grant is None:
+                raise EnrollmentError("Invalid, expired or already used enrollment token")
+            if grant.env and env and env != grant.env:
+                raise EnrollmentError(f"Enrollment token is for env {grant.env}, not {env}")
+            if grant.owner_team and owner_team and owner_team != grant.owner_team:
+                raise EnrollmentError(f"Enrollment token is for owner team {grant.owner_team}, not {owner_team}")
+            if grant.tenant and tenants.enabled:
+                tenant = tenants.by_name(grant.tenant)
+                if tenant is None:
+                    raise EnrollmentError(f"Tenant {grant.tenant} no longer exists")
+                if not tenant_allows(tenant, env, owner_team):
+                    raise EnrollmentError(f"Tenant {grant.tenant} may not submit env={env} owner_team={owner_team}")
+
+            server_id = None
+            if previous_key_id:
+                previous = await session.get(AgentCredentialsModel, previous_key_id)
+                if (previous is None or previous.revoked_at is not None or previous.tenant != grant.tenant
+                        or proves is None or not proves(previous.secret)):
+                    raise EnrollmentError(f"Re-enrollment is not signed with current key {previous_key_id}")
+                server_id = previous.server_id
+                await session.execute(
+                    update(AgentCredentialsModel)
+                    .where(
+                        AgentCredentialsModel.server_id == server_id,
+                        AgentCredentialsModel.tenant == grant.tenant,
+                        AgentCredentialsModel.revoked_at.is_(None),
+                    )
+                    .values(revoked_at=now)
+                )
+
+            credentials = AgentCredentialsModel(
+                key_id="ak_" + secrets.token_hex(8),
+                secret=secrets.token_urlsafe(32),
+                server_id=server_id or str(uuid.uuid4()),
+                machine_id=machine_id,
+                host=host,
+                agent_version=agent_version,
+                tenant=grant.tenant,
+                env=grant.env,
+                owner_team=grant.owner_team,
+                enrolled_at=now,
+            )
+            session.add(credentials)
+            grant.key_id = credentials.key_id
+
+    logger.info(f"Enrolled {host} as {credentials.server_id} with key {credentials.key_id}"
+                f"{' (re-enrollment)' if server_id else ''}")
+    return credentials
+
+
+async def lookup_key(key_id: str) -> Optional[APIKey]:
+    """
+    Find an enrolled agent's API key.
+
+    Returns:
+        The key, or None if it is unknown, revoked or its tenant was removed
+    """
+    async with async_session_maker() as session:
+        credentials = await session.get(AgentCredentialsModel, key_id)
+    if credentials is None or credentials.revoked_at is not None:
+        return None
+
+    if credentials.tenant and tenants.enabled:
+        tenant = tenants.by_name(credentials.tenant)
+        if tenant is None:
+            return None
+        # The server assigned the server_id, so the tenant's server ID
+        # patterns don't apply to it
+        tenant = Tenant(name=tenant.name, scope=Scope(envs=tenant.scope.envs, owner_teams=tenant.scope.owner_teams),
+                        admin=tenant.admin)
+    else:
+        tenant = Tenant(name=credentials.tenant or "default", scope=Scope())
+    return APIKey(
+        id=credentials.key_id,
+        secret=credentials.secret,
+        tenant=tenant,
+        scope=Scope(
+            envs=[credentials.env] if credentials.env else [],
+            owner_teams=[credentials.owner_team] if credentials.owner_team else [],
+            server_ids=[credentials.server_id],
+        ),
+    )
+
+
+async def revoke_key(key_id: str, tenant: Optional[str] = None) -> bool:
+    """
+    Revoke an enrolled agent's API key, optionally only if it belongs to tenant.
+
+    Returns:
+        False if no such active key exists
+    """
+    query = update(AgentCredentialsModel).where(
+        AgentCredentialsModel.key_id == key_id, AgentCredentialsModel.revoked_at.is_(None))
+    if tenant is not None:
+        query = query.where(AgentCredentialsModel.tenant == tenant)
+    async with async_session_maker() as session:
+        async with session.begin():
+            result = await session.execute(query.values(revoked_at=datetime.now(timezone.utc)))
+    if result.rowcount:
+        logger.info(f"Revoked agent key {key_id}")
+    return bool(result.rowcount)
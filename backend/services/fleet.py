@@ -0,0 +1,140 @@
+"""
+Fleet status: detects agents that stopped reporting.
+
+An agent that hasn't sent a payload for AGENT_SILENT_SECONDS gets an
+AGENT_SILENT alert, which is stored and routed like agent alerts. The alert
+is resolved once the agent reports again.
+
+Agents sending heartbeats between payloads are silent sooner, after
+HEARTBEAT_MISSED_BEATS of their heartbeat intervals without a heartbeat or
+payload, so a dead host is noticed within seconds.
+"""
+
+import logging
+import os
+from datetime import datetime, timedelta, timezone
+from typing import List, Optional
+
+from sqlalchemy import select, update
+from sqlalchemy.dialects.postgresql import insert as pg_insert
+
+from database import async_session_maker
+from db_models import AgentsModel, AlertsModel
+from models import Heartbeat
+
+logger = logging.getLogger("monitoring-backend")
+
+# Seconds without a payload after which an agent is considered silent
+AGENT_SILENT_SECONDS = int(os.environ.get("AGENT_SILENT_SECONDS", "300"))
+
+# Heartbeat intervals without a heartbeat after which an agent sending them
+# is considered silent
+HEARTBEAT_MISSED_BEATS = int(os.environ.get("HEARTBEAT_MISSED_BEATS", "3"))
+
+# Score difference from the moving average reported as a rise or fall
+SCORE_TREND_THRESHOLD = 5.0
+
+
+def last_heard(agent: AgentsModel) -> datetime:
+    """When the agent last sent a payload or heartbeat."""
+    if agent.last_heartbeat is not None and agent.last_heartbeat > agent.last_seen:
+        return agent.last_heartbeat
+    return agent.last_seen
+
+
+def silent_after(agent: AgentsModel) -> timedelta:
+    """How long the agent may stay quiet before it is silent."""
+    limit = timedelta(seconds=AGENT_SILENT_SECONDS)
+    if agent.heartbeat_interval:
+        limit = min(limit, timedelta(seconds=agent.heartbeat_interval * HEARTBEAT_MISSED_BEATS))
+    return limit
+
+
+def agent_status(agent: AgentsModel, now: datetime) -> str:
+    """Return "silent" for agents quiet for longer than silent_after, "ok" otherwise."""
+    if now - last_heard(agent) >= silent_after(agent):
+        return "silent"
+    return "ok"
+
+
+async def record_heartbeat(heartbeat: Heartbeat) -> None:
+    """
+    Note a verified heartbeat in the agent inventory. An agent's first
+    heartbeat adds it to the inventory as if it had reported.
+    """
+    now = datetime.now(timezone.utc)
+    values = {
+        "host": heartbeat.host,
+        "server_id": heartbeat.server_id,
+        "machine_id": heartbeat.machine_id,
+        "agent_version": heartbeat.agent_version,
+        "env": heartbeat.env,
+        "owner_team": heartbeat.owner_team,
+        "last_score": heartbeat.score,
+        "last_heartbeat": now,
+        "heartbeat_interval": heartbeat.interval,
+    }
+    stmt = pg_insert(AgentsModel).values(
+        agent_key=heartbeat.server_id or heartbeat.host, first_seen=now, last_seen=now,
+        score_avg=heartbeat.score, **values
+    )
+    async with async_session_maker() as session:
+        async with session.begin():
+            await session.execute(stmt.on_conflict_do_update(index_elements=["agent_key"], set_=values))
+
+
+def score_trend(agent: AgentsModel) -> Optional[str]:
+    """Compare the last score with the agent's moving average."""
+    if agent.last_score is None or agent.score_avg is None:
+        return None
+    delta = float(agent.last_score) - float(agent.score_avg)
+    if delta >= SCORE_TREND_THRESHOLD:
+        return "rising"
+    if delta <= -SCORE_TREND_THRESHOLD:
+        return "falling"
+    return "steady"
+
+
+async def check_silent_agents() -> List[AgentsModel]:
+    """
+    Open an AGENT_SILENT alert for each agent that went silent and resolve the
+    alerts of agents that reported again.
+
+    Returns:
+        Agents that newly went silent, for routing their alerts
+    """
+    now = datetime.now(timezone.utc)
+    async with async_session_maker() as session:
+        async with session.begin():
+            result = await session.execute(
+                select(AgentsModel).where(
+                    AgentsModel.silent_since.isnot(None),
+                    (AgentsModel.last_seen > AgentsModel.silent_since) | (AgentsModel.last_heartbeat > AgentsModel.silent_since)
+                )
+            )
+            for agent in result.scalars().all():
+                logger.info(f"Agent {agent.host} is reporting again after going silent at {agent.silent_since.isoformat()}")
+                if agent.silent_alert_id is not None:
+                    await session.execute(
+                        update(AlertsModel).where(AlertsModel.id == agent.silent_alert_id).values(resolved=True)
+                    )
+                agent.silent_since = None
+                agent.silent_alert_id = None
+
+            # Heartbeat intervals differ per agent, so the cutoff is checked per agent
+            result = await session.execute(select(AgentsModel).where(AgentsModel.silent_since.is_(None)))
+            silent = [agent for agent in result.scalars().all() if agent_status(agent, now) == "silent"]
+            for agent in silent:
+                alert = AlertsModel(
+                    timestamp=now,
+                    severity="HIGH",
+                    type="AGENT_SILENT",
+                    message=f"Agent {agent.host} has not reported since {last_heard(agent).isoformat()}",
+                    resolved=False
+                )
+                session.add(alert)
+                await session.flush()
+                agent.silent_since = now
+                agent.silent_alert_id = alert.id
+                logger.warning(f"Agent {agent.host} is silent, last heard from {last_heard(agent).isoformat()}")
+    return silent
@@ -0,0 +1,80 @@
+"""
+Grafana annotation channel for the alert router.
+
+When an alert group opens, an annotation is posted to the Grafana HTTP API,
+on a dashboard or panel if configured and otherwise as an organization
+annotation that dashboards pick up by tag. When the group closes, the
+annotation is turned into a region ending at the group's last alert, so
+graphs show how long RichardOps saw the problem.
+"""
+
+import os
+from typing import Any, Dict, List, Optional
+
+import requests
+
+
+def validate(name: str, channel: Dict[str, Any]) -> None:
+    """
+    Check a grafana channel's settings.
+
+    Raises:
+        ValueError: If the channel has no URL or API token
+    """
+    if not channel.get("url"):
+        raise ValueError(f"grafana channel {name!r} needs url")
+    if not channel.get("api_key") and not os.environ.get("GRAFANA_API_KEY"):
+        raise ValueError(f"grafana channel {name!r} needs api_key or GRAFANA_API_KEY")
+
+
+def group_tag(group_id: str) -> str:
+    """The tag that finds a group's annotation again when it closes."""
+    return f"richardops-group:{group_id}"
+
+
+def tags(channel: Dict[str, Any], group: Dict[str, Any]) -> List[str]:
+    scope = [f"{key}:{group[key]}" for key in ("env", "owner_team") if group[key]]
+    return ["richardops", group["alert_type"], *scope, group_tag(group["id"])] + channel.get("tags", [])
+
+
+def _request(channel: Dict[str, Any], method: str, path: str, **kwargs: Any) -> Any:
+    key = channel.get("api_key") or os.environ["GRAFANA_API_KEY"]
+    response = requests.request(method, channel["url"].rstrip("/") + path,
+                                headers={"Authorization": f"Bearer {key}"}, timeout=30, **kwargs)
+    response.raise_for_status()
+    return response.json()
+
+
+def _milliseconds(epoch: float) -> int:
+    return int(epoch * 1000)
+
+
+def _post(channel: Dict[str, Any], group: Dict[str, Any], text: str, time: float,
+          time_end: Optional[float] = None) -> None:
+    body: Dict[str, Any] = {"time": _milliseconds(time), "tags": tags(channel, group), "text": text}
+    if time_end is not None:
+        body["timeEnd"] = _milliseconds(time_end)
+    if channel.get("dashboard_uid"):
+        body["dashboardUID"] = channel["dashboard_uid"]
+        if channel.get("panel_id") is not None:
+            body["panelId"] = channel["panel_id"]
+    _request(channel, "POST", "/api/annotations", json=body)
+
+
+def annotate(channel: Dict[str, Any], group: Dict[str, Any], subject: str, message: str) -> None:
+    """Annotate the time a group opened."""
+    _post(channel, group, f"{subject}\n{message}", group["first_seen"])
+
+
+def resolve(channel: Dict[str, Any], group: Dict[str, Any], subject: str) -> None:
+    """Extend a group's annotation to a region ending at its last alert."""
+    found = _request(channel, "GET", "/api/annotations", params={"tags": group_tag(group["id"]), "limit": 1})
+    if not found:
+        # Opened before the channel was configured, or the annotation was deleted
+        _post(channel, group, subject, group["first_seen"], group["last_seen"])
+        return
+    annotation = found[0]
+    _request(channel, "PATCH", f"/api/annotations/{annotation['id']}", json={
+        "timeEnd": _milliseconds(group["last_seen"]),
+        "text": f"{annotation.get('text', '')}\n{subject}",
+    })
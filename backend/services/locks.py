@@ -0,0 +1,47 @@
+"""
+Cluster-wide locks for running several backend replicas.
+
+Replicas share nothing but their databases, so any of them can take any
+request. Jobs that must run once per cluster, like retention compaction,
+silent agent checks and alert escalation, hold a PostgreSQL advisory lock
+while they run; replicas that don't get it skip their turn.
+"""
+
+import hashlib
+from contextlib import asynccontextmanager
+from typing import AsyncIterator
+
+from sqlalchemy import func, select
+
+from database import engine
+
+
+def lock_key(name: str) -> int:
+    """A stable 64-bit advisory lock key for a job name."""
+    return int.from_bytes(hashlib.sha256(f"richardops:{name}".encode()).digest()[:8], "big", signed=True)
+
+
+@asynccontextmanager
+async def exclusive(name: str, wait: bool = False) -> AsyncIterator[bool]:
+    """
+    Hold the cluster-wide lock name for the block.
+
+    Args:
+        name: The job's name
+        wait: Wait for the lock rather than give up if another replica holds it
+
+    Yields:
+        Whether this replica holds the lock
+    """
+    key = lock_key(name)
+    async with engine.connect() as connection:
+        if wait:
+            await connection.execute(select(func.pg_advisory_lock(key)))
+            held = True
+        else:
+            held = (await connection.execute(select(func.pg_try_advisory_lock(key)))).scalar()
+        try:
+            yield held
+        finally:
+            if held:
+                await connection.execute(select(func.pg_advisory_unlock(key)))
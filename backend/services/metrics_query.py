@@ -0,0 +1,134 @@
+"""
+Historical metrics queries for dashboards and the Grafana datasource.
+
+A query aggregates one metric per host into evenly spaced buckets. Steps of
+whole hours are answered from the hourly rollups, which outlive raw
+metrics; shorter steps read raw metrics and only reach back as far as
+retention keeps them.
+"""
+
+import math
+from dataclasses import dataclass
+from datetime import datetime, timedelta, timezone
+from typing import Any, Dict, List, Optional, Tuple
+
+from storage.base import METRIC_ROLLUPS, PayloadStorage
+
+METRICS = tuple(METRIC_ROLLUPS)
+AGGREGATIONS = ("avg", "max")
+
+# Smallest step, the agents' usual reporting interval
+MIN_STEP_SECONDS = 60
+# Points per host aimed for when no step is given
+DEFAULT_POINTS = 500
+# Points per host above which a query is refused
+MAX_POINTS = 11000
+
+HOUR = 3600
+
+
+class QueryError(ValueError):
+    """A query that can't be answered, reported to the client as a 400."""
+
+
+@dataclass
+class MetricQuery:
+    metric: str
+    aggregation: str
+    start: datetime
+    end: datetime
+    step: int
+
+    @property
+    def uses_rollups(self) -> bool:
+        """Whole-hour steps read rollups unless they lack the maximum asked for."""
+        return self.step % HOUR == 0 and (self.aggregation == "avg" or METRIC_ROLLUPS[self.metric][1] is not None)
+
+
+def plan_query(metric: str, aggregation: str, start: datetime, end: datetime,
+               step: Optional[int] = None, points: int = DEFAULT_POINTS) -> MetricQuery:
+    """
+    Validate a query and pick its step.
+
+    Args:
+        metric: One of METRICS
+        aggregation: One of AGGREGATIONS
+        start: Start of the range; naive times are UTC
+        end: End of the range; naive times are UTC
+        step: Bucket width in seconds, or None to fit about points buckets
+        points: Buckets aimed for without a step
+
+    Returns:
+        The query, with start aligned down to the step
+
+    Raises:
+        QueryError: If the metric, aggregation, range or step is invalid
+    """
+    if metric not in METRICS:
+        raise QueryError(f"Unknown metric {metric} (available: {', '.join(METRICS)})")
+    if aggregation not in AGGREGATIONS:
+        raise QueryError(f"Unknown aggregation {aggregation} (available: {', '.join(AGGREGATIONS)})")
+    start, end = (t if t.tzinfo else t.replace(tzinfo=timezone.utc) for t in (start, end))
+    if end <= start:
+        raise QueryError("end must be after start")
+
+    seconds = (end - start).total_seconds()
+    if step is None:
+        step = max(MIN_STEP_SECONDS, math.ceil(seconds / max(points, 1)))
+        # Round up to whole minutes, or whole hours so that rollups can answer
+        unit = HOUR if step > HOUR else MIN_STEP_SECONDS
+        step = math.ceil(step / unit) * unit
+    elif step < MIN_STEP_SECONDS:
+        raise QueryError(f"step must be at least {MIN_STEP_SECONDS} seconds")
+    if seconds / step > MAX_POINTS:
+        raise QueryError(f"Query would return more than {MAX_POINTS} points per host; use a larger step")
+
+    aligned = datetime.fromtimestamp(start.timestamp() // step * step, timezone.utc)
+    return MetricQuery(metric, aggregation, aligned, end, step)
+
+
+def parse_target(target: str) -> Tuple[str, str]:
+    """Split a Grafana target of the form "metric" or "metric.aggregation"."""
+    metric, _, aggregation = target.partition(".")
+    return metric, aggregation or "avg"
+
+
+async def run_query(storage: PayloadStorage, query: MetricQuery,
+                    hosts: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+    """
+    Run a query against the payload storage.
+
+    Args:
+        storage: Storage holding the metrics
+        query: Query from plan_query
+        hosts: Only these hosts, None for all
+
+    Returns:
+        One series per host, sorted by host, each with its points as
+        (bucket start, value) sorted by time
+    """
+    rows = await storage.query_metric(query.metric, query.start, query.end, query.step, hosts, query.uses_rollups)
+
+    # Rollups and raw metrics may both cover a bucket
+    buckets: Dict[Tuple[str, datetime], List[float]] = {}
+    for row in rows:
+        if not row["samples"] or row["total"] is None:
+            continue
+        merged = buckets.setdefault((row["host"] or "", row["bucket"]), [0.0, 0, None])
+        merged[0] += float(row["total"])
+        merged[1] += int(row["samples"])
+        if row["maximum"] is not None:
+            merged[2] = float(row["maximum"]) if merged[2] is None else max(merged[2], float(row["maximum"]))
+
+    series: Dict[str, List[Tuple[datetime, float]]] = {}
+    for (host, bucket), (total, samples, maximum) in sorted(buckets.items()):
+        value = total / samples if query.aggregation == "avg" else maximum
+        if value is not None:
+            series.setdefault(host, []).append((bucket, round(value, 2)))
+    return [{"host": host, "points": points} for host, points in series.items()]
+
+
+def default_range(end: Optional[datetime] = None) -> Tuple[datetime, datetime]:
+    """The last hour, for queries without a range."""
+    end = end or datetime.now(timezone.utc)
+    return end - timedelta(hours=1), end
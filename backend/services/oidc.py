@@ -0,0 +1,342 @@
+"""
+OpenID Connect login for the dashboard and query API.
+
+With OIDC_ISSUER set, users sign in at /auth/login with the company's
+identity provider (authorization code flow with PKCE) and get a signed
+session cookie; scripts and Grafana send the provider's access token as a
+bearer token instead, which is checked with the provider's token
+introspection endpoint to be active and issued to or for OIDC_CLIENT_ID.
+Each user gets the highest role whose groups they are in:
+
+- viewer: read dashboards, metrics, logs, alerts and agents
+- operator: also acknowledge alert groups, command agents and evaluate rules
+- admin: also manage enrollment tokens and agent keys and reload rules
+"""
+
+import asyncio
+import base64
+import hashlib
+import hmac
+import json
+import logging
+import os
+import secrets
+import time
+from dataclasses import asdict, dataclass
+from typing import Any, Dict, List, Optional, Tuple
+from urllib.parse import urlencode
+
+import requests
+from cachetools import TTLCache
+
+logger = logging.getLogger("monitoring-backend")
+
+# Roles from least to most privileged
+ROLES = ("viewer", "operator", "admin")
+
+SESSION_COOKIE = "richardops_session"
+# Holds state, nonce and PKCE verifier between /auth/login and /auth/callback
+LOGIN_COOKIE = "richardops_login"
+LOGIN_TIMEOUT_SECONDS = 600
+
+# Seconds a bearer token's userinfo is reused before asking the provider again
+TOKEN_CACHE_SECONDS = 300
+
+
+def role_at_least(role: str, required: str) -> bool:
+    return ROLES.index(role) >= ROLES.index(required)
+
+
+class OIDCError(Exception):
+    """A login that failed or a user the configuration grants no access."""
+
+
+@dataclass
+class User:
+    """A signed-in user, as kept in the session cookie."""
+    subject: str
+    name: str
+    role: str
+    tenant: Optional[str]  # tenant name from OIDC_TENANT_CLAIM, None for all data
+    expires: int  # epoch seconds
+
+
+def _b64encode(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode()
+
+
+def _b64decode(text: str) -> bytes:
+    return base64.urlsafe_b64decode(text + "=" * (-len(text) % 4))
+
+
+def _claim(claims: Dict[str, Any], path: str) -> List[str]:
+    """Values of a claim, following dots into nested objects (e.g. realm_access.roles)."""
+    value: Any = claims
+    for part in path.split("."):
+        value = value.get(part) if isinstance(value, dict) else None
+    if value is None:
+        return []
+    if isinstance(value, str):
+        return value.replace(",", " ").split()
+    return [str(item) for item in value] if isinstance(value, list) else [str(value)]
+
+
+def _groups(name: str) -> List[str]:
+    return [group.strip() for group in os.environ.get(name, "").split(",") if group.strip()]
+
+
+class OIDCProvider:
+    """Runs the login flow against one identity provider and signs sessions."""
+
+    def __init__(
+        self,
+        issuer: Optional[str],
+        client_id: str = "",
+        client_secret: str = "",
+        redirect_url: Optional[str] = None,
+        scopes: str = "openid email profile",
+        roles_claim: str = "groups",
+        role_groups: Optional[Dict[str, List[str]]] = None,
+        tenant_claim: Optional[str] = None,
+        session_secret: Optional[str] = None,
+        session_hours: float = 8,
+    ):
+        self.issuer = issuer.rstrip("/") if issuer else None
+        self.client_id = client_id
+        self.client_secret = client_secret
+        self.redirect_url = redirect_url
+        self.scopes = scopes
+        self.roles_claim = roles_claim
+        self.role_groups = role_groups or {}
+        self.tenant_claim = tenant_claim
+        self.session_secret = (session_secret or secrets.token_hex(32)).encode()
+        self.session_seconds = int(session_hours * 3600)
+        self.metadata: Optional[Dict[str, Any]] = None
+        self.tokens: TTLCache = TTLCache(maxsize=10000, ttl=TOKEN_CACHE_SECONDS)
+
+    @property
+    def enabled(self) -> bool:
+        return bool(self.issuer)
+
+    @classmethod
+    def from_environment(cls) -> "OIDCProvider":
+        """Configure from OIDC_* variables; disabled without OIDC_ISSUER."""
+        issuer = os.environ.get("OIDC_ISSUER")
+        if not issuer:
+            return cls(None)
+        session_secret = os.environ.get("SESSION_SECRET")
+        if not session_secret:
+            logger.warning("SESSION_SECRET is not set; sessions end when the server restarts")
+        provider = cls(
+            issuer,
+            client_id=os.environ.get("OIDC_CLIENT_ID", ""),
+            client_secret=os.environ.get("OIDC_CLIENT_SECRET", ""),
+            redirect_url=os.environ.get("OIDC_REDIRECT_URL"),
+            scopes=os.environ.get("OIDC_SCOPES", "openid email profile"),
+            roles_claim=os.environ.get("OIDC_ROLES_CLAIM", "groups"),
+            role_groups={role: _groups(f"OIDC_{role.upper()}_GROUPS") for role in ROLES},
+            tenant_claim=os.environ.get("OIDC_TENANT_CLAIM"),
+            session_secret=session_secret,
+            session_hours=float(os.environ.get("SESSION_HOURS", "8")),
+        )
+        logger.info(f"OIDC login enabled with issuer {provider.issuer}")
+        return provider
+
+    # Signed cookies
+
+    def _sign(self, data: Dict[str, Any]) -> str:
+        body = _b64encode(json.dumps(data, separators=(",", ":")).encode())
+        return f"{body}.{hmac.new(self.session_secret, body.encode(), hashlib.sha256).hexdigest()}"
+
+    def _verify(self, value: str) -> Optional[Dict[str, Any]]:
+        body, _, signature = value.partition(".")
+        expected = hmac.new(self.session_secret, body.encode(), hashlib.sha256).hexdigest()
+        if not hmac.compare_digest(signature, expected):
+            return None
+        try:
+            data = json.loads(_b64decode(body))
+        except ValueError:
+            return None
+        return data if data.get("expires", 0) > time.time() else None
+
+    def session_cookie(self, user: User) -> str:
+        return self._sign(asdict(user))
+
+    def read_session(self, cookie: Optional[str]) -> Optional[User]:
+        """The user of a session cookie, or None if it's missing, forged or expired."""
+        data = self._verify(cookie) if cookie else None
+        return User(**data) if data else None
+
+    # Provider calls, made in a thread like ClickHouse requests
+
+    def _discover(self) -> Dict[str, Any]:
+        if self.metadata is None:
+            response = requests.get(f"{self.issuer}/.well-known/openid-configuration", timeout=10)
+            response.raise_for_status()
+            self.metadata = response.json()
+        return self.metadata
+
+    def _exchange(self, code: str, redirect_uri: str, verifier: str) -> Dict[str, Any]:
+        response = requests.post(self._discover()["token_endpoint"], data={
+            "grant_type": "authorization_code",
+            "code": code,
+            "redirect_uri": redirect_uri,
+            "code_verifier": verifier,
+        }, auth=(self.client_id, self.client_secret), timeout=10)
+        if response.status_code != 200:
+            raise OIDCError(f"token endpoint returned {response.status_code}: {response.text.strip()[:200]}")
+        return response.json()
+
+    def _userinfo(self, access_token: str) -> Optional[Dict[str, Any]]:
+        endpoint = self._discover().get("userinfo_endpoint")
+        if not endpoint:
+            return None
+        response = requests.get(endpoint, headers={"Authorization": f"Bearer {access_token}"}, timeout=10)
+        return response.json() if response.status_code == 200 else None
+
+    def _token_claims(self, access_token: str) -> Optional[Dict[str, Any]]:
+        """
+        Claims of a bearer access token, from introspection (RFC 7662) and
+        userinfo. Userinfo alone accepts tokens the provider issued to any of
+        its clients, so the token must be issued to or for this client.
+
+        Returns:
+            The claims, or None if the token isn't active
+
+        Raises:
+            OIDCError: If the provider can't introspect tokens or the token is
+                for another client or issuer
+        """
+        endpoint = self._discover().get("introspection_endpoint")
+        if not endpoint:
+            raise OIDCError("the provider has no token introspection endpoint to check bearer tokens with")
+        response = requests.post(endpoint, data={"token": access_token, "token_type_hint": "access_token"},
+                                 auth=(self.client_id, self.client_secret), timeout=10)
+        if response.status_code != 200:
+            raise OIDCError(f"introspection endpoint returned {response.status_code}")
+        introspected = response.json()
+        if not introspected.get("active"):
+            return None
+        audience = introspected.get("aud")
+        audiences = audience if isinstance(audience, list) else [audience]
+        if self.client_id not in audiences and self.client_id not in (introspected.get("azp"), introspected.get("client_id")):
+            raise OIDCError(f"token was issued for client {introspected.get('azp') or introspected.get('client_id')}, "
+                            f"not {self.client_id}")
+        if introspected.get("iss") and introspected["iss"].rstrip("/") != self.issuer:
+            raise OIDCError(f"token was issued by {introspected['iss']}")
+        # Group claims are often only in userinfo
+        return {**(self._userinfo(access_token) or {}), **introspected}
+
+    # Login flow
+
+    async def login_redirect(self, redirect_uri: str, next_path: str) -> Tuple[str, str]:
+        """
+        Start a login.
+
+        Returns:
+            The provider's authorization URL and the value of LOGIN_COOKIE
+        """
+        metadata = await asyncio.to_thread(self._discover)
+        state, nonce, verifier = secrets.token_urlsafe(24), secrets.token_urlsafe(24), secrets.token_urlsafe(48)
+        challenge = _b64encode(hashlib.sha256(verifier.encode()).digest())
+        url = metadata["authorization_endpoint"] + "?" + urlencode({
+            "response_type": "code",
+            "client_id": self.client_id,
+            "redirect_uri": redirect_uri,
+            "scope": self.scopes,
+            "state": state,
+            "nonce": nonce,
+            "code_challenge": challenge,
+            "code_challenge_method": "S256",
+        })
+        cookie = self._sign({
+            "state": state, "nonce": nonce, "verifier": verifier, "next": next_path,
+            "expires": int(time.time()) + LOGIN_TIMEOUT_SECONDS,
+        })
+        return url, cookie
+
+    async def complete(self, code: str, state: str, login_cookie: Optional[str], redirect_uri: str) -> Tuple[User, str]:
+        """
+        Finish a login on the callback.
+
+        Returns:
+            The user and the path to return to
+
+        Raises:
+            OIDCError: If the login doesn't match the one started, the
+                provider rejects the code or the user has no role
+        """
+        login = self._verify(login_cookie) if login_cookie else None
+        if login is None or not hmac.compare_digest(login["state"], state):
+            raise OIDCError("login expired or was started elsewhere")
+        tokens = await asyncio.to_thread(self._exchange, code, redirect_uri, login["verifier"])
+
+        # The ID token comes straight from the token endpoint over TLS, which
+        # OIDC Core 3.1.3.7 accepts in place of checking its signature
+        try:
+            claims = json.loads(_b64decode(tokens["id_token"].split(".")[1]))
+        except (KeyError, IndexError, ValueError):
+            raise OIDCError("token endpoint returned no valid ID token")
+        audience = claims.get("aud")
+        if claims.get("iss", "").rstrip("/") != self.issuer or \
+                self.client_id not in (audience if isinstance(audience, list) else [audience]):
+            raise OIDCError("ID token was issued for another issuer or client")
+        if claims.get("exp", 0) < time.time() or claims.get("nonce") != login["nonce"]:
+            raise OIDCError("ID token is expired or replayed")
+
+        # Group claims are often only in userinfo
+        if tokens.get("access_token"):
+            claims = {**(await asyncio.to_thread(self._userinfo, tokens["access_token"]) or {}), **claims}
+        return self.user_from_claims(claims, int(time.time()) + self.session_seconds), login["next"]
+
+    async def user_for_token(self, access_token: str) -> Optional[User]:
+        """
+        The user of a bearer access token, checked by introspection and cached
+        for TOKEN_CACHE_SECONDS.
+
+        Returns:
+            The user, or None if the provider doesn't accept the token or the
+            user has no role
+        """
+        key = hashlib.sha256(access_token.encode()).hexdigest()
+        if key not in self.tokens:
+            user = None
+            try:
+                claims = await asyncio.to_thread(self._token_claims, access_token)
+                if claims is not None:
+                    user = self.user_from_claims(claims, int(time.time()) + TOKEN_CACHE_SECONDS)
+            except OIDCError as e:
+                logger.warning(f"Rejected bearer token: {e}")
+            except requests.RequestException as e:
+                logger.error(f"OIDC introspection request failed: {e}")
+                return None
+            self.tokens[key] = user
+        return self.tokens[key]
+
+    def user_from_claims(self, claims: Dict[str, Any], expires: int) -> User:
+        """
+        Map a user's claims to a role and tenant.
+
+        Raises:
+            OIDCError: If the user is in none of the role groups or lacks the
+                tenant claim
+        """
+        name = claims.get("email") or claims.get("preferred_username") or claims.get("sub", "")
+        groups = set(_claim(claims, self.roles_claim))
+        role = None
+        for candidate in reversed(ROLES):
+            allowed = self.role_groups.get(candidate)
+            # Without viewer groups every user of the provider may view
+            if (allowed and groups & set(allowed)) or (candidate == "viewer" and not allowed):
+                role = candidate
+                break
+        if role is None:
+            raise OIDCError(f"{name} is in none of the groups granted a role")
+
+        tenant = None
+        if self.tenant_claim:
+            values = _claim(claims, self.tenant_claim)
+            if not values:
+                raise OIDCError(f"{name} has no {self.tenant_claim} claim")
+            tenant = values[0]
+        return User(subject=claims.get("sub", ""), name=name, role=role, tenant=tenant, expires=expires)
@@ -0,0 +1,103 @@
+"""
+Opsgenie channel for the alert router.
+
+An alert group becomes one Opsgenie alert, aliased by the group's ID so that
+summaries and escalations of the group update it instead of opening more,
+and is closed when the group goes quiet. The priority follows the alert's
+severity and the payload score; the responding team follows the agent's
+owner team.
+"""
+
+import os
+from typing import Any, Dict, List, Optional
+from urllib.parse import quote
+
+import requests
+
+DEFAULT_API_URL = "https://api.opsgenie.com"
+
+# First matching rule wins; rules may set severity ("critical" or
+# "warning") and min_score
+DEFAULT_PRIORITIES = [
+    {"severity": "critical", "min_score": 1.0, "priority": "P1"},
+    {"severity": "critical", "priority": "P2"},
+    {"min_score": 0.5, "priority": "P3"},
+    {"priority": "P4"},
+]
+
+PRIORITIES = ("P1", "P2", "P3", "P4", "P5")
+
+# Opsgenie truncates longer messages
+MAX_MESSAGE_LENGTH = 130
+
+
+def validate(name: str, channel: Dict[str, Any]) -> None:
+    """
+    Check an opsgenie channel's settings.
+
+    Raises:
+        ValueError: If the channel has no API key or an invalid priority
+    """
+    if not channel.get("api_key") and not os.environ.get("OPSGENIE_API_KEY"):
+        raise ValueError(f"opsgenie channel {name!r} needs api_key or OPSGENIE_API_KEY")
+    for rule in channel.get("priorities", []):
+        if rule.get("priority") not in PRIORITIES:
+            raise ValueError(f"opsgenie channel {name!r} has invalid priority {rule.get('priority')!r}")
+
+
+def priority(channel: Dict[str, Any], severity: str, score: float) -> str:
+    """The priority of the first of the channel's rules matching an alert."""
+    for rule in channel.get("priorities", DEFAULT_PRIORITIES):
+        if rule.get("severity", severity) == severity and score >= rule.get("min_score", 0.0):
+            return rule["priority"]
+    return "P3"
+
+
+def responders(channel: Dict[str, Any], owner_team: Optional[str]) -> List[Dict[str, str]]:
+    """
+    The team responding to an alert: the owner team, renamed by the channel's
+    teams map, or the channel's default team.
+    """
+    teams = channel.get("teams", {})
+    team = teams.get(owner_team, owner_team) if owner_team else None
+    team = team or channel.get("team")
+    return [{"type": "team", "name": team}] if team else []
+
+
+def alias(group_id: str) -> str:
+    return f"richardops-{group_id}"
+
+
+def _request(channel: Dict[str, Any], path: str, body: Dict[str, Any]) -> None:
+    url = channel.get("api_url", DEFAULT_API_URL).rstrip("/") + path
+    key = channel.get("api_key") or os.environ["OPSGENIE_API_KEY"]
+    response = requests.post(url, json=body, headers={"Authorization": f"GenieKey {key}"}, timeout=30)
+    response.raise_for_status()
+
+
+def create_alert(channel: Dict[str, Any], group: Dict[str, Any], subject: str, message: str, severity: str) -> None:
+    """Create the group's alert, or add to the count of the one already open."""
+    body = {
+        "message": subject[:MAX_MESSAGE_LENGTH],
+        "alias": alias(group["id"]),
+        "description": message,
+        "priority": priority(channel, severity, group["score"]),
+        "responders": responders(channel, group["owner_team"]),
+        "tags": [group["alert_type"], severity] + [t for t in (group["env"],) if t] + channel.get("tags", []),
+        "details": {
+            "route": group["route"],
+            "env": group["env"] or "",
+            "owner_team": group["owner_team"] or "",
+            "score": str(group["score"]),
+            "hosts": ", ".join(sorted(group["hosts"])),
+        },
+        "entity": next(iter(sorted(group["hosts"])), ""),
+        "source": "RichardOps",
+    }
+    _request(channel, "/v2/alerts", body)
+
+
+def close_alert(channel: Dict[str, Any], group: Dict[str, Any], message: str) -> None:
+    """Close the group's alert."""
+    path = f"/v2/alerts/{quote(alias(group['id']), safe='')}/close?identifierType=alias"
+    _request(channel, path, {"source": "RichardOps", "note": message})
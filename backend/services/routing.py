@@ -0,0 +1,484 @@
+"""
+Alert routing and notification engine.
+
+Agent alerts are matched against routes by alert type, env, owner team and
+payload score, and sent to the route's notification channels. Repeats of an
+alert within a route's group window are folded into one group and summarized
+instead of notifying on every payload; groups still firing and not
+acknowledged escalate to further channels after a delay. Open groups are kept
+in PostgreSQL, so every replica of the backend folds repeats into the same
+group and acknowledgements apply everywhere.
+
+Channels that track alerts on their side, like Opsgenie and Grafana
+annotations, are also told when a group closes. Ticket channels (Jira,
+ServiceNow) open a ticket only for groups that keep firing and resolve it
+when the group closes.
+
+Alerts matching an active silence (services/silences.py) aren't routed.
+
+Routes and channels are read from the JSON file in ALERT_ROUTING_CONFIG.
+Without one, critical alerts are sent to ALERT_EMAIL.
+"""
+
+import asyncio
+import html
+import json
+import logging
+import os
+import time
+import uuid
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Callable, Dict, List, Optional
+
+import requests
+from sqlalchemy import select, update
+from sqlalchemy.dialects.postgresql import insert as pg_insert
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from database import async_session_maker
+from db_models import AlertGroupsModel
+from services.alerts import CRITICAL_ALERTS
+from services import chat, grafana_annotations, opsgenie, tickets
+from services.email import send_alert_email
+from services.silences import active_silences
+
+logger = logging.getLogger("monitoring-backend")
+
+# Default seconds during which repeats of an alert are grouped
+DEFAULT_GROUP_WINDOW = 300
+
+# Channel types that open a ticket for groups firing longer than their
+# open_after_seconds
+TICKET_CHANNELS = ("jira", "servicenow")
+
+# Channel types that are notified when a group closes
+RESOLVABLE_CHANNELS = ("opsgenie", "grafana") + TICKET_CHANNELS
+
+
+@dataclass
+class Escalation:
+    """Channels notified once a group has been firing for after_seconds."""
+    after_seconds: int
+    channels: List[str]
+
+
+@dataclass
+class Route:
+    """Which alerts go to which channels. Empty match lists match anything."""
+    name: str
+    channels: List[str]
+    types: List[str] = field(default_factory=list)
+    envs: List[str] = field(default_factory=list)
+    owner_teams: List[str] = field(default_factory=list)
+    min_score: float = 0.0
+    group_window: int = DEFAULT_GROUP_WINDOW
+    escalations: List[Escalation] = field(default_factory=list)
+    continue_matching: bool = False
+
+    def matches(self, alert_type: str, env: Optional[str], owner_team: Optional[str], score: float) -> bool:
+        return (
+            (not self.types or alert_type in self.types)
+            and (not self.envs or env in self.envs)
+            and (not self.owner_teams or owner_team in self.owner_teams)
+            and score >= self.min_score
+        )
+
+
+@dataclass
+class AlertGroup:
+    """Occurrences of one alert type routed by one route for one env and team."""
+    id: str
+    route: Route
+    alert_type: str
+    env: Optional[str]
+    owner_team: Optional[str]
+    first_seen: float
+    last_seen: float
+    notified_at: float
+    score: float = 0.0  # highest payload score seen
+    count: int = 1
+    pending: int = 0  # occurrences since the last notification
+    hosts: Dict[str, int] = field(default_factory=dict)
+    alerts: Dict[str, int] = field(default_factory=dict)
+    escalation_level: int = 0
+    acknowledged: bool = False
+    tickets: Dict[str, Dict[str, str]] = field(default_factory=dict)  # channel -> ticket key and URL
+
+    def add(self, host: str, alert: str, now: float) -> None:
+        self.hosts[host] = self.hosts.get(host, 0) + 1
+        self.alerts[alert] = self.alerts.get(alert, 0) + 1
+        self.last_seen = now
+
+    def active(self, now: float) -> bool:
+        return now - self.last_seen < self.route.group_window
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {
+            "id": self.id,
+            "route": self.route.name,
+            "alert_type": self.alert_type,
+            "env": self.env,
+            "owner_team": self.owner_team,
+            "count": self.count,
+            "score": self.score,
+            "hosts": dict(self.hosts),
+            "alerts": dict(self.alerts),
+            "first_seen": self.first_seen,
+            "last_seen": self.last_seen,
+            "escalation_level": self.escalation_level,
+            "acknowledged": self.acknowledged,
+            "tickets": dict(self.tickets),
+        }
+
+
+@dataclass
+class Notification:
+    """A message for a set of channels about an alert group."""
+    channels: List[str]
+    subject: str
+    message: str
+    group: Dict[str, Any]
+    severity: str  # "critical" or "warning"
+    event: str  # "opened", "repeated", "escalated", "ticket" or "resolved"
+
+
+def alert_type(alert: str) -> str:
+    """Strip an alert's qualifier, e.g. BRUTE_FORCE:10.0.0.1 -> BRUTE_FORCE."""
+    return alert.split(":", 1)[0]
+
+
+def group_key(route: str, kind: str, env: Optional[str], owner_team: Optional[str]) -> str:
+    """Identify the open group of an alert type per route, env and team."""
+    return json.dumps([route, kind, env, owner_team])
+
+
+def _time(epoch: float) -> datetime:
+    return datetime.fromtimestamp(epoch, timezone.utc)
+
+
+class AlertRouter:
+    """Matches alerts to routes, groups repeats and tracks escalation."""
+
+    def __init__(self, routes: List[Route], channels: Dict[str, Dict[str, Any]], clock: Callable[[], float] = time.time):
+        self.routes = routes
+        self.channels = channels
+        self.clock = clock
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any]) -> "AlertRouter":
+        """
+        Build a router from a config dict of the form
+        {"channels": {name: {"type": "email" | "webhook", ...}}, "routes": [...]}.
+
+        Raises:
+            ValueError: If a route refers to an unknown channel
+        """
+        channels = config.get("channels", {})
+        routes = []
+        for i, spec in enumerate(config.get("routes", [])):
+            match = spec.get("match", {})
+            route = Route(
+                name=spec.get("name", f"route-{i + 1}"),
+                channels=spec.get("channels", []),
+                types=match.get("type", []),
+                envs=match.get("env", []),
+                owner_teams=match.get("owner_team", []),
+                min_score=match.get("min_score", 0.0),
+                group_window=spec.get("group_window_seconds", DEFAULT_GROUP_WINDOW),
+                escalations=[Escalation(e["after_seconds"], e["channels"]) for e in spec.get("escalate", [])],
+                continue_matching=spec.get("continue", False),
+            )
+            for name in route.channels + [c for e in route.escalations for c in e.channels]:
+                if name not in channels:
+                    raise ValueError(f"route {route.name} uses unknown channel {name!r}")
+            routes.append(route)
+        for name, channel in channels.items():
+            if channel.get("type") == "opsgenie":
+                opsgenie.validate(name, channel)
+            elif channel.get("type") == "grafana":
+                grafana_annotations.validate(name, channel)
+            elif channel.get("type") in TICKET_CHANNELS:
+                tickets.validate(name, channel)
+        return cls(routes, channels)
+
+    @classmethod
+    def from_environment(cls) -> "AlertRouter":
+        """Load ALERT_ROUTING_CONFIG, or route critical alerts to ALERT_EMAIL."""
+        path = os.environ.get("ALERT_ROUTING_CONFIG")
+        if path:
+            with open(path) as f:
+                return cls.from_config(json.load(f))
+
+        alert_email = os.environ.get("ALERT_EMAIL")
+        if not alert_email:
+            logger.warning("Neither ALERT_ROUTING_CONFIG nor ALERT_EMAIL is set, agent alerts won't be routed")
+            return cls([], {})
+        return cls.from_config({
+            "channels": {"email": {"type": "email", "to": [alert_email]}},
+            "routes": [{"name": "critical", "match": {"type": CRITICAL_ALERTS}, "channels": ["email"]}],
+        })
+
+    async def route(self, host: str, alerts: List[str], env: Optional[str], owner_team: Optional[str], score: float) -> List[Notification]:
+        """
+        Group a payload's alerts and return the notifications due now: one per
+        new group. Repeats within a group's window are summarized by tick().
+        """
+        if not alerts or not self.routes:
+            return []
+        silences = await active_silences()
+        matched = []
+        for alert in alerts:
+            kind = alert_type(alert)
+            if any(silence.matches(kind, host) for silence in silences):
+                continue
+            for route in self.routes:
+                if not route.matches(kind, env, owner_team, score):
+                    continue
+                matched.append((route, kind, alert))
+                if not route.continue_matching:
+                    break
+        if not matched:
+            return []
+
+        now = self.clock()
+        notifications = []
+        async with async_session_maker() as session:
+            async with session.begin():
+                for route, kind, alert in matched:
+                    group = AlertGroup(
+                        id=uuid.uuid4().hex[:12], route=route, alert_type=kind, env=env, owner_team=owner_team,
+                        first_seen=now, last_seen=now, notified_at=now, score=score,
+                    )
+                    group.add(host, alert, now)
+                    if await self._record(session, group):
+                        notifications.append(self._notification(group, route.channels, "opened", "New alert"))
+        return notifications
+
+    async def _record(self, session: AsyncSession, new: AlertGroup) -> bool:
+        """
+        Fold an occurrence into its open group, or open new as the group.
+
+        Returns:
+            True if new was opened
+        """
+        key = group_key(new.route.name, new.alert_type, new.env, new.owner_team)
+        query = select(AlertGroupsModel).where(AlertGroupsModel.group_key == key).with_for_update()
+        row = (await session.execute(query)).scalar_one_or_none()
+        if row is None:
+            # Another replica may open the same group concurrently; the
+            # unique key lets exactly one of them in
+            inserted = await session.execute(
+                pg_insert(AlertGroupsModel).values(group_key=key, **self._columns(new))
+                .on_conflict_do_nothing(index_elements=["group_key"])
+                .returning(AlertGroupsModel.id)
+            )
+            if inserted.scalar() is not None:
+                return True
+            row = (await session.execute(query)).scalar_one()
+
+        group = self._group(row)
+        if group is None or not group.active(new.last_seen):
+            self._store(row, new)
+            return True
+        host, alert = next(iter(new.hosts)), next(iter(new.alerts))
+        group.add(host, alert, new.last_seen)
+        group.count += 1
+        group.pending += 1
+        group.score = max(group.score, new.score)
+        self._store(row, group)
+        return False
+
+    async def tick(self) -> List[Notification]:
+        """
+        Return summaries of groups with unreported repeats whose window has
+        passed and escalations that are due, and drop groups that went quiet,
+        resolving them on the resolvable channels they were sent to. Only one
+        replica should tick at a time.
+        """
+        now = self.clock()
+        notifications = []
+        async with async_session_maker() as session:
+            async with session.begin():
+                rows = (await session.execute(select(AlertGroupsModel).with_for_update())).scalars().all()
+                for row in rows:
+                    group = self._group(row)
+                    if group is None:
+                        await session.delete(row)
+                        continue
+                    route = group.route
+                    if group.pending and now - group.notified_at >= route.group_window:
+                        notifications.append(self._notification(group, route.channels, "repeated", f"{group.pending} more"))
+                        group.pending = 0
+                        group.notified_at = now
+
+                    if not group.active(now):
+                        resolvable = self._resolvable(group)
+                        if resolvable:
+                            notifications.append(self._notification(group, resolvable, "resolved", "Resolved"))
+                        await session.delete(row)
+                        continue
+
+                    if not group.acknowledged and group.escalation_level < len(route.escalations):
+                        escalation = route.escalations[group.escalation_level]
+                        if now - group.first_seen >= escalation.after_seconds:
+                            group.escalation_level += 1
+                            notifications.append(self._notification(
+                                group, escalation.channels, "escalated", f"Escalated (level {group.escalation_level})"))
+
+                    # Tickets are opened whether or not the group was acknowledged
+                    for name in self._sent(group):
+                        channel = self.channels[name]
+                        persisting = now - group.first_seen
+                        if channel.get("type") in TICKET_CHANNELS and name not in group.tickets and \
+                                persisting >= channel.get("open_after_seconds", tickets.DEFAULT_OPEN_AFTER_SECONDS):
+                            notifications.append(self._notification(
+                                group, [name], "ticket", f"Firing for {int(persisting // 60)} minutes"))
+                    self._store(row, group)
+        return notifications
+
+    async def acknowledge(self, group_id: str) -> bool:
+        """Stop escalating a group. Returns False if no such group is open."""
+        async with async_session_maker() as session:
+            async with session.begin():
+                result = await session.execute(
+                    update(AlertGroupsModel).where(AlertGroupsModel.id == group_id).values(acknowledged=True)
+                )
+        return result.rowcount > 0
+
+    async def list_groups(self) -> List[Dict[str, Any]]:
+        """Open alert groups, most recently seen first."""
+        async with async_session_maker() as session:
+            result = await session.execute(select(AlertGroupsModel).order_by(AlertGroupsModel.last_seen.desc()))
+            groups = [self._group(row) for row in result.scalars()]
+        return [group.to_dict() for group in groups if group is not None]
+
+    def _group(self, row: AlertGroupsModel) -> Optional[AlertGroup]:
+        """The group a row holds, or None if its route is no longer configured."""
+        route = next((r for r in self.routes if r.name == row.route), None)
+        if route is None:
+            return None
+        return AlertGroup(
+            id=row.id, route=route, alert_type=row.alert_type, env=row.env, owner_team=row.owner_team,
+            first_seen=row.first_seen.timestamp(), last_seen=row.last_seen.timestamp(),
+            notified_at=row.notified_at.timestamp(), score=float(row.score), count=row.count, pending=row.pending,
+            hosts=json.loads(row.hosts), alerts=json.loads(row.alerts),
+            escalation_level=row.escalation_level, acknowledged=row.acknowledged,
+            tickets=json.loads(row.tickets or "{}"),
+        )
+
+    @staticmethod
+    def _columns(group: AlertGroup) -> Dict[str, Any]:
+        return {
+            "id": group.id,
+            "route": group.route.name,
+            "alert_type": group.alert_type,
+            "env": group.env,
+            "owner_team": group.owner_team,
+            "first_seen": _time(group.first_seen),
+            "last_seen": _time(group.last_seen),
+            "notified_at": _time(group.notified_at),
+            "score": group.score,
+            "count": group.count,
+            "pending": group.pending,
+            "hosts": json.dumps(group.hosts),
+            "alerts": json.dumps(group.alerts),
+            "escalation_level": group.escalation_level,
+            "acknowledged": group.acknowledged,
+            "tickets": json.dumps(group.tickets),
+        }
+
+    def _store(self, row: AlertGroupsModel, group: AlertGroup) -> None:
+        for column, value in self._columns(group).items():
+            setattr(row, column, value)
+
+    def _sent(self, group: AlertGroup) -> List[str]:
+        """Channels the group was sent to, at opening or escalation."""
+        sent = group.route.channels + [c for e in group.route.escalations[:group.escalation_level] for c in e.channels]
+        return list(dict.fromkeys(sent))
+
+    def _resolvable(self, group: AlertGroup) -> List[str]:
+        return [name for name in self._sent(group) if self.channels[name].get("type") in RESOLVABLE_CHANNELS]
+
+    def _notification(self, group: AlertGroup, channels: List[str], event: str, reason: str) -> Notification:
+        scope = " / ".join(x for x in (group.env, group.owner_team) if x) or "all"
+        hosts = ", ".join(f"{host} ({n})" for host, n in sorted(group.hosts.items()))
+        icon = "✅" if event == "resolved" else "🚨"
+        subject = f"{icon} {reason}: {group.alert_type} [{scope}]"
+        message = (
+            f"{group.alert_type} fired {group.count} time(s) on {len(group.hosts)} host(s): {hosts}\n"
+            f"Alerts: {', '.join(sorted(group.alerts))}\n"
+            f"Route: {group.route.name}, group {group.id}"
+        )
+        return Notification(
+            channels=list(channels), subject=subject, message=message, group=group.to_dict(),
+            severity="critical" if group.alert_type in CRITICAL_ALERTS else "warning", event=event,
+        )
+
+    async def dispatch(self, notifications: List[Notification]) -> None:
+        """Send notifications, logging channel failures instead of raising."""
+        for notification in notifications:
+            for name in notification.channels:
+                try:
+                    ticket = await asyncio.to_thread(self._send, name, notification)
+                    logger.info(f"Notification sent to {name}: {notification.subject}")
+                    if ticket is not None:
+                        await self._save_ticket(notification.group["id"], name, ticket)
+                except Exception as e:
+                    logger.error(f"Failed to notify {name}: {str(e)}")
+
+    async def _save_ticket(self, group_id: str, name: str, ticket: Dict[str, str]) -> None:
+        """Keep a ticket opened for a group; a group closed meanwhile keeps it open."""
+        async with async_session_maker() as session:
+            async with session.begin():
+                query = select(AlertGroupsModel).where(AlertGroupsModel.id == group_id).with_for_update()
+                row = (await session.execute(query)).scalar_one_or_none()
+                if row is None:
+                    logger.warning(f"Alert group {group_id} closed while ticket {ticket['key']} was opened")
+                    return
+                row.tickets = json.dumps({**json.loads(row.tickets or "{}"), name: ticket})
+        logger.info(f"Opened ticket {ticket['key']} on {name} for alert group {group_id}")
+
+    def _send(self, name: str, notification: Notification) -> Optional[Dict[str, str]]:
+        """Send a notification to a channel; returns the ticket opened, if any."""
+        channel = self.channels[name]
+        kind = channel.get("type")
+        if kind == "email":
+            recipients = channel["to"] if isinstance(channel["to"], list) else [channel["to"]]
+            content = f"<pre style='font-family: Arial, sans-serif;'>{html.escape(notification.message)}</pre>"
+            for recipient in recipients:
+                send_alert_email(notification.subject, content, recipient)
+        elif kind == "opsgenie":
+            if notification.event == "resolved":
+                opsgenie.close_alert(channel, notification.group, notification.message)
+            else:
+                opsgenie.create_alert(channel, notification.group, notification.subject,
+                                      notification.message, notification.severity)
+        elif kind == "grafana":
+            if notification.event == "opened":
+                grafana_annotations.annotate(channel, notification.group, notification.subject, notification.message)
+            elif notification.event == "resolved":
+                grafana_annotations.resolve(channel, notification.group, notification.subject)
+        elif kind in TICKET_CHANNELS:
+            if notification.event == "ticket":
+                return tickets.open_ticket(channel, notification.group, notification.subject,
+                                           notification.message, notification.severity)
+            ticket = notification.group["tickets"].get(name)
+            if notification.event == "resolved" and ticket:
+                tickets.close_ticket(channel, ticket, notification.message)
+        elif kind in ("discord", "teams"):
+            format_message = chat.discord_message if kind == "discord" else chat.teams_message
+            body = format_message(channel, notification.subject, notification.message,
+                                  notification.severity, notification.group)
+            response = requests.post(channel["url"], json=body, timeout=30)
+            response.raise_for_status()
+        elif kind == "webhook":
+            response = requests.post(channel["url"], json={
+                "subject": notification.subject,
+                "message": notification.message,
+                "group": notification.group,
+            }, headers=channel.get("headers", {}), timeout=30)
+            response.raise_for_status()
+        else:
+            raise ValueError(f"unknown channel type {kind!r}")
+        return None
@@ -0,0 +1,96 @@
+"""
+Alert silences.
+
+A silence stops an alert type, on one host or all of them, from being routed
+to any channel until it expires. Alerts are still stored and shown. Silences
+are kept in PostgreSQL, so they apply on every replica.
+"""
+
+import re
+import uuid
+from dataclasses import dataclass
+from datetime import datetime, timedelta, timezone
+from typing import List, Optional
+
+from sqlalchemy import delete, or_, select
+
+from database import async_session_maker
+from db_models import AlertSilencesModel
+
+# Longest silence accepted, so a forgotten one can't hide an alert for good
+MAX_SILENCE = timedelta(days=30)
+
+DURATION_UNITS = {"s": 1, "m": 60, "h": 3600, "d": 86400}
+
+
+@dataclass
+class Silence:
+    id: str
+    alert_type: str
+    host: Optional[str]
+    created_by: str
+    expires_at: datetime
+
+    def matches(self, alert_type: str, host: str) -> bool:
+        return self.alert_type == alert_type and (self.host is None or self.host == host)
+
+
+def parse_duration(text: str) -> timedelta:
+    """
+    Parse a duration such as 90s, 30m, 1h or 2d.
+
+    Raises:
+        ValueError: If the duration is malformed or longer than MAX_SILENCE
+    """
+    match = re.fullmatch(r"(\d+)([smhd])", text.strip().lower())
+    if not match:
+        raise ValueError(f"invalid duration {text!r} (use e.g. 30m, 1h or 2d)")
+    duration = timedelta(seconds=int(match.group(1)) * DURATION_UNITS[match.group(2)])
+    if not timedelta(0) < duration <= MAX_SILENCE:
+        raise ValueError(f"duration must be between 1s and {MAX_SILENCE.days}d")
+    return duration
+
+
+def _silence(row: AlertSilencesModel) -> Silence:
+    return Silence(row.id, row.alert_type, row.host, row.created_by, row.expires_at)
+
+
+async def add_silence(alert_type: str, duration: timedelta, created_by: str, host: Optional[str] = None) -> Silence:
+    """Silence an alert type, on host only if given, for duration."""
+    now = datetime.now(timezone.utc)
+    row = AlertSilencesModel(
+        id=uuid.uuid4().hex[:12], alert_type=alert_type.upper(), host=host,
+        created_by=created_by, created_at=now, expires_at=now + duration,
+    )
+    async with async_session_maker() as session:
+        async with session.begin():
+            # Expired silences are cleared out whenever one is added
+            await session.execute(delete(AlertSilencesModel).where(AlertSilencesModel.expires_at <= now))
+            session.add(row)
+    return _silence(row)
+
+
+async def remove_silences(target: str) -> int:
+    """
+    End silences early by ID, or all silences of an alert type.
+
+    Returns:
+        The number of silences removed
+    """
+    async with async_session_maker() as session:
+        async with session.begin():
+            result = await session.execute(delete(AlertSilencesModel).where(
+                or_(AlertSilencesModel.id == target, AlertSilencesModel.alert_type == target.upper())
+            ))
+    return result.rowcount
+
+
+async def active_silences() -> List[Silence]:
+    """Unexpired silences, soonest to expire first."""
+    async with async_session_maker() as session:
+        result = await session.execute(
+            select(AlertSilencesModel)
+            .where(AlertSilencesModel.expires_at > datetime.now(timezone.utc))
+            .order_by(AlertSilencesModel.expires_at)
+        )
+        return [_silence(row) for row in result.scalars()]
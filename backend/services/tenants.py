@@ -0,0 +1,253 @@
+"""
+Multi-tenant API keys.
+
+TENANTS_CONFIG names a JSON file of tenants. Each tenant has ingest keys (an
+ID and the HMAC secret agents sign with, sent as X-Agent-Key-Id) and bearer
+tokens for the query API, both scoped to the envs, owner teams and server IDs
+the tenant owns. Without TENANTS_CONFIG the server is single-tenant: agents
+sign with INGEST_SECRET and the query API is open unless OIDC login is
+configured (see services/oidc.py).
+"""
+
+import fnmatch
+import json
+import logging
+import os
+from dataclasses import dataclass, field
+from typing import Dict, List, Optional
+
+from fastapi import Cookie, Depends, Header, HTTPException
+from sqlalchemy import or_, select
+
+from database import async_session_maker
+from db_models import AgentsModel
+from services.oidc import ROLES, SESSION_COOKIE, OIDCProvider, role_at_least
+
+logger = logging.getLogger("monitoring-backend")
+
+
+@dataclass
+class Scope:
+    """Envs, owner teams and server ID patterns; empty lists allow anything."""
+    envs: List[str] = field(default_factory=list)
+    owner_teams: List[str] = field(default_factory=list)
+    server_ids: List[str] = field(default_factory=list)  # glob patterns, e.g. "pay-*"
+
+    def allows(self, env: Optional[str], owner_team: Optional[str], server_id: Optional[str]) -> bool:
+        return (
+            (not self.envs or env in self.envs)
+            and (not self.owner_teams or owner_team in self.owner_teams)
+            and (not self.server_ids or any(fnmatch.fnmatchcase(server_id or "", p) for p in self.server_ids))
+        )
+
+
+@dataclass
+class Tenant:
+    """A team sharing the server. Admin tenants see all data."""
+    name: str
+    scope: Scope
+    admin: bool = False
+    role: str = "admin"  # role of its query tokens within its scope
+
+
+@dataclass
+class APIKey:
+    """An ingest key. Its scope narrows the tenant's, e.g. to one env."""
+    id: str
+    secret: str
+    tenant: Tenant
+    scope: Scope
+
+    def allows(self, env: Optional[str], owner_team: Optional[str], server_id: Optional[str]) -> bool:
+        return self.tenant.scope.allows(env, owner_team, server_id) and self.scope.allows(env, owner_team, server_id)
+
+
+def _scope(spec: Dict) -> Scope:
+    return Scope(
+        envs=spec.get("envs", []),
+        owner_teams=spec.get("owner_teams", []),
+        server_ids=spec.get("server_ids", []),
+    )
+
+
+class TenantRegistry:
+    """Looks up tenants by ingest key ID and by query token."""
+
+    def __init__(self, keys: Dict[str, APIKey], tokens: Dict[str, Tenant]):
+        self.keys = keys
+        self.tokens = tokens
+
+    @property
+    def enabled(self) -> bool:
+        return bool(self.keys or self.tokens)
+
+    def by_name(self, name: str) -> Optional[Tenant]:
+        for tenant in list(self.tokens.values()) + [key.tenant for key in self.keys.values()]:
+            if tenant.name == name:
+                return tenant
+        return None
+
+    @classmethod
+    def from_config(cls, config: Dict) -> "TenantRegistry":
+        """
+        Build a registry from a config dict of the form
+        {"tenants": [{"name", "envs", "owner_teams", "server_ids", "admin", "keys", "tokens"}]}.
+
+        Raises:
+            ValueError: If a key ID or token is used twice
+        """
+        keys: Dict[str, APIKey] = {}
+        tokens: Dict[str, Tenant] = {}
+        for spec in config.get("tenants", []):
+            tenant = Tenant(name=spec["name"], scope=_scope(spec), admin=spec.get("admin", False),
+                            role=spec.get("role", "admin"))
+            if tenant.role not in ROLES:
+                raise ValueError(f"tenant {tenant.name!r} has unknown role {tenant.role!r}")
+            for key in spec.get("keys", []):
+                if key["id"] in keys:
+                    raise ValueError(f"API key {key['id']!r} is defined twice")
+                keys[key["id"]] = APIKey(id=key["id"], secret=key["secret"], tenant=tenant, scope=_scope(key))
+            for token in spec.get("tokens", []):
+                if token in tokens:
+                    raise ValueError(f"a query token of tenant {tenant.name!r} is already used")
+                tokens[token] = tenant
+        return cls(keys, tokens)
+
+    @classmethod
+    def from_environment(cls) -> "TenantRegistry":
+        """Load TENANTS_CONFIG, or return a disabled registry."""
+        path = os.environ.get("TENANTS_CONFIG")
+        if not path:
+            return cls({}, {})
+        with open(path) as f:
+            registry = cls.from_config(json.load(f))
+        logger.info(f"Loaded {len(registry.keys)} API keys and {len(registry.tokens)} query tokens from {path}")
+        return registry
+
+
+tenants = TenantRegistry.from_environment()
+oidc = OIDCProvider.from_environment()
+
+
+@dataclass
+class Principal:
+    """A caller of the query API: a tenant's token or a signed-in user."""
+    name: str
+    role: str
+    tenant: Optional[Tenant]  # None for all data
+
+
+async def get_principal(
+    authorization: Optional[str] = Header(None),
+    session: Optional[str] = Cookie(None, alias=SESSION_COOKIE)
+) -> Optional[Principal]:
+    """
+    FastAPI dependency resolving the caller from a tenant's bearer token, an
+    OIDC session cookie or an OIDC bearer access token.
+
+    Returns:
+        The caller, or None when neither tenants nor OIDC are configured
+
+    Raises:
+        HTTPException: 401 if the caller isn't authenticated, 403 if an OIDC
+            user's tenant is unknown
+    """
+    if not tenants.enabled and not oidc.enabled:
+        return None
+    scheme, _, token = (authorization or "").partition(" ")
+    token = token if scheme.lower() == "bearer" else ""
+    tenant = tenants.tokens.get(token) if token else None
+    if tenant is not None:
+        return Principal(name=tenant.name, role=tenant.role, tenant=tenant)
+
+    user = None
+    if oidc.enabled:
+        user = oidc.read_session(session) or (await oidc.user_for_token(token) if token else None)
+    if user is None:
+        # The dashboard sends users without a session to the login page
+        headers = {"WWW-Authenticate": "Bearer"}
+        if oidc.enabled:
+            headers["X-Login-URL"] = "/auth/login"
+        raise HTTPException(status_code=401, detail="Valid bearer token or login required", headers=headers)
+    if user.tenant is None:
+        return Principal(name=user.name, role=user.role, tenant=None)
+    tenant = tenants.by_name(user.tenant)
+    if tenant is None:
+        raise HTTPException(status_code=403, detail=f"Tenant {user.tenant} of {user.name} not found")
+    return Principal(name=user.name, role=user.role, tenant=tenant)
+
+
+async def get_tenant(principal: Optional[Principal] = Depends(get_principal)) -> Optional[Tenant]:
+    """
+    FastAPI dependency resolving the tenant whose data the caller may query.
+
+    Returns:
+        The tenant, or None for all data
+    """
+    return principal.tenant if principal else None
+
+
+async def require_admin(principal: Optional[Principal] = Depends(get_principal)) -> None:
+    """FastAPI dependency for fleet-wide endpoints that only admin tenants may use."""
+    tenant = principal.tenant if principal else None
+    if tenant is not None and not tenant.admin:
+        raise HTTPException(status_code=403, detail=f"Tenant {tenant.name} may not access fleet-wide data")
+
+
+def require_role(role: str):
+    """FastAPI dependency for endpoints that need at least role; the open API allows everything."""
+    async def check(principal: Optional[Principal] = Depends(get_principal)) -> Optional[Principal]:
+        if principal is not None and not role_at_least(principal.role, role):
+            raise HTTPException(status_code=403, detail=f"{principal.name} has role {principal.role}, {role} required")
+        return principal
+    return check
+
+
+def _like(pattern: str) -> str:
+    escaped = pattern.replace("\\", "\\\\").replace("%", "\\%").replace("_", "\\_")
+    return escaped.replace("*", "%").replace("?", "_")
+
+
+def _tenant_agents(tenant: Tenant):
+    """Select the hosts of the tenant's agents in the inventory."""
+    agents = select(AgentsModel.host)
+    scope = tenant.scope
+    if scope.envs:
+        agents = agents.where(AgentsModel.env.in_(scope.envs))
+    if scope.owner_teams:
+        agents = agents.where(AgentsModel.owner_team.in_(scope.owner_teams))
+    if scope.server_ids:
+        agents = agents.where(or_(*[AgentsModel.server_id.like(_like(p), escape="\\") for p in scope.server_ids]))
+    return agents
+
+
+def scope_query(query, model, tenant: Optional[Tenant]):
+    """
+    Restrict a query on a table with a host column to the tenant's hosts, as
+    recorded in the agent inventory. Unscoped for admins and single-tenant use.
+    """
+    if tenant is None or tenant.admin:
+        return query
+    return query.where(model.host.in_(_tenant_agents(tenant)))
+
+
+async def tenant_hosts(tenant: Optional[Tenant]) -> Optional[List[str]]:
+    """
+    The tenant's hosts, for storage that can't join the agent inventory.
+
+    Returns:
+        Host names, or None for admins and single-tenant use
+    """
+    if tenant is None or tenant.admin:
+        return None
+    async with async_session_maker() as session:
+        result = await session.execute(_tenant_agents(tenant).distinct())
+        return [host for host in result.scalars() if host]
+
+
+def tenant_allows(tenant: Optional[Tenant], env: Optional[str], owner_team: Optional[str]) -> bool:
+    """Whether a tenant may see data for the given env and owner team."""
+    if tenant is None or tenant.admin:
+        return True
+    scope = tenant.scope
+    return (not scope.envs or env in scope.envs) and (not scope.owner_teams or owner_team in scope.owner_teams)
@@ -0,0 +1,118 @@
+"""
+Jira and ServiceNow ticket channels for the alert router.
+
+Paging is for alerts that need someone now; an alert that keeps firing also
+needs tracked remediation work. A ticket channel opens one ticket per alert
+group once the group has been firing for the channel's open_after_seconds,
+and comments on and resolves it when the group closes. The ticket's key and
+URL are kept with the group, so the dashboard and chat show the link.
+"""
+
+import os
+from typing import Any, Dict, Optional
+
+import requests
+
+# Default seconds an alert group fires before a ticket is opened
+DEFAULT_OPEN_AFTER_SECONDS = 3600
+
+# ServiceNow incident state for resolved
+SERVICENOW_RESOLVED = "6"
+
+# ServiceNow urgency per severity: 1 high, 2 medium, 3 low
+SERVICENOW_URGENCY = {"critical": "1", "warning": "2"}
+
+
+def _credential(channel: Dict[str, Any], key: str, variable: str) -> Optional[str]:
+    return channel.get(key) or os.environ.get(variable)
+
+
+def validate(name: str, channel: Dict[str, Any]) -> None:
+    """
+    Check a ticket channel's settings.
+
+    Raises:
+        ValueError: If the channel lacks its URL, project or credentials
+    """
+    if not channel.get("url"):
+        raise ValueError(f"{channel['type']} channel {name!r} needs url")
+    if channel["type"] == "jira":
+        if not channel.get("project"):
+            raise ValueError(f"jira channel {name!r} needs project")
+        if not channel.get("user") or not _credential(channel, "api_token", "JIRA_API_TOKEN"):
+            raise ValueError(f"jira channel {name!r} needs user and api_token or JIRA_API_TOKEN")
+    elif not channel.get("user") or not _credential(channel, "password", "SERVICENOW_PASSWORD"):
+        raise ValueError(f"servicenow channel {name!r} needs user and password or SERVICENOW_PASSWORD")
+
+
+def _request(channel: Dict[str, Any], method: str, path: str, body: Optional[Dict[str, Any]] = None) -> Any:
+    if channel["type"] == "jira":
+        auth = (channel["user"], _credential(channel, "api_token", "JIRA_API_TOKEN"))
+    else:
+        auth = (channel["user"], _credential(channel, "password", "SERVICENOW_PASSWORD"))
+    response = requests.request(method, channel["url"].rstrip("/") + path, json=body, auth=auth,
+                                headers={"Accept": "application/json"}, timeout=30)
+    response.raise_for_status()
+    return response.json() if response.content else None
+
+
+def open_ticket(channel: Dict[str, Any], group: Dict[str, Any], subject: str, message: str,
+                severity: str) -> Dict[str, str]:
+    """
+    Open a ticket for a group.
+
+    Returns:
+        The ticket's key and URL, kept with the group to close it later
+    """
+    base = channel["url"].rstrip("/")
+    labels = ["richardops", group["alert_type"].lower()] + ([group["env"]] if group["env"] else [])
+    if channel["type"] == "jira":
+        fields: Dict[str, Any] = {
+            "project": {"key": channel["project"]},
+            "issuetype": {"name": channel.get("issue_type", "Task")},
+            "summary": subject[:255],
+            "description": message,
+            "labels": labels + channel.get("labels", []),
+        }
+        if severity in channel.get("priorities", {}):
+            fields["priority"] = {"name": channel["priorities"][severity]}
+        issue = _request(channel, "POST", "/rest/api/2/issue", {"fields": fields})
+        return {"key": issue["key"], "url": f"{base}/browse/{issue['key']}"}
+
+    incident = {
+        "short_description": subject[:160],
+        "description": message,
+        "urgency": SERVICENOW_URGENCY[severity],
+        "impact": channel.get("impact", "2"),
+        "category": channel.get("category", "software"),
+        "correlation_id": f"richardops-{group['id']}",
+    }
+    if channel.get("assignment_group"):
+        incident["assignment_group"] = channel["assignment_group"]
+    result = _request(channel, "POST", "/api/now/table/incident", incident)["result"]
+    return {
+        "key": result["number"],
+        "id": result["sys_id"],
+        "url": f"{base}/nav_to.do?uri=incident.do?sys_id={result['sys_id']}",
+    }
+
+
+def close_ticket(channel: Dict[str, Any], ticket: Dict[str, str], message: str) -> None:
+    """Comment that a group closed and resolve its ticket."""
+    if channel["type"] == "jira":
+        _request(channel, "POST", f"/rest/api/2/issue/{ticket['key']}/comment", {"body": message})
+        # Transitions are per workflow, so the one to take is found by name
+        wanted = channel.get("resolve_transition", "Done").lower()
+        transitions = _request(channel, "GET", f"/rest/api/2/issue/{ticket['key']}/transitions")["transitions"]
+        transition = next((t for t in transitions if t["name"].lower() == wanted), None)
+        if transition is None:
+            raise ValueError(f"{ticket['key']} has no transition {wanted!r}")
+        _request(channel, "POST", f"/rest/api/2/issue/{ticket['key']}/transitions",
+                 {"transition": {"id": transition["id"]}})
+        return
+
+    _request(channel, "PATCH", f"/api/now/table/incident/{ticket['id']}", {
+        "state": SERVICENOW_RESOLVED,
+        "close_code": channel.get("close_code", "Solution provided"),
+        "close_notes": message,
+    })
@@ -0,0 +1,34 @@
+"""
+Pluggable storage for ingested agent payloads.
+
+The backend is selected with the STORAGE_BACKEND environment variable:
+- postgres (default): everything in PostgreSQL
+- clickhouse: metrics, Docker events and logs in ClickHouse; alerts,
+  payload deduplication and the agent inventory in PostgreSQL
+"""
+
+import os
+
+from storage.base import PayloadStorage
+
+
+def create_storage() -> PayloadStorage:
+    """
+    Create the payload storage configured by STORAGE_BACKEND.
+
+    Returns:
+        PayloadStorage instance for the configured backend
+
+    Raises:
+        ValueError: If the backend name is unknown
+    """
+    backend = os.environ.get("STORAGE_BACKEND", "postgres").lower()
+
+    if backend == "postgres":
+        from storage.postgres import PostgresStorage
+        return PostgresStorage()
+    if backend == "clickhouse":
+        from storage.clickhouse import ClickHouseStorage
+        return ClickHouseStorage()
+
+    raise ValueError(f"Unknown STORAGE_BACKEND {backend!r} (supported: postgres, clickhouse)")
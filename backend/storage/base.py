@@ -0,0 +1,105 @@
+"""
+Storage interface for ingested agent payloads.
+"""
+
+from abc import ABC, abstractmethod
+from datetime import datetime
+from typing import Any, Dict, List, Optional
+
+from models import Payload
+from storage.retention import RetentionPolicy
+
+
+# Columns returned by read_window for each raw table
+RAW_COLUMNS = {
+    "metrics": ["host", "server_id", "timestamp", "cpu_usage", "memory_usage", "disk_usage",
+                "network_rx", "network_tx", "tcp_connections"],
+    "docker_events": ["host", "timestamp", "type", "action", "container", "image"],
+    "container_logs": ["host", "timestamp", "container", "message"],
+}
+
+# Queryable metric columns and their average and maximum columns in
+# metrics_hourly (None where rollups keep no maximum)
+METRIC_ROLLUPS = {
+    "cpu_usage": ("cpu_avg", "cpu_max"),
+    "memory_usage": ("memory_avg", "memory_max"),
+    "disk_usage": ("disk_avg", "disk_max"),
+    "network_rx": ("network_rx_avg", None),
+    "network_tx": ("network_tx_avg", None),
+    "tcp_connections": ("tcp_connections_avg", "tcp_connections_max"),
+}
+
+
+class PayloadStorage(ABC):
+    """
+    Where verified agent payloads are written.
+
+    Implementations must store a payload and record its dedupe ID atomically,
+    so a payload retried by the agent (for example after a timeout where the
+    first attempt actually landed) or replayed is never stored twice.
+    """
+
+    @abstractmethod
+    async def store_payload(self, payload: Payload, dedupe_id: str) -> bool:
+        """
+        Store a payload unless its dedupe ID was stored before.
+
+        Args:
+            payload: Verified monitoring payload
+            dedupe_id: The payload_id, or the request signature for agents
+                too old to send one
+
+        Returns:
+            True if the payload was stored, False if it is a duplicate
+        """
+
+    async def read_window(self, table: str, start: datetime, end: datetime) -> List[Dict[str, Any]]:
+        """
+        Read raw rows back, e.g. to re-run detection rules over them.
+
+        Args:
+            table: metrics, docker_events or container_logs
+            start: Earliest timestamp, inclusive
+            end: Latest timestamp, exclusive
+
+        Returns:
+            Rows as dicts of the table's columns (RAW_COLUMNS), oldest first
+        """
+        raise NotImplementedError(f"{type(self).__name__} can't read back {table}")
+
+    async def query_metric(self, metric: str, start: datetime, end: datetime, step: int,
+                           hosts: Optional[List[str]], rollups: bool) -> List[Dict[str, Any]]:
+        """
+        Aggregate a metric per host into buckets of step seconds, aligned to
+        the epoch.
+
+        Args:
+            metric: A column of METRIC_ROLLUPS
+            start: Earliest timestamp, inclusive
+            end: Latest timestamp, exclusive
+            step: Bucket width in seconds
+            hosts: Only these hosts, None for all
+            rollups: Read hourly rollups instead of raw metrics; step is
+                then a multiple of an hour
+
+        Returns:
+            Rows of host, bucket (its start), total, samples and maximum
+            (None from rollups without one). A host and bucket may appear in
+            more than one row, whose values are to be combined.
+        """
+        raise NotImplementedError(f"{type(self).__name__} can't query metrics")
+
+    async def compact(self, policy: RetentionPolicy) -> Dict[str, int]:
+        """
+        Roll up raw metrics and delete data older than the policy allows.
+
+        Returns:
+            Rows removed (or rolled up) per table, for logging
+        """
+        return {}
+
+    async def migrate(self) -> None:
+        """Bring the storage schema up to date; called once at startup."""
+
+    async def close(self) -> None:
+        """Release connections held by the storage."""
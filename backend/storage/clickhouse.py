@@ -0,0 +1,215 @@
+"""
+ClickHouse payload storage for large fleets.
+
+Metrics, Docker events and container logs go to ClickHouse, which keeps
+months of history cheaply queryable. Payload deduplication and the agent
+inventory stay in PostgreSQL next to alerts.
+"""
+
+import asyncio
+import json
+import logging
+import os
+from datetime import datetime, timezone
+from pathlib import Path
+from typing import Any, Dict, List, Optional
+
+import requests
+
+from database import async_session_maker
+from models import Payload
+from storage.base import METRIC_ROLLUPS, RAW_COLUMNS, PayloadStorage
+from storage.postgres import claim_payload, upsert_agent
+from storage.retention import RetentionPolicy
+
+logger = logging.getLogger("monitoring-backend")
+
+# Schema migrations, applied in file name order and recorded in schema_migrations
+MIGRATIONS_DIR = Path(__file__).parent / "clickhouse_migrations"
+
+
+class ClickHouseStorage(PayloadStorage):
+    """Stores metrics, Docker events and container logs in ClickHouse over HTTP."""
+
+    def __init__(
+        self,
+        url: Optional[str] = None,
+        database: Optional[str] = None,
+        user: Optional[str] = None,
+        password: Optional[str] = None,
+    ):
+        self.url = url or os.environ.get("CLICKHOUSE_URL", "http://localhost:8123")
+        self.database = database or os.environ.get("CLICKHOUSE_DATABASE", "monitoring")
+        user = user or os.environ.get("CLICKHOUSE_USER", "default")
+        password = password if password is not None else os.environ.get("CLICKHOUSE_PASSWORD", "")
+        self.http = requests.Session()
+        self.http.auth = (user, password)
+        self.ttls: Dict[str, str] = {}  # TTL clause last applied per table
+
+    def _execute(self, sql: str, data: Optional[str] = None, database: bool = True, **settings: Any) -> str:
+        """Run one statement, returning the response body."""
+        params = {"query": sql, **settings}
+        if database:
+            params["database"] = self.database
+        response = self.http.post(self.url, params=params, data=(data or "").encode(), timeout=30)
+        if response.status_code != 200:
+            raise RuntimeError(f"ClickHouse error {response.status_code}: {response.text.strip()[:500]}")
+        return response.text
+
+    async def execute(self, sql: str, data: Optional[str] = None, database: bool = True, **settings: Any) -> str:
+        """Run one statement without blocking the event loop."""
+        return await asyncio.to_thread(self._execute, sql, data, database, **settings)
+
+    async def insert(self, table: str, rows: List[Dict[str, Any]], dedup_token: Optional[str]) -> None:
+        """
+        Insert rows as JSONEachRow. With a dedup_token, ClickHouse drops a
+        repeated insert of the same block, covering a retry after a write
+        that landed here but whose PostgreSQL claim didn't commit.
+        """
+        if not rows:
+            return
+        settings = {"date_time_input_format": "best_effort"}
+        if dedup_token:
+            settings["insert_deduplication_token"] = f"{dedup_token}:{table}"
+        body = "\n".join(json.dumps(row, default=str) for row in rows)
+        await self.execute(f"INSERT INTO {table} FORMAT JSONEachRow", body, **settings)
+
+    async def migrate(self) -> None:
+        await self.execute(f"CREATE DATABASE IF NOT EXISTS {self.database}", database=False)
+        await self.execute(
+            "CREATE TABLE IF NOT EXISTS schema_migrations "
+            "(version String, applied_at DateTime DEFAULT now()) "
+            "ENGINE = MergeTree ORDER BY version"
+        )
+        applied = set((await self.execute("SELECT version FROM schema_migrations FORMAT TSV")).split())
+
+        for path in sorted(MIGRATIONS_DIR.glob("*.sql")):
+            version = path.stem
+            if version in applied:
+                continue
+            # The HTTP interface runs one statement per request
+            for statement in path.read_text().split(";"):
+                if statement.strip():
+                    await self.execute(statement)
+            await self.execute(f"INSERT INTO schema_migrations (version) VALUES ('{version}')")
+            logger.info(f"Applied ClickHouse migration {version}")
+
+    async def store_payload(self, payload: Payload, dedupe_id: str) -> bool:
+        async with async_session_maker() as session:
+            async with session.begin():
+                if not await claim_payload(session, payload, dedupe_id):
+                    return False
+                await upsert_agent(session, payload)
+
+                # Written before the claim commits: if ClickHouse fails the
+                # claim rolls back and the agent's retry is stored normally
+                common = {"payload_id": payload.payload_id or "", "host": payload.host}
+                await self.insert("metrics", [{
+                    **common,
+                    "server_id": payload.server_id or "",
+                    "timestamp": payload.timestamp.isoformat(),
+                    "cpu_usage": payload.metrics.cpu_usage,
+                    "memory_usage": payload.metrics.memory_usage,
+                    "disk_usage": payload.metrics.disk_usage,
+                    "network_rx": payload.metrics.network_rx_bytes_per_sec,
+                    "network_tx": payload.metrics.network_tx_bytes_per_sec,
+                    "tcp_connections": payload.metrics.tcp_connections,
+                }], dedupe_id)
+                await self.insert("docker_events", [{
+                    **common,
+                    "timestamp": event.timestamp.isoformat(),
+                    "type": event.type,
+                    "action": event.action,
+                    "container": event.container,
+                    "image": event.image,
+                } for event in payload.docker_events], dedupe_id)
+                await self.insert("container_logs", [{
+                    **common,
+                    "timestamp": log_entry.timestamp.isoformat(),
+                    "container": log_entry.container,
+                    "message": log_entry.message,
+                } for log_entry in payload.logs], dedupe_id)
+
+        return True
+
+    async def read_window(self, table: str, start: datetime, end: datetime) -> List[Dict[str, Any]]:
+        columns = RAW_COLUMNS[table]
+        body = await self.execute(
+            f"SELECT {', '.join(columns)} FROM {table} "
+            f"WHERE timestamp >= fromUnixTimestamp64Milli({int(start.timestamp() * 1000)}) "
+            f"AND timestamp < fromUnixTimestamp64Milli({int(end.timestamp() * 1000)}) "
+            f"ORDER BY timestamp FORMAT JSONEachRow"
+        )
+        rows = []
+        for line in body.splitlines():
+            row = json.loads(line)
+            # DateTime64 comes back as "2025-01-15 10:30:00.000" in UTC
+            row["timestamp"] = datetime.fromisoformat(row["timestamp"]).replace(tzinfo=timezone.utc)
+            rows.append(row)
+        return rows
+
+    async def query_metric(self, metric: str, start: datetime, end: datetime, step: int,
+                           hosts: Optional[List[str]], rollups: bool) -> List[Dict[str, Any]]:
+        host_filter = ""
+        if hosts is not None:
+            quoted = ["'" + host.replace("\\", "\\\\").replace("'", "\\'") + "'" for host in hosts]
+            host_filter = f"AND host IN ({', '.join(quoted)}) " if quoted else "AND 0 "
+
+        if rollups:
+            # metrics_hourly is kept up to date by metrics_hourly_mv, so no
+            # raw metrics are needed for the latest hours
+            avg_name, max_name = METRIC_ROLLUPS[metric]
+            maximum = f"maxMerge({max_name})" if max_name else "NULL"
+            sql = (
+                f"SELECT host, intDiv(toUnixTimestamp(hour), {step}) * {step} AS period, "
+                f"sum(value * n) AS total, sum(n) AS samples, max(peak) AS maximum FROM ("
+                f"SELECT host, bucket AS hour, countMerge(samples) AS n, avgMerge({avg_name}) AS value, "
+                f"{maximum} AS peak FROM metrics_hourly "
+                f"WHERE bucket >= toDateTime({int(start.timestamp())}, 'UTC') "
+                f"AND bucket < toDateTime({int(end.timestamp())}, 'UTC') {host_filter}"
+                f"GROUP BY host, bucket) GROUP BY host, period FORMAT JSONEachRow"
+            )
+        else:
+            sql = (
+                f"SELECT host, intDiv(toUnixTimestamp(toDateTime(timestamp)), {step}) * {step} AS period, "
+                f"sum({metric}) AS total, count() AS samples, max({metric}) AS maximum FROM metrics "
+                f"WHERE timestamp >= fromUnixTimestamp64Milli({int(start.timestamp() * 1000)}) "
+                f"AND timestamp < fromUnixTimestamp64Milli({int(end.timestamp() * 1000)}) {host_filter}"
+                f"GROUP BY host, period FORMAT JSONEachRow"
+            )
+        body = await self.execute(sql, output_format_json_quote_64bit_integers=0)
+        rows = []
+        for line in body.splitlines():
+            row = json.loads(line)
+            row["bucket"] = datetime.fromtimestamp(row.pop("period"), timezone.utc)
+            rows.append(row)
+        return rows
+
+    async def compact(self, policy: RetentionPolicy) -> Dict[str, int]:
+        # ClickHouse expires rows itself during merges; only the TTLs need
+        # to follow the policy. Rollups are written by metrics_hourly_mv.
+        ttls = {
+            "metrics": ("toDateTime(timestamp)", f"{policy.metrics_days} DAY", policy.metrics_days),
+            "metrics_hourly": ("bucket", f"{policy.rollup_months} MONTH", policy.rollup_months),
+            "container_logs": ("toDateTime(timestamp)", f"{policy.logs_days} DAY", policy.logs_days),
+            "docker_events": ("toDateTime(timestamp)", f"{policy.events_days} DAY", policy.events_days),
+        }
+        for table, (column, interval, keep) in ttls.items():
+            clause = f"{column} + INTERVAL {interval}" if keep else ""
+            if self.ttls.get(table) == clause:
+                continue
+            if clause:
+                # Existing parts are cleaned up by later merges rather than
+                # rewritten all at once
+                await self.execute(f"ALTER TABLE {table} MODIFY TTL {clause}", materialize_ttl_after_modify=0)
+            else:
+                try:
+                    await self.execute(f"ALTER TABLE {table} REMOVE TTL")
+                except RuntimeError:
+                    pass  # the table had no TTL
+            self.ttls[table] = clause
+            logger.info(f"ClickHouse {table} TTL set to {clause or 'none'}")
+        return {}
+
+    async def close(self) -> None:
+        self.http.close()
@@ -0,0 +1,44 @@
+-- Metrics, Docker events and container logs, partitioned by month.
+-- non_replicated_deduplication_window lets retried inserts be dropped by
+-- their insert_deduplication_token.
+
+CREATE TABLE IF NOT EXISTS metrics (
+    payload_id String,
+    host LowCardinality(String),
+    server_id String,
+    timestamp DateTime64(3, 'UTC'),
+    cpu_usage Float64,
+    memory_usage Float64,
+    disk_usage Float64,
+    network_rx UInt64,
+    network_tx UInt64,
+    tcp_connections UInt32
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (host, timestamp)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+CREATE TABLE IF NOT EXISTS docker_events (
+    payload_id String,
+    host LowCardinality(String),
+    timestamp DateTime64(3, 'UTC'),
+    type LowCardinality(String),
+    action LowCardinality(String),
+    container String,
+    image String
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (host, timestamp)
+SETTINGS non_replicated_deduplication_window = 1000;
+
+CREATE TABLE IF NOT EXISTS container_logs (
+    payload_id String,
+    host LowCardinality(String),
+    timestamp DateTime64(3, 'UTC'),
+    container LowCardinality(String),
+    message String,
+    INDEX message_tokens message TYPE tokenbf_v1(32768, 3, 0) GRANULARITY 4
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (host, container, timestamp)
+SETTINGS non_replicated_deduplication_window = 1000;
@@ -0,0 +1,39 @@
+-- Hourly metric rollups, filled by a materialized view as metrics are
+-- inserted. Query with avgMerge/maxMerge grouped by host and bucket.
+-- Retention is applied as table TTLs by ClickHouseStorage.compact.
+
+CREATE TABLE IF NOT EXISTS metrics_hourly (
+    host LowCardinality(String),
+    bucket DateTime('UTC'),
+    samples AggregateFunction(count),
+    cpu_avg AggregateFunction(avg, Float64),
+    cpu_max AggregateFunction(max, Float64),
+    memory_avg AggregateFunction(avg, Float64),
+    memory_max AggregateFunction(max, Float64),
+    disk_avg AggregateFunction(avg, Float64),
+    disk_max AggregateFunction(max, Float64),
+    network_rx_avg AggregateFunction(avg, UInt64),
+    network_tx_avg AggregateFunction(avg, UInt64),
+    tcp_connections_avg AggregateFunction(avg, UInt32),
+    tcp_connections_max AggregateFunction(max, UInt32)
+) ENGINE = AggregatingMergeTree
+PARTITION BY toYYYYMM(bucket)
+ORDER BY (host, bucket);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS metrics_hourly_mv TO metrics_hourly AS
+SELECT
+    host,
+    toStartOfHour(timestamp) AS bucket,
+    countState() AS samples,
+    avgState(cpu_usage) AS cpu_avg,
+    maxState(cpu_usage) AS cpu_max,
+    avgState(memory_usage) AS memory_avg,
+    maxState(memory_usage) AS memory_max,
+    avgState(disk_usage) AS disk_avg,
+    maxState(disk_usage) AS disk_max,
+    avgState(network_rx) AS network_rx_avg,
+    avgState(network_tx) AS network_tx_avg,
+    avgState(tcp_connections) AS tcp_connections_avg,
+    maxState(tcp_connections) AS tcp_connections_max
+FROM metrics
+GROUP BY host, bucket;
@@ -0,0 +1,310 @@
+"""
+PostgreSQL payload storage using the backend's SQLAlchemy models.
+"""
+
+from datetime import datetime, timedelta, timezone
+from typing import Any, Dict, List, Optional
+
+from sqlalchemy import BigInteger, Integer, case, cast, insert, delete, func, null, select
+from sqlalchemy.dialects.postgresql import insert as pg_insert
+from sqlalchemy.ext.asyncio import AsyncSession
+
+from database import async_session_maker
+from db_models import (
+    MetricsModel, DockerEventsModel, ContainerLogsModel,
+    ReceivedPayloadsModel, AgentsModel, MetricsHourlyModel
+)
+from models import Payload
+from storage.base import METRIC_ROLLUPS, RAW_COLUMNS, PayloadStorage
+from storage.retention import RetentionPolicy
+
+
+# Weight of the newest score in an agent's moving average
+SCORE_AVG_WEIGHT = 0.2
+
+# Rows deleted per statement when expiring data, keeping transactions short
+DELETE_BATCH = 10000
+
+# Models read back by read_window
+RAW_MODELS = {
+    "metrics": MetricsModel,
+    "docker_events": DockerEventsModel,
+    "container_logs": ContainerLogsModel,
+}
+
+# Hours before the last rollup that are rolled up again, picking up metrics
+# that arrived late from agent queues
+ROLLUP_LOOKBACK = timedelta(hours=24)
+
+
+def agent_key(payload: Payload) -> str:
+    """Identify the reporting agent by server ID, falling back to host name."""
+    return payload.server_id or payload.host
+
+
+async def claim_payload(session: AsyncSession, payload: Payload, dedupe_id: str) -> bool:
+    """
+    Record a payload's dedupe ID in the current transaction.
+
+    Returns:
+        False if the ID was already recorded, True otherwise
+    """
+    claimed = await session.execute(
+        pg_insert(ReceivedPayloadsModel)
+        .values(
+            payload_id=dedupe_id,
+            host=payload.host,
+            server_id=payload.server_id,
+            received_at=datetime.now(timezone.utc),
+        )
+        .on_conflict_do_nothing(index_elements=["payload_id"])
+        .returning(ReceivedPayloadsModel.payload_id)
+    )
+    return claimed.scalar() is not None
+
+
+async def prune_received_payloads(before: datetime) -> int:
+    """
+    Forget dedupe IDs received before the given time.
+
+    Returns:
+        Number of IDs removed
+    """
+    async with async_session_maker() as session:
+        async with session.begin():
+            result = await session.execute(
+                delete(ReceivedPayloadsModel).where(ReceivedPayloadsModel.received_at < before)
+            )
+    return result.rowcount
+
+
+def queue_depth(payload: Payload) -> Optional[int]:
+    """Payloads queued on the agent, from its self-metrics if it sent them."""
+    stats = (payload.model_extra or {}).get("agent_stats") or {}
+    return stats.get("buffers", {}).get("payload_queue", {}).get("length")
+
+
+async def upsert_agent(session: AsyncSession, payload: Payload) -> None:
+    """
+    Update the reporting agent's inventory row in the current transaction.
+    A backfill payload only shows the agent is reporting again; its score
+    and queue depth are from before the outage and are left out.
+    """
+    now = datetime.now(timezone.utc)
+    values = {
+        "host": payload.host,
+        "server_id": payload.server_id,
+        "machine_id": payload.machine_id,
+        "agent_version": payload.agent_version,
+        "env": payload.env,
+        "owner_team": payload.owner_team,
+        "last_seen": now,
+        "last_payload_id": payload.payload_id,
+        "last_score": payload.score,
+        "queue_depth": queue_depth(payload),
+    }
+    stmt = pg_insert(AgentsModel).values(
+        agent_key=agent_key(payload), first_seen=now, score_avg=payload.score, **values
+    )
+    if payload.backfill:
+        updates = {name: values[name] for name in ("host", "server_id", "machine_id", "agent_version", "env", "owner_team", "last_seen")}
+        await session.execute(stmt.on_conflict_do_update(index_elements=["agent_key"], set_=updates))
+        return
+    score_avg = (
+        func.coalesce(AgentsModel.score_avg, stmt.excluded.score_avg) * (1 - SCORE_AVG_WEIGHT)
+        + stmt.excluded.score_avg * SCORE_AVG_WEIGHT
+    )
+    await session.execute(
+        stmt.on_conflict_do_update(index_elements=["agent_key"], set_={**values, "score_avg": score_avg})
+    )
+
+
+async def rollup_metrics(until: datetime) -> int:
+    """
+    Upsert hourly rollups of raw metrics for the hours before until, starting
+    ROLLUP_LOOKBACK before the last hour rolled up (or at the first metric).
+
+    Returns:
+        Number of hourly rows written
+    """
+    async with async_session_maker() as session:
+        async with session.begin():
+            last = (await session.execute(select(func.max(MetricsHourlyModel.bucket)))).scalar()
+            host = func.coalesce(MetricsModel.host, "")
+            bucket = func.date_trunc("hour", MetricsModel.timestamp)
+            rows = select(
+                host, bucket, func.count(),
+                func.avg(MetricsModel.cpu_usage), func.max(MetricsModel.cpu_usage),
+                func.avg(MetricsModel.memory_usage), func.max(MetricsModel.memory_usage),
+                func.avg(MetricsModel.disk_usage), func.max(MetricsModel.disk_usage),
+                cast(func.avg(MetricsModel.network_rx), BigInteger), cast(func.avg(MetricsModel.network_tx), BigInteger),
+                cast(func.avg(MetricsModel.tcp_connections), Integer), func.max(MetricsModel.tcp_connections),
+            ).where(MetricsModel.timestamp < until).group_by(host, bucket)
+            if last is not None:
+                rows = rows.where(MetricsModel.timestamp >= last - ROLLUP_LOOKBACK)
+
+            columns = [
+                "host", "bucket", "samples", "cpu_avg", "cpu_max", "memory_avg", "memory_max",
+                "disk_avg", "disk_max", "network_rx_avg", "network_tx_avg",
+                "tcp_connections_avg", "tcp_connections_max",
+            ]
+            stmt = pg_insert(MetricsHourlyModel).from_select(columns, rows)
+            stmt = stmt.on_conflict_do_update(
+                index_elements=["host", "bucket"],
+                set_={column: stmt.excluded[column] for column in columns[2:]},
+            )
+            result = await session.execute(stmt)
+    return result.rowcount
+
+
+def epoch_bucket(column, step: int):
+    """Start of the step-second bucket, counted from the epoch, holding column."""
+    return func.to_timestamp(func.floor(func.extract("epoch", column) / step) * step)
+
+
+async def delete_before(model, cutoff: datetime) -> int:
+    """
+    Delete rows of a table with id and timestamp columns older than cutoff,
+    DELETE_BATCH at a time.
+
+    Returns:
+        Number of rows deleted
+    """
+    total = 0
+    while True:
+        async with async_session_maker() as session:
+            async with session.begin():
+                batch = select(model.id).where(model.timestamp < cutoff).limit(DELETE_BATCH)
+                result = await session.execute(delete(model).where(model.id.in_(batch)))
+        total += result.rowcount
+        if result.rowcount < DELETE_BATCH:
+            return total
+
+
+class PostgresStorage(PayloadStorage):
+    """Stores metrics, Docker events, container logs and inventory in PostgreSQL."""
+
+    async def store_payload(self, payload: Payload, dedupe_id: str) -> bool:
+        async with async_session_maker() as session:
+            async with session.begin():
+                # Claim the payload ID first; the claim and the data commit
+                # together, so a concurrent retry either sees the claim or waits
+                if not await claim_payload(session, payload, dedupe_id):
+                    return False
+                await upsert_agent(session, payload)
+
+                session.add(MetricsModel(
+                    host=payload.host,
+                    server_id=payload.server_id,
+                    timestamp=payload.timestamp,
+                    cpu_usage=payload.metrics.cpu_usage,
+                    memory_usage=payload.metrics.memory_usage,
+                    disk_usage=payload.metrics.disk_usage,
+                    network_rx=payload.metrics.network_rx_bytes_per_sec,
+                    network_tx=payload.metrics.network_tx_bytes_per_sec,
+                    tcp_connections=payload.metrics.tcp_connections
+                ))
+
+                for event in payload.docker_events:
+                    session.add(DockerEventsModel(
+                        host=payload.host,
+                        timestamp=event.timestamp,
+                        type=event.type,
+                        action=event.action,
+                        container=event.container,
+                        image=event.image
+                    ))
+
+                if payload.logs:
+                    await session.execute(insert(ContainerLogsModel), [
+                        {
+                            "host": payload.host,
+                            "container": log_entry.container,
+                            "timestamp": log_entry.timestamp,
+                            "message": log_entry.message,
+                        }
+                        for log_entry in payload.logs
+                    ])
+
+        return True
+
+    async def read_window(self, table: str, start: datetime, end: datetime) -> List[Dict[str, Any]]:
+        model = RAW_MODELS[table]
+        columns = [getattr(model, name) for name in RAW_COLUMNS[table]]
+        async with async_session_maker() as session:
+            result = await session.execute(
+                select(*columns)
+                .where(model.timestamp >= start, model.timestamp < end)
+                .order_by(model.timestamp, model.id)
+            )
+            return [dict(row._mapping) for row in result]
+
+    async def query_metric(self, metric: str, start: datetime, end: datetime, step: int,
+                           hosts: Optional[List[str]], rollups: bool) -> List[Dict[str, Any]]:
+        queries = []
+        raw_from = start
+        async with async_session_maker() as session:
+            if rollups:
+                avg_name, max_name = METRIC_ROLLUPS[metric]
+                avg = getattr(MetricsHourlyModel, avg_name)
+                samples = MetricsHourlyModel.samples
+                bucket = epoch_bucket(MetricsHourlyModel.bucket, step)
+                query = select(
+                    MetricsHourlyModel.host.label("host"), bucket.label("bucket"),
+                    func.sum(avg * samples).label("total"),
+                    func.sum(case((avg.isnot(None), samples), else_=0)).label("samples"),
+                    (func.max(getattr(MetricsHourlyModel, max_name)) if max_name else null()).label("maximum"),
+                ).where(
+                    MetricsHourlyModel.bucket >= start, MetricsHourlyModel.bucket < end
+                ).group_by(MetricsHourlyModel.host, bucket)
+                if hosts is not None:
+                    query = query.where(MetricsHourlyModel.host.in_(hosts))
+                queries.append(query)
+
+                # Hours not rolled up yet are read from raw metrics
+                last = (await session.execute(select(func.max(MetricsHourlyModel.bucket)))).scalar()
+                raw_from = max(start, last + timedelta(hours=1)) if last is not None else start
+
+            if raw_from < end:
+                column = getattr(MetricsModel, metric)
+                host = func.coalesce(MetricsModel.host, "")
+                bucket = epoch_bucket(MetricsModel.timestamp, step)
+                query = select(
+                    host.label("host"), bucket.label("bucket"),
+                    func.sum(column).label("total"), func.count(column).label("samples"),
+                    func.max(column).label("maximum"),
+                ).where(
+                    MetricsModel.timestamp >= raw_from, MetricsModel.timestamp < end
+                ).group_by(host, bucket)
+                if hosts is not None:
+                    query = query.where(MetricsModel.host.in_(hosts))
+                queries.append(query)
+
+            rows = []
+            for query in queries:
+                result = await session.execute(query)
+                rows.extend(dict(row._mapping) for row in result)
+            return rows
+
+    async def compact(self, policy: RetentionPolicy) -> Dict[str, int]:
+        now = datetime.now(timezone.utc)
+        # Only complete hours are rolled up, and raw metrics are only deleted
+        # once their hour is
+        until = now.replace(minute=0, second=0, microsecond=0)
+        removed = {"metrics_hourly_written": await rollup_metrics(until)}
+
+        if policy.metrics_days:
+            cutoff = min(now - timedelta(days=policy.metrics_days), until)
+            removed["metrics"] = await delete_before(MetricsModel, cutoff)
+        if policy.rollup_months:
+            async with async_session_maker() as session:
+                async with session.begin():
+                    result = await session.execute(delete(MetricsHourlyModel).where(
+                        MetricsHourlyModel.bucket < func.now() - func.make_interval(0, policy.rollup_months)
+                    ))
+            removed["metrics_hourly"] = result.rowcount
+        if policy.logs_days:
+            removed["container_logs"] = await delete_before(ContainerLogsModel, now - timedelta(days=policy.logs_days))
+        if policy.events_days:
+            removed["docker_events"] = await delete_before(DockerEventsModel, now - timedelta(days=policy.events_days))
+        return removed
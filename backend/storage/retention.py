@@ -0,0 +1,30 @@
+"""
+Retention policy for stored agent data.
+
+Raw metrics are rolled up into hourly averages and maxima, which are kept much
+longer than the raw rows. Each period is read from the environment; 0 keeps
+that data forever.
+"""
+
+import os
+from dataclasses import dataclass
+
+
+@dataclass
+class RetentionPolicy:
+    """How long each kind of stored data is kept."""
+    metrics_days: int = 30   # raw metrics
+    rollup_months: int = 13  # hourly metric rollups
+    logs_days: int = 14      # container logs
+    events_days: int = 90    # Docker events
+
+    @classmethod
+    def from_environment(cls) -> "RetentionPolicy":
+        """Read RETENTION_METRICS_DAYS, RETENTION_ROLLUP_MONTHS, RETENTION_LOGS_DAYS and RETENTION_EVENTS_DAYS."""
+        defaults = cls()
+        return cls(
+            metrics_days=int(os.environ.get("RETENTION_METRICS_DAYS", defaults.metrics_days)),
+            rollup_months=int(os.environ.get("RETENTION_ROLLUP_MONTHS", defaults.rollup_months)),
+            logs_days=int(os.environ.get("RETENTION_LOGS_DAYS", defaults.logs_days)),
+            events_days=int(os.environ.get("RETENTION_EVENTS_DAYS", defaults.events_days)),
+        )
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Combined log format (the Apache and nginx default), or the common log
+	// format without referer and user agent, followed by anything the
+	// server adds, such as a request time
+	accessLinePattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[[^\]]+\] "(\S+) (\S+)[^"]*" (\d{3}) \S+(?: "[^"]*" "([^"]*)")?(.*)$`)
+	// Request time after the user agent: nginx $request_time in seconds
+	// (optionally as rt= or request_time=) or Apache %D in microseconds
+	accessLatencyPattern = regexp.MustCompile(`^\s+"?(?:rt=|request_time=)?(\d+(?:\.\d+)?)"?(?:\s|$)`)
+	// Path segments that are IDs, folded so /users/42 and /users/43 are one endpoint
+	endpointIDPattern = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+)
+
+// webAttackPatterns are signs of exploitation attempts in a request's
+// (decoded, lowercased) target or user agent, by kind
+var webAttackPatterns = []struct {
+	kind     string
+	patterns []string
+}{
+	{"traversal", []string{"../", "..\\", "/etc/passwd", "/proc/self/", "c:\\windows"}},
+	{"sqli", []string{"union select", "union all select", "' or '1'='1", "\" or \"1\"=\"1", "or 1=1", "sleep(", "benchmark(", "information_schema"}},
+	{"xss", []string{"<script", "javascript:", "onerror=", "onload=", "<svg"}},
+	{"rce", []string{"${jndi:", ";wget ", ";curl ", "|sh", "$(", "`", "/bin/sh", "cmd.exe"}},
+	{"probe", []string{"/.env", "/.git/", "/wp-login.php", "/xmlrpc.php", "/phpmyadmin", "/cgi-bin/", "/actuator/", "/.aws/"}},
+	{"scanner", []string{"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei", "dirbuster", "gobuster"}},
+}
+
+const (
+	// Latency samples kept per source and interval; more are sampled
+	maxLatencySamples = 4096
+	// Distinct endpoints counted per source and interval, others are "other"
+	maxEndpoints = 1000
+	// Endpoints reported per source
+	topEndpointCount = 10
+)
+
+// accessRecord is one request from an access log
+type accessRecord struct {
+	Client     string
+	Method     string
+	Target     string
+	Status     int
+	UserAgent  string
+	Latency    time.Duration
+	HasLatency bool
+	RequestID  string
+}
+
+// parseAccessLine parses a combined or common format access log line,
+// returning false for anything else
+func parseAccessLine(line string) (accessRecord, bool) {
+	// Cheap check first: this runs on every container log line
+	if !strings.Contains(line, "HTTP/") && !strings.Contains(line, `" `) {
+		return accessRecord{}, false
+	}
+	matches := accessLinePattern.FindStringSubmatch(line)
+	if matches == nil {
+		return accessRecord{}, false
+	}
+	status, _ := strconv.Atoi(matches[4])
+	record := accessRecord{
+		Client:    matches[1],
+		Method:    matches[2],
+		Target:    matches[3],
+		Status:    status,
+		UserAgent: matches[5],
+	}
+	if latency := accessLatencyPattern.FindStringSubmatch(matches[6]); latency != nil {
+		value, err := strconv.ParseFloat(latency[1], 64)
+		if err == nil {
+			record.HasLatency = true
+			if strings.Contains(latency[1], ".") {
+				record.Latency = time.Duration(value * float64(time.Second))
+			} else {
+				record.Latency = time.Duration(value) * time.Microsecond
+			}
+		}
+	}
+	return record, true
+}
+
+// endpoint returns a request's method and path, without the query and with
+// ID segments replaced by :id
+func (r accessRecord) endpoint() string {
+	path, _, _ := strings.Cut(r.Target, "?")
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if endpointIDPattern.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	path = strings.Join(segments, "/")
+	if len(path) > 100 {
+		path = path[:100] + "..."
+	}
+	return r.Method + " " + path
+}
+
+// attackKind returns the kind of exploitation attempt a request looks like,
+// or "" for an ordinary request
+func (r accessRecord) attackKind() string {
+	target := strings.ToLower(r.Target)
+	if decoded, err := url.QueryUnescape(target); err == nil {
+		target = decoded
+	}
+	userAgent := strings.ToLower(r.UserAgent)
+	for _, group := range webAttackPatterns {
+		subject := target
+		if group.kind == "scanner" {
+			subject = userAgent
+		}
+		for _, pattern := range group.patterns {
+			if strings.Contains(subject, pattern) {
+				return group.kind
+			}
+		}
+	}
+	return ""
+}
+
+// HTTPMetrics summarizes one source's access log since the previous payload
+type HTTPMetrics struct {
+	Source         string          `json:"source"`
+	Requests       int             `json:"requests"`
+	RequestsPerSec float64         `json:"requests_per_sec"`
+	StatusClasses  map[string]int  `json:"status_classes"`
+	LatencyP50Ms   float64         `json:"latency_p50_ms,omitempty"`
+	LatencyP95Ms   float64         `json:"latency_p95_ms,omitempty"`
+	LatencyP99Ms   float64         `json:"latency_p99_ms,omitempty"`
+	TopEndpoints   []EndpointCount `json:"top_endpoints,omitempty"`
+}
+
+// EndpointCount is an endpoint's requests and server errors
+type EndpointCount struct {
+	Endpoint  string `json:"endpoint"`
+	Requests  int    `json:"requests"`
+	ServerErr int    `json:"errors_5xx,omitempty"`
+}
+
+// accessWindow accumulates one source's requests between payloads
+type accessWindow struct {
+	requests   int
+	classes    map[string]int
+	latencies  []time.Duration
+	latencyN   int // latencies seen, for reservoir sampling
+	endpoints  map[string]*EndpointCount
+	attacks    map[string]map[string]int // client -> attack kind -> requests
+	lastAttack map[string]string         // client -> last suspicious request
+	errorIDs   []string                  // request IDs of recent 5xx responses
+	attackIDs  map[string][]string       // client -> request IDs of recent suspicious requests
+}
+
+func newAccessWindow() *accessWindow {
+	return &accessWindow{
+		classes:    make(map[string]int),
+		endpoints:  make(map[string]*EndpointCount),
+		attacks:    make(map[string]map[string]int),
+		lastAttack: make(map[string]string),
+		attackIDs:  make(map[string][]string),
+	}
+}
+
+func (w *accessWindow) add(record accessRecord) {
+	w.requests++
+	w.classes[fmt.Sprintf("%dxx", record.Status/100)]++
+
+	if record.HasLatency {
+		w.latencyN++
+		if len(w.latencies) < maxLatencySamples {
+			w.latencies = append(w.latencies, record.Latency)
+		} else if i := rand.IntN(w.latencyN); i < maxLatencySamples {
+			w.latencies[i] = record.Latency
+		}
+	}
+
+	endpoint := record.endpoint()
+	if _, ok := w.endpoints[endpoint]; !ok && len(w.endpoints) >= maxEndpoints {
+		endpoint = "other"
+	}
+	count, ok := w.endpoints[endpoint]
+	if !ok {
+		count = &EndpointCount{Endpoint: endpoint}
+		w.endpoints[endpoint] = count
+	}
+	count.Requests++
+	if record.Status >= 500 {
+		count.ServerErr++
+		w.errorIDs = addCorrelationID(w.errorIDs, record.RequestID)
+	}
+
+	if kind := record.attackKind(); kind != "" {
+		kinds, ok := w.attacks[record.Client]
+		if !ok {
+			kinds = make(map[string]int)
+			w.attacks[record.Client] = kinds
+		}
+		kinds[kind]++
+		target := record.Target
+		if len(target) > 80 {
+			target = target[:80] + "..."
+		}
+		w.lastAttack[record.Client] = record.Method + " " + target
+		w.attackIDs[record.Client] = addCorrelationID(w.attackIDs[record.Client], record.RequestID)
+	}
+}
+
+// metrics summarizes the window, which lasted elapsed
+func (w *accessWindow) metrics(source string, elapsed time.Duration) HTTPMetrics {
+	m := HTTPMetrics{Source: source, Requests: w.requests, StatusClasses: w.classes}
+	if elapsed > 0 {
+		m.RequestsPerSec = float64(w.requests) / elapsed.Seconds()
+	}
+	if len(w.latencies) > 0 {
+		sort.Slice(w.latencies, func(i, j int) bool { return w.latencies[i] < w.latencies[j] })
+		m.LatencyP50Ms = latencyPercentile(w.latencies, 0.50)
+		m.LatencyP95Ms = latencyPercentile(w.latencies, 0.95)
+		m.LatencyP99Ms = latencyPercentile(w.latencies, 0.99)
+	}
+	for _, count := range w.endpoints {
+		m.TopEndpoints = append(m.TopEndpoints, *count)
+	}
+	sort.Slice(m.TopEndpoints, func(i, j int) bool {
+		a, b := m.TopEndpoints[i], m.TopEndpoints[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Endpoint < b.Endpoint
+	})
+	if len(m.TopEndpoints) > topEndpointCount {
+		m.TopEndpoints = m.TopEndpoints[:topEndpointCount]
+	}
+	return m
+}
+
+// latencyPercentile returns the nearest-rank percentile of sorted latencies in milliseconds
+func latencyPercentile(sorted []time.Duration, p float64) float64 {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	i = min(max(i, 0), len(sorted)-1)
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+// accessLogStats collects access log windows per source: a container name
+// or a log file's base name
+type accessLogStats struct {
+	mu      sync.Mutex
+	since   time.Time
+	windows map[string]*accessWindow
+	w3c     *w3cParsers // IIS field layouts per source
+}
+
+func newAccessLogStats() *accessLogStats {
+	return &accessLogStats{since: time.Now(), windows: make(map[string]*accessWindow), w3c: newW3CParsers()}
+}
+
+// observe records line if it is an access log line, with the request's
+// correlation ID if one was found
+func (s *accessLogStats) observe(source, line, requestID string) {
+	var record accessRecord
+	var ok bool
+	if strings.HasPrefix(line, "#") || w3cLinePattern.MatchString(line) {
+		record, ok = s.w3c.parse(source, line)
+	} else {
+		record, ok = parseAccessLine(line)
+	}
+	if !ok {
+		return
+	}
+	record.RequestID = requestID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window, ok := s.windows[source]
+	if !ok {
+		window = newAccessWindow()
+		s.windows[source] = window
+	}
+	window.add(record)
+}
+
+// take returns the windows collected since the previous call and starts new ones
+func (s *accessLogStats) take() (map[string]*accessWindow, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	windows, elapsed := s.windows, time.Since(s.since)
+	s.windows, s.since = make(map[string]*accessWindow), time.Now()
+	return windows, elapsed
+}
+
+// setupAccessLogMonitoring follows the host access log files in --access-logs,
+// which feed both HTTP and, for HAProxy and Envoy logs, upstream metrics
+func (a *Agent) setupAccessLogMonitoring() {
+	for _, path := range strings.Split(a.config.AccessLogs, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		source := filepath.Base(path)
+		tailer, err := newFileTailer(path, false, func(line string) {
+			requestID := a.correlation.find(line, nil)
+			a.accessLogs.observe(source, line, requestID)
+			a.proxyLogs.observe(source, line, requestID)
+		})
+		if err != nil {
+			log.Printf("Warning: Failed to follow access log %s: %v", path, err)
+			continue
+		}
+		a.logSources = append(a.logSources, tailer)
+		log.Printf("Monitoring access log: %s", path)
+	}
+}
+
+// collectHTTPMetrics summarizes the access logs seen since the previous
+// payload and runs the detectors fed by them: HTTP_5XX_SPIKE:<source> when
+// at least --http-5xx-pct of a source's requests failed, and
+// WEB_ATTACK:<client> when a client sent --web-attack-threshold suspicious
+// requests. Both carry the request IDs of recent offending requests.
+func (a *Agent) collectHTTPMetrics() []HTTPMetrics {
+	defer a.selfMetrics.Detector("access_log").Since(time.Now())
+
+	windows, elapsed := a.accessLogs.take()
+	sources := make([]string, 0, len(windows))
+	for source := range windows {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+	var metrics []HTTPMetrics
+	for _, source := range sources {
+		window := windows[source]
+		m := window.metrics(source, elapsed)
+		metrics = append(metrics, m)
+		if a.warmingUp() {
+			continue
+		}
+
+		errors := m.StatusClasses["5xx"]
+		if m.Requests >= a.config.HTTPMinRequests && float64(errors)*100 >= a.config.HTTP5xxPct*float64(m.Requests) {
+			alert := "HTTP_5XX_SPIKE:" + source
+			detail := fmt.Sprintf("%d of %d requests returned 5xx", errors, m.Requests)
+			if worst := worstEndpoint(m.TopEndpoints); worst != "" {
+				detail += ", most on " + worst
+			}
+			if a.raiseAlert(alert) {
+				log.Printf("HTTP 5xx spike in %s: %s", source, detail)
+			}
+			a.alertStates[alert].Detail = detail
+			a.alertStates[alert].CorrelationIDs = window.errorIDs
+		}
+
+		for client, kinds := range window.attacks {
+			total := 0
+			for _, n := range kinds {
+				total += n
+			}
+			if total < a.config.WebAttackThreshold {
+				continue
+			}
+			alert := "WEB_ATTACK:" + client
+			detail := fmt.Sprintf("%d suspicious requests to %s (%s), last %s", total, source, formatRuleCounts(kinds), window.lastAttack[client])
+			if a.raiseAlert(alert) {
+				log.Printf("Web attack from %s: %s", client, detail)
+			}
+			a.alertStates[alert].Detail = detail
+			a.alertStates[alert].CorrelationIDs = window.attackIDs[client]
+		}
+	}
+	return metrics
+}
+
+// worstEndpoint returns the endpoint with the most server errors
+func worstEndpoint(endpoints []EndpointCount) string {
+	worst := EndpointCount{}
+	for _, endpoint := range endpoints {
+		if endpoint.ServerErr > worst.ServerErr {
+			worst = endpoint
+		}
+	}
+	return worst.Endpoint
+}
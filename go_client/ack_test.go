@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerifyAck tests ack checking, including that a server which has sent
+// an ack can't be impersonated by a bare 2xx afterwards
+func TestVerifyAck(t *testing.T) {
+	agent := &Agent{config: Config{Secret: "s3cret"}}
+	response := func(ack Ack) string {
+		data, _ := json.Marshal(map[string]interface{}{"status": "success", "ack": ack})
+		return string(data)
+	}
+
+	if err := agent.verifyAck(strings.NewReader(`{"status": "success"}`), "p1"); err != nil {
+		t.Errorf("Expected a server without acks to be accepted, got %v", err)
+	}
+	if err := agent.verifyAck(strings.NewReader(response(newAck("s3cret", "p1", AckStored))), "p1"); err != nil {
+		t.Errorf("Expected a valid ack to be accepted, got %v", err)
+	}
+	if err := agent.verifyAck(strings.NewReader(`{"status": "success"}`), "p2"); err != errNoAck {
+		t.Errorf("Expected a missing ack to be rejected once acks were seen, got %v", err)
+	}
+
+	for name, body := range map[string]string{
+		"other payload": response(newAck("s3cret", "p1", AckStored)),
+		"wrong secret":  response(newAck("other", "p2", AckStored)),
+		"bad status":    response(newAck("s3cret", "p2", "lost")),
+	} {
+		if err := agent.verifyAck(strings.NewReader(body), "p2"); err == nil {
+			t.Errorf("Expected %s ack to be rejected", name)
+		}
+	}
+	if err := agent.verifyAck(strings.NewReader(response(newAck("s3cret", "p2", AckDuplicate))), "p2"); err != nil {
+		t.Errorf("Expected a duplicate ack to be accepted, got %v", err)
+	}
+
+	strict := &Agent{config: Config{Secret: "s3cret", RequireAck: true}}
+	if err := strict.verifyAck(strings.NewReader(`ok`), "p1"); err != errNoAck {
+		t.Errorf("Expected --require-ack to reject a response without ack, got %v", err)
+	}
+}
+
+// TestQueueFileKeptUntilAcked tests that persisted payloads stay on disk
+// after loading and their file is removed once all of them are acknowledged
+func TestQueueFileKeptUntilAcked(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { queueDir = old }(queueDir)
+	queueDir = dir
+
+	file := filepath.Join(dir, "queue_1700000000.jsonl")
+	payloads := []Payload{{ID: newUUID(), Timestamp: time.Now()}, {ID: newUUID(), Timestamp: time.Now()}}
+	if err := rewriteQueueFile(file, payloads); err != nil {
+		t.Fatal(err)
+	}
+
+	var acked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Agent-Payload-Id")
+		acked = append(acked, id)
+		writeJSON(w, map[string]interface{}{"status": "success", "ack": newAck("s3cret", id, AckStored)})
+	}))
+	defer server.Close()
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("Expected the queue file to be kept after loading: %v", err)
+	}
+
+	agent.processQueue()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected the queue file to be kept while a payload in it is unacknowledged: %v", err)
+	}
+	agent.processQueue()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected the queue file to be removed once all its payloads were acknowledged, got %v", err)
+	}
+	if len(acked) != 2 || acked[0] != payloads[0].ID || len(agent.payloadQueue) != 0 {
+		t.Errorf("Expected both payloads delivered in order and dequeued, got %v (%d queued)", acked, len(agent.payloadQueue))
+	}
+}
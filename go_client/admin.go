@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MonitoredContainer describes a container with an active log monitor
+type MonitoredContainer struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	Since     time.Time `json:"since"`
+	LinesRead uint64    `json:"lines_read"`
+	Streaming bool      `json:"streaming"` // false while waiting for a --log-workers slot
+
+	linesRead atomic.Uint64
+	streaming atomic.Bool
+}
+
+// QueueSummary summarizes queued payloads awaiting delivery
+type QueueSummary struct {
+	Length     int              `json:"length"`
+	Limit      int              `json:"limit"`
+	Oldest     time.Time        `json:"oldest,omitempty"`
+	Newest     time.Time        `json:"newest,omitempty"`
+	Payloads   []QueuedPayload  `json:"payloads"`
+	DiskFiles  []QueueFileEntry `json:"disk_files"`
+	TotalBytes int64            `json:"total_bytes"`
+}
+
+// QueuedPayload is a short description of a single queued payload
+type QueuedPayload struct {
+	ID        string    `json:"payload_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Logs      int       `json:"logs"`
+	Events    int       `json:"docker_events"`
+	Alerts    []string  `json:"local_alerts"`
+}
+
+// QueueFileEntry describes a persisted queue file on disk
+type QueueFileEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// BaselineStats describes the statistics behind the anomaly detectors
+type BaselineStats struct {
+	CPU  CPUBaselineStats  `json:"cpu"`
+	Auth AuthBaselineStats `json:"auth"`
+}
+
+// CPUBaselineStats describes the CPU sliding window
+type CPUBaselineStats struct {
+	Samples      int       `json:"samples"`
+	WindowSize   int       `json:"window_size"`
+	Mean         float64   `json:"mean"`
+	StdDev       float64   `json:"stddev"`
+	Min          float64   `json:"min"`
+	Max          float64   `json:"max"`
+	Last         float64   `json:"last"`
+	LastSampled  time.Time `json:"last_sampled,omitempty"`
+	SpikePct     float64   `json:"spike_pct"`
+	ZScoreCutoff float64   `json:"z_score_cutoff"`
+}
+
+// AuthBaselineStats describes failed auth attempts inside the detection window
+type AuthBaselineStats struct {
+	WindowSeconds    int            `json:"window_seconds"`
+	Threshold        int            `json:"threshold"`
+	FailuresInWindow int            `json:"failures_in_window"`
+	FailuresByIP     map[string]int `json:"failures_by_ip"`
+}
+
+// trackContainer registers a container as actively monitored
+func (a *Agent) trackContainer(id, name, image string) *MonitoredContainer {
+	monitored := &MonitoredContainer{
+		ID:    id,
+		Name:  strings.TrimPrefix(name, "/"),
+		Image: image,
+		Since: time.Now(),
+	}
+
+	a.monitoredMutex.Lock()
+	a.monitoredContainers[id] = monitored
+	a.monitoredMutex.Unlock()
+
+	return monitored
+}
+
+// untrackContainer removes a container from the monitored set
+func (a *Agent) untrackContainer(id string) {
+	a.monitoredMutex.Lock()
+	delete(a.monitoredContainers, id)
+	a.monitoredMutex.Unlock()
+}
+
+// registerAdminHandlers adds authenticated admin endpoints to the health server mux
+func (a *Agent) registerAdminHandlers(mux *http.ServeMux) {
+	if a.config.AdminToken == "" {
+		log.Printf("Admin API disabled (no admin token configured)")
+		return
+	}
+
+	mux.HandleFunc("/admin/containers", a.requireAdmin(a.handleAdminContainers))
+	mux.HandleFunc("/admin/alerts", a.requireAdmin(a.handleAdminAlerts))
+	mux.HandleFunc("/admin/queue", a.requireAdmin(a.handleAdminQueue))
+	mux.HandleFunc("/admin/queue/flush", a.requireAdminMethod(http.MethodPost, a.handleAdminQueueFlush))
+	mux.HandleFunc("/admin/config", a.requireAdmin(a.handleAdminConfig))
+	mux.HandleFunc("/admin/baseline", a.requireAdmin(a.handleAdminBaseline))
+	mux.HandleFunc("/admin/events", a.requireAdmin(a.handleAdminEvents))
+	mux.HandleFunc("/admin/logs", a.requireAdmin(a.handleAdminLogs))
+	mux.HandleFunc("/admin/payloads", a.requireAdmin(a.handleAdminPayloads))
+	mux.HandleFunc("/admin/goroutines", a.requireAdmin(a.handleAdminGoroutines))
+}
+
+// requireAdmin wraps a read-only handler with bearer token authentication
+func (a *Agent) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return a.requireAdminMethod(http.MethodGet, next)
+}
+
+// requireAdminMethod wraps a handler with bearer token authentication,
+// accepting only the given method
+func (a *Agent) requireAdminMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) != 1 {
+			a.audit(AuditRemoteCommand, r.RemoteAddr, "rejected %s %s: unauthorized", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.audit(AuditRemoteCommand, r.RemoteAddr, "%s %s", r.Method, r.URL.RequestURI())
+		next(w, r)
+	}
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func (a *Agent) handleAdminContainers(w http.ResponseWriter, r *http.Request) {
+	a.monitoredMutex.RLock()
+	containers := make([]MonitoredContainer, 0, len(a.monitoredContainers))
+	for _, c := range a.monitoredContainers {
+		containers = append(containers, MonitoredContainer{
+			ID:        c.ID,
+			Name:      c.Name,
+			Image:     c.Image,
+			Since:     c.Since,
+			LinesRead: c.linesRead.Load(),
+			Streaming: c.streaming.Load(),
+		})
+	}
+	a.monitoredMutex.RUnlock()
+
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+
+	writeJSON(w, containers)
+}
+
+func (a *Agent) handleAdminAlerts(w http.ResponseWriter, r *http.Request) {
+	a.alertMutex.RLock()
+	alerts := make([]AlertState, 0, len(a.alertStates))
+	for alert, state := range a.alertStates {
+		copied := *state
+		copied.Detail = a.alertDetail(alert, state)
+		alerts = append(alerts, copied)
+	}
+	a.alertMutex.RUnlock()
+
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].LastSeen.After(alerts[j].LastSeen)
+	})
+
+	writeJSON(w, alerts)
+}
+
+func (a *Agent) handleAdminQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.queueSummary())
+}
+
+// handleAdminQueueFlush delivers every queued payload now rather than at the
+// backfill pace
+func (a *Agent) handleAdminQueueFlush(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.flushQueue())
+}
+
+// queueSummary describes in-memory and on-disk queued payloads
+func (a *Agent) queueSummary() QueueSummary {
+	summary := QueueSummary{
+		Limit:     a.queueLimit(),
+		Payloads:  make([]QueuedPayload, 0),
+		DiskFiles: make([]QueueFileEntry, 0),
+	}
+
+	a.queueMutex.Lock()
+	summary.Length = len(a.payloadQueue)
+	for _, p := range a.payloadQueue {
+		summary.Payloads = append(summary.Payloads, QueuedPayload{
+			ID:        p.ID,
+			Timestamp: p.Timestamp,
+			Logs:      len(p.Logs),
+			Events:    len(p.DockerEvents),
+			Alerts:    p.LocalAlerts,
+		})
+		if summary.Oldest.IsZero() || p.Timestamp.Before(summary.Oldest) {
+			summary.Oldest = p.Timestamp
+		}
+		if p.Timestamp.After(summary.Newest) {
+			summary.Newest = p.Timestamp
+		}
+	}
+	a.queueMutex.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(a.queueDirectory(), "queue_*.jsonl"))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		summary.DiskFiles = append(summary.DiskFiles, QueueFileEntry{
+			Path:    file,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		summary.TotalBytes += info.Size()
+	}
+
+	return summary
+}
+
+func (a *Agent) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.redactedConfig())
+}
+
+// redactedConfig returns the effective configuration with secrets removed
+func (a *Agent) redactedConfig() Config {
+	cfg := a.config
+	if cfg.Secret != "" {
+		cfg.Secret = "[REDACTED]"
+	}
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "[REDACTED]"
+	}
+	if cfg.HealthToken != "" {
+		cfg.HealthToken = "[REDACTED]"
+	}
+	if cfg.MaskHashKey != "" {
+		cfg.MaskHashKey = "[REDACTED]"
+	}
+	if cfg.EnrollToken != "" {
+		cfg.EnrollToken = "[REDACTED]"
+	}
+	// Only the password of a proxy URL is secret
+	if cfg.ProxyURL != "" {
+		cfg.ProxyURL = redactURL(cfg.ProxyURL)
+	}
+	// The Sentry DSN holds the project key
+	if cfg.SentryDSN != "" {
+		cfg.SentryDSN = "[REDACTED]"
+	}
+	// Webhook URLs carry their token, anyone holding one can post
+	for _, webhook := range []*string{&cfg.SlackWebhook, &cfg.SlackCriticalWebhook, &cfg.DiscordWebhook, &cfg.DiscordCriticalWebhook,
+		&cfg.TeamsWebhook, &cfg.TeamsCriticalWebhook} {
+		if *webhook != "" {
+			*webhook = "[REDACTED]"
+		}
+	}
+	return cfg
+}
+
+func (a *Agent) handleAdminBaseline(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.baselineStats())
+}
+
+// baselineStats computes the current detector baselines
+func (a *Agent) baselineStats() BaselineStats {
+	stats := BaselineStats{
+		CPU: CPUBaselineStats{
+			WindowSize:   a.config.BaselineSamples,
+			SpikePct:     a.config.CPUSpikePct,
+			ZScoreCutoff: 3.0,
+		},
+		Auth: AuthBaselineStats{
+			WindowSeconds: a.config.AuthWindowSeconds,
+			Threshold:     a.config.FailedAuthThreshold,
+			FailuresByIP:  make(map[string]int),
+		},
+	}
+
+	a.cpuMutex.RLock()
+	if n := len(a.cpuSamples); n > 0 {
+		var sum, sumSquares float64
+		stats.CPU.Min = a.cpuSamples[0].Value
+		for _, s := range a.cpuSamples {
+			sum += s.Value
+			sumSquares += s.Value * s.Value
+			stats.CPU.Min = math.Min(stats.CPU.Min, s.Value)
+			stats.CPU.Max = math.Max(stats.CPU.Max, s.Value)
+		}
+		stats.CPU.Samples = n
+		stats.CPU.Mean = sum / float64(n)
+		stats.CPU.StdDev = math.Sqrt(math.Max(0, sumSquares/float64(n)-stats.CPU.Mean*stats.CPU.Mean))
+		stats.CPU.Last = a.cpuSamples[n-1].Value
+		stats.CPU.LastSampled = a.cpuSamples[n-1].Timestamp
+	}
+	a.cpuMutex.RUnlock()
+
+	windowStart := time.Now().Add(-time.Duration(a.config.AuthWindowSeconds) * time.Second)
+	a.alertMutex.RLock()
+	for _, failure := range a.authFailures {
+		if failure.Timestamp.After(windowStart) {
+			stats.Auth.FailuresByIP[failure.IP]++
+			stats.Auth.FailuresInWindow++
+		}
+	}
+	a.alertMutex.RUnlock()
+
+	return stats
+}
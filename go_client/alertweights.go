@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseAlertWeights parses --alert-weights, a comma-separated list of
+// TYPE=weight entries, into score weights by alert type
+func parseAlertWeights(spec string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		alertType, value, ok := strings.Cut(entry, "=")
+		alertType = strings.TrimSpace(alertType)
+		if !ok || alertType == "" || strings.Contains(alertType, ":") {
+			return nil, fmt.Errorf("invalid alert weight %q (want TYPE=weight)", entry)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			return nil, fmt.Errorf("invalid alert weight %q: weight must be a number of at least 0", entry)
+		}
+		weights[alertType] = weight
+	}
+	return weights, nil
+}
+
+// scoreWeights returns the built-in alert weights with --alert-weights
+// applied on top
+func scoreWeights(spec string) (map[string]float64, error) {
+	overrides, err := parseAlertWeights(spec)
+	if err != nil {
+		return nil, err
+	}
+	weights := make(map[string]float64, len(alertWeights)+len(overrides))
+	for alertType, weight := range alertWeights {
+		weights[alertType] = weight
+	}
+	for alertType, weight := range overrides {
+		weights[alertType] = weight
+	}
+	return weights, nil
+}
+
+// alertWeight returns the score weight of an alert type and whether it is
+// configured, built in or given with --alert-weights. Agents built without
+// a config (replay, tests) use the built-in weights.
+func (a *Agent) alertWeight(alertType string) (float64, bool) {
+	weights := a.scoreWeights
+	if weights == nil {
+		weights = alertWeights
+	}
+	weight, ok := weights[alertType]
+	return weight, ok
+}
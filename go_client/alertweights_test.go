@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestAlertWeights tests overriding built-in alert weights and weighting
+// custom alert types with --alert-weights
+func TestAlertWeights(t *testing.T) {
+	agent, err := NewAgent(Config{AlertWeights: "CPU_SPIKE=0.1, BRUTE_FORCE=0.9,CARD_TESTING=0.7"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	testCases := []struct {
+		alerts        []string
+		expectedScore float64
+	}{
+		{[]string{"CPU_SPIKE"}, 0.1},
+		{[]string{"BRUTE_FORCE:10.0.0.1"}, 0.9},
+		{[]string{"SHELL_IN_CONTAINER"}, 0.6},
+		{[]string{"CARD_TESTING:checkout", "CPU_SPIKE"}, 0.8},
+	}
+	for _, tc := range testCases {
+		if score := agent.calculateScore(tc.alerts); math.Abs(score-tc.expectedScore) > 0.001 {
+			t.Errorf("Expected score %.3f for alerts %v, got %.3f", tc.expectedScore, tc.alerts, score)
+		}
+	}
+	if alertWeights["CPU_SPIKE"] != 0.4 {
+		t.Errorf("Expected the built-in weights left alone, got CPU_SPIKE=%v", alertWeights["CPU_SPIKE"])
+	}
+
+	// A detector can't change a weight given with --alert-weights
+	agent.detectors = []Detector{&fakeDetector{alerts: []DetectorAlert{{Alert: "CARD_TESTING:checkout", Weight: 0.2}}}}
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(payload.Score-0.7) > 0.001 {
+		t.Errorf("Expected the configured CARD_TESTING weight, got score %v", payload.Score)
+	}
+
+	for _, spec := range []string{"CPU_SPIKE", "=0.3", "CPU_SPIKE=high", "CPU_SPIKE=-1", "BRUTE_FORCE:1.2.3.4=1"} {
+		if _, err := NewAgent(Config{AlertWeights: spec}); err == nil {
+			t.Errorf("Expected --alert-weights %q to be rejected", spec)
+		}
+	}
+}
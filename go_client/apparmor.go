@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// procRoot is where process cgroups are read from
+var procRoot = "/proc"
+
+var (
+	apparmorDeniedPattern = regexp.MustCompile(`apparmor="DENIED"`)
+	containerIDPattern    = regexp.MustCompile(`[0-9a-f]{64}`)
+)
+
+// parseAppArmorDenial extracts an AppArmor denial and the denied pid from a
+// kernel or audit log line, returning false for anything else
+func parseAppArmorDenial(line string) (SecurityEvent, int, bool) {
+	if !apparmorDeniedPattern.MatchString(line) {
+		return SecurityEvent{}, 0, false
+	}
+
+	fields := make(map[string]string)
+	for _, field := range avcFieldPattern.FindAllStringSubmatch(line, -1) {
+		fields[field[1]] = strings.Trim(field[2], `"`)
+	}
+
+	event := SecurityEvent{
+		Type:        "apparmor",
+		Action:      "denied",
+		Subject:     fields["profile"],
+		Target:      fields["operation"],
+		Class:       fields["class"],
+		Permissions: strings.Split(fields["denied_mask"], ""),
+		Process:     fields["comm"],
+		Path:        fields["name"],
+		Timestamp:   time.Now(),
+	}
+	if ts := auditTimePattern.FindStringSubmatch(line); ts != nil {
+		sec, _ := strconv.ParseInt(ts[1], 10, 64)
+		msec, _ := strconv.ParseInt(ts[2], 10, 64)
+		event.Timestamp = time.Unix(sec, msec*int64(time.Millisecond))
+	}
+	pid, _ := strconv.Atoi(fields["pid"])
+	return event, pid, true
+}
+
+// containerIDForPID returns the Docker container ID from a process's cgroup,
+// or "" if the process is not in a container or has exited
+func containerIDForPID(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	return containerIDPattern.FindString(string(data))
+}
+
+// containerNameForID maps a container ID to the name of a monitored
+// container, falling back to the short ID
+func (a *Agent) containerNameForID(id string) string {
+	a.monitoredMutex.RLock()
+	defer a.monitoredMutex.RUnlock()
+
+	if monitored, ok := a.monitoredContainers[id]; ok {
+		return monitored.Name
+	}
+	return id[:12]
+}
+
+// handleAppArmorLine records AppArmor denials as security events and raises
+// APPARMOR_DENIAL:<container> for denials inside containers. The container is
+// found from the denied pid's cgroup; for docker-* profiles whose process has
+// already exited the profile name is used instead.
+func (a *Agent) handleAppArmorLine(line string) {
+	event, pid, ok := parseAppArmorDenial(line)
+	if !ok {
+		return
+	}
+
+	if id := containerIDForPID(pid); id != "" {
+		event.Container = a.containerNameForID(id)
+	} else if strings.HasPrefix(event.Subject, "docker") {
+		event.Container = event.Subject
+	}
+	a.recordSecurityEvent(event)
+
+	if event.Container == "" {
+		return
+	}
+	alert := "APPARMOR_DENIAL:" + event.Container
+	reason := fmt.Sprintf("%s %s", event.Target, event.Path)
+	if a.recordDenial(alert, strings.TrimSpace(reason)) {
+		log.Printf("AppArmor denied %s %s in container %s (profile %s, %s)", event.Target, event.Path, event.Container, event.Subject, event.Process)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAppArmorDenialAlert tests container attribution of AppArmor denials
+func TestAppArmorDenialAlert(t *testing.T) {
+	containerID := strings.Repeat("ab", 32)
+	procRoot = t.TempDir()
+	defer func() { procRoot = "/proc" }()
+	os.MkdirAll(filepath.Join(procRoot, "4242"), 0755)
+	os.WriteFile(filepath.Join(procRoot, "4242", "cgroup"), []byte("0::/system.slice/docker-"+containerID+".scope\n"), 0644)
+
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.trackContainer(containerID, "/web", "nginx:latest")
+
+	line := `[ 99.1] audit: type=1400 audit(1736937000.500:789): apparmor="DENIED" operation="open" profile="docker-default" name="/etc/shadow" pid=4242 comm="cat" requested_mask="r" denied_mask="r" fsuid=0 ouid=0`
+	agent.handleDenialLine(line)
+
+	if !agent.containsAlert("APPARMOR_DENIAL:web") {
+		t.Fatalf("Expected APPARMOR_DENIAL:web, got %v", agent.localAlerts)
+	}
+	if detail := agent.alertStates["APPARMOR_DENIAL:web"].Detail; detail != "open /etc/shadow=1" {
+		t.Errorf("Unexpected alert detail %q", detail)
+	}
+	if len(agent.securityEvents) != 1 || agent.securityEvents[0].Subject != "docker-default" {
+		t.Errorf("Unexpected security events %+v", agent.securityEvents)
+	}
+
+	// Host profiles are recorded but do not raise container alerts
+	agent.handleDenialLine(`audit: type=1400 audit(1736937001.000:790): apparmor="DENIED" operation="exec" profile="/usr/sbin/cupsd" name="/bin/sh" pid=1 comm="cupsd" denied_mask="x"`)
+	if len(agent.localAlerts) != 1 || len(agent.securityEvents) != 2 {
+		t.Errorf("Expected host denial as event only, got alerts %v", agent.localAlerts)
+	}
+}
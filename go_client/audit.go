@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditAgentStarted  = "agent_started"
+	AuditAgentStopped  = "agent_stopped"
+	AuditAlertRaised   = "alert_raised"
+	AuditConfigApplied = "config_applied"
+	AuditRemoteCommand = "remote_command"
+)
+
+// AuditEntry is a single hash-chained audit record. Hash covers every other
+// field including PrevHash, so editing or removing an entry breaks the chain.
+type AuditEntry struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor,omitempty"`
+	Detail   string    `json:"detail"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// auditLog is an append-only JSON Lines file of AuditEntry records
+type auditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	lastHash string
+	seq      uint64
+}
+
+// openAuditLog opens (or creates) the audit log and resumes its hash chain
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	l := &auditLog{}
+	last, err := lastAuditEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		l.lastHash = last.Hash
+		l.seq = last.Seq
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// lastAuditEntry returns the final entry of an existing audit log, if any
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last *AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("corrupt audit entry after seq %d: %w", seqOf(last), err)
+		}
+		last = &entry
+	}
+	return last, scanner.Err()
+}
+
+func seqOf(entry *AuditEntry) uint64 {
+	if entry == nil {
+		return 0
+	}
+	return entry.Seq
+}
+
+// hashAuditEntry computes the chained hash of an entry with its Hash field cleared
+func hashAuditEntry(entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Append writes a new entry chained to the previous one and syncs it to disk
+func (l *auditLog) Append(action, actor, detail string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := AuditEntry{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Action:   action,
+		Actor:    actor,
+		Detail:   detail,
+		PrevHash: l.lastHash,
+	}
+	entry.Hash = hashAuditEntry(entry)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.seq = entry.Seq
+	l.lastHash = entry.Hash
+	return nil
+}
+
+// Close closes the underlying file
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// verifyAuditLog walks the chain and returns the number of valid entries,
+// or an error identifying the first entry that was modified, removed or reordered
+func verifyAuditLog(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var prevHash string
+	var prevSeq uint64
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, fmt.Errorf("line %d: invalid entry: %w", count+1, err)
+		}
+		if entry.Seq != prevSeq+1 {
+			return count, fmt.Errorf("seq %d: expected seq %d", entry.Seq, prevSeq+1)
+		}
+		if entry.PrevHash != prevHash {
+			return count, fmt.Errorf("seq %d: previous hash mismatch", entry.Seq)
+		}
+		if hashAuditEntry(entry) != entry.Hash {
+			return count, fmt.Errorf("seq %d: entry hash mismatch", entry.Seq)
+		}
+		prevHash = entry.Hash
+		prevSeq = entry.Seq
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// audit records a security-relevant action if audit logging is enabled
+func (a *Agent) audit(action, actor, format string, args ...interface{}) {
+	if a.auditLog == nil {
+		return
+	}
+	if err := a.auditLog.Append(action, actor, fmt.Sprintf(format, args...)); err != nil {
+		a.recordEvent(EventAuditFailure, "", "audit write failed: %v", err)
+	}
+}
+
+// configFingerprint returns a short hash of the redacted effective configuration
+func (a *Agent) configFingerprint() string {
+	data, _ := json.Marshal(a.redactedConfig())
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAuditLogChain tests chaining across reopen and tamper detection
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	l.Append(AuditAlertRaised, "", "CPU_SPIKE")
+	l.Append(AuditRemoteCommand, "127.0.0.1:5555", "GET /admin/config")
+	l.Close()
+
+	// Reopening must continue the existing chain
+	l, err = openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	l.Append(AuditAgentStopped, "", "shutdown")
+	l.Close()
+
+	count, err := verifyAuditLog(path)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 valid entries, got %d (err: %v)", count, err)
+	}
+
+	data, _ := os.ReadFile(path)
+	tampered := strings.Replace(string(data), "CPU_SPIKE", "NOTHING", 1)
+	os.WriteFile(path, []byte(tampered), 0600)
+
+	if _, err := verifyAuditLog(path); err == nil {
+		t.Error("Expected verification to fail after tampering")
+	}
+}
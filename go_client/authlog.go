@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Values accepted by --auth-log-format
+var authLogFormats = map[string]bool{"syslog": true, "json": true}
+
+// Fields of a JSON auth log line that may hold the log message, in order of
+// preference
+var authLogMessageFields = []string{"message", "msg", "MESSAGE", "log"}
+
+// authLineMatcher finds the client address of a failed login in an auth log
+// message, using the sshd pattern or --auth-log-pattern
+type authLineMatcher struct {
+	pattern *regexp.Regexp
+	group   int
+}
+
+// newAuthLineMatcher compiles --auth-log-pattern. The client address is the
+// group named ip, or else the first group. An empty pattern matches sshd's
+// "Failed password" lines.
+func newAuthLineMatcher(pattern string) (*authLineMatcher, error) {
+	if pattern == "" {
+		return &authLineMatcher{pattern: sshdFailurePattern, group: 1}, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth log pattern: %w", err)
+	}
+	group := re.SubexpIndex("ip")
+	if group < 0 {
+		if re.NumSubexp() == 0 {
+			return nil, fmt.Errorf("invalid auth log pattern %q: needs a group capturing the client address, e.g. (?P<ip>\\S+)", pattern)
+		}
+		group = 1
+	}
+	return &authLineMatcher{pattern: re, group: group}, nil
+}
+
+// match returns the client address of a failed login in message
+func (m *authLineMatcher) match(message string) (string, bool) {
+	matches := m.pattern.FindStringSubmatch(message)
+	if len(matches) <= m.group || matches[m.group] == "" {
+		return "", false
+	}
+	return matches[m.group], true
+}
+
+// newAuthLogParser checks --auth-log-format and compiles --auth-log-pattern
+func newAuthLogParser(config Config) (*authLineMatcher, error) {
+	if config.AuthLogFormat != "" && !authLogFormats[config.AuthLogFormat] {
+		return nil, fmt.Errorf("invalid auth log format %q (valid: syslog, json)", config.AuthLogFormat)
+	}
+	return newAuthLineMatcher(config.AuthLogPattern)
+}
+
+// handleAuthLogLine records a failed login from a followed auth log line in
+// --auth-log-format. Agents built without a config (tests) read sshd syslog
+// lines.
+func (a *Agent) handleAuthLogLine(line string) {
+	message := line
+	if a.config.AuthLogFormat == "json" {
+		var ok bool
+		if message, ok = jsonLogMessage(line); !ok {
+			return
+		}
+	}
+	matcher := a.authMatcher
+	if matcher == nil {
+		matcher = &authLineMatcher{pattern: sshdFailurePattern, group: 1}
+	}
+	if ip, ok := matcher.match(message); ok {
+		a.recordAuthFailure(ip, time.Now())
+	}
+}
+
+// jsonLogMessage returns the message of a JSON log line, such as rsyslog or
+// syslog-ng JSON output
+func jsonLogMessage(line string) (string, bool) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return "", false
+	}
+	for _, name := range authLogMessageFields {
+		if message, ok := fields[name].(string); ok {
+			return message, true
+		}
+	}
+	return "", false
+}
+
+// configuredAuthLogs returns the --auth-logs files
+func configuredAuthLogs(config Config) []string {
+	var paths []string
+	for _, path := range strings.Split(config.AuthLogs, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// authOffsetFile returns where the read position of the i-th followed auth
+// log is saved. The first keeps --auth-offset-file, so its position survives
+// adding files to --auth-logs; the others get the file's name appended.
+func authOffsetFile(offsetFile, path string, i int) string {
+	if offsetFile == "" || i == 0 {
+		return offsetFile
+	}
+	ext := filepath.Ext(offsetFile)
+	return strings.TrimSuffix(offsetFile, ext) + "." + filepath.Base(path) + ext
+}
+
+// followAuthLogs follows every --auth-logs file; missing files are skipped
+// with a warning
+func (a *Agent) followAuthLogs(paths []string) error {
+	followed := 0
+	for i, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("Warning: Auth log %s not found: %v", path, err)
+			continue
+		}
+		if err := a.followAuthLog(path, authOffsetFile(a.config.AuthOffsetFile, path, i)); err != nil {
+			return err
+		}
+		followed++
+	}
+	if followed == 0 {
+		log.Printf("Warning: None of the --auth-logs files exist, security monitoring disabled")
+	}
+	return nil
+}
+
+// followAuthLog follows an auth log across rotations, resuming from the
+// position saved in offsetFile when it is set
+func (a *Agent) followAuthLog(path, offsetFile string) error {
+	var tailer *fileTailer
+	var err error
+	if offsetFile != "" {
+		tailer, err = newStatefulFileTailer(path, offsetFile, !a.config.DryRun, a.handleAuthLogLine)
+	} else {
+		tailer, err = newFileTailer(path, true, a.handleAuthLogLine)
+	}
+	if err != nil {
+		return err
+	}
+	a.logSources = append(a.logSources, tailer)
+	log.Printf("Monitoring auth log: %s (%s format)", path, a.authLogFormat())
+	return nil
+}
+
+// authLogFormat returns --auth-log-format
+func (a *Agent) authLogFormat() string {
+	if a.config.AuthLogFormat == "" {
+		return "syslog"
+	}
+	return a.config.AuthLogFormat
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestAuthLogFormats tests failed login extraction with --auth-log-format
+// and --auth-log-pattern
+func TestAuthLogFormats(t *testing.T) {
+	testCases := []struct {
+		format, pattern string
+		line            string
+		ip              string
+	}{
+		{"", "", "Jan 15 10:30:00 web-01 sshd[1234]: Failed password for root from 203.0.113.9 port 40022 ssh2", "203.0.113.9"},
+		{"syslog", "", "Jan 15 10:30:00 web-01 sshd[1234]: Accepted publickey for deploy from 203.0.113.9", ""},
+		{"json", "", `{"@timestamp":"2025-01-15T10:30:00Z","program":"sshd","message":"Failed password for invalid user oracle from 198.51.100.4 port 51000 ssh2"}`, "198.51.100.4"},
+		{"json", "", `{"msg":"Failed password for root from 198.51.100.5 port 51000 ssh2"}`, "198.51.100.5"},
+		{"json", "", "Failed password for root from 198.51.100.6 port 51000 ssh2", ""},
+		{"", `sshd\[\d+\]: Invalid user \S+ from (?P<ip>[0-9a-f:.]+)`, "Jan 15 10:30:00 web-01 sshd[1234]: Invalid user admin from 2001:db8::7 port 22", "2001:db8::7"},
+		{"", `auth failed user=\S+ src=(\S+)`, "custom-sshd: auth failed user=root src=192.0.2.44", "192.0.2.44"},
+		{"json", `LOGIN FAILED .* from (?P<ip>\S+)`, `{"log":"LOGIN FAILED for bob from 192.0.2.45"}`, "192.0.2.45"},
+	}
+	for _, tc := range testCases {
+		matcher, err := newAuthLogParser(Config{AuthLogFormat: tc.format, AuthLogPattern: tc.pattern})
+		if err != nil {
+			t.Fatalf("Failed to build parser for %q %q: %v", tc.format, tc.pattern, err)
+		}
+		agent := &Agent{config: Config{AuthLogFormat: tc.format}, authMatcher: matcher}
+		agent.handleAuthLogLine(tc.line)
+		switch {
+		case tc.ip == "" && len(agent.authFailures) != 0:
+			t.Errorf("Expected no failure from %q, got %+v", tc.line, agent.authFailures)
+		case tc.ip != "" && (len(agent.authFailures) != 1 || agent.authFailures[0].IP != tc.ip):
+			t.Errorf("Expected a failure from %s in %q, got %+v", tc.ip, tc.line, agent.authFailures)
+		}
+	}
+
+	for _, config := range []Config{
+		{AuthLogFormat: "logfmt"},
+		{AuthLogPattern: "Failed password from \\S+"},
+		{AuthLogPattern: "Failed (password"},
+	} {
+		if _, err := NewAgent(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+// TestAuthLogFiles tests following every --auth-logs file, each resuming
+// from its own saved position
+func TestAuthLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "sshd.log"), filepath.Join(dir, "missing.log"), filepath.Join(dir, "bastion.log")}
+	os.WriteFile(paths[0], []byte("sshd[1]: Failed password for root from 192.0.2.1 port 1 ssh2\n"), 0644)
+	os.WriteFile(paths[2], []byte("sshd[2]: Failed password for root from 192.0.2.2 port 2 ssh2\n"), 0644)
+
+	offsetFile := filepath.Join(dir, "auth_offset.json")
+	config := Config{AuthLogs: paths[0] + ", " + paths[1] + "," + paths[2], AuthOffsetFile: offsetFile}
+	agent := &Agent{config: config}
+	if err := agent.followAuthLogs(configuredAuthLogs(config)); err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.logSources) != 2 {
+		t.Fatalf("Expected the 2 existing auth logs followed, got %d", len(agent.logSources))
+	}
+	for _, source := range agent.logSources {
+		source.(*fileTailer).poll()
+		source.Close()
+	}
+
+	agent.alertMutex.Lock()
+	ips := map[string]bool{}
+	for _, failure := range agent.authFailures {
+		ips[failure.IP] = true
+	}
+	agent.alertMutex.Unlock()
+	if len(ips) != 2 || !ips["192.0.2.1"] || !ips["192.0.2.2"] {
+		t.Errorf("Expected failures from both auth logs, got %+v", agent.authFailures)
+	}
+	for _, state := range []string{offsetFile, filepath.Join(dir, "auth_offset.bastion.log.json")} {
+		if _, err := os.Stat(state); err != nil {
+			t.Errorf("Expected read position saved in %s: %v", state, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// backfillPace is the wait between queued payload deliveries
+func (a *Agent) backfillPace() time.Duration {
+	if a.config.BackfillRate <= 0 {
+		return a.sendInterval()
+	}
+	return time.Duration(float64(time.Second) / a.config.BackfillRate)
+}
+
+// runBackfill delivers queued payloads oldest-first, at most --backfill-rate
+// per second, until ctx is done. It runs apart from the payload loop, so
+// draining a backlog after an outage never holds up live payloads. While the
+// queue is empty or the server keeps failing it checks again every --interval.
+func (a *Agent) runBackfill(ctx context.Context) {
+	defer reportPanic()
+
+	for {
+		wait := a.backfillPace()
+		if a.queueLength() == 0 || a.processQueue() != nil {
+			wait = a.sendInterval()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// QueueFlushResult reports a flush of the payload queue
+type QueueFlushResult struct {
+	Sent      int    `json:"sent"`
+	Remaining int    `json:"remaining"`
+	Error     string `json:"error,omitempty"`
+}
+
+// flushQueue delivers queued payloads back to back, oldest-first, stopping
+// at the first failure. Payloads queued during the flush wait for backfill.
+func (a *Agent) flushQueue() QueueFlushResult {
+	var result QueueFlushResult
+	for pending := a.queueLength(); pending > 0 && a.queueLength() > 0; pending-- {
+		if err := a.processQueue(); err != nil {
+			result.Error = err.Error()
+			break
+		}
+		result.Sent++
+	}
+	result.Remaining = a.queueLength()
+	log.Printf("Queue flush sent %d payload(s), %d remaining", result.Sent, result.Remaining)
+	return result
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backfillServer acknowledges payloads and records them in arrival order
+type backfillServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	payloads []Payload
+	signedAt []time.Time
+}
+
+func newBackfillServer(t *testing.T) *backfillServer {
+	s := &backfillServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Agent-Timestamp"), 10, 64)
+		s.mu.Lock()
+		s.payloads = append(s.payloads, payload)
+		s.signedAt = append(s.signedAt, time.Unix(ts, 0))
+		s.mu.Unlock()
+		writeJSON(w, map[string]interface{}{"status": "success", "ack": newAck("s3cret", payload.ID, AckStored)})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *backfillServer) received() []Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Payload(nil), s.payloads...)
+}
+
+// TestBackfillKeepsCollectionTime tests that queued payloads are sent marked
+// as backfill with their collection timestamp, and leave live data alone
+func TestBackfillKeepsCollectionTime(t *testing.T) {
+	defer func(old string) { queueDir = old }(queueDir)
+	queueDir = t.TempDir()
+	server := newBackfillServer(t)
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	collected := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	agent.enqueuePayload(Payload{ID: newUUID(), Timestamp: collected})
+	agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "web", Message: "live"})
+
+	if err := agent.processQueue(); err != nil {
+		t.Fatalf("Expected queued payload to be delivered: %v", err)
+	}
+	received := server.received()
+	if len(received) != 1 || !received[0].Backfill || !received[0].Timestamp.Equal(collected) {
+		t.Fatalf("Expected one backfill payload collected at %v, got %+v", collected, received)
+	}
+	if time.Since(server.signedAt[0]) > time.Minute {
+		t.Errorf("Expected backfill to be signed at send time, got %v", server.signedAt[0])
+	}
+	if len(agent.logBuffer) != 1 {
+		t.Errorf("Expected backfill to leave the live log buffer alone, got %d entries", len(agent.logBuffer))
+	}
+	if agent.queueLength() != 0 {
+		t.Errorf("Expected queue to be empty, got %d", agent.queueLength())
+	}
+}
+
+// TestBackfillOldestFirst tests that runBackfill drains the queue in
+// collection order at --backfill-rate
+func TestBackfillOldestFirst(t *testing.T) {
+	defer func(old string) { queueDir = old }(queueDir)
+	queueDir = t.TempDir()
+	server := newBackfillServer(t)
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret", Interval: 60, BackfillRate: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	now := time.Now()
+	for _, age := range []time.Duration{2 * time.Minute, 5 * time.Minute, time.Minute} {
+		agent.enqueuePayload(Payload{ID: age.String(), Timestamp: now.Add(-age)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go agent.runBackfill(ctx)
+	for deadline := time.Now().Add(10 * time.Second); len(server.received()) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 payloads backfilled, got %d", len(server.received()))
+		}
+	}
+	cancel()
+
+	var order []string
+	for _, payload := range server.received() {
+		order = append(order, payload.ID)
+	}
+	if len(order) != 3 || order[0] != "5m0s" || order[1] != "2m0s" || order[2] != "1m0s" {
+		t.Errorf("Expected oldest payload first, got %v", order)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected deliveries paced at 10 per second, all 3 took %v", elapsed)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Content type of a batch: one payload per line, each encoded as it would be
+// POSTed on its own
+const batchContentType = "application/x-ndjson"
+
+// Largest batch response body read when looking for acks
+const maxBatchResponseBytes = 1 << 20
+
+// errBatchUnsupported is returned when a server has no batch endpoint
+var errBatchUnsupported = errors.New("server has no batch endpoint")
+
+// batchedPayload is a live payload waiting in the batch, and its encoding
+type batchedPayload struct {
+	payload Payload
+	line    []byte
+}
+
+// batchAck is one entry of a batch response: the payload's ack, or why the
+// server rejected it
+type batchAck struct {
+	Ack
+	Error string `json:"error,omitempty"`
+}
+
+// batchURL returns the batch endpoint beside a --server-url endpoint:
+// /ingest/batch for /ingest
+func batchURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	u.Path = path.Join(u.Path, "batch")
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// batching reports whether live payloads are sent in batches. The gRPC
+// stream already carries payloads without a request each, and a server
+// without a batch endpoint gets them one by one.
+func (a *Agent) batching() bool {
+	return a.config.BatchSize > 1 && a.stream == nil && !a.batchUnsupported.Load()
+}
+
+// batchLimit returns --batch-max-kb in bytes
+func (a *Agent) batchLimit() int {
+	if a.config.BatchMaxKB > 0 {
+		return a.config.BatchMaxKB << 10
+	}
+	return math.MaxInt
+}
+
+// batchPayload adds a live payload to the batch, sending the batch once it
+// holds --batch-size payloads. A payload that would take the batch past
+// --batch-max-kb sends the batch before it, and a payload raising an alert
+// sends the batch right away so alerts are not held back.
+func (a *Agent) batchPayload(payload Payload) error {
+	line, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	a.batchMutex.Lock()
+	defer a.batchMutex.Unlock()
+	var errs []error
+	if len(a.batch) > 0 && a.batchBytes+len(line)+1 > a.batchLimit() {
+		errs = append(errs, a.sendBatch())
+	}
+	a.batch = append(a.batch, batchedPayload{payload: payload, line: line})
+	a.batchBytes += len(line) + 1
+	// The payload carries what was buffered; the next one starts afresh even
+	// though this one is not delivered yet
+	a.clearLiveBuffers()
+
+	if len(a.batch) >= a.config.BatchSize || a.raisesAlert(payload) {
+		errs = append(errs, a.sendBatch())
+	}
+	return errors.Join(errs...)
+}
+
+// flushBatch sends any payloads waiting in the batch, e.g. on shutdown
+func (a *Agent) flushBatch() error {
+	a.batchMutex.Lock()
+	defer a.batchMutex.Unlock()
+	if len(a.batch) == 0 {
+		return nil
+	}
+	return a.sendBatch()
+}
+
+// raisesAlert reports whether payload carries an alert that has not reached
+// the server before. Alerts still firing since their last delivery wait for
+// the batch like everything else.
+func (a *Agent) raisesAlert(payload Payload) bool {
+	a.alertMutex.RLock()
+	defer a.alertMutex.RUnlock()
+	for _, alert := range payload.LocalAlerts {
+		if state, ok := a.alertStates[alert]; !ok || state.LastDelivered.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// sendBatch delivers the batch and empties it. Payloads the server did not
+// acknowledge are queued for backfill. Must be called with batchMutex held.
+func (a *Agent) sendBatch() error {
+	batch := a.batch
+	a.batch = nil
+	a.batchBytes = 0
+
+	failed, err := a.deliverBatch(batch)
+	if errors.Is(err, errBatchUnsupported) {
+		log.Printf("Warning: %v, sending payloads one by one", err)
+		a.batchUnsupported.Store(true)
+		for _, batched := range batch {
+			if err := a.deliverPayload(batched.payload); err != nil {
+				failed[batched.payload.ID] = err
+			}
+		}
+		err = nil
+	}
+
+	var delivered []string
+	for _, batched := range batch {
+		if ackErr, ok := failed[batched.payload.ID]; ok {
+			a.selfMetrics.SendFailures.Add(1)
+			a.queueUndelivered(batched.payload, ackErr)
+			continue
+		}
+		delivered = append(delivered, batched.payload.LocalAlerts...)
+	}
+	// Alerts of a payload left undelivered stay pending and go out again
+	a.alertMutex.Lock()
+	a.markAlertsDelivered(delivered)
+	if len(failed) == 0 {
+		a.localAlerts = a.localAlerts[:0]
+	}
+	a.alertMutex.Unlock()
+
+	if err == nil && len(failed) > 0 {
+		err = fmt.Errorf("%d of %d payload(s) in the batch not acknowledged", len(failed), len(batch))
+	}
+	return err
+}
+
+// deliverBatch posts a batch to the server with retries, like deliverPayload.
+// It returns the payloads that were not acknowledged, with the reason; when
+// the whole batch failed they all are, and the error says why.
+func (a *Agent) deliverBatch(batch []batchedPayload) (map[string]error, error) {
+	var body bytes.Buffer
+	for _, batched := range batch {
+		body.Write(batched.line)
+		body.WriteByte('\n')
+	}
+
+	maxRetries := 3
+	baseDelay := time.Second
+	var err error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		a.selfMetrics.SendAttempts.Add(1)
+		if attempt > 0 {
+			a.selfMetrics.SendRetries.Add(1)
+		}
+
+		var failed map[string]error
+		sendStart := time.Now()
+		err = a.tryServers(func(serverURL string) error {
+			var postErr error
+			failed, postErr = a.postBatchTo(serverURL, body.Bytes(), batch)
+			return postErr
+		})
+		a.selfMetrics.PayloadSend.Since(sendStart)
+		if err == nil {
+			log.Printf("Sent batch of %d payload(s) to server, %d acknowledged", len(batch), len(batch)-len(failed))
+			a.lastSendOK = time.Now()
+			a.selfMetrics.BatchesSent.Add(1)
+			a.selfMetrics.SendSuccesses.Add(uint64(len(batch) - len(failed)))
+			return failed, nil
+		}
+		if errors.Is(err, errBatchUnsupported) {
+			return map[string]error{}, err
+		}
+		log.Printf("Failed to send batch of %d payload(s) (attempt %d/%d): %v", len(batch), attempt+1, maxRetries, err)
+		for _, batched := range batch {
+			a.recordEvent(EventSendFailure, batched.payload.ID, "batch attempt %d/%d: %v", attempt+1, maxRetries, err)
+		}
+
+		if attempt < maxRetries-1 {
+			delay := time.Duration(math.Pow(2, float64(attempt))) * baseDelay
+			log.Printf("Retrying in %v...", delay)
+			time.Sleep(delay)
+		}
+	}
+
+	failed := make(map[string]error, len(batch))
+	for _, batched := range batch {
+		failed[batched.payload.ID] = err
+	}
+	return failed, fmt.Errorf("failed to send batch of %d payload(s) after %d attempts: %w", len(batch), maxRetries, err)
+}
+
+// postBatchTo POSTs an encoded batch to the batch endpoint beside one server
+// endpoint, and checks the ack for each payload in it
+func (a *Agent) postBatchTo(serverURL string, body []byte, batch []batchedPayload) (map[string]error, error) {
+	target, err := batchURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := a.newBatchRequest(target, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errBatchUnsupported
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Acks []batchAck `json:"acks"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBatchResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if len(data) > 0 {
+		// Like a single payload's response, one without acks is checked as such
+		json.Unmarshal(data, &response)
+	}
+	acks := make(map[string]batchAck, len(response.Acks))
+	for _, ack := range response.Acks {
+		acks[ack.PayloadID] = ack
+	}
+
+	failed := make(map[string]error)
+	for _, batched := range batch {
+		id := batched.payload.ID
+		ack, ok := acks[id]
+		if ok && ack.Status == AckRejected {
+			failed[id] = fmt.Errorf("server rejected payload: %s", ack.Error)
+			continue
+		}
+		var checked *Ack
+		if ok {
+			checked = &ack.Ack
+		}
+		if err := a.checkAck(checked, id); err != nil {
+			failed[id] = fmt.Errorf("not acknowledged: %w", err)
+		}
+	}
+	return failed, nil
+}
+
+// newBatchRequest builds a POST of an encoded batch, signed over the time
+// it is sent and the whole body like a single payload
+func (a *Agent) newBatchRequest(target string, batchBytes []byte) (*http.Request, error) {
+	body, encoding, err := compressBody(a.config.Compression, batchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress batch: %w", err)
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	signedAt := time.Now()
+	req.Header.Set("Content-Type", batchContentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("X-Agent-Signature", fmt.Sprintf("sha256=%s", a.signPayload(batchBytes, signedAt)))
+	req.Header.Set("X-Agent-Timestamp", strconv.FormatInt(signedAt.Unix(), 10))
+	if a.config.KeyID != "" {
+		req.Header.Set("X-Agent-Key-Id", a.config.KeyID)
+	}
+	return req, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBatching tests sending live payloads of several intervals in one
+// signed request, early for new alerts and --batch-max-kb, and on shutdown
+func TestBatching(t *testing.T) {
+	var out bytes.Buffer
+	rv := &receiver{secret: "s3cret", maxSkew: time.Minute, out: &out}
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		rv.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+
+	agent, err := NewAgent(Config{ServerURL: server.URL + "/ingest", Secret: "s3cret", QueueDir: t.TempDir(), BatchSize: 3, Compression: "gzip"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if !agent.batching() {
+		t.Fatal("Expected --batch-size 3 to batch payloads")
+	}
+
+	for i := 0; i < 3; i++ {
+		agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "web", Message: "line"})
+		if err := agent.sendPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if len(agent.logBuffer) != 0 {
+			t.Error("Expected a batched payload's logs cleared from the live buffer")
+		}
+		if i < 2 && len(requests()) != 0 {
+			t.Fatalf("Expected payloads held until the batch is full, got %v", requests())
+		}
+	}
+	if got := requests(); len(got) != 1 || got[0] != "/ingest/batch" {
+		t.Fatalf("Expected one request to /ingest/batch, got %v", got)
+	}
+	if n := strings.Count(out.String(), "signature OK"); n != 3 {
+		t.Errorf("Expected 3 payloads verified in the batch, got %d:\n%s", n, out.String())
+	}
+	if agent.queueLength() != 0 || agent.selfMetrics.BatchesSent.Load() != 1 {
+		t.Errorf("Expected the whole batch acknowledged, %d queued", agent.queueLength())
+	}
+
+	// A new alert doesn't wait for the batch to fill
+	agent.alertMutex.Lock()
+	agent.raiseAlert("HIGH_CPU")
+	alerts := append([]string(nil), agent.localAlerts...)
+	agent.alertMutex.Unlock()
+	agent.sendPayload(Payload{ID: newUUID(), Timestamp: time.Now(), LocalAlerts: alerts})
+	if len(requests()) != 2 || len(agent.localAlerts) != 0 || agent.alertStates["HIGH_CPU"].State != AlertStateDelivered {
+		t.Errorf("Expected the new alert sent and delivered right away, got %v", requests())
+	}
+
+	// A payload past --batch-max-kb sends the batch before it
+	agent.config.BatchMaxKB = 1
+	agent.sendPayload(Payload{ID: newUUID(), Timestamp: time.Now()})
+	agent.sendPayload(Payload{ID: newUUID(), Timestamp: time.Now(), Logs: []LogEntry{{Message: strings.Repeat("x", 1<<10)}}})
+	if len(requests()) != 3 || len(agent.batch) != 1 {
+		t.Errorf("Expected the batch sent before the oversized payload, got %v", requests())
+	}
+	if err := agent.flushBatch(); err != nil || len(requests()) != 4 || len(agent.batch) != 0 {
+		t.Errorf("Expected flushBatch to send what is left: %v", err)
+	}
+}
+
+// TestBatchFallback tests payloads missing from a batch's acks are queued,
+// and servers without a batch endpoint getting payloads one by one
+func TestBatchFallback(t *testing.T) {
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"acks": []batchAck{
+			{Ack: newAck("s3cret", "first", AckStored)},
+			{Ack: Ack{PayloadID: "second", Status: AckRejected}, Error: "invalid payload"},
+		}})
+	}))
+	defer partial.Close()
+	agent, err := NewAgent(Config{ServerURL: partial.URL, Secret: "s3cret", QueueDir: t.TempDir(), BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.sendPayload(Payload{ID: "first", Timestamp: time.Now()})
+	if err := agent.sendPayload(Payload{ID: "second", Timestamp: time.Now()}); err == nil {
+		t.Error("Expected an error for the rejected payload")
+	}
+	if summary := agent.queueSummary(); summary.Length != 1 || summary.Payloads[0].ID != "second" {
+		t.Errorf("Expected only the rejected payload queued, got %+v", summary)
+	}
+
+	backfill := newBackfillServer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/batch") {
+			http.NotFound(w, r)
+			return
+		}
+		backfill.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	agent, err = NewAgent(Config{ServerURL: server.URL + "/ingest", Secret: "s3cret", QueueDir: t.TempDir(), BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.sendPayload(Payload{ID: "one", Timestamp: time.Now()})
+	if err := agent.sendPayload(Payload{ID: "two", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if received := backfill.received(); len(received) != 2 || agent.batching() {
+		t.Errorf("Expected both payloads sent one by one and batching stopped, got %d", len(received))
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// benchOptions configures a load test
+type benchOptions struct {
+	Containers    int
+	LinesPerSec   int // per container
+	LineBytes     int
+	Duration      time.Duration
+	BuildInterval time.Duration
+	PayloadRate   float64 // payloads per second sent to the server, 0 disables sending
+	Senders       int
+}
+
+// benchResult summarizes a load test
+type benchResult struct {
+	Duration        float64           `json:"duration_seconds"`
+	TargetLineRate  int               `json:"target_lines_per_sec"`
+	LinesProcessed  uint64            `json:"lines_processed"`
+	LineRate        float64           `json:"lines_per_sec"`
+	PayloadsBuilt   uint64            `json:"payloads_built"`
+	AvgPayloadBytes int               `json:"avg_payload_bytes"`
+	Build           HistogramSnapshot `json:"payload_build"`
+	PayloadsSent    uint64            `json:"payloads_sent"`
+	PayloadsFailed  uint64            `json:"payloads_failed"`
+	SendRate        float64           `json:"payloads_per_sec"`
+	Send            HistogramSnapshot `json:"payload_send"`
+	CPUAvg          float64           `json:"cpu_avg_percent"`
+	CPUMax          float64           `json:"cpu_max_percent"`
+	RSSMax          uint64            `json:"rss_max_bytes"`
+	HeapMax         uint64            `json:"heap_max_bytes"`
+}
+
+// Synthetic log line templates, roughly the mix of a web service. One in 25
+// lines carries a credential so masking cost is included.
+var benchLineTemplates = []string{
+	`10.0.%d.%d - - [%s] "GET /api/orders/%d HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+	`level=info ts=%s msg="request completed" route=/api/cart status=200 duration_ms=%d user=%d`,
+	`level=debug ts=%s msg="cache lookup" key=session:%d hit=true latency_us=%d`,
+	`level=warn ts=%s msg="slow query" table=orders rows=%d duration_ms=%d`,
+}
+
+// benchLine renders synthetic line n, padded to roughly size bytes
+func benchLine(n, size int) string {
+	now := time.Now().Format(time.RFC3339)
+	var line string
+	switch {
+	case n%25 == 0:
+		line = fmt.Sprintf(`level=info ts=%s msg="db connect" dsn=postgres://app:pw%d@db:5432/app`, now, n)
+	case n%4 == 0:
+		line = fmt.Sprintf(benchLineTemplates[0], n%255, n%200, now, n)
+	case n%4 == 1:
+		line = fmt.Sprintf(benchLineTemplates[1], now, n%900, n)
+	case n%4 == 2:
+		line = fmt.Sprintf(benchLineTemplates[2], now, n, n%300)
+	default:
+		line = fmt.Sprintf(benchLineTemplates[3], now, n%5000, n%2000)
+	}
+	if pad := size - len(line) - len(" pad="); pad > 0 {
+		line += " pad=" + strings.Repeat("x", pad)
+	}
+	return line
+}
+
+// runBench drives the agent's log processing and payload pipeline with
+// synthetic load and samples the process's own CPU and memory use
+func runBench(ctx context.Context, a *Agent, opts benchOptions, progress io.Writer) (benchResult, error) {
+	result := benchResult{TargetLineRate: opts.Containers * opts.LinesPerSec}
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return result, err
+	}
+
+	var lines, built, builtBytes, sent, failed atomic.Uint64
+	buildHist := NewHistogram(defaultLatencyBuckets)
+	sendHist := NewHistogram(defaultLatencyBuckets)
+	var wg sync.WaitGroup
+
+	// Log generators, one per synthetic container
+	for c := 0; c < opts.Containers; c++ {
+		name := fmt.Sprintf("bench-%03d", c)
+		monitored := a.trackContainer(name, "/"+name, "bench:latest")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer a.untrackContainer(name)
+			if opts.LinesPerSec <= 0 {
+				return
+			}
+			// Emit in 10ms batches so high rates don't need a ticker per line
+			const tick = 10 * time.Millisecond
+			ticker := time.NewTicker(tick)
+			defer ticker.Stop()
+			start := time.Now()
+			n := 0
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					due := int(now.Sub(start).Seconds() * float64(opts.LinesPerSec))
+					for ; n < due; n++ {
+						a.processLogLine(name, benchLine(n, opts.LineBytes))
+						monitored.linesRead.Add(1)
+						lines.Add(1)
+					}
+				}
+			}
+		}()
+	}
+
+	// Payload builder: the agent's interval work
+	var current atomic.Pointer[Payload]
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(opts.BuildInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				start := time.Now()
+				payload, err := a.createPayload()
+				if err != nil {
+					continue
+				}
+				buildHist.Since(start)
+				data, _ := json.Marshal(payload)
+				built.Add(1)
+				builtBytes.Add(uint64(len(data)))
+				current.Store(&payload)
+				a.payloadDelivered(payload)
+			}
+		}
+	}()
+
+	// Senders: replay the latest payload under fresh IDs at the requested rate
+	if opts.PayloadRate > 0 && a.config.ServerURL != "" {
+		jobs := make(chan struct{}, opts.Senders)
+		for i := 0; i < opts.Senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range jobs {
+					template := current.Load()
+					if template == nil {
+						continue
+					}
+					payload := *template
+					payload.ID = newUUID()
+					payload.Timestamp = time.Now()
+					start := time.Now()
+					if err := a.postPayload(payload); err != nil {
+						failed.Add(1)
+						continue
+					}
+					sendHist.Since(start)
+					sent.Add(1)
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(jobs)
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.PayloadRate))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					select {
+					case jobs <- struct{}{}:
+					default: // senders saturated; the shortfall shows in the send rate
+					}
+				}
+			}
+		}()
+	}
+
+	// Resource sampler
+	start := time.Now()
+	startTimes, _ := proc.Times()
+	lastTimes, lastSample := startTimes, start
+	sampler := time.NewTicker(time.Second)
+	defer sampler.Stop()
+	var mem runtime.MemStats
+
+sample:
+	for {
+		select {
+		case <-ctx.Done():
+			break sample
+		case now := <-sampler.C:
+			if times, err := proc.Times(); err == nil && lastTimes != nil {
+				cpu := (times.User + times.System - lastTimes.User - lastTimes.System) / now.Sub(lastSample).Seconds() * 100
+				result.CPUMax = max(result.CPUMax, cpu)
+				lastTimes, lastSample = times, now
+			}
+			if info, err := proc.MemoryInfo(); err == nil {
+				result.RSSMax = max(result.RSSMax, info.RSS)
+			}
+			runtime.ReadMemStats(&mem)
+			result.HeapMax = max(result.HeapMax, mem.HeapAlloc)
+			if progress != nil {
+				fmt.Fprintf(progress, "\r%5.0fs  %8d lines  %5d payloads sent  cpu %5.1f%%", now.Sub(start).Seconds(), lines.Load(), sent.Load(), result.CPUMax)
+			}
+		}
+	}
+	// Rates cover the load period, not waiting for an in-flight payload build
+	elapsed := time.Since(start).Seconds()
+	if endTimes, err := proc.Times(); err == nil && startTimes != nil {
+		result.CPUAvg = (endTimes.User + endTimes.System - startTimes.User - startTimes.System) / elapsed * 100
+	}
+	wg.Wait()
+	if progress != nil {
+		fmt.Fprintln(progress)
+	}
+
+	result.Duration = elapsed
+	result.LinesProcessed = lines.Load()
+	result.LineRate = float64(result.LinesProcessed) / elapsed
+	result.PayloadsBuilt = built.Load()
+	if result.PayloadsBuilt > 0 {
+		result.AvgPayloadBytes = int(builtBytes.Load() / result.PayloadsBuilt)
+	}
+	result.Build = buildHist.Snapshot(false)
+	result.PayloadsSent = sent.Load()
+	result.PayloadsFailed = failed.Load()
+	result.SendRate = float64(result.PayloadsSent) / elapsed
+	result.Send = sendHist.Snapshot(false)
+	return result, nil
+}
+
+// writeBenchResult prints a human-readable load test summary
+func writeBenchResult(w io.Writer, r benchResult, opts benchOptions) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Duration\t%.0fs\n", r.Duration)
+	fmt.Fprintf(tw, "Log lines\t%d processed, %.0f/s (target %d/s from %d containers)\n",
+		r.LinesProcessed, r.LineRate, r.TargetLineRate, opts.Containers)
+	fmt.Fprintf(tw, "Payloads built\t%d, avg %.1f KiB, build p95 %.3fs\n",
+		r.PayloadsBuilt, float64(r.AvgPayloadBytes)/1024, r.Build.P95)
+	if opts.PayloadRate > 0 {
+		fmt.Fprintf(tw, "Payloads sent\t%d ok, %d failed, %.1f/s (target %.1f/s), p50 %.3fs p95 %.3fs p99 %.3fs\n",
+			r.PayloadsSent, r.PayloadsFailed, r.SendRate, opts.PayloadRate, r.Send.P50, r.Send.P95, r.Send.P99)
+	}
+	fmt.Fprintf(tw, "Agent CPU\tavg %.1f%%, max %.1f%% (100%% = one core)\n", r.CPUAvg, r.CPUMax)
+	fmt.Fprintf(tw, "Agent memory\tRSS max %.1f MiB, heap max %.1f MiB\n", float64(r.RSSMax)/(1<<20), float64(r.HeapMax)/(1<<20))
+	tw.Flush()
+}
+
+func cmdBench(args []string) error {
+	fs := newFlagSet("bench", "bench [--containers N] [--lines-per-sec N] [--duration SECONDS] [--payload-rate N] [flags]")
+	var opts benchOptions
+	fs.IntVar(&opts.Containers, "containers", 20, "Synthetic containers generating logs")
+	fs.IntVar(&opts.LinesPerSec, "lines-per-sec", 50, "Log lines per second per container")
+	fs.IntVar(&opts.LineBytes, "line-bytes", 160, "Approximate size of each log line")
+	duration := fs.Int("duration", 60, "Test duration in seconds")
+	fs.Float64Var(&opts.PayloadRate, "payload-rate", 0, "Payloads per second to send to --server-url (0 only builds payloads)")
+	fs.IntVar(&opts.Senders, "senders", 4, "Concurrent payload senders")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if opts.PayloadRate > 0 && (config.ServerURL == "" || !secretConfigured(config)) {
+		return fmt.Errorf("--payload-rate needs --server-url and a secret")
+	}
+	opts.Duration = time.Duration(*duration) * time.Second
+	opts.BuildInterval = time.Duration(config.Interval) * time.Second
+	opts.Senders = max(opts.Senders, 1)
+
+	// The benchmark drives the pipeline itself; keep real sources and the
+	// health server out of the measurement
+	config.AuthSource = "none"
+	config.HealthAddr = ""
+	config.AuditLogPath = ""
+	agent, err := NewAgent(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Benchmarking %d containers x %d lines/s for %v\n", opts.Containers, opts.LinesPerSec, opts.Duration)
+	result, err := runBench(context.Background(), agent, opts, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	writeBenchResult(os.Stdout, result, opts)
+	return nil
+}
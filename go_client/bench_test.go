@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBenchLine tests synthetic line sizing and the credential mix
+func TestBenchLine(t *testing.T) {
+	if line := benchLine(1, 300); len(line) != 300 {
+		t.Errorf("Expected a 300 byte line, got %d: %s", len(line), line)
+	}
+	if !strings.Contains(benchLine(25, 0), "postgres://app:") {
+		t.Error("Expected every 25th line to carry a credential")
+	}
+}
+
+// TestBenchRun tests a short load test against a local server
+func TestBenchRun(t *testing.T) {
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "bench", MaxLogEntries: 500, BaselineSamples: 5})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	opts := benchOptions{Containers: 2, LinesPerSec: 100, LineBytes: 120, Duration: 2500 * time.Millisecond,
+		BuildInterval: 200 * time.Millisecond, PayloadRate: 20, Senders: 2}
+	result, err := runBench(context.Background(), agent, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.LinesProcessed < 300 || result.TargetLineRate != 200 {
+		t.Errorf("Expected ~500 lines at a 200/s target, got %d (%d/s)", result.LinesProcessed, result.TargetLineRate)
+	}
+	if result.PayloadsBuilt == 0 || result.AvgPayloadBytes == 0 {
+		t.Errorf("Expected payloads to be built, got %+v", result)
+	}
+	if result.PayloadsSent == 0 || result.PayloadsFailed != 0 || int64(result.PayloadsSent) != received.Load() {
+		t.Errorf("Expected every sent payload to reach the server, got sent=%d failed=%d received=%d",
+			result.PayloadsSent, result.PayloadsFailed, received.Load())
+	}
+	if result.RSSMax == 0 || result.HeapMax == 0 {
+		t.Errorf("Expected memory samples, got %+v", result)
+	}
+}
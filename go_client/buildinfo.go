@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=2.1.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the running agent binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// currentBuild caches buildInfo for per-payload use
+var currentBuild = sync.OnceValue(buildInfo)
+
+// buildInfo returns the link-time metadata, falling back to the VCS stamp the
+// go command embeds when the binary was built without ldflags
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+					if len(info.Commit) > 12 {
+						info.Commit = info.Commit[:12]
+					}
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				if s.Value == "true" && info.Commit != "" && commit == "" {
+					info.Commit += "-dirty"
+				}
+			}
+		}
+	}
+	return info
+}
+
+// writeVersion prints the build metadata in the `version` subcommand format
+func writeVersion(w io.Writer, info BuildInfo) {
+	fmt.Fprintf(w, "monitoring-agent %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Fprintf(w, "  commit:     %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Fprintf(w, "  built:      %s\n", info.BuildDate)
+	}
+	fmt.Fprintf(w, "  go version: %s\n", info.GoVersion)
+	fmt.Fprintf(w, "  platform:   %s\n", info.Platform)
+}
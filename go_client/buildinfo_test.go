@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestBuildInfoLdflags tests that link-time metadata wins over the VCS fallback
+func TestBuildInfoLdflags(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "2.1.0", "abc1234", "2025-01-15T10:30:00Z"
+
+	info := buildInfo()
+	if info.Version != "2.1.0" || info.Commit != "abc1234" || info.BuildDate != "2025-01-15T10:30:00Z" {
+		t.Errorf("Expected ldflags metadata, got %+v", info)
+	}
+	if !strings.HasPrefix(info.GoVersion, "go") || info.Platform == "" {
+		t.Errorf("Expected Go version and platform, got %+v", info)
+	}
+
+	var out bytes.Buffer
+	writeVersion(&out, info)
+	for _, want := range []string{"monitoring-agent 2.1.0", "commit:     abc1234", "built:      2025-01-15T10:30:00Z", "go version: go"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in version output:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestPayloadAgentVersion tests that every payload reports the agent version
+func TestPayloadAgentVersion(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.AgentVersion == "" || payload.AgentVersion != currentBuild().Version {
+		t.Errorf("Expected agent version %q, got %q", currentBuild().Version, payload.AgentVersion)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a monitoring-agent subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// commands lists the subcommands in the order shown by help
+func commands() []command {
+	return []command{
+		{"run", "run [--validate] [flags]", "Run the agent (default when no command is given)", cmdRun},
+		{"check-config", "check-config [--json] [--no-connect] [flags]", "Validate flags, environment, referenced files, thresholds and server reachability, then print a report", cmdCheckConfig},
+		{"generate-config", "generate-config [--output PATH] [--prefixed] [flags]", "Print a commented environment file with every option, seeded from flags and env", cmdGenerateConfig},
+		{"status", "status [--addr ADDR] [--admin-token TOKEN] [--json]", "Show a running agent's health, send counters, queue and alerts via its local API", cmdStatus},
+		{"version", "version [--json]", "Print version, commit, build date and Go version", cmdVersion},
+		{"simulate", "simulate [--simulate SCENARIOS] [--list] [flags]", "Run the agent injecting synthetic incident scenarios (default: attack)", cmdSimulate},
+		{"receive", "receive [--listen ADDR] --secret SECRET", "Run a local test endpoint that verifies signatures and prints payloads", cmdReceive},
+		{"top", "top [--addr ADDR] [--admin-token TOKEN]", "Live terminal dashboard of the local agent via its admin API", cmdTop},
+		{"bench", "bench [--containers N] [--lines-per-sec N] [--payload-rate N] [flags]", "Load-test the log and payload pipeline and report agent CPU/memory and send latency", cmdBench},
+		{"diag", "diag [--addr ADDR] [--admin-token TOKEN] [--output FILE]", "Write a support bundle of logs, redacted config, queue, goroutines and recent payloads", cmdDiag},
+		{"queue", "queue ls|flush|replay [flags]", "Inspect persisted payloads, have a running agent deliver its queue now, or re-send them", cmdQueue},
+		{"install", "install [--service-file PATH] [flags]", "Record the integrity manifest and write a systemd unit running the agent with the given flags", cmdInstall},
+	}
+}
+
+// runCLI dispatches to a subcommand and returns the process exit code. A
+// leading flag (or no arguments) runs the agent, so pre-subcommand
+// invocations keep working. Dispatch is kept on the standard flag package
+// rather than a CLI framework: most subcommands share parseConfig's flags and
+// their environment fallbacks, which a framework would have to duplicate.
+func runCLI(args []string) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name != name {
+			continue
+		}
+		if err := cmd.run(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return 2
+}
+
+// printUsage lists the available subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: monitoring-agent <command> [flags]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands() {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'monitoring-agent <command> -h' for command flags.\n")
+}
+
+// newFlagSet creates a flag set for a subcommand that reports errors instead of exiting
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: monitoring-agent %s\n\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func cmdRun(args []string) error {
+	fs := newFlagSet("run", "run [--validate] [flags]")
+	validate := fs.Bool("validate", false, "Check the configuration like check-config and exit instead of running")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *validate {
+		return runConfigCheck(os.Stdout, os.Stderr, config, false, true)
+	}
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	return runAgent(config)
+}
+
+func cmdSimulate(args []string) error {
+	fs := newFlagSet("simulate", "simulate [--simulate SCENARIOS] [--list] [flags]")
+	list := fs.Bool("list", false, "List simulation scenarios and exit")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *list {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, s := range simulationScenarios {
+			fmt.Fprintf(tw, "%s\t%s\n", s.name, s.description)
+		}
+		groups := make([]string, 0, len(simulationGroups))
+		for name := range simulationGroups {
+			groups = append(groups, name)
+		}
+		sort.Strings(groups)
+		for _, name := range groups {
+			fmt.Fprintf(tw, "%s\t%s\n", name, strings.Join(simulationGroups[name], ", "))
+		}
+		fmt.Fprintf(tw, "all\tevery scenario above\n")
+		return tw.Flush()
+	}
+	config.SimulateAttack = true
+	if err := validateConfig(config); err != nil {
+		return err
+	}
+	return runAgent(config)
+}
+
+// cmdCheckConfig validates everything NewAgent would, without starting
+// monitors or binding the health server
+func cmdCheckConfig(args []string) error {
+	fs := newFlagSet("check-config", "check-config [--json] [--no-connect] [flags]")
+	asJSON := fs.Bool("json", false, "Print the report, including the effective config, as JSON")
+	noConnect := fs.Bool("no-connect", false, "Skip checking that the server is reachable")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	return runConfigCheck(os.Stdout, os.Stderr, config, *asJSON, !*noConnect)
+}
+
+func cmdVersion(args []string) error {
+	fs := newFlagSet("version", "version [--json]")
+	asJSON := fs.Bool("json", false, "Print build metadata as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	info := currentBuild()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+	writeVersion(os.Stdout, info)
+	return nil
+}
+
+func cmdQueue(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("missing queue command (ls, flush, replay)")
+	}
+	verb, args := args[0], args[1:]
+
+	switch verb {
+	case "ls", "list":
+		fs := newFlagSet("queue ls", "queue ls [--dir DIR]")
+		dir := fs.String("dir", defaultQueueDirectory(), "Queue directory (default QUEUE_DIR or the agent default)")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		return listQueue(os.Stdout, *dir)
+	case "flush":
+		fs := newFlagSet("queue flush", "queue flush [--addr ADDR] [--admin-token TOKEN] [--timeout SECONDS]")
+		addr := fs.String("addr", defaultAgentAddr(), "Agent health server address (host:port, https:// URL or unix:/path; default HEALTH_ADDR)")
+		token := fs.String("admin-token", getenv("ADMIN_TOKEN"), "Admin API bearer token (ADMIN_TOKEN)")
+		caFile := fs.String("ca-file", "", "CA bundle for a TLS health server")
+		timeout := fs.Int("timeout", 120, "Seconds to wait for the agent to deliver its queue")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *token == "" {
+			return fmt.Errorf("--admin-token is required")
+		}
+		client, err := newTopClient(*addr, *token, *caFile)
+		if err != nil {
+			return err
+		}
+		client.http.Timeout = time.Duration(*timeout) * time.Second
+		return flushRemoteQueue(os.Stdout, client)
+	case "replay":
+		fs := newFlagSet("queue replay", "queue replay [--dir DIR] --server-url URL|--grpc-addr ADDR [--secret SECRET] [--key-id ID] [--keep]")
+		dir := fs.String("dir", defaultQueueDirectory(), "Queue directory (default QUEUE_DIR or the agent default)")
+		serverURL := fs.String("server-url", getenv("SERVER_URL"), "Server to deliver to (SERVER_URL)")
+		secret := fs.String("secret", getenv("SECRET"), "Shared secret to re-sign payloads with (SECRET)")
+		keyID := fs.String("key-id", getenv("KEY_ID"), "API key ID of the secret (KEY_ID)")
+		grpcAddr := fs.String("grpc-addr", getenv("GRPC_ADDR"), "Deliver over the server's gRPC stream instead (GRPC_ADDR)")
+		grpcInsecure := fs.Bool("grpc-insecure", getenv("GRPC_INSECURE") == "true", "Connect to --grpc-addr without TLS (GRPC_INSECURE)")
+		keep := fs.Bool("keep", false, "Leave queue files in place after delivery")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if (*serverURL == "" && *grpcAddr == "") || *secret == "" {
+			return fmt.Errorf("--server-url or --grpc-addr, and --secret are required")
+		}
+		config := Config{ServerURL: *serverURL, Secret: *secret, KeyID: *keyID, GRPCAddr: *grpcAddr, GRPCInsecure: *grpcInsecure}
+		stats, err := replayQueue(os.Stdout, *dir, config, *keep)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d payload(s) sent, %d failed, from %d file(s)\n", stats.Sent, stats.Failed, stats.Files)
+		if stats.Failed > 0 {
+			return fmt.Errorf("%d payload(s) could not be delivered", stats.Failed)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown queue command %q (ls, flush, replay)", verb)
+	}
+}
+
+// listQueue prints every persisted payload in dir
+func listQueue(w io.Writer, dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "queue_*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "FILE\tPAYLOAD ID\tTIMESTAMP\tLOGS\tEVENTS\tALERTS\n")
+	total := 0
+	for _, file := range files {
+		payloads, err := readQueueFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", file, err)
+		}
+		for _, p := range payloads {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", filepath.Base(file), p.ID, p.Timestamp.Format("2006-01-02T15:04:05Z07:00"),
+				len(p.Logs), len(p.DockerEvents), strings.Join(p.LocalAlerts, ","))
+			total++
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d payload(s) in %d file(s)\n", total, len(files))
+	return nil
+}
+
+// Flags consumed by install itself rather than passed to the service
+var installOnlyFlags = map[string]bool{"service-file": true}
+
+func cmdInstall(args []string) error {
+	fs := newFlagSet("install", "install [--service-file PATH] [flags]")
+	defaultServiceFile := ""
+	if runtime.GOOS == "linux" {
+		defaultServiceFile = "/etc/systemd/system/monitoring-agent.service"
+	}
+	serviceFile := fs.String("service-file", defaultServiceFile, "systemd unit to write (empty to skip)")
+	config, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if config.IntegrityManifest != "" {
+		manifest, err := writeIntegrityManifest(config, config.IntegrityManifest)
+		if err != nil {
+			return fmt.Errorf("failed to write integrity manifest: %w", err)
+		}
+		fmt.Printf("Recorded %d file hashes in %s\n", len(manifest.Files), config.IntegrityManifest)
+	}
+
+	if *serviceFile == "" {
+		if runtime.GOOS == "darwin" {
+			fmt.Println("On macOS install launchd/com.richardops.monitoring-agent.plist in /Library/LaunchDaemons")
+		}
+		return nil
+	}
+
+	// Pass explicitly set flags through to the service, except secrets which
+	// belong in the environment file
+	var runArgs []string
+	fs.Visit(func(f *flag.Flag) {
+		if installOnlyFlags[f.Name] || isSecretFlag(f.Name) {
+			return
+		}
+		runArgs = append(runArgs, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*serviceFile, []byte(systemdUnit(exe, runArgs)), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s; put SECRET and tokens in %s, then run: systemctl daemon-reload && systemctl enable --now monitoring-agent\n", *serviceFile, systemdEnvFile)
+	return nil
+}
+
+// Environment file read by the systemd unit for secrets
+const systemdEnvFile = "/etc/monitoring-agent/agent.env"
+
+// isSecretFlag reports flags whose values must not be written into the unit file
+func isSecretFlag(name string) bool {
+	switch name {
+	case "secret", "admin-token", "health-token", "mask-hash-key", "enroll-token":
+		return true
+	case "slack-webhook", "slack-critical-webhook", "discord-webhook", "discord-critical-webhook",
+		"teams-webhook", "teams-critical-webhook", "sentry-dsn", "proxy-url":
+		return true
+	}
+	return false
+}
+
+// systemdUnit renders a unit running the agent in the foreground
+func systemdUnit(exe string, args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = fmt.Sprintf("%q", arg)
+	}
+	return fmt.Sprintf(`[Unit]
+Description=RichardOps monitoring agent
+After=network-online.target docker.service
+Wants=network-online.target
+
+[Service]
+ExecStart=%s run %s
+EnvironmentFile=-%s
+WorkingDirectory=/var/lib/monitoring-agent
+StateDirectory=monitoring-agent
+Restart=on-failure
+RestartSec=5
+KillSignal=SIGTERM
+TimeoutStopSec=30
+
+[Install]
+WantedBy=multi-user.target
+`, exe, strings.Join(quoted, " "), systemdEnvFile)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCLIDispatch tests subcommand selection and the backwards-compatible default
+func TestCLIDispatch(t *testing.T) {
+	if code := runCLI([]string{"no-such-command"}); code != 2 {
+		t.Errorf("Expected exit code 2 for unknown command, got %d", code)
+	}
+	if code := runCLI([]string{"version"}); code != 0 {
+		t.Errorf("Expected version to succeed, got %d", code)
+	}
+	if code := runCLI([]string{"--server-url", "", "--interval", "5"}); code != 1 {
+		t.Errorf("Expected flag-only invocation to run (and fail validation), got %d", code)
+	}
+}
+
+// TestQueueList tests listing persisted payloads
+func TestQueueList(t *testing.T) {
+	dir := t.TempDir()
+	line := `{"payload_id":"11111111-2222-4333-8444-555555555555","timestamp":"2025-01-15T10:30:00Z","local_alerts":["CPU_SPIKE"]}` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "queue_1.jsonl"), []byte(line+"not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := listQueue(&out, dir); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "11111111-2222-4333-8444-555555555555") || !strings.Contains(out.String(), "1 payload(s) in 1 file(s)") {
+		t.Errorf("Unexpected queue listing:\n%s", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "queue_1.jsonl")); err != nil {
+		t.Error("Expected queue list to leave files in place")
+	}
+}
+
+// TestSystemdUnit tests that secrets are not written into the unit
+func TestSystemdUnit(t *testing.T) {
+	unit := systemdUnit("/usr/local/bin/monitoring-agent", []string{"--server-url=https://example.com/ingest"})
+	if !strings.Contains(unit, `ExecStart=/usr/local/bin/monitoring-agent run "--server-url=https://example.com/ingest"`) {
+		t.Errorf("Unexpected ExecStart in unit:\n%s", unit)
+	}
+	if !isSecretFlag("secret") || !isSecretFlag("enroll-token") || !isSecretFlag("slack-webhook") || !isSecretFlag("sentry-dsn") || !isSecretFlag("discord-critical-webhook") || !isSecretFlag("teams-webhook") || !isSecretFlag("proxy-url") || isSecretFlag("server-url") {
+		t.Error("Expected only secret flags to be withheld from the unit")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// Delay before restarting a followed command that exited
+const followRestartDelay = 5 * time.Second
+
+// commandFollower runs a long-lived command (log stream, journalctl -f) and
+// feeds each stdout line to a handler, restarting the command if it exits
+type commandFollower struct {
+	name   string
+	args   []string
+	handle func(string)
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// followCommand starts name with args in the background
+func followCommand(handle func(string), name string, args ...string) *commandFollower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &commandFollower{
+		name:   name,
+		args:   args,
+		handle: handle,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go f.run(ctx)
+	return f
+}
+
+func (f *commandFollower) run(ctx context.Context) {
+	defer close(f.done)
+
+	for {
+		if err := f.follow(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%s exited: %v", f.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(followRestartDelay):
+		}
+	}
+}
+
+// follow runs the command once until it exits or ctx is cancelled
+func (f *commandFollower) follow(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, f.name, f.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		f.handle(scanner.Text())
+	}
+	return cmd.Wait()
+}
+
+// Close stops the command and waits for the follower to exit
+func (f *commandFollower) Close() error {
+	f.cancel()
+	<-f.done
+	return nil
+}
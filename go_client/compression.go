@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values accepted by --compression
+var compressionModes = map[string]bool{"none": true, "gzip": true, "zstd": true}
+
+// zstdEncoder is shared by all payloads; EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+})
+
+// checkCompression checks a --compression value
+func checkCompression(mode string) error {
+	if mode != "" && !compressionModes[mode] {
+		return fmt.Errorf("invalid compression %q (valid: none, gzip, zstd)", mode)
+	}
+	return nil
+}
+
+// compressBody encodes an outgoing payload body with --compression. It
+// returns the Content-Encoding of the result, empty when it is sent as is.
+func compressBody(mode string, body []byte) ([]byte, string, error) {
+	switch mode {
+	case "", "none":
+		return body, "", nil
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "gzip", nil
+	case "zstd":
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, "", err
+		}
+		return encoder.EncodeAll(body, make([]byte, 0, len(body)/4)), "zstd", nil
+	}
+	return nil, "", checkCompression(mode)
+}
+
+// decompressBody decodes a request body by its Content-Encoding, refusing to
+// expand it beyond limit bytes
+func decompressBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var reader io.Reader
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		decoder, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderMaxMemory(uint64(limit)), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd body: %w", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s body: %w", encoding, err)
+	}
+	if int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("%s body expands beyond %d bytes", encoding, limit)
+	}
+	return decoded, nil
+}
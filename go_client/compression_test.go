@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPayloadCompression tests sending compressed payloads that the
+// receiver verifies against the signature of the uncompressed body
+func TestPayloadCompression(t *testing.T) {
+	var out strings.Builder
+	rv := &receiver{secret: "shared", maxSkew: time.Hour, out: &out}
+	var encoding string
+	var wireBytes int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding, wireBytes = r.Header.Get("Content-Encoding"), r.ContentLength
+		rv.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	logs := make([]LogEntry, 500)
+	for i := range logs {
+		logs[i] = LogEntry{Container: "web", Message: "GET /api/orders 200 12ms user-agent=Mozilla/5.0"}
+	}
+	payload := Payload{ID: newUUID(), Host: "web-01", Timestamp: time.Now(), Logs: logs}
+	plain := &Agent{config: Config{ServerURL: server.URL, Secret: "shared"}, httpClient: server.Client()}
+	if err := plain.postPayload(payload); err != nil || encoding != "" {
+		t.Fatalf("Expected an uncompressed payload by default, got %q: %v", encoding, err)
+	}
+	plainBytes := wireBytes
+
+	for _, mode := range []string{"gzip", "zstd"} {
+		agent := &Agent{config: Config{ServerURL: server.URL, Secret: "shared", Compression: mode}, httpClient: server.Client()}
+		payload.ID = newUUID()
+		if err := agent.postPayload(payload); err != nil {
+			t.Fatalf("Expected %s payload to be verified and accepted: %v", mode, err)
+		}
+		if encoding != mode || wireBytes*10 > plainBytes {
+			t.Errorf("Expected a %s body well under %d bytes, got %q with %d bytes", mode, plainBytes, encoding, wireBytes)
+		}
+		if !strings.Contains(out.String(), "payload "+payload.ID+" from web-01") {
+			t.Errorf("Expected the %s payload printed, got:\n%s", mode, out.String())
+		}
+	}
+
+	if _, err := NewAgent(Config{Compression: "brotli"}); err == nil {
+		t.Error("Expected unknown compression to be rejected")
+	}
+}
+
+// TestDecompressBodyLimit tests that a body can't expand beyond the limit
+func TestDecompressBodyLimit(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 1<<20)
+	for _, mode := range []string{"gzip", "zstd"} {
+		compressed, encoding, err := compressBody(mode, large)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := decompressBody(encoding, compressed, 2<<20); err != nil || !bytes.Equal(decoded, large) {
+			t.Errorf("Expected %s round trip, got %d bytes: %v", mode, len(decoded), err)
+		}
+		if _, err := decompressBody(encoding, compressed, 1<<10); err == nil {
+			t.Errorf("Expected %s body over the limit to be rejected", mode)
+		}
+	}
+	if _, err := decompressBody("br", large, 2<<20); err == nil {
+		t.Error("Expected unsupported encoding to be rejected")
+	}
+}
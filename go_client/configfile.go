@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a --config file into flag values: keys are flag
+// names (with - or _), nested tables join their keys with "-" (slack:
+// webhook: sets --slack-webhook) and lists become comma-separated values.
+// The format follows the extension: .yaml, .yml or .toml.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: %w", err)
+	}
+
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("config file %s: unknown format (use .yaml, .yml or .toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file: parse %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig("", doc, values); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// flattenConfig adds the values of a config file table under prefix
+func flattenConfig(prefix string, table map[string]any, values map[string]string) error {
+	for key, value := range table {
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		if nested, ok := value.(map[string]any); ok {
+			if err := flattenConfig(name, nested, values); err != nil {
+				return err
+			}
+			continue
+		}
+		rendered, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		values[name] = rendered
+	}
+	return nil
+}
+
+// configValue renders a scalar or a list of scalars as a flag value
+func configValue(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(value))
+		for i, item := range value {
+			if _, ok := item.([]any); ok {
+				return "", fmt.Errorf("nested lists are not supported")
+			}
+			if _, ok := item.(map[string]any); ok {
+				return "", fmt.Errorf("lists of tables are not supported")
+			}
+			rendered, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = rendered
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// applyConfigFile sets the flags a --config file names, except those given
+// on the command line, which take precedence. Values are set like defaults,
+// so the flag set still only visits command line flags (install passes
+// those and --config on to the service). Unknown keys are errors so typos
+// don't go unnoticed. Returns the names of the flags the file set.
+func applyConfigFile(fs *flag.FlagSet, path string) (map[string]bool, error) {
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	applied := make(map[string]bool)
+	var unknown []string
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			unknown = append(unknown, name)
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := f.Value.Set(values[name]); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, name, err)
+		}
+		applied[name] = true
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("config file %s: unknown settings %s", path, strings.Join(unknown, ", "))
+	}
+	return applied, nil
+}
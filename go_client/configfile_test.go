@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes a --config file with the given name to a temporary directory
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfigFileFormats tests that YAML and TOML files set the same options,
+// including nested tables and lists
+func TestConfigFileFormats(t *testing.T) {
+	files := map[string]string{
+		"agent.yaml": `
+server_url: https://ops.example.com/ingest
+secret: s3cret
+interval: 30
+cpu-spike-pct: 92.5
+dry-run: true
+env: prod
+access_logs:
+  - /var/log/nginx/access.log
+  - /var/log/app/access.log
+slack:
+  webhook: https://hooks.slack.com/x
+  min_severity: critical
+`,
+		"agent.toml": `
+server_url = "https://ops.example.com/ingest"
+secret = "s3cret"
+interval = 30
+cpu-spike-pct = 92.5
+dry-run = true
+env = "prod"
+access_logs = ["/var/log/nginx/access.log", "/var/log/app/access.log"]
+
+[slack]
+webhook = "https://hooks.slack.com/x"
+min_severity = "critical"
+`,
+	}
+	for name, content := range files {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		config, err := parseConfig(fs, []string{"--config", writeConfigFile(t, name, content)})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if config.ServerURL != "https://ops.example.com/ingest" || config.Secret != "s3cret" || config.Interval != 30 ||
+			config.CPUSpikePct != 92.5 || !config.DryRun || config.Env != "prod" ||
+			config.AccessLogs != "/var/log/nginx/access.log,/var/log/app/access.log" ||
+			config.SlackWebhook != "https://hooks.slack.com/x" || config.SlackMinSeverity != "critical" {
+			t.Errorf("%s: unexpected config %+v", name, config)
+		}
+	}
+}
+
+// TestConfigFilePrecedence tests that flags and environment variables
+// override the file, and that file values are not passed on as flags
+func TestConfigFilePrecedence(t *testing.T) {
+	path := writeConfigFile(t, "agent.yml", "interval: 30\nenv: staging\nowner-team: payments\n")
+	t.Setenv("OWNER_TEAM", "platform")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := parseConfig(fs, []string{"--config", path, "--interval", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != 5 || config.Env != "staging" || config.OwnerTeam != "platform" {
+		t.Errorf("Expected flag, file and environment values, got interval %d, env %q, owner team %q", config.Interval, config.Env, config.OwnerTeam)
+	}
+	var visited []string
+	fs.Visit(func(f *flag.Flag) { visited = append(visited, f.Name) })
+	if strings.Join(visited, ",") != "config,interval" {
+		t.Errorf("Expected only command line flags to be visited, got %v", visited)
+	}
+
+	t.Setenv("CONFIG_FILE", path)
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	if config, err = parseConfig(fs, nil); err != nil || config.Env != "staging" {
+		t.Errorf("Expected CONFIG_FILE to be loaded, got %q, %v", config.Env, err)
+	}
+}
+
+// TestConfigFileErrors tests unknown settings, bad values and formats
+func TestConfigFileErrors(t *testing.T) {
+	for name, want := range map[string]string{
+		"agent.yaml": "unknown settings intreval, slack-hook",
+		"agent.toml": `interval: parse error`,
+		"agent.json": "unknown format",
+		"bad.yaml":   "parse",
+	} {
+		content := map[string]string{
+			"agent.yaml": "intreval: 30\nslack:\n  hook: x\n",
+			"agent.toml": `interval = "soon"`,
+			"agent.json": `{}`,
+			"bad.yaml":   "interval: [",
+		}[name]
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		_, err := parseConfig(fs, []string{"--config", writeConfigFile(t, name, content)})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, want, err)
+		}
+	}
+}
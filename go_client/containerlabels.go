@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Docker labels that tune how the agent treats a single container
+const (
+	labelLogs        = "richardops.logs"         // off stops log collection
+	labelTail        = "richardops.tail"         // initial lines instead of --tail-lines
+	labelMaskDisable = "richardops.mask.disable" // masking rule names to skip
+	labelMaskRule    = "richardops.mask.rule."   // richardops.mask.rule.<name>=<pattern>
+)
+
+// ContainerLabels are the settings a container's labels override
+type ContainerLabels struct {
+	LogsOff bool             `json:"logs_off,omitempty"`
+	Tail    *int             `json:"tail,omitempty"` // nil: --tail-lines
+	Masking ContainerMasking `json:"masking,omitempty"`
+}
+
+// hasMasking reports whether the labels change masking rules
+func (l ContainerLabels) hasMasking() bool {
+	return len(l.Masking.Disable) > 0 || len(l.Masking.Rules) > 0
+}
+
+// parseContainerLabels reads the richardops.* labels of a container. Invalid
+// labels are left out and reported in the error, so one typo doesn't stop a
+// container's logs from being collected.
+func parseContainerLabels(labels map[string]string) (ContainerLabels, error) {
+	var settings ContainerLabels
+	var problems []error
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if strings.HasPrefix(name, "richardops.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := strings.TrimSpace(labels[name])
+		switch {
+		case name == labelLogs:
+			switch strings.ToLower(value) {
+			case "off", "false", "no", "0":
+				settings.LogsOff = true
+			case "on", "true", "yes", "1":
+			default:
+				problems = append(problems, fmt.Errorf("%s=%q: use on or off", name, value))
+			}
+		case name == labelTail:
+			tail, err := strconv.Atoi(value)
+			if err != nil || tail < 0 {
+				problems = append(problems, fmt.Errorf("%s=%q: not a number of lines", name, value))
+				continue
+			}
+			settings.Tail = &tail
+		case name == labelMaskDisable:
+			for _, rule := range strings.Split(value, ",") {
+				if rule = strings.TrimSpace(rule); rule != "" {
+					settings.Masking.Disable = append(settings.Masking.Disable, rule)
+				}
+			}
+		case strings.HasPrefix(name, labelMaskRule):
+			rule := MaskRule{Name: strings.TrimPrefix(name, labelMaskRule), Pattern: value}
+			if err := rule.compile(); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			settings.Masking.Rules = append(settings.Masking.Rules, rule)
+		default:
+			problems = append(problems, fmt.Errorf("unknown label %s", name))
+		}
+	}
+	return settings, errors.Join(problems...)
+}
+
+// inspectContainerLabels reads a container's labels, applies their masking
+// rules and keeps the rest for its log stream. A container that can't be
+// inspected gets the defaults.
+func (a *Agent) inspectContainerLabels(ctx context.Context, containerID string) ContainerLabels {
+	info, err := a.dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil || info.Config == nil {
+		return ContainerLabels{}
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+
+	settings, err := parseContainerLabels(info.Config.Labels)
+	if err != nil {
+		log.Printf("Warning: Ignoring labels of container %s: %v", name, err)
+	}
+	if settings.LogsOff {
+		log.Printf("Not collecting logs of container %s (%s=off)", name, labelLogs)
+	}
+	if settings.hasMasking() {
+		a.masker.setContainerOverride(name, settings.Masking)
+	} else {
+		a.masker.clearContainerOverride(name)
+	}
+
+	a.monitoredMutex.Lock()
+	a.containerLabels[containerID] = settings
+	a.monitoredMutex.Unlock()
+	return settings
+}
+
+// tailLines returns the number of initial log lines to read for a container
+func (a *Agent) tailLines(containerID string) int {
+	a.monitoredMutex.RLock()
+	settings := a.containerLabels[containerID]
+	a.monitoredMutex.RUnlock()
+	if settings.Tail != nil {
+		return *settings.Tail
+	}
+	return a.config.TailLines
+}
+
+// forgetContainerLabels drops the label settings of a removed container
+func (a *Agent) forgetContainerLabels(containerID, name string) {
+	a.monitoredMutex.Lock()
+	delete(a.containerLabels, containerID)
+	a.monitoredMutex.Unlock()
+	a.masker.clearContainerOverride(strings.TrimPrefix(name, "/"))
+}
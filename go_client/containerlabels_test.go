@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// TestParseContainerLabels tests label values and that invalid labels are
+// reported without dropping the valid ones
+func TestParseContainerLabels(t *testing.T) {
+	settings, err := parseContainerLabels(map[string]string{
+		"richardops.logs":            "on",
+		"richardops.tail":            "500",
+		"richardops.mask.disable":    "jwt, cookie",
+		"richardops.mask.rule.order": `ORD-[0-9]+`,
+		"com.example.team":           "payments",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.LogsOff || settings.Tail == nil || *settings.Tail != 500 ||
+		strings.Join(settings.Masking.Disable, ",") != "jwt,cookie" || len(settings.Masking.Rules) != 1 || settings.Masking.Rules[0].Name != "order" {
+		t.Errorf("Unexpected settings %+v", settings)
+	}
+
+	settings, err = parseContainerLabels(map[string]string{
+		"richardops.logs":          "OFF",
+		"richardops.tail":          "lots",
+		"richardops.mask.rule.bad": "([a-z",
+		"richardops.logz":          "off",
+	})
+	if !settings.LogsOff || settings.Tail != nil || settings.hasMasking() {
+		t.Errorf("Expected only the logs label to apply, got %+v", settings)
+	}
+	for _, want := range []string{"richardops.tail", "richardops.mask.rule.bad", "unknown label richardops.logz"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be reported, got %v", want, err)
+		}
+	}
+}
+
+// TestContainerLabelMasking tests that label rules apply on top of the
+// masking config, and go away with the container
+func TestContainerLabelMasking(t *testing.T) {
+	m, err := newMasker(MaskingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := parseContainerLabels(map[string]string{
+		"richardops.mask.disable":    "key_value",
+		"richardops.mask.rule.order": `ORD-[0-9]+`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setContainerOverride("/shop", settings.Masking)
+
+	line := "token=abc123 order ORD-42"
+	if got := m.Mask("shop", line); got != "token=abc123 order [REDACTED]" {
+		t.Errorf("Unexpected masking with labels: %s", got)
+	}
+	if got := m.Mask("other", line); got != "token=[REDACTED] order ORD-42" {
+		t.Errorf("Expected other containers to keep the defaults, got %s", got)
+	}
+	m.clearContainerOverride("shop")
+	if got := m.Mask("shop", line); got != "token=[REDACTED] order ORD-42" {
+		t.Errorf("Expected the defaults after the container is gone, got %s", got)
+	}
+}
+
+// TestContainerLabelsLogs tests that richardops.logs=off containers are not
+// followed and richardops.tail sets the initial lines
+func TestContainerLabelsLogs(t *testing.T) {
+	var mu sync.Mutex
+	tails := make(map[string]string)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.43/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1.43/containers/"), "/")
+		switch endpoint {
+		case "json":
+			labels := map[string]string{
+				"noisy": `{"richardops.logs": "off"}`,
+				"quiet": `{"richardops.tail": "500"}`,
+			}[id]
+			if labels == "" {
+				labels = "{}"
+			}
+			fmt.Fprintf(w, `{"Id": %q, "Name": "/%s", "Config": {"Image": "nginx", "Labels": %s}}`, id, id, labels)
+		case "logs":
+			mu.Lock()
+			tails[id] = r.URL.Query().Get("tail")
+			mu.Unlock()
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	agent, err := NewAgent(Config{TailLines: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.dockerClient, err = client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, id := range []string{"noisy", "quiet", "plain"} {
+		agent.monitorContainerLogs(ctx, id)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(tails) >= 2
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := tails["noisy"]; ok {
+		t.Error("Expected richardops.logs=off to stop log collection")
+	}
+	if tails["quiet"] != "500" || tails["plain"] != "10" {
+		t.Errorf("Expected tail 500 from the label and 10 otherwise, got %v", tails)
+	}
+}
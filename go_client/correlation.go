@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Request IDs kept as examples per alert
+const maxCorrelationIDs = 5
+
+// correlationExtractor finds a request's correlation ID in a log line or its
+// parsed fields, by the field and header names in --correlation-fields
+type correlationExtractor struct {
+	names   []string // lowercased, in order of preference
+	pattern *regexp.Regexp
+}
+
+// newCorrelationExtractor matches the comma-separated names as parsed field
+// names (case-insensitively) and in lines as name=value, "name": "value" or
+// "Name: value" header pairs
+func newCorrelationExtractor(names string) *correlationExtractor {
+	c := &correlationExtractor{}
+	var quoted []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		c.names = append(c.names, name)
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	if len(quoted) > 0 {
+		c.pattern = regexp.MustCompile(`(?i)(?:^|[^\w-])"?(?:` + strings.Join(quoted, "|") + `)"?\s*[=:]\s*"?([\w.:/+-]{4,128})`)
+	}
+	return c
+}
+
+// find returns the correlation ID in fields or line, or ""
+func (c *correlationExtractor) find(line string, fields map[string]any) string {
+	for _, want := range c.names {
+		for name, value := range fields {
+			if strings.ToLower(name) != want {
+				continue
+			}
+			if id := fmt.Sprint(value); id != "" && id != "-" {
+				return id
+			}
+		}
+	}
+	if c.pattern == nil {
+		return ""
+	}
+	if m := c.pattern.FindStringSubmatch(line); m != nil && m[1] != "-" {
+		return m[1]
+	}
+	return ""
+}
+
+// addCorrelationID appends id to the latest example IDs, dropping the oldest
+// beyond maxCorrelationIDs
+func addCorrelationID(ids []string, id string) []string {
+	if id == "" {
+		return ids
+	}
+	for _, seen := range ids {
+		if seen == id {
+			return ids
+		}
+	}
+	if len(ids) >= maxCorrelationIDs {
+		ids = ids[1:]
+	}
+	return append(ids, id)
+}
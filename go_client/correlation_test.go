@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestCorrelationExtractor tests finding request IDs in fields, key=value pairs, JSON and headers
+func TestCorrelationExtractor(t *testing.T) {
+	c := newCorrelationExtractor("request_id, X-Request-ID,trace_id")
+	cases := []struct {
+		line   string
+		fields map[string]any
+		want   string
+	}{
+		{`10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 500 0 "-" "curl/8.0" request_id=4bf92f35`, nil, "4bf92f35"},
+		{`{"level":"error","trace_id":"0af7651916cd43dd8448eb211c80319c","msg":"failed"}`, nil, "0af7651916cd43dd8448eb211c80319c"},
+		{`upstream error X-Request-Id: 9c1e-44aa`, nil, "9c1e-44aa"},
+		{`order failed`, map[string]any{"Request_ID": "req-77"}, "req-77"},
+		{`order failed request_id=from-line`, map[string]any{"trace_id": "from-fields"}, "from-fields"},
+		{`my_request_id=nope x_trace_id=nope`, nil, ""},
+		{`request_id=- status=500`, nil, ""},
+		{`GET / HTTP/1.1 200`, nil, ""},
+	}
+	for _, tc := range cases {
+		if got := c.find(tc.line, tc.fields); got != tc.want {
+			t.Errorf("find(%q, %v) = %q, want %q", tc.line, tc.fields, got, tc.want)
+		}
+	}
+
+	if got := newCorrelationExtractor("").find("request_id=4bf92f35", nil); got != "" {
+		t.Errorf("Expected no IDs without correlation fields, got %q", got)
+	}
+}
+
+// TestAddCorrelationID tests that the latest distinct IDs are kept
+func TestAddCorrelationID(t *testing.T) {
+	var ids []string
+	for _, id := range []string{"a", "", "b", "a", "c", "d", "e", "f"} {
+		ids = addCorrelationID(ids, id)
+	}
+	if want := []string{"b", "c", "d", "e", "f"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected %v, got %v", want, ids)
+	}
+}
+
+// TestAlertCorrelationIDs tests that HTTP_5XX_SPIKE and UPSTREAM_ERROR_SPIKE carry request IDs of failed requests
+func TestAlertCorrelationIDs(t *testing.T) {
+	agent, err := NewAgent(Config{
+		HTTP5xxPct: 10, HTTPMinRequests: 20, WebAttackThreshold: 100, UpstreamErrorPct: 5, UpstreamSpikeFactor: 3,
+		MaxLogEntries: 1000, CorrelationFields: "request_id",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		status := 200
+		if i%4 == 0 {
+			status = 502
+		}
+		agent.processLogLine("/web", fmt.Sprintf(`10.0.1.1 - - [10/Oct/2026:13:55:36 +0000] "GET /api/cart HTTP/1.1" %d 0 "-" "Mozilla/5.0" request_id=req-%03d`, status, i))
+		agent.processLogLine("/envoy", fmt.Sprintf(`[2026-10-10T13:55:36.123Z] "GET /api/cart HTTP/1.1" %d - 0 12 5 4 "10.0.1.1" "curl/8.0" "env-%03d" "cart.internal" "10.0.1.5:8080"`, status, i))
+	}
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	want := map[string][]string{
+		"HTTP_5XX_SPIKE:web":                 {"req-000", "req-004", "req-008", "req-012", "req-016"},
+		"UPSTREAM_ERROR_SPIKE:cart.internal": {"env-000", "env-004", "env-008", "env-012", "env-016"},
+	}
+	if !reflect.DeepEqual(payload.AlertCorrelationIDs, want) {
+		t.Errorf("Expected correlation IDs %v, got %v", want, payload.AlertCorrelationIDs)
+	}
+	if ids := agent.alertStates["HTTP_5XX_SPIKE:web"].CorrelationIDs; len(ids) != 5 {
+		t.Errorf("Expected the alert state to keep the IDs, got %v", ids)
+	}
+}
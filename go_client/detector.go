@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	// Longest a WASM detector may take per payload before it is stopped and disabled
+	detectorTimeout = 5 * time.Second
+	// Memory a WASM detector may use, in 64 KiB pages (64 MiB)
+	detectorMemoryPages = 1024
+)
+
+// DetectorInput is what detectors see of each payload: its metrics and the
+// Docker events and logs collected since the previous one
+type DetectorInput struct {
+	Host         string        `json:"host"`
+	ServerID     string        `json:"server_id,omitempty"`
+	Env          string        `json:"env,omitempty"`
+	Timestamp    time.Time     `json:"timestamp"`
+	Metrics      SystemMetrics `json:"metrics"`
+	DockerEvents []DockerEvent `json:"docker_events"`
+	Logs         []LogEntry    `json:"logs"`
+}
+
+// DetectorAlert is an alert raised by a detector, named like the agent's
+// own (TYPE or TYPE:<subject>)
+type DetectorAlert struct {
+	Alert  string `json:"alert"`
+	Detail string `json:"detail,omitempty"`
+	// Weight of the alert type in the payload score; built-in types and those
+	// in --alert-weights keep theirs
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// Detector is detection logic run on every payload before it is sent.
+// External detectors from --detectors implement it as Go plugins or WASM
+// modules, both exchanging JSON: a DetectorInput in, a list of
+// DetectorAlert out.
+type Detector interface {
+	Name() string
+	Detect(input DetectorInput) ([]DetectorAlert, error)
+	Close() error
+}
+
+// loadDetectors loads the comma-separated --detectors paths: Go plugins
+// (.so) and WASM modules (.wasm)
+func loadDetectors(paths string) ([]Detector, error) {
+	var detectors []Detector
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		var detector Detector
+		var err error
+		switch filepath.Ext(path) {
+		case ".so":
+			detector, err = loadPluginDetector(path)
+		case ".wasm":
+			detector, err = loadWASMDetector(path)
+		default:
+			err = fmt.Errorf("unknown detector type (.so Go plugin or .wasm module)")
+		}
+		if err != nil {
+			for _, loaded := range detectors {
+				loaded.Close()
+			}
+			return nil, fmt.Errorf("detector %s: %w", path, err)
+		}
+		detectors = append(detectors, detector)
+	}
+	return detectors, nil
+}
+
+// detectorName names a detector after its file
+func detectorName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// decodeDetectorAlerts parses a detector's output
+func decodeDetectorAlerts(output []byte) ([]DetectorAlert, error) {
+	var alerts []DetectorAlert
+	if len(output) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(output, &alerts); err != nil {
+		return nil, fmt.Errorf("invalid output: %w", err)
+	}
+	return alerts, nil
+}
+
+// pluginDetector is a Go plugin exporting
+//
+//	func Detect(input []byte) ([]byte, error)
+//
+// It runs inside the agent's process, so it must be built with the same Go
+// version as the agent and is trusted like the agent itself.
+type pluginDetector struct {
+	name   string
+	detect func([]byte) ([]byte, error)
+}
+
+func loadPluginDetector(path string) (*pluginDetector, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup("Detect")
+	if err != nil {
+		return nil, err
+	}
+	detect, ok := symbol.(func([]byte) ([]byte, error))
+	if !ok {
+		return nil, fmt.Errorf("Detect is %T, expected func([]byte) ([]byte, error)", symbol)
+	}
+	return &pluginDetector{name: detectorName(path), detect: detect}, nil
+}
+
+func (d *pluginDetector) Name() string { return d.name }
+
+func (d *pluginDetector) Detect(input DetectorInput) ([]DetectorAlert, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	output, err := d.detect(body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDetectorAlerts(output)
+}
+
+// Go plugins cannot be unloaded
+func (d *pluginDetector) Close() error { return nil }
+
+// wasmDetector is a WASM module, sandboxed without file, network or
+// environment access, exporting its memory and
+//
+//	alloc(size i32) -> ptr i32
+//	detect(ptr i32, len i32) -> i64
+//
+// The input is written to memory from alloc, and detect returns the output's
+// pointer and length packed as ptr<<32 | len. An optional free(ptr, len)
+// export is called for both buffers afterwards. Modules may import WASI
+// (e.g. TinyGo or Rust wasm32-wasi reactors); their output goes to the agent log.
+type wasmDetector struct {
+	name    string
+	runtime wazero.Runtime
+	module  api.Module
+	alloc   api.Function
+	detect  api.Function
+	free    api.Function // nil if not exported
+}
+
+func loadWASMDetector(path string) (*wasmDetector, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(detectorMemoryPages))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	name := detectorName(path)
+	module, err := runtime.InstantiateWithConfig(ctx, code, wazero.NewModuleConfig().
+		WithName(name).
+		WithStartFunctions("_initialize").
+		WithStdout(log.Writer()).
+		WithStderr(log.Writer()))
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	d := &wasmDetector{
+		name:    name,
+		runtime: runtime,
+		module:  module,
+		alloc:   module.ExportedFunction("alloc"),
+		detect:  module.ExportedFunction("detect"),
+		free:    module.ExportedFunction("free"),
+	}
+	if d.alloc == nil || d.detect == nil || module.Memory() == nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("module must export memory, alloc and detect")
+	}
+	return d, nil
+}
+
+func (d *wasmDetector) Name() string { return d.name }
+
+func (d *wasmDetector) Detect(input DetectorInput) ([]DetectorAlert, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	// A module still running at the deadline is closed, which disables it
+	ctx, cancel := context.WithTimeout(context.Background(), detectorTimeout)
+	defer cancel()
+
+	results, err := d.alloc.Call(ctx, uint64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	inPtr := uint32(results[0])
+	if !d.module.Memory().Write(inPtr, body) {
+		return nil, fmt.Errorf("alloc returned %d, out of memory bounds for %d bytes", inPtr, len(body))
+	}
+	results, err = d.detect.Call(ctx, uint64(inPtr), uint64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("detect: %w", err)
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := d.module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("detect returned %d bytes at %d, out of memory bounds", outLen, outPtr)
+	}
+	alerts, err := decodeDetectorAlerts(output)
+
+	if d.free != nil {
+		d.free.Call(ctx, uint64(inPtr), uint64(len(body)))
+		d.free.Call(ctx, uint64(outPtr), uint64(outLen))
+	}
+	return alerts, err
+}
+
+func (d *wasmDetector) Close() error {
+	return d.runtime.Close(context.Background())
+}
+
+// runDetectors runs the --detectors on a payload's data and raises their
+// alerts. A failing detector is logged and skipped.
+func (a *Agent) runDetectors(input DetectorInput) {
+	for _, detector := range a.detectors {
+		start := time.Now()
+		alerts, err := detector.Detect(input)
+		a.selfMetrics.Detector("plugin:" + detector.Name()).Since(start)
+		if err != nil {
+			log.Printf("Detector %s failed: %v", detector.Name(), err)
+			continue
+		}
+
+		a.alertMutex.Lock()
+		for _, alert := range alerts {
+			alert.Alert = strings.TrimSpace(alert.Alert)
+			if alert.Alert == "" {
+				continue
+			}
+			alertType, _, _ := strings.Cut(alert.Alert, ":")
+			if _, configured := a.alertWeight(alertType); !configured && alert.Weight > 0 {
+				a.detectorWeights[alertType] = alert.Weight
+			}
+			if a.raiseAlert(alert.Alert) {
+				log.Printf("Detector %s raised %s: %s", detector.Name(), alert.Alert, alert.Detail)
+			}
+			a.alertStates[alert.Alert].Detail = alert.Detail
+		}
+		a.alertMutex.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDetectorOutput is what testDetectorWASM's detect returns
+const testDetectorOutput = `[{"alert":"WASM_RULE:demo","detail":"from wasm","weight":0.2}]`
+
+// testDetectorWASM is, followed by testDetectorOutput as its data segment:
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (func (export "alloc") (param i32) (result i32) i32.const 1024)
+//	  (func (export "detect") (param i32 i32) (result i64) i64.const 62)
+//	  (data (i32.const 0) "[{\"alert\": ...}]"))
+var testDetectorWASM = append([]byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x03, 0x03, 0x02, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1b, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x05, 0x61, 0x6c, 0x6c,
+	0x6f, 0x63, 0x00, 0x00, 0x06, 0x64, 0x65, 0x74, 0x65, 0x63, 0x74, 0x00, 0x01, 0x0a, 0x0c, 0x02,
+	0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x04, 0x00, 0x42, 0x3e, 0x0b, 0x0b, 0x44, 0x01, 0x00, 0x41,
+	0x00, 0x0b, 0x3e,
+}, testDetectorOutput...)
+
+// TestWASMDetector tests loading a WASM module and exchanging JSON with it
+func TestWASMDetector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.wasm")
+	if err := os.WriteFile(path, testDetectorWASM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	detectors, err := loadDetectors(path)
+	if err != nil {
+		t.Fatalf("Failed to load WASM detector: %v", err)
+	}
+	defer detectors[0].Close()
+	if detectors[0].Name() != "rules" {
+		t.Errorf("Expected detector named after its file, got %s", detectors[0].Name())
+	}
+
+	alerts, err := detectors[0].Detect(DetectorInput{Host: "web-01", Logs: []LogEntry{{Container: "api", Message: "hello"}}})
+	if err != nil {
+		t.Fatalf("Detect failed: %v", err)
+	}
+	if len(alerts) != 1 || alerts[0] != (DetectorAlert{Alert: "WASM_RULE:demo", Detail: "from wasm", Weight: 0.2}) {
+		t.Errorf("Unexpected alerts %+v", alerts)
+	}
+}
+
+// TestLoadDetectorsErrors tests that unusable detectors fail startup
+func TestLoadDetectorsErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.wasm")
+	os.WriteFile(empty, []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, 0644)
+	notPlugin := filepath.Join(dir, "rules.so")
+	os.WriteFile(notPlugin, []byte("not a plugin"), 0644)
+
+	for path, want := range map[string]string{
+		empty:                             "must export memory, alloc and detect",
+		notPlugin:                         "rules.so",
+		filepath.Join(dir, "rules.py"):    "unknown detector type",
+		filepath.Join(dir, "absent.wasm"): "no such file",
+	} {
+		if _, err := loadDetectors(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s to fail with %q, got %v", filepath.Base(path), want, err)
+		}
+	}
+}
+
+// fakeDetector returns fixed alerts or an error
+type fakeDetector struct {
+	alerts []DetectorAlert
+	err    error
+	input  DetectorInput
+}
+
+func (d *fakeDetector) Name() string { return "fake" }
+func (d *fakeDetector) Detect(input DetectorInput) ([]DetectorAlert, error) {
+	d.input = input
+	return d.alerts, d.err
+}
+func (d *fakeDetector) Close() error { return nil }
+
+// TestRunDetectors tests that detector alerts are raised with their details
+// and weights, and that failing detectors are skipped
+func TestRunDetectors(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	detector := &fakeDetector{alerts: []DetectorAlert{
+		{Alert: "CARD_TESTING:checkout", Detail: "42 declines from one BIN", Weight: 0.7},
+		{Alert: "CPU_SPIKE", Weight: 5},
+		{Alert: " "},
+	}}
+	agent.detectors = []Detector{&fakeDetector{err: errors.New("boom")}, detector}
+	agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "checkout", Message: "card declined"})
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detector.input.Logs) != 1 || detector.input.Logs[0].Container != "checkout" {
+		t.Errorf("Expected detector to see the buffered logs, got %+v", detector.input.Logs)
+	}
+	if strings.Join(payload.LocalAlerts, ",") != "CARD_TESTING:checkout,CPU_SPIKE" {
+		t.Errorf("Expected detector alerts in the payload, got %v", payload.LocalAlerts)
+	}
+	if payload.AlertDetails["CARD_TESTING:checkout"] != "42 declines from one BIN" {
+		t.Errorf("Expected detector detail, got %v", payload.AlertDetails)
+	}
+	// Built-in alert types keep their own weight
+	if payload.Score < 1.09 || payload.Score > 1.11 {
+		t.Errorf("Expected score 0.7 + 0.4, got %v", payload.Score)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent log lines kept in memory for diagnostic bundles
+const maxAgentLogLines = 1000
+
+// Recently sent payloads kept in memory for diagnostic bundles
+const maxRecentPayloads = 20
+
+// lineRing is an io.Writer that keeps the last lines written to it
+type lineRing struct {
+	mu      sync.Mutex
+	lines   []string
+	max     int
+	partial []byte
+}
+
+// newLineRing creates a ring holding at most max lines
+func newLineRing(max int) *lineRing {
+	return &lineRing{max: max}
+}
+
+// agentLog captures the agent's log output; runAgent tees the log package into it
+var agentLog = newLineRing(maxAgentLogLines)
+
+// Write splits p into lines, holding back a trailing partial line
+func (r *lineRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		r.lines = append(r.lines, string(data[:i]))
+		data = data[i+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+	if len(r.lines) > r.max {
+		r.lines = append([]string(nil), r.lines[len(r.lines)-r.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the buffered lines oldest first
+func (r *lineRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// rememberPayload keeps a payload for diagnostics; retries of the same payload
+// are recorded once
+func (a *Agent) rememberPayload(payload Payload) {
+	a.recentMutex.Lock()
+	defer a.recentMutex.Unlock()
+
+	for _, p := range a.recentPayloads {
+		if p.ID == payload.ID {
+			return
+		}
+	}
+	a.recentPayloads = append(a.recentPayloads, payload)
+	if len(a.recentPayloads) > maxRecentPayloads {
+		a.recentPayloads = a.recentPayloads[1:]
+	}
+}
+
+// handleAdminLogs returns the agent's recent log output as text
+func (a *Agent) handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range agentLog.Lines() {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// handleAdminPayloads returns recently sent payloads, newest first (?limit=)
+func (a *Agent) handleAdminPayloads(w http.ResponseWriter, r *http.Request) {
+	limit := maxRecentPayloads
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	a.recentMutex.Lock()
+	result := make([]Payload, 0, limit)
+	for i := len(a.recentPayloads) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, a.recentPayloads[i])
+	}
+	a.recentMutex.Unlock()
+
+	writeJSON(w, result)
+}
+
+// handleAdminGoroutines returns a full goroutine dump
+func (a *Agent) handleAdminGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// diagFiles maps bundle file names to the agent endpoints they are fetched from
+func diagFiles(payloads int) []struct{ name, path string } {
+	return []struct{ name, path string }{
+		{"health.json", "/healthz"},
+		{"metrics.json", "/metrics"},
+		{"config.json", "/admin/config"},
+		{"queue.json", "/admin/queue"},
+		{"alerts.json", "/admin/alerts"},
+		{"containers.json", "/admin/containers"},
+		{"events.json", "/admin/events"},
+		{"baseline.json", "/admin/baseline"},
+		{"agent.log", "/admin/logs"},
+		{"goroutines.txt", "/admin/goroutines"},
+		{"payloads.json", fmt.Sprintf("/admin/payloads?limit=%d", payloads)},
+	}
+}
+
+// writeDiagBundle writes a gzipped tarball of everything the agent exposes for
+// debugging. Endpoints that fail are listed in errors.txt instead of aborting,
+// so a half-broken agent still produces a useful bundle.
+func writeDiagBundle(w io.Writer, c *topClient, payloads int) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	prefix := "monitoring-agent-diag-" + now.UTC().Format("20060102T150405Z") + "/"
+
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: prefix + name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	version, _ := json.MarshalIndent(currentBuild(), "", "  ")
+	if err := add("diag-tool-version.json", version); err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, f := range diagFiles(payloads) {
+		data, err := c.fetch(f.path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", f.name, err))
+			continue
+		}
+		if strings.HasSuffix(f.name, ".json") {
+			var pretty bytes.Buffer
+			if json.Indent(&pretty, data, "", "  ") == nil {
+				data = pretty.Bytes()
+			}
+		}
+		if err := add(f.name, data); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		if err := add("errors.txt", []byte(strings.Join(errs, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func cmdDiag(args []string) error {
+	fs := newFlagSet("diag", "diag [--addr ADDR] [--admin-token TOKEN] [--output FILE] [--payloads N]")
+	addr := fs.String("addr", defaultAgentAddr(), "Agent health server address (host:port, https:// URL or unix:/path; default HEALTH_ADDR)")
+	token := fs.String("admin-token", getenv("ADMIN_TOKEN"), "Admin API bearer token (ADMIN_TOKEN)")
+	caFile := fs.String("ca-file", "", "CA bundle for a TLS health server")
+	output := fs.String("output", "", "Bundle to write (default monitoring-agent-diag-<host>-<time>.tar.gz)")
+	payloads := fs.Int("payloads", 5, "Number of recent payloads to include")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newTopClient(*addr, *token, *caFile)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		hostname, _ := os.Hostname()
+		*output = fmt.Sprintf("monitoring-agent-diag-%s-%s.tar.gz", hostname, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeDiagBundle(file, client, *payloads); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", *output)
+	return nil
+}
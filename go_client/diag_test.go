@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLineRing tests that only the last complete lines are kept
+func TestLineRing(t *testing.T) {
+	ring := newLineRing(2)
+	ring.Write([]byte("one\ntwo\nthr"))
+	ring.Write([]byte("ee\nfour"))
+	if got := strings.Join(ring.Lines(), ","); got != "two,three" {
+		t.Errorf("Expected two,three, got %s", got)
+	}
+}
+
+// TestDiagBundle tests building a support bundle from a running agent
+func TestDiagBundle(t *testing.T) {
+	log.SetOutput(io.MultiWriter(os.Stderr, agentLog))
+	defer log.SetOutput(os.Stderr)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret-value", HealthAddr: "unix:" + socketPath,
+		AdminToken: "admin-secret", MaxLogEntries: 10, BaselineSamples: 5})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.healthServer.Close()
+
+	payload := Payload{ID: newUUID(), Timestamp: time.Now()}
+	if err := agent.sendPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	agent.sendPayload(payload) // a retry is not recorded twice
+
+	client, err := newTopClient("unix:"+socketPath, "admin-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	if err := writeDiagBundle(&bundle, client, 5); err != nil {
+		t.Fatalf("Failed to write bundle: %v", err)
+	}
+
+	files := make(map[string]string)
+	gz, err := gzip.NewReader(&bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[path.Base(hdr.Name)] = string(data)
+	}
+
+	for _, name := range []string{"config.json", "queue.json", "agent.log", "goroutines.txt", "payloads.json", "diag-tool-version.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in bundle, got %v", name, files)
+		}
+	}
+	if _, ok := files["errors.txt"]; ok {
+		t.Errorf("Unexpected errors: %s", files["errors.txt"])
+	}
+	if strings.Contains(files["config.json"], "s3cret-value") {
+		t.Error("Expected secret to be redacted from config.json")
+	}
+	if strings.Count(files["payloads.json"], payload.ID) != 1 {
+		t.Errorf("Expected payload %s once in payloads.json:\n%s", payload.ID, files["payloads.json"])
+	}
+	if !strings.Contains(files["agent.log"], "Successfully sent payload "+payload.ID) {
+		t.Errorf("Expected send log line in agent.log:\n%s", files["agent.log"])
+	}
+	if !strings.Contains(files["goroutines.txt"], "goroutine ") {
+		t.Error("Expected a goroutine dump")
+	}
+}
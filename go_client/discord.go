@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Embed side bar colors per severity
+var discordColors = map[string]int{
+	SeverityCritical: 0xE01E5A,
+	SeverityWarning:  0xF2C744,
+}
+
+// Discord rejects embeds with longer descriptions
+const maxDiscordDescription = 4096
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description"`
+	Color       int                 `json:"color"`
+	Fields      []discordEmbedField `json:"fields"`
+	Timestamp   string              `json:"timestamp,omitempty"`
+	Footer      *discordEmbedFooter `json:"footer,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbedFooter struct {
+	Text string `json:"text"`
+}
+
+// newDiscordNotifier returns nil when no webhook is configured
+func newDiscordNotifier(config Config) (*alertNotifier, error) {
+	if config.DiscordWebhook == "" && config.DiscordCriticalWebhook == "" {
+		return nil, nil
+	}
+	client, err := newOutboundClient(config, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	post := func(webhook string, message AlertMessage) error {
+		return postDiscord(client, webhook, message)
+	}
+	options := serviceOptions(config, config.DiscordTemplate, config.DiscordMinSeverity, config.DiscordRepeatMinutes)
+	return newAlertNotifier("Discord", severityWebhooks(config.DiscordWebhook, config.DiscordCriticalWebhook), options, post)
+}
+
+// discordEmbedFor formats a message as an embed: the rendered template, or
+// alerts with their details, in the description, the host's identity and
+// score as fields
+func discordEmbedFor(message AlertMessage) discordEmbed {
+	text := message.Text
+	if text == "" {
+		var description strings.Builder
+		for _, alert := range message.Alerts {
+			fmt.Fprintf(&description, "**%s**", alert)
+			if detail := message.Details[alert]; detail != "" {
+				fmt.Fprintf(&description, ": %s", detail)
+			}
+			description.WriteByte('\n')
+		}
+		text = strings.TrimSuffix(description.String(), "\n")
+	}
+	if len(text) > maxDiscordDescription {
+		text = text[:maxDiscordDescription-1] + "…"
+	}
+
+	fields := []discordEmbedField{{Name: "Host", Value: message.Host, Inline: true}}
+	extra := map[string]string{"Env": message.Env, "Team": message.OwnerTeam, "Server ID": message.ServerID}
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if extra[name] != "" {
+			fields = append(fields, discordEmbedField{Name: name, Value: extra[name], Inline: true})
+		}
+	}
+	fields = append(fields, discordEmbedField{Name: "Score", Value: fmt.Sprintf("%.2f", message.Score), Inline: true})
+
+	embed := discordEmbed{
+		Title:       fmt.Sprintf("%s: %d alert(s) on %s", strings.ToUpper(message.Severity), len(message.Alerts), message.Host),
+		Description: text,
+		Color:       discordColors[message.Severity],
+		Fields:      fields,
+		Footer:      &discordEmbedFooter{Text: "monitoring-agent " + currentBuild().Version},
+	}
+	if !message.Time.IsZero() {
+		embed.Timestamp = message.Time.UTC().Format(time.RFC3339)
+	}
+	return embed
+}
+
+// postDiscord sends a message to a Discord webhook as one embed
+func postDiscord(client *http.Client, webhook string, message AlertMessage) error {
+	body, err := json.Marshal(map[string]any{
+		"username": "RichardOps",
+		"embeds":   []discordEmbed{discordEmbedFor(message)},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 204 No Content, or 200 with ?wait=true
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
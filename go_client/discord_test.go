@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDiscordNotifier tests that alerts are posted as embeds to the webhook of their severity
+func TestDiscordNotifier(t *testing.T) {
+	var posted []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+		posted = append(posted, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier, err := newDiscordNotifier(Config{DiscordWebhook: server.URL, DiscordRepeatMinutes: 60})
+	if err != nil || notifier == nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	payload := Payload{
+		Host:         "nas",
+		OwnerTeam:    "home",
+		LocalAlerts:  []string{"BRUTE_FORCE:10.0.0.9"},
+		AlertDetails: map[string]string{"BRUTE_FORCE:10.0.0.9": "25 failed logins"},
+		Score:        0.5,
+		Timestamp:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("Expected one post, got %d", len(posted))
+	}
+
+	embeds := posted[0]["embeds"].([]any)
+	embed := embeds[0].(map[string]any)
+	if embed["title"] != "CRITICAL: 1 alert(s) on nas" || embed["color"] != float64(0xE01E5A) {
+		t.Errorf("Unexpected title or color: %v", embed)
+	}
+	if embed["description"] != "**BRUTE_FORCE:10.0.0.9**: 25 failed logins" {
+		t.Errorf("Unexpected description %q", embed["description"])
+	}
+	if embed["timestamp"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("Unexpected timestamp %v", embed["timestamp"])
+	}
+	var fields []string
+	for _, field := range embed["fields"].([]any) {
+		f := field.(map[string]any)
+		fields = append(fields, f["name"].(string)+"="+f["value"].(string))
+	}
+	if got := strings.Join(fields, ","); got != "Host=nas,Team=home,Score=0.50" {
+		t.Errorf("Unexpected fields %s", got)
+	}
+}
+
+// TestNewAlertNotifiers tests that a notifier is created per configured chat service
+func TestNewAlertNotifiers(t *testing.T) {
+	notifiers, err := newAlertNotifiers(Config{})
+	if err != nil || len(notifiers) != 0 {
+		t.Fatalf("Expected no notifiers without webhooks, got %v, %v", notifiers, err)
+	}
+	notifiers, err = newAlertNotifiers(Config{SlackWebhook: "http://slack", DiscordCriticalWebhook: "http://discord"})
+	if err != nil || len(notifiers) != 2 || notifiers[0].name != "Slack" || notifiers[1].name != "Discord" {
+		t.Fatalf("Expected Slack and Discord notifiers, got %v, %v", notifiers, err)
+	}
+	if discord := notifiers[1].webhooks; discord[SeverityCritical] != "http://discord" || discord[SeverityWarning] != "" {
+		t.Errorf("Expected Discord to post only critical alerts, got %v", discord)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// TestDockerReconnect tests that a failed event stream is resubscribed from
+// the last event seen and that log monitors are re-attached afterwards
+func TestDockerReconnect(t *testing.T) {
+	eventTime := time.Unix(1700000000, 123456789)
+	var mu sync.Mutex
+	var sinces []string
+	var logRequests []string
+	lists := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.43/events", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sinces = append(sinces, r.URL.Query().Get("since"))
+		first := len(sinces) == 1
+		mu.Unlock()
+		if first {
+			// One event, then the daemon goes away
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Type": "container", "Action": "start", "time": eventTime.Unix(), "timeNano": eventTime.UnixNano(),
+				"Actor": map[string]interface{}{"ID": "c1", "Attributes": map[string]string{"name": "web", "image": "nginx"}},
+			})
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/v1.43/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lists++
+		mu.Unlock()
+		fmt.Fprint(w, `[{"Id": "c1", "State": "running"}, {"Id": "c2", "State": "running"}, {"Id": "c3", "State": "exited"}]`)
+	})
+	mux.HandleFunc("/v1.43/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1.43/containers/"), "/")
+		switch endpoint {
+		case "json":
+			fmt.Fprintf(w, `{"Id": %q, "Name": "/%s", "Config": {"Image": "nginx"}}`, id, id)
+		case "logs":
+			mu.Lock()
+			logRequests = append(logRequests, id)
+			mu.Unlock()
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	agent, err := NewAgent(Config{TailLines: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.dockerClient, err = client.NewClientWithOpts(client.WithHost("tcp://"+server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.monitorDockerEvents(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		// c1's log stream ends at once and is followed again, so wait for c2 by name
+		done := len(sinces) == 2 && lists == 1 && slices.Contains(logRequests, "c2")
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sinces) != 2 || sinces[0] != "" {
+		t.Fatalf("Expected one resubscription, got since filters %q", sinces)
+	}
+	if want := "1700000000.123456790"; sinces[1] != want {
+		t.Errorf("Expected resubscription since %s, got %s", want, sinces[1])
+	}
+	if lists != 1 {
+		t.Errorf("Expected running containers to be listed after reconnecting, got %d lists", lists)
+	}
+	attached := strings.Join(logRequests, ",")
+	if !strings.Contains(attached, "c1") || !strings.Contains(attached, "c2") || strings.Contains(attached, "c3") {
+		t.Errorf("Expected logs followed for running containers c1 and c2, got %s", attached)
+	}
+	agent.eventMutex.RLock()
+	defer agent.eventMutex.RUnlock()
+	if len(agent.eventBuffer) != 1 || agent.eventBuffer[0].Container != "web" {
+		t.Errorf("Expected the start event to be recorded once, got %+v", agent.eventBuffer)
+	}
+}
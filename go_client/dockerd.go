@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Log file written by dockerd where it doesn't log to the journal
+const dockerDaemonLogFile = "/var/log/docker.log"
+
+// Systemd unit whose journal holds the daemon's log
+const dockerDaemonUnit = "docker.service"
+
+// logrus level field of a dockerd line, e.g. `time="..." level=error msg="..."`
+var dockerdLevelPattern = regexp.MustCompile(`\blevel=(\w+)`)
+
+// dockerdRule maps a dockerd log message to an alert and the reason counted
+// in its details, like infraLogRule
+type dockerdRule struct {
+	alert   string
+	reason  string
+	message string
+}
+
+// dockerdRules are the daemon-level failures worth alerting on, matched case-insensitively
+var dockerdRules = []dockerdRule{
+	// Storage drivers failing to mount, create or remove layers
+	{"DOCKER_STORAGE_ERROR", "no_space", "no space left on device"},
+	{"DOCKER_STORAGE_ERROR", "thin_pool", "devmapper: thin pool"},
+	{"DOCKER_STORAGE_ERROR", "devicemapper", "devmapper:"},
+	{"DOCKER_STORAGE_ERROR", "overlay", "overlay2:"},
+	{"DOCKER_STORAGE_ERROR", "overlay", "error creating overlay mount"},
+	{"DOCKER_STORAGE_ERROR", "layer", "failed to register layer"},
+	{"DOCKER_STORAGE_ERROR", "layer", "error removing rootfs"},
+	{"DOCKER_STORAGE_ERROR", "graphdriver", "graphdriver"},
+	// Containers not reattached after a daemon restart with live-restore
+	{"DOCKER_LIVE_RESTORE_FAILED", "restore", "failed to restore container"},
+	{"DOCKER_LIVE_RESTORE_FAILED", "restore", "error restoring container"},
+	{"DOCKER_LIVE_RESTORE_FAILED", "shim", "failed to connect to shim"},
+	{"DOCKER_LIVE_RESTORE_FAILED", "containerd", "containerd.sock"},
+	// Registry and API rate limits
+	{"DOCKER_API_THROTTLED", "pull_rate_limit", "toomanyrequests"},
+	{"DOCKER_API_THROTTLED", "too_many_requests", "429 too many requests"},
+	{"DOCKER_API_THROTTLED", "rate_limit", "rate limit"},
+}
+
+// matchDockerdRule returns the rule matching a dockerd log message. Lines
+// logged below warning level are routine and never match.
+func matchDockerdRule(message string) (dockerdRule, bool) {
+	if m := dockerdLevelPattern.FindStringSubmatch(message); m != nil {
+		switch m[1] {
+		case "trace", "debug", "info":
+			return dockerdRule{}, false
+		}
+	}
+	lower := strings.ToLower(message)
+	for _, rule := range dockerdRules {
+		if strings.Contains(lower, rule.message) {
+			return rule, true
+		}
+	}
+	return dockerdRule{}, false
+}
+
+// handleDockerdMessage raises the alert for a daemon-level failure, with
+// per-reason counts in alert_details
+func (a *Agent) handleDockerdMessage(message string) {
+	rule, ok := matchDockerdRule(message)
+	if !ok {
+		return
+	}
+	if a.recordDenial(rule.alert, rule.reason) {
+		log.Printf("Docker daemon: %s (%s)", rule.alert, rule.reason)
+	}
+}
+
+// handleDockerdJournalLine decodes a `journalctl -o json` entry of the docker unit
+func (a *Agent) handleDockerdJournalLine(line string) {
+	var entry journalEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return
+	}
+	a.handleDockerdMessage(entry.message())
+}
+
+// setupDockerDaemonMonitoring follows the Docker daemon's own log, set by
+// --docker-daemon-log: auto, journald, none or a file path. In auto mode
+// /var/log/docker.log is used when it exists, else the docker unit's journal.
+func (a *Agent) setupDockerDaemonMonitoring() {
+	source := a.config.DockerDaemonLog
+	switch source {
+	case "", "none":
+		return
+	case "auto":
+		if _, err := os.Stat(dockerDaemonLogFile); err == nil {
+			source = dockerDaemonLogFile
+		} else if _, err := exec.LookPath("journalctl"); err == nil {
+			source = "journald"
+		} else {
+			return
+		}
+	}
+
+	if source == "journald" {
+		journalctl, err := exec.LookPath("journalctl")
+		if err != nil {
+			log.Printf("Warning: journalctl not found, Docker daemon monitoring disabled")
+			return
+		}
+		a.logSources = append(a.logSources, followCommand(a.handleDockerdJournalLine, journalctl,
+			"--follow", "--output=json", "--lines=0", "--no-pager", "--unit="+dockerDaemonUnit))
+		log.Printf("Monitoring Docker daemon log: %s journal", dockerDaemonUnit)
+		return
+	}
+
+	tailer, err := newFileTailer(source, false, a.handleDockerdMessage)
+	if err != nil {
+		log.Printf("Warning: Failed to follow Docker daemon log %s: %v", source, err)
+		return
+	}
+	a.logSources = append(a.logSources, tailer)
+	log.Printf("Monitoring Docker daemon log: %s", source)
+}
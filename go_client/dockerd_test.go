@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMatchDockerdRule tests dockerd messages against their alerts and levels
+func TestMatchDockerdRule(t *testing.T) {
+	cases := map[string]string{
+		`time="2026-10-10T13:55:36.123456789Z" level=error msg="failed to register layer: devmapper: Thin Pool has 162 free data blocks which is less than minimum required 163"`:                     "DOCKER_STORAGE_ERROR/thin_pool",
+		`time="2026-10-10T13:55:36Z" level=error msg="Handler for POST /v1.43/containers/create returned error: error creating overlay mount to /var/lib/docker/overlay2/x/merged: invalid argument"`: "DOCKER_STORAGE_ERROR/overlay",
+		`time="2026-10-10T13:55:36Z" level=error msg="write /var/lib/docker/tmp/GetImageBlob123: no space left on device"`:                                                                            "DOCKER_STORAGE_ERROR/no_space",
+		`time="2026-10-10T13:55:36Z" level=error msg="Failed to restore container with live-restore" container=4f1c9e error="failed to connect to shim"`:                                              "DOCKER_LIVE_RESTORE_FAILED/restore",
+		`time="2026-10-10T13:55:36Z" level=warning msg="Error getting v2 registry: toomanyrequests: You have reached your pull rate limit."`:                                                          "DOCKER_API_THROTTLED/pull_rate_limit",
+		`time="2026-10-10T13:55:36Z" level=info msg="[graphdriver] using prior storage driver: overlay2"`:                                                                                             "",
+		`time="2026-10-10T13:55:36Z" level=info msg="Loading containers: done."`:                                                                                                                      "",
+	}
+	for message, want := range cases {
+		got := ""
+		if rule, ok := matchDockerdRule(message); ok {
+			got = rule.alert + "/" + rule.reason
+		}
+		if got != want {
+			t.Errorf("matchDockerdRule(%q) = %q, want %q", message, got, want)
+		}
+	}
+}
+
+// TestDockerdJournalAlerts tests that docker unit journal entries raise alerts with reason counts
+func TestDockerdJournalAlerts(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 100})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.handleDockerdJournalLine(`{"MESSAGE":"time=\"2026-10-10T13:55:36Z\" level=error msg=\"error removing rootfs: device or resource busy\"","SYSLOG_IDENTIFIER":"dockerd","__REALTIME_TIMESTAMP":"1791640536000000"}`)
+	agent.handleDockerdJournalLine(`{"MESSAGE":"time=\"2026-10-10T13:55:37Z\" level=error msg=\"write /var/lib/docker/overlay2/x/diff/tmp: no space left on device\"","SYSLOG_IDENTIFIER":"dockerd"}`)
+	agent.handleDockerdJournalLine(`not json`)
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if alerts := strings.Join(payload.LocalAlerts, ","); alerts != "DOCKER_STORAGE_ERROR" {
+		t.Fatalf("Unexpected alerts %s", alerts)
+	}
+	if detail := payload.AlertDetails["DOCKER_STORAGE_ERROR"]; detail != "layer=1, no_space=1" {
+		t.Errorf("Unexpected detail %q", detail)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// dryRunOutput receives pretty-printed payloads in dry-run mode
+var dryRunOutput io.Writer = os.Stdout
+
+// printPayload writes the payload exactly as it would be sent, indented for
+// reading. Buffers are cleared as after a successful send so each printed
+// payload only contains new data.
+func (a *Agent) printPayload(payload Payload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	pretty, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	if _, err := fmt.Fprintf(dryRunOutput, "%s\n", pretty); err != nil {
+		return err
+	}
+	log.Printf("Dry run: payload %s is %d bytes on the wire", payload.ID, len(payloadBytes))
+	a.payloadDelivered(payload)
+	return nil
+}
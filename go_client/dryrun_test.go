@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// TestDryRunPrintsPayload tests that dry-run prints payloads instead of sending them
+func TestDryRunPrintsPayload(t *testing.T) {
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+
+	agent, err := NewAgent(Config{DryRun: true, ServerURL: "http://127.0.0.1:1/unreachable", MaxLogEntries: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.processLogLine("web", "hello")
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.sendPayload(payload); err != nil {
+		t.Fatalf("Expected dry run to succeed, got %v", err)
+	}
+
+	var printed Payload
+	if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+		t.Fatalf("Expected printed payload JSON, got %v:\n%s", err, out.String())
+	}
+	if printed.ID != payload.ID || len(printed.Logs) != 1 {
+		t.Errorf("Unexpected printed payload %+v", printed)
+	}
+	if len(agent.payloadQueue) != 0 || len(agent.logBuffer) != 0 {
+		t.Error("Expected nothing queued and buffers cleared after dry run")
+	}
+}
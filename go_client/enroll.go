@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Credentials are what the server issues an agent at enrollment: its own API
+// key and the canonical server ID it reports as. TokenSHA256 records which
+// enrollment token they were issued for.
+type Credentials struct {
+	KeyID       string `json:"key_id"`
+	Secret      string `json:"secret"`
+	ServerID    string `json:"server_id"`
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+}
+
+// enrollRequest identifies the agent to the enrollment endpoint. A
+// re-enrolling agent adds its current key ID and a signature with that key
+// over "<timestamp>.enroll.<token>", which is how it keeps its server ID.
+type enrollRequest struct {
+	Token        string `json:"token"`
+	Host         string `json:"host"`
+	MachineID    string `json:"machine_id,omitempty"`
+	AgentVersion string `json:"agent_version"`
+	Env          string `json:"env,omitempty"`
+	OwnerTeam    string `json:"owner_team,omitempty"`
+	KeyID        string `json:"key_id,omitempty"`
+	Timestamp    string `json:"timestamp,omitempty"`
+	Signature    string `json:"signature,omitempty"`
+}
+
+// applyCredentials replaces the configured secret, key ID and server ID with
+// the persisted enrollment credentials. Without them, an agent given
+// --enroll-token enrolls first; otherwise config is returned unchanged. An
+// --enroll-token other than the one the credentials were issued for
+// re-enrolls, proving the agent holds its current key.
+func applyCredentials(client *http.Client, config Config) (Config, error) {
+	if config.CredentialsFile == "" || config.ServerURL == "" {
+		return config, nil
+	}
+	creds, err := loadCredentials(config.CredentialsFile)
+	if os.IsNotExist(err) {
+		if config.EnrollToken == "" || config.DryRun || config.Exporter {
+			return config, nil
+		}
+		if creds, err = enroll(client, config, nil); err != nil {
+			return config, fmt.Errorf("enrollment failed: %w", err)
+		}
+		if err := saveCredentials(config.CredentialsFile, creds); err != nil {
+			return config, fmt.Errorf("failed to save credentials: %w", err)
+		}
+		log.Printf("Enrolled as %s with key %s (%s)", creds.ServerID, creds.KeyID, config.CredentialsFile)
+	} else if err != nil {
+		return config, fmt.Errorf("failed to load credentials: %w", err)
+	} else if config.EnrollToken != "" && creds.TokenSHA256 != "" && creds.TokenSHA256 != tokenDigest(config.EnrollToken) &&
+		!config.DryRun && !config.Exporter {
+		// A failed re-enrollment keeps the agent running on its current key
+		if renewed, err := enroll(client, config, &creds); err != nil {
+			log.Printf("Warning: Re-enrollment failed, keeping key %s: %v", creds.KeyID, err)
+		} else if err := saveCredentials(config.CredentialsFile, renewed); err != nil {
+			log.Printf("Warning: Failed to save re-enrolled credentials, keeping key %s: %v", creds.KeyID, err)
+		} else {
+			log.Printf("Re-enrolled as %s with key %s, replacing key %s", renewed.ServerID, renewed.KeyID, creds.KeyID)
+			creds = renewed
+		}
+	}
+
+	config.KeyID = creds.KeyID
+	config.Secret = creds.Secret
+	config.ServerID = creds.ServerID
+	return config, nil
+}
+
+// tokenDigest is the SHA-256 of an enrollment token, kept with the
+// credentials instead of the token itself
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// enroll exchanges config.EnrollToken for credentials, signing the request
+// with previous when re-enrolling
+func enroll(client *http.Client, config Config, previous *Credentials) (Credentials, error) {
+	var creds Credentials
+	hostname, err := os.Hostname()
+	if err != nil {
+		return creds, err
+	}
+	request := enrollRequest{
+		Token:        config.EnrollToken,
+		Host:         hostname,
+		MachineID:    machineID(),
+		AgentVersion: currentBuild().Version,
+		Env:          config.Env,
+		OwnerTeam:    config.OwnerTeam,
+	}
+	if previous != nil {
+		request.KeyID = previous.KeyID
+		request.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		request.Signature = signFields(previous.Secret, request.Timestamp, "enroll", config.EnrollToken)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return creds, err
+	}
+
+	// With several --server-url endpoints, enroll with the first that answers
+	var resp *http.Response
+	for _, serverURL := range serverURLs(config.ServerURL) {
+		var endpoint string
+		if endpoint, err = enrollmentURL(serverURL); err != nil {
+			return creds, err
+		}
+		if resp, err = client.Post(endpoint, "application/json", bytes.NewReader(body)); err == nil {
+			break
+		}
+		log.Printf("Warning: Enrollment with %s failed: %v", endpoint, err)
+	}
+	if resp == nil {
+		return creds, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return creds, fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return creds, fmt.Errorf("invalid enrollment response: %w", err)
+	}
+	if creds.KeyID == "" || creds.Secret == "" || creds.ServerID == "" {
+		return creds, fmt.Errorf("incomplete enrollment response")
+	}
+	creds.TokenSHA256 = tokenDigest(config.EnrollToken)
+	return creds, nil
+}
+
+// enrollmentURL is the enroll endpoint beside the ingest URL, e.g.
+// https://host/api/ingest -> https://host/api/enroll
+func enrollmentURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "enroll")
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+func loadCredentials(file string) (Credentials, error) {
+	var creds Credentials
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("%s: %w", file, err)
+	}
+	if creds.KeyID == "" || creds.Secret == "" || creds.ServerID == "" {
+		return creds, fmt.Errorf("%s is missing key_id, secret or server_id", file)
+	}
+	return creds, nil
+}
+
+// saveCredentials writes creds readable only by the agent's user, replacing
+// the file atomically
+func saveCredentials(file string, creds Credentials) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// fileExists reports whether file exists; an empty path never does
+func fileExists(file string) bool {
+	if file == "" {
+		return false
+	}
+	_, err := os.Stat(file)
+	return err == nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEnrollment tests that an enrollment token is exchanged once for
+// credentials that are persisted and used instead of the configured ones
+func TestEnrollment(t *testing.T) {
+	var requests []enrollRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/enroll" {
+			t.Errorf("Expected enrollment at /api/enroll, got %s", r.URL.Path)
+		}
+		var req enrollRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		switch {
+		case req.Token == "one-time" && req.KeyID == "":
+			json.NewEncoder(w).Encode(Credentials{KeyID: "agent-1", Secret: "issued", ServerID: "srv-1"})
+		case req.Token == "rotate" && req.KeyID == "agent-1" &&
+			verifySignature("issued", req.Timestamp, []byte("enroll.rotate"), req.Signature) == nil:
+			json.NewEncoder(w).Encode(Credentials{KeyID: "agent-2", Secret: "renewed", ServerID: "srv-1"})
+		default:
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "state", "credentials.json")
+	config := Config{ServerURL: server.URL + "/api/ingest", Secret: "shared", EnrollToken: "one-time", CredentialsFile: file, Env: "prod"}
+
+	for i := 0; i < 2; i++ {
+		got, err := applyCredentials(server.Client(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.KeyID != "agent-1" || got.Secret != "issued" || got.ServerID != "srv-1" {
+			t.Errorf("Expected issued credentials, got key %q secret %q server ID %q", got.KeyID, got.Secret, got.ServerID)
+		}
+	}
+	if len(requests) != 1 || requests[0].Env != "prod" || requests[0].Host == "" {
+		t.Errorf("Expected one enrollment request with host and env, got %+v", requests)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected credentials saved with mode 0600, got %v %v", info, err)
+	}
+
+	// A new token re-enrolls, signed with the current key; a failed attempt
+	// keeps the agent on its current key
+	config.EnrollToken = "spent"
+	if got, err := applyCredentials(server.Client(), config); err != nil || got.KeyID != "agent-1" {
+		t.Errorf("Expected a failed re-enrollment to keep the current key, got %q: %v", got.KeyID, err)
+	}
+	config.EnrollToken = "rotate"
+	if got, err := applyCredentials(server.Client(), config); err != nil || got.KeyID != "agent-2" || got.ServerID != "srv-1" {
+		t.Errorf("Expected re-enrollment to keep the server ID with a new key, got %+v: %v", got, err)
+	}
+	if got, _ := applyCredentials(server.Client(), config); got.KeyID != "agent-2" || len(requests) != 3 {
+		t.Errorf("Expected the renewed credentials saved and the token used once, got %d requests", len(requests))
+	}
+
+	config.EnrollToken = "spent"
+	config.CredentialsFile = filepath.Join(t.TempDir(), "credentials.json")
+	if _, err := applyCredentials(server.Client(), config); err == nil {
+		t.Error("Expected a rejected token to fail")
+	}
+	if fileExists(config.CredentialsFile) {
+		t.Error("Expected no credentials saved after a failed enrollment")
+	}
+}
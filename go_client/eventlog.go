@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net"
+	"time"
+)
+
+// Windows event IDs handled by the agent
+const (
+	winEventFailedLogon      = 4625
+	winEventServiceInstalled = 7045
+)
+
+// winEvent is the subset of a rendered Windows event the agent uses
+type winEvent struct {
+	System struct {
+		EventID     int    `xml:"EventID"`
+		Channel     string `xml:"Channel"`
+		Computer    string `xml:"Computer"`
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		} `xml:"TimeCreated"`
+	} `xml:"System"`
+	Data []struct {
+		Name  string `xml:"Name,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"EventData>Data"`
+}
+
+// field returns a named EventData value
+func (e *winEvent) field(name string) string {
+	for _, d := range e.Data {
+		if d.Name == name {
+			return d.Value
+		}
+	}
+	return ""
+}
+
+// timestamp returns when the event was created, or now if unknown
+func (e *winEvent) timestamp() time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, e.System.TimeCreated.SystemTime); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// handleWindowsEventXML turns failed logons into auth failures and new
+// services into NEW_SERVICE alerts
+func (a *Agent) handleWindowsEventXML(data []byte) {
+	var event winEvent
+	if err := xml.Unmarshal(data, &event); err != nil {
+		log.Printf("Error parsing Windows event: %v", err)
+		return
+	}
+
+	switch event.System.EventID {
+	case winEventFailedLogon:
+		// Interactive and local failures carry "-" or no address
+		ip := event.field("IpAddress")
+		if net.ParseIP(ip) == nil {
+			ip = "local"
+		}
+		a.recordAuthFailure(ip, event.timestamp())
+
+	case winEventServiceInstalled:
+		service := event.field("ServiceName")
+		alert := "NEW_SERVICE:" + service
+		a.alertMutex.Lock()
+		if a.raiseAlert(alert) {
+			log.Printf("New service installed: %s (%s)", service, event.field("ImagePath"))
+		}
+		a.alertStates[alert].Detail = event.field("ImagePath")
+		a.alertMutex.Unlock()
+	}
+}
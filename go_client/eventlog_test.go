@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+const failedLogonXML = `<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+  <System>
+    <EventID>4625</EventID>
+    <TimeCreated SystemTime="2025-01-15T10:30:00.1234567Z"/>
+    <Channel>Security</Channel>
+  </System>
+  <EventData>
+    <Data Name="TargetUserName">Administrator</Data>
+    <Data Name="IpAddress">203.0.113.7</Data>
+  </EventData>
+</Event>`
+
+const serviceInstalledXML = `<Event xmlns="http://schemas.microsoft.com/win/2004/08/events/event">
+  <System>
+    <EventID>7045</EventID>
+    <Channel>System</Channel>
+  </System>
+  <EventData>
+    <Data Name="ServiceName">evilsvc</Data>
+    <Data Name="ImagePath">C:\Users\Public\evil.exe</Data>
+  </EventData>
+</Event>`
+
+// TestWindowsEventHandling tests failed logon and new service events
+func TestWindowsEventHandling(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.authFailures = agent.authFailures[:0]
+
+	agent.handleWindowsEventXML([]byte(failedLogonXML))
+	if len(agent.authFailures) != 1 || agent.authFailures[0].IP != "203.0.113.7" {
+		t.Errorf("Expected auth failure from 203.0.113.7, got %v", agent.authFailures)
+	}
+	if agent.authFailures[0].Timestamp.Year() != 2025 {
+		t.Errorf("Expected event timestamp to be used, got %v", agent.authFailures[0].Timestamp)
+	}
+
+	agent.handleWindowsEventXML([]byte(serviceInstalledXML))
+	if !agent.containsAlert("NEW_SERVICE:evilsvc") {
+		t.Fatalf("Expected NEW_SERVICE:evilsvc alert, got %v", agent.localAlerts)
+	}
+	if detail := agent.alertStates["NEW_SERVICE:evilsvc"].Detail; detail != `C:\Users\Public\evil.exe` {
+		t.Errorf("Expected image path in alert detail, got %q", detail)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modwevtapi       = windows.NewLazySystemDLL("wevtapi.dll")
+	procEvtSubscribe = modwevtapi.NewProc("EvtSubscribe")
+	procEvtNext      = modwevtapi.NewProc("EvtNext")
+	procEvtRender    = modwevtapi.NewProc("EvtRender")
+	procEvtClose     = modwevtapi.NewProc("EvtClose")
+)
+
+const (
+	evtSubscribeToFutureEvents = 1
+	evtRenderEventXML          = 1
+	eventLogBatchSize          = 16
+	eventLogPollMillis         = 1000
+)
+
+// eventLogSubscription is a pull-model EvtSubscribe subscription signalled
+// through a Win32 event object
+type eventLogSubscription struct {
+	channel string
+	handle  uintptr
+	signal  windows.Handle
+	closed  atomic.Bool
+	done    chan struct{}
+}
+
+// subscribeEventLog subscribes to future events on a channel matching an XPath query
+func subscribeEventLog(channel, query string) (*eventLogSubscription, error) {
+	if err := procEvtSubscribe.Find(); err != nil {
+		return nil, err
+	}
+
+	signal, err := windows.CreateEvent(nil, 1, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	channelPtr, err := windows.UTF16PtrFromString(channel)
+	if err != nil {
+		windows.CloseHandle(signal)
+		return nil, err
+	}
+	queryPtr, err := windows.UTF16PtrFromString(query)
+	if err != nil {
+		windows.CloseHandle(signal)
+		return nil, err
+	}
+
+	handle, _, callErr := procEvtSubscribe.Call(
+		0,
+		uintptr(signal),
+		uintptr(unsafe.Pointer(channelPtr)),
+		uintptr(unsafe.Pointer(queryPtr)),
+		0,
+		0,
+		0,
+		evtSubscribeToFutureEvents,
+	)
+	if handle == 0 {
+		windows.CloseHandle(signal)
+		return nil, fmt.Errorf("EvtSubscribe: %w", callErr)
+	}
+
+	return &eventLogSubscription{
+		channel: channel,
+		handle:  handle,
+		signal:  signal,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// run delivers the XML of each new event to handle until Close is called
+func (s *eventLogSubscription) run(handle func([]byte)) {
+	defer close(s.done)
+
+	events := make([]uintptr, eventLogBatchSize)
+	for !s.closed.Load() {
+		status, err := windows.WaitForSingleObject(s.signal, eventLogPollMillis)
+		if err != nil {
+			log.Printf("Event log %s wait failed: %v", s.channel, err)
+			return
+		}
+		if status != windows.WAIT_OBJECT_0 {
+			continue
+		}
+
+		for !s.closed.Load() {
+			var returned uint32
+			ok, _, callErr := procEvtNext.Call(
+				s.handle,
+				uintptr(len(events)),
+				uintptr(unsafe.Pointer(&events[0])),
+				0,
+				0,
+				uintptr(unsafe.Pointer(&returned)),
+			)
+			if ok == 0 {
+				if callErr != windows.ERROR_NO_MORE_ITEMS {
+					log.Printf("Event log %s read failed: %v", s.channel, callErr)
+				}
+				windows.ResetEvent(s.signal)
+				break
+			}
+
+			for _, event := range events[:returned] {
+				xml, err := renderEventXML(event)
+				procEvtClose.Call(event)
+				if err != nil {
+					log.Printf("Event log %s render failed: %v", s.channel, err)
+					continue
+				}
+				handle(xml)
+			}
+		}
+	}
+}
+
+// renderEventXML renders an event handle as XML
+func renderEventXML(event uintptr) ([]byte, error) {
+	buf := make([]uint16, 4096)
+	for {
+		var used, properties uint32
+		ok, _, callErr := procEvtRender.Call(
+			0,
+			event,
+			evtRenderEventXML,
+			uintptr(len(buf)*2),
+			uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(unsafe.Pointer(&used)),
+			uintptr(unsafe.Pointer(&properties)),
+		)
+		if ok != 0 {
+			return []byte(windows.UTF16ToString(buf[:used/2])), nil
+		}
+		if callErr != windows.ERROR_INSUFFICIENT_BUFFER {
+			return nil, callErr
+		}
+		buf = make([]uint16, used/2+1)
+	}
+}
+
+// Close stops the read loop and releases the subscription
+func (s *eventLogSubscription) Close() error {
+	s.closed.Store(true)
+	windows.SetEvent(s.signal)
+	<-s.done
+	procEvtClose.Call(s.handle)
+	return windows.CloseHandle(s.signal)
+}
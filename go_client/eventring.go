@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of internal events kept in memory
+const maxAgentEvents = 256
+
+// Internal event kinds
+const (
+	EventSendFailure       = "send_failure"
+	EventDetectorFired     = "detector_fired"
+	EventMonitorStarted    = "monitor_started"
+	EventMonitorStopped    = "monitor_stopped"
+	EventDockerError       = "docker_error"
+	EventQueueDropped      = "queue_dropped"
+	EventAuditFailure      = "audit_failure"
+	EventPayloadSummarized = "payload_summarized"
+	EventPayloadVetoed     = "payload_vetoed"
+)
+
+// AgentEvent is a significant agent-internal event
+type AgentEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	PayloadID string    `json:"payload_id,omitempty"`
+}
+
+// eventRing is a fixed-size ring buffer of agent events
+type eventRing struct {
+	mu     sync.Mutex
+	events []AgentEvent
+	next   int
+	full   bool
+}
+
+// newEventRing creates a ring holding at most size events
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]AgentEvent, size)}
+}
+
+// Add appends an event, overwriting the oldest one when full
+func (r *eventRing) Add(event AgentEvent) {
+	r.mu.Lock()
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// Snapshot returns buffered events oldest first
+func (r *eventRing) Snapshot() []AgentEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		out := make([]AgentEvent, r.next)
+		copy(out, r.events[:r.next])
+		return out
+	}
+	out := make([]AgentEvent, 0, len(r.events))
+	out = append(out, r.events[r.next:]...)
+	out = append(out, r.events[:r.next]...)
+	return out
+}
+
+// recordEvent adds an internal event to the agent's event ring
+func (a *Agent) recordEvent(kind, payloadID, format string, args ...interface{}) {
+	a.agentEvents.Add(AgentEvent{
+		Time:      time.Now(),
+		Kind:      kind,
+		Message:   fmt.Sprintf(format, args...),
+		PayloadID: payloadID,
+	})
+}
+
+// handleAdminEvents returns recent internal events, newest first.
+// Supports ?kind= to filter and ?limit= to cap the number of results.
+func (a *Agent) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	limit := maxAgentEvents
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	events := a.agentEvents.Snapshot()
+	result := make([]AgentEvent, 0, limit)
+	for i := len(events) - 1; i >= 0 && len(result) < limit; i-- {
+		if kind == "" || events[i].Kind == kind {
+			result = append(result, events[i])
+		}
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestEventRingWraparound tests that the ring keeps only the newest events in order
+func TestEventRingWraparound(t *testing.T) {
+	ring := newEventRing(3)
+	for i := 0; i < 5; i++ {
+		ring.Add(AgentEvent{Time: time.Now(), Kind: EventSendFailure, Message: fmt.Sprintf("event %d", i)})
+	}
+
+	events := ring.Snapshot()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	for i, want := range []string{"event 2", "event 3", "event 4"} {
+		if events[i].Message != want {
+			t.Errorf("Expected %q at position %d, got %q", want, i, events[i].Message)
+		}
+	}
+}
+
+// TestDetectorFiringRecorded tests that raising an alert records an internal event
+func TestDetectorFiringRecorded(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	agent.alertMutex.Lock()
+	agent.raiseAlert("SHELL_IN_CONTAINER")
+	agent.alertMutex.Unlock()
+
+	events := agent.agentEvents.Snapshot()
+	if len(events) == 0 || events[len(events)-1].Kind != EventDetectorFired {
+		t.Errorf("Expected detector_fired event, got %+v", events)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportedPayloads keeps the last payload built in exporter mode, the one
+// /metrics and /alerts describe
+type exportedPayloads struct {
+	mu      sync.RWMutex
+	payload Payload
+	ok      bool
+}
+
+// ExportedAlerts is the /alerts response in exporter mode
+type ExportedAlerts struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Score     float64         `json:"score"`
+	Alerts    []ExportedAlert `json:"alerts"`
+}
+
+// ExportedAlert is a local alert of the last payload
+type ExportedAlert struct {
+	Alert          string   `json:"alert"`
+	Severity       string   `json:"severity"`
+	Detail         string   `json:"detail,omitempty"`
+	CorrelationIDs []string `json:"correlation_ids,omitempty"`
+}
+
+// exportPayload keeps a payload for /metrics and /alerts instead of sending
+// it anywhere. Its buffers and alerts count as delivered.
+func (a *Agent) exportPayload(payload Payload) error {
+	a.exported.mu.Lock()
+	a.exported.payload = payload
+	a.exported.ok = true
+	a.exported.mu.Unlock()
+
+	a.lastSendOK = time.Now()
+	a.payloadDelivered(payload)
+	return nil
+}
+
+// lastExport returns the last payload built in exporter mode, if any
+func (a *Agent) lastExport() (Payload, bool) {
+	a.exported.mu.RLock()
+	defer a.exported.mu.RUnlock()
+	return a.exported.payload, a.exported.ok
+}
+
+// handleExportedAlerts serves the local alerts of the last payload
+func (a *Agent) handleExportedAlerts(w http.ResponseWriter, r *http.Request) {
+	payload, _ := a.lastExport()
+	response := ExportedAlerts{
+		Timestamp: payload.Timestamp,
+		Score:     payload.Score,
+		Alerts:    make([]ExportedAlert, 0, len(payload.LocalAlerts)),
+	}
+	for _, alert := range payload.LocalAlerts {
+		response.Alerts = append(response.Alerts, ExportedAlert{
+			Alert:          alert,
+			Severity:       alertSeverity(alert),
+			Detail:         payload.AlertDetails[alert],
+			CorrelationIDs: payload.AlertCorrelationIDs[alert],
+		})
+	}
+	writeJSON(w, response)
+}
+
+// handlePrometheusMetrics serves the last payload in the Prometheus text
+// exposition format
+func (a *Agent) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	payload, ok := a.lastExport()
+	writePrometheus(w, payload, ok, a.agentStats(false), time.Since(a.startTime))
+}
+
+// promWriter collects samples by metric family, since the exposition format
+// wants each family's samples together under one HELP and TYPE
+type promWriter struct {
+	families []string
+	help     map[string]string
+	samples  map[string][]string
+}
+
+// promEscaper escapes label values
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (p *promWriter) sample(name, kind, help string, value float64, labels ...string) {
+	if _, ok := p.help[name]; !ok {
+		p.families = append(p.families, name)
+		p.help[name] = fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	var rendered string
+	if len(labels) > 0 {
+		parts := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			parts = append(parts, labels[i]+`="`+promEscaper.Replace(labels[i+1])+`"`)
+		}
+		rendered = "{" + strings.Join(parts, ",") + "}"
+	}
+	p.samples[name] = append(p.samples[name], name+rendered+" "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+}
+
+func (p *promWriter) writeTo(w io.Writer) {
+	for _, name := range p.families {
+		io.WriteString(w, p.help[name])
+		for _, line := range p.samples[name] {
+			io.WriteString(w, line)
+		}
+	}
+}
+
+// writePrometheus writes a payload's metrics and alerts. Without a payload
+// yet only the agent's own metrics are written.
+func writePrometheus(w io.Writer, payload Payload, ok bool, stats AgentStats, uptime time.Duration) {
+	p := &promWriter{help: make(map[string]string), samples: make(map[string][]string)}
+	defer p.writeTo(w)
+
+	p.sample("richardops_agent_uptime_seconds", "gauge", "Seconds since the agent started", uptime.Seconds())
+	p.sample("richardops_agent_goroutines", "gauge", "Goroutines running in the agent", float64(stats.Goroutines))
+	p.sample("richardops_agent_heap_bytes", "gauge", "Heap memory in use by the agent", float64(stats.HeapBytes))
+	if !ok {
+		return
+	}
+
+	m := payload.Metrics
+	p.sample("richardops_last_collection_timestamp_seconds", "gauge", "Unix time of the last collection", float64(payload.Timestamp.Unix()))
+	p.sample("richardops_cpu_usage_percent", "gauge", "CPU usage", m.CPUUsage)
+	p.sample("richardops_memory_usage_percent", "gauge", "Memory usage", m.MemoryUsage)
+	p.sample("richardops_disk_usage_percent", "gauge", "Root filesystem usage", m.DiskUsage)
+	p.sample("richardops_network_receive_bytes_per_second", "gauge", "Network bytes received per second", float64(m.NetworkRX))
+	p.sample("richardops_network_transmit_bytes_per_second", "gauge", "Network bytes sent per second", float64(m.NetworkTX))
+	p.sample("richardops_tcp_connections", "gauge", "Open TCP connections", float64(m.TCPConns))
+
+	for _, h := range m.HTTP {
+		p.sample("richardops_http_requests", "gauge", "Requests in access logs since the previous collection", float64(h.Requests), "source", h.Source)
+		p.sample("richardops_http_requests_per_second", "gauge", "Request rate in access logs", h.RequestsPerSec, "source", h.Source)
+		classes := make([]string, 0, len(h.StatusClasses))
+		for class := range h.StatusClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			p.sample("richardops_http_responses", "gauge", "Responses by status class since the previous collection", float64(h.StatusClasses[class]), "source", h.Source, "class", class)
+		}
+		for _, q := range []struct {
+			quantile string
+			value    float64
+		}{{"0.5", h.LatencyP50Ms}, {"0.95", h.LatencyP95Ms}, {"0.99", h.LatencyP99Ms}} {
+			if q.value > 0 {
+				p.sample("richardops_http_latency_milliseconds", "gauge", "Request latency percentiles", q.value, "source", h.Source, "quantile", q.quantile)
+			}
+		}
+	}
+	for _, u := range m.Upstreams {
+		labels := []string{"source", u.Source, "proxy", u.Proxy, "backend", u.Backend}
+		p.sample("richardops_upstream_requests", "gauge", "Proxied requests since the previous collection", float64(u.Requests), labels...)
+		p.sample("richardops_upstream_errors_5xx", "gauge", "Proxied 5xx responses since the previous collection", float64(u.Errors5xx), labels...)
+		p.sample("richardops_upstream_retries", "gauge", "Proxy retries since the previous collection", float64(u.Retries), labels...)
+		p.sample("richardops_upstream_timeouts", "gauge", "Proxy timeouts since the previous collection", float64(u.Timeouts), labels...)
+	}
+	for _, s := range m.SlowQueries {
+		labels := []string{"source", s.Source, "engine", s.Engine}
+		p.sample("richardops_slow_queries", "gauge", "Slow queries since the previous collection", float64(s.Count), labels...)
+		p.sample("richardops_slow_query_max_milliseconds", "gauge", "Slowest query since the previous collection", s.MaxMs, labels...)
+	}
+	for _, l := range m.LogMetrics {
+		labels := []string{"name", l.Name, "source", l.Source}
+		if l.Group != "" {
+			labels = append(labels, "group", l.Group)
+		}
+		p.sample("richardops_log_metric", "gauge", "Values of --parse-rules-file metrics", l.Value, labels...)
+	}
+	for _, probe := range m.Probes {
+		labels := []string{"name", probe.Name, "type", probe.Type, "target", probe.Target}
+		up := 0.0
+		if probe.Up {
+			up = 1
+		}
+		p.sample("richardops_probe_up", "gauge", "Whether the last probe check succeeded", up, labels...)
+		p.sample("richardops_probe_latency_milliseconds", "gauge", "Average latency of successful probe checks", probe.LatencyMs, labels...)
+		p.sample("richardops_probe_uptime_ratio", "gauge", "Ratio of successful probe checks", probe.Uptime1h, append(labels, "window", "1h")...)
+		p.sample("richardops_probe_uptime_ratio", "gauge", "Ratio of successful probe checks", probe.Uptime24h, append(labels, "window", "24h")...)
+	}
+
+	for _, d := range m.SNMP {
+		up := 0.0
+		if d.Up {
+			up = 1
+		}
+		p.sample("richardops_snmp_up", "gauge", "Whether the last SNMP poll of a device answered", up, "device", d.Name)
+		for _, iface := range d.Interfaces {
+			labels := []string{"device", d.Name, "interface", iface.Name}
+			up := 0.0
+			if iface.Up {
+				up = 1
+			}
+			p.sample("richardops_snmp_interface_up", "gauge", "Operational status of administratively up interfaces", up, labels...)
+			p.sample("richardops_snmp_interface_receive_bytes_per_second", "gauge", "Interface bytes received per second", iface.InBytesPerSec, labels...)
+			p.sample("richardops_snmp_interface_transmit_bytes_per_second", "gauge", "Interface bytes sent per second", iface.OutBytesPerSec, labels...)
+		}
+		if d.UPS != nil {
+			p.sample("richardops_ups_charge_percent", "gauge", "UPS battery charge", d.UPS.ChargePercent, "device", d.Name)
+			p.sample("richardops_ups_minutes_remaining", "gauge", "UPS estimated runtime on battery", d.UPS.MinutesRemaining, "device", d.Name)
+		}
+	}
+
+	p.sample("richardops_score", "gauge", "Weighted score of the local alerts", payload.Score)
+	for _, alert := range payload.LocalAlerts {
+		alertType, subject, _ := strings.Cut(alert, ":")
+		p.sample("richardops_alert", "gauge", "Local alerts raised in the last collection", 1,
+			"type", alertType, "subject", subject, "severity", alertSeverity(alert))
+	}
+}
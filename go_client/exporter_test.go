@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestExporterConfig tests that exporter mode needs neither a server URL nor
+// a secret, only the health server
+func TestExporterConfig(t *testing.T) {
+	if err := validateConfig(Config{Exporter: true, HealthAddr: "localhost:8081"}); err != nil {
+		t.Errorf("Expected exporter mode without server URL or secret to be valid, got %v", err)
+	}
+	if err := validateConfig(Config{Exporter: true}); err == nil {
+		t.Error("Expected exporter mode without a health address to fail")
+	}
+	if err := validateConfig(Config{ServerURL: "http://localhost:8000/ingest"}); err == nil {
+		t.Error("Expected push mode without a secret to fail")
+	}
+}
+
+// TestExporterEndpoints tests that exported payloads are served on /metrics
+// and /alerts instead of being sent
+func TestExporterEndpoints(t *testing.T) {
+	agent, err := NewAgent(Config{Exporter: true, ServerURL: "http://127.0.0.1:1/ingest"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "api", Message: "hello"})
+	agent.raiseAlert("CPU_SPIKE")
+	agent.raiseAlert(`PROBE_FAILED:shop "eu"`)
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.Metrics.Probes = []ProbeMetrics{{Name: "shop", Type: "http", Target: "https://shop", Up: true, Uptime1h: 1, Uptime24h: 0.5}}
+	if err := agent.sendPayload(payload); err != nil {
+		t.Fatalf("Expected the payload to be exported, got %v", err)
+	}
+	if len(agent.logBuffer) != 0 || len(agent.payloadQueue) != 0 {
+		t.Errorf("Expected buffers cleared and nothing queued, got %d logs, %d queued", len(agent.logBuffer), len(agent.payloadQueue))
+	}
+
+	recorder := httptest.NewRecorder()
+	agent.handlePrometheusMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"# TYPE richardops_cpu_usage_percent gauge\n",
+		`richardops_probe_uptime_ratio{name="shop",type="http",target="https://shop",window="24h"} 0.5`,
+		`richardops_alert{type="CPU_SPIKE",subject="",severity="warning"} 1`,
+		`richardops_alert{type="PROBE_FAILED",subject="shop \"eu\"",severity="warning"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected /metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Count(body, "# HELP richardops_alert ") != 1 {
+		t.Errorf("Expected one HELP line per metric family, got:\n%s", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	agent.handleExportedAlerts(recorder, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	var alerts ExportedAlerts
+	if err := json.NewDecoder(recorder.Body).Decode(&alerts); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts.Alerts) != 2 || alerts.Alerts[0].Alert != "CPU_SPIKE" || alerts.Score != payload.Score {
+		t.Errorf("Unexpected alerts %+v", alerts)
+	}
+}
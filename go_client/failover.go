@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of choosing among several --server-url endpoints
+const (
+	FailoverOrder      = "order"
+	FailoverRoundRobin = "round-robin"
+)
+
+// serverURLs splits a comma-separated --server-url into its endpoints
+func serverURLs(serverURL string) []string {
+	var urls []string
+	for _, u := range strings.Split(serverURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// validateServerURLs checks every --server-url endpoint and --server-failover
+func validateServerURLs(config Config) error {
+	for _, serverURL := range serverURLs(config.ServerURL) {
+		u, err := url.Parse(serverURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid server URL %q (expected http:// or https://)", serverURL)
+		}
+	}
+	switch config.ServerFailover {
+	case "", FailoverOrder, FailoverRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("invalid server failover %q (order or round-robin)", config.ServerFailover)
+}
+
+// serverEndpoints picks the --server-url endpoint each payload is sent to.
+// In order mode sends stick to the last endpoint that accepted a payload and
+// move on down the list when it fails; in round-robin mode each send starts
+// at the endpoint after the previous one.
+type serverEndpoints struct {
+	mu         sync.Mutex
+	urls       []string
+	roundRobin bool
+	healthy    int // index of the last endpoint that accepted a payload
+	next       int // where the next round-robin send starts
+}
+
+func newServerEndpoints(serverURL, failover string) *serverEndpoints {
+	return &serverEndpoints{urls: serverURLs(serverURL), roundRobin: failover == FailoverRoundRobin}
+}
+
+// attemptOrder returns the endpoints to try for one send, in order
+func (e *serverEndpoints) attemptOrder() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.urls) == 0 {
+		return nil
+	}
+
+	start := e.healthy
+	if e.roundRobin {
+		start = e.next
+		e.next = (e.next + 1) % len(e.urls)
+	}
+	order := make([]string, 0, len(e.urls))
+	for i := range e.urls {
+		order = append(order, e.urls[(start+i)%len(e.urls)])
+	}
+	return order
+}
+
+// succeeded remembers the endpoint that accepted a payload. It reports
+// whether that is a failover from the previous healthy endpoint.
+func (e *serverEndpoints) succeeded(serverURL string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, u := range e.urls {
+		if u == serverURL {
+			changed := i != e.healthy
+			e.healthy = i
+			return changed && !e.roundRobin
+		}
+	}
+	return false
+}
+
+// current returns the last endpoint that accepted a payload, or the first
+// before any did
+func (e *serverEndpoints) current() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.urls) == 0 {
+		return ""
+	}
+	return e.urls[e.healthy]
+}
+
+// endpoints returns the agent's server endpoints. Agents built without
+// NewAgent (replay, tests) try --server-url in order on every send.
+func (a *Agent) endpoints() *serverEndpoints {
+	if a.servers != nil {
+		return a.servers
+	}
+	return newServerEndpoints(a.config.ServerURL, a.config.ServerFailover)
+}
+
+// postToServers POSTs an encoded payload to each endpoint in turn until one
+// acknowledges it
+func (a *Agent) postToServers(payloadBytes []byte, id string, signedAt time.Time) error {
+	return a.tryServers(func(serverURL string) error {
+		return a.postPayloadTo(serverURL, payloadBytes, id, signedAt)
+	})
+}
+
+// tryServers calls post with each endpoint in turn until one succeeds
+func (a *Agent) tryServers(post func(serverURL string) error) error {
+	endpoints := a.endpoints()
+	var errs []error
+	for _, serverURL := range endpoints.attemptOrder() {
+		err := post(serverURL)
+		if err == nil {
+			if endpoints.succeeded(serverURL) {
+				log.Printf("Failed over to server %s", serverURL)
+				a.selfMetrics.ServerFailovers.Add(1)
+			}
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", serverURL, err))
+	}
+	if len(errs) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	return errors.Join(errs...)
+}
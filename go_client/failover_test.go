@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestServerEndpointsOrder tests the endpoints tried in order and
+// round-robin modes
+func TestServerEndpointsOrder(t *testing.T) {
+	ordered := newServerEndpoints("http://a/ingest, http://b/ingest,http://c/ingest", FailoverOrder)
+	if got := strings.Join(ordered.attemptOrder(), " "); got != "http://a/ingest http://b/ingest http://c/ingest" {
+		t.Errorf("Unexpected order %s", got)
+	}
+	if !ordered.succeeded("http://b/ingest") || ordered.succeeded("http://b/ingest") {
+		t.Error("Expected only the first success on b to be a failover")
+	}
+	if got := strings.Join(ordered.attemptOrder(), " "); got != "http://b/ingest http://c/ingest http://a/ingest" {
+		t.Errorf("Expected sends to start at the last healthy endpoint, got %s", got)
+	}
+
+	roundRobin := newServerEndpoints("http://a/ingest,http://b/ingest", FailoverRoundRobin)
+	first, second := roundRobin.attemptOrder(), roundRobin.attemptOrder()
+	if first[0] != "http://a/ingest" || second[0] != "http://b/ingest" || roundRobin.attemptOrder()[0] != "http://a/ingest" {
+		t.Errorf("Expected sends to alternate, got %v then %v", first, second)
+	}
+	if roundRobin.succeeded("http://b/ingest") {
+		t.Error("Expected round-robin not to count failovers")
+	}
+}
+
+// TestServerFailover tests that a payload goes to the next endpoint when one
+// fails, and that the healthy endpoint is remembered
+func TestServerFailover(t *testing.T) {
+	var downHits, upHits atomic.Int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	agent, err := NewAgent(Config{ServerURL: down.URL + "," + up.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := agent.sendOnce([]byte(`{}`), newUUID(), time.Now()); err != nil {
+			t.Fatalf("Expected delivery through the healthy endpoint, got %v", err)
+		}
+	}
+	if downHits.Load() != 1 || upHits.Load() != 2 {
+		t.Errorf("Expected the failed endpoint to be tried once, got %d and %d requests", downHits.Load(), upHits.Load())
+	}
+	stats := agent.agentStats(false)
+	if stats.Send.Failovers != 1 || stats.Send.Server != up.URL {
+		t.Errorf("Expected one failover to %s, got %+v", up.URL, stats.Send)
+	}
+
+	up.Close()
+	err = agent.sendOnce([]byte(`{}`), newUUID(), time.Now())
+	if err == nil || !strings.Contains(err.Error(), down.URL) || !strings.Contains(err.Error(), up.URL) {
+		t.Errorf("Expected both endpoints in the error, got %v", err)
+	}
+}
+
+// TestValidateServerURLs tests rejected endpoint lists
+func TestValidateServerURLs(t *testing.T) {
+	for _, config := range []Config{
+		{ServerURL: "https://a.example.com/ingest,b.example.com/ingest"},
+		{ServerURL: "ftp://a.example.com/ingest"},
+		{ServerURL: "https://a.example.com/ingest", ServerFailover: "random"},
+	} {
+		if err := validateServerURLs(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	if err := validateServerURLs(Config{ServerURL: "https://a.example.com/ingest, https://b.example.com/ingest", ServerFailover: FailoverRoundRobin}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"fmt"
+)
+
+// fipsBuild is set when the agent is compiled with the fips build tag
+var fipsBuild = false
+
+// Minimum HMAC key length accepted by the FIPS 140-3 module (112 bits)
+const fipsMinKeyBytes = 14
+
+// fipsTLSCipherSuites are the FIPS-approved TLS 1.2 cipher suites
+var fipsTLSCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// checkFIPSMode verifies that FIPS mode is actually in effect and that
+// configured keys satisfy FIPS requirements
+func checkFIPSMode(config Config) error {
+	if !config.FIPS {
+		return nil
+	}
+	if !fips140.Enabled() {
+		return fmt.Errorf("FIPS mode requested but the Go FIPS 140-3 module is not enabled " +
+			"(build with GOFIPS140=v1.0.0 -tags fips, or run with GODEBUG=fips140=on)")
+	}
+	keys := map[string]string{"secret": config.Secret, "mask hash key": config.MaskHashKey}
+	for name, key := range keys {
+		if key != "" && len(key) < fipsMinKeyBytes {
+			return fmt.Errorf("FIPS mode requires the %s to be at least %d bytes", name, fipsMinKeyBytes)
+		}
+	}
+	return nil
+}
+
+// applyFIPSTLS restricts a TLS config to FIPS-approved versions, suites and curves
+func applyFIPSTLS(tlsConfig *tls.Config) {
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.CipherSuites = fipsTLSCipherSuites
+	tlsConfig.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+}
@@ -0,0 +1,9 @@
+//go:build fips
+
+//go:debug fips140=on
+
+package main
+
+func init() {
+	fipsBuild = true
+}
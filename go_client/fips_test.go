@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+// TestFIPSModeCheck tests startup validation of FIPS mode
+func TestFIPSModeCheck(t *testing.T) {
+	if err := checkFIPSMode(Config{Secret: "short"}); err != nil {
+		t.Errorf("Expected no error with FIPS disabled, got %v", err)
+	}
+
+	err := checkFIPSMode(Config{FIPS: true, Secret: "short"})
+	if !fips140.Enabled() {
+		if err == nil || !strings.Contains(err.Error(), "GOFIPS140") {
+			t.Errorf("Expected error explaining how to enable FIPS, got %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected short secret to be rejected, got %v", err)
+	}
+	if err := checkFIPSMode(Config{FIPS: true, Secret: "a-sufficiently-long-secret"}); err != nil {
+		t.Errorf("Expected long secret to be accepted, got %v", err)
+	}
+}
+
+// TestFIPSTLSConfig tests that FIPS mode restricts TLS parameters
+func TestFIPSTLSConfig(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	applyFIPSTLS(tlsConfig)
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 minimum, got %x", tlsConfig.MinVersion)
+	}
+	for _, suite := range tlsConfig.CipherSuites {
+		if !strings.Contains(tls.CipherSuiteName(suite), "GCM") {
+			t.Errorf("Unexpected non-GCM suite %s", tls.CipherSuiteName(suite))
+		}
+	}
+}
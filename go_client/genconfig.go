@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Agent flags that have no environment variable and so can only be set on
+// the command line (ExecStart in the systemd unit)
+var flagOnlyOptions = map[string]bool{}
+
+// Environment variables not named after their flag
+var flagEnvNames = map[string]string{"config": "CONFIG_FILE"}
+
+// envPrefix namespaces every environment variable the agent reads, for
+// containers where generic names like SECRET or INTERVAL are taken
+const envPrefix = "RICHARDOPS_"
+
+// lookupEnv reads an environment variable, preferring its RICHARDOPS_ name
+// over the bare one when both are set
+func lookupEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(envPrefix + name); ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// getenv reads an environment variable where empty means unset, preferring a
+// non-empty RICHARDOPS_ name over the bare one
+func getenv(name string) string {
+	if value := os.Getenv(envPrefix + name); value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// envName returns the environment variable that overrides an agent flag
+func envName(flagName string) string {
+	if name, ok := flagEnvNames[flagName]; ok {
+		return name
+	}
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// envValue quotes a value when an EnvironmentFile or shell would otherwise split it
+func envValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"'#$\\`") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
+
+// writeConfigTemplate renders every agent option as a commented environment
+// file. Options whose value differs from the default (set by flag or already
+// present in the environment) are written uncommented.
+// With prefix, variables are written under their RICHARDOPS_ names.
+func writeConfigTemplate(w io.Writer, fs *flag.FlagSet, skip map[string]bool, prefix bool) {
+	fmt.Fprintf(w, "# monitoring-agent configuration, generated %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "#\n")
+	fmt.Fprintf(w, "# Load as a systemd EnvironmentFile (%s) or with\n", systemdEnvFile)
+	fmt.Fprintf(w, "# `set -a; . ./agent.env; set +a`. Commented lines show the default;\n")
+	fmt.Fprintf(w, "# uncomment and edit to change. Empty values leave the default in place.\n")
+
+	var flagOnly []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		if skip[f.Name] {
+			return
+		}
+		if flagOnlyOptions[f.Name] {
+			flagOnly = append(flagOnly, f)
+			return
+		}
+
+		fmt.Fprintf(w, "\n# --%s: %s\n", f.Name, f.Usage)
+		if isSecretFlag(f.Name) {
+			fmt.Fprintf(w, "# Secret: keep this file mode 0600.\n")
+		}
+		name := envName(f.Name)
+		if prefix {
+			name = envPrefix + name
+		}
+		value := f.Value.String()
+		if value != f.DefValue {
+			fmt.Fprintf(w, "%s=%s\n", name, envValue(value))
+		} else {
+			fmt.Fprintf(w, "#%s=%s\n", name, envValue(f.DefValue))
+		}
+	})
+
+	if len(flagOnly) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n# Command line only (add to ExecStart):\n")
+	for _, f := range flagOnly {
+		fmt.Fprintf(w, "#   --%s=%s  %s\n", f.Name, f.Value.String(), f.Usage)
+	}
+}
+
+// Flags consumed by generate-config itself
+var generateConfigOnlyFlags = map[string]bool{"output": true, "prefixed": true}
+
+func cmdGenerateConfig(args []string) error {
+	fs := newFlagSet("generate-config", "generate-config [--output PATH] [--prefixed] [flags]")
+	output := fs.String("output", "", "File to write (default stdout); created with mode 0600")
+	prefixed := fs.Bool("prefixed", false, "Write RICHARDOPS_-prefixed variable names")
+	if _, err := parseConfig(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		writeConfigTemplate(os.Stdout, fs, generateConfigOnlyFlags, *prefixed)
+		return nil
+	}
+
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writeConfigTemplate(file, fs, generateConfigOnlyFlags, *prefixed)
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", *output)
+	return nil
+}
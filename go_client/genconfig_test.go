@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestGenerateConfigEnvNames tests that every option in the template really is
+// read from the environment variable it is written as, with and without the
+// RICHARDOPS_ prefix
+func TestGenerateConfigEnvNames(t *testing.T) {
+	for _, prefix := range []string{"", envPrefix} {
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			testEnvOverrides(t, prefix)
+		})
+	}
+}
+
+func testEnvOverrides(t *testing.T, prefix string) {
+	probe := flag.NewFlagSet("probe", flag.ContinueOnError)
+	if _, err := parseConfig(probe, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	probe.VisitAll(func(f *flag.Flag) {
+		if flagOnlyOptions[f.Name] {
+			return
+		}
+		value := "custom"
+		switch def := f.Value.(flag.Getter).Get().(type) {
+		case bool:
+			value = strconv.FormatBool(!def)
+		case int, float64:
+			value = "7"
+		}
+		if f.Name == "profile" {
+			value = "dev"
+		}
+		if f.Name == "config" {
+			value = filepath.Join(t.TempDir(), "agent.yaml")
+			if err := os.WriteFile(value, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Setenv(prefix+envName(f.Name), value)
+	})
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := parseConfig(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !flagOnlyOptions[f.Name] && f.Value.String() == f.DefValue {
+			t.Errorf("--%s is not overridden by %s; add the env override or list it in flagOnlyOptions", f.Name, prefix+envName(f.Name))
+		}
+	})
+}
+
+// TestPrefixedEnvPrecedence tests that a RICHARDOPS_ variable wins over the
+// bare name, and that an empty one still disables the health server
+func TestPrefixedEnvPrecedence(t *testing.T) {
+	t.Setenv("INTERVAL", "30")
+	t.Setenv("RICHARDOPS_INTERVAL", "15")
+	t.Setenv("SECRET", "other-software")
+	t.Setenv("RICHARDOPS_SECRET", "")
+	t.Setenv("HEALTH_ADDR", "localhost:9000")
+	t.Setenv("RICHARDOPS_HEALTH_ADDR", "")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := parseConfig(fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != 15 || config.Secret != "other-software" || config.HealthAddr != "" {
+		t.Errorf("Expected the prefixed interval, the bare secret and no health server, got %d %q %q",
+			config.Interval, config.Secret, config.HealthAddr)
+	}
+}
+
+// TestGenerateConfigSeeded tests that set options are written uncommented
+func TestGenerateConfigSeeded(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := parseConfig(fs, []string{"--env", "prod", "--owner-team", "payments team", "--health-addr", "unix:/run/agent.sock"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	writeConfigTemplate(&out, fs, nil, false)
+	text := out.String()
+
+	for _, want := range []string{
+		"\nENV=prod\n",
+		"\nOWNER_TEAM=\"payments team\"\n",
+		"\n#INTERVAL=10\n",
+		"\n#SECRET=\"\"\n",
+		"\nHEALTH_ADDR=unix:/run/agent.sock\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in generated config:\n%s", want, text)
+		}
+	}
+
+	out.Reset()
+	writeConfigTemplate(&out, fs, nil, true)
+	if !strings.Contains(out.String(), "\nRICHARDOPS_ENV=prod\n") || !strings.Contains(out.String(), "\n#RICHARDOPS_INTERVAL=10\n") {
+		t.Errorf("Expected prefixed names in generated config:\n%s", out.String())
+	}
+}
@@ -3,9 +3,19 @@ module monitoring-agent
 go 1.24.0
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/docker/docker v25.0.0+incompatible
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gosnmp/gosnmp v1.38.0
+	github.com/klauspost/compress v1.17.11
 	github.com/shirou/gopsutil/v3 v3.23.10
+	github.com/tetratelabs/wazero v1.9.0
+	github.com/yuin/gopher-lua v1.1.2
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
+	google.golang.org/grpc v1.75.0
+	google.golang.org/protobuf v1.36.8
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -36,7 +46,8 @@ require (
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.38.0 // indirect
 	go.opentelemetry.io/otel/metric v1.38.0 // indirect
 	go.opentelemetry.io/otel/trace v1.38.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 	golang.org/x/time v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250825161204-c5933d9347a5 // indirect
 	gotest.tools/v3 v3.5.2 // indirect
 )
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestHealthServerUnixSocket tests serving health endpoints on a Unix socket
+func TestHealthServerUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := NewAgent(Config{HealthAddr: "unix:" + socketPath})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.healthServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://agent/healthz")
+	if err != nil {
+		t.Fatalf("Failed to query health endpoint over unix socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+}
+
+// TestHealthServerBindConflict tests that a port conflict fails agent startup
+func TestHealthServerBindConflict(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	defer occupied.Close()
+
+	if _, err := NewAgent(Config{HealthAddr: occupied.Addr().String()}); err == nil {
+		t.Error("Expected NewAgent to fail when the health address is in use")
+	}
+}
+
+// TestHealthAddrShorthands tests disabling the health server with "off" and
+// giving only a port
+func TestHealthAddrShorthands(t *testing.T) {
+	for addr, want := range map[string]string{
+		"off":                  "",
+		"OFF":                  "",
+		"9090":                 "localhost:9090",
+		":9090":                ":9090",
+		"0.0.0.0:8081":         "0.0.0.0:8081",
+		"unix:/run/agent.sock": "unix:/run/agent.sock",
+	} {
+		if got := normalizeHealthAddr(addr); got != want {
+			t.Errorf("--health-addr %q: expected %q, got %q", addr, want, got)
+		}
+	}
+
+	t.Setenv("HEALTH_ADDR", "off")
+	config, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil || config.HealthAddr != "" {
+		t.Errorf("Expected HEALTH_ADDR=off to disable the health server, got %v %q", err, config.HealthAddr)
+	}
+}
+
+// TestHealthSecurityValidation tests that non-loopback binds require TLS and authentication
+func TestHealthSecurityValidation(t *testing.T) {
+	testCases := []struct {
+		config  Config
+		wantErr bool
+	}{
+		{Config{HealthAddr: "localhost:8081"}, false},
+		{Config{HealthAddr: "127.0.0.1:8081"}, false},
+		{Config{HealthAddr: "unix:/run/agent.sock"}, false},
+		{Config{HealthAddr: "0.0.0.0:8081"}, true},
+		{Config{HealthAddr: ":8081", HealthToken: "t"}, true},
+		{Config{HealthAddr: ":8081", HealthTLSCert: "c", HealthTLSKey: "k"}, true},
+		{Config{HealthAddr: ":8081", HealthTLSCert: "c", HealthTLSKey: "k", HealthToken: "t"}, false},
+		{Config{HealthAddr: "10.0.0.5:8081", HealthTLSCert: "c", HealthTLSKey: "k", HealthClientCA: "ca"}, false},
+		{Config{HealthAddr: "localhost:8081", HealthTLSCert: "c"}, true},
+	}
+
+	for _, tc := range testCases {
+		agent := &Agent{config: tc.config}
+		err := agent.validateHealthSecurity()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Config %+v: expected error=%v, got %v", tc.config, tc.wantErr, err)
+		}
+	}
+}
+
+// TestHealthTokenAuth tests bearer token enforcement on health endpoints
+func TestHealthTokenAuth(t *testing.T) {
+	agent := &Agent{config: Config{HealthToken: "health", AdminToken: "admin"}}
+	handler := agent.requireHealthAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for token, want := range map[string]int{"": 401, "wrong": 401, "health": 200, "admin": 200} {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != want {
+			t.Errorf("Token %q: expected %d, got %d", token, want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// isLoopbackAddr reports whether a health address only accepts local connections.
+// Unix sockets count as local; an empty or unspecified host does not.
+func isLoopbackAddr(addr string) bool {
+	if strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateHealthSecurity enforces TLS and authentication for non-loopback health addresses
+func (a *Agent) validateHealthSecurity() error {
+	cfg := a.config
+	if (cfg.HealthTLSCert == "") != (cfg.HealthTLSKey == "") {
+		return fmt.Errorf("--health-tls-cert and --health-tls-key must be set together")
+	}
+	if cfg.HealthClientCA != "" && cfg.HealthTLSCert == "" {
+		return fmt.Errorf("--health-client-ca requires --health-tls-cert and --health-tls-key")
+	}
+	if isLoopbackAddr(cfg.HealthAddr) {
+		return nil
+	}
+	if cfg.HealthTLSCert == "" {
+		return fmt.Errorf("health address %s is not loopback: TLS is required (--health-tls-cert/--health-tls-key)", cfg.HealthAddr)
+	}
+	if cfg.HealthToken == "" && cfg.HealthClientCA == "" {
+		return fmt.Errorf("health address %s is not loopback: authentication is required (--health-token or --health-client-ca)", cfg.HealthAddr)
+	}
+	return nil
+}
+
+// healthTLSConfig builds the server TLS config, requiring client certificates when a CA is set
+func (a *Agent) healthTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(a.config.HealthTLSCert, a.config.HealthTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load health TLS key pair: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if a.config.HealthClientCA != "" {
+		caPEM, err := os.ReadFile(a.config.HealthClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read health client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", a.config.HealthClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if a.config.FIPS {
+		applyFIPSTLS(tlsConfig)
+	}
+
+	return tlsConfig, nil
+}
+
+// requireHealthAuth protects health endpoints with the health token when one is configured.
+// The admin token is accepted as well. Client certificates are verified at the TLS layer.
+func (a *Agent) requireHealthAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.config.HealthToken != "" {
+			token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			healthOK := subtle.ConstantTimeCompare(token, []byte(a.config.HealthToken)) == 1
+			adminOK := a.config.AdminToken != "" && subtle.ConstantTimeCompare(token, []byte(a.config.AdminToken)) == 1
+			if !healthOK && !adminOK {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="health"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
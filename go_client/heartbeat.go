@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Heartbeat is the small signed message sent between payloads so the server
+// notices a dead host within a few heartbeat intervals
+type Heartbeat struct {
+	AgentVersion string    `json:"agent_version"`
+	Host         string    `json:"host"`
+	ServerID     string    `json:"server_id,omitempty"`
+	MachineID    string    `json:"machine_id,omitempty"`
+	Env          string    `json:"env,omitempty"`
+	OwnerTeam    string    `json:"owner_team,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+	Score        float64   `json:"score"`
+	Interval     int       `json:"interval"` // seconds until the next heartbeat
+}
+
+// heartbeatURL returns --heartbeat-url, or the /heartbeat endpoint next to
+// the ingest path of --server-url (its first endpoint, if it lists several)
+func heartbeatURL(config Config) (string, error) {
+	if config.HeartbeatURL != "" {
+		return config.HeartbeatURL, nil
+	}
+	var serverURL string
+	if urls := serverURLs(config.ServerURL); len(urls) > 0 {
+		serverURL = urls[0]
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	u.Path = path.Join(path.Dir(u.Path), "heartbeat")
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// heartbeatTarget returns the heartbeat endpoint beside the server endpoint
+// payloads currently go to
+func (a *Agent) heartbeatTarget() (string, error) {
+	config := a.config
+	config.ServerURL = a.endpoints().current()
+	return heartbeatURL(config)
+}
+
+// newHeartbeat describes the agent now, scored by its pending alerts
+func (a *Agent) newHeartbeat() Heartbeat {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	a.alertMutex.RLock()
+	score := a.calculateScore(a.localAlerts)
+	a.alertMutex.RUnlock()
+	return Heartbeat{
+		AgentVersion: currentBuild().Version,
+		Host:         hostname,
+		ServerID:     a.config.ServerID,
+		MachineID:    a.machineID,
+		Env:          a.config.Env,
+		OwnerTeam:    a.config.OwnerTeam,
+		Timestamp:    time.Now(),
+		Score:        score,
+		Interval:     a.config.HeartbeatInterval,
+	}
+}
+
+// sendHeartbeat makes one attempt to POST a heartbeat, signed like payloads.
+// Heartbeats are not retried or queued: the next one follows shortly.
+func (a *Agent) sendHeartbeat(ctx context.Context, target string) error {
+	heartbeat := a.newHeartbeat()
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.config.HeartbeatInterval)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Agent-Signature", fmt.Sprintf("sha256=%s", a.signPayload(body, heartbeat.Timestamp)))
+	req.Header.Set("X-Agent-Timestamp", strconv.FormatInt(heartbeat.Timestamp.Unix(), 10))
+	if a.config.KeyID != "" {
+		req.Header.Set("X-Agent-Key-Id", a.config.KeyID)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &heartbeatStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// heartbeatStatusError is a heartbeat rejected by the server
+type heartbeatStatusError struct {
+	status int
+}
+
+func (e *heartbeatStatusError) Error() string {
+	return fmt.Sprintf("server returned status %d", e.status)
+}
+
+// runHeartbeats sends a heartbeat every --heartbeat-interval seconds until
+// ctx is done. It runs apart from the payload loop, so heartbeats keep
+// flowing while a payload send is being retried. A server without a
+// heartbeat endpoint (404 or 405) stops them.
+func (a *Agent) runHeartbeats(ctx context.Context) {
+	defer reportPanic()
+
+	target, err := a.heartbeatTarget()
+	if err != nil {
+		log.Printf("Warning: Heartbeats disabled: %v", err)
+		return
+	}
+	log.Printf("Sending heartbeats to %s every %ds", target, a.config.HeartbeatInterval)
+
+	ticker := time.NewTicker(time.Duration(a.config.HeartbeatInterval) * time.Second)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+			if next, err := a.heartbeatTarget(); err == nil && next != target {
+				log.Printf("Sending heartbeats to %s", next)
+				target = next
+			}
+			err := a.sendHeartbeat(ctx, target)
+			if err == nil {
+				a.selfMetrics.Heartbeats.Add(1)
+				if failing {
+					log.Printf("Heartbeats to %s are succeeding again", target)
+				}
+				failing = false
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			a.selfMetrics.HeartbeatFailures.Add(1)
+			var statusErr *heartbeatStatusError
+			if errors.As(err, &statusErr) && (statusErr.status == http.StatusNotFound || statusErr.status == http.StatusMethodNotAllowed) {
+				log.Printf("Warning: %s does not accept heartbeats (status %d), heartbeats disabled", target, statusErr.status)
+				return
+			}
+			// Logged once per outage rather than every few seconds
+			if !failing {
+				log.Printf("Failed to send heartbeat: %v", err)
+			}
+			failing = true
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHeartbeatURL tests deriving the heartbeat endpoint from --server-url
+func TestHeartbeatURL(t *testing.T) {
+	cases := []struct {
+		config Config
+		want   string
+	}{
+		{Config{ServerURL: "https://mon.example.com/api/ingest"}, "https://mon.example.com/api/heartbeat"},
+		{Config{ServerURL: "https://mon.example.com/ingest?tenant=a"}, "https://mon.example.com/heartbeat"},
+		{Config{ServerURL: "https://mon.example.com"}, "https://mon.example.com/heartbeat"},
+		{Config{ServerURL: "https://mon.example.com/ingest", HeartbeatURL: "https://beats.example.com/hb"}, "https://beats.example.com/hb"},
+	}
+	for _, c := range cases {
+		got, err := heartbeatURL(c.config)
+		if err != nil {
+			t.Fatalf("heartbeatURL(%q): %v", c.config.ServerURL, err)
+		}
+		if got != c.want {
+			t.Errorf("heartbeatURL(%q, %q) = %q, expected %q", c.config.ServerURL, c.config.HeartbeatURL, got, c.want)
+		}
+	}
+}
+
+// TestHeartbeatReceived tests that heartbeats are signed like payloads
+func TestHeartbeatReceived(t *testing.T) {
+	var out strings.Builder
+	server := httptest.NewServer(&receiver{secret: "shared", maxSkew: time.Hour, out: &out})
+	defer server.Close()
+	target := server.URL + "/heartbeat"
+
+	agent := &Agent{
+		config:      Config{ServerURL: server.URL + "/ingest", Secret: "shared", HeartbeatInterval: 5},
+		httpClient:  server.Client(),
+		localAlerts: []string{"CPU_SPIKE"},
+	}
+	if err := agent.sendHeartbeat(context.Background(), target); err != nil {
+		t.Fatalf("Expected correctly signed heartbeat to be accepted: %v", err)
+	}
+	if !strings.Contains(out.String(), "heartbeat from") || !strings.Contains(out.String(), "next in 5s") {
+		t.Errorf("Expected heartbeat to be printed, got:\n%s", out.String())
+	}
+
+	agent.config.Secret = "other"
+	var statusErr *heartbeatStatusError
+	if err := agent.sendHeartbeat(context.Background(), target); !errors.As(err, &statusErr) || statusErr.status != http.StatusUnauthorized {
+		t.Errorf("Expected wrong secret to be rejected with 401, got %v", err)
+	}
+}
+
+// TestHeartbeatsStopWithoutEndpoint tests that a server without a heartbeat
+// endpoint turns heartbeats off
+func TestHeartbeatsStopWithoutEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	agent := &Agent{
+		config:      Config{ServerURL: server.URL + "/ingest", Secret: "shared", HeartbeatInterval: 1},
+		httpClient:  server.Client(),
+		selfMetrics: NewSelfMetrics(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		agent.runHeartbeats(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("Expected heartbeats to stop after a 404")
+	}
+	if failures := agent.selfMetrics.HeartbeatFailures.Load(); failures != 1 {
+		t.Errorf("Expected 1 heartbeat failure, got %d", failures)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// Longest a hook call, or the script's top-level code, may run
+	hookTimeout = time.Second
+	// Deepest Lua call stack a hook may build
+	hookCallStackSize = 256
+)
+
+// hookNames are the functions a --hooks script may define
+var hookNames = []string{"collect", "on_alert", "pre_send"}
+
+// luaHooks is a --hooks Lua script run at three stages of every payload:
+//
+//	collect(data)     after collection, returns alerts like an external detector
+//	on_alert(alert)   for each alert going out, may replace its detail or drop it
+//	pre_send(payload) before sending, may replace the payload or veto the send
+//
+// The script only gets the base, string, table and math libraries, so it
+// cannot reach files, the network or other processes. Its globals persist
+// between calls.
+type luaHooks struct {
+	name    string
+	mu      sync.Mutex // an LState is not safe for concurrent use
+	state   *lua.LState
+	closed  bool
+	collect *lua.LFunction // nil if not defined
+	onAlert *lua.LFunction
+	preSend *lua.LFunction
+}
+
+// loadHooks runs a --hooks script and looks up the hooks it defines
+func loadHooks(path string) (*luaHooks, error) {
+	if path == "" {
+		return nil, nil
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: hookCallStackSize})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// The base library can still load files and modules
+	for _, global := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(global, lua.LNil)
+	}
+
+	h := &luaHooks{name: detectorName(path), state: L}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		log.Printf("Hooks %s: %s", h.name, strings.Join(parts, " "))
+		return 0
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	L.SetContext(ctx)
+	err := L.DoFile(path)
+	L.RemoveContext()
+	cancel()
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+
+	functions := make(map[string]*lua.LFunction)
+	for _, name := range hookNames {
+		switch value := L.GetGlobal(name).(type) {
+		case *lua.LNilType:
+		case *lua.LFunction:
+			functions[name] = value
+		default:
+			L.Close()
+			return nil, fmt.Errorf("%s is a %s, expected a function", name, value.Type())
+		}
+	}
+	if len(functions) == 0 {
+		L.Close()
+		return nil, fmt.Errorf("script defines none of %s", strings.Join(hookNames, ", "))
+	}
+	h.collect, h.onAlert, h.preSend = functions["collect"], functions["on_alert"], functions["pre_send"]
+	return h, nil
+}
+
+// call runs a hook with the time limit and returns its first result. Must
+// be called with mu held.
+func (h *luaHooks) call(fn *lua.LFunction, args ...lua.LValue) (lua.LValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	h.state.SetContext(ctx)
+	defer h.state.RemoveContext()
+
+	if err := h.state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+		return lua.LNil, err
+	}
+	result := h.state.Get(-1)
+	h.state.Pop(1)
+	return result, nil
+}
+
+func (h *luaHooks) Name() string { return h.name }
+
+// Detect runs the collect hook, which makes the script an external detector.
+// It returns a list of alert names or {alert=, detail=, weight=} tables.
+func (h *luaHooks) Detect(input DetectorInput) ([]DetectorAlert, error) {
+	data, err := jsonValue(input)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result, err := h.call(h.collect, toLua(h.state, data))
+	if err != nil {
+		return nil, err
+	}
+	if result == lua.LNil {
+		return nil, nil
+	}
+	list, ok := result.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("collect returned a %s, expected a list of alerts", result.Type())
+	}
+
+	var alerts []DetectorAlert
+	for i := 1; i <= list.Len(); i++ {
+		switch item := list.RawGetInt(i).(type) {
+		case lua.LString:
+			alerts = append(alerts, DetectorAlert{Alert: string(item)})
+		case *lua.LTable:
+			alerts = append(alerts, DetectorAlert{
+				Alert:  lua.LVAsString(item.RawGetString("alert")),
+				Detail: lua.LVAsString(item.RawGetString("detail")),
+				Weight: float64(lua.LVAsNumber(item.RawGetString("weight"))),
+			})
+		default:
+			return nil, fmt.Errorf("collect returned a %s in its alerts", item.Type())
+		}
+	}
+	return alerts, nil
+}
+
+// alertHook runs on_alert on each alert of a payload. Returning a string
+// replaces the alert's detail and returning false drops the alert from the
+// payload; a failing call keeps the alert as it is.
+func (h *luaHooks) alertHook(alerts []string, details map[string]string) ([]string, map[string]string) {
+	if h.onAlert == nil {
+		return alerts, details
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	kept := alerts[:0]
+	for _, alert := range alerts {
+		alertType, subject, _ := strings.Cut(alert, ":")
+		arg := h.state.CreateTable(0, 5)
+		arg.RawSetString("alert", lua.LString(alert))
+		arg.RawSetString("type", lua.LString(alertType))
+		arg.RawSetString("subject", lua.LString(subject))
+		arg.RawSetString("detail", lua.LString(details[alert]))
+		arg.RawSetString("severity", lua.LString(alertSeverity(alert)))
+
+		result, err := h.call(h.onAlert, arg)
+		if err != nil {
+			log.Printf("Hook on_alert failed for %s: %v", alert, err)
+		}
+		switch result := result.(type) {
+		case lua.LBool:
+			if !result {
+				delete(details, alert)
+				continue
+			}
+		case lua.LString:
+			if details == nil {
+				details = make(map[string]string)
+			}
+			details[alert] = string(result)
+		}
+		kept = append(kept, alert)
+	}
+	return kept, details
+}
+
+// preSendHook runs pre_send on a payload and returns the payload to send and
+// whether to send it. Returning false vetoes the send and returning a table
+// replaces the payload; a failing call sends the payload unchanged.
+func (h *luaHooks) preSendHook(payload Payload) (Payload, bool) {
+	if h.preSend == nil {
+		return payload, true
+	}
+	data, err := jsonValue(payload)
+	if err != nil {
+		log.Printf("Hook pre_send skipped for payload %s: %v", payload.ID, err)
+		return payload, true
+	}
+	h.mu.Lock()
+	result, err := h.call(h.preSend, toLua(h.state, data))
+	h.mu.Unlock()
+	if err != nil {
+		log.Printf("Hook pre_send failed, sending payload %s unchanged: %v", payload.ID, err)
+		return payload, true
+	}
+
+	switch result := result.(type) {
+	case lua.LBool:
+		return payload, bool(result)
+	case *lua.LTable:
+		var replaced Payload
+		value, err := fromLua(result, data)
+		if err == nil {
+			var body []byte
+			if body, err = json.Marshal(value); err == nil {
+				err = json.Unmarshal(body, &replaced)
+			}
+		}
+		if err != nil {
+			log.Printf("Hook pre_send returned an invalid payload, sending payload %s unchanged: %v", payload.ID, err)
+			return payload, true
+		}
+		return replaced, true
+	}
+	return payload, true
+}
+
+func (h *luaHooks) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		h.state.Close()
+		h.closed = true
+	}
+	return nil
+}
+
+// jsonValue converts v to the maps, slices and scalars it encodes to in JSON
+func jsonValue(v any) (any, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	err = json.Unmarshal(body, &value)
+	return value, err
+}
+
+// toLua converts a JSON value to Lua: objects and arrays become tables
+func toLua(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case map[string]any:
+		table := L.CreateTable(0, len(value))
+		for key, item := range value {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	case []any:
+		table := L.CreateTable(len(value), 0)
+		for _, item := range value {
+			table.Append(toLua(L, item))
+		}
+		return table
+	case string:
+		return lua.LString(value)
+	case float64:
+		return lua.LNumber(value)
+	case bool:
+		return lua.LBool(value)
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value back to JSON. A table with only the keys 1..n
+// is an array; shape is the JSON value the table was made from, if any, and
+// tells whether an empty table is an array or an object.
+func fromLua(value lua.LValue, shape any) (any, error) {
+	switch value := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(value), nil
+	case lua.LNumber:
+		return float64(value), nil
+	case lua.LString:
+		return string(value), nil
+	case *lua.LTable:
+		entries := 0
+		value.ForEach(func(lua.LValue, lua.LValue) { entries++ })
+		shapeArray, isArray := shape.([]any)
+		shapeObject, _ := shape.(map[string]any)
+		if entries == 0 {
+			switch {
+			case isArray:
+				return []any{}, nil
+			case shapeObject != nil:
+				return map[string]any{}, nil
+			}
+			return nil, nil
+		}
+
+		if n := value.MaxN(); n == entries {
+			var itemShape any
+			if len(shapeArray) > 0 {
+				itemShape = shapeArray[0]
+			}
+			array := make([]any, n)
+			for i := range array {
+				item, err := fromLua(value.RawGetInt(i+1), itemShape)
+				if err != nil {
+					return nil, err
+				}
+				array[i] = item
+			}
+			return array, nil
+		}
+
+		object := make(map[string]any, entries)
+		var err error
+		value.ForEach(func(key, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			name := key.String()
+			object[name], err = fromLua(item, shapeObject[name])
+		})
+		return object, err
+	}
+	return nil, fmt.Errorf("cannot convert a %s to JSON", value.Type())
+}
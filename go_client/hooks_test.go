@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHooks writes a --hooks script to a temporary file
+func writeHooks(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hooks.lua")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadHooks tests which scripts are accepted and that they are sandboxed
+func TestLoadHooks(t *testing.T) {
+	for script, want := range map[string]string{
+		"collect = function(":             "hooks.lua",
+		"x = 1":                           "defines none of collect, on_alert, pre_send",
+		"pre_send = 'yes'":                "pre_send is a string, expected a function",
+		"dofile('/etc/passwd')":           "attempt to call a non-function object",
+		"while true do end":               "context deadline exceeded",
+		"local f = io.open('/etc/hosts')": "non-table object(nil) with key 'open'",
+	} {
+		if _, err := loadHooks(writeHooks(t, script)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to fail with %q, got %v", script, want, err)
+		}
+	}
+
+	hooks, err := loadHooks(writeHooks(t, "function on_alert(alert) end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+	if hooks.Name() != "hooks" || hooks.onAlert == nil || hooks.collect != nil || hooks.preSend != nil {
+		t.Errorf("Unexpected hooks %+v", hooks)
+	}
+}
+
+// TestHookStages tests the collect and on_alert hooks on a payload
+func TestHookStages(t *testing.T) {
+	script := `
+seen = 0
+
+function collect(data)
+  seen = seen + 1
+  local alerts = {"SCRIPT_RAN"}
+  for _, entry in ipairs(data.logs) do
+    if string.find(entry.message, "declined") then
+      table.insert(alerts, {alert = "CARD_TESTING:" .. entry.container, detail = "seen " .. seen, weight = 0.6})
+    end
+  end
+  return alerts
+end
+
+function on_alert(alert)
+  if alert.type == "SCRIPT_RAN" then
+    return false
+  end
+  if alert.type == "CARD_TESTING" then
+    return alert.subject .. ": " .. alert.detail .. " (" .. alert.severity .. ")"
+  end
+end
+`
+	agent, err := NewAgent(Config{Hooks: writeHooks(t, script)})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.hooks.Close()
+	agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "checkout", Message: "card declined"})
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(payload.LocalAlerts, ",") != "CARD_TESTING:checkout" {
+		t.Fatalf("Expected only the alert on_alert kept, got %v", payload.LocalAlerts)
+	}
+	if detail := payload.AlertDetails["CARD_TESTING:checkout"]; detail != "checkout: seen 1 (warning)" {
+		t.Errorf("Expected the detail from on_alert, got %q", detail)
+	}
+	if payload.Score != 0.6 {
+		t.Errorf("Expected the collect weight as score, got %v", payload.Score)
+	}
+
+	// Globals persist between calls
+	payload, _ = agent.createPayload()
+	if detail := payload.AlertDetails["CARD_TESTING:checkout"]; !strings.Contains(detail, "seen 2") {
+		t.Errorf("Expected the script's state to persist, got %q", detail)
+	}
+}
+
+// TestPreSendHook tests replacing and vetoing payloads, and that a payload
+// returned as is survives the round trip through Lua
+func TestPreSendHook(t *testing.T) {
+	script := `
+function pre_send(payload)
+  if payload.env == "staging" then
+    return false
+  end
+  if payload.env == "unchanged" then
+    return payload
+  end
+  payload.owner_team = "payments"
+  payload.alert_details = payload.alert_details or {}
+  payload.alert_details.ENRICHED = "by hook"
+  payload.logs = {}
+  return payload
+end
+`
+	agent, err := NewAgent(Config{Hooks: writeHooks(t, script), DryRun: true})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.hooks.Close()
+	agent.logBuffer = append(agent.logBuffer, LogEntry{Container: "api", Message: "hello"})
+	agent.raiseAlert("CPU_SPIKE")
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.Env = "unchanged"
+	kept, send := agent.hooks.preSendHook(payload)
+	want, _ := json.Marshal(payload)
+	got, _ := json.Marshal(kept)
+	if !send || string(got) != string(want) {
+		t.Errorf("Expected the payload unchanged:\n%s\ngot:\n%s", want, got)
+	}
+
+	payload.Env = "prod"
+	enriched, send := agent.hooks.preSendHook(payload)
+	if !send || enriched.OwnerTeam != "payments" || enriched.AlertDetails["ENRICHED"] != "by hook" ||
+		enriched.Logs == nil || len(enriched.Logs) != 0 || enriched.ID != payload.ID || !enriched.Timestamp.Equal(payload.Timestamp) {
+		t.Errorf("Unexpected enriched payload %+v", enriched)
+	}
+
+	payload.Env = "staging"
+	if _, send := agent.hooks.preSendHook(payload); send {
+		t.Error("Expected the staging payload to be vetoed")
+	}
+	if err := agent.sendPayload(payload); err != nil {
+		t.Fatal(err)
+	}
+	events := agent.agentEvents.Snapshot()
+	if len(events) == 0 || events[len(events)-1].Kind != EventPayloadVetoed {
+		t.Errorf("Expected a payload_vetoed event, got %+v", events)
+	}
+	if len(agent.logBuffer) != 0 || len(agent.localAlerts) != 0 || agent.alertStates["CPU_SPIKE"].State != AlertStateDelivered {
+		t.Errorf("Expected the vetoed logs and alerts dropped, not sent with the next payload")
+	}
+}
+
+// TestHookTimeout tests that a hook running too long fails and leaves the
+// alert as it is
+func TestHookTimeout(t *testing.T) {
+	hooks, err := loadHooks(writeHooks(t, "function on_alert(alert) while true do end end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+
+	start := time.Now()
+	alerts, details := hooks.alertHook([]string{"CPU_SPIKE"}, map[string]string{"CPU_SPIKE": "95%"})
+	if time.Since(start) > 3*hookTimeout {
+		t.Errorf("Expected the hook to be stopped after %v, took %v", hookTimeout, time.Since(start))
+	}
+	if len(alerts) != 1 || details["CPU_SPIKE"] != "95%" {
+		t.Errorf("Expected the alert unchanged, got %v %v", alerts, details)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// uuidPattern matches the canonical textual form produced by newUUID
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// loadAgentID reads the agent ID persisted at path, generating and saving one
+// on first run. With persist unset (dry-run) a missing ID is generated but not
+// written, so the run leaves no trace.
+func loadAgentID(path string, persist bool) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if !uuidPattern.MatchString(id) {
+			return "", fmt.Errorf("agent ID file %s does not contain a UUID", path)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := newUUID()
+	if !persist {
+		return id, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// O_EXCL: if another instance raced us, use its ID instead
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return loadAgentID(path, false)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(id + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	log.Printf("Generated agent ID %s (%s)", id, path)
+	return id, nil
+}
+
+// resolveServerID returns the configured server ID or, when unset, the
+// persisted auto-generated agent ID
+func resolveServerID(config Config) (string, error) {
+	if config.ServerID != "" || config.AgentIDFile == "" {
+		return config.ServerID, nil
+	}
+	id, err := loadAgentID(config.AgentIDFile, !config.DryRun)
+	if err != nil {
+		return "", fmt.Errorf("failed to load agent ID: %w", err)
+	}
+	return id, nil
+}
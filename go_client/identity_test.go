@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAgentIDPersistence tests that the generated ID survives restarts
+func TestAgentIDPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "agent_id")
+
+	if _, err := loadAgentID(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected dry-run not to persist the agent ID")
+	}
+
+	first, err := loadAgentID(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadAgentID(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || !uuidPattern.MatchString(first) {
+		t.Errorf("Expected the same UUID across runs, got %q and %q", first, second)
+	}
+
+	os.WriteFile(path, []byte("not-a-uuid\n"), 0644)
+	if _, err := loadAgentID(path, true); err == nil {
+		t.Error("Expected a corrupt agent ID file to be rejected")
+	}
+}
+
+// TestPayloadServerID tests the generated ID and explicit --server-id in payloads
+func TestPayloadServerID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_id")
+	agent, err := NewAgent(Config{AgentIDFile: path, MaxLogEntries: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if payload.ServerID == "" || payload.ServerID != strings.TrimSpace(string(data)) {
+		t.Errorf("Expected persisted ID %q as server_id, got %q", data, payload.ServerID)
+	}
+	if payload.MachineID != machineID() {
+		t.Errorf("Expected machine ID %q, got %q", machineID(), payload.MachineID)
+	}
+
+	explicit, err := resolveServerID(Config{ServerID: "web-01", AgentIDFile: filepath.Join(t.TempDir(), "unused")})
+	if err != nil || explicit != "web-01" {
+		t.Errorf("Expected explicit server ID to win, got %q (%v)", explicit, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// TestNewUUID tests UUID format and uniqueness
+func TestNewUUID(t *testing.T) {
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newUUID()
+		if !uuidPattern.MatchString(id) {
+			t.Fatalf("Invalid UUID format: %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate UUID generated: %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+// TestPayloadIDPropagation tests that the payload ID is carried in the signed
+// body and headers, along with the API key ID
+func TestPayloadIDPropagation(t *testing.T) {
+	var headerID, bodyID, keyID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerID = r.Header.Get("X-Agent-Payload-Id")
+		keyID = r.Header.Get("X-Agent-Key-Id")
+		body, _ := io.ReadAll(r.Body)
+		var p Payload
+		json.Unmarshal(body, &p)
+		bodyID = p.ID
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "test", KeyID: "payments-prod"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	payload := Payload{ID: newUUID(), Timestamp: time.Now()}
+	if err := agent.sendPayload(payload); err != nil {
+		t.Fatalf("Failed to send payload: %v", err)
+	}
+
+	if headerID != payload.ID || bodyID != payload.ID {
+		t.Errorf("Expected payload ID %s in header and body, got header=%s body=%s", payload.ID, headerID, bodyID)
+	}
+	if keyID != "payments-prod" {
+		t.Errorf("Expected X-Agent-Key-Id payments-prod, got %q", keyID)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// W3C extended log lines start with the UTC date and time
+	w3cLinePattern    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} `)
+	httpMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+)
+
+// iisDefaultFields is the field list IIS logs by default, used for a source
+// until its #Fields directive is seen
+var iisDefaultFields = []string{
+	"date", "time", "s-ip", "cs-method", "cs-uri-stem", "cs-uri-query", "s-port", "cs-username",
+	"c-ip", "cs(User-Agent)", "cs(Referer)", "sc-status", "sc-substatus", "sc-win32-status", "time-taken",
+}
+
+var iisDefaultParser = newW3CParser(iisDefaultFields)
+
+// w3cParser reads W3C extended log lines laid out by a #Fields directive
+type w3cParser struct {
+	fields map[string]int
+	count  int
+}
+
+func newW3CParser(fields []string) *w3cParser {
+	p := &w3cParser{fields: make(map[string]int), count: len(fields)}
+	for i, field := range fields {
+		p.fields[strings.ToLower(field)] = i
+	}
+	return p
+}
+
+// parseW3CFields returns the field names of a "#Fields: ..." directive
+func parseW3CFields(line string) ([]string, bool) {
+	rest, ok := strings.CutPrefix(line, "#Fields:")
+	if !ok {
+		return nil, false
+	}
+	fields := strings.Fields(rest)
+	return fields, len(fields) > 0
+}
+
+// parse turns a W3C line into a request: the URI stem and query are the
+// target, time-taken (milliseconds) the latency. IIS logs spaces in values
+// as "+" and missing values as "-".
+func (p *w3cParser) parse(line string) (accessRecord, bool) {
+	values := strings.Fields(line)
+	if len(values) != p.count {
+		return accessRecord{}, false
+	}
+	value := func(field string) string {
+		if i, ok := p.fields[field]; ok && values[i] != "-" {
+			return values[i]
+		}
+		return ""
+	}
+	// Lines of other logs that start with a timestamp rarely get this far
+	status, err := strconv.Atoi(value("sc-status"))
+	if err != nil || status < 100 || status > 599 || !httpMethodPattern.MatchString(value("cs-method")) {
+		return accessRecord{}, false
+	}
+	record := accessRecord{
+		Client:    value("c-ip"),
+		Method:    value("cs-method"),
+		Target:    value("cs-uri-stem"),
+		Status:    status,
+		UserAgent: strings.ReplaceAll(value("cs(user-agent)"), "+", " "),
+	}
+	if query := value("cs-uri-query"); query != "" {
+		record.Target += "?" + query
+	}
+	if ms, err := strconv.Atoi(value("time-taken")); err == nil {
+		record.Latency = time.Duration(ms) * time.Millisecond
+		record.HasLatency = true
+	}
+	return record, true
+}
+
+// w3cParsers keeps the field layout of each source's W3C log
+type w3cParsers struct {
+	mu      sync.Mutex
+	parsers map[string]*w3cParser
+}
+
+func newW3CParsers() *w3cParsers {
+	return &w3cParsers{parsers: make(map[string]*w3cParser)}
+}
+
+// parse handles a W3C directive or log line from source, returning false
+// for directives and anything else
+func (w *w3cParsers) parse(source, line string) (accessRecord, bool) {
+	if fields, ok := parseW3CFields(line); ok {
+		w.mu.Lock()
+		w.parsers[source] = newW3CParser(fields)
+		w.mu.Unlock()
+		return accessRecord{}, false
+	}
+	w.mu.Lock()
+	parser, ok := w.parsers[source]
+	w.mu.Unlock()
+	if !ok {
+		parser = iisDefaultParser
+	}
+	return parser.parse(line)
+}
+
+// iisLogFollower follows the newest log file in an IIS site's log
+// directory. IIS starts a new file (u_exYYMMDD.log) each period instead of
+// rotating one, so the directory is checked for a newer file on every poll.
+type iisLogFollower struct {
+	dir    string
+	handle func(line string)
+
+	current string
+	tailer  *fileTailer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// followIISLogs starts following dir, reading only lines written from now on
+func followIISLogs(dir string, handle func(line string)) (*iisLogFollower, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	f := &iisLogFollower{dir: dir, handle: handle, stop: make(chan struct{}), done: make(chan struct{})}
+	f.check(false)
+	go f.run()
+	return f, nil
+}
+
+func (f *iisLogFollower) run() {
+	defer reportPanic()
+	defer close(f.done)
+
+	ticker := time.NewTicker(tailerPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.check(true)
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// check switches to the newest log file when it changed. A file that
+// appears while the agent runs is read from the start; the one current at
+// startup from its end, after replaying its last #Fields directive.
+func (f *iisLogFollower) check(fromStart bool) {
+	newest := newestLogFile(f.dir)
+	if newest == "" || newest == f.current {
+		return
+	}
+	if !fromStart {
+		if fields := lastW3CDirective(newest); fields != "" {
+			f.handle(fields)
+		}
+	}
+	tailer, err := newFileTailer(newest, fromStart, f.handle)
+	if err != nil {
+		log.Printf("Warning: Failed to follow IIS log %s: %v", newest, err)
+		return
+	}
+	if f.tailer != nil {
+		f.tailer.Close()
+	}
+	f.current, f.tailer = newest, tailer
+	log.Printf("Monitoring IIS log: %s", newest)
+}
+
+// Close stops following the directory
+func (f *iisLogFollower) Close() error {
+	close(f.stop)
+	<-f.done
+	if f.tailer != nil {
+		return f.tailer.Close()
+	}
+	return nil
+}
+
+// newestLogFile returns the most recently modified *.log file in dir
+func newestLogFile(dir string) string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	var newest string
+	var newestTime time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = path, info.ModTime()
+		}
+	}
+	return newest
+}
+
+// lastW3CDirective returns the last #Fields directive in a log file
+func lastW3CDirective(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	var fields string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "#Fields:") {
+			fields = line
+		}
+	}
+	return fields
+}
+
+// setupIISLogMonitoring follows the IIS site log directories in --iis-logs,
+// feeding the same HTTP metrics and detectors as other access logs
+func (a *Agent) setupIISLogMonitoring() {
+	for _, dir := range strings.Split(a.config.IISLogs, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		source := filepath.Base(dir)
+		follower, err := followIISLogs(dir, func(line string) { a.accessLogs.observe(source, line, a.correlation.find(line, nil)) })
+		if err != nil {
+			log.Printf("Warning: Failed to follow IIS logs in %s: %v", dir, err)
+			continue
+		}
+		a.logSources = append(a.logSources, follower)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestW3CParsing tests IIS lines with the default layout and after a #Fields directive
+func TestW3CParsing(t *testing.T) {
+	parsers := newW3CParsers()
+	record, ok := parsers.parse("W3SVC1", `2026-10-16 13:55:36 10.0.0.5 GET /api/orders/42 page=2 443 - 198.51.100.7 Mozilla/5.0+(Windows+NT+10.0) - 500 0 0 1234`)
+	if !ok || record.Client != "198.51.100.7" || record.Method != "GET" || record.Target != "/api/orders/42?page=2" || record.Status != 500 ||
+		record.UserAgent != "Mozilla/5.0 (Windows NT 10.0)" || !record.HasLatency || record.Latency != 1234*time.Millisecond {
+		t.Fatalf("Unexpected default layout record %+v, %v", record, ok)
+	}
+
+	if _, ok := parsers.parse("W3SVC2", "#Fields: date time c-ip cs-method cs-uri-stem sc-status time-taken"); ok {
+		t.Error("Expected a directive not to be a request")
+	}
+	record, ok = parsers.parse("W3SVC2", `2026-10-16 13:55:36 203.0.113.9 POST /login.aspx 302 15`)
+	if !ok || record.Client != "203.0.113.9" || record.Target != "/login.aspx" || record.Status != 302 || record.Latency != 15*time.Millisecond {
+		t.Errorf("Unexpected custom layout record %+v, %v", record, ok)
+	}
+
+	for _, line := range []string{
+		`2026-10-16 13:55:36 INFO [main] Started application in 4.2 seconds (JVM running for 5.1) pid 1 ok`,
+		`2026-10-16 13:55:36 203.0.113.9 POST /login.aspx 302`,
+		`#Software: Microsoft Internet Information Services 10.0`,
+	} {
+		if record, ok := parsers.parse("W3SVC2", line); ok {
+			t.Errorf("Expected %q not to be a request, got %+v", line, record)
+		}
+	}
+}
+
+// TestIISLogMetrics tests that IIS logs feed HTTP metrics and HTTP_5XX_SPIKE
+func TestIISLogMetrics(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "W3SVC1")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	header := "#Software: Microsoft Internet Information Services 10.0\r\n#Fields: date time cs-method cs-uri-stem c-ip sc-status time-taken\r\n"
+	old := filepath.Join(dir, "u_ex261015.log")
+	current := filepath.Join(dir, "u_ex261016.log")
+	os.WriteFile(old, []byte(header), 0o644)
+	os.Chtimes(old, time.Now().Add(-24*time.Hour), time.Now().Add(-24*time.Hour))
+	os.WriteFile(current, []byte(header+"2026-10-16 00:00:01 GET /old 10.0.0.1 500 5\r\n"), 0o644)
+	if newest := newestLogFile(dir); newest != current {
+		t.Fatalf("Expected newest log %s, got %s", current, newest)
+	}
+
+	agent, err := NewAgent(Config{IISLogs: dir, HTTP5xxPct: 10, HTTPMinRequests: 4, MaxLogEntries: 100})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer func() {
+		for _, source := range agent.logSources {
+			source.Close()
+		}
+	}()
+
+	file, err := os.OpenFile(current, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"2026-10-16 13:55:36 GET /default.aspx 10.0.0.2 200 31",
+		"2026-10-16 13:55:37 GET /default.aspx 10.0.0.3 200 45",
+		"2026-10-16 13:55:38 POST /api/cart 10.0.0.4 503 2041",
+		"2026-10-16 13:55:39 POST /api/cart 10.0.0.5 500 1804",
+	} {
+		file.WriteString(line + "\r\n")
+	}
+	file.Close()
+
+	requests := func() int {
+		agent.accessLogs.mu.Lock()
+		defer agent.accessLogs.mu.Unlock()
+		if window := agent.accessLogs.windows["W3SVC1"]; window != nil {
+			return window.requests
+		}
+		return 0
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for requests() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected four IIS requests, got %d", requests())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Metrics.HTTP) != 1 {
+		t.Fatalf("Expected one HTTP source, got %+v", payload.Metrics.HTTP)
+	}
+	m := payload.Metrics.HTTP[0]
+	if m.Source != "W3SVC1" || m.Requests != 4 || m.StatusClasses["5xx"] != 2 || m.LatencyP99Ms != 2041 {
+		t.Errorf("Unexpected IIS metrics %+v", m)
+	}
+	if alerts := strings.Join(payload.LocalAlerts, ","); alerts != "HTTP_5XX_SPIKE:W3SVC1" {
+		t.Errorf("Expected HTTP_5XX_SPIKE:W3SVC1, got %s", alerts)
+	}
+}
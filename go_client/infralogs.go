@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// infraLogRule maps a message logged by an infrastructure component to an
+// alert and the reason counted in its details
+type infraLogRule struct {
+	alert   string
+	reason  string
+	message string
+}
+
+// infraLogRules are the Redis, RabbitMQ and Kafka messages worth alerting on.
+// Clients log some of them too (Redis OOM and MISCONF replies, Kafka
+// NotEnoughReplicas), so they are matched in any container.
+var infraLogRules = []infraLogRule{
+	// Redis: writes refused at maxmemory, or the allocator failing
+	{"REDIS_OOM", "maxmemory", "OOM command not allowed when used memory"},
+	{"REDIS_OOM", "allocation", "Out Of Memory allocating"},
+	// Redis: RDB snapshots and the AOF failing, after which writes may be refused
+	{"REDIS_PERSISTENCE", "fork", "Can't save in background: fork"},
+	{"REDIS_PERSISTENCE", "bgsave", "Background saving error"},
+	{"REDIS_PERSISTENCE", "rdb_write", "Write error saving DB on disk"},
+	{"REDIS_PERSISTENCE", "rdb_open", "Failed opening the RDB file"},
+	{"REDIS_PERSISTENCE", "rdb_open", "Failed opening the temp RDB file"},
+	{"REDIS_PERSISTENCE", "aof_rewrite", "Background AOF rewrite terminated with error"},
+	{"REDIS_PERSISTENCE", "aof_write", "Error writing to the AOF file"},
+	{"REDIS_PERSISTENCE", "aof_fsync", "Asynchronous AOF fsync is taking too long"},
+	{"REDIS_PERSISTENCE", "misconf", "MISCONF Redis is configured to save RDB snapshots"},
+	// RabbitMQ: resource alarms block every publishing connection
+	{"RABBITMQ_ALARM", "memory", "memory resource limit alarm set"},
+	{"RABBITMQ_ALARM", "disk", "disk resource limit alarm set"},
+	{"RABBITMQ_ALARM", "disk", "Free disk space is insufficient"},
+	{"RABBITMQ_ALARM", "file_descriptors", "file descriptor limit alarm set"},
+	// RabbitMQ: cluster partitions
+	{"RABBITMQ_PARTITION", "partial", "Partial partition detected"},
+	{"RABBITMQ_PARTITION", "partitioned", "running_partitioned_network"},
+	{"RABBITMQ_PARTITION", "inconsistent", "inconsistent_database"},
+	// Kafka: replicas falling out of sync, and producers with acks=all failing for it
+	{"KAFKA_UNDER_REPLICATED", "isr_shrink", "Shrinking ISR from"},
+	{"KAFKA_UNDER_REPLICATED", "not_enough_replicas", "NotEnoughReplicasException"},
+	// Kafka: brokers stopping or unable to serve
+	{"KAFKA_BROKER_ERROR", "startup", "Fatal error during KafkaServer startup"},
+	{"KAFKA_BROKER_ERROR", "log_dirs", "all log dirs in"},
+	{"KAFKA_BROKER_ERROR", "io", "Halting due to unrecoverable I/O error"},
+	{"KAFKA_BROKER_ERROR", "leader", "LEADER_NOT_AVAILABLE"},
+}
+
+// matchInfraLogRule returns the rule matching a log line, if any
+func matchInfraLogRule(line string) (infraLogRule, bool) {
+	for _, rule := range infraLogRules {
+		if strings.Contains(line, rule.message) {
+			return rule, true
+		}
+	}
+	return infraLogRule{}, false
+}
+
+// handleInfraLogLine raises <ALERT>:<source> for Redis, RabbitMQ and Kafka
+// failures logged by source, a container name or log file base name, with
+// per-reason counts in alert_details
+func (a *Agent) handleInfraLogLine(source, line string) {
+	rule, ok := matchInfraLogRule(line)
+	// Lines replayed from container log tails on start are old news
+	if !ok || a.warmingUp() {
+		return
+	}
+	alert := rule.alert + ":" + source
+	if a.recordDenial(alert, rule.reason) {
+		log.Printf("%s in %s (%s)", rule.alert, source, rule.reason)
+	}
+}
+
+// setupInfraLogMonitoring follows the host Redis, RabbitMQ and Kafka log files in --infra-logs
+func (a *Agent) setupInfraLogMonitoring() {
+	for _, path := range strings.Split(a.config.InfraLogs, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		source := filepath.Base(path)
+		tailer, err := newFileTailer(path, false, func(line string) { a.handleInfraLogLine(source, line) })
+		if err != nil {
+			log.Printf("Warning: Failed to follow infrastructure log %s: %v", path, err)
+			continue
+		}
+		a.logSources = append(a.logSources, tailer)
+		log.Printf("Monitoring infrastructure log: %s", path)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMatchInfraLogRule tests Redis, RabbitMQ and Kafka messages against their alerts
+func TestMatchInfraLogRule(t *testing.T) {
+	cases := map[string]string{
+		`1:M 10 Oct 2026 13:55:36.123 # Background saving error`:                                                                    "REDIS_PERSISTENCE/bgsave",
+		`1:M 10 Oct 2026 13:55:36.123 # Asynchronous AOF fsync is taking too long (disk is busy?).`:                                 "REDIS_PERSISTENCE/aof_fsync",
+		`ERR MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk.`:                      "REDIS_PERSISTENCE/misconf",
+		`2026-10-10 13:55:36.123 [warning] <0.431.0> memory resource limit alarm set on node rabbit@mq-1.`:                          "RABBITMQ_ALARM/memory",
+		`2026-10-10 13:55:36.123 [error] <0.212.0> Partial partition detected:`:                                                     "RABBITMQ_PARTITION/partial",
+		`[2026-10-10 13:55:36,123] INFO [Partition orders-3 broker=1] Shrinking ISR from 1,2,3 to 1. (kafka.cluster.Partition)`:     "KAFKA_UNDER_REPLICATED/isr_shrink",
+		`[2026-10-10 13:55:36,123] ERROR Shutdown broker because all log dirs in /var/lib/kafka have failed (kafka.log.LogManager)`: "KAFKA_BROKER_ERROR/log_dirs",
+		`1:M 10 Oct 2026 13:55:36.123 * Background saving terminated with success`:                                                  "",
+		`2026-10-10 13:55:36.123 [info] <0.431.0> memory resource limit alarm cleared on node rabbit@mq-1`:                          "",
+	}
+	for line, want := range cases {
+		got := ""
+		if rule, ok := matchInfraLogRule(line); ok {
+			got = rule.alert + "/" + rule.reason
+		}
+		if got != want {
+			t.Errorf("matchInfraLogRule(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+// TestInfraLogAlerts tests that container log lines raise per-source alerts with reason counts
+func TestInfraLogAlerts(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 100})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.processLogLine("/cache", `1:M 10 Oct 2026 13:55:36.123 # Write error saving DB on disk: No space left on device`)
+	agent.processLogLine("/cache", `1:M 10 Oct 2026 13:55:37.123 # Background saving error`)
+	agent.processLogLine("/cache", `1:M 10 Oct 2026 13:55:42.123 # Background saving error`)
+	agent.processLogLine("/kafka", `[2026-10-10 13:55:36,123] ERROR [KafkaServer id=1] Fatal error during KafkaServer startup. Prepare to shutdown (kafka.server.KafkaServer)`)
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	alerts := strings.Join(payload.LocalAlerts, ",")
+	if alerts != "REDIS_PERSISTENCE:cache,KAFKA_BROKER_ERROR:kafka" {
+		t.Fatalf("Unexpected alerts %s", alerts)
+	}
+	if detail := payload.AlertDetails["REDIS_PERSISTENCE:cache"]; detail != "bgsave=2, rdb_write=1" {
+		t.Errorf("Unexpected detail %q", detail)
+	}
+	if payload.Score != 0.7 {
+		t.Errorf("Expected score 0.7, got %v", payload.Score)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IntegrityManifest records file hashes taken at install time
+type IntegrityManifest struct {
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"` // absolute path -> sha256 hex
+}
+
+// integrityFiles returns the agent binary, the detectors and hooks it loads
+// and every config file it reads. --mask-rules-file is left out: it is
+// reloaded whenever it changes and each reload is audited, so an edit there
+// is a config change rather than tampering.
+func integrityFiles(config Config) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate agent binary: %w", err)
+	}
+	files := []string{exe}
+	for _, path := range []string{config.ConfigFile, config.ParseRulesFile, config.SNMPFile, config.Hooks, config.HealthTLSCert, config.HealthTLSKey, config.HealthClientCA} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	// Detector plugins and modules are code run in-process
+	for _, path := range strings.Split(config.Detectors, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			files = append(files, path)
+		}
+	}
+
+	for i, path := range files {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		files[i] = path
+	}
+	return files, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeIntegrityManifest hashes the agent binary and config files and saves
+// the result, to be run once at install time
+func writeIntegrityManifest(config Config, path string) (*IntegrityManifest, error) {
+	files, err := integrityFiles(config)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &IntegrityManifest{Created: time.Now().UTC(), Files: make(map[string]string)}
+	for _, file := range files {
+		sum, err := hashFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", file, err)
+		}
+		manifest.Files[file] = sum
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// loadIntegrityManifest reads a manifest written by writeIntegrityManifest
+func loadIntegrityManifest(path string) (*IntegrityManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest IntegrityManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid integrity manifest: %w", err)
+	}
+	if len(manifest.Files) == 0 {
+		return nil, fmt.Errorf("integrity manifest %s lists no files", path)
+	}
+	return &manifest, nil
+}
+
+// verifyIntegrity compares current file hashes with the manifest and returns
+// one description per discrepancy. Files the agent now reads that were not
+// recorded at install time are reported too.
+func verifyIntegrity(manifest *IntegrityManifest, files []string) []string {
+	var problems []string
+	for path, expected := range manifest.Files {
+		sum, err := hashFile(path)
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, path+": missing")
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: unreadable (%v)", path, err))
+		case sum != expected:
+			problems = append(problems, path+": hash changed")
+		}
+	}
+	for _, path := range files {
+		if _, ok := manifest.Files[path]; !ok {
+			problems = append(problems, path+": not in manifest")
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// checkIntegrity raises AGENT_TAMPERED while the binary or config files differ
+// from the install-time manifest
+func (a *Agent) checkIntegrity() {
+	if a.integrity == nil {
+		return
+	}
+	defer a.selfMetrics.Detector("integrity").Since(time.Now())
+
+	files, err := integrityFiles(a.config)
+	if err != nil {
+		log.Printf("Integrity check failed: %v", err)
+		return
+	}
+	problems := verifyIntegrity(a.integrity, files)
+	if len(problems) == 0 {
+		return
+	}
+
+	detail := strings.Join(problems, "; ")
+	a.alertMutex.Lock()
+	if a.raiseAlert("AGENT_TAMPERED") {
+		log.Printf("Agent integrity check failed: %s", detail)
+	}
+	a.alertStates["AGENT_TAMPERED"].Detail = detail
+	a.alertMutex.Unlock()
+}
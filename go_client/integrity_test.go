@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestIntegritySelfCheck tests that modified config files raise AGENT_TAMPERED
+func TestIntegritySelfCheck(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(rulesFile, []byte(`{"parsers":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, "integrity.json")
+
+	config := Config{ParseRulesFile: rulesFile, IntegrityManifest: manifestPath}
+	manifest, err := writeIntegrityManifest(config, manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("Expected binary and rules file in manifest, got %v", manifest.Files)
+	}
+
+	agent, err := NewAgent(config)
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if agent.containsAlert("AGENT_TAMPERED") {
+		t.Fatal("Unexpected AGENT_TAMPERED alert for unmodified files")
+	}
+
+	if err := os.WriteFile(rulesFile, []byte(`{"parsers":[{"name":"x"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	agent.checkIntegrity()
+
+	if !agent.containsAlert("AGENT_TAMPERED") {
+		t.Fatal("Expected AGENT_TAMPERED alert after config file change")
+	}
+	if detail := agent.alertStates["AGENT_TAMPERED"].Detail; !strings.Contains(detail, "rules.json: hash changed") {
+		t.Errorf("Expected changed file in alert detail, got %q", detail)
+	}
+}
+
+// TestIntegrityFiles tests that each --detectors plugin and the --hooks script
+// are hashed, but not the hot-reloaded --mask-rules-file
+func TestIntegrityFiles(t *testing.T) {
+	dir := t.TempDir()
+	files, err := integrityFiles(Config{
+		Detectors:     filepath.Join(dir, "geo.so") + ", " + filepath.Join(dir, "spam.wasm"),
+		Hooks:         filepath.Join(dir, "hooks.lua"),
+		MaskRulesFile: filepath.Join(dir, "masking.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(files, "\n")
+	for _, name := range []string{"geo.so", "spam.wasm", "hooks.lua"} {
+		if !strings.Contains(joined, filepath.Join(dir, name)) {
+			t.Errorf("Expected %s in the manifest files, got %v", name, files)
+		}
+	}
+	if strings.Contains(joined, "masking.json") {
+		t.Errorf("Expected the reloaded mask rules file to be left out, got %v", files)
+	}
+}
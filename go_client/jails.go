@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// JailInfo describes a running FreeBSD jail as reported by jls
+type JailInfo struct {
+	JID      int    `json:"jid"`
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	Path     string `json:"path"`
+}
+
+// parseJLS parses the output of `jls --libxo json`
+func parseJLS(data []byte) ([]JailInfo, error) {
+	var out struct {
+		Info struct {
+			Jails []JailInfo `json:"jail"`
+		} `json:"jail-information"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("invalid jls output: %w", err)
+	}
+	return out.Info.Jails, nil
+}
+
+// diffJails returns start and stop events between two jail listings, keyed by JID
+func diffJails(previous, current map[int]JailInfo, now time.Time) []DockerEvent {
+	var events []DockerEvent
+	for jid, jail := range current {
+		if _, ok := previous[jid]; !ok {
+			events = append(events, jailEvent("start", jail, now))
+		}
+	}
+	for jid, jail := range previous {
+		if _, ok := current[jid]; !ok {
+			events = append(events, jailEvent("stop", jail, now))
+		}
+	}
+	return events
+}
+
+// jailEvent reports a jail lifecycle change in the docker_events stream
+func jailEvent(action string, jail JailInfo, now time.Time) DockerEvent {
+	return DockerEvent{
+		Type:      "jail",
+		Action:    action,
+		Container: jail.Name,
+		Image:     jail.Path,
+		Timestamp: now,
+	}
+}
+
+// monitorJails polls jls once per interval and records jail start/stop events.
+// Jails already running at startup are reported as started.
+func (a *Agent) monitorJails(ctx context.Context, jls string) {
+	interval := time.Duration(a.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	known := make(map[int]JailInfo)
+	for {
+		output, err := exec.CommandContext(ctx, jls, "--libxo", "json").Output()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error listing jails: %v", err)
+		} else if jails, err := parseJLS(output); err != nil {
+			log.Printf("Error listing jails: %v", err)
+		} else {
+			current := make(map[int]JailInfo, len(jails))
+			for _, jail := range jails {
+				current[jail.JID] = jail
+			}
+			for _, event := range diffJails(known, current, time.Now()) {
+				a.recordDockerEvent(event)
+				log.Printf("Jail event: %s %s %s", event.Action, event.Container, event.Image)
+			}
+			known = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const jlsOutput = `{"__version": "2", "jail-information": {"jail": [
+  {"jid":1,"hostname":"web.example.com","path":"/usr/local/jails/web","name":"web"},
+  {"jid":2,"hostname":"db.example.com","path":"/usr/local/jails/db","name":"db"}
+]}}`
+
+// TestJailDiff tests jls parsing and start/stop event generation
+func TestJailDiff(t *testing.T) {
+	jails, err := parseJLS([]byte(jlsOutput))
+	if err != nil {
+		t.Fatalf("Failed to parse jls output: %v", err)
+	}
+	if len(jails) != 2 || jails[0].Name != "web" {
+		t.Fatalf("Unexpected jails %+v", jails)
+	}
+
+	previous := map[int]JailInfo{1: jails[0], 3: {JID: 3, Name: "old"}}
+	current := map[int]JailInfo{1: jails[0], 2: jails[1]}
+
+	events := diffJails(previous, current, time.Now())
+	actions := make(map[string]string)
+	for _, event := range events {
+		if event.Type != "jail" {
+			t.Errorf("Expected jail event type, got %q", event.Type)
+		}
+		actions[event.Container] = event.Action
+	}
+	if len(events) != 2 || actions["db"] != "start" || actions["old"] != "stop" {
+		t.Errorf("Unexpected jail events %+v", events)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Values accepted by --auth-source
+var authSourceModes = map[string]bool{"auto": true, "file": true, "journald": true, "none": true}
+
+// Journal identifiers whose messages carry authentication failures
+var journaldIdentifiers = []string{"sshd", "sudo", "su", "login"}
+
+// PAM failure lines, e.g. "pam_unix(sudo:auth): authentication failure; ... rhost=10.0.0.5"
+var pamFailurePattern = regexp.MustCompile(`authentication failure;.*?(?:rhost=(\S*))?(?:\s|$)`)
+
+// sshd failure lines, shared with auth.log parsing
+var sshdFailurePattern = regexp.MustCompile(`Failed password for .* from (\d+\.\d+\.\d+\.\d+)`)
+
+// journaldArgs builds a journalctl invocation following new entries from the auth identifiers
+func journaldArgs() []string {
+	args := []string{"--follow", "--output=json", "--lines=0", "--no-pager"}
+	for i, id := range journaldIdentifiers {
+		if i > 0 {
+			args = append(args, "+")
+		}
+		args = append(args, "SYSLOG_IDENTIFIER="+id)
+	}
+	return args
+}
+
+// journalEntry is the subset of a `journalctl -o json` record the agent uses.
+// MESSAGE is a string, or an array of bytes when it is not valid UTF-8.
+type journalEntry struct {
+	Message    json.RawMessage `json:"MESSAGE"`
+	Identifier string          `json:"SYSLOG_IDENTIFIER"`
+	Realtime   string          `json:"__REALTIME_TIMESTAMP"`
+}
+
+// message decodes MESSAGE in either of its JSON forms
+func (e *journalEntry) message() string {
+	var text string
+	if err := json.Unmarshal(e.Message, &text); err == nil {
+		return text
+	}
+	var raw []byte
+	var ints []int
+	if err := json.Unmarshal(e.Message, &ints); err == nil {
+		for _, b := range ints {
+			raw = append(raw, byte(b))
+		}
+	}
+	return string(raw)
+}
+
+// timestamp converts __REALTIME_TIMESTAMP (microseconds since the epoch)
+func (e *journalEntry) timestamp() time.Time {
+	if usec, err := strconv.ParseInt(e.Realtime, 10, 64); err == nil {
+		return time.UnixMicro(usec)
+	}
+	return time.Now()
+}
+
+// handleJournalLine records authentication failures from a journal entry.
+// sshd also emits a PAM line for each failed password, so only its
+// "Failed ..." line is counted.
+func (a *Agent) handleJournalLine(line string) {
+	var entry journalEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return
+	}
+	message := entry.message()
+
+	if entry.Identifier == "sshd" {
+		if matches := sshdFailurePattern.FindStringSubmatch(message); len(matches) > 1 {
+			a.recordAuthFailure(matches[1], entry.timestamp())
+		}
+		return
+	}
+
+	if matches := pamFailurePattern.FindStringSubmatch(message); matches != nil {
+		ip := matches[1]
+		if net.ParseIP(ip) == nil {
+			ip = "local"
+		}
+		a.recordAuthFailure(ip, entry.timestamp())
+	}
+}
+
+// setupJournaldMonitoring follows auth-related units in the systemd journal
+func (a *Agent) setupJournaldMonitoring() error {
+	journalctl, err := exec.LookPath("journalctl")
+	if err != nil {
+		return fmt.Errorf("journalctl not found: %w", err)
+	}
+
+	a.logSources = append(a.logSources, followCommand(a.handleJournalLine, journalctl, journaldArgs()...))
+	log.Printf("Monitoring systemd journal for %v authentication failures", journaldIdentifiers)
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestJournalParsing tests auth failure extraction from journalctl JSON output
+func TestJournalParsing(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.authFailures = agent.authFailures[:0]
+
+	lines := []string{
+		`{"SYSLOG_IDENTIFIER":"sshd","__REALTIME_TIMESTAMP":"1736937000000000","MESSAGE":"Failed password for root from 203.0.113.9 port 40022 ssh2"}`,
+		`{"SYSLOG_IDENTIFIER":"sshd","MESSAGE":"pam_unix(sshd:auth): authentication failure; logname= uid=0 euid=0 tty=ssh ruser= rhost=203.0.113.9  user=root"}`,
+		`{"SYSLOG_IDENTIFIER":"sudo","MESSAGE":"pam_unix(sudo:auth): authentication failure; logname=bob uid=1000 euid=0 tty=/dev/pts/0 ruser=bob rhost=  user=bob"}`,
+		`{"SYSLOG_IDENTIFIER":"sshd","MESSAGE":[65,99,99,101,112,116,101,100]}`,
+	}
+	for _, line := range lines {
+		agent.handleJournalLine(line)
+	}
+
+	if len(agent.authFailures) != 2 {
+		t.Fatalf("Expected 2 auth failures, got %+v", agent.authFailures)
+	}
+	if f := agent.authFailures[0]; f.IP != "203.0.113.9" || f.Timestamp.Year() != 2025 {
+		t.Errorf("Unexpected sshd failure %+v", f)
+	}
+	if f := agent.authFailures[1]; f.IP != "local" {
+		t.Errorf("Expected sudo failure counted as local, got %+v", f)
+	}
+
+	if _, err := NewAgent(Config{AuthSource: "syslog"}); err == nil {
+		t.Error("Expected invalid auth source to be rejected")
+	}
+}
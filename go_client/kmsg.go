@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Kernel log device; each read returns one record
+const kmsgPath = "/dev/kmsg"
+
+// Largest kernel log record, a read with a smaller buffer fails
+const kmsgRecordSize = 8192
+
+// Longest raw message kept in alert_details
+const kernelMessageMaxLen = 500
+
+// kernelErrorRule maps kernel messages to the kind in KERNEL_ERROR:<kind>
+type kernelErrorRule struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+// kernelErrorRules are the hardware and filesystem errors that tend to precede
+// outages, checked in order: filesystem messages often mention I/O errors too
+var kernelErrorRules = []kernelErrorRule{
+	// Machine check exceptions: CPU, cache and bus errors
+	{"mce", regexp.MustCompile(`(?i)machine check|\[Hardware Error\]`)},
+	// ECC memory errors and pages taken offline
+	{"memory", regexp.MustCompile(`EDAC \S+: \d+ (?:CE|UE) |Memory failure: `)},
+	{"fs_readonly", regexp.MustCompile(`(?i)remounting filesystem read-only|remounted read-only|forced readonly`)},
+	{"fs_error", regexp.MustCompile(`EXT[234]-fs error|XFS \(\S+\): (?:Corruption|Filesystem has been shut down)|BTRFS (?:error|critical)`)},
+	{"io", regexp.MustCompile(`I/O error|critical (?:medium|target) error|ata\d+(?:\.\d+)?: (?:failed command|exception Emask)|nvme\d+: I/O \d+ QID \d+ timeout`)},
+}
+
+// parseKmsgRecord returns the message of a /dev/kmsg record,
+// "<priority>,<sequence>,<usec>,<flags>;<message>", false for continuation
+// (" KEY=value") lines
+func parseKmsgRecord(record string) (string, bool) {
+	header, message, ok := strings.Cut(record, ";")
+	if !ok {
+		return "", false
+	}
+	priority, _, _ := strings.Cut(header, ",")
+	if _, err := strconv.Atoi(priority); err != nil {
+		return "", false
+	}
+	return message, true
+}
+
+// matchKernelError returns the kind of a kernel error message, if it is one
+func matchKernelError(message string) (string, bool) {
+	for _, rule := range kernelErrorRules {
+		if rule.pattern.MatchString(message) {
+			return rule.kind, true
+		}
+	}
+	return "", false
+}
+
+// handleKernelMessage raises KERNEL_ERROR:<kind> for hardware and filesystem
+// errors, keeping the latest raw message in alert_details
+func (a *Agent) handleKernelMessage(message string) {
+	kind, ok := matchKernelError(message)
+	if !ok {
+		return
+	}
+	alert := "KERNEL_ERROR:" + kind
+	if len(message) > kernelMessageMaxLen {
+		message = message[:kernelMessageMaxLen]
+	}
+
+	a.alertMutex.Lock()
+	raised := a.raiseAlert(alert)
+	a.alertStates[alert].Detail = message
+	a.alertMutex.Unlock()
+
+	if raised {
+		log.Printf("Kernel error (%s): %s", kind, message)
+	}
+}
+
+// kmsgFollower reads kernel log records and feeds each message to a handler
+type kmsgFollower struct {
+	file   io.ReadCloser
+	handle func(string)
+	done   chan struct{}
+}
+
+// followKmsg reads records from file in the background until it is closed
+func followKmsg(file io.ReadCloser, handle func(string)) *kmsgFollower {
+	f := &kmsgFollower{file: file, handle: handle, done: make(chan struct{})}
+	go f.run()
+	return f
+}
+
+func (f *kmsgFollower) run() {
+	defer reportPanic()
+	defer close(f.done)
+
+	buf := make([]byte, kmsgRecordSize)
+	for {
+		n, err := f.file.Read(buf)
+		// Records were overwritten before they were read; carry on from the oldest left
+		if errors.Is(err, syscall.EPIPE) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) && err != io.EOF {
+				log.Printf("Kernel log read failed: %v", err)
+			}
+			return
+		}
+		for _, record := range strings.Split(strings.TrimRight(string(buf[:n]), "\n"), "\n") {
+			if message, ok := parseKmsgRecord(record); ok {
+				f.handle(message)
+			}
+		}
+	}
+}
+
+// Close stops reading and waits for the follower to exit
+func (f *kmsgFollower) Close() error {
+	err := f.file.Close()
+	<-f.done
+	return err
+}
+
+// setupKernelErrorMonitoring follows /dev/kmsg for hardware and filesystem errors
+func (a *Agent) setupKernelErrorMonitoring() {
+	if !a.config.KernelErrors {
+		return
+	}
+	file, err := os.Open(kmsgPath)
+	if err != nil {
+		log.Printf("Warning: Failed to open %s, kernel error monitoring disabled: %v", kmsgPath, err)
+		return
+	}
+	// The ring buffer holds everything since boot; only new records matter
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		log.Printf("Warning: Failed to seek %s: %v", kmsgPath, err)
+	}
+	a.logSources = append(a.logSources, followKmsg(file, a.handleKernelMessage))
+	log.Printf("Monitoring kernel errors: %s", kmsgPath)
+}
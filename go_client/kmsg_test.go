@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMatchKernelError tests hardware and filesystem messages against their kinds
+func TestMatchKernelError(t *testing.T) {
+	cases := map[string]string{
+		`mce: [Hardware Error]: Machine check events logged`:                                               "mce",
+		`EDAC MC0: 1 CE memory read error on CPU_SrcID#0_Ha#0_Chan#1_DIMM#0 (channel:1 slot:0 page:0x0)`:   "memory",
+		`Memory failure: 0x12345: recovery action for dirty LRU page: Recovered`:                           "memory",
+		`blk_update_request: I/O error, dev sda, sector 123456 op 0x0:(READ) flags 0x0`:                    "io",
+		`ata1.00: exception Emask 0x0 SAct 0x0 SErr 0x0 action 0x0`:                                        "io",
+		`nvme0: I/O 512 QID 3 timeout, aborting`:                                                           "io",
+		`EXT4-fs (sda1): Remounting filesystem read-only`:                                                  "fs_readonly",
+		`BTRFS info (device sda1): forced readonly`:                                                        "fs_readonly",
+		`EXT4-fs error (device sda1): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0`: "fs_error",
+		`XFS (dm-0): metadata I/O error in "xfs_trans_read_buf_map" at daddr 0x2 len 1 error 5`:            "io",
+		`XFS (dm-0): Filesystem has been shut down due to log error (0x2).`:                                "fs_error",
+		`EXT4-fs (sda1): mounted filesystem with ordered data mode. Quota mode: none.`:                     "",
+		`EDAC MC0: Giving out device to module skx_edac controller Skylake Socket#0 IMC#0`:                 "",
+	}
+	for message, want := range cases {
+		if got, _ := matchKernelError(message); got != want {
+			t.Errorf("matchKernelError(%q) = %q, want %q", message, got, want)
+		}
+	}
+}
+
+// TestParseKmsgRecord tests record headers and continuation lines
+func TestParseKmsgRecord(t *testing.T) {
+	if message, ok := parseKmsgRecord("3,1024,5140900,-;EXT4-fs (sda1): Remounting filesystem read-only"); !ok || message != "EXT4-fs (sda1): Remounting filesystem read-only" {
+		t.Errorf("Unexpected message %q, %v", message, ok)
+	}
+	for _, record := range []string{" SUBSYSTEM=block", " DEVICE=+block:8;0", ""} {
+		if _, ok := parseKmsgRecord(record); ok {
+			t.Errorf("Expected %q not to be a record", record)
+		}
+	}
+}
+
+// TestKmsgFollower tests that records read raise KERNEL_ERROR with the raw message
+func TestKmsgFollower(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 100})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	follower := followKmsg(r, agent.handleKernelMessage)
+
+	w.WriteString("6,100,5140900,-;usb 1-1: new high-speed USB device number 2 using xhci_hcd\n")
+	w.WriteString("3,101,5140950,-;blk_update_request: I/O error, dev sdb, sector 2048 op 0x1:(WRITE)\n SUBSYSTEM=block\n DEVICE=+block:8:16\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		agent.alertMutex.Lock()
+		state := agent.alertStates["KERNEL_ERROR:io"]
+		agent.alertMutex.Unlock()
+		if state != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected KERNEL_ERROR:io")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := follower.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	payload, _ := agent.createPayload()
+	if alerts := strings.Join(payload.LocalAlerts, ","); alerts != "KERNEL_ERROR:io" {
+		t.Fatalf("Unexpected alerts %s", alerts)
+	}
+	if detail := payload.AlertDetails["KERNEL_ERROR:io"]; detail != "blk_update_request: I/O error, dev sdb, sector 2048 op 0x1:(WRITE)" {
+		t.Errorf("Unexpected detail %q", detail)
+	}
+}
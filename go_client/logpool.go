@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long a container's log stream is held while other containers wait
+const logStreamSlice = 30 * time.Second
+
+// logStreamFunc follows one container's logs from since (zero for the initial
+// tail) until ctx is cancelled or the stream ends, returning the position to
+// resume from
+type logStreamFunc func(ctx context.Context, id string, since time.Time) time.Time
+
+// logPool bounds how many container log streams run at once. Containers
+// beyond the limit wait in a FIFO queue. While any are waiting, a stream is
+// released after logStreamSlice and its container rejoins the back of the
+// queue, resuming from its last log timestamp, so every container gets a turn
+// and no lines are skipped. A limit of 0 streams every container at once.
+// Positions outlive a stream that ended, so a container that is restarted or
+// re-attached after a Docker reconnect carries on where it left off.
+type logPool struct {
+	limit    int
+	slice    time.Duration
+	stream   logStreamFunc
+	finished func(id string) // called with mu held once a container's stream has ended for good
+
+	mu      sync.Mutex
+	running int
+	waiting []string
+	known   map[string]bool      // queued or streaming
+	resume  map[string]time.Time // kept until Forget
+}
+
+// newLogPool creates a pool running at most limit streams
+func newLogPool(limit int, stream logStreamFunc, finished func(id string)) *logPool {
+	return &logPool{
+		limit:    limit,
+		slice:    logStreamSlice,
+		stream:   stream,
+		finished: finished,
+		known:    make(map[string]bool),
+		resume:   make(map[string]time.Time),
+	}
+}
+
+// Add schedules a container's logs to be followed. Containers already queued
+// or streaming are ignored, so repeated start events are harmless.
+func (p *logPool) Add(ctx context.Context, id string) {
+	p.mu.Lock()
+	if p.known[id] {
+		p.mu.Unlock()
+		return
+	}
+	p.known[id] = true
+	if p.limit > 0 && p.running >= p.limit {
+		p.waiting = append(p.waiting, id)
+		p.mu.Unlock()
+		return
+	}
+	p.running++
+	p.mu.Unlock()
+
+	go p.work(ctx, id)
+}
+
+// work streams id, then keeps taking queued containers until none are left
+func (p *logPool) work(ctx context.Context, id string) {
+	defer reportPanic()
+
+	for {
+		preempted := p.runSlice(ctx, id)
+
+		p.mu.Lock()
+		if preempted && ctx.Err() == nil {
+			p.waiting = append(p.waiting, id)
+		} else {
+			delete(p.known, id)
+			if p.finished != nil {
+				p.finished(id)
+			}
+		}
+		if ctx.Err() != nil || len(p.waiting) == 0 {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		id = p.waiting[0]
+		p.waiting = p.waiting[1:]
+		p.mu.Unlock()
+	}
+}
+
+// runSlice follows id until its stream ends or, while other containers are
+// waiting, for one time slice. Reports whether the stream was cut short.
+func (p *logPool) runSlice(ctx context.Context, id string) bool {
+	p.mu.Lock()
+	since := p.resume[id]
+	p.mu.Unlock()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var preempted bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(p.slice)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-streamCtx.Done():
+				return
+			case <-ticker.C:
+				if p.Waiting() > 0 {
+					preempted = true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	next := p.stream(streamCtx, id, since)
+	cancel()
+	wg.Wait()
+
+	if !next.IsZero() {
+		p.mu.Lock()
+		p.resume[id] = next
+		p.mu.Unlock()
+	}
+	return preempted
+}
+
+// Forget drops the resume position of a container that no longer exists
+func (p *logPool) Forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.known[id] {
+		delete(p.resume, id)
+	}
+}
+
+// Running returns the number of active streams
+func (p *logPool) Running() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// Waiting returns the number of containers queued for a stream
+func (p *logPool) Waiting() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiting)
+}
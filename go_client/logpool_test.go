@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLogPoolFairness tests that the pool caps concurrent streams, rotates
+// waiting containers through the slots and resumes each where it stopped
+func TestLogPoolFairness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	turns := make(map[string]int)
+	resumed := make(map[string]bool)
+	finished := make(map[string]bool)
+	ended := make(chan struct{})
+
+	stream := func(ctx context.Context, id string, since time.Time) time.Time {
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		turns[id]++
+		turn := turns[id]
+		if !since.IsZero() {
+			if since.Unix() != int64(turns[id]-1) {
+				t.Errorf("%s resumed from %v, expected position %d", id, since, turns[id]-1)
+			}
+			resumed[id] = true
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		if id == "c0" && turn == 2 {
+			return since // log stream ended (container stopped)
+		}
+		select {
+		case <-ctx.Done():
+		case <-ended:
+		}
+		return time.Unix(int64(turn), 0)
+	}
+
+	pool := newLogPool(2, stream, func(id string) {
+		mu.Lock()
+		finished[id] = true
+		mu.Unlock()
+	})
+	pool.slice = 10 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		pool.Add(ctx, fmt.Sprintf("c%d", i))
+	}
+	pool.Add(ctx, "c1") // duplicate start event
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(resumed) == 5 && finished["c0"]
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pool.Running() > 2 {
+		t.Errorf("Expected at most 2 streams, got %d", pool.Running())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	defer close(ended)
+	if maxActive > 2 {
+		t.Errorf("Expected at most 2 concurrent streams, saw %d", maxActive)
+	}
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("c%d", i)
+		if turns[id] < 2 {
+			t.Errorf("Expected %s to get repeated turns, got %d", id, turns[id])
+		}
+	}
+	if !finished["c0"] {
+		t.Error("Expected c0 to be finished after its stream ended")
+	}
+	if finished["c1"] {
+		t.Error("Expected preempted c1 not to be finished")
+	}
+}
+
+// TestLogPoolResumeAfterEnd tests that a container whose stream ended resumes
+// from its last position when added again, until it is forgotten
+func TestLogPoolResumeAfterEnd(t *testing.T) {
+	ctx := context.Background()
+	sinces := make(chan time.Time, 1)
+	finished := make(chan string, 1)
+	pool := newLogPool(1, func(ctx context.Context, id string, since time.Time) time.Time {
+		sinces <- since
+		return time.Unix(5, 0)
+	}, func(id string) { finished <- id })
+
+	for _, want := range []time.Time{{}, time.Unix(5, 0)} {
+		pool.Add(ctx, "c0")
+		if since := <-sinces; !since.Equal(want) {
+			t.Errorf("Expected stream from %v, got %v", want, since)
+		}
+		<-finished
+	}
+	pool.Forget("c0")
+	pool.Add(ctx, "c0")
+	if since := <-sinces; !since.IsZero() {
+		t.Errorf("Expected a forgotten container to start afresh, got %v", since)
+	}
+	<-finished
+}
@@ -22,23 +22,27 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
 
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -46,7 +50,6 @@ import (
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/fsnotify/fsnotify"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/mem"
@@ -55,21 +58,146 @@ import (
 
 // Configuration holds all configuration options
 type Config struct {
-	ServerURL            string
-	Secret               string
-	Interval             int
-	TailLines            int
-	AuthWindowSeconds    int
-	CPUSpikePct          float64
-	FailedAuthThreshold  int
-	BaselineSamples      int
-	SimulateAttack       bool
-	Env                  string
-	OwnerTeam            string
-	ServerID             string
-	MaxLogEntries        int
+	ConfigFile          string  `json:"config_file"`
+	Profile             string  `json:"profile"`
+	ServerURL           string  `json:"server_url"`
+	ServerFailover      string  `json:"server_failover"`
+	Secret              string  `json:"secret"`
+	SecretFile          string  `json:"secret_file"`
+	VaultAddr           string  `json:"vault_addr"`
+	VaultPath           string  `json:"vault_path"`
+	VaultField          string  `json:"vault_field"`
+	VaultTokenFile      string  `json:"vault_token_file"`
+	SecretRefresh       int     `json:"secret_refresh"`
+	KeyID               string  `json:"key_id"`
+	EnrollToken         string  `json:"enroll_token"`
+	CredentialsFile     string  `json:"credentials_file"`
+	RequireAck          bool    `json:"require_ack"`
+	GRPCAddr            string  `json:"grpc_addr"`
+	GRPCInsecure        bool    `json:"grpc_insecure"`
+	Compression         string  `json:"compression"`
+	BatchSize           int     `json:"batch_size"`
+	BatchMaxKB          int     `json:"batch_max_kb"`
+	ClientCert          string  `json:"client_cert"`
+	ClientKey           string  `json:"client_key"`
+	ServerCA            string  `json:"server_ca"`
+	TLSMinVersion       string  `json:"tls_min_version"`
+	ProxyURL            string  `json:"proxy_url"`
+	Interval            int     `json:"interval"`
+	BackfillRate        float64 `json:"backfill_rate"`
+	QueueDir            string  `json:"queue_dir"`
+	QueueMaxPayloads    int     `json:"queue_max_payloads"`
+	QueueMaxMB          int     `json:"queue_max_mb"`
+	QueueMaxAgeHours    int     `json:"queue_max_age_hours"`
+	HeartbeatInterval   int     `json:"heartbeat_interval"`
+	HeartbeatURL        string  `json:"heartbeat_url"`
+	TailLines           int     `json:"tail_lines"`
+	AuthWindowSeconds   int     `json:"auth_window_seconds"`
+	CPUSpikePct         float64 `json:"cpu_spike_pct"`
+	FailedAuthThreshold int     `json:"failed_auth_threshold"`
+	AlertWeights        string  `json:"alert_weights"`
+	AccessLogs          string  `json:"access_logs"`
+	IISLogs             string  `json:"iis_logs"`
+	HTTP5xxPct          float64 `json:"http_5xx_pct"`
+	HTTPMinRequests     int     `json:"http_min_requests"`
+	WebAttackThreshold  int     `json:"web_attack_threshold"`
+	UpstreamErrorPct    float64 `json:"upstream_error_pct"`
+	UpstreamSpikeFactor float64 `json:"upstream_spike_factor"`
+	CorrelationFields   string  `json:"correlation_fields"`
+
+	SlowQueryLogs        string  `json:"slow_query_logs"`
+	SlowQueryMinCount    int     `json:"slow_query_min_count"`
+	SlowQuerySpikeFactor float64 `json:"slow_query_spike_factor"`
+	InfraLogs            string  `json:"infra_logs"`
+	KernelErrors         bool    `json:"kernel_errors"`
+	DockerDaemonLog      string  `json:"docker_daemon_log"`
+	Probes               string  `json:"probes"`
+	ProbeInterval        int     `json:"probe_interval"`
+	ProbeTimeout         int     `json:"probe_timeout"`
+	ProbeFailures        int     `json:"probe_failures"`
+	SNMPFile             string  `json:"snmp_file"`
+	SNMPInterval         int     `json:"snmp_interval"`
+
+	BaselineSamples   int    `json:"baseline_samples"`
+	SimulateAttack    bool   `json:"simulate_attack"`
+	WarmupSeconds     int    `json:"warmup_seconds"`
+	Simulate          string `json:"simulate"`
+	AgentIDFile       string `json:"agent_id_file"`
+	AuthOffsetFile    string `json:"auth_offset_file"`
+	AuthLogs          string `json:"auth_logs"`
+	AuthLogFormat     string `json:"auth_log_format"`
+	AuthLogPattern    string `json:"auth_log_pattern"`
+	Env               string `json:"env"`
+	OwnerTeam         string `json:"owner_team"`
+	ServerID          string `json:"server_id"`
+	MaxLogEntries     int    `json:"max_log_entries"`
+	DedupeLogs        bool   `json:"dedupe_logs"`
+	MemoryBudgetMB    int    `json:"memory_budget_mb"`
+	MaxPayloadKB      int    `json:"max_payload_kb"`
+	LogWorkers        int    `json:"log_workers"`
+	AdminToken        string `json:"admin_token"`
+	HealthAddr        string `json:"health_addr"`
+	AuditLogPath      string `json:"audit_log"`
+	HealthToken       string `json:"health_token"`
+	HealthTLSCert     string `json:"health_tls_cert"`
+	HealthTLSKey      string `json:"health_tls_key"`
+	HealthClientCA    string `json:"health_client_ca"`
+	MaskRulesFile     string `json:"mask_rules_file"`
+	ParseRulesFile    string `json:"parse_rules_file"`
+	Detectors         string `json:"detectors"`
+	Hooks             string `json:"hooks"`
+	PIIMask           string `json:"pii_mask"`
+	MaskMode          string `json:"mask_mode"`
+	MaskHashKey       string `json:"mask_hash_key"`
+	FIPS              bool   `json:"fips"`
+	IntegrityManifest string `json:"integrity_manifest"`
+	IntegrityInterval int    `json:"integrity_interval"`
+	AuthSource        string `json:"auth_source"`
+	DryRun            bool   `json:"dry_run"`
+	Exporter          bool   `json:"exporter"`
+	OutputDir         string `json:"output_dir"`
+	OutputMaxFileMB   int    `json:"output_max_file_mb"`
+	OutputMaxFiles    int    `json:"output_max_files"`
+
+	SlackWebhook         string `json:"slack_webhook"`
+	SlackCriticalWebhook string `json:"slack_critical_webhook"`
+	SlackTemplate        string `json:"slack_template"`
+	SlackRepeatMinutes   int    `json:"slack_repeat_minutes"`
+	SlackMinSeverity     string `json:"slack_min_severity"`
+
+	DiscordWebhook         string `json:"discord_webhook"`
+	DiscordCriticalWebhook string `json:"discord_critical_webhook"`
+	DiscordRepeatMinutes   int    `json:"discord_repeat_minutes"`
+	DiscordTemplate        string `json:"discord_template"`
+	DiscordMinSeverity     string `json:"discord_min_severity"`
+
+	TeamsWebhook         string `json:"teams_webhook"`
+	TeamsCriticalWebhook string `json:"teams_critical_webhook"`
+	TeamsRepeatMinutes   int    `json:"teams_repeat_minutes"`
+	TeamsTemplate        string `json:"teams_template"`
+	TeamsMinSeverity     string `json:"teams_min_severity"`
+
+	NotifyTemplate     string `json:"notify_template"`
+	NotifyGroupSeconds int    `json:"notify_group_seconds"`
+	NotifyRateLimit    int    `json:"notify_rate_limit"`
+
+	SentryDSN            string `json:"sentry_dsn"`
+	SentryErrorThreshold int    `json:"sentry_error_threshold"`
 }
 
+// Buffer size limits
+const (
+	maxEventBuffer    = 100
+	maxAuthFailures   = 1000
+	maxQueuedPayloads = 50 // default --queue-max-payloads
+)
+
+// queueDir is the default --queue-dir, holding persisted payloads awaiting delivery
+var queueDir = filepath.Join(defaultDataDir(), "queue")
+
+// Shells whose execution inside a container raises SHELL_IN_CONTAINER
+var shellCommands = []string{"bash", "sh", "cmd.exe", "powershell", "pwsh"}
+
 // SystemMetrics represents system performance metrics
 type SystemMetrics struct {
 	CPUUsage     float64 `json:"cpu_usage"`
@@ -78,6 +206,18 @@ type SystemMetrics struct {
 	NetworkRX    uint64  `json:"network_rx_bytes_per_sec"`
 	NetworkTX    uint64  `json:"network_tx_bytes_per_sec"`
 	TCPConns     int     `json:"tcp_connections"`
+	// Access log summaries per container or log file, since the previous payload
+	HTTP []HTTPMetrics `json:"http,omitempty"`
+	// Slow query log summaries per database container or log file
+	SlowQueries []SlowQueryMetrics `json:"slow_queries,omitempty"`
+	// HAProxy and Envoy summaries per proxy source and backend
+	Upstreams []UpstreamMetrics `json:"upstreams,omitempty"`
+	// Metrics of --parse-rules-file parsers per source
+	LogMetrics []LogMetric `json:"log_metrics,omitempty"`
+	// Availability and latency of --probes endpoints
+	Probes []ProbeMetrics `json:"probes,omitempty"`
+	// Health and interface counters of --snmp-file devices
+	SNMP []SNMPDeviceMetrics `json:"snmp,omitempty"`
 }
 
 // DockerEvent represents a Docker event
@@ -94,20 +234,37 @@ type LogEntry struct {
 	Container string    `json:"container"`
 	Message   string    `json:"message"`
 	Timestamp time.Time `json:"timestamp"`
+	// Identical consecutive lines from a container are collapsed: Count is
+	// the number of occurrences and LastTimestamp the last one (both unset
+	// for a single line)
+	Count         int       `json:"count,omitempty"`
+	LastTimestamp time.Time `json:"last_timestamp,omitzero"`
+	// Fields extracted by a --parse-rules-file parser
+	Fields map[string]any `json:"fields,omitempty"`
 }
 
 // Payload represents the complete monitoring payload
 type Payload struct {
-	Host         string         `json:"host"`
-	ServerID     string         `json:"server_id,omitempty"`
-	Env          string         `json:"env,omitempty"`
-	OwnerTeam    string         `json:"owner_team,omitempty"`
-	Timestamp    time.Time      `json:"timestamp"`
-	Metrics      SystemMetrics  `json:"metrics"`
-	DockerEvents []DockerEvent  `json:"docker_events"`
-	Logs         []LogEntry     `json:"logs"`
-	LocalAlerts  []string       `json:"local_alerts"`
-	Score        float64        `json:"score"`
+	ID                  string              `json:"payload_id"`
+	AgentVersion        string              `json:"agent_version"`
+	Host                string              `json:"host"`
+	ServerID            string              `json:"server_id,omitempty"`
+	MachineID           string              `json:"machine_id,omitempty"`
+	Env                 string              `json:"env,omitempty"`
+	OwnerTeam           string              `json:"owner_team,omitempty"`
+	Timestamp           time.Time           `json:"timestamp"`
+	Backfill            bool                `json:"backfill,omitempty"` // delivered from the queue, Timestamp is when it was collected
+	Metrics             SystemMetrics       `json:"metrics"`
+	DockerEvents        []DockerEvent       `json:"docker_events"`
+	SecurityEvents      []SecurityEvent     `json:"security_events,omitempty"`
+	Logs                []LogEntry          `json:"logs"`
+	LocalAlerts         []string            `json:"local_alerts"`
+	AlertDetails        map[string]string   `json:"alert_details,omitempty"`
+	AlertCorrelationIDs map[string][]string `json:"alert_correlation_ids,omitempty"`
+	Score               float64             `json:"score"`
+	AgentStats          *AgentStats         `json:"agent_stats,omitempty"`
+	Simulation          []string            `json:"simulation,omitempty"`
+	Overflow            *PayloadOverflow    `json:"overflow,omitempty"`
 }
 
 // HealthStatus represents health endpoint response
@@ -119,9 +276,30 @@ type HealthStatus struct {
 
 // MetricsStatus represents metrics endpoint response
 type MetricsStatus struct {
-	CPU         float64  `json:"cpu_usage"`
-	Memory      float64  `json:"memory_usage"`
-	LocalAlerts []string `json:"local_alerts"`
+	CPU         float64    `json:"cpu_usage"`
+	Memory      float64    `json:"memory_usage"`
+	CollectedAt time.Time  `json:"collected_at"`
+	LocalAlerts []string   `json:"local_alerts"`
+	Agent       AgentStats `json:"agent"`
+}
+
+// Alert delivery states
+const (
+	AlertStatePending   = "pending"
+	AlertStateDelivered = "delivered"
+)
+
+// AlertState tracks the lifecycle of a local alert
+type AlertState struct {
+	Alert         string    `json:"alert"`
+	State         string    `json:"state"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	LastDelivered time.Time `json:"last_delivered,omitempty"`
+	Count         int       `json:"count"`
+	Detail        string    `json:"detail,omitempty"`
+	// Request IDs of recent requests behind the alert, to find them in traces
+	CorrelationIDs []string `json:"correlation_ids,omitempty"`
 }
 
 // CPUSample represents a CPU usage sample for baseline calculation
@@ -142,15 +320,29 @@ type Agent struct {
 	dockerClient *client.Client
 	httpClient   *http.Client
 	startTime    time.Time
+	warmupUntil  time.Time // detectors build baselines but don't alert until then
 	lastSendOK   time.Time
 	
 	// Data buffers
 	eventBuffer []DockerEvent
 	logBuffer   []LogEntry
+	eventBytes  int64 // accounted against liveMemory, guarded by eventMutex
+	logBytes    int64 // guarded by logMutex
+
+	// Each container's latest log entry, as a position counted over every
+	// entry ever buffered; logBase is the position of logBuffer[0]. Used to
+	// collapse repeated lines (--dedupe-logs), guarded by logMutex.
+	lastLog map[string]int64
+	logBase int64
+
+	// Byte budgets for the event and log buffers and for the payload queue (--memory-budget-mb)
+	liveMemory  *memoryBudget
+	queueMemory *memoryBudget
 	
 	// Security monitoring
 	authFailures []AuthFailure
 	localAlerts  []string
+	alertStates  map[string]*AlertState
 	
 	// CPU baseline tracking
 	cpuSamples []CPUSample
@@ -165,37 +357,191 @@ type Agent struct {
 	lastNetStats map[string]psnet.IOCountersStat
 	lastNetTime  time.Time
 	netMutex     sync.RWMutex
+
+	// Metrics from the last payload interval, served by /metrics so scrapes
+	// don't sample the CPU or feed the baseline themselves
+	lastMetrics   SystemMetrics
+	lastMetricsAt time.Time
+	metricsMutex  sync.RWMutex
 	
 	// Queue for failed requests
 	payloadQueue []Payload
+	queueBytes   int64 // accounted against queueMemory
 	queueMutex   sync.Mutex
+	backfillMutex sync.Mutex // one queued payload is delivered at a time, oldest first
+
+	// Live payloads waiting to be sent together with --batch-size, and their
+	// encoded size; batchUnsupported is set once the server turns batches away
+	batch            []batchedPayload
+	batchBytes       int
+	batchMutex       sync.Mutex
+	batchUnsupported atomic.Bool
+	// Queue files and the file each queued payload is persisted in; a file
+	// is removed once every payload in it has been acknowledged
+	queueFiles map[string]int
+	queuedIn   map[string]string
+	// Set once the server has sent a valid ack; from then on one is required
+	ackSeen atomic.Bool
 	
 	// Health server
 	healthServer *http.Server
 	
-	// File watcher for auth logs
-	authWatcher *fsnotify.Watcher
+	// Followed log sources (auth log, journal, event logs, kernel log), closed on shutdown
+	logSources []io.Closer
+	
+	// SELinux/AppArmor denials since the last payload, and per-alert reason counts
+	securityEvents []SecurityEvent
+	denialCounts   map[string]map[string]int
+	
+	// Sensitive data masking rules
+	masker *masker
+
+	// User-defined log parsers and their metrics since the last payload
+	pipeline *logPipeline
+	
+	// Masked credential counts per container and rule since last delivery
+	secretHits map[string]map[string]int
+
+	// Access log requests per source since the last payload
+	accessLogs *accessLogStats
+
+	// Slow queries per source since the last payload, and their recent rates
+	slowQueries *slowQueryStats
+
+	// HAProxy and Envoy requests per backend since the last payload, and recent error rates
+	proxyLogs *proxyLogStats
+
+	// Finds request IDs in access log lines for the alerts they raise
+	correlation *correlationExtractor
+
+	// Checks --probes endpoints; nil without any
+	probes *probeRunner
+
+	// Polls --snmp-file devices; nil without any
+	snmp *snmpPoller
+
+	// Picks the --server-url endpoint payloads are POSTed to
+	servers *serverEndpoints
+
+	// Re-reads the secret from --secret-file or Vault; nil when it is given
+	// directly or replaced by enrollment credentials
+	signingSecret *secretSource
+
+	// External --detectors, and the score weights of alert types they raise
+	// (guarded by alertMutex)
+	detectors       []Detector
+	detectorWeights map[string]float64
+
+	// Score weights of alert types: the built-in ones with --alert-weights
+	// applied
+	scoreWeights map[string]float64
+
+	// Finds failed logins in followed auth log lines (--auth-log-pattern)
+	authMatcher *authLineMatcher
+
+	// Lua --hooks script; nil without one
+	hooks *luaHooks
+	
+	// Agent self-metrics
+	selfMetrics *SelfMetrics
+	
+	// Containers with an active log monitor, keyed by container ID
+	monitoredContainers map[string]*MonitoredContainer
+	monitoredMutex      sync.RWMutex
+
+	// Settings from containers' richardops.* labels, keyed by container ID
+	// (guarded by monitoredMutex)
+	containerLabels map[string]ContainerLabels
+
+	// Bounds concurrent container log streams (--log-workers)
+	logPool *logPool
+	
+	// Recent agent-internal events for the admin API
+	agentEvents *eventRing
+
+	// Synthetic scenarios injected each interval (--simulate)
+	simulations []simulationScenario
+
+	// Host identity reported with server_id, which distinguishes duplicate hostnames
+	machineID string
+
+	// Recently sent payloads for diagnostic bundles
+	recentPayloads []Payload
+	recentMutex    sync.Mutex
+	
+	// Hash-chained audit log of security-relevant activity
+	auditLog *auditLog
 	
-	// Sensitive data patterns
-	sensitivePatterns []*regexp.Regexp
+	// Install-time hashes of the agent binary and config files
+	integrity *IntegrityManifest
 	
-	// Fixed: Auth log file offset tracking to avoid re-parsing entire files
-	authLogOffsets map[string]int64
-	offsetMutex    sync.RWMutex
+	// Local file output used instead of the server in offline mode
+	offline *offlineWriter
+
+	// Last payload, served on /metrics and /alerts in exporter mode
+	exported exportedPayloads
+
+	// gRPC transport (--grpc-addr) and the remote commands it receives
+	stream   *streamClient
+	commands chan Command
+	// --interval pushed by the server with set_config, 0 until then
+	pushedInterval atomic.Int64
+
+	// Chat notifications of local alerts (Slack, Discord, Teams)
+	notifiers []*alertNotifier
 }
 
-// Alert scoring weights
+// Built-in alert scoring weights; --alert-weights overrides them
 var alertWeights = map[string]float64{
-	"CPU_SPIKE":           0.4,
-	"BRUTE_FORCE":         0.5,
-	"SHELL_IN_CONTAINER":  0.6,
-	"HTTP_5XX_SPIKE":      0.25,
+	"CPU_SPIKE":                  0.4,
+	"BRUTE_FORCE":                0.5,
+	"SHELL_IN_CONTAINER":         0.6,
+	"HTTP_5XX_SPIKE":             0.25,
+	"SECRET_IN_LOGS":             0.3,
+	"AGENT_TAMPERED":             0.8,
+	"NEW_SERVICE":                0.5,
+	"SELINUX_DENIAL":             0.3,
+	"APPARMOR_DENIAL":            0.4,
+	"WEB_ATTACK":                 0.5,
+	"UPSTREAM_ERROR_SPIKE":       0.3,
+	"SLOW_QUERY_SPIKE":           0.25,
+	"REDIS_OOM":                  0.3,
+	"REDIS_PERSISTENCE":          0.3,
+	"RABBITMQ_ALARM":             0.35,
+	"RABBITMQ_PARTITION":         0.4,
+	"KAFKA_UNDER_REPLICATED":     0.25,
+	"KAFKA_BROKER_ERROR":         0.4,
+	"KERNEL_ERROR":               0.5,
+	"DOCKER_STORAGE_ERROR":       0.4,
+	"DOCKER_LIVE_RESTORE_FAILED": 0.35,
+	"DOCKER_API_THROTTLED":       0.2,
+	"PROBE_FAILED":               0.4,
+	"SNMP_UNREACHABLE":           0.3,
+	"INTERFACE_DOWN":             0.3,
+	"UPS_ON_BATTERY":             0.4,
+	"UPS_BATTERY_LOW":            0.6,
 }
 
 // NewAgent creates a new monitoring agent
 func NewAgent(config Config) (*Agent, error) {
 	var dockerClient *client.Client
 	var err error
+
+	// Read --secret-file or Vault before anything checks the secret
+	signingSecret, err := newSecretSource(config)
+	if err != nil {
+		return nil, err
+	}
+	if signingSecret != nil {
+		config.Secret = signingSecret.current()
+	}
+	
+	if err := checkFIPSMode(config); err != nil {
+		return nil, err
+	}
+	if config.AuthSource != "" && !authSourceModes[config.AuthSource] {
+		return nil, fmt.Errorf("invalid auth source %q (auto, file, journald or none)", config.AuthSource)
+	}
 	
 	// Try to create Docker client, but don't fail if Docker is not available
 	dockerClient, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -204,14 +550,82 @@ func NewAgent(config Config) (*Agent, error) {
 		dockerClient = nil
 	}
 
-	httpClient := &http.Client{
-		Timeout: 30 * time.Second,
+	httpClient, err := newServerHTTPClient(config, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if config.ProxyURL != "" {
+		log.Printf("Sending through proxy %s", redactURL(config.ProxyURL))
+	}
+
+	// Enrolled agents sign with their own credentials instead of --secret
+	config, err = applyCredentials(httpClient, config)
+	if err != nil {
+		return nil, err
+	}
+	if signingSecret != nil && config.Secret != signingSecret.current() {
+		signingSecret = nil
+	}
+
+	if err := checkCompression(config.Compression); err != nil {
+		return nil, err
+	}
+	weights, err := scoreWeights(config.AlertWeights)
+	if err != nil {
+		return nil, err
+	}
+	authMatcher, err := newAuthLogParser(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile sensitive data masking rules
+	dataMasker, err := buildMasker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := loadLogPipeline(config.ParseRulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	probes, err := parseProbes(config.Probes)
+	if err != nil {
+		return nil, err
+	}
+	if len(probes) > 0 && config.ProbeInterval <= 0 {
+		return nil, fmt.Errorf("--probe-interval must be positive")
+	}
+	snmpDevices, err := loadSNMPDevices(config.SNMPFile, config.FIPS)
+	if err != nil {
+		return nil, err
+	}
+	if len(snmpDevices) > 0 && config.SNMPInterval <= 0 {
+		return nil, fmt.Errorf("--snmp-interval must be positive")
+	}
+
+	detectors, err := loadDetectors(config.Detectors)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := loadHooks(config.Hooks)
+	if err != nil {
+		return nil, fmt.Errorf("hooks %s: %w", config.Hooks, err)
+	}
+	if hooks != nil && hooks.collect != nil {
+		detectors = append(detectors, hooks)
+	}
+
+	simulations, err := parseSimulations(simulationSpec(config))
+	if err != nil {
+		return nil, err
 	}
 
-	// Compile sensitive data patterns
-	patterns := []*regexp.Regexp{
-		regexp.MustCompile(`(?i)(password|token|secret|key|auth)=([^\s&]+)`),
-		regexp.MustCompile(`(?i)"(password|token|secret|key|auth)"\s*:\s*"([^"]+)"`),
+	// Without --server-id, identify the agent by a UUID persisted on first run
+	config.ServerID, err = resolveServerID(config)
+	if err != nil {
+		return nil, err
 	}
 
 	agent := &Agent{
@@ -221,161 +635,184 @@ func NewAgent(config Config) (*Agent, error) {
 		startTime:         time.Now(),
 		eventBuffer:       make([]DockerEvent, 0, 100),
 		logBuffer:         make([]LogEntry, 0, config.MaxLogEntries),
+		lastLog:           make(map[string]int64),
 		authFailures:      make([]AuthFailure, 0, 1000),
 		localAlerts:       make([]string, 0),
+		alertStates:       make(map[string]*AlertState),
 		cpuSamples:        make([]CPUSample, 0, config.BaselineSamples),
 		lastNetStats:      make(map[string]psnet.IOCountersStat),
 		lastNetTime:       time.Now(),
 		payloadQueue:      make([]Payload, 0),
-		sensitivePatterns: patterns,
-		authLogOffsets:    make(map[string]int64),
+		queueFiles:        make(map[string]int),
+		queuedIn:          make(map[string]string),
+		masker:            dataMasker,
+		pipeline:          pipeline,
+		secretHits:        make(map[string]map[string]int),
+		accessLogs:        newAccessLogStats(),
+		slowQueries:       newSlowQueryStats(),
+		proxyLogs:         newProxyLogStats(),
+		correlation:       newCorrelationExtractor(config.CorrelationFields),
+		detectors:         detectors,
+		detectorWeights:   make(map[string]float64),
+		scoreWeights:      weights,
+		authMatcher:       authMatcher,
+		hooks:             hooks,
+		denialCounts:      make(map[string]map[string]int),
+		selfMetrics:       NewSelfMetrics(),
+		monitoredContainers: make(map[string]*MonitoredContainer),
+		containerLabels:     make(map[string]ContainerLabels),
+		agentEvents:         newEventRing(maxAgentEvents),
+		simulations:         simulations,
+		machineID:           machineID(),
+		signingSecret:       signingSecret,
+		servers:             newServerEndpoints(config.ServerURL, config.ServerFailover),
+	}
+
+	agent.liveMemory, agent.queueMemory = newMemoryBudgets(config.MemoryBudgetMB)
+	agent.logPool = newLogPool(config.LogWorkers, agent.streamContainerLogs, agent.logStreamFinished)
+	if len(probes) > 0 {
+		agent.probes = newProbeRunner(probes, time.Duration(config.ProbeTimeout)*time.Second)
+	}
+	if len(snmpDevices) > 0 {
+		agent.snmp = newSNMPPoller(snmpDevices, snmpTimeout)
+	}
+
+	// Simulated incidents are expected to alert straight away
+	if config.WarmupSeconds > 0 && len(simulations) == 0 {
+		agent.warmupUntil = agent.startTime.Add(time.Duration(config.WarmupSeconds) * time.Second)
+	}
+
+	// Open audit log before anything can raise alerts
+	if config.AuditLogPath != "" {
+		auditLog, err := openAuditLog(config.AuditLogPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		agent.auditLog = auditLog
+		agent.audit(AuditAgentStarted, "", "pid %d", os.Getpid())
+		agent.audit(AuditConfigApplied, "", "effective config %s", agent.configFingerprint())
+	}
+
+	// Verify the agent has not been modified since install
+	if config.IntegrityManifest != "" {
+		manifest, err := loadIntegrityManifest(config.IntegrityManifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load integrity manifest: %w", err)
+		}
+		agent.integrity = manifest
+		agent.checkIntegrity()
+	}
+
+	// Offline mode writes payloads locally instead of sending them
+	if config.ServerURL == "" && config.GRPCAddr == "" && config.OutputDir != "" && !config.DryRun && !config.Exporter {
+		writer, err := newOfflineWriter(config.OutputDir, config.OutputMaxFileMB, config.OutputMaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output directory: %w", err)
+		}
+		agent.offline = writer
+	}
+
+	// Payloads are streamed over gRPC instead of POSTed with --grpc-addr
+	if config.GRPCAddr != "" && !config.DryRun && !config.Exporter && agent.offline == nil {
+		agent.stream, err = newStreamClient(agent)
+		if err != nil {
+			return nil, err
+		}
+		agent.commands = make(chan Command)
+	}
+
+	// Local alerts are posted to Slack directly, with or without a server
+	if !config.DryRun {
+		agent.notifiers, err = newAlertNotifiers(config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Create queue directory
-	if err := os.MkdirAll("./queue", 0755); err != nil {
+	if err := os.MkdirAll(agent.queueDirectory(), 0755); err != nil {
 		log.Printf("Warning: Failed to create queue directory: %v", err)
 	}
 
-	// Load persisted payloads
-	if err := agent.loadPersistedPayloads(); err != nil {
-		log.Printf("Warning: Failed to load persisted payloads: %v", err)
+	// Load persisted payloads (left on disk in dry-run and exporter mode, which never send)
+	if !config.DryRun && !config.Exporter {
+		if err := agent.loadPersistedPayloads(); err != nil {
+			log.Printf("Warning: Failed to load persisted payloads: %v", err)
+		}
 	}
 
-	// Setup auth log monitoring
-	if err := agent.setupAuthLogMonitoring(); err != nil {
+	// Setup auth log (or Windows event log) monitoring
+	if err := agent.setupPlatformAuthMonitoring(); err != nil {
 		log.Printf("Warning: Failed to setup auth log monitoring: %v", err)
 	}
+	agent.setupAccessLogMonitoring()
+	agent.setupIISLogMonitoring()
+	agent.setupSlowQueryLogMonitoring()
+	agent.setupInfraLogMonitoring()
+	agent.setupDockerDaemonMonitoring()
+	agent.setupParsedFileMonitoring()
 
 	// Setup health server
-	agent.setupHealthServer()
+	if err := agent.setupHealthServer(); err != nil {
+		return nil, fmt.Errorf("failed to start health server: %w", err)
+	}
 
 	return agent, nil
 }
 
-// setupAuthLogMonitoring sets up file watching for auth logs
-func (a *Agent) setupAuthLogMonitoring() error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
+// setupAuthLogMonitoring follows every --auth-logs file or, without them, the
+// first auth log found in paths, across rotations
+func (a *Agent) setupAuthLogMonitoring(paths []string) error {
+	if configured := configuredAuthLogs(a.config); len(configured) > 0 {
+		return a.followAuthLogs(configured)
 	}
-	a.authWatcher = watcher
-
-	// Try common auth log paths
-	authPaths := []string{"/var/log/auth.log", "/var/log/secure"}
-	var watchedPath string
-	
-	for _, path := range authPaths {
-		if _, err := os.Stat(path); err == nil {
-			if err := watcher.Add(path); err == nil {
-				watchedPath = path
-				log.Printf("Monitoring auth log: %s", path)
-				break
-			}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
 		}
-	}
-	
-	if watchedPath == "" {
-		log.Printf("Warning: No auth log found, security monitoring disabled")
-		return nil
+		return a.followAuthLog(path, a.config.AuthOffsetFile)
 	}
 
-	// Start monitoring goroutine
-	go a.monitorAuthLog(watchedPath)
-	
+	log.Printf("Warning: No auth log found, security monitoring disabled")
 	return nil
 }
 
-// monitorAuthLog monitors auth log for failed login attempts
-func (a *Agent) monitorAuthLog(logPath string) {
-	// Read existing log entries first
-	a.parseAuthLogFile(logPath)
-	
-	for {
-		select {
-		case event, ok := <-a.authWatcher.Events:
-			if !ok {
-				return
-			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				a.parseAuthLogFile(logPath)
-			}
-		case err, ok := <-a.authWatcher.Errors:
-			if !ok {
-				return
-			}
-			log.Printf("Auth log watcher error: %v", err)
-		}
+// parseAuthLogLine records a failed login from an sshd syslog line
+func (a *Agent) parseAuthLogLine(line string) {
+	if matches := sshdFailurePattern.FindStringSubmatch(line); len(matches) > 1 {
+		a.recordAuthFailure(matches[1], time.Now()) // Using current time for new failures
 	}
 }
 
-// Fixed: parseAuthLogFile now tracks file offset to avoid re-parsing entire files
-// Only processes new lines since last read, improving performance and avoiding duplicates
-func (a *Agent) parseAuthLogFile(logPath string) {
-	file, err := os.Open(logPath)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-
-	// Get file info to check size
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return
-	}
-	currentSize := fileInfo.Size()
-
-	// Get last known offset for this file
-	a.offsetMutex.RLock()
-	lastOffset := a.authLogOffsets[logPath]
-	a.offsetMutex.RUnlock()
-
-	// If file is smaller than last offset, it was rotated/truncated
-	if currentSize < lastOffset {
-		lastOffset = 0
-	}
-
-	// Seek to last known position
-	if _, err := file.Seek(lastOffset, 0); err != nil {
-		return
-	}
-
-	failedAuthPattern := regexp.MustCompile(`Failed password for .* from (\d+\.\d+\.\d+\.\d+)`)
-	scanner := bufio.NewScanner(file)
-	newOffset := lastOffset
-
-	// Process only new lines
-	for scanner.Scan() {
-		line := scanner.Text()
-		newOffset += int64(len(line)) + 1 // +1 for newline character
+// recordAuthFailure buffers a failed login for brute force detection
+func (a *Agent) recordAuthFailure(ip string, timestamp time.Time) {
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
 
-		if matches := failedAuthPattern.FindStringSubmatch(line); len(matches) > 1 {
-			ip := matches[1]
-			a.alertMutex.Lock()
-			a.authFailures = append(a.authFailures, AuthFailure{
-				IP:        ip,
-				Timestamp: time.Now(), // Using current time for new failures
-			})
-			// Keep buffer manageable
-			if len(a.authFailures) > 1000 {
-				a.authFailures = a.authFailures[100:]
-			}
-			a.alertMutex.Unlock()
-		}
+	a.authFailures = append(a.authFailures, AuthFailure{
+		IP:        ip,
+		Timestamp: timestamp,
+	})
+	// Keep buffer manageable
+	if len(a.authFailures) > maxAuthFailures {
+		a.authFailures = a.authFailures[100:]
 	}
-
-	// Update offset for this file
-	a.offsetMutex.Lock()
-	a.authLogOffsets[logPath] = newOffset
-	a.offsetMutex.Unlock()
 }
 
 // checkBruteForceAttacks checks for brute force attacks
 func (a *Agent) checkBruteForceAttacks() {
+	defer a.selfMetrics.Detector("brute_force").Since(time.Now())
+
 	a.alertMutex.Lock()
 	defer a.alertMutex.Unlock()
 
 	now := time.Now()
 	windowStart := now.Add(-time.Duration(a.config.AuthWindowSeconds) * time.Second)
+	// Failures seen during warm-up are mostly old log lines replayed on
+	// start, stamped with the time they were read; they never count
+	if windowStart.Before(a.warmupUntil) {
+		windowStart = a.warmupUntil
+	}
 	
 	// Count failures per IP in the window
 	ipCounts := make(map[string]int)
@@ -389,14 +826,64 @@ func (a *Agent) checkBruteForceAttacks() {
 	for ip, count := range ipCounts {
 		if count >= a.config.FailedAuthThreshold {
 			alert := fmt.Sprintf("BRUTE_FORCE:%s", ip)
-			if !a.containsAlert(alert) {
-				a.localAlerts = append(a.localAlerts, alert)
+			if a.raiseAlert(alert) {
 				log.Printf("Brute force detected from IP %s: %d failed attempts", ip, count)
 			}
 		}
 	}
 }
 
+// warmingUp reports whether the startup grace period is still running
+func (a *Agent) warmingUp() bool {
+	return time.Now().Before(a.warmupUntil)
+}
+
+// raiseAlert adds an alert to the pending set and updates its state.
+// Returns true if the alert was not already pending. Must be called with alertMutex held.
+func (a *Agent) raiseAlert(alert string) bool {
+	now := time.Now()
+	state, exists := a.alertStates[alert]
+	if !exists {
+		state = &AlertState{Alert: alert, FirstSeen: now}
+		a.alertStates[alert] = state
+	}
+	state.LastSeen = now
+	state.Count++
+	state.State = AlertStatePending
+
+	if a.containsAlert(alert) {
+		return false
+	}
+	a.localAlerts = append(a.localAlerts, alert)
+	a.recordEvent(EventDetectorFired, "", "%s raised", alert)
+	a.audit(AuditAlertRaised, "", "%s", alert)
+	return true
+}
+
+// markAlertsDelivered records that the given alerts reached the server and
+// forgets alerts that have not fired for an hour. Must be called with alertMutex held.
+func (a *Agent) markAlertsDelivered(alerts []string) {
+	now := time.Now()
+	for _, alert := range alerts {
+		if state, ok := a.alertStates[alert]; ok {
+			state.State = AlertStateDelivered
+			state.LastDelivered = now
+		}
+		if container, ok := strings.CutPrefix(alert, "SECRET_IN_LOGS:"); ok {
+			if state, ok := a.alertStates[alert]; ok {
+				state.Detail = a.alertDetail(alert, state)
+			}
+			delete(a.secretHits, container)
+		}
+		delete(a.denialCounts, alert)
+	}
+	for alert, state := range a.alertStates {
+		if state.State == AlertStateDelivered && now.Sub(state.LastSeen) > time.Hour {
+			delete(a.alertStates, alert)
+		}
+	}
+}
+
 // containsAlert checks if alert already exists
 func (a *Agent) containsAlert(alert string) bool {
 	for _, existing := range a.localAlerts {
@@ -409,9 +896,15 @@ func (a *Agent) containsAlert(alert string) bool {
 
 // updateCPUBaseline updates CPU baseline and checks for anomalies
 func (a *Agent) updateCPUBaseline(cpuUsage float64) {
+	defer a.selfMetrics.Detector("cpu_baseline").Since(time.Now())
+
 	a.cpuMutex.Lock()
 	defer a.cpuMutex.Unlock()
 
+	// Score the new sample against the baseline before adding it, so a
+	// spike doesn't inflate the statistics it is measured against
+	a.checkCPUSpike(cpuUsage)
+
 	// Add new sample
 	sample := CPUSample{
 		Value:     cpuUsage,
@@ -423,7 +916,11 @@ func (a *Agent) updateCPUBaseline(cpuUsage float64) {
 	if len(a.cpuSamples) > a.config.BaselineSamples {
 		a.cpuSamples = a.cpuSamples[1:]
 	}
-	
+}
+
+// checkCPUSpike raises CPU_SPIKE when cpuUsage is far above the current
+// baseline. Must be called with cpuMutex held.
+func (a *Agent) checkCPUSpike(cpuUsage float64) {
 	// Need at least 3 samples for meaningful statistics
 	if len(a.cpuSamples) < 3 {
 		return
@@ -447,9 +944,12 @@ func (a *Agent) updateCPUBaseline(cpuUsage float64) {
 		
 		// Check for CPU spike
 		if cpuUsage >= a.config.CPUSpikePct && zScore >= 3.0 {
+			if a.warmingUp() {
+				a.recordEvent(EventDetectorFired, "", "CPU_SPIKE suppressed during warm-up: %.2f%% (z-score: %.2f)", cpuUsage, zScore)
+				return
+			}
 			a.alertMutex.Lock()
-			if !a.containsAlert("CPU_SPIKE") {
-				a.localAlerts = append(a.localAlerts, "CPU_SPIKE")
+			if a.raiseAlert("CPU_SPIKE") {
 				log.Printf("CPU spike detected: %.2f%% (z-score: %.2f)", cpuUsage, zScore)
 			}
 			a.alertMutex.Unlock()
@@ -457,51 +957,9 @@ func (a *Agent) updateCPUBaseline(cpuUsage float64) {
 	}
 }
 
-// simulateAttack generates synthetic attack events for testing
-func (a *Agent) simulateAttack() {
-	if !a.config.SimulateAttack {
-		return
-	}
-	
-	log.Printf("Simulating attack events...")
-	
-	// Simulate brute force
-	a.alertMutex.Lock()
-	for i := 0; i < a.config.FailedAuthThreshold+5; i++ {
-		a.authFailures = append(a.authFailures, AuthFailure{
-			IP:        "192.0.2.1",
-			Timestamp: time.Now(),
-		})
-	}
-	a.alertMutex.Unlock()
-	
-	// Simulate CPU spike
-	a.cpuMutex.Lock()
-	for i := 0; i < 5; i++ {
-		a.cpuSamples = append(a.cpuSamples, CPUSample{
-			Value:     a.config.CPUSpikePct + 10,
-			Timestamp: time.Now(),
-		})
-	}
-	a.cpuMutex.Unlock()
-	
-	// Simulate shell in container
-	a.eventMutex.Lock()
-	a.eventBuffer = append(a.eventBuffer, DockerEvent{
-		Type:      "container",
-		Action:    "exec_create: /bin/bash",
-		Container: "test-container",
-		Image:     "test-image",
-		Timestamp: time.Now(),
-	})
-	a.eventMutex.Unlock()
-	
-	a.alertMutex.Lock()
-	a.localAlerts = append(a.localAlerts, "SHELL_IN_CONTAINER")
-	a.alertMutex.Unlock()
-}
-
-// collectSystemMetrics gathers system performance metrics
+// collectSystemMetrics gathers system performance metrics and feeds the CPU
+// baseline. Only the payload loop may call it; anything else reads
+// latestMetrics instead.
 func (a *Agent) collectSystemMetrics() (SystemMetrics, error) {
 	var metrics SystemMetrics
 
@@ -524,7 +982,7 @@ func (a *Agent) collectSystemMetrics() (SystemMetrics, error) {
 	}
 
 	// Disk usage (root partition)
-	diskInfo, err := disk.Usage("/")
+	diskInfo, err := disk.Usage(rootDiskPath())
 	if err != nil {
 		log.Printf("Error collecting disk metrics: %v", err)
 	} else {
@@ -578,96 +1036,249 @@ func (a *Agent) collectSystemMetrics() (SystemMetrics, error) {
 	return metrics, nil
 }
 
-// monitorDockerEvents listens for Docker events
+// isShellCommand reports whether an exec command starts a shell
+func isShellCommand(cmd string) bool {
+	cmd = strings.ToLower(cmd)
+	for _, shell := range shellCommands {
+		if strings.Contains(cmd, shell) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkShellExec raises SHELL_IN_CONTAINER when an exec runs a shell
+func (a *Agent) checkShellExec(container, cmd string) {
+	if !isShellCommand(cmd) {
+		return
+	}
+	a.alertMutex.Lock()
+	if a.raiseAlert("SHELL_IN_CONTAINER") {
+		log.Printf("Shell execution detected in container: %s (cmd: %s)", container, cmd)
+	}
+	a.alertMutex.Unlock()
+}
+
+// recordDockerEvent buffers a container (or jail) lifecycle event for the next payload
+func (a *Agent) recordDockerEvent(event DockerEvent) {
+	a.eventMutex.Lock()
+	defer a.eventMutex.Unlock()
+
+	var fits bool
+	a.eventBuffer, _, fits = admit(a.liveMemory, a.eventBuffer, &a.eventBytes, dockerEventSize(event), dockerEventSize)
+	if !fits {
+		return
+	}
+	a.eventBuffer = append(a.eventBuffer, event)
+	// Keep buffer size manageable
+	if len(a.eventBuffer) > maxEventBuffer {
+		a.eventBuffer = dropOldest(a.liveMemory, a.eventBuffer, &a.eventBytes, dockerEventSize)
+	}
+}
+
+// Delay before resubscribing after the Docker event stream fails, doubling
+// on each consecutive failure
+const (
+	dockerReconnectMin = time.Second
+	dockerReconnectMax = time.Minute
+)
+
+// monitorDockerEvents listens for Docker events. When the stream fails (e.g.
+// the daemon restarts) it resubscribes with backoff from the last event seen,
+// so nothing in between is missed, and re-attaches log monitors to running
+// containers, whose log streams ended with the old connection.
 func (a *Agent) monitorDockerEvents(ctx context.Context) {
+	defer reportPanic()
+
 	if a.dockerClient == nil {
 		log.Printf("Docker client not available, skipping Docker monitoring")
 		return
 	}
-	
-	eventChan, errChan := a.dockerClient.Events(ctx, types.EventsOptions{})
 
+	var since time.Time
+	delay := dockerReconnectMin
 	for {
+		subscribed := time.Now()
+		err := a.watchDockerEvents(ctx, &since)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error monitoring Docker events: %v (reconnecting in %v)", err, delay)
+		a.recordEvent(EventDockerError, "", "event stream error: %v", err)
+
+		// A stream that stayed up a while was healthy; start backing off afresh
+		if time.Since(subscribed) > dockerReconnectMax {
+			delay = dockerReconnectMin
+		}
 		select {
-		case event := <-eventChan:
-			if event.Type == events.ContainerEventType {
-				dockerEvent := DockerEvent{
-					Type:      string(event.Type),
-					Action:    string(event.Action),
-					Container: event.Actor.Attributes["name"],
-					Image:     event.Actor.Attributes["image"],
-					Timestamp: time.Unix(event.Time, 0),
-				}
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, dockerReconnectMax)
 
-				a.eventMutex.Lock()
-				a.eventBuffer = append(a.eventBuffer, dockerEvent)
-				// Keep buffer size manageable
-				if len(a.eventBuffer) > 100 {
-					a.eventBuffer = a.eventBuffer[1:]
-				}
-				a.eventMutex.Unlock()
-
-				log.Printf("Docker event: %s %s %s", dockerEvent.Action, dockerEvent.Container, dockerEvent.Image)
-
-				// Fixed: Check for shell execution by inspecting execCommand attribute instead of just action string
-				if event.Action == "exec_create" {
-					cmd := event.Actor.Attributes["execCommand"]
-					if strings.Contains(cmd, "bash") || strings.Contains(cmd, "sh") {
-						a.alertMutex.Lock()
-						if !a.containsAlert("SHELL_IN_CONTAINER") {
-							a.localAlerts = append(a.localAlerts, "SHELL_IN_CONTAINER")
-							log.Printf("Shell execution detected in container: %s (cmd: %s)", dockerEvent.Container, cmd)
-						}
-						a.alertMutex.Unlock()
-					}
-				}
+		if err := a.attachRunningContainers(ctx); err == nil {
+			log.Printf("Reconnected to Docker")
+		}
+	}
+}
 
-				// If it's a start event, start monitoring logs for this container
-				if event.Action == "start" {
-					go a.monitorContainerLogs(ctx, event.Actor.ID)
-				}
+// watchDockerEvents handles container events until the stream fails,
+// advancing since past each event received. Events from since onwards are
+// replayed by the daemon when since is set.
+func (a *Agent) watchDockerEvents(ctx context.Context, since *time.Time) error {
+	options := types.EventsOptions{}
+	if !since.IsZero() {
+		options.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+	eventChan, errChan := a.dockerClient.Events(ctx, options)
+
+	for {
+		select {
+		case event := <-eventChan:
+			if event.TimeNano != 0 {
+				*since = time.Unix(0, event.TimeNano).Add(time.Nanosecond)
+			}
+			if event.Type == events.ContainerEventType {
+				a.handleContainerEvent(ctx, event)
 			}
 		case err := <-errChan:
-			if err != nil {
-				log.Printf("Error monitoring Docker events: %v", err)
-				time.Sleep(5 * time.Second) // Wait before retrying
+			if err == nil {
+				err = io.EOF
 			}
-		case <-ctx.Done():
-			return
+			return err
 		}
 	}
 }
 
-// monitorContainerLogs monitors logs for a specific container
-// Fixed: Replace bytes.Buffer + ReadString with io.Pipe + bufio.Scanner to avoid race conditions
-func (a *Agent) monitorContainerLogs(ctx context.Context, containerID string) {
-	if a.dockerClient == nil {
-		return
+// handleContainerEvent records a container event and reacts to starts and execs
+func (a *Agent) handleContainerEvent(ctx context.Context, event events.Message) {
+	dockerEvent := DockerEvent{
+		Type:      string(event.Type),
+		Action:    string(event.Action),
+		Container: event.Actor.Attributes["name"],
+		Image:     event.Actor.Attributes["image"],
+		Timestamp: time.Unix(event.Time, 0),
 	}
-	
-	// Get container info
-	containerInfo, err := a.dockerClient.ContainerInspect(ctx, containerID)
-	if err != nil {
-		log.Printf("Error inspecting container %s: %v", containerID, err)
-		return
+
+	a.recordDockerEvent(dockerEvent)
+
+	log.Printf("Docker event: %s %s %s", dockerEvent.Action, dockerEvent.Container, dockerEvent.Image)
+
+	// Fixed: Check for shell execution by inspecting execCommand attribute instead of just action string
+	if event.Action == "exec_create" {
+		a.checkShellExec(dockerEvent.Container, event.Actor.Attributes["execCommand"])
+	}
+
+	switch event.Action {
+	case "start":
+		// If it's a start event, start monitoring logs for this container
+		a.monitorContainerLogs(ctx, event.Actor.ID)
+	case "destroy":
+		a.logPool.Forget(event.Actor.ID)
+		a.forgetContainerLabels(event.Actor.ID, dockerEvent.Container)
+	}
+}
+
+// attachRunningContainers starts log monitors for every running container.
+// Containers already being followed are left alone.
+func (a *Agent) attachRunningContainers(ctx context.Context) error {
+	containers, err := a.dockerClient.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		log.Printf("Error listing containers: %v", err)
+		return err
+	}
+	for _, container := range containers {
+		if container.State == "running" {
+			a.monitorContainerLogs(ctx, container.ID)
+		}
+	}
+	return nil
+}
+
+// scanBufferPool holds the initial line buffers of container log scanners
+var scanBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 64*1024)
+		return &buf
+	},
+}
+
+// monitorContainerLogs schedules a container's logs to be followed by the log
+// pool, unless its richardops.logs label turns them off
+func (a *Agent) monitorContainerLogs(ctx context.Context, containerID string) {
+	if a.dockerClient == nil {
+		return
+	}
+	if a.inspectContainerLabels(ctx, containerID).LogsOff {
+		return
+	}
+	a.logPool.Add(ctx, containerID)
+}
+
+// logStreamFinished forgets a container whose log stream has ended for good.
+// Called by the log pool with its lock held.
+func (a *Agent) logStreamFinished(containerID string) {
+	a.monitoredMutex.RLock()
+	monitored := a.monitoredContainers[containerID]
+	a.monitoredMutex.RUnlock()
+	if monitored == nil {
+		return
+	}
+	a.untrackContainer(containerID)
+	a.recordEvent(EventMonitorStopped, "", "log monitor stopped for %s", monitored.Name)
+}
+
+// streamContainerLogs follows a container's logs for the log pool, starting
+// with the last --tail-lines lines or, when since is set, from that time.
+// Returns the time to resume from, or since if the stream couldn't be opened.
+// Fixed: Replace bytes.Buffer + ReadString with io.Pipe + bufio.Scanner to avoid race conditions
+func (a *Agent) streamContainerLogs(ctx context.Context, containerID string, since time.Time) time.Time {
+	requested := since
+	resuming := !since.IsZero()
+	if !resuming {
+		since = time.Now()
+	}
+
+	// Get container info
+	containerInfo, err := a.dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		log.Printf("Error inspecting container %s: %v", containerID, err)
+		return requested
 	}
 
 	// Get initial logs
 	logOptions := types.ContainerLogsOptions{
 		ShowStdout: true,
 		ShowStderr: true,
-		Tail:       strconv.Itoa(a.config.TailLines),
+		Tail:       strconv.Itoa(a.tailLines(containerID)),
 		Follow:     true,
 		Timestamps: true,
 	}
+	if resuming {
+		// Resuming after yielding to another container, a restart or a Docker
+		// reconnect: no tail, nothing skipped
+		logOptions.Tail = ""
+		logOptions.Since = since.Format(time.RFC3339Nano)
+	}
 
 	logReader, err := a.dockerClient.ContainerLogs(ctx, containerID, logOptions)
 	if err != nil {
 		log.Printf("Error getting logs for container %s: %v", containerID, err)
-		return
+		return requested
 	}
 	defer logReader.Close()
 
+	a.monitoredMutex.RLock()
+	monitored := a.monitoredContainers[containerID]
+	a.monitoredMutex.RUnlock()
+	if monitored == nil {
+		monitored = a.trackContainer(containerID, containerInfo.Name, containerInfo.Config.Image)
+		a.recordEvent(EventMonitorStarted, "", "log monitor started for %s", monitored.Name)
+	}
+	monitored.streaming.Store(true)
+	defer monitored.streaming.Store(false)
+
 	// Fixed: Use io.Pipe with bufio.Scanner instead of bytes.Buffer + ReadString
 	pr, pw := io.Pipe()
 	go func() {
@@ -675,21 +1286,31 @@ func (a *Agent) monitorContainerLogs(ctx context.Context, containerID string) {
 		pw.CloseWithError(err)
 	}()
 
+	// Streams are reopened every log pool slice, so reuse their scan buffers
+	buf := scanBufferPool.Get().(*[]byte)
+	defer scanBufferPool.Put(buf)
 	scanner := bufio.NewScanner(pr)
-	scanner.Buffer(make([]byte, 64*1024), 1<<20) // 64KB initial, 1MB max
+	scanner.Buffer(*buf, 1<<20) // 64KB initial, 1MB max
 	
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return since
 		default:
 			if !scanner.Scan() {
-				if err := scanner.Err(); err != nil && err != io.EOF {
+				if err := scanner.Err(); err != nil && err != io.EOF && ctx.Err() == nil {
 					log.Printf("scan err %s: %v", containerID, err)
 				}
-				return
+				return since
 			}
-			a.processLogLine(containerInfo.Name, strings.TrimSpace(scanner.Text()))
+			monitored.linesRead.Add(1)
+			line := strings.TrimSpace(scanner.Text())
+			if ts, _, ok := strings.Cut(line, " "); ok {
+				if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+					since = t.Add(time.Nanosecond)
+				}
+			}
+			a.processLogLine(containerInfo.Name, line)
 		}
 	}
 }
@@ -701,56 +1322,110 @@ func (a *Agent) processLogLine(containerName, logMessage string) {
 	}
 	
 	// Mask sensitive data
-	maskedMessage := a.maskSensitiveData(logMessage)
-	
-	// Truncate if too long
-	if len(maskedMessage) > 1024 {
-		maskedMessage = maskedMessage[:1021] + "..."
+	maskedMessage, secretHits := a.masker.MaskWithHits(containerName, logMessage)
+	if secretHits != nil {
+		a.recordSecretHits(containerName, secretHits)
 	}
 	
+	// User-defined parsers turn the masked line into fields and metrics
+	fields, timestamp := a.pipeline.apply(strings.TrimPrefix(containerName, "/"), maskedMessage)
+
+	// Web server containers' access logs feed HTTP metrics, proxies'
+	// upstream metrics, database containers' slow query logs slow query
+	// metrics, and Redis, RabbitMQ and Kafka failures raise alerts. Request
+	// IDs come from the masked line or its parsed fields.
+	requestID := a.correlation.find(maskedMessage, fields)
+	a.accessLogs.observe(strings.TrimPrefix(containerName, "/"), logMessage, requestID)
+	a.proxyLogs.observe(strings.TrimPrefix(containerName, "/"), logMessage, requestID)
+	a.slowQueries.observe(strings.TrimPrefix(containerName, "/"), logMessage)
+	a.handleInfraLogLine(strings.TrimPrefix(containerName, "/"), logMessage)
+	
 	logEntry := LogEntry{
 		Container: containerName,
 		Message:   maskedMessage,
 		Timestamp: time.Now(),
+		Fields:    fields,
+	}
+	if !timestamp.IsZero() {
+		logEntry.Timestamp = timestamp
+	}
+	// Processors add, rename and shorten fields, truncate the message and
+	// drop unwanted lines
+	if !a.pipeline.process(strings.TrimPrefix(containerName, "/"), &logEntry) {
+		return
 	}
 
 	a.logMutex.Lock()
+	defer a.logMutex.Unlock()
+	if a.config.DedupeLogs && a.repeatLastLog(logEntry) {
+		return
+	}
+	var fits bool
+	var evicted []LogEntry
+	a.logBuffer, evicted, fits = admit(a.liveMemory, a.logBuffer, &a.logBytes, logEntrySize(logEntry), logEntrySize)
+	a.logBase += int64(len(evicted))
+	if !fits {
+		return
+	}
 	a.logBuffer = append(a.logBuffer, logEntry)
+	a.lastLog[containerName] = a.logBase + int64(len(a.logBuffer)-1)
 	// Keep buffer size manageable
 	if len(a.logBuffer) > a.config.MaxLogEntries {
-		a.logBuffer = a.logBuffer[1:]
+		a.logBuffer = dropOldest(a.liveMemory, a.logBuffer, &a.logBytes, logEntrySize)
+		a.logBase++
 	}
-	a.logMutex.Unlock()
+}
+
+// repeatLastLog folds entry into its container's latest buffered entry if
+// that has the same message, syslog "last message repeated" style. Must be
+// called with logMutex held.
+func (a *Agent) repeatLastLog(entry LogEntry) bool {
+	position, ok := a.lastLog[entry.Container]
+	if !ok || position < a.logBase {
+		return false
+	}
+	last := &a.logBuffer[position-a.logBase]
+	if last.Message != entry.Message {
+		return false
+	}
+	last.Count = max(last.Count, 1) + 1
+	last.LastTimestamp = entry.Timestamp
+	return true
 }
 
 // maskSensitiveData masks sensitive information in log messages
 func (a *Agent) maskSensitiveData(message string) string {
-	result := message
-	for _, pattern := range a.sensitivePatterns {
-		result = pattern.ReplaceAllString(result, "${1}=[REDACTED]")
-	}
-	return result
+	return a.masker.Mask("", message)
 }
 
 // calculateScore calculates alert score based on weights
 func (a *Agent) calculateScore(alerts []string) float64 {
 	var score float64
 	for _, alert := range alerts {
-		// Extract base alert type (remove IP suffix for BRUTE_FORCE)
-		alertType := alert
-		if strings.HasPrefix(alert, "BRUTE_FORCE:") {
-			alertType = "BRUTE_FORCE"
-		}
+		// Extract base alert type (remove IP/container suffix, e.g. BRUTE_FORCE:<ip>)
+		alertType, _, _ := strings.Cut(alert, ":")
 		
-		if weight, exists := alertWeights[alertType]; exists {
+		if weight, exists := a.alertWeight(alertType); exists {
 			score += weight
+		} else {
+			score += a.detectorWeights[alertType]
 		}
 	}
 	return score
 }
 
+// latestMetrics returns the metrics collected for the last payload and when
+// they were taken (zero before the first interval)
+func (a *Agent) latestMetrics() (SystemMetrics, time.Time) {
+	a.metricsMutex.RLock()
+	defer a.metricsMutex.RUnlock()
+	return a.lastMetrics, a.lastMetricsAt
+}
+
 // createPayload creates a monitoring payload
 func (a *Agent) createPayload() (Payload, error) {
+	defer a.selfMetrics.PayloadBuild.Since(time.Now())
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown"
@@ -761,16 +1436,28 @@ func (a *Agent) createPayload() (Payload, error) {
 		log.Printf("Error collecting system metrics: %v", err)
 	}
 
+	// Inject simulated scenarios if enabled, before detection runs on them
+	a.simulateAttack()
+	a.simulateMetrics(&metrics)
+	a.metricsMutex.Lock()
+	a.lastMetrics, a.lastMetricsAt = metrics, time.Now()
+	a.metricsMutex.Unlock()
+
 	// Check for security alerts
 	a.checkBruteForceAttacks()
-	
-	// Simulate attack if enabled
-	a.simulateAttack()
+	metrics.HTTP = a.collectHTTPMetrics()
+	metrics.SlowQueries = a.collectSlowQueryMetrics()
+	metrics.Upstreams = a.collectUpstreamMetrics()
+	metrics.LogMetrics = a.pipeline.take()
+	metrics.Probes = a.collectProbeMetrics()
+	metrics.SNMP = a.collectSNMPMetrics()
 
 	// Copy current events and logs
 	a.eventMutex.RLock()
 	events := make([]DockerEvent, len(a.eventBuffer))
 	copy(events, a.eventBuffer)
+	securityEvents := make([]SecurityEvent, len(a.securityEvents))
+	copy(securityEvents, a.securityEvents)
 	a.eventMutex.RUnlock()
 
 	a.logMutex.RLock()
@@ -778,23 +1465,74 @@ func (a *Agent) createPayload() (Payload, error) {
 	copy(logs, a.logBuffer)
 	a.logMutex.RUnlock()
 
+	// External detectors see the same data, and their alerts go out with it
+	if len(a.detectors) > 0 {
+		a.runDetectors(DetectorInput{
+			Host: hostname, ServerID: a.config.ServerID, Env: a.config.Env, Timestamp: time.Now(),
+			Metrics: metrics, DockerEvents: events, Logs: logs,
+		})
+	}
+
 	// Copy current alerts
 	a.alertMutex.RLock()
 	alerts := make([]string, len(a.localAlerts))
 	copy(alerts, a.localAlerts)
+	var alertDetails map[string]string
+	var correlationIDs map[string][]string
+	for _, alert := range alerts {
+		if state, ok := a.alertStates[alert]; ok {
+			if detail := a.alertDetail(alert, state); detail != "" {
+				if alertDetails == nil {
+					alertDetails = make(map[string]string)
+				}
+				alertDetails[alert] = detail
+			}
+			if len(state.CorrelationIDs) > 0 {
+				if correlationIDs == nil {
+					correlationIDs = make(map[string][]string)
+				}
+				correlationIDs[alert] = state.CorrelationIDs
+			}
+		}
+	}
 	a.alertMutex.RUnlock()
 
+	if a.hooks != nil {
+		alerts, alertDetails = a.hooks.alertHook(alerts, alertDetails)
+		for alert := range correlationIDs {
+			if !slices.Contains(alerts, alert) {
+				delete(correlationIDs, alert)
+			}
+		}
+	}
+
+	stats := a.agentStats(false)
+
 	payload := Payload{
-		Host:         hostname,
-		ServerID:     a.config.ServerID,
-		Env:          a.config.Env,
-		OwnerTeam:    a.config.OwnerTeam,
-		Timestamp:    time.Now(),
-		Metrics:      metrics,
-		DockerEvents: events,
-		Logs:         logs,
-		LocalAlerts:  alerts,
-		Score:        a.calculateScore(alerts),
+		ID:                  newUUID(),
+		AgentVersion:        currentBuild().Version,
+		Host:                hostname,
+		ServerID:            a.config.ServerID,
+		MachineID:           a.machineID,
+		Env:                 a.config.Env,
+		OwnerTeam:           a.config.OwnerTeam,
+		Timestamp:           time.Now(),
+		Metrics:             metrics,
+		DockerEvents:        events,
+		SecurityEvents:      securityEvents,
+		Logs:                logs,
+		LocalAlerts:         alerts,
+		AlertDetails:        alertDetails,
+		AlertCorrelationIDs: correlationIDs,
+		Score:               a.calculateScore(alerts),
+		AgentStats:          &stats,
+		Simulation:          a.simulationNames(),
+	}
+
+	if overflow := capPayload(&payload, a.config.MaxPayloadKB<<10); overflow != nil {
+		message := describeOverflow(overflow, jsonSize(&payload))
+		log.Printf("Warning: %s", message)
+		a.recordEvent(EventPayloadSummarized, payload.ID, "%s", message)
 	}
 
 	return payload, nil
@@ -810,58 +1548,112 @@ func (a *Agent) signPayload(payload []byte, timestamp time.Time) string {
 	
 	// Sign timestamp + payload
 	message := fmt.Sprintf("%d.%s", timestamp.Unix(), string(payload))
-	h := hmac.New(sha256.New, []byte(a.config.Secret))
+	h := hmac.New(sha256.New, []byte(a.secret()))
 	h.Write([]byte(message))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
 // sendPayload sends payload to the server with retry logic
 func (a *Agent) sendPayload(payload Payload) error {
+	if a.hooks != nil {
+		var send bool
+		if payload, send = a.hooks.preSendHook(payload); !send {
+			log.Printf("Hook pre_send vetoed payload %s", payload.ID)
+			a.recordEvent(EventPayloadVetoed, payload.ID, "pre_send hook vetoed the payload")
+			// The vetoed data is dropped rather than going out with the next payload
+			a.payloadDelivered(payload)
+			return nil
+		}
+	}
+	a.rememberPayload(payload)
+
+	// Dry-run mode: print instead of sending
+	if a.config.DryRun {
+		return a.printPayload(payload)
+	}
+
+	// Exporter mode: nothing is pushed, /metrics and /alerts serve the payload
+	if a.config.Exporter {
+		return a.exportPayload(payload)
+	}
+
+	// Offline mode: no server, payloads go to local files
+	if a.offline != nil {
+		return a.writeOffline(payload)
+	}
+
+	// Batching: sent with the payloads of the next intervals
+	if a.batching() {
+		return a.batchPayload(payload)
+	}
+
+	if err := a.deliverPayload(payload); err != nil {
+		// If all retries failed, queue the payload
+		a.selfMetrics.SendFailures.Add(1)
+		a.queueUndelivered(payload, err)
+		return err
+	}
+	return nil
+}
+
+// queueUndelivered queues a live payload the server did not acknowledge and
+// persists it to disk, for backfill to deliver
+func (a *Agent) queueUndelivered(payload Payload, err error) {
+	a.queueMutex.Lock()
+	a.enqueuePayload(payload)
+	a.queueMutex.Unlock()
+
+	// Persist to disk
+	if err := a.persistPayload(payload); err != nil {
+		log.Printf("Failed to persist payload %s: %v", payload.ID, err)
+	} else {
+		a.selfMetrics.QueuePersisted.Add(1)
+	}
+
+	log.Printf("Queued payload %s: %v", payload.ID, err)
+}
+
+// deliverPayload posts payload to the server with retries. It succeeds only
+// once the server has acknowledged the payload; a timeout or a response
+// without a valid ack is retried, which the server's deduplication makes safe.
+// Backfill payloads are signed at send time and leave the live buffers alone.
+func (a *Agent) deliverPayload(payload Payload) error {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	signature := a.signPayload(payloadBytes, payload.Timestamp)
-
 	maxRetries := 3
 	baseDelay := time.Second
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		req, err := http.NewRequest("POST", a.config.ServerURL, bytes.NewBuffer(payloadBytes))
-		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
+		a.selfMetrics.SendAttempts.Add(1)
+		if attempt > 0 {
+			a.selfMetrics.SendRetries.Add(1)
 		}
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("X-Agent-Signature", fmt.Sprintf("sha256=%s", signature))
-		req.Header.Set("X-Agent-Timestamp", strconv.FormatInt(payload.Timestamp.Unix(), 10))
-
-		resp, err := a.httpClient.Do(req)
+		signedAt := payload.Timestamp
+		if payload.Backfill {
+			// Signed now, so payloads older than the server's timestamp tolerance are accepted
+			signedAt = time.Now()
+		}
+		sendStart := time.Now()
+		err := a.sendOnce(payloadBytes, payload.ID, signedAt)
+		a.selfMetrics.PayloadSend.Since(sendStart)
 		if err == nil {
-			resp.Body.Close()
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				log.Printf("Successfully sent payload to server (status: %d)", resp.StatusCode)
-				a.lastSendOK = time.Now()
-				
-				// Fixed: Clear event/log buffers after successful send to prevent accumulation
-				a.eventMutex.Lock()
-				a.eventBuffer = a.eventBuffer[:0]
-				a.eventMutex.Unlock()
-				
-				a.logMutex.Lock()
-				a.logBuffer = a.logBuffer[:0]
-				a.logMutex.Unlock()
-				
-				a.alertMutex.Lock()
-				a.localAlerts = a.localAlerts[:0]
-				a.alertMutex.Unlock()
-				
-				return nil
+			log.Printf("Successfully sent payload %s to server", payload.ID)
+			a.lastSendOK = time.Now()
+			a.selfMetrics.SendSuccesses.Add(1)
+			if !payload.Backfill {
+				a.payloadDelivered(payload)
 			}
-			log.Printf("Server returned error status: %d", resp.StatusCode)
-		} else {
-			log.Printf("Failed to send payload (attempt %d/%d): %v", attempt+1, maxRetries, err)
+			return nil
+		}
+		log.Printf("Failed to send payload %s (attempt %d/%d): %v", payload.ID, attempt+1, maxRetries, err)
+		a.recordEvent(EventSendFailure, payload.ID, "attempt %d/%d: %v", attempt+1, maxRetries, err)
+		if errors.Is(err, errServerThrottled) {
+			// Waiting out the pause here would hold up the payload loop
+			return fmt.Errorf("failed to send payload %s: %w", payload.ID, err)
 		}
 
 		if attempt < maxRetries-1 {
@@ -871,28 +1663,133 @@ func (a *Agent) sendPayload(payload Payload) error {
 		}
 	}
 
-	// If all retries failed, queue the payload
-	a.queueMutex.Lock()
+	return fmt.Errorf("failed to send payload %s after %d attempts", payload.ID, maxRetries)
+}
+
+// sendOnce makes a single delivery attempt of an encoded payload signed over
+// signedAt, on the gRPC stream or as a POST to the --server-url endpoints. It
+// succeeds only if the payload was acknowledged.
+func (a *Agent) sendOnce(payloadBytes []byte, id string, signedAt time.Time) error {
+	if a.stream != nil {
+		return a.stream.deliver(payloadBytes, id, signedAt)
+	}
+	return a.postToServers(payloadBytes, id, signedAt)
+}
+
+// postPayloadTo POSTs an encoded payload to one server endpoint
+func (a *Agent) postPayloadTo(serverURL string, payloadBytes []byte, id string, signedAt time.Time) error {
+	req, err := a.newPayloadRequest(serverURL, payloadBytes, id, signedAt)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	if err := a.verifyAck(resp.Body, id); err != nil {
+		return fmt.Errorf("not acknowledged: %w", err)
+	}
+	return nil
+}
+
+// enqueuePayload adds an undelivered payload to the queue, dropping the oldest
+// when the queue is full or over its share of the memory budget. Must be
+// called with queueMutex held.
+func (a *Agent) enqueuePayload(payload Payload) {
+	queue, evicted, fits := admit(a.queueMemory, a.payloadQueue, &a.queueBytes, payloadSize(payload), payloadSize)
+	a.payloadQueue = queue
+	for _, dropped := range evicted {
+		a.recordEvent(EventQueueDropped, dropped.ID, "queue over memory budget, dropped oldest payload")
+		a.selfMetrics.QueueDropped.Add(1)
+		// Its queue file is kept, so it is sent again after a restart
+		delete(a.queuedIn, dropped.ID)
+	}
+	if !fits {
+		a.recordEvent(EventQueueDropped, payload.ID, "payload larger than the queue memory budget, dropped")
+		a.selfMetrics.QueueDropped.Add(1)
+		return
+	}
+	// Kept in collection order, so backfill delivers the oldest first
 	a.payloadQueue = append(a.payloadQueue, payload)
+	for i := len(a.payloadQueue) - 1; i > 0 && a.payloadQueue[i-1].Timestamp.After(payload.Timestamp); i-- {
+		a.payloadQueue[i-1], a.payloadQueue[i] = a.payloadQueue[i], a.payloadQueue[i-1]
+	}
+	a.selfMetrics.QueueEnqueued.Add(1)
 	// Keep queue size manageable
-	if len(a.payloadQueue) > 50 {
-		a.payloadQueue = a.payloadQueue[1:]
+	if len(a.payloadQueue) > a.queueLimit() {
+		a.recordEvent(EventQueueDropped, a.payloadQueue[0].ID, "queue full, dropped oldest payload")
+		delete(a.queuedIn, a.payloadQueue[0].ID)
+		a.payloadQueue = dropOldest(a.queueMemory, a.payloadQueue, &a.queueBytes, payloadSize)
+		a.selfMetrics.QueueDropped.Add(1)
 	}
-	a.queueMutex.Unlock()
+}
 
-	// Persist to disk
-	if err := a.persistPayload(payload); err != nil {
-		log.Printf("Failed to persist payload: %v", err)
+// payloadDelivered clears buffers and alerts that reached the server (or offline output)
+func (a *Agent) payloadDelivered(payload Payload) {
+	a.clearLiveBuffers()
+
+	a.alertMutex.Lock()
+	a.markAlertsDelivered(payload.LocalAlerts)
+	a.localAlerts = a.localAlerts[:0]
+	a.alertMutex.Unlock()
+}
+
+// clearLiveBuffers empties the event and log buffers once a payload carries
+// them
+func (a *Agent) clearLiveBuffers() {
+	// Fixed: Clear event/log buffers after successful send to prevent accumulation
+	a.eventMutex.Lock()
+	a.eventBuffer = a.eventBuffer[:0]
+	a.liveMemory.Release(a.eventBytes)
+	a.eventBytes = 0
+	a.securityEvents = a.securityEvents[:0]
+	a.eventMutex.Unlock()
+
+	a.logMutex.Lock()
+	a.logBase += int64(len(a.logBuffer))
+	a.logBuffer = a.logBuffer[:0]
+	clear(a.lastLog)
+	a.liveMemory.Release(a.logBytes)
+	a.logBytes = 0
+	a.logMutex.Unlock()
+}
+
+// newPayloadRequest builds a POST of an encoded payload to a server endpoint,
+// signed over signedAt and the body
+func (a *Agent) newPayloadRequest(serverURL string, payloadBytes []byte, id string, signedAt time.Time) (*http.Request, error) {
+	// The signature covers the uncompressed body, which the server verifies
+	// after decoding it
+	body, encoding, err := compressBody(a.config.Compression, payloadBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	req, err := http.NewRequest("POST", serverURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	return fmt.Errorf("failed to send payload after %d attempts", maxRetries)
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("X-Agent-Signature", fmt.Sprintf("sha256=%s", a.signPayload(payloadBytes, signedAt)))
+	req.Header.Set("X-Agent-Timestamp", strconv.FormatInt(signedAt.Unix(), 10))
+	req.Header.Set("X-Agent-Payload-Id", id)
+	if a.config.KeyID != "" {
+		req.Header.Set("X-Agent-Key-Id", a.config.KeyID)
+	}
+	return req, nil
 }
 
 // persistPayload saves payload to disk
 func (a *Agent) persistPayload(payload Payload) error {
 	// Create filename with timestamp
 	filename := fmt.Sprintf("queue_%d.jsonl", time.Now().Unix())
-	filepath := filepath.Join("./queue", filename)
+	filepath := filepath.Join(a.queueDirectory(), filename)
 	
 	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
@@ -909,6 +1806,7 @@ func (a *Agent) persistPayload(payload Payload) error {
 	if err != nil {
 		return err
 	}
+	a.trackQueueFile(filepath, payload.ID)
 	
 	// Rotate files if needed
 	go a.rotateQueueFiles()
@@ -916,9 +1814,11 @@ func (a *Agent) persistPayload(payload Payload) error {
 	return nil
 }
 
-// rotateQueueFiles manages queue file rotation
+// rotateQueueFiles manages queue file rotation: files past --queue-max-age-hours
+// are removed, then the oldest files until at most --queue-max-payloads files
+// and --queue-max-mb remain
 func (a *Agent) rotateQueueFiles() {
-	files, err := filepath.Glob("./queue/queue_*.jsonl")
+	files, err := filepath.Glob(filepath.Join(a.queueDirectory(), "queue_*.jsonl"))
 	if err != nil {
 		return
 	}
@@ -931,6 +1831,7 @@ func (a *Agent) rotateQueueFiles() {
 	}
 	
 	var fileInfos []fileInfo
+	var totalBytes int64
 	for _, file := range files {
 		info, err := os.Stat(file)
 		if err != nil {
@@ -941,6 +1842,7 @@ func (a *Agent) rotateQueueFiles() {
 			modTime: info.ModTime(),
 			size:    info.Size(),
 		})
+		totalBytes += info.Size()
 	}
 	
 	// Sort by modification time (oldest first)
@@ -948,24 +1850,29 @@ func (a *Agent) rotateQueueFiles() {
 		return fileInfos[i].modTime.Before(fileInfos[j].modTime)
 	})
 	
-	// Remove old files if we have more than 10
-	if len(fileInfos) > 10 {
-		for i := 0; i < len(fileInfos)-10; i++ {
-			os.Remove(fileInfos[i].path)
-		}
-	}
-	
-	// Remove files larger than 50MB
-	for _, info := range fileInfos {
-		if info.size > 50*1024*1024 {
-			os.Remove(info.path)
+	cutoff, expires := a.queueCutoff()
+	maxBytes := int64(a.config.QueueMaxMB) << 20
+	for len(fileInfos) > 0 {
+		oldest := fileInfos[0]
+		switch {
+		case expires && oldest.modTime.Before(cutoff):
+			log.Printf("Removing queue file %s: older than %dh", oldest.path, a.config.QueueMaxAgeHours)
+		case len(fileInfos) > a.queueLimit():
+			log.Printf("Removing queue file %s: more than %d queue files", oldest.path, a.queueLimit())
+		case maxBytes > 0 && totalBytes > maxBytes:
+			log.Printf("Removing queue file %s: queue files over %d MB", oldest.path, a.config.QueueMaxMB)
+		default:
+			return
 		}
+		os.Remove(oldest.path)
+		totalBytes -= oldest.size
+		fileInfos = fileInfos[1:]
 	}
 }
 
 // loadPersistedPayloads loads payloads from disk
 func (a *Agent) loadPersistedPayloads() error {
-	files, err := filepath.Glob("./queue/queue_*.jsonl")
+	files, err := filepath.Glob(filepath.Join(a.queueDirectory(), "queue_*.jsonl"))
 	if err != nil {
 		return err
 	}
@@ -981,12 +1888,68 @@ func (a *Agent) loadPersistedPayloads() error {
 
 // loadPayloadsFromFile loads payloads from a specific file
 func (a *Agent) loadPayloadsFromFile(filename string) error {
+	payloads, err := readQueueFile(filename)
+	if err != nil && payloads == nil {
+		return err
+	}
+	
+	if len(payloads) == 0 {
+		os.Remove(filename)
+		return err
+	}
+
+	// The file stays until its payloads are acknowledged, so a crash before
+	// then loses nothing
+	a.queueMutex.Lock()
+	for _, payload := range payloads {
+		a.queuedIn[payload.ID] = filename
+		a.queueFiles[filename]++
+		a.enqueuePayload(payload)
+	}
+	a.dropExpiredPayloads()
+	a.queueMutex.Unlock()
+	a.selfMetrics.QueueLoaded.Add(uint64(len(payloads)))
+	
+	return err
+}
+
+// trackQueueFile records that payload id is persisted in filename
+func (a *Agent) trackQueueFile(filename, id string) {
+	a.queueMutex.Lock()
+	defer a.queueMutex.Unlock()
+	if _, queued := a.queuedIn[id]; queued {
+		return
+	}
+	a.queuedIn[id] = filename
+	a.queueFiles[filename]++
+}
+
+// queuedPayloadAcked removes a queue file once every payload persisted in it
+// has been acknowledged. Must be called with queueMutex held.
+func (a *Agent) queuedPayloadAcked(id string) {
+	filename, ok := a.queuedIn[id]
+	if !ok {
+		return
+	}
+	delete(a.queuedIn, id)
+	a.queueFiles[filename]--
+	if a.queueFiles[filename] <= 0 {
+		delete(a.queueFiles, filename)
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove delivered queue file %s: %v", filename, err)
+		}
+	}
+}
+
+// readQueueFile reads the payloads persisted in a queue file, skipping invalid lines
+func readQueueFile(filename string) ([]Payload, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
 	
+	payloads := make([]Payload, 0)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		var payload Payload
@@ -994,51 +1957,88 @@ func (a *Agent) loadPayloadsFromFile(filename string) error {
 			log.Printf("Error unmarshaling payload: %v", err)
 			continue
 		}
-		
-		a.queueMutex.Lock()
-		a.payloadQueue = append(a.payloadQueue, payload)
-		a.queueMutex.Unlock()
+		// Payloads persisted before IDs existed get one on load
+		if payload.ID == "" {
+			payload.ID = newUUID()
+		}
+		payloads = append(payloads, payload)
 	}
 	
-	// Remove the file after loading
-	os.Remove(filename)
-	
-	return scanner.Err()
+	return payloads, scanner.Err()
 }
 
-// Fixed: processQueue now uses consistent locking to avoid race conditions
-// Keeps the queue locked during the entire pop operation
-func (a *Agent) processQueue() {
+// processQueue delivers the oldest queued payload, marked as backfill, and
+// returns the delivery error. The queue stays locked except during the
+// network call.
+func (a *Agent) processQueue() error {
+	a.backfillMutex.Lock()
+	defer a.backfillMutex.Unlock()
 	a.queueMutex.Lock()
 	defer a.queueMutex.Unlock()
 	
+	a.dropExpiredPayloads()
 	if len(a.payloadQueue) == 0 {
-		return
+		return nil
 	}
 
 	// Get the oldest payload while holding the lock
 	payload := a.payloadQueue[0]
+	payload.Backfill = true
 	
-	// Temporarily unlock to send payload (avoid holding lock during network call)
+	// Temporarily unlock to send payload (avoid holding lock during network call).
+	// It stays queued, in memory and on disk, until the server acknowledges it.
 	a.queueMutex.Unlock()
-	err := a.sendPayload(payload)
+	a.rememberPayload(payload)
+	err := a.deliverPayload(payload)
 	a.queueMutex.Lock()
 
 	if err == nil {
+		a.queuedPayloadAcked(payload.ID)
 		// Successfully sent, remove from queue if it's still the first item
 		// (defensive check in case queue was modified)
-		if len(a.payloadQueue) > 0 && a.payloadQueue[0].Timestamp.Equal(payload.Timestamp) {
-			a.payloadQueue = a.payloadQueue[1:]
-			log.Printf("Successfully sent queued payload")
+		if len(a.payloadQueue) > 0 && a.payloadQueue[0].ID == payload.ID {
+			a.payloadQueue = dropOldest(a.queueMemory, a.payloadQueue, &a.queueBytes, payloadSize)
+			a.selfMetrics.QueueDequeued.Add(1)
+			log.Printf("Successfully sent queued payload %s", payload.ID)
 		}
+	} else {
+		log.Printf("Queued payload %s stays queued: %v", payload.ID, err)
 	}
+	return err
 }
 
-// setupHealthServer sets up the health monitoring HTTP server
-func (a *Agent) setupHealthServer() {
+// setupHealthServer sets up the health monitoring HTTP server.
+// The listener is bound synchronously so address conflicts fail agent startup
+// instead of leaving the agent running without health endpoints.
+func (a *Agent) setupHealthServer() error {
+	if a.config.HealthAddr == "" {
+		log.Printf("Health server disabled (no health address configured)")
+		return nil
+	}
+
+	if err := a.validateHealthSecurity(); err != nil {
+		return err
+	}
+
+	listener, err := listenHealth(a.config.HealthAddr)
+	if err != nil {
+		return err
+	}
+	
+	scheme := "http"
+	if a.config.HealthTLSCert != "" {
+		tlsConfig, err := a.healthTLSConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+
 	mux := http.NewServeMux()
 	
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/healthz", a.requireHealthAuth(func(w http.ResponseWriter, r *http.Request) {
 		a.queueMutex.Lock()
 		queueLen := len(a.payloadQueue)
 		a.queueMutex.Unlock()
@@ -1051,81 +2051,211 @@ func (a *Agent) setupHealthServer() {
 		
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(status)
-	})
+	}))
 	
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics, _ := a.collectSystemMetrics()
-		
-		a.alertMutex.RLock()
-		alerts := make([]string, len(a.localAlerts))
-		copy(alerts, a.localAlerts)
-		a.alertMutex.RUnlock()
-		
-		status := MetricsStatus{
-			CPU:         metrics.CPUUsage,
-			Memory:      metrics.MemoryUsage,
-			LocalAlerts: alerts,
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(status)
-	})
+	// Exporter mode serves Prometheus metrics and the last payload's alerts
+	if a.config.Exporter {
+		mux.HandleFunc("/metrics", a.requireHealthAuth(a.handlePrometheusMetrics))
+		mux.HandleFunc("/alerts", a.requireHealthAuth(a.handleExportedAlerts))
+	} else {
+		mux.HandleFunc("/metrics", a.requireHealthAuth(a.handleMetrics))
+	}
+
+	a.registerAdminHandlers(mux)
 	
 	a.healthServer = &http.Server{
-		Addr:    "localhost:8081",
 		Handler: mux,
 	}
 	
 	go func() {
-		log.Printf("Health server starting on localhost:8081")
-		if err := a.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Health server listening on %s (%s)", a.config.HealthAddr, scheme)
+		if err := a.healthServer.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Printf("Health server error: %v", err)
 		}
 	}()
+	
+	return nil
+}
+
+// handleMetrics serves the metrics collected for the last payload as JSON
+func (a *Agent) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics, collectedAt := a.latestMetrics()
+	
+	a.alertMutex.RLock()
+	alerts := make([]string, len(a.localAlerts))
+	copy(alerts, a.localAlerts)
+	a.alertMutex.RUnlock()
+	
+	status := MetricsStatus{
+		CPU:         metrics.CPUUsage,
+		Memory:      metrics.MemoryUsage,
+		CollectedAt: collectedAt,
+		LocalAlerts: alerts,
+		Agent:       a.agentStats(true),
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// normalizeHealthAddr resolves the --health-addr shorthands: "off" disables
+// the health server like an empty address, which orchestrators can't always
+// pass, and a bare port listens on localhost
+func normalizeHealthAddr(addr string) string {
+	if strings.EqualFold(addr, "off") {
+		return ""
+	}
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		return "localhost:" + addr
+	}
+	return addr
+}
+
+// listenHealth binds the health server address. Addresses of the form
+// "unix:/path/to/socket" bind a Unix domain socket; anything else is TCP host:port.
+func listenHealth(addr string) (net.Listener, error) {
+	if socketPath, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// Remove a stale socket left behind by an unclean shutdown
+		if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socketPath)
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("bind unix socket %s: %w", socketPath, err)
+		}
+		if err := os.Chmod(socketPath, 0660); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("chmod unix socket %s: %w", socketPath, err)
+		}
+		return listener, nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bind %s (is another agent or service using this port? set --health-addr): %w", addr, err)
+	}
+	return listener, nil
 }
 
 // Run starts the monitoring agent
 func (a *Agent) Run(ctx context.Context) error {
 	log.Printf("Starting monitoring agent...")
-	log.Printf("Server URL: %s", a.config.ServerURL)
+	if a.config.DryRun {
+		log.Printf("Dry run: printing payloads to stdout, nothing is sent")
+	} else if a.config.Exporter {
+		log.Printf("Exporter mode: serving results on %s/metrics and /alerts, nothing is sent", a.config.HealthAddr)
+	} else if a.offline != nil {
+		log.Printf("Offline mode: writing payloads to %s", a.config.OutputDir)
+	} else if a.stream != nil {
+		log.Printf("Streaming payloads to %s over gRPC", a.config.GRPCAddr)
+	} else {
+		log.Printf("Server URL: %s", a.config.ServerURL)
+		if urls := serverURLs(a.config.ServerURL); len(urls) > 1 {
+			log.Printf("Failing over between %d servers (%s)", len(urls), a.config.ServerFailover)
+		}
+	}
+	log.Printf("Server ID: %s (machine ID %s)", a.config.ServerID, a.machineID)
 	log.Printf("Interval: %d seconds", a.config.Interval)
 	log.Printf("Tail lines: %d", a.config.TailLines)
-	log.Printf("Simulate attack: %v", a.config.SimulateAttack)
+	if a.warmingUp() {
+		log.Printf("Warm-up: CPU_SPIKE and BRUTE_FORCE suppressed for %d seconds", a.config.WarmupSeconds)
+	}
+	if len(a.simulations) > 0 {
+		log.Printf("Simulation: %s (payloads are tagged \"simulation\")", strings.Join(a.simulationNames(), ","))
+	}
 
 	// Start Docker event monitoring
 	go a.monitorDockerEvents(ctx)
+	
+	// Start platform-specific monitors (e.g. FreeBSD jails)
+	a.startPlatformMonitors(ctx)
 
 	// Start monitoring existing containers
 	if a.dockerClient != nil {
-		containers, err := a.dockerClient.ContainerList(ctx, types.ContainerListOptions{})
-		if err != nil {
-			log.Printf("Error listing containers: %v", err)
-		} else {
-			for _, container := range containers {
-				if container.State == "running" {
-					go a.monitorContainerLogs(ctx, container.ID)
-				}
-			}
-		}
+		a.attachRunningContainers(ctx)
+	}
+
+	// Take remote commands pushed over the gRPC stream
+	if a.stream != nil {
+		go a.stream.receiveCommands(ctx, a.commands)
+	}
+
+	// Availability checks of --probes endpoints
+	if a.probes != nil {
+		log.Printf("Probing %d endpoints every %ds", len(a.probes.probes), a.config.ProbeInterval)
+		go a.runProbes(ctx)
+	}
+
+	// SNMP polling of --snmp-file devices
+	if a.snmp != nil {
+		log.Printf("Polling %d SNMP devices every %ds", len(a.snmp.devices), a.config.SNMPInterval)
+		go a.runSNMP(ctx)
+	}
+
+	// Secret rotation in --secret-file or Vault
+	if a.signingSecret != nil && a.config.SecretRefresh > 0 {
+		log.Printf("Re-reading the secret from %s every %ds", a.signingSecret.describe, a.config.SecretRefresh)
+		go a.runSecretRefresh(ctx)
+	}
+
+	// Masking rule changes apply without a restart
+	if a.config.MaskRulesFile != "" {
+		go a.runMaskRulesReload(ctx)
+	}
+
+	// Queued payloads are backfilled apart from live ones
+	if !a.config.DryRun && !a.config.Exporter && a.offline == nil {
+		go a.runBackfill(ctx)
+	}
+
+	// Heartbeats between payloads; a gRPC stream already shows liveness
+	// unless --heartbeat-url is set
+	if a.config.HeartbeatInterval > 0 && !a.config.DryRun && !a.config.Exporter && a.offline == nil &&
+		(a.config.GRPCAddr == "" || a.config.HeartbeatURL != "") {
+		go a.runHeartbeats(ctx)
 	}
 
 	// Main loop for sending payloads
-	ticker := time.NewTicker(time.Duration(a.config.Interval) * time.Second)
+	interval := a.sendInterval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	// Periodic integrity self-check (nil channel blocks forever when disabled)
+	var integrityTick <-chan time.Time
+	if a.integrity != nil && a.config.IntegrityInterval > 0 {
+		integrityTicker := time.NewTicker(time.Duration(a.config.IntegrityInterval) * time.Second)
+		defer integrityTicker.Stop()
+		integrityTick = integrityTicker.C
+	}
+
 	for {
 		select {
+		case <-integrityTick:
+			a.checkIntegrity()
+
+		// Commands run here so they don't race payload creation (nil channel without --grpc-addr)
+		case command := <-a.commands:
+			a.runCommand(command)
+			if next := a.sendInterval(); next != interval {
+				ticker.Reset(next)
+				interval = next
+			}
+
 		case <-ticker.C:
 			payload, err := a.createPayload()
 			if err != nil {
 				log.Printf("Error creating payload: %v", err)
 				continue
 			}
+			log.Printf("Created payload %s (%d events, %d logs, %d alerts)", payload.ID, len(payload.DockerEvents), len(payload.Logs), len(payload.LocalAlerts))
 
-			// Try to process any queued payloads first
-			a.processQueue()
+			for _, notifier := range a.notifiers {
+				if err := notifier.notify(payload); err != nil {
+					log.Printf("%s notification failed: %v", notifier.name, err)
+				}
+			}
 
-			// Send current payload
+			// Send current payload; queued ones are left to runBackfill
 			if err := a.sendPayload(payload); err != nil {
 				log.Printf("Error sending payload: %v", err)
 			}
@@ -1141,15 +2271,39 @@ func (a *Agent) Run(ctx context.Context) error {
 			if payload, err := a.createPayload(); err == nil {
 				a.sendPayload(payload)
 			}
+			// Payloads still waiting for a batch go now, or to the queue
+			a.flushBatch()
+			
+			if a.stream != nil {
+				a.stream.Close()
+			}
 			
 			// Close health server
 			if a.healthServer != nil {
 				a.healthServer.Shutdown(context.Background())
 			}
 			
-			// Close auth watcher
-			if a.authWatcher != nil {
-				a.authWatcher.Close()
+			// Close auth sources
+			for _, source := range a.logSources {
+				source.Close()
+			}
+
+			for _, detector := range a.detectors {
+				detector.Close()
+			}
+			if a.hooks != nil {
+				a.hooks.Close()
+			}
+			
+			// Publish the current offline output file
+			if a.offline != nil {
+				a.offline.Close()
+			}
+			
+			// Close audit log last so shutdown is recorded
+			if a.auditLog != nil {
+				a.audit(AuditAgentStopped, "", "shutdown")
+				a.auditLog.Close()
 			}
 			
 			return nil
@@ -1158,95 +2312,637 @@ func (a *Agent) Run(ctx context.Context) error {
 }
 
 // parseConfig parses configuration from command line flags and environment variables
-func parseConfig() Config {
+func parseConfig(fs *flag.FlagSet, args []string) (Config, error) {
 	var config Config
 
-	flag.StringVar(&config.ServerURL, "server-url", "http://localhost:8000/ingest", "Server URL for sending payloads")
-	flag.StringVar(&config.Secret, "secret", "", "Shared secret for HMAC signing")
-	flag.IntVar(&config.Interval, "interval", 10, "Interval in seconds between payload sends")
-	flag.IntVar(&config.TailLines, "tail-lines", 100, "Number of initial log lines to tail")
-	flag.IntVar(&config.AuthWindowSeconds, "auth-window-seconds", 300, "Window for auth failure detection")
-	flag.Float64Var(&config.CPUSpikePct, "cpu-spike-pct", 85.0, "CPU percentage threshold for spike detection")
-	flag.IntVar(&config.FailedAuthThreshold, "failed-auth-threshold", 20, "Failed auth attempts threshold")
-	flag.IntVar(&config.BaselineSamples, "baseline-samples", 12, "Number of samples for CPU baseline")
-	flag.BoolVar(&config.SimulateAttack, "simulate-attack", false, "Enable attack simulation mode")
-	flag.StringVar(&config.Env, "env", "", "Environment (prod/stage/dev)")
-	flag.StringVar(&config.OwnerTeam, "owner-team", "", "Owner team name")
-	flag.StringVar(&config.ServerID, "server-id", "", "Server identifier")
-	flag.IntVar(&config.MaxLogEntries, "max-log-entries", 500, "Maximum log entries to keep")
-	flag.Parse()
+	fs.StringVar(&config.Profile, "profile", "", "Bundled defaults for thresholds, intervals and buffer sizes: prod, staging or dev (overridden by --config, flags and environment)")
+	fs.StringVar(&config.ConfigFile, "config", "", "YAML (.yaml, .yml) or TOML (.toml) file with agent settings; flags and environment variables override it")
+	fs.StringVar(&config.ServerURL, "server-url", "http://localhost:8000/ingest", "Server URL for sending payloads; a comma-separated list fails over between them")
+	fs.StringVar(&config.ServerFailover, "server-failover", FailoverOrder, "How payloads are spread over several --server-url endpoints: order (stick to the last healthy one) or round-robin")
+	fs.StringVar(&config.Secret, "secret", "", "Shared secret for HMAC signing (visible in ps; prefer SECRET, --secret-file or Vault)")
+	fs.StringVar(&config.SecretFile, "secret-file", "", "File holding the HMAC secret, such as a mounted Kubernetes or Docker secret")
+	fs.StringVar(&config.VaultAddr, "vault-addr", "", "HashiCorp Vault address to read the HMAC secret from (token in VAULT_TOKEN or --vault-token-file)")
+	fs.StringVar(&config.VaultPath, "vault-path", "", "Vault API path of the secret, e.g. secret/data/richardops for a KV v2 mount")
+	fs.StringVar(&config.VaultField, "vault-field", "secret", "Field of the Vault secret holding the HMAC secret")
+	fs.StringVar(&config.VaultTokenFile, "vault-token-file", "", "File holding the Vault token, re-read with the secret (default VAULT_TOKEN)")
+	fs.IntVar(&config.SecretRefresh, "secret-refresh", 300, "Seconds between re-reads of --secret-file or the Vault secret, so rotations apply without a restart (0 to read once)")
+	fs.StringVar(&config.KeyID, "key-id", "", "ID of the server API key --secret belongs to (multi-tenant servers)")
+	fs.StringVar(&config.EnrollToken, "enroll-token", "", "One-time token exchanged with the server for this agent's own key ID, secret and server ID on first start")
+	fs.BoolVar(&config.RequireAck, "require-ack", false, "Treat a payload as delivered only with a signed ack from the server, even before the first one is seen")
+	fs.StringVar(&config.GRPCAddr, "grpc-addr", "", "Stream payloads to the server's gRPC endpoint at host:port and take remote commands from it, instead of POSTing to --server-url")
+	fs.BoolVar(&config.GRPCInsecure, "grpc-insecure", false, "Connect to --grpc-addr without TLS")
+	fs.StringVar(&config.ClientCert, "client-cert", "", "Client certificate presented to --server-url and --grpc-addr for mutual TLS (with --client-key); re-read when renewed")
+	fs.StringVar(&config.ClientKey, "client-key", "", "Private key of --client-cert")
+	fs.StringVar(&config.ServerCA, "server-ca", "", "CA bundle trusted for --server-url and --grpc-addr instead of the system roots")
+	fs.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Lowest TLS version used with --server-url and --grpc-addr: 1.2 or 1.3")
+	fs.StringVar(&config.ProxyURL, "proxy-url", "", "HTTP(S) proxy for the server, webhooks, Vault and Sentry, instead of HTTPS_PROXY and HTTP_PROXY (NO_PROXY still applies)")
+	fs.StringVar(&config.Compression, "compression", "none", "Compression of payloads POSTed to --server-url: none, gzip or zstd (the HMAC still covers the uncompressed JSON)")
+	fs.IntVar(&config.BatchSize, "batch-size", 1, "Live payloads of consecutive intervals POSTed together in one request to the batch endpoint beside --server-url (1 sends each on its own)")
+	fs.IntVar(&config.BatchMaxKB, "batch-max-kb", 4096, "Largest batch body; a payload that would exceed it sends the batch first (0 for no limit)")
+	fs.StringVar(&config.CredentialsFile, "credentials-file", filepath.Join(defaultDataDir(), "credentials.json"), "Where credentials issued at enrollment are kept; they replace --secret, --key-id and --server-id")
+	fs.IntVar(&config.Interval, "interval", 10, "Interval in seconds between payload sends")
+	fs.Float64Var(&config.BackfillRate, "backfill-rate", 1, "Queued payloads per second delivered after an outage, oldest first and apart from live payloads (0 for one per --interval)")
+	fs.StringVar(&config.QueueDir, "queue-dir", queueDir, "Directory undelivered payloads are persisted in, e.g. on a persistent volume")
+	fs.IntVar(&config.QueueMaxPayloads, "queue-max-payloads", maxQueuedPayloads, "Undelivered payloads kept in memory, and queue files kept on disk; the oldest are dropped beyond it")
+	fs.IntVar(&config.QueueMaxMB, "queue-max-mb", 50, "Total size of queue files on disk; the oldest files are removed beyond it (0 for no limit)")
+	fs.IntVar(&config.QueueMaxAgeHours, "queue-max-age-hours", 0, "Hours after collection an undelivered payload is dropped instead of sent (0 to keep until delivered)")
+	fs.IntVar(&config.HeartbeatInterval, "heartbeat-interval", 5, "Interval in seconds between heartbeats sent between payloads (0 to disable)")
+	fs.StringVar(&config.HeartbeatURL, "heartbeat-url", "", "Server URL for heartbeats (default: /heartbeat next to --server-url)")
+	fs.IntVar(&config.TailLines, "tail-lines", 100, "Number of initial log lines to tail")
+	fs.IntVar(&config.AuthWindowSeconds, "auth-window-seconds", 300, "Window for auth failure detection")
+	fs.Float64Var(&config.CPUSpikePct, "cpu-spike-pct", 85.0, "CPU percentage threshold for spike detection")
+	fs.IntVar(&config.FailedAuthThreshold, "failed-auth-threshold", 20, "Failed auth attempts threshold")
+	fs.StringVar(&config.AlertWeights, "alert-weights", "", "Comma-separated TYPE=weight list of alert score weights, overriding built-in types and adding custom ones (e.g. CPU_SPIKE=0.2,BRUTE_FORCE=0.9)")
+	fs.StringVar(&config.AccessLogs, "access-logs", "", "Comma-separated access log files (combined, HAProxy or Envoy format) to follow besides container logs")
+	fs.StringVar(&config.IISLogs, "iis-logs", "", "Comma-separated IIS site log directories (e.g. C:\\inetpub\\logs\\LogFiles\\W3SVC1) whose newest W3C log is followed")
+	fs.Float64Var(&config.HTTP5xxPct, "http-5xx-pct", 10.0, "Percentage of a source's requests per interval returning 5xx that raises HTTP_5XX_SPIKE")
+	fs.IntVar(&config.HTTPMinRequests, "http-min-requests", 20, "Requests per interval a source needs before HTTP_5XX_SPIKE is checked")
+	fs.IntVar(&config.WebAttackThreshold, "web-attack-threshold", 5, "Suspicious requests per interval from one client that raise WEB_ATTACK")
+	fs.Float64Var(&config.UpstreamErrorPct, "upstream-error-pct", 5.0, "Percentage of a proxy backend's requests per interval returning 5xx that raises UPSTREAM_ERROR_SPIKE")
+	fs.Float64Var(&config.UpstreamSpikeFactor, "upstream-spike-factor", 3.0, "Times a backend's usual error rate that raises UPSTREAM_ERROR_SPIKE")
+	fs.StringVar(&config.CorrelationFields, "correlation-fields", "request_id,x_request_id,x-request-id,trace_id,correlation_id", "Comma-separated field and header names of request IDs attached to HTTP and upstream alerts")
+	fs.StringVar(&config.SlowQueryLogs, "slow-query-logs", "", "Comma-separated MySQL or PostgreSQL slow query log files to follow besides container logs")
+	fs.IntVar(&config.SlowQueryMinCount, "slow-query-min-count", 5, "Slow queries per interval a source needs before SLOW_QUERY_SPIKE is raised")
+	fs.Float64Var(&config.SlowQuerySpikeFactor, "slow-query-spike-factor", 3.0, "Times a source's usual slow query rate that raises SLOW_QUERY_SPIKE")
+	fs.StringVar(&config.InfraLogs, "infra-logs", "", "Comma-separated Redis, RabbitMQ or Kafka log files to follow besides container logs")
+	fs.BoolVar(&config.KernelErrors, "kernel-errors", true, "Follow /dev/kmsg for machine check, memory, disk I/O and filesystem errors (Linux)")
+	fs.StringVar(&config.DockerDaemonLog, "docker-daemon-log", "auto", "Docker daemon log to follow: auto, journald, none or a file path")
+	fs.StringVar(&config.Probes, "probes", "", "Comma-separated [name=]http(s)://url, tcp://host:port or icmp://host endpoints to check for availability")
+	fs.IntVar(&config.ProbeInterval, "probe-interval", 30, "Seconds between checks of each --probes endpoint")
+	fs.IntVar(&config.ProbeTimeout, "probe-timeout", 5, "Seconds a probe check may take before it fails")
+	fs.IntVar(&config.ProbeFailures, "probe-failures", 3, "Consecutive failed checks of a probe that raise PROBE_FAILED")
+	fs.StringVar(&config.SNMPFile, "snmp-file", "", "JSON file with switches, UPSes and other devices to poll over SNMP v2c or v3")
+	fs.IntVar(&config.SNMPInterval, "snmp-interval", 60, "Seconds between SNMP polls of each --snmp-file device")
+	fs.IntVar(&config.BaselineSamples, "baseline-samples", 12, "Number of samples for CPU baseline")
+	fs.BoolVar(&config.SimulateAttack, "simulate-attack", false, "Enable attack simulation mode (same as --simulate=attack)")
+	fs.IntVar(&config.WarmupSeconds, "warmup-seconds", 120, "Seconds after start during which CPU and auth baselines are built without alerting (0 disables)")
+	fs.StringVar(&config.Simulate, "simulate", "", "Comma-separated simulation scenarios to inject each interval (see `simulate --list`)")
+	fs.StringVar(&config.Env, "env", "", "Environment (prod/stage/dev)")
+	fs.StringVar(&config.OwnerTeam, "owner-team", "", "Owner team name")
+	fs.StringVar(&config.ServerID, "server-id", "", "Server identifier (default: UUID generated on first run and kept in --agent-id-file)")
+	fs.StringVar(&config.AgentIDFile, "agent-id-file", filepath.Join(defaultDataDir(), "agent_id"), "Where the generated agent ID is persisted when --server-id is unset")
+	fs.IntVar(&config.MaxLogEntries, "max-log-entries", 500, "Maximum log entries to keep")
+	fs.BoolVar(&config.DedupeLogs, "dedupe-logs", true, "Collapse identical consecutive log lines from a container into one entry with a count and time range")
+	fs.IntVar(&config.MemoryBudgetMB, "memory-budget-mb", 64, "Memory for buffered logs, events and queued payloads; oldest entries are evicted beyond it (0 for no limit)")
+	fs.IntVar(&config.MaxPayloadKB, "max-payload-kb", 1024, "Largest payload body; beyond it the oldest logs and events are sent as per-container summaries (0 for no limit)")
+	fs.IntVar(&config.LogWorkers, "log-workers", 50, "Maximum container log streams followed at once; further containers take turns (0 for no limit)")
+	fs.StringVar(&config.HealthAddr, "health-addr", "localhost:8081", "Health server address: host:port, :port for all interfaces, a bare port for localhost, unix:/path/to.sock, or off (or empty) to disable")
+	fs.StringVar(&config.AuditLogPath, "audit-log", filepath.Join(defaultDataDir(), "audit", "audit.jsonl"), "Path of the hash-chained audit log (empty to disable)")
+	fs.StringVar(&config.HealthToken, "health-token", "", "Bearer token required for health endpoints (optional on loopback)")
+	fs.StringVar(&config.HealthTLSCert, "health-tls-cert", "", "TLS certificate for the health server")
+	fs.StringVar(&config.HealthTLSKey, "health-tls-key", "", "TLS private key for the health server")
+	fs.StringVar(&config.HealthClientCA, "health-client-ca", "", "CA bundle for verifying health server client certificates (enables mTLS)")
+	fs.StringVar(&config.MaskRulesFile, "mask-rules-file", "", "JSON file with additional masking rules and per-container overrides")
+	fs.StringVar(&config.ParseRulesFile, "parse-rules-file", "", "JSON file with log parsers turning container or file lines into fields and metrics")
+	fs.StringVar(&config.Detectors, "detectors", "", "Comma-separated external detectors run on every payload: Go plugins (.so) or WASM modules (.wasm)")
+	fs.StringVar(&config.Hooks, "hooks", "", "Lua script with collect, on_alert and pre_send hooks run on every payload")
+	fs.StringVar(&config.PIIMask, "pii-mask", "", "Comma-separated PII categories to mask in container logs (email,credit_card,national_id,ip)")
+	fs.StringVar(&config.MaskMode, "mask-mode", "redact", "How masked values are replaced: redact or hash (keyed HMAC for correlation)")
+	fs.StringVar(&config.MaskHashKey, "mask-hash-key", "", "Key for hash masking mode and hash rules, required by them; use the same key fleet-wide")
+	fs.BoolVar(&config.FIPS, "fips", fipsBuild, "Restrict crypto to FIPS 140-3 approved algorithms (requires the Go FIPS module)")
+	fs.StringVar(&config.IntegrityManifest, "integrity-manifest", "", "Install-time manifest of binary and config file hashes to verify (empty to disable)")
+	fs.IntVar(&config.IntegrityInterval, "integrity-interval", 300, "Interval in seconds between integrity self-checks")
+	fs.StringVar(&config.AuthOffsetFile, "auth-offset-file", filepath.Join(defaultDataDir(), "auth_offset.json"), "Where the auth log read position is saved so restarts resume instead of re-reading (empty to read the whole log on start)")
+	fs.StringVar(&config.AuthLogs, "auth-logs", "", "Comma-separated auth log files to follow, all of them, instead of the first of /var/log/auth.log and /var/log/secure")
+	fs.StringVar(&config.AuthLogFormat, "auth-log-format", "syslog", "Format of auth log lines: syslog, or json with the message in a message, msg, MESSAGE or log field")
+	fs.StringVar(&config.AuthLogPattern, "auth-log-pattern", "", "Regular expression matching a failed login in an auth log message, with the client address in a group named ip or the first group (default: sshd \"Failed password ... from <ip>\")")
+	fs.StringVar(&config.AuthSource, "auth-source", "auto", "Linux failed-login source: auto, file (auth.log/secure), journald or none")
+	fs.BoolVar(&config.DryRun, "dry-run", false, "Collect and detect as usual but print payloads to stdout instead of sending them")
+	fs.BoolVar(&config.Exporter, "exporter", false, "Push nothing; serve results as Prometheus /metrics and /alerts on --health-addr (no server URL or secret needed)")
+	fs.StringVar(&config.OutputDir, "output-dir", "", "Write payloads to rotating files in this directory instead of a server (requires empty --server-url)")
+	fs.IntVar(&config.OutputMaxFileMB, "output-max-file-mb", 50, "Rotate offline output files at this size")
+	fs.IntVar(&config.OutputMaxFiles, "output-max-files", 168, "Finished offline output files to keep (0 keeps all)")
+	fs.StringVar(&config.SlackWebhook, "slack-webhook", "", "Slack incoming webhook URL to post local alerts to")
+	fs.StringVar(&config.SlackCriticalWebhook, "slack-critical-webhook", "", "Slack incoming webhook URL for critical alerts (default --slack-webhook)")
+	fs.StringVar(&config.SlackTemplate, "slack-template", "", "Go template for Slack messages (fields: Host, ServerID, Env, OwnerTeam, Severity, Alerts, Details, Score, Time)")
+	fs.IntVar(&config.SlackRepeatMinutes, "slack-repeat-minutes", 60, "Minutes before an alert that is still raised is posted to Slack again")
+	fs.StringVar(&config.SlackMinSeverity, "slack-min-severity", "", "Lowest severity of alerts posted to Slack: warning or critical (default all)")
+	fs.StringVar(&config.DiscordWebhook, "discord-webhook", "", "Discord webhook URL to post local alerts to")
+	fs.StringVar(&config.DiscordCriticalWebhook, "discord-critical-webhook", "", "Discord webhook URL for critical alerts (default --discord-webhook)")
+	fs.IntVar(&config.DiscordRepeatMinutes, "discord-repeat-minutes", 60, "Minutes before an alert that is still raised is posted to Discord again")
+	fs.StringVar(&config.DiscordTemplate, "discord-template", "", "Go template for the description of Discord embeds (default the alerts with their details)")
+	fs.StringVar(&config.DiscordMinSeverity, "discord-min-severity", "", "Lowest severity of alerts posted to Discord: warning or critical (default all)")
+	fs.StringVar(&config.TeamsWebhook, "teams-webhook", "", "Microsoft Teams webhook URL to post local alerts to")
+	fs.StringVar(&config.TeamsCriticalWebhook, "teams-critical-webhook", "", "Microsoft Teams webhook URL for critical alerts (default --teams-webhook)")
+	fs.IntVar(&config.TeamsRepeatMinutes, "teams-repeat-minutes", 60, "Minutes before an alert that is still raised is posted to Teams again")
+	fs.StringVar(&config.TeamsTemplate, "teams-template", "", "Go template for the text of Teams cards (default the alerts with their details)")
+	fs.StringVar(&config.TeamsMinSeverity, "teams-min-severity", "", "Lowest severity of alerts posted to Teams: warning or critical (default all)")
+	fs.StringVar(&config.NotifyTemplate, "notify-template", "", "Go template for chat notifications of services without their own template")
+	fs.IntVar(&config.NotifyGroupSeconds, "notify-group-seconds", 0, "Seconds newly raised alerts are held to be posted in one chat message")
+	fs.IntVar(&config.NotifyRateLimit, "notify-rate-limit", 30, "Chat messages per hour at most per service, alerts over it are held (0 for no limit)")
+	fs.StringVar(&config.SentryDSN, "sentry-dsn", "", "Sentry DSN to report the agent's own panics and repeated errors to")
+	fs.IntVar(&config.SentryErrorThreshold, "sentry-error-threshold", 5, "Times an error must be logged within 10 minutes to be reported to Sentry")
+	fs.StringVar(&config.AdminToken, "admin-token", "", "Bearer token for admin API endpoints (admin API disabled if empty)")
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+
+	// Settings from a config file, below flags and environment variables
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if config.ConfigFile == "" {
+		config.ConfigFile = getenv("CONFIG_FILE")
+	}
+	if config.ConfigFile != "" {
+		applied, err := applyConfigFile(fs, config.ConfigFile)
+		if err != nil {
+			return config, err
+		}
+		for name := range applied {
+			set[name] = true
+		}
+	}
+
+	// Profile defaults, below everything else
+	if profile := getenv("PROFILE"); profile != "" {
+		config.Profile = profile
+	}
+	if config.Profile != "" {
+		if err := applyProfile(fs, config.Profile, set); err != nil {
+			return config, err
+		}
+	}
 
 	// Override with environment variables if set
-	if serverURL := os.Getenv("SERVER_URL"); serverURL != "" {
+	if serverURL := getenv("SERVER_URL"); serverURL != "" {
 		config.ServerURL = serverURL
 	}
-	if secret := os.Getenv("SECRET"); secret != "" {
+	if serverFailover := getenv("SERVER_FAILOVER"); serverFailover != "" {
+		config.ServerFailover = serverFailover
+	}
+	if secret := getenv("SECRET"); secret != "" {
 		config.Secret = secret
 	}
-	if interval := os.Getenv("INTERVAL"); interval != "" {
+	if secretFile := getenv("SECRET_FILE"); secretFile != "" {
+		config.SecretFile = secretFile
+	}
+	if vaultAddr := getenv("VAULT_ADDR"); vaultAddr != "" {
+		config.VaultAddr = vaultAddr
+	}
+	if vaultPath := getenv("VAULT_PATH"); vaultPath != "" {
+		config.VaultPath = vaultPath
+	}
+	if vaultField := getenv("VAULT_FIELD"); vaultField != "" {
+		config.VaultField = vaultField
+	}
+	if vaultTokenFile := getenv("VAULT_TOKEN_FILE"); vaultTokenFile != "" {
+		config.VaultTokenFile = vaultTokenFile
+	}
+	if secretRefresh := getenv("SECRET_REFRESH"); secretRefresh != "" {
+		if i, err := strconv.Atoi(secretRefresh); err == nil {
+			config.SecretRefresh = i
+		}
+	}
+	if keyID := getenv("KEY_ID"); keyID != "" {
+		config.KeyID = keyID
+	}
+	if enrollToken := getenv("ENROLL_TOKEN"); enrollToken != "" {
+		config.EnrollToken = enrollToken
+	}
+	if credentialsFile := getenv("CREDENTIALS_FILE"); credentialsFile != "" {
+		config.CredentialsFile = credentialsFile
+	}
+	if interval := getenv("INTERVAL"); interval != "" {
 		if i, err := strconv.Atoi(interval); err == nil {
 			config.Interval = i
 		}
 	}
-	if tailLines := os.Getenv("TAIL_LINES"); tailLines != "" {
+	if backfillRate := getenv("BACKFILL_RATE"); backfillRate != "" {
+		if f, err := strconv.ParseFloat(backfillRate, 64); err == nil {
+			config.BackfillRate = f
+		}
+	}
+	if dir := getenv("QUEUE_DIR"); dir != "" {
+		config.QueueDir = dir
+	}
+	if maxPayloads := getenv("QUEUE_MAX_PAYLOADS"); maxPayloads != "" {
+		if i, err := strconv.Atoi(maxPayloads); err == nil {
+			config.QueueMaxPayloads = i
+		}
+	}
+	if maxMB := getenv("QUEUE_MAX_MB"); maxMB != "" {
+		if i, err := strconv.Atoi(maxMB); err == nil {
+			config.QueueMaxMB = i
+		}
+	}
+	if maxAge := getenv("QUEUE_MAX_AGE_HOURS"); maxAge != "" {
+		if i, err := strconv.Atoi(maxAge); err == nil {
+			config.QueueMaxAgeHours = i
+		}
+	}
+	if heartbeatInterval := getenv("HEARTBEAT_INTERVAL"); heartbeatInterval != "" {
+		if i, err := strconv.Atoi(heartbeatInterval); err == nil {
+			config.HeartbeatInterval = i
+		}
+	}
+	if heartbeatURL := getenv("HEARTBEAT_URL"); heartbeatURL != "" {
+		config.HeartbeatURL = heartbeatURL
+	}
+	if tailLines := getenv("TAIL_LINES"); tailLines != "" {
 		if i, err := strconv.Atoi(tailLines); err == nil {
 			config.TailLines = i
 		}
 	}
-	if authWindow := os.Getenv("AUTH_WINDOW_SECONDS"); authWindow != "" {
+	if authWindow := getenv("AUTH_WINDOW_SECONDS"); authWindow != "" {
 		if i, err := strconv.Atoi(authWindow); err == nil {
 			config.AuthWindowSeconds = i
 		}
 	}
-	if cpuSpike := os.Getenv("CPU_SPIKE_PCT"); cpuSpike != "" {
+	if cpuSpike := getenv("CPU_SPIKE_PCT"); cpuSpike != "" {
 		if f, err := strconv.ParseFloat(cpuSpike, 64); err == nil {
 			config.CPUSpikePct = f
 		}
 	}
-	if failedAuth := os.Getenv("FAILED_AUTH_THRESHOLD"); failedAuth != "" {
+	if failedAuth := getenv("FAILED_AUTH_THRESHOLD"); failedAuth != "" {
 		if i, err := strconv.Atoi(failedAuth); err == nil {
 			config.FailedAuthThreshold = i
 		}
 	}
-	if baseline := os.Getenv("BASELINE_SAMPLES"); baseline != "" {
+	if weights := getenv("ALERT_WEIGHTS"); weights != "" {
+		config.AlertWeights = weights
+	}
+	if accessLogs := getenv("ACCESS_LOGS"); accessLogs != "" {
+		config.AccessLogs = accessLogs
+	}
+	if iisLogs := getenv("IIS_LOGS"); iisLogs != "" {
+		config.IISLogs = iisLogs
+	}
+	if pct := getenv("HTTP_5XX_PCT"); pct != "" {
+		if f, err := strconv.ParseFloat(pct, 64); err == nil {
+			config.HTTP5xxPct = f
+		}
+	}
+	if minRequests := getenv("HTTP_MIN_REQUESTS"); minRequests != "" {
+		if i, err := strconv.Atoi(minRequests); err == nil {
+			config.HTTPMinRequests = i
+		}
+	}
+	if threshold := getenv("WEB_ATTACK_THRESHOLD"); threshold != "" {
+		if i, err := strconv.Atoi(threshold); err == nil {
+			config.WebAttackThreshold = i
+		}
+	}
+	if errorPct := getenv("UPSTREAM_ERROR_PCT"); errorPct != "" {
+		if f, err := strconv.ParseFloat(errorPct, 64); err == nil {
+			config.UpstreamErrorPct = f
+		}
+	}
+	if factor := getenv("UPSTREAM_SPIKE_FACTOR"); factor != "" {
+		if f, err := strconv.ParseFloat(factor, 64); err == nil {
+			config.UpstreamSpikeFactor = f
+		}
+	}
+	if correlationFields := getenv("CORRELATION_FIELDS"); correlationFields != "" {
+		config.CorrelationFields = correlationFields
+	}
+	if slowLogs := getenv("SLOW_QUERY_LOGS"); slowLogs != "" {
+		config.SlowQueryLogs = slowLogs
+	}
+	if minCount := getenv("SLOW_QUERY_MIN_COUNT"); minCount != "" {
+		if i, err := strconv.Atoi(minCount); err == nil {
+			config.SlowQueryMinCount = i
+		}
+	}
+	if factor := getenv("SLOW_QUERY_SPIKE_FACTOR"); factor != "" {
+		if f, err := strconv.ParseFloat(factor, 64); err == nil {
+			config.SlowQuerySpikeFactor = f
+		}
+	}
+	if infraLogs := getenv("INFRA_LOGS"); infraLogs != "" {
+		config.InfraLogs = infraLogs
+	}
+	if daemonLog := getenv("DOCKER_DAEMON_LOG"); daemonLog != "" {
+		config.DockerDaemonLog = daemonLog
+	}
+	if probes := getenv("PROBES"); probes != "" {
+		config.Probes = probes
+	}
+	if probeInterval := getenv("PROBE_INTERVAL"); probeInterval != "" {
+		if i, err := strconv.Atoi(probeInterval); err == nil {
+			config.ProbeInterval = i
+		}
+	}
+	if probeTimeout := getenv("PROBE_TIMEOUT"); probeTimeout != "" {
+		if i, err := strconv.Atoi(probeTimeout); err == nil {
+			config.ProbeTimeout = i
+		}
+	}
+	if probeFailures := getenv("PROBE_FAILURES"); probeFailures != "" {
+		if i, err := strconv.Atoi(probeFailures); err == nil {
+			config.ProbeFailures = i
+		}
+	}
+	if snmpFile := getenv("SNMP_FILE"); snmpFile != "" {
+		config.SNMPFile = snmpFile
+	}
+	if snmpInterval := getenv("SNMP_INTERVAL"); snmpInterval != "" {
+		if i, err := strconv.Atoi(snmpInterval); err == nil {
+			config.SNMPInterval = i
+		}
+	}
+	if kernelErrors := getenv("KERNEL_ERRORS"); kernelErrors != "" {
+		if b, err := strconv.ParseBool(kernelErrors); err == nil {
+			config.KernelErrors = b
+		}
+	}
+	if baseline := getenv("BASELINE_SAMPLES"); baseline != "" {
 		if i, err := strconv.Atoi(baseline); err == nil {
 			config.BaselineSamples = i
 		}
 	}
-	if simulate := os.Getenv("SIMULATE_ATTACK"); simulate == "true" {
+	if warmup := getenv("WARMUP_SECONDS"); warmup != "" {
+		if i, err := strconv.Atoi(warmup); err == nil {
+			config.WarmupSeconds = i
+		}
+	}
+	if simulate := getenv("SIMULATE_ATTACK"); simulate == "true" {
 		config.SimulateAttack = true
 	}
-	if env := os.Getenv("ENV"); env != "" {
+	if simulate := getenv("SIMULATE"); simulate != "" {
+		config.Simulate = simulate
+	}
+	if env := getenv("ENV"); env != "" {
 		config.Env = env
 	}
-	if team := os.Getenv("OWNER_TEAM"); team != "" {
+	if team := getenv("OWNER_TEAM"); team != "" {
 		config.OwnerTeam = team
 	}
-	if serverID := os.Getenv("SERVER_ID"); serverID != "" {
+	if serverID := getenv("SERVER_ID"); serverID != "" {
 		config.ServerID = serverID
 	}
-	if maxLogs := os.Getenv("MAX_LOG_ENTRIES"); maxLogs != "" {
+	if agentIDFile := getenv("AGENT_ID_FILE"); agentIDFile != "" {
+		config.AgentIDFile = agentIDFile
+	}
+	if maxLogs := getenv("MAX_LOG_ENTRIES"); maxLogs != "" {
 		if i, err := strconv.Atoi(maxLogs); err == nil {
 			config.MaxLogEntries = i
 		}
 	}
+	if dedupe := getenv("DEDUPE_LOGS"); dedupe != "" {
+		if b, err := strconv.ParseBool(dedupe); err == nil {
+			config.DedupeLogs = b
+		}
+	}
+	if memoryBudget := getenv("MEMORY_BUDGET_MB"); memoryBudget != "" {
+		if i, err := strconv.Atoi(memoryBudget); err == nil {
+			config.MemoryBudgetMB = i
+		}
+	}
+	if maxPayload := getenv("MAX_PAYLOAD_KB"); maxPayload != "" {
+		if i, err := strconv.Atoi(maxPayload); err == nil {
+			config.MaxPayloadKB = i
+		}
+	}
+	if logWorkers := getenv("LOG_WORKERS"); logWorkers != "" {
+		if i, err := strconv.Atoi(logWorkers); err == nil {
+			config.LogWorkers = i
+		}
+	}
+	if healthAddr, ok := lookupEnv("HEALTH_ADDR"); ok {
+		config.HealthAddr = healthAddr
+	}
+	config.HealthAddr = normalizeHealthAddr(config.HealthAddr)
+	if auditLog, ok := lookupEnv("AUDIT_LOG"); ok {
+		config.AuditLogPath = auditLog
+	}
+	if adminToken := getenv("ADMIN_TOKEN"); adminToken != "" {
+		config.AdminToken = adminToken
+	}
+	if maskRules := getenv("MASK_RULES_FILE"); maskRules != "" {
+		config.MaskRulesFile = maskRules
+	}
+	if parseRules := getenv("PARSE_RULES_FILE"); parseRules != "" {
+		config.ParseRulesFile = parseRules
+	}
+	if detectors := getenv("DETECTORS"); detectors != "" {
+		config.Detectors = detectors
+	}
+	if hooks := getenv("HOOKS"); hooks != "" {
+		config.Hooks = hooks
+	}
+	if piiMask := getenv("PII_MASK"); piiMask != "" {
+		config.PIIMask = piiMask
+	}
+	if maskMode := getenv("MASK_MODE"); maskMode != "" {
+		config.MaskMode = maskMode
+	}
+	if hashKey := getenv("MASK_HASH_KEY"); hashKey != "" {
+		config.MaskHashKey = hashKey
+	}
+	if fipsMode := getenv("FIPS"); fipsMode == "true" {
+		config.FIPS = true
+	}
+	if dryRun := getenv("DRY_RUN"); dryRun == "true" {
+		config.DryRun = true
+	}
+	if exporter := getenv("EXPORTER"); exporter == "true" {
+		config.Exporter = true
+	}
+	if requireAck := getenv("REQUIRE_ACK"); requireAck == "true" {
+		config.RequireAck = true
+	}
+	if grpcAddr := getenv("GRPC_ADDR"); grpcAddr != "" {
+		config.GRPCAddr = grpcAddr
+	}
+	if grpcInsecure := getenv("GRPC_INSECURE"); grpcInsecure == "true" {
+		config.GRPCInsecure = true
+	}
+	if proxyURL := getenv("PROXY_URL"); proxyURL != "" {
+		config.ProxyURL = proxyURL
+	}
+	if compression := getenv("COMPRESSION"); compression != "" {
+		config.Compression = compression
+	}
+	if batchSize := getenv("BATCH_SIZE"); batchSize != "" {
+		if i, err := strconv.Atoi(batchSize); err == nil {
+			config.BatchSize = i
+		}
+	}
+	if batchMaxKB := getenv("BATCH_MAX_KB"); batchMaxKB != "" {
+		if i, err := strconv.Atoi(batchMaxKB); err == nil {
+			config.BatchMaxKB = i
+		}
+	}
+	if clientCert := getenv("CLIENT_CERT"); clientCert != "" {
+		config.ClientCert = clientCert
+	}
+	if clientKey := getenv("CLIENT_KEY"); clientKey != "" {
+		config.ClientKey = clientKey
+	}
+	if serverCA := getenv("SERVER_CA"); serverCA != "" {
+		config.ServerCA = serverCA
+	}
+	if tlsMinVersion := getenv("TLS_MIN_VERSION"); tlsMinVersion != "" {
+		config.TLSMinVersion = tlsMinVersion
+	}
+	if outputDir := getenv("OUTPUT_DIR"); outputDir != "" {
+		config.OutputDir = outputDir
+	}
+	if maxFileMB := getenv("OUTPUT_MAX_FILE_MB"); maxFileMB != "" {
+		if i, err := strconv.Atoi(maxFileMB); err == nil {
+			config.OutputMaxFileMB = i
+		}
+	}
+	if maxFiles := getenv("OUTPUT_MAX_FILES"); maxFiles != "" {
+		if i, err := strconv.Atoi(maxFiles); err == nil {
+			config.OutputMaxFiles = i
+		}
+	}
+	if webhook := getenv("SLACK_WEBHOOK"); webhook != "" {
+		config.SlackWebhook = webhook
+	}
+	if webhook := getenv("SLACK_CRITICAL_WEBHOOK"); webhook != "" {
+		config.SlackCriticalWebhook = webhook
+	}
+	if tmpl := getenv("SLACK_TEMPLATE"); tmpl != "" {
+		config.SlackTemplate = tmpl
+	}
+	if repeat := getenv("SLACK_REPEAT_MINUTES"); repeat != "" {
+		if i, err := strconv.Atoi(repeat); err == nil {
+			config.SlackRepeatMinutes = i
+		}
+	}
+	if severity := getenv("SLACK_MIN_SEVERITY"); severity != "" {
+		config.SlackMinSeverity = severity
+	}
+	if webhook := getenv("DISCORD_WEBHOOK"); webhook != "" {
+		config.DiscordWebhook = webhook
+	}
+	if webhook := getenv("DISCORD_CRITICAL_WEBHOOK"); webhook != "" {
+		config.DiscordCriticalWebhook = webhook
+	}
+	if repeat := getenv("DISCORD_REPEAT_MINUTES"); repeat != "" {
+		if i, err := strconv.Atoi(repeat); err == nil {
+			config.DiscordRepeatMinutes = i
+		}
+	}
+	if tmpl := getenv("DISCORD_TEMPLATE"); tmpl != "" {
+		config.DiscordTemplate = tmpl
+	}
+	if severity := getenv("DISCORD_MIN_SEVERITY"); severity != "" {
+		config.DiscordMinSeverity = severity
+	}
+	if webhook := getenv("TEAMS_WEBHOOK"); webhook != "" {
+		config.TeamsWebhook = webhook
+	}
+	if webhook := getenv("TEAMS_CRITICAL_WEBHOOK"); webhook != "" {
+		config.TeamsCriticalWebhook = webhook
+	}
+	if repeat := getenv("TEAMS_REPEAT_MINUTES"); repeat != "" {
+		if i, err := strconv.Atoi(repeat); err == nil {
+			config.TeamsRepeatMinutes = i
+		}
+	}
+	if tmpl := getenv("TEAMS_TEMPLATE"); tmpl != "" {
+		config.TeamsTemplate = tmpl
+	}
+	if severity := getenv("TEAMS_MIN_SEVERITY"); severity != "" {
+		config.TeamsMinSeverity = severity
+	}
+	if tmpl := getenv("NOTIFY_TEMPLATE"); tmpl != "" {
+		config.NotifyTemplate = tmpl
+	}
+	if group := getenv("NOTIFY_GROUP_SECONDS"); group != "" {
+		if i, err := strconv.Atoi(group); err == nil {
+			config.NotifyGroupSeconds = i
+		}
+	}
+	if limit := getenv("NOTIFY_RATE_LIMIT"); limit != "" {
+		if i, err := strconv.Atoi(limit); err == nil {
+			config.NotifyRateLimit = i
+		}
+	}
+	if dsn := getenv("SENTRY_DSN"); dsn != "" {
+		config.SentryDSN = dsn
+	}
+	if threshold := getenv("SENTRY_ERROR_THRESHOLD"); threshold != "" {
+		if i, err := strconv.Atoi(threshold); err == nil {
+			config.SentryErrorThreshold = i
+		}
+	}
+	if authOffsetFile := getenv("AUTH_OFFSET_FILE"); authOffsetFile != "" {
+		config.AuthOffsetFile = authOffsetFile
+	}
+	if authLogs := getenv("AUTH_LOGS"); authLogs != "" {
+		config.AuthLogs = authLogs
+	}
+	if authLogFormat := getenv("AUTH_LOG_FORMAT"); authLogFormat != "" {
+		config.AuthLogFormat = authLogFormat
+	}
+	if authLogPattern := getenv("AUTH_LOG_PATTERN"); authLogPattern != "" {
+		config.AuthLogPattern = authLogPattern
+	}
+	if authSource := getenv("AUTH_SOURCE"); authSource != "" {
+		config.AuthSource = authSource
+	}
+	if manifest := getenv("INTEGRITY_MANIFEST"); manifest != "" {
+		config.IntegrityManifest = manifest
+	}
+	if interval := getenv("INTEGRITY_INTERVAL"); interval != "" {
+		if i, err := strconv.Atoi(interval); err == nil {
+			config.IntegrityInterval = i
+		}
+	}
+	if healthToken := getenv("HEALTH_TOKEN"); healthToken != "" {
+		config.HealthToken = healthToken
+	}
+	if cert := getenv("HEALTH_TLS_CERT"); cert != "" {
+		config.HealthTLSCert = cert
+	}
+	if key := getenv("HEALTH_TLS_KEY"); key != "" {
+		config.HealthTLSKey = key
+	}
+	if ca := getenv("HEALTH_CLIENT_CA"); ca != "" {
+		config.HealthClientCA = ca
+	}
 
-	return config
+	return config, nil
 }
 
-func main() {
-	config := parseConfig()
+// validateConfig checks the settings required before the agent can start
+func validateConfig(config Config) error {
+	if config.DryRun {
+		return nil
+	}
+	if config.Exporter {
+		if config.HealthAddr == "" {
+			return fmt.Errorf("exporter mode serves results on the health server (set --health-addr)")
+		}
+		return nil
+	}
+	if config.ServerURL == "" && config.GRPCAddr == "" && config.OutputDir == "" {
+		return fmt.Errorf("server URL is required (use --server-url flag or SERVER_URL environment variable), or --output-dir for offline mode")
+	}
+	if err := validateServerURLs(config); err != nil {
+		return err
+	}
+	if err := validateSecretSource(config); err != nil {
+		return err
+	}
+	if (config.ServerURL != "" || config.GRPCAddr != "") && !secretConfigured(config) && config.EnrollToken == "" && !fileExists(config.CredentialsFile) {
+		return fmt.Errorf("secret is required (use SECRET, --secret-file or --vault-addr, or --enroll-token to enroll)")
+	}
+	return nil
+}
 
-	if config.ServerURL == "" {
-		log.Fatal("Server URL is required (use --server-url flag or SERVER_URL environment variable)")
+// runAgent runs the agent until SIGINT or SIGTERM
+func runAgent(config Config) error {
+	// Keep recent log output for `diag` bundles, and count errors for Sentry
+	reporter, err := newSentryReporter(config)
+	if err != nil {
+		return err
 	}
-	if config.Secret == "" {
-		log.Fatal("Secret is required (use --secret flag or SECRET environment variable)")
+	if reporter != nil {
+		sentry = reporter
+		log.SetOutput(io.MultiWriter(os.Stderr, agentLog, reporter))
+	} else {
+		log.SetOutput(io.MultiWriter(os.Stderr, agentLog))
 	}
+	defer reportPanic()
 
 	agent, err := NewAgent(config)
 	if err != nil {
-		log.Fatalf("Failed to create agent: %v", err)
+		return fmt.Errorf("failed to create agent: %w", err)
 	}
 
 	// Setup graceful shutdown
@@ -1263,7 +2959,9 @@ func main() {
 		cancel()
 	}()
 
-	if err := agent.Run(ctx); err != nil {
-		log.Fatalf("Agent error: %v", err)
-	}
-}
\ No newline at end of file
+	return agent.Run(ctx)
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
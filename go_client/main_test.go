@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -246,4 +247,137 @@ func TestBruteForceDetection(t *testing.T) {
 	}
 	
 	t.Logf("Brute force detection test passed: detected attack from %s", testIP)
-}
\ No newline at end of file
+}
+
+// TestWarmupSuppressesAlerts tests that baseline detectors stay quiet during
+// the startup grace period and ignore auth failures replayed during it
+func TestWarmupSuppressesAlerts(t *testing.T) {
+	config := Config{
+		AuthWindowSeconds:   300,
+		FailedAuthThreshold: 5,
+		BaselineSamples:     5,
+		CPUSpikePct:         85.0,
+		WarmupSeconds:       60,
+	}
+
+	agent, err := NewAgent(config)
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if !agent.warmingUp() {
+		t.Fatal("Expected agent to be warming up after start")
+	}
+
+	for _, sample := range []float64{20.0, 22.0, 21.0, 23.0, 19.0} {
+		agent.updateCPUBaseline(sample)
+	}
+	agent.updateCPUBaseline(95.0)
+
+	// Old auth log lines read at startup
+	for i := 0; i < 10; i++ {
+		agent.recordAuthFailure("192.168.1.100", time.Now())
+	}
+	agent.checkBruteForceAttacks()
+
+	if len(agent.localAlerts) != 0 {
+		t.Fatalf("Expected no alerts during warm-up, got %v", agent.localAlerts)
+	}
+	if len(agent.cpuSamples) != 5 {
+		t.Errorf("Expected CPU baseline to keep collecting during warm-up, got %d samples", len(agent.cpuSamples))
+	}
+
+	// Warm-up over: failures replayed during it still don't count, new ones do
+	agent.warmupUntil = time.Now()
+	agent.checkBruteForceAttacks()
+	if len(agent.localAlerts) != 0 {
+		t.Fatalf("Expected replayed auth failures to be ignored, got %v", agent.localAlerts)
+	}
+	for i := 0; i < 5; i++ {
+		agent.recordAuthFailure("192.168.1.100", time.Now().Add(time.Second))
+	}
+	agent.checkBruteForceAttacks()
+	for _, sample := range []float64{20.0, 22.0, 21.0, 23.0, 19.0} {
+		agent.updateCPUBaseline(sample)
+	}
+	agent.updateCPUBaseline(95.0)
+
+	for _, expected := range []string{"BRUTE_FORCE:192.168.1.100", "CPU_SPIKE"} {
+		if !agent.containsAlert(expected) {
+			t.Errorf("Expected %s after warm-up, got %v", expected, agent.localAlerts)
+		}
+	}
+}
+
+// TestMetricsEndpointCached tests that /metrics serves the last collected
+// snapshot without sampling the CPU or touching the baseline
+func TestMetricsEndpointCached(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := NewAgent(Config{HealthAddr: "unix:" + socketPath, BaselineSamples: 5})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.healthServer.Close()
+
+	collectedAt := time.Now().Add(-time.Minute)
+	agent.lastMetrics = SystemMetrics{CPUUsage: 42.5, MemoryUsage: 61.0}
+	agent.lastMetricsAt = collectedAt
+
+	client, err := newTopClient("unix:"+socketPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var status MetricsStatus
+	for i := 0; i < 3; i++ {
+		if err := client.get("/metrics", &status); err != nil {
+			t.Fatalf("Failed to fetch metrics: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("Expected cached metrics to be served without sampling, took %v", elapsed)
+	}
+	if status.CPU != 42.5 || status.Memory != 61.0 || !status.CollectedAt.Equal(collectedAt) {
+		t.Errorf("Expected the last snapshot, got %+v", status)
+	}
+	if len(agent.cpuSamples) != 0 {
+		t.Errorf("Expected scrapes to leave the CPU baseline alone, got %d samples", len(agent.cpuSamples))
+	}
+}
+
+// TestLogDeduplication tests that identical consecutive lines from a container
+// collapse into one entry, even when other containers' lines are interleaved
+func TestLogDeduplication(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 3, DedupeLogs: true})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		agent.processLogLine("web", "GET /health 200")
+		agent.processLogLine("db", "checkpoint complete")
+	}
+	agent.processLogLine("web", "GET /orders 200")
+	agent.processLogLine("web", "GET /health 200") // not consecutive, starts a new entry
+
+	if len(agent.logBuffer) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v", agent.logBuffer)
+	}
+	db := agent.logBuffer[0]
+	if db.Container != "db" || db.Count != 5 || db.LastTimestamp.Before(db.Timestamp) {
+		t.Errorf("Expected db line collapsed 5 times, got %+v", db)
+	}
+	if web := agent.logBuffer[2]; web.Message != "GET /health 200" || web.Count != 0 {
+		t.Errorf("Expected a fresh health check entry, got %+v", web)
+	}
+
+	// Positions stay valid after the oldest entries are dropped and delivered
+	agent.processLogLine("web", "GET /health 200")
+	if agent.logBuffer[2].Count != 2 {
+		t.Errorf("Expected repeat after eviction, got %+v", agent.logBuffer)
+	}
+	agent.payloadDelivered(Payload{})
+	agent.processLogLine("web", "GET /health 200")
+	if len(agent.logBuffer) != 1 || agent.logBuffer[0].Count != 0 {
+		t.Errorf("Expected a new entry after delivery, got %+v", agent.logBuffer)
+	}
+}
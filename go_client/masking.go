@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Default replacement for masked values
+const redactedValue = "[REDACTED]"
+
+// Masking modes, which are also per-rule strategies
+const (
+	MaskModeRedact = "redact"
+	MaskModeHash   = "hash"
+	// MaskStrategyPartial keeps the last characters of a value, like the last
+	// four digits of a card number
+	MaskStrategyPartial = "partial"
+)
+
+// Characters MaskStrategyPartial keeps unless a rule sets keep_last
+const defaultKeepLast = 4
+
+// Match validators user rules can name in "validate"
+var maskValidators = map[string]func(string) bool{
+	"luhn": luhnValid,
+}
+
+// MaskRule is a named sensitive-data masking rule. If the pattern has a named
+// group "value", only that group is masked; otherwise the whole match is. A
+// Replacement containing "$" is expanded as a template instead (redact mode only).
+type MaskRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+	// Strategy overrides the masking mode for this rule: redact, hash, or
+	// partial, which replaces all but the last KeepLast characters with "*"
+	Strategy string `json:"strategy,omitempty"`
+	KeepLast int    `json:"keep_last,omitempty"`
+	// Validate names a check a match must pass to be masked: "luhn" for card numbers
+	Validate string `json:"validate,omitempty"`
+	// Keywords optionally lists literals, matched ignoring ASCII case, of which
+	// at least one must occur in a line for the pattern to be tried. Lines
+	// without any skip the regexp entirely. Defaults to the pattern's literal
+	// prefix, if it has one.
+	Keywords []string `json:"keywords,omitempty"`
+
+	re *regexp.Regexp
+	// valueGroup is the index of the "value" capture group, or 0 for the whole match
+	valueGroup int
+	// validate optionally confirms a match before it is masked (e.g. Luhn check)
+	validate func(match string) bool
+	// prefilter optionally rules out lines cheaply before the regexp runs
+	prefilter func(message string) bool
+	// pii marks rules that detect personal data rather than leaked credentials
+	pii bool
+}
+
+// ContainerMasking overrides masking rules for a single container
+type ContainerMasking struct {
+	Disable []string   `json:"disable,omitempty"`
+	Rules   []MaskRule `json:"rules,omitempty"`
+}
+
+// MaskingConfig is the format of the --mask-rules-file JSON document
+type MaskingConfig struct {
+	Mode            string                      `json:"mode"`
+	HashKey         string                      `json:"-"`
+	DisableDefaults bool                        `json:"disable_defaults"`
+	PII             []string                    `json:"pii"`
+	Rules           []MaskRule                  `json:"rules"`
+	Containers      map[string]ContainerMasking `json:"containers"`
+}
+
+// defaultMaskRules are always applied unless disabled in the masking config
+var defaultMaskRules = []MaskRule{
+	{Name: "key_value", Pattern: `(?i)(?:password|token|secret|key|auth)=(?P<value>[^\s&]+)`,
+		Keywords: []string{"password=", "token=", "secret=", "key=", "auth="}},
+	{Name: "json_field", Pattern: `(?i)"(?:password|token|secret|key|auth)"\s*:\s*"(?P<value>[^"]*)"`,
+		Keywords: []string{`password"`, `token"`, `secret"`, `key"`, `auth"`}},
+	{Name: "authorization_header", Pattern: `(?i)authorization\s*[:=]\s*(?:(?:bearer|basic|digest|token|negotiate)\s+)?(?P<value>[^\s,;"']+)`,
+		Keywords: []string{"authorization"}},
+	{Name: "cookie", Pattern: `(?i)(?:set-)?cookie\s*:\s*(?P<value>[^\r\n"]+)`, Keywords: []string{"cookie"}},
+	{Name: "jwt", Pattern: `eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`},
+	{Name: "connection_string", Pattern: `(?i)\b[a-z][a-z0-9+.-]*://[^:/\s@]+:(?P<value>[^@\s/]+)@`, Keywords: []string{"://"}},
+}
+
+// masker applies compiled masking rules, with per-container overrides. The
+// rules are replaced in place when --mask-rules-file is reloaded.
+type masker struct {
+	mu         sync.RWMutex
+	mode       string
+	hashKey    []byte
+	global     []*MaskRule
+	containers map[string][]*MaskRule
+
+	// Rules set by containers' richardops.mask.* labels, which replace
+	// those above for the container, and the overrides they are built from
+	labels    map[string][]*MaskRule
+	overrides map[string]ContainerMasking
+}
+
+// compile prepares a rule for use
+func (r *MaskRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("masking rule with pattern %q has no name", r.Pattern)
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("masking rule %q: %w", r.Name, err)
+	}
+	r.re = re
+	if idx := re.SubexpIndex("value"); idx > 0 {
+		r.valueGroup = idx
+	}
+	keywords := r.Keywords
+	if len(keywords) == 0 {
+		if prefix, _ := re.LiteralPrefix(); prefix != "" {
+			keywords = []string{prefix}
+		}
+	}
+	r.Keywords = nil
+	for _, keyword := range keywords {
+		r.Keywords = append(r.Keywords, strings.ToLower(keyword))
+	}
+	if r.Replacement == "" {
+		r.Replacement = redactedValue
+	}
+	switch r.Strategy {
+	case "", MaskModeRedact, MaskModeHash:
+	case MaskStrategyPartial:
+		if r.KeepLast < 0 {
+			return fmt.Errorf("masking rule %q: keep_last must not be negative", r.Name)
+		}
+		if r.KeepLast == 0 {
+			r.KeepLast = defaultKeepLast
+		}
+	default:
+		return fmt.Errorf("masking rule %q: unknown strategy %q (valid: redact, hash, partial)", r.Name, r.Strategy)
+	}
+	if r.Validate != "" {
+		validate, ok := maskValidators[r.Validate]
+		if !ok {
+			return fmt.Errorf("masking rule %q: unknown validate %q (valid: luhn)", r.Name, r.Validate)
+		}
+		r.validate = validate
+	}
+	return nil
+}
+
+// loadMaskingConfig reads a masking config file; an empty path yields the defaults
+func loadMaskingConfig(path string) (MaskingConfig, error) {
+	var cfg MaskingConfig
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// buildMasker compiles masking rules from the rules file and agent flags
+func buildMasker(config Config) (*masker, error) {
+	maskingConfig, err := loadMaskingConfig(config.MaskRulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load masking rules: %w", err)
+	}
+	maskingConfig.PII = append(maskingConfig.PII, parsePIICategories(config.PIIMask)...)
+	if config.MaskMode != "" {
+		maskingConfig.Mode = config.MaskMode
+	}
+	// Never the signing secret: enrolled agents each have their own and
+	// rotation changes it, and hashes must match across the fleet
+	maskingConfig.HashKey = config.MaskHashKey
+	dataMasker, err := newMasker(maskingConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid masking rules: %w", err)
+	}
+	return dataMasker, nil
+}
+
+// newMasker compiles the default and user-supplied rules
+func newMasker(cfg MaskingConfig) (*masker, error) {
+	m := &masker{
+		mode:       cfg.Mode,
+		hashKey:    []byte(cfg.HashKey),
+		containers: make(map[string][]*MaskRule),
+		labels:     make(map[string][]*MaskRule),
+		overrides:  make(map[string]ContainerMasking),
+	}
+	switch m.mode {
+	case "":
+		m.mode = MaskModeRedact
+	case MaskModeRedact:
+	case MaskModeHash:
+		if cfg.HashKey == "" {
+			return nil, fmt.Errorf("hash masking mode requires --mask-hash-key")
+		}
+	default:
+		return nil, fmt.Errorf("unknown masking mode %q (valid: redact, hash)", cfg.Mode)
+	}
+
+	var rules []MaskRule
+	if !cfg.DisableDefaults {
+		rules = append(rules, defaultMaskRules...)
+	}
+	pii, err := piiRulesFor(cfg.PII)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, pii...)
+	rules = append(rules, cfg.Rules...)
+
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		if rule.Strategy == MaskModeHash && cfg.HashKey == "" {
+			return nil, fmt.Errorf("masking rule %q: the hash strategy requires --mask-hash-key", rule.Name)
+		}
+		m.global = append(m.global, &rule)
+	}
+
+	for name, override := range cfg.Containers {
+		disabled := make(map[string]bool)
+		for _, ruleName := range override.Disable {
+			disabled[ruleName] = true
+		}
+
+		var containerRules []*MaskRule
+		for _, rule := range m.global {
+			if !disabled[rule.Name] {
+				containerRules = append(containerRules, rule)
+			}
+		}
+		for i := range override.Rules {
+			rule := override.Rules[i]
+			if err := rule.compile(); err != nil {
+				return nil, fmt.Errorf("container %s: %w", name, err)
+			}
+			if rule.Strategy == MaskModeHash && cfg.HashKey == "" {
+				return nil, fmt.Errorf("container %s: masking rule %q: the hash strategy requires --mask-hash-key", name, rule.Name)
+			}
+			containerRules = append(containerRules, &rule)
+		}
+		m.containers[strings.TrimPrefix(name, "/")] = containerRules
+	}
+
+	return m, nil
+}
+
+// rulesFor returns the rules that apply to a container. Must be called with
+// mu held.
+func (m *masker) rulesFor(container string) []*MaskRule {
+	container = strings.TrimPrefix(container, "/")
+	if rules, ok := m.labels[container]; ok {
+		return rules
+	}
+	if rules, ok := m.containers[container]; ok {
+		return rules
+	}
+	return m.global
+}
+
+// setContainerOverride applies a container's label overrides on top of the
+// rules the masking config gives it. Override rules must be compiled.
+func (m *masker) setContainerOverride(container string, override ContainerMasking) {
+	container = strings.TrimPrefix(container, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[container] = override
+	m.labels[container] = m.overrideRules(container, override)
+}
+
+// overrideRules builds a container's rules from its label overrides. Must be
+// called with mu held.
+func (m *masker) overrideRules(container string, override ContainerMasking) []*MaskRule {
+	base, ok := m.containers[container]
+	if !ok {
+		base = m.global
+	}
+
+	disabled := make(map[string]bool)
+	for _, ruleName := range override.Disable {
+		disabled[ruleName] = true
+	}
+	var rules []*MaskRule
+	for _, rule := range base {
+		if !disabled[rule.Name] {
+			rules = append(rules, rule)
+		}
+	}
+	for i := range override.Rules {
+		rule := override.Rules[i]
+		rules = append(rules, &rule)
+	}
+	return rules
+}
+
+// clearContainerOverride drops a container's label overrides
+func (m *masker) clearContainerOverride(container string) {
+	container = strings.TrimPrefix(container, "/")
+	m.mu.Lock()
+	delete(m.labels, container)
+	delete(m.overrides, container)
+	m.mu.Unlock()
+}
+
+// replace swaps in the mode and rules of a newly compiled masker, keeping
+// containers' label overrides on top of them
+func (m *masker) replace(next *masker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode = next.mode
+	m.hashKey = next.hashKey
+	m.global = next.global
+	m.containers = next.containers
+	for container, override := range m.overrides {
+		m.labels[container] = m.overrideRules(container, override)
+	}
+}
+
+// ruleCount returns the number of rules applied to containers without overrides
+func (m *masker) ruleCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.global)
+}
+
+// Mask applies the container's rules to a message
+func (m *masker) Mask(container, message string) string {
+	masked, _ := m.MaskWithHits(container, message)
+	return masked
+}
+
+// ruleHit counts the values one masking rule caught in a message
+type ruleHit struct {
+	Rule  string
+	Count int
+}
+
+// MaskWithHits applies the container's rules to a message and also returns how
+// many credential (non-PII) values each rule masked, or nil if none were.
+func (m *masker) MaskWithHits(container, message string) (string, []ruleHit) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var secretHits []ruleHit
+	for _, rule := range m.rulesFor(container) {
+		var count int
+		message, count = m.apply(rule, message)
+		if count > 0 && !rule.pii {
+			secretHits = append(secretHits, ruleHit{Rule: rule.Name, Count: count})
+		}
+	}
+	return message, secretHits
+}
+
+// mayMatch reports whether the rule's pattern could match message: it
+// contains one of the keywords (if any) and passes the prefilter (if any)
+func (r *MaskRule) mayMatch(message string) bool {
+	if r.prefilter != nil && !r.prefilter(message) {
+		return false
+	}
+	if len(r.Keywords) == 0 {
+		return true
+	}
+	for _, keyword := range r.Keywords {
+		if containsFold(message, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether s contains the lower-case ASCII substr,
+// ignoring case, without allocating a lowered copy of s
+func containsFold(s, substr string) bool {
+	n := len(substr)
+	if n == 0 {
+		return true
+	}
+	first := substr[0]
+	firstUpper := first
+	if 'a' <= first && first <= 'z' {
+		firstUpper -= 'a' - 'A'
+	}
+	for i := 0; i+n <= len(s); i++ {
+		if c := s[i]; c != first && c != firstUpper {
+			continue
+		}
+		j := 1
+		for ; j < n; j++ {
+			c := s[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != substr[j] {
+				break
+			}
+		}
+		if j == n {
+			return true
+		}
+	}
+	return false
+}
+
+// apply masks every match of a single rule and returns the number of values masked
+func (m *masker) apply(rule *MaskRule, message string) (string, int) {
+	if !rule.mayMatch(message) {
+		return message, 0
+	}
+	matches := rule.re.FindAllStringSubmatchIndex(message, -1)
+	if matches == nil {
+		return message, 0
+	}
+
+	var b strings.Builder
+	b.Grow(len(message))
+	last := 0
+	count := 0
+	for _, loc := range matches {
+		if rule.validate != nil && !rule.validate(message[loc[0]:loc[1]]) {
+			continue
+		}
+		count++
+
+		if rule.valueGroup == 0 && strings.Contains(rule.Replacement, "$") && (rule.Strategy == "" || rule.Strategy == MaskModeRedact) {
+			b.WriteString(message[last:loc[0]])
+			b.Write(rule.re.ExpandString(nil, rule.Replacement, message, loc))
+			last = loc[1]
+			continue
+		}
+
+		start, end := loc[0], loc[1]
+		if rule.valueGroup > 0 && loc[2*rule.valueGroup] >= 0 {
+			start, end = loc[2*rule.valueGroup], loc[2*rule.valueGroup+1]
+		}
+		b.WriteString(message[last:start])
+		b.WriteString(m.token(rule, message[start:end]))
+		last = end
+	}
+	b.WriteString(message[last:])
+	return b.String(), count
+}
+
+// token returns the replacement for a masked value under the rule's strategy,
+// or else the masking mode: the rule's replacement to redact, a keyed hash
+// that lets the server correlate identical values across hosts without
+// learning them, or the value's last characters after asterisks. Must be
+// called with mu held.
+func (m *masker) token(rule *MaskRule, value string) string {
+	strategy := rule.Strategy
+	if strategy == "" {
+		strategy = m.mode
+	}
+	switch strategy {
+	case MaskModeHash:
+		h := hmac.New(sha256.New, m.hashKey)
+		h.Write([]byte(value))
+		return "[HASH:" + hex.EncodeToString(h.Sum(nil))[:16] + "]"
+	case MaskStrategyPartial:
+		runes := []rune(value)
+		keep := min(rule.KeepLast, len(runes)/2)
+		return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+	}
+	return rule.Replacement
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDefaultMaskRules tests the built-in masking rules beyond key=value pairs
+func TestDefaultMaskRules(t *testing.T) {
+	m, err := newMasker(MaskingConfig{})
+	if err != nil {
+		t.Fatalf("Failed to compile default rules: %v", err)
+	}
+
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"Authorization: Bearer abc.def", "Authorization: Bearer [REDACTED]"},
+		{"authorization=Basic dXNlcjpwYXNz", "authorization=Basic [REDACTED]"},
+		{"Cookie: session=abc; theme=dark", "Cookie: [REDACTED]"},
+		{"jwt eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig_123 seen", "jwt [REDACTED] seen"},
+		{"connecting to postgres://app:hunter2@db:5432/app", "connecting to postgres://app:[REDACTED]@db:5432/app"},
+		{"login PASSWORD=hunter2 Token=abc", "login PASSWORD=[REDACTED] Token=[REDACTED]"},
+		{`{"Secret": "s3cr3t"}`, `{"Secret": "[REDACTED]"}`},
+		{"GET /health 200 1ms", "GET /health 200 1ms"},
+	}
+
+	for _, tc := range testCases {
+		if result := m.Mask("", tc.input); result != tc.expected {
+			t.Errorf("Expected '%s' for input '%s', got '%s'", tc.expected, tc.input, result)
+		}
+	}
+}
+
+// TestMaskingConfigFile tests user rules, disabled defaults and per-container overrides
+func TestMaskingConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "masking.json")
+	os.WriteFile(path, []byte(`{
+		"rules": [{"name": "employee_id", "pattern": "EMP-[0-9]{6}"}],
+		"containers": {
+			"legacy-app": {
+				"disable": ["employee_id"],
+				"rules": [{"name": "pin", "pattern": "(pin=)[0-9]+", "replacement": "${1}****"}]
+			}
+		}
+	}`), 0600)
+
+	cfg, err := loadMaskingConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load masking config: %v", err)
+	}
+	m, err := newMasker(cfg)
+	if err != nil {
+		t.Fatalf("Failed to compile masking config: %v", err)
+	}
+
+	if got := m.Mask("/web", "user EMP-123456 password=x"); got != "user [REDACTED] password=[REDACTED]" {
+		t.Errorf("Unexpected global masking result: %s", got)
+	}
+	if got := m.Mask("/legacy-app", "user EMP-123456 pin=1234"); got != "user EMP-123456 pin=****" {
+		t.Errorf("Unexpected container override result: %s", got)
+	}
+
+	if _, err := newMasker(MaskingConfig{Rules: []MaskRule{{Name: "bad", Pattern: "("}}}); err == nil {
+		t.Error("Expected invalid pattern to be rejected")
+	}
+
+	m, _ = newMasker(MaskingConfig{DisableDefaults: true})
+	if got := m.Mask("", "password=secret"); got != "password=secret" {
+		t.Errorf("Expected defaults to be disabled, got %s", got)
+	}
+}
+
+// TestMaskRuleKeywords tests that rules only run their pattern on lines
+// containing a keyword, with keywords defaulting to the literal prefix
+func TestMaskRuleKeywords(t *testing.T) {
+	m, err := newMasker(MaskingConfig{DisableDefaults: true, Rules: []MaskRule{
+		{Name: "api_key", Pattern: `(?i)x-api-key:\s*(?P<value>\S+)`, Keywords: []string{"X-API-Key"}},
+		{Name: "employee_id", Pattern: `EMP-[0-9]{6}`},
+		// Keywords are a prefilter only: a wrong keyword hides matches
+		{Name: "wrong_keyword", Pattern: `pin=[0-9]+`, Keywords: []string{"passcode"}},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	if keywords := m.global[1].Keywords; len(keywords) != 1 || keywords[0] != "emp-" {
+		t.Errorf("Expected literal prefix keyword, got %v", keywords)
+	}
+
+	masked, hits := m.MaskWithHits("", "X-API-KEY: abc123 user EMP-123456 pin=1234")
+	if masked != "X-API-KEY: [REDACTED] user [REDACTED] pin=1234" {
+		t.Errorf("Unexpected masking result: %s", masked)
+	}
+	if len(hits) != 2 || hits[0] != (ruleHit{"api_key", 1}) || hits[1] != (ruleHit{"employee_id", 1}) {
+		t.Errorf("Unexpected hits: %v", hits)
+	}
+
+	for _, tc := range []struct {
+		s, substr string
+		expected  bool
+	}{
+		{"Authorization: x", "authorization", true},
+		{"AUTH", "auth=", false},
+		{"xxPaSsWoRd=", "password=", true},
+		{"", "a", false},
+	} {
+		if got := containsFold(tc.s, tc.substr); got != tc.expected {
+			t.Errorf("containsFold(%q, %q) = %v", tc.s, tc.substr, got)
+		}
+	}
+	for _, tc := range []struct {
+		s         string
+		minDigits int
+		expected  bool
+	}{
+		{"4111 1111 1111 1111", 13, true},
+		{"ts=2026-10-16T19:16:42Z", 9, false},
+		{"123-45-6789", 9, true},
+		{"12--34", 4, false},
+	} {
+		if got := hasDigitRun(tc.s, tc.minDigits, " -"); got != tc.expected {
+			t.Errorf("hasDigitRun(%q, %d) = %v", tc.s, tc.minDigits, got)
+		}
+	}
+}
+
+// BenchmarkProcessLogLine measures the per-line cost of masking and buffering
+// a realistic mix of log lines with all PII categories enabled
+func BenchmarkProcessLogLine(b *testing.B) {
+	agent, err := NewAgent(Config{MaxLogEntries: 500, PIIMask: "email,credit_card,national_id,ip"})
+	if err != nil {
+		b.Fatalf("Failed to create agent: %v", err)
+	}
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = benchLine(i+1, 160)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		agent.processLogLine("web", lines[i%len(lines)])
+	}
+}
+
+// TestHashMaskingMode tests that hash mode produces stable keyed hashes of the masked value only
+func TestHashMaskingMode(t *testing.T) {
+	m, err := newMasker(MaskingConfig{Mode: MaskModeHash, HashKey: "fleet-key"})
+	if err != nil {
+		t.Fatalf("Failed to create hash masker: %v", err)
+	}
+
+	first := m.Mask("", "token=abc123 user=bob")
+	second := m.Mask("/other", `{"token": "abc123"}`)
+	if !strings.HasPrefix(first, "token=[HASH:") || !strings.HasSuffix(first, "] user=bob") {
+		t.Fatalf("Unexpected hash masking result: %s", first)
+	}
+	hash := first[len("token="):strings.Index(first, " ")]
+	if !strings.Contains(second, hash) {
+		t.Errorf("Expected the same value to hash identically, got %s and %s", first, second)
+	}
+	if strings.Contains(first, "abc123") {
+		t.Errorf("Expected secret value to be removed, got %s", first)
+	}
+
+	other, _ := newMasker(MaskingConfig{Mode: MaskModeHash, HashKey: "other-key"})
+	if strings.Contains(other.Mask("", "token=abc123"), hash) {
+		t.Error("Expected different keys to produce different hashes")
+	}
+
+	if _, err := newMasker(MaskingConfig{Mode: MaskModeHash}); err == nil {
+		t.Error("Expected hash mode without a key to be rejected")
+	}
+	// The signing secret differs per enrolled agent, so it is no fallback
+	if _, err := buildMasker(Config{MaskMode: MaskModeHash, Secret: "shared"}); err == nil || !strings.Contains(err.Error(), "--mask-hash-key") {
+		t.Errorf("Expected hash mode to require --mask-hash-key, got %v", err)
+	}
+}
+
+// TestMaskStrategies tests per-rule redact, hash and partial strategies and
+// the luhn validator
+func TestMaskStrategies(t *testing.T) {
+	m, err := newMasker(MaskingConfig{Mode: MaskModeHash, HashKey: "fleet-key", Rules: []MaskRule{
+		{Name: "card", Pattern: `\b(?:\d[ -]?){12,18}\d\b`, Strategy: MaskStrategyPartial, Validate: "luhn"},
+		{Name: "employee_id", Pattern: `EMP-(?P<value>[0-9]{6})`, Strategy: MaskModeRedact, Replacement: "[EMPLOYEE]"},
+		{Name: "pin", Pattern: `pin=(?P<value>[0-9]+)`, Strategy: MaskStrategyPartial, KeepLast: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"paid with 4111 1111 1111 1111":  "paid with ***************1111",
+		"order 4111 1111 1111 1112 late": "order 4111 1111 1111 1112 late", // fails the Luhn check
+		"badge EMP-123456 entered":       "badge EMP-[EMPLOYEE] entered",
+		"pin=1234":                       "pin=**34", // never more than half the value
+	}
+	for input, want := range testCases {
+		if got := m.Mask("", input); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, input, got)
+		}
+	}
+	if got := m.Mask("", "token=abc123"); !strings.HasPrefix(got, "token=[HASH:") {
+		t.Errorf("Expected rules without a strategy to follow hash mode, got %s", got)
+	}
+
+	for _, rule := range []MaskRule{
+		{Name: "bad", Pattern: `x`, Strategy: "scramble"},
+		{Name: "bad", Pattern: `x`, Validate: "mod97"},
+		{Name: "bad", Pattern: `x`, Strategy: MaskModeHash},
+	} {
+		if _, err := newMasker(MaskingConfig{Rules: []MaskRule{rule}}); err == nil {
+			t.Errorf("Expected %+v to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Interval of the fallback check for --mask-rules-file changes fsnotify
+// missed, or the only check when the directory can't be watched
+const maskReloadPollInterval = 30 * time.Second
+
+// reloadMasking recompiles the masking rules from --mask-rules-file and swaps
+// them in. On error the current rules stay in place.
+func (a *Agent) reloadMasking() error {
+	next, err := buildMasker(a.config)
+	if err != nil {
+		return err
+	}
+	a.masker.replace(next)
+	log.Printf("Reloaded %d masking rules from %s", a.masker.ruleCount(), a.config.MaskRulesFile)
+	a.audit(AuditConfigApplied, "", "masking rules reloaded from %s", a.config.MaskRulesFile)
+	return nil
+}
+
+// runMaskRulesReload reloads --mask-rules-file whenever its content changes.
+// The parent directory is watched, so editors that replace the file and
+// Kubernetes ConfigMap updates, which swap a symlink, are both seen.
+func (a *Agent) runMaskRulesReload(ctx context.Context) {
+	defer reportPanic()
+
+	path := a.config.MaskRulesFile
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Cannot watch %s, checking it for changes every %s: %v", path, maskReloadPollInterval, err)
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	last, _ := fileDigest(path)
+	ticker := time.NewTicker(maskReloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+		case err, ok := <-watchErrors:
+			if ok {
+				log.Printf("Mask rules watcher error for %s: %v", path, err)
+			} else {
+				watchErrors = nil
+			}
+			continue
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		digest, err := fileDigest(path)
+		if err != nil || digest == last {
+			continue
+		}
+		last = digest
+		if err := a.reloadMasking(); err != nil {
+			log.Printf("Warning: Keeping the current masking rules: %v", err)
+		}
+	}
+}
+
+// fileDigest returns the SHA-256 of a file's content
+func fileDigest(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMaskRulesReload tests that edits to --mask-rules-file apply without a
+// restart, keep container label overrides, and that invalid edits are ignored
+func TestMaskRulesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "masking.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [{"name": "employee_id", "pattern": "EMP-[0-9]{6}"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewAgent(Config{MaskRulesFile: path})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.masker.setContainerOverride("shop", ContainerMasking{Disable: []string{"key_value"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.runMaskRulesReload(ctx)
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"name": "card", "pattern": "[0-9]{16}", "strategy": "partial"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	line := "EMP-123456 paid 4111111111111111 token=abc"
+	want := "EMP-123456 paid ************1111 token=abc"
+	for deadline := time.Now().Add(5 * time.Second); agent.masker.Mask("shop", line) != want; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected reloaded rules under the container's override, got %q", agent.masker.Mask("shop", line))
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"name": "broken", "pattern": "("}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := agent.masker.Mask("shop", line); got != want {
+		t.Errorf("Expected invalid rules to keep the current ones, got %q", got)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Approximate fixed cost of a buffered entry beyond its string contents
+// (struct, string headers, slice slot)
+const bufferEntryOverhead = 64
+
+// memoryBudget accounts the approximate bytes held by buffers against a
+// limit. A buffer that can't reserve room for a new entry evicts its own
+// oldest entries until it can; an entry that still doesn't fit is dropped.
+// A limit of 0 only tracks usage.
+type memoryBudget struct {
+	limit   int64
+	used    atomic.Int64
+	evicted atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// newMemoryBudgets splits --memory-budget-mb between the live log and event
+// buffers and the payload queue, so neither a long outage nor a log flood
+// can starve the other
+func newMemoryBudgets(limitMB int) (live, queue *memoryBudget) {
+	limit := int64(limitMB) << 20
+	return &memoryBudget{limit: limit - limit/2}, &memoryBudget{limit: limit / 2}
+}
+
+// Reserve claims n bytes, reporting false (and claiming nothing) when that
+// would exceed the limit
+func (b *memoryBudget) Reserve(n int64) bool {
+	for {
+		used := b.used.Load()
+		if b.limit > 0 && used+n > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// Release returns n bytes to the budget
+func (b *memoryBudget) Release(n int64) {
+	b.used.Add(-n)
+}
+
+// Used returns the bytes currently accounted
+func (b *memoryBudget) Used() int64 {
+	return b.used.Load()
+}
+
+// admit makes room for an entry of size bytes in buf, whose entries hold
+// *held bytes in total, evicting the oldest entries as needed. Returns the
+// trimmed buffer, the evicted entries and whether the new entry fits; on
+// success the caller appends it. Must be called with the buffer's lock held.
+func admit[T any](b *memoryBudget, buf []T, held *int64, size int64, sizeOf func(T) int64) ([]T, []T, bool) {
+	var evicted []T
+	for !b.Reserve(size) {
+		if len(buf) == 0 {
+			b.dropped.Add(1)
+			return buf, evicted, false
+		}
+		evicted = append(evicted, buf[0])
+		buf = dropOldest(b, buf, held, sizeOf)
+		b.evicted.Add(1)
+	}
+	*held += size
+	return buf, evicted, true
+}
+
+// dropOldest removes the first entry of buf and returns its bytes to the budget
+func dropOldest[T any](b *memoryBudget, buf []T, held *int64, sizeOf func(T) int64) []T {
+	freed := sizeOf(buf[0])
+	*held -= freed
+	b.Release(freed)
+	return buf[1:]
+}
+
+// logEntrySize estimates the memory held by a buffered log entry
+func logEntrySize(entry LogEntry) int64 {
+	size := bufferEntryOverhead + len(entry.Container) + len(entry.Message)
+	for name, value := range entry.Fields {
+		size += bufferEntryOverhead + len(name)
+		if s, ok := value.(string); ok {
+			size += len(s)
+		}
+	}
+	return int64(size)
+}
+
+// dockerEventSize estimates the memory held by a buffered Docker event
+func dockerEventSize(event DockerEvent) int64 {
+	return int64(bufferEntryOverhead + len(event.Type) + len(event.Action) + len(event.Container) + len(event.Image))
+}
+
+// payloadSize estimates the memory held by a queued payload, dominated by its
+// logs and events
+func payloadSize(payload Payload) int64 {
+	size := int64(4 * bufferEntryOverhead)
+	for _, entry := range payload.Logs {
+		size += logEntrySize(entry)
+	}
+	for _, event := range payload.DockerEvents {
+		size += dockerEventSize(event)
+	}
+	for _, event := range payload.SecurityEvents {
+		size += int64(bufferEntryOverhead + len(event.Subject) + len(event.Target) + len(event.Process) + len(event.Path))
+	}
+	for _, alert := range payload.LocalAlerts {
+		size += int64(bufferEntryOverhead/4 + len(alert))
+	}
+	for key, detail := range payload.AlertDetails {
+		size += int64(bufferEntryOverhead/4 + len(key) + len(detail))
+	}
+	for key, ids := range payload.AlertCorrelationIDs {
+		size += int64(bufferEntryOverhead/4 + len(key))
+		for _, id := range ids {
+			size += int64(len(id))
+		}
+	}
+	return size
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestMemoryBudget tests that buffers evict by bytes once their half of the
+// budget is exhausted and that the live buffers and queue can't starve each other
+func TestMemoryBudget(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 100000, MemoryBudgetMB: 1})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	limit := agent.liveMemory.limit
+
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 3000; i++ {
+		agent.processLogLine("web", fmt.Sprintf("%d %s", i, line))
+	}
+	if agent.liveMemory.Used() > limit {
+		t.Errorf("Expected usage within %d bytes, got %d", limit, agent.liveMemory.Used())
+	}
+	if agent.liveMemory.evicted.Load() == 0 {
+		t.Error("Expected old log entries to be evicted")
+	}
+	if got := agent.logBuffer[len(agent.logBuffer)-1].Message; !strings.HasPrefix(got, "2999 ") {
+		t.Errorf("Expected newest log line to be kept, got %.10q", got)
+	}
+
+	// Queued payloads get the other half of the budget, even with the log buffer full
+	payload := Payload{ID: "p0", Logs: agent.logBuffer[:100]}
+	size := payloadSize(payload)
+	agent.queueMutex.Lock()
+	for i := 0; i < 10; i++ {
+		payload.ID = fmt.Sprintf("p%d", i)
+		agent.enqueuePayload(payload)
+	}
+	agent.queueMutex.Unlock()
+	if agent.queueBytes > agent.queueMemory.limit {
+		t.Errorf("Expected queue within %d bytes, got %d", agent.queueMemory.limit, agent.queueBytes)
+	}
+	if want := int(agent.queueMemory.limit / size); len(agent.payloadQueue) != want {
+		t.Errorf("Expected %d queued payloads, got %d", want, len(agent.payloadQueue))
+	}
+	if agent.payloadQueue[len(agent.payloadQueue)-1].ID != "p9" {
+		t.Errorf("Expected newest payload to be kept, got %s", agent.payloadQueue[len(agent.payloadQueue)-1].ID)
+	}
+
+	// Delivery frees the log buffer
+	agent.payloadDelivered(Payload{})
+	if agent.liveMemory.Used() != 0 || agent.queueMemory.Used() != agent.queueBytes {
+		t.Errorf("Expected only queued payloads to be accounted after delivery, got %d live and %d queued",
+			agent.liveMemory.Used(), agent.queueMemory.Used())
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Alert severities for notifications sent by the agent itself
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+)
+
+// Order of severities, for --<service>-min-severity
+var severityRanks = map[string]int{SeverityWarning: 0, SeverityCritical: 1}
+
+// Alerts weighing at least this much in the score are critical
+const criticalAlertWeight = 0.5
+
+// notifyTemplateFuncs are available to notification templates besides the
+// text/template builtins
+var notifyTemplateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// AlertMessage is one notification about newly raised alerts of one
+// severity; notification templates are executed with it
+type AlertMessage struct {
+	Host      string
+	ServerID  string
+	Env       string
+	OwnerTeam string
+	Severity  string
+	Alerts    []string
+	Details   map[string]string
+	Score     float64
+	Time      time.Time
+	// Text is the message rendered from the notifier's template, empty when
+	// the service uses its own format
+	Text string
+}
+
+// alertSeverity classifies an alert by its type's score weight
+func alertSeverity(alert string) string {
+	alertType, _, _ := strings.Cut(alert, ":")
+	if alertWeights[alertType] >= criticalAlertWeight {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+// severityWebhooks maps severities to webhooks: critical alerts go to the
+// general webhook unless they have their own
+func severityWebhooks(webhook, criticalWebhook string) map[string]string {
+	if criticalWebhook == "" {
+		criticalWebhook = webhook
+	}
+	return map[string]string{SeverityWarning: webhook, SeverityCritical: criticalWebhook}
+}
+
+// notifierOptions are a chat service's settings of the notification
+// pipeline shared by all services
+type notifierOptions struct {
+	Template      string // Go template of the message text, empty for the service's own format
+	MinSeverity   string // lowest severity posted, empty for all
+	RepeatMinutes int    // minutes before an alert that is still raised is posted again
+	GroupSeconds  int    // seconds newly raised alerts are held to be posted together
+	RateLimit     int    // messages per hour at most, 0 for no limit
+}
+
+// serviceOptions returns a service's pipeline settings; its own template
+// overrides --notify-template
+func serviceOptions(config Config, tmpl, minSeverity string, repeatMinutes int) notifierOptions {
+	if tmpl == "" {
+		tmpl = config.NotifyTemplate
+	}
+	return notifierOptions{
+		Template:      tmpl,
+		MinSeverity:   minSeverity,
+		RepeatMinutes: repeatMinutes,
+		GroupSeconds:  config.NotifyGroupSeconds,
+		RateLimit:     config.NotifyRateLimit,
+	}
+}
+
+// pendingAlerts are alerts of one severity held for grouping or by the rate
+// limit
+type pendingAlerts struct {
+	since   time.Time
+	details map[string]string // alert -> detail, "" without one
+}
+
+// alertNotifier is the notification pipeline of one chat service: it
+// filters newly raised local alerts by severity, leaves out those notified
+// within the repeat window, groups them per severity, limits the message
+// rate and renders the message template, then posts to the service's
+// webhook of the severity, so hosts are watched without a backend server.
+// Services only supply post.
+type alertNotifier struct {
+	name        string
+	webhooks    map[string]string
+	minSeverity string
+	repeat      time.Duration
+	group       time.Duration
+	rateLimit   int
+	tmpl        *template.Template
+	post        func(webhook string, message AlertMessage) error
+
+	mu       sync.Mutex
+	notified map[string]time.Time      // alert -> last notification
+	pending  map[string]*pendingAlerts // severity -> alerts not posted yet
+	sent     []time.Time               // posts within the last hour
+	limited  bool
+}
+
+func newAlertNotifier(name string, webhooks map[string]string, options notifierOptions, post func(string, AlertMessage) error) (*alertNotifier, error) {
+	if _, ok := severityRanks[options.MinSeverity]; options.MinSeverity != "" && !ok {
+		return nil, fmt.Errorf("invalid --%s-min-severity %q (use warning or critical)", strings.ToLower(name), options.MinSeverity)
+	}
+	n := &alertNotifier{
+		name:        name,
+		webhooks:    webhooks,
+		minSeverity: options.MinSeverity,
+		repeat:      time.Duration(options.RepeatMinutes) * time.Minute,
+		group:       time.Duration(options.GroupSeconds) * time.Second,
+		rateLimit:   options.RateLimit,
+		post:        post,
+		notified:    make(map[string]time.Time),
+		pending:     make(map[string]*pendingAlerts),
+	}
+	if options.Template != "" {
+		tmpl, err := template.New(name).Funcs(notifyTemplateFuncs).Parse(options.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		n.tmpl = tmpl
+	}
+	return n, nil
+}
+
+// notify adds the payload's alerts that pass the severity filter and weren't
+// notified within the repeat window to the pending alerts, then posts one
+// message per severity whose alerts were held for the group window, as long
+// as the rate limit allows. Alerts whose message failed or was held back
+// are posted with a later payload.
+func (n *alertNotifier) notify(payload Payload) error {
+	now := time.Now()
+	n.mu.Lock()
+	for _, alert := range payload.LocalAlerts {
+		if last, ok := n.notified[alert]; ok && now.Sub(last) < n.repeat {
+			continue
+		}
+		severity := alertSeverity(alert)
+		if n.webhooks[severity] == "" || (n.minSeverity != "" && severityRanks[severity] < severityRanks[n.minSeverity]) {
+			continue
+		}
+		pending := n.pending[severity]
+		if pending == nil {
+			pending = &pendingAlerts{since: now, details: make(map[string]string)}
+			n.pending[severity] = pending
+		}
+		pending.details[alert] = payload.AlertDetails[alert]
+	}
+	for alert, last := range n.notified {
+		if now.Sub(last) >= n.repeat {
+			delete(n.notified, alert)
+		}
+	}
+	n.mu.Unlock()
+
+	var errs []error
+	// Critical alerts come first to the rate limit
+	for _, severity := range []string{SeverityCritical, SeverityWarning} {
+		n.mu.Lock()
+		pending := n.pending[severity]
+		due := pending != nil && now.Sub(pending.since) >= n.group && n.allow(now)
+		var details map[string]string
+		if due {
+			details = maps.Clone(pending.details)
+		}
+		n.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		message := AlertMessage{
+			Host:      payload.Host,
+			ServerID:  payload.ServerID,
+			Env:       payload.Env,
+			OwnerTeam: payload.OwnerTeam,
+			Severity:  severity,
+			Score:     payload.Score,
+			Time:      payload.Timestamp,
+		}
+		for alert, detail := range details {
+			message.Alerts = append(message.Alerts, alert)
+			if detail != "" {
+				if message.Details == nil {
+					message.Details = make(map[string]string)
+				}
+				message.Details[alert] = detail
+			}
+		}
+		sort.Strings(message.Alerts)
+		if n.tmpl != nil {
+			var text strings.Builder
+			if err := n.tmpl.Execute(&text, message); err != nil {
+				errs = append(errs, fmt.Errorf("%s alerts: template: %w", severity, err))
+				continue
+			}
+			message.Text = text.String()
+		}
+		if err := n.post(n.webhooks[severity], message); err != nil {
+			errs = append(errs, fmt.Errorf("%s alerts: %w", severity, err))
+			continue
+		}
+		n.mu.Lock()
+		n.sent = append(n.sent, now)
+		for _, alert := range message.Alerts {
+			n.notified[alert] = now
+			delete(pending.details, alert)
+		}
+		if len(pending.details) == 0 {
+			delete(n.pending, severity)
+		}
+		n.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// allow reports whether the rate limit allows another message now, logging
+// when alerts start being held back. n.mu must be held.
+func (n *alertNotifier) allow(now time.Time) bool {
+	if n.rateLimit <= 0 {
+		return true
+	}
+	recent := n.sent[:0]
+	for _, sent := range n.sent {
+		if now.Sub(sent) < time.Hour {
+			recent = append(recent, sent)
+		}
+	}
+	n.sent = recent
+	if len(n.sent) < n.rateLimit {
+		n.limited = false
+		return true
+	}
+	if !n.limited {
+		log.Printf("%s notifications reached %d messages per hour, holding alerts", n.name, n.rateLimit)
+		n.limited = true
+	}
+	return false
+}
+
+// newAlertNotifiers returns the notifiers of the configured chat services
+func newAlertNotifiers(config Config) ([]*alertNotifier, error) {
+	var notifiers []*alertNotifier
+	for _, build := range []func(Config) (*alertNotifier, error){newSlackNotifier, newDiscordNotifier, newTeamsNotifier} {
+		notifier, err := build(config)
+		if err != nil {
+			return nil, err
+		}
+		if notifier != nil {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingNotifier returns a notifier whose posts are kept in messages
+func recordingNotifier(t *testing.T, options notifierOptions, messages *[]AlertMessage) *alertNotifier {
+	t.Helper()
+	post := func(webhook string, message AlertMessage) error {
+		*messages = append(*messages, message)
+		return nil
+	}
+	notifier, err := newAlertNotifier("Test", severityWebhooks("http://warnings", "http://criticals"), options, post)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	return notifier
+}
+
+// TestNotifierSeverityFilter tests that alerts below a service's minimum severity aren't posted
+func TestNotifierSeverityFilter(t *testing.T) {
+	var messages []AlertMessage
+	notifier := recordingNotifier(t, notifierOptions{MinSeverity: SeverityCritical, RepeatMinutes: 60}, &messages)
+	if err := notifier.notify(Payload{Host: "web-1", LocalAlerts: []string{"CPU_SPIKE", "BRUTE_FORCE"}}); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 1 || messages[0].Severity != SeverityCritical || strings.Join(messages[0].Alerts, ",") != "BRUTE_FORCE" {
+		t.Fatalf("Expected only the critical alert, got %+v", messages)
+	}
+
+	if _, err := newAlertNotifier("Teams", nil, notifierOptions{MinSeverity: "info"}, nil); err == nil || !strings.Contains(err.Error(), "--teams-min-severity") {
+		t.Errorf("Expected an unknown severity to be rejected, got %v", err)
+	}
+}
+
+// TestNotifierGrouping tests that alerts raised within the group window are posted together
+func TestNotifierGrouping(t *testing.T) {
+	var messages []AlertMessage
+	notifier := recordingNotifier(t, notifierOptions{RepeatMinutes: 60, GroupSeconds: 300}, &messages)
+	payload := Payload{Host: "web-1", LocalAlerts: []string{"CPU_SPIKE"}}
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	payload.LocalAlerts = []string{"HTTP_5XX_SPIKE"}
+	payload.AlertDetails = map[string]string{"HTTP_5XX_SPIKE": "12% of requests"}
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("Expected alerts to be held for the group window, got %+v", messages)
+	}
+
+	notifier.pending[SeverityWarning].since = time.Now().Add(-5 * time.Minute)
+	payload.LocalAlerts = nil
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 1 || strings.Join(messages[0].Alerts, ",") != "CPU_SPIKE,HTTP_5XX_SPIKE" {
+		t.Fatalf("Expected one message with both alerts, got %+v", messages)
+	}
+	if messages[0].Details["HTTP_5XX_SPIKE"] != "12% of requests" {
+		t.Errorf("Expected the alert's detail to be kept, got %v", messages[0].Details)
+	}
+	if len(notifier.pending) != 0 {
+		t.Errorf("Expected no pending alerts after posting, got %v", notifier.pending)
+	}
+}
+
+// TestNotifierRateLimit tests that alerts over the rate limit are held, critical ones first
+func TestNotifierRateLimit(t *testing.T) {
+	var messages []AlertMessage
+	notifier := recordingNotifier(t, notifierOptions{RepeatMinutes: 60, RateLimit: 1}, &messages)
+	if err := notifier.notify(Payload{Host: "db-1", LocalAlerts: []string{"CPU_SPIKE", "BRUTE_FORCE"}}); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 1 || messages[0].Severity != SeverityCritical {
+		t.Fatalf("Expected only the critical message within the limit, got %+v", messages)
+	}
+
+	// The held alert is posted once the hour has passed
+	notifier.sent[0] = time.Now().Add(-time.Hour)
+	if err := notifier.notify(Payload{Host: "db-1"}); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 2 || strings.Join(messages[1].Alerts, ",") != "CPU_SPIKE" {
+		t.Fatalf("Expected the held warning to be posted, got %+v", messages)
+	}
+}
+
+// TestNotifierTemplate tests that --notify-template renders the text of services without their own template
+func TestNotifierTemplate(t *testing.T) {
+	config := Config{NotifyTemplate: "{{upper .Severity}} {{.Host}}: {{join .Alerts \", \"}}"}
+	var messages []AlertMessage
+	notifier := recordingNotifier(t, serviceOptions(config, "", "", 60), &messages)
+	if err := notifier.notify(Payload{Host: "web-1", LocalAlerts: []string{"NEW_SERVICE:redis", "BRUTE_FORCE"}}); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(messages) != 1 || messages[0].Text != "CRITICAL web-1: BRUTE_FORCE, NEW_SERVICE:redis" {
+		t.Fatalf("Unexpected rendered text %+v", messages)
+	}
+	if embed := discordEmbedFor(messages[0]); embed.Description != messages[0].Text {
+		t.Errorf("Expected the Discord description to be the rendered text, got %q", embed.Description)
+	}
+
+	if options := serviceOptions(config, "{{.Host}}", "", 60); options.Template != "{{.Host}}" {
+		t.Errorf("Expected a service's own template to override --notify-template, got %q", options.Template)
+	}
+	if _, err := newAlertNotifier("Discord", nil, notifierOptions{Template: "{{.Host"}, nil); err == nil {
+		t.Error("Expected an invalid template to be rejected")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Offline output files are rotated at least this often so exports pick up recent data
+const offlineRotateInterval = time.Hour
+
+// OfflineRecord is one line of an offline output file
+type OfflineRecord struct {
+	PayloadID string          `json:"payload_id"`
+	Timestamp int64           `json:"timestamp"`
+	Signature string          `json:"signature,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// offlineWriter appends payloads to rotating JSON Lines files. The file being
+// written ends in .partial and is renamed to .jsonl when complete, so export
+// jobs only ever pick up finished files.
+type offlineWriter struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+}
+
+// newOfflineWriter creates the output directory and finalizes any partial
+// file left by a previous run
+func newOfflineWriter(dir string, maxFileMB, maxFiles int) (*offlineWriter, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	partials, _ := filepath.Glob(filepath.Join(dir, "payloads_*.jsonl.partial"))
+	for _, partial := range partials {
+		os.Rename(partial, strings.TrimSuffix(partial, ".partial"))
+	}
+
+	if maxFileMB <= 0 {
+		maxFileMB = 50
+	}
+	return &offlineWriter{
+		dir:      dir,
+		maxBytes: int64(maxFileMB) * 1024 * 1024,
+		maxFiles: maxFiles,
+	}, nil
+}
+
+// Write appends a record, rotating the current file when it is too large or too old
+func (w *offlineWriter) Write(record OfflineRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil && (w.size+int64(len(line)) > w.maxBytes || time.Since(w.opened) > offlineRotateInterval) {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		now := time.Now()
+		w.path = filepath.Join(w.dir, fmt.Sprintf("payloads_%s.jsonl.partial", now.UTC().Format("20060102T150405.000000000Z")))
+		file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		w.file, w.size, w.opened = file, 0, now
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// finish closes and publishes the current file, then prunes old files.
+// Must be called with w.mu held.
+func (w *offlineWriter) finish() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	if renameErr := os.Rename(w.path, strings.TrimSuffix(w.path, ".partial")); err == nil {
+		err = renameErr
+	}
+	w.prune()
+	return err
+}
+
+// prune removes the oldest finished files beyond maxFiles (0 keeps everything)
+func (w *offlineWriter) prune() {
+	if w.maxFiles <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(w.dir, "payloads_*.jsonl"))
+	if len(files) <= w.maxFiles {
+		return
+	}
+	sort.Strings(files) // names sort by creation time
+	for _, file := range files[:len(files)-w.maxFiles] {
+		if err := os.Remove(file); err != nil {
+			log.Printf("Failed to remove old output file %s: %v", file, err)
+		}
+	}
+}
+
+// Close publishes the current file
+func (w *offlineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.finish()
+}
+
+// writeOffline stores a payload in the output directory instead of sending it
+func (a *Agent) writeOffline(payload Payload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	record := OfflineRecord{
+		PayloadID: payload.ID,
+		Timestamp: payload.Timestamp.Unix(),
+		Payload:   payloadBytes,
+	}
+	if a.secret() != "" {
+		record.Signature = "sha256=" + a.signPayload(payloadBytes, payload.Timestamp)
+	}
+
+	if err := a.offline.Write(record); err != nil {
+		return fmt.Errorf("failed to write payload %s to %s: %w", payload.ID, a.config.OutputDir, err)
+	}
+	log.Printf("Wrote payload %s to %s", payload.ID, a.config.OutputDir)
+	a.lastSendOK = time.Now()
+	a.payloadDelivered(payload)
+	return nil
+}
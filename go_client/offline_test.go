@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOfflineOutput tests that payloads are written to rotating local files in offline mode
+func TestOfflineOutput(t *testing.T) {
+	dir := t.TempDir()
+	agent, err := NewAgent(Config{OutputDir: dir, Secret: "test-secret", MaxLogEntries: 10})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		payload, err := agent.createPayload()
+		if err != nil {
+			t.Fatalf("Failed to create payload: %v", err)
+		}
+		if err := agent.sendPayload(payload); err != nil {
+			t.Fatalf("Expected offline write to succeed, got %v", err)
+		}
+	}
+
+	if partials, _ := filepath.Glob(filepath.Join(dir, "*.partial")); len(partials) != 1 {
+		t.Fatalf("Expected one in-progress file, got %v", partials)
+	}
+	agent.offline.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "payloads_*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one finished output file, got %v", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record OfflineRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid record: %v", err)
+		}
+		expected := "sha256=" + agent.signPayload(record.Payload, time.Unix(record.Timestamp, 0))
+		if record.Signature != expected {
+			t.Errorf("Signature does not verify for payload %s", record.PayloadID)
+		}
+		records++
+	}
+	if records != 2 {
+		t.Errorf("Expected 2 records, got %d", records)
+	}
+}
+
+// TestOfflineRotation tests size-based rotation and pruning of finished files
+func TestOfflineRotation(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := newOfflineWriter(dir, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.maxBytes = 100
+
+	for i := 0; i < 5; i++ {
+		if err := writer.Write(OfflineRecord{PayloadID: "p", Payload: json.RawMessage(`{"padding":"` + strings.Repeat("x", 40) + `"}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "payloads_*.jsonl"))
+	if len(files) != 2 {
+		t.Errorf("Expected pruning to keep 2 files, got %d", len(files))
+	}
+}
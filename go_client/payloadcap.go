@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sample lines kept per container when its logs are summarized, and the
+// runes each sample is cut to
+const (
+	overflowSamples      = 3
+	overflowSampleLength = 256
+)
+
+// LogSummary aggregates one container's log lines that were left out of an
+// oversized payload
+type LogSummary struct {
+	Container string    `json:"container"`
+	Count     int       `json:"count"`
+	Bytes     int       `json:"bytes"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	Samples   []string  `json:"samples"`
+}
+
+// PayloadOverflow records what was summarized to keep a payload under
+// --max-payload-kb. The oldest entries are summarized first; the newest stay
+// raw.
+type PayloadOverflow struct {
+	OriginalBytes            int            `json:"original_bytes"`
+	LogsSummarized           int            `json:"logs_summarized"`
+	DockerEventsSummarized   int            `json:"docker_events_summarized,omitempty"`
+	SecurityEventsSummarized int            `json:"security_events_summarized,omitempty"`
+	Logs                     []LogSummary   `json:"log_summaries,omitempty"`
+	DockerEvents             map[string]int `json:"docker_event_counts,omitempty"`   // by "container action"
+	SecurityEvents           map[string]int `json:"security_event_counts,omitempty"` // by "type action"
+}
+
+// capPayload keeps payload's JSON encoding within limit bytes by replacing
+// the oldest logs, then Docker events, then security events with summaries.
+// Metrics and alerts are never summarized, so a payload can still exceed the
+// limit. Returns nil when nothing had to be summarized or limit is 0.
+func capPayload(payload *Payload, limit int) *PayloadOverflow {
+	if limit <= 0 {
+		return nil
+	}
+	size := jsonSize(payload)
+	if size <= limit {
+		return nil
+	}
+
+	overflow := &PayloadOverflow{OriginalBytes: size}
+	payload.Overflow = overflow
+	logs, events, securityEvents := payload.Logs, payload.DockerEvents, payload.SecurityEvents
+
+	stages := []struct {
+		n     int
+		apply func(keep int)
+	}{
+		{len(logs), func(keep int) {
+			drop := len(logs) - keep
+			payload.Logs = logs[drop:]
+			overflow.LogsSummarized = drop
+			overflow.Logs = summarizeLogs(logs[:drop])
+		}},
+		{len(events), func(keep int) {
+			drop := len(events) - keep
+			payload.DockerEvents = events[drop:]
+			overflow.DockerEventsSummarized = drop
+			overflow.DockerEvents = countBy(events[:drop], func(e DockerEvent) string { return e.Container + " " + e.Action })
+		}},
+		{len(securityEvents), func(keep int) {
+			drop := len(securityEvents) - keep
+			payload.SecurityEvents = securityEvents[drop:]
+			overflow.SecurityEventsSummarized = drop
+			overflow.SecurityEvents = countBy(securityEvents[:drop], func(e SecurityEvent) string { return e.Type + " " + e.Action })
+		}},
+	}
+	for _, stage := range stages {
+		if jsonSize(payload) <= limit {
+			break
+		}
+		// Summarize as few entries as possible: find the smallest fitting drop
+		drop := sort.Search(stage.n+1, func(drop int) bool {
+			stage.apply(stage.n - drop)
+			return jsonSize(payload) <= limit
+		})
+		stage.apply(stage.n - min(drop, stage.n))
+	}
+	return overflow
+}
+
+// summarizeLogs groups log entries by container in order of first appearance
+func summarizeLogs(entries []LogEntry) []LogSummary {
+	if len(entries) == 0 {
+		return nil
+	}
+	index := make(map[string]int)
+	var summaries []LogSummary
+	lines := make(map[string][]string)
+	for _, entry := range entries {
+		i, ok := index[entry.Container]
+		if !ok {
+			i = len(summaries)
+			index[entry.Container] = i
+			summaries = append(summaries, LogSummary{Container: entry.Container, First: entry.Timestamp})
+		}
+		s := &summaries[i]
+		count := max(entry.Count, 1)
+		s.Count += count
+		s.Bytes += count * len(entry.Message)
+		s.Last = entry.Timestamp
+		if entry.Count > 1 {
+			s.Last = entry.LastTimestamp
+		}
+		lines[entry.Container] = append(lines[entry.Container], entry.Message)
+	}
+	for i := range summaries {
+		summaries[i].Samples = sampleLines(lines[summaries[i].Container])
+	}
+	return summaries
+}
+
+// sampleLines picks up to overflowSamples lines spread evenly over lines,
+// always including the first and last
+func sampleLines(lines []string) []string {
+	n := min(len(lines), overflowSamples)
+	samples := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line := lines[0]
+		if n > 1 {
+			line = lines[i*(len(lines)-1)/(n-1)]
+		}
+		samples = append(samples, truncate(line, overflowSampleLength))
+	}
+	return samples
+}
+
+// countBy counts entries by key
+func countBy[T any](entries []T, key func(T) string) map[string]int {
+	if len(entries) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[key(entry)]++
+	}
+	return counts
+}
+
+// jsonSize returns the length of payload's JSON encoding
+func jsonSize(payload *Payload) int {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// describeOverflow renders an overflow record for logs and agent events
+func describeOverflow(overflow *PayloadOverflow, size int) string {
+	return fmt.Sprintf("payload of %d bytes summarized to %d: %d logs, %d Docker events, %d security events",
+		overflow.OriginalBytes, size, overflow.LogsSummarized, overflow.DockerEventsSummarized, overflow.SecurityEventsSummarized)
+}
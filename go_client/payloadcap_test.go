@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPayloadSizeCap tests that oversized payloads keep their newest entries
+// raw and summarize the rest per container
+func TestPayloadSizeCap(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 1000, MaxPayloadKB: 16})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	for i := 0; i < 400; i++ {
+		container := []string{"web", "worker"}[i%2]
+		agent.processLogLine(container, fmt.Sprintf("%d %s", i, strings.Repeat("x", 100)))
+	}
+	agent.eventMutex.Lock()
+	for i := 0; i < 20; i++ {
+		agent.eventBuffer = append(agent.eventBuffer, DockerEvent{Type: "container", Action: "restart", Container: "web", Timestamp: time.Now()})
+	}
+	agent.eventMutex.Unlock()
+	agent.alertMutex.Lock()
+	agent.raiseAlert("CPU_SPIKE")
+	agent.alertMutex.Unlock()
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if size := jsonSize(&payload); size > 16<<10 {
+		t.Errorf("Expected payload within 16 KiB, got %d bytes", size)
+	}
+	overflow := payload.Overflow
+	if overflow == nil {
+		t.Fatal("Expected overflow summary")
+	}
+	if overflow.LogsSummarized+len(payload.Logs) != 400 || overflow.LogsSummarized == 0 {
+		t.Errorf("Expected every log to be raw or summarized, got %d summarized and %d raw", overflow.LogsSummarized, len(payload.Logs))
+	}
+	if got := payload.Logs[len(payload.Logs)-1].Message; !strings.HasPrefix(got, "399 ") {
+		t.Errorf("Expected newest log line to stay raw, got %.10q", got)
+	}
+	if len(payload.DockerEvents) != 20 || overflow.DockerEventsSummarized != 0 {
+		t.Errorf("Expected events to stay raw while summarizing logs suffices, got %d", len(payload.DockerEvents))
+	}
+	if len(payload.LocalAlerts) != 1 {
+		t.Errorf("Expected alerts to be kept, got %v", payload.LocalAlerts)
+	}
+
+	counted := 0
+	for _, summary := range overflow.Logs {
+		counted += summary.Count
+		if len(summary.Samples) != overflowSamples || summary.First.After(summary.Last) {
+			t.Errorf("Unexpected summary for %s: %+v", summary.Container, summary)
+		}
+	}
+	if counted != overflow.LogsSummarized || len(overflow.Logs) != 2 {
+		t.Errorf("Expected 2 container summaries covering %d lines, got %d covering %d", overflow.LogsSummarized, len(overflow.Logs), counted)
+	}
+	if first := overflow.Logs[0].Samples[0]; !strings.HasPrefix(first, "0 ") {
+		t.Errorf("Expected the oldest line among the samples, got %.10q", first)
+	}
+
+	// Events are summarized once there are no logs left to give up
+	payload = Payload{ID: "p", DockerEvents: make([]DockerEvent, 200)}
+	for i := range payload.DockerEvents {
+		payload.DockerEvents[i] = DockerEvent{Type: "container", Action: "die", Container: fmt.Sprintf("c%d", i%3)}
+	}
+	overflow = capPayload(&payload, 4<<10)
+	if overflow == nil || overflow.DockerEventsSummarized == 0 || jsonSize(&payload) > 4<<10 {
+		t.Fatalf("Expected events to be summarized within 4 KiB, got %+v", overflow)
+	}
+	if overflow.DockerEvents["c0 die"]+overflow.DockerEvents["c1 die"]+overflow.DockerEvents["c2 die"] != overflow.DockerEventsSummarized {
+		t.Errorf("Unexpected event counts: %v", overflow.DockerEvents)
+	}
+
+	if capPayload(&payload, 0) != nil {
+		t.Error("Expected no limit with 0")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PII categories that can be enabled individually
+const (
+	PIIEmail      = "email"
+	PIICreditCard = "credit_card"
+	PIINationalID = "national_id"
+	PIIIPAddress  = "ip"
+)
+
+// piiRules maps each PII category to its masking rules
+var piiRules = map[string][]MaskRule{
+	PIIEmail: {
+		{Name: "pii_email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Replacement: "[EMAIL]", Keywords: []string{"@"}},
+	},
+	PIICreditCard: {
+		{Name: "pii_credit_card", Pattern: `\b(?:\d[ -]?){12,18}\d\b`, Replacement: "[CARD]", validate: luhnValid,
+			prefilter: func(s string) bool { return hasDigitRun(s, 13, " -") }},
+	},
+	PIINationalID: {
+		// US Social Security Number
+		{Name: "pii_us_ssn", Pattern: `\b\d{3}-\d{2}-\d{4}\b`, Replacement: "[NATIONAL_ID]", validate: ssnValid,
+			prefilter: func(s string) bool { return hasDigitRun(s, 9, "-") }},
+		// UK National Insurance Number
+		{Name: "pii_uk_nino", Pattern: `\b[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`, Replacement: "[NATIONAL_ID]",
+			prefilter: func(s string) bool { return hasDigitRun(s, 6, " ") }},
+	},
+	PIIIPAddress: {
+		{Name: "pii_ipv4", Pattern: `\b\d{1,3}(?:\.\d{1,3}){3}\b`, Replacement: "[IP]", validate: ipValid,
+			prefilter: func(s string) bool { return hasDigitRun(s, 4, ".") }},
+		{Name: "pii_ipv6", Pattern: `\b(?:[0-9A-Fa-f]{1,4}:){2,7}[0-9A-Fa-f]{1,4}\b|\b(?:[0-9A-Fa-f]{1,4}:){1,7}:(?:[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,6})?`, Replacement: "[IP]", validate: ipValid,
+			prefilter: ipv6Candidate},
+	},
+}
+
+// parsePIICategories splits a comma-separated category list
+func parsePIICategories(list string) []string {
+	var categories []string
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			categories = append(categories, c)
+		}
+	}
+	return categories
+}
+
+// piiRulesFor returns the rules for the enabled PII categories
+func piiRulesFor(categories []string) ([]MaskRule, error) {
+	var rules []MaskRule
+	seen := make(map[string]bool)
+	for _, category := range categories {
+		if seen[category] {
+			continue
+		}
+		seen[category] = true
+
+		categoryRules, ok := piiRules[category]
+		if !ok {
+			return nil, fmt.Errorf("unknown PII category %q (valid: email, credit_card, national_id, ip)", category)
+		}
+		for _, rule := range categoryRules {
+			rule.pii = true
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// hasDigitRun reports whether s contains at least minDigits digits in a row,
+// allowing single separator characters between them
+func hasDigitRun(s string, minDigits int, separators string) bool {
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			if digits >= minDigits {
+				return true
+			}
+		case digits > 0 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' && strings.IndexByte(separators, c) >= 0:
+		default:
+			digits = 0
+		}
+	}
+	return false
+}
+
+// ipv6Candidate reports whether s could hold an IPv6 address: a "::" or a run
+// of hex digits with at least six colons (eight groups, or six before an
+// embedded IPv4 address). Shorter runs like clock times can't be valid.
+func ipv6Candidate(s string) bool {
+	if strings.Contains(s, "::") {
+		return true
+	}
+	colons := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ':':
+			colons++
+			if colons >= 6 {
+				return true
+			}
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '.':
+		default:
+			colons = 0
+		}
+	}
+	return false
+}
+
+// luhnValid reports whether a digit sequence (spaces and dashes ignored) passes the Luhn check
+func luhnValid(s string) bool {
+	var sum, digits int
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
+
+// ssnValid rejects SSNs with never-issued area, group or serial numbers
+func ssnValid(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	return group != "00" && serial != "0000"
+}
+
+// ipValid confirms a candidate is a real IP address rather than e.g. a version number
+func ipValid(s string) bool {
+	return net.ParseIP(s) != nil
+}
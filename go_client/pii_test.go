@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+// TestPIIMasking tests per-category PII detection and masking
+func TestPIIMasking(t *testing.T) {
+	m, err := newMasker(MaskingConfig{PII: []string{PIIEmail, PIICreditCard, PIINationalID, PIIIPAddress}})
+	if err != nil {
+		t.Fatalf("Failed to compile PII rules: %v", err)
+	}
+
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"signup from jane.doe+news@example.co.uk", "signup from [EMAIL]"},
+		{"charged 4111 1111 1111 1111 ok", "charged [CARD] ok"},
+		{"charged 4111-1111-1111-1112 failed", "charged 4111-1111-1111-1112 failed"}, // fails Luhn
+		{"ssn 123-45-6789 stored", "ssn [NATIONAL_ID] stored"},
+		{"ssn 000-45-6789 invalid", "ssn 000-45-6789 invalid"},
+		{"nino AB 12 34 56 C", "nino [NATIONAL_ID]"},
+		{"client 203.0.113.7 connected", "client [IP] connected"},
+		{"client 2001:db8::1 connected", "client [IP] connected"},
+		{"peer 2001:0db8:85a3:0000:0000:8a2e:0370:7334 up", "peer [IP] up"},
+		{"card 4111111111111111 on file", "card [CARD] on file"},
+		{"version 1.2.3.4567 at 12:30:45", "version 1.2.3.4567 at 12:30:45"},
+	}
+
+	for _, tc := range testCases {
+		if result := m.Mask("", tc.input); result != tc.expected {
+			t.Errorf("Expected '%s' for input '%s', got '%s'", tc.expected, tc.input, result)
+		}
+	}
+}
+
+// TestPIICategoryToggles tests that only enabled categories are masked
+func TestPIICategoryToggles(t *testing.T) {
+	m, err := newMasker(MaskingConfig{PII: parsePIICategories("email")})
+	if err != nil {
+		t.Fatalf("Failed to compile PII rules: %v", err)
+	}
+	if got := m.Mask("", "a@b.io from 10.0.0.1"); got != "[EMAIL] from 10.0.0.1" {
+		t.Errorf("Expected only email to be masked, got %s", got)
+	}
+
+	if _, err := newMasker(MaskingConfig{PII: []string{"passport"}}); err == nil {
+		t.Error("Expected unknown PII category to be rejected")
+	}
+}
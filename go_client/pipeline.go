@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Distinct group_by values counted per metric and source, others are "other"
+const maxLogMetricGroups = 100
+
+// References to named patterns: %{NAME}, %{NAME:field} or %{NAME:field:type}
+var patternRefPattern = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(\w+))?\}`)
+
+// builtinPatterns are the named patterns available in every parser, after grok's
+var builtinPatterns = map[string]string{
+	"INT":               `[+-]?\d+`,
+	"NUMBER":            `[+-]?(?:\d+(?:\.\d*)?|\.\d+)`,
+	"WORD":              `\w+`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"QUOTEDSTRING":      `"(?:[^"\\]|\\.)*"`,
+	"UUID":              `[0-9a-fA-F]{8}-(?:[0-9a-fA-F]{4}-){3}[0-9a-fA-F]{12}`,
+	"IP":                `(?:\d{1,3}\.){3}\d{1,3}|[0-9a-fA-F]*:[0-9a-fA-F:.]+`,
+	"HOSTNAME":          `[A-Za-z0-9](?:[A-Za-z0-9.-]*[A-Za-z0-9])?`,
+	"PATH":              `/[^\s?#]*`,
+	"URIPATHPARAM":      `/[^\s#]*`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|error|err|crit(?:ical)?|fatal|alert|emerg(?:ency)?)`,
+	"DURATION":          `\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h)`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`,
+	"HTTPDATE":          `\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+}
+
+// Field types a captured string can be converted to
+var fieldTypes = map[string]bool{"string": true, "int": true, "float": true, "bool": true, "duration_ms": true}
+
+// Timestamp layouts accepted by name besides Go reference layouts
+var namedTimestampLayouts = map[string]string{
+	"rfc3339":  time.RFC3339Nano,
+	"httpdate": "02/Jan/2006:15:04:05 -0700",
+}
+
+// ParseRulesConfig is the format of the --parse-rules-file JSON document
+type ParseRulesConfig struct {
+	// Patterns adds named patterns, which may reference other patterns
+	Patterns   map[string]string `json:"patterns"`
+	Parsers    []LogParser       `json:"parsers"`
+	Processors []LogProcessor    `json:"processors"`
+}
+
+// LogParser turns the lines of some containers and files into fields and metrics
+type LogParser struct {
+	Name string `json:"name"`
+	// Containers are container names or path.Match globs ("api-*")
+	Containers []string `json:"containers,omitempty"`
+	// Files are host log files to follow; their source is the base name
+	Files []string `json:"files,omitempty"`
+	// Pattern is a regular expression with named groups and %{NAME:field:type} references
+	Pattern string `json:"pattern"`
+	// Types converts fields: string (default), int, float, bool or duration_ms
+	Types     map[string]string `json:"types,omitempty"`
+	Timestamp *TimestampRule    `json:"timestamp,omitempty"`
+	Metrics   []FieldMetric     `json:"metrics,omitempty"`
+
+	re      *regexp.Regexp
+	sources map[string]bool // file base names
+}
+
+// TimestampRule sets log entries' timestamps from a field, which is then
+// dropped from the fields. Layout is a Go reference layout, rfc3339,
+// httpdate, unix or unix_ms.
+type TimestampRule struct {
+	Field  string `json:"field"`
+	Layout string `json:"layout"`
+}
+
+// FieldMetric aggregates parsed lines per source and interval: count of
+// lines, or the sum, max or avg of a numeric field
+type FieldMetric struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Field   string            `json:"field,omitempty"`
+	GroupBy string            `json:"group_by,omitempty"`
+	Where   map[string]string `json:"where,omitempty"` // field values a line must have
+}
+
+// LogMetric is one aggregated FieldMetric in a payload
+type LogMetric struct {
+	Name   string  `json:"name"`
+	Source string  `json:"source"`
+	Group  string  `json:"group,omitempty"`
+	Value  float64 `json:"value"`
+	Count  int     `json:"count"`
+}
+
+// expandPatterns replaces %{NAME:field:type} references with regexp groups,
+// recording inline types
+func expandPatterns(pattern string, patterns map[string]string, types map[string]string, depth int) (string, error) {
+	if depth > 10 {
+		return "", fmt.Errorf("patterns nested too deeply (recursive?)")
+	}
+	var err error
+	expanded := patternRefPattern.ReplaceAllStringFunc(pattern, func(ref string) string {
+		m := patternRefPattern.FindStringSubmatch(ref)
+		body, ok := patterns[m[1]]
+		if !ok {
+			body, ok = builtinPatterns[m[1]]
+		}
+		if !ok {
+			err = fmt.Errorf("unknown pattern %%{%s}", m[1])
+			return ref
+		}
+		body, expandErr := expandPatterns(body, patterns, types, depth+1)
+		if expandErr != nil {
+			err = expandErr
+			return ref
+		}
+		if m[2] == "" {
+			return "(?:" + body + ")"
+		}
+		if m[3] != "" {
+			types[m[2]] = m[3]
+		}
+		return "(?P<" + m[2] + ">" + body + ")"
+	})
+	return expanded, err
+}
+
+// compile prepares a parser for use
+func (p *LogParser) compile(patterns map[string]string) error {
+	if p.Name == "" {
+		return fmt.Errorf("parser with pattern %q has no name", p.Pattern)
+	}
+	if len(p.Containers) == 0 && len(p.Files) == 0 {
+		return fmt.Errorf("parser %q has no containers or files", p.Name)
+	}
+	types := make(map[string]string)
+	for field, typ := range p.Types {
+		types[field] = typ
+	}
+	expanded, err := expandPatterns(p.Pattern, patterns, types, 0)
+	if err != nil {
+		return fmt.Errorf("parser %q: %w", p.Name, err)
+	}
+	if p.re, err = regexp.Compile(expanded); err != nil {
+		return fmt.Errorf("parser %q: %w", p.Name, err)
+	}
+	for field, typ := range types {
+		if !fieldTypes[typ] {
+			return fmt.Errorf("parser %q: unknown type %q for field %s", p.Name, typ, field)
+		}
+	}
+	p.Types = types
+	for _, pattern := range p.Containers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("parser %q: container pattern %q: %w", p.Name, pattern, err)
+		}
+	}
+	p.sources = make(map[string]bool)
+	for _, file := range p.Files {
+		p.sources[filepath.Base(file)] = true
+	}
+	for _, metric := range p.Metrics {
+		switch {
+		case metric.Name == "":
+			return fmt.Errorf("parser %q has a metric without a name", p.Name)
+		case metric.Type == "count":
+		case metric.Type == "sum" || metric.Type == "max" || metric.Type == "avg":
+			if metric.Field == "" {
+				return fmt.Errorf("parser %q: %s metric %s needs a field", p.Name, metric.Type, metric.Name)
+			}
+		default:
+			return fmt.Errorf("parser %q: unknown type %q for metric %s (count, sum, max or avg)", p.Name, metric.Type, metric.Name)
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the parser reads a container's or file's lines
+func (p *LogParser) appliesTo(source string) bool {
+	if p.sources[source] {
+		return true
+	}
+	for _, pattern := range p.Containers {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// convertField converts a captured string to its configured type, leaving
+// it a string when it doesn't convert
+func convertField(value, typ string) any {
+	switch typ {
+	case "int":
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case "duration_ms":
+		if d, err := time.ParseDuration(value); err == nil {
+			return float64(d.Microseconds()) / 1000
+		}
+	}
+	return value
+}
+
+// parseTimestamp reads a timestamp field by layout
+func parseTimestamp(value, layout string) (time.Time, bool) {
+	switch layout {
+	case "unix", "unix_ms":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if layout == "unix_ms" {
+			return time.UnixMilli(int64(f)), true
+		}
+		return time.UnixMicro(int64(f * 1e6)), true
+	}
+	if named, ok := namedTimestampLayouts[layout]; ok {
+		layout = named
+	}
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	return t, err == nil
+}
+
+// numericField returns a field as a number for sum, max and avg metrics
+func numericField(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// logMetricKey identifies an aggregated metric
+type logMetricKey struct {
+	name   string
+	source string
+	group  string
+}
+
+// logMetricWindow accumulates one metric between payloads
+type logMetricWindow struct {
+	typ   string
+	count int
+	sum   float64
+	max   float64
+}
+
+// logPipeline applies the configured parsers to log lines and aggregates
+// their metrics per source until the next payload
+type logPipeline struct {
+	parsers    []*LogParser
+	processors []*LogProcessor
+
+	mu      sync.Mutex
+	metrics map[logMetricKey]*logMetricWindow
+	groups  map[logMetricKey]int // distinct groups per metric and source (group unset)
+}
+
+// loadLogPipeline reads and compiles a parse rules file; an empty path
+// yields a pipeline without parsers or processors
+func loadLogPipeline(path string) (*logPipeline, error) {
+	pipeline := &logPipeline{metrics: make(map[logMetricKey]*logMetricWindow), groups: make(map[logMetricKey]int)}
+	if path == "" {
+		return pipeline, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load parse rules: %w", err)
+	}
+	var cfg ParseRulesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to load parse rules: parse %s: %w", path, err)
+	}
+	for i := range cfg.Parsers {
+		parser := &cfg.Parsers[i]
+		if err := parser.compile(cfg.Patterns); err != nil {
+			return nil, fmt.Errorf("invalid parse rules: %w", err)
+		}
+		pipeline.parsers = append(pipeline.parsers, parser)
+	}
+	for i := range cfg.Processors {
+		processor := &cfg.Processors[i]
+		if err := processor.compile(i); err != nil {
+			return nil, fmt.Errorf("invalid parse rules: %w", err)
+		}
+		pipeline.processors = append(pipeline.processors, processor)
+	}
+	return pipeline, nil
+}
+
+// apply parses a line from source with the first parser that applies and
+// matches, returning its fields (nil if none matched) and the extracted
+// timestamp, if any
+func (p *logPipeline) apply(source, line string) (map[string]any, time.Time) {
+	for _, parser := range p.parsers {
+		if !parser.appliesTo(source) {
+			continue
+		}
+		match := parser.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		fields := make(map[string]any)
+		for i, name := range parser.re.SubexpNames() {
+			if name != "" && match[i] != "" {
+				fields[name] = convertField(match[i], parser.Types[name])
+			}
+		}
+		var timestamp time.Time
+		if rule := parser.Timestamp; rule != nil {
+			if value, ok := fields[rule.Field].(string); ok {
+				if t, ok := parseTimestamp(value, rule.Layout); ok {
+					timestamp = t
+					delete(fields, rule.Field)
+				}
+			}
+		}
+		p.record(parser, source, fields)
+		return fields, timestamp
+	}
+	return nil, time.Time{}
+}
+
+// record adds a parsed line to its parser's metrics
+func (p *logPipeline) record(parser *LogParser, source string, fields map[string]any) {
+	if len(parser.Metrics) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, metric := range parser.Metrics {
+		if !fieldsMatch(fields, metric.Where) {
+			continue
+		}
+		var value float64
+		if metric.Type != "count" {
+			var ok bool
+			if value, ok = numericField(fields[metric.Field]); !ok {
+				continue
+			}
+		}
+
+		key := logMetricKey{name: metric.Name, source: source}
+		if metric.GroupBy != "" {
+			group := fmt.Sprint(fields[metric.GroupBy])
+			if fields[metric.GroupBy] == nil {
+				group = "none"
+			}
+			grouped := logMetricKey{metric.Name, source, group}
+			if _, ok := p.metrics[grouped]; !ok && p.groups[key] >= maxLogMetricGroups {
+				group = "other"
+				grouped.group = group
+			}
+			if _, ok := p.metrics[grouped]; !ok {
+				p.groups[key]++
+			}
+			key = grouped
+		}
+		window, ok := p.metrics[key]
+		if !ok {
+			window = &logMetricWindow{typ: metric.Type, max: value}
+			p.metrics[key] = window
+		}
+		window.count++
+		window.sum += value
+		window.max = max(window.max, value)
+	}
+}
+
+// fieldsMatch reports whether fields have every value in where
+func fieldsMatch(fields map[string]any, where map[string]string) bool {
+	for field, want := range where {
+		value, ok := fields[field]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// take returns the metrics aggregated since the previous call, sorted by
+// name, source and group, and starts new windows
+func (p *logPipeline) take() []LogMetric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metrics := make([]LogMetric, 0, len(p.metrics))
+	for key, window := range p.metrics {
+		m := LogMetric{Name: key.name, Source: key.source, Group: key.group, Count: window.count}
+		switch window.typ {
+		case "count":
+			m.Value = float64(window.count)
+		case "sum":
+			m.Value = window.sum
+		case "max":
+			m.Value = window.max
+		case "avg":
+			m.Value = window.sum / float64(window.count)
+		}
+		metrics = append(metrics, m)
+	}
+	p.metrics = make(map[logMetricKey]*logMetricWindow)
+	p.groups = make(map[logMetricKey]int)
+	sort.Slice(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Group < b.Group
+	})
+	return metrics
+}
+
+// setupParsedFileMonitoring follows the host files of the configured
+// parsers; their lines are handled like container log lines from a source
+// named after the file
+func (a *Agent) setupParsedFileMonitoring() {
+	for _, parser := range a.pipeline.parsers {
+		for _, path := range parser.Files {
+			source := filepath.Base(path)
+			tailer, err := newFileTailer(path, false, func(line string) { a.processLogLine(source, line) })
+			if err != nil {
+				log.Printf("Warning: Failed to follow %s for parser %s: %v", path, parser.Name, err)
+				continue
+			}
+			a.logSources = append(a.logSources, tailer)
+			log.Printf("Monitoring %s with parser %s", path, parser.Name)
+		}
+	}
+}
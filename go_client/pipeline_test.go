@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeParseRules writes a parse rules file for a test
+func writeParseRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "parsers.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLogPipelineFields tests pattern references, type conversion and timestamp extraction
+func TestLogPipelineFields(t *testing.T) {
+	pipeline, err := loadLogPipeline(writeParseRules(t, `{
+  "patterns": {"ORDER": "ORD-\\d+"},
+  "parsers": [{
+    "name": "checkout",
+    "containers": ["checkout-*"],
+    "pattern": "^%{TIMESTAMP_ISO8601:ts} %{LOGLEVEL:level} order=%{ORDER:order} amount=%{NUMBER:amount:float} items=(?P<items>\\d+) took=%{DURATION:took:duration_ms} retry=%{WORD:retry}",
+    "types": {"items": "int", "retry": "bool"},
+    "timestamp": {"field": "ts", "layout": "rfc3339"}
+  }]
+}`))
+	if err != nil {
+		t.Fatalf("Failed to load parse rules: %v", err)
+	}
+
+	fields, timestamp := pipeline.apply("checkout-api", "2026-10-16T13:55:36.5Z ERROR order=ORD-1042 amount=19.99 items=3 took=1.5s retry=false")
+	want := map[string]any{"level": "ERROR", "order": "ORD-1042", "amount": 19.99, "items": int64(3), "took": 1500.0, "retry": false}
+	if len(fields) != len(want) {
+		t.Fatalf("Unexpected fields %v", fields)
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("Field %s = %#v, want %#v", name, fields[name], value)
+		}
+	}
+	if !timestamp.Equal(time.Date(2026, 10, 16, 13, 55, 36, 500000000, time.UTC)) {
+		t.Errorf("Unexpected timestamp %v", timestamp)
+	}
+
+	if fields, _ := pipeline.apply("payments-api", "2026-10-16T13:55:36Z ERROR order=ORD-1 amount=1 items=1 took=1s retry=true"); fields != nil {
+		t.Errorf("Expected no fields for another container, got %v", fields)
+	}
+	if fields, _ := pipeline.apply("checkout-api", "starting worker"); fields != nil {
+		t.Errorf("Expected no fields for an unmatched line, got %v", fields)
+	}
+}
+
+// TestLogPipelineMetrics tests count, sum, max and avg metrics with where and group_by
+func TestLogPipelineMetrics(t *testing.T) {
+	pipeline, err := loadLogPipeline(writeParseRules(t, `{"parsers": [{
+  "name": "jobs",
+  "containers": ["worker"],
+  "files": ["/var/log/jobs/batch.log"],
+  "pattern": "job=%{WORD:job} status=%{WORD:status} ms=%{INT:ms:int}",
+  "metrics": [
+    {"name": "jobs_failed", "type": "count", "where": {"status": "failed"}},
+    {"name": "job_ms_total", "type": "sum", "field": "ms"},
+    {"name": "job_ms_max", "type": "max", "field": "ms", "group_by": "job"},
+    {"name": "job_ms_avg", "type": "avg", "field": "ms"}
+  ]
+}]}`))
+	if err != nil {
+		t.Fatalf("Failed to load parse rules: %v", err)
+	}
+	for _, line := range []string{"job=export status=ok ms=120", "job=export status=failed ms=480", "job=import status=ok ms=60"} {
+		pipeline.apply("worker", line)
+	}
+	pipeline.apply("batch.log", "job=nightly status=failed ms=9000")
+
+	got := make(map[string]LogMetric)
+	for _, m := range pipeline.take() {
+		got[m.Name+"/"+m.Source+"/"+m.Group] = m
+	}
+	for key, want := range map[string]float64{
+		"jobs_failed/worker/":      1,
+		"jobs_failed/batch.log/":   1,
+		"job_ms_total/worker/":     660,
+		"job_ms_max/worker/export": 480,
+		"job_ms_max/worker/import": 60,
+		"job_ms_avg/worker/":       220,
+	} {
+		if got[key].Value != want {
+			t.Errorf("%s = %v, want %v", key, got[key].Value, want)
+		}
+	}
+	if got["job_ms_avg/worker/"].Count != 3 {
+		t.Errorf("Expected avg over 3 lines, got %+v", got["job_ms_avg/worker/"])
+	}
+	if len(pipeline.take()) != 0 {
+		t.Error("Expected metrics to reset after take")
+	}
+}
+
+// TestLogPipelineErrors tests that invalid parse rules are rejected
+func TestLogPipelineErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"parsers": [{"name": "a", "containers": ["x"], "pattern": "%{NOPE:x}"}]}`:                                    "unknown pattern",
+		`{"parsers": [{"name": "a", "containers": ["x"], "pattern": "(?P<x>\\d+", "types": {}}]}`:                      "missing closing",
+		`{"parsers": [{"name": "a", "containers": ["x"], "pattern": "%{INT:x:hex}"}]}`:                                 "unknown type",
+		`{"parsers": [{"name": "a", "pattern": "x"}]}`:                                                                 "no containers or files",
+		`{"patterns": {"A": "%{B}", "B": "%{A}"}, "parsers": [{"name": "a", "containers": ["x"], "pattern": "%{A}"}]}`: "nested too deeply",
+		`{"parsers": [{"name": "a", "containers": ["x"], "pattern": "x", "metrics": [{"name": "m", "type": "sum"}]}]}`: "needs a field",
+	}
+	for rules, want := range cases {
+		if _, err := loadLogPipeline(writeParseRules(t, rules)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q for %s, got %v", want, rules, err)
+		}
+	}
+}
+
+// TestParsedLogEntries tests that parsed fields and timestamps reach buffered log entries and metrics the payload
+func TestParsedLogEntries(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 100, ParseRulesFile: writeParseRules(t, `{"parsers": [{
+  "name": "api",
+  "containers": ["api"],
+  "pattern": "^\\[(?P<time>[^\\]]+)\\] user=%{WORD:user} password=%{NOTSPACE:password} status=%{INT:status:int}",
+  "timestamp": {"field": "time", "layout": "2006-01-02 15:04:05"},
+  "metrics": [{"name": "logins", "type": "count", "group_by": "status"}]
+}]}`)})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.processLogLine("/api", "[2026-10-16 13:55:36] user=alice password=hunter2 status=401")
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Logs) != 1 {
+		t.Fatalf("Expected one log entry, got %+v", payload.Logs)
+	}
+	entry := payload.Logs[0]
+	if entry.Fields["user"] != "alice" || entry.Fields["status"] != int64(401) || entry.Fields["password"] != redactedValue {
+		t.Errorf("Unexpected fields %v", entry.Fields)
+	}
+	if !entry.Timestamp.Equal(time.Date(2026, 10, 16, 13, 55, 36, 0, time.Local)) {
+		t.Errorf("Unexpected timestamp %v", entry.Timestamp)
+	}
+	if len(payload.Metrics.LogMetrics) != 1 || payload.Metrics.LogMetrics[0] != (LogMetric{Name: "logins", Source: "api", Group: "401", Value: 1, Count: 1}) {
+		t.Errorf("Unexpected log metrics %+v", payload.Metrics.LogMetrics)
+	}
+}
@@ -0,0 +1,50 @@
+//go:build freebsd || openbsd
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Auth log locations: FreeBSD uses auth.log, OpenBSD uses authlog
+var authLogPaths = []string{"/var/log/auth.log", "/var/log/authlog"}
+
+// defaultDataDir is where the queue and audit log live by default
+func defaultDataDir() string {
+	return "."
+}
+
+// rootDiskPath is the filesystem reported as disk usage
+func rootDiskPath() string {
+	return "/"
+}
+
+// machineID returns the host UUID: /etc/hostid on FreeBSD, hw.uuid on OpenBSD
+func machineID() string {
+	if data, err := os.ReadFile("/etc/hostid"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if out, err := exec.Command("sysctl", "-n", "hw.uuid").Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	return ""
+}
+
+// setupPlatformAuthMonitoring starts the platform's failed-login source
+func (a *Agent) setupPlatformAuthMonitoring() error {
+	return a.setupAuthLogMonitoring(authLogPaths)
+}
+
+// startPlatformMonitors watches jails where jls is available (FreeBSD)
+func (a *Agent) startPlatformMonitors(ctx context.Context) {
+	jls, err := exec.LookPath("jls")
+	if err != nil {
+		return
+	}
+	log.Printf("Monitoring jails with %s", jls)
+	go a.monitorJails(ctx, jls)
+}
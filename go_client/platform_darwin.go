@@ -0,0 +1,65 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Data directory used when launchd starts the agent with "/" as working directory
+const launchdDataDir = "/Library/Application Support/MonitoringAgent"
+
+// defaultDataDir is where the queue and audit log live by default
+func defaultDataDir() string {
+	if wd, err := os.Getwd(); err == nil && wd == "/" {
+		return launchdDataDir
+	}
+	return "."
+}
+
+// rootDiskPath is the filesystem reported as disk usage. On APFS "/" is the
+// sealed read-only system volume, so report the data volume instead.
+func rootDiskPath() string {
+	if _, err := os.Stat("/System/Volumes/Data"); err == nil {
+		return "/System/Volumes/Data"
+	}
+	return "/"
+}
+
+// machineID returns the hardware IOPlatformUUID
+func machineID() string {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && strings.Contains(key, `"IOPlatformUUID"`) {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
+
+// setupPlatformAuthMonitoring follows sshd failures in the unified log, or
+// the --auth-logs files when given
+func (a *Agent) setupPlatformAuthMonitoring() error {
+	if paths := configuredAuthLogs(a.config); len(paths) > 0 {
+		return a.followAuthLogs(paths)
+	}
+	logPath, err := exec.LookPath("log")
+	if err != nil {
+		log.Printf("Warning: log command not found, security monitoring disabled")
+		return nil
+	}
+
+	a.logSources = append(a.logSources, followCommand(a.handleUnifiedLogLine, logPath, unifiedLogArgs...))
+	log.Printf("Monitoring unified log for sshd authentication failures")
+	return nil
+}
+
+// startPlatformMonitors starts monitors that only exist on some platforms
+func (a *Agent) startPlatformMonitors(ctx context.Context) {}
@@ -0,0 +1,101 @@
+//go:build !windows && !darwin && !freebsd && !openbsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Auth log locations, in order of preference
+var authLogPaths = []string{"/var/log/auth.log", "/var/log/secure"}
+
+// defaultDataDir is where the queue and audit log live by default
+func defaultDataDir() string {
+	return "."
+}
+
+// rootDiskPath is the filesystem reported as disk usage
+func rootDiskPath() string {
+	return "/"
+}
+
+// machineID returns the systemd/D-Bus machine ID, if the host has one
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// setupPlatformAuthMonitoring starts the configured failed-login source. In
+// auto mode (the flag default) the journal is used when no auth log file exists
+// and no --auth-logs are given.
+func (a *Agent) setupPlatformAuthMonitoring() error {
+	switch a.config.AuthSource {
+	case "auto":
+		if len(configuredAuthLogs(a.config)) > 0 {
+			return a.setupAuthLogMonitoring(authLogPaths)
+		}
+		for _, path := range authLogPaths {
+			if _, err := os.Stat(path); err == nil {
+				return a.setupAuthLogMonitoring(authLogPaths)
+			}
+		}
+		if _, err := exec.LookPath("journalctl"); err == nil {
+			return a.setupJournaldMonitoring()
+		}
+		return a.setupAuthLogMonitoring(authLogPaths)
+	case "", "file":
+		return a.setupAuthLogMonitoring(authLogPaths)
+	case "journald":
+		return a.setupJournaldMonitoring()
+	case "none":
+		log.Printf("Auth monitoring disabled (auth source none)")
+		return nil
+	default:
+		return fmt.Errorf("unknown auth source %q", a.config.AuthSource)
+	}
+}
+
+// startPlatformMonitors starts monitors that only exist on some platforms
+func (a *Agent) startPlatformMonitors(ctx context.Context) {
+	a.setupDenialMonitoring()
+	a.setupKernelErrorMonitoring()
+}
+
+// setupDenialMonitoring follows SELinux AVC and AppArmor denials when either
+// is enabled, from the auditd log or, without auditd, from the kernel log
+func (a *Agent) setupDenialMonitoring() {
+	_, selinuxErr := os.Stat("/sys/fs/selinux/enforce")
+	_, apparmorErr := os.Stat("/sys/kernel/security/apparmor")
+	if selinuxErr != nil && apparmorErr != nil {
+		return
+	}
+
+	if _, err := os.Stat(auditdLog); err == nil {
+		tailer, err := newFileTailer(auditdLog, false, a.handleDenialLine)
+		if err == nil {
+			a.logSources = append(a.logSources, tailer)
+			log.Printf("Monitoring SELinux/AppArmor denials: %s", auditdLog)
+			return
+		}
+		log.Printf("Warning: Failed to follow %s: %v", auditdLog, err)
+	}
+
+	dmesg, err := exec.LookPath("dmesg")
+	if err != nil {
+		log.Printf("Warning: No audit log or dmesg, denial monitoring disabled")
+		return
+	}
+	a.logSources = append(a.logSources, followCommand(a.handleDenialLine, dmesg, "--follow-new"))
+	log.Printf("Monitoring SELinux/AppArmor denials: kernel log")
+}
@@ -0,0 +1,73 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// defaultDataDir is where the queue and audit log live by default
+func defaultDataDir() string {
+	if programData := os.Getenv("ProgramData"); programData != "" {
+		return filepath.Join(programData, "MonitoringAgent")
+	}
+	return "."
+}
+
+// rootDiskPath is the filesystem reported as disk usage
+func rootDiskPath() string {
+	if drive := os.Getenv("SystemDrive"); drive != "" {
+		return drive + `\`
+	}
+	return `C:\`
+}
+
+// machineID returns the MachineGuid assigned at Windows installation
+func machineID() string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Cryptography`, registry.QUERY_VALUE|registry.WOW64_64KEY)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	guid, _, err := key.GetStringValue("MachineGuid")
+	if err != nil {
+		return ""
+	}
+	return guid
+}
+
+// Windows event log sources replacing auth.log parsing
+var windowsEventSources = []struct {
+	channel string
+	query   string
+}{
+	{"Security", "*[System[(EventID=4625)]]"}, // failed logon
+	{"System", "*[System[(EventID=7045)]]"},   // service installed
+}
+
+// setupPlatformAuthMonitoring subscribes to the Security and System event logs
+func (a *Agent) setupPlatformAuthMonitoring() error {
+	for _, source := range windowsEventSources {
+		sub, err := subscribeEventLog(source.channel, source.query)
+		if err != nil {
+			log.Printf("Warning: Failed to subscribe to %s event log: %v", source.channel, err)
+			continue
+		}
+		a.logSources = append(a.logSources, sub)
+		go sub.run(a.handleWindowsEventXML)
+		log.Printf("Monitoring Windows event log: %s (%s)", source.channel, source.query)
+	}
+
+	if len(a.logSources) == 0 {
+		log.Printf("Warning: No event log subscription, security monitoring disabled")
+	}
+	return nil
+}
+
+// startPlatformMonitors starts monitors that only exist on some platforms
+func (a *Agent) startPlatformMonitors(ctx context.Context) {}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Check results kept per probe for its uptime ratios
+const probeHistory = 24 * time.Hour
+
+// probe is one --probes target
+type probe struct {
+	name   string
+	kind   string // http, tcp or icmp
+	target string // the URL, host:port or host checked
+}
+
+// parseProbes parses comma-separated [name=]target specs, where a target is
+// an http:// or https:// URL, tcp://host:port or icmp://host. The name
+// defaults to the target without its scheme.
+func parseProbes(spec string) ([]*probe, error) {
+	var probes []*probe
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, target := "", item
+		if before, after, ok := strings.Cut(item, "="); ok && !strings.ContainsAny(before, ":/") {
+			name, target = before, after
+		}
+		scheme, rest, ok := strings.Cut(target, "://")
+		if !ok || rest == "" {
+			return nil, fmt.Errorf("probe %q: expected http(s)://, tcp:// or icmp:// target", item)
+		}
+
+		p := &probe{name: name, target: target}
+		switch scheme {
+		case "http", "https":
+			u, err := url.Parse(target)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("probe %q: invalid URL", item)
+			}
+			p.kind = "http"
+		case "tcp":
+			if _, port, err := net.SplitHostPort(rest); err != nil || port == "" {
+				return nil, fmt.Errorf("probe %q: expected tcp://host:port", item)
+			}
+			p.kind, p.target = "tcp", rest
+		case "icmp":
+			if strings.ContainsAny(rest, "/:") && net.ParseIP(rest) == nil {
+				return nil, fmt.Errorf("probe %q: expected icmp://host", item)
+			}
+			p.kind, p.target = "icmp", rest
+		default:
+			return nil, fmt.Errorf("probe %q: unknown scheme %q (http, https, tcp or icmp)", item, scheme)
+		}
+		if p.name == "" {
+			p.name = rest
+		}
+		if seen[p.name] {
+			return nil, fmt.Errorf("probe %q: duplicate name %s", item, p.name)
+		}
+		seen[p.name] = true
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+// ProbeMetrics summarizes one probe's checks since the previous payload
+type ProbeMetrics struct {
+	Name         string  `json:"name"`
+	Type         string  `json:"type"`
+	Target       string  `json:"target"`
+	Checks       int     `json:"checks"`
+	Failures     int     `json:"failures"`
+	LatencyMs    float64 `json:"latency_ms"` // average of successful checks
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+	StatusCode   int     `json:"status_code,omitempty"` // of the last HTTP response
+	Up           bool    `json:"up"`                    // the last check succeeded
+	LastError    string  `json:"last_error,omitempty"`
+	// Ratios of successful checks over the last hour and day
+	Uptime1h  float64 `json:"uptime_1h"`
+	Uptime24h float64 `json:"uptime_24h"`
+
+	failing int // consecutive failed checks
+}
+
+// probeResult is one check's outcome, kept for uptime ratios
+type probeResult struct {
+	at time.Time
+	ok bool
+}
+
+// probeState is a probe's window since the previous payload and its recent checks
+type probeState struct {
+	window    ProbeMetrics
+	latencyMs float64 // sum over the window's successful checks
+	history   []probeResult
+}
+
+// probeRunner checks the --probes targets and collects their results
+type probeRunner struct {
+	probes  []*probe
+	timeout time.Duration
+	client  *http.Client
+
+	mu     sync.Mutex
+	states map[string]*probeState
+}
+
+func newProbeRunner(probes []*probe, timeout time.Duration) *probeRunner {
+	r := &probeRunner{
+		probes:  probes,
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+		states:  make(map[string]*probeState, len(probes)),
+	}
+	for _, p := range probes {
+		r.states[p.name] = &probeState{window: ProbeMetrics{Name: p.name, Type: p.kind, Target: p.target}}
+	}
+	return r
+}
+
+// check makes one check of p, returning its latency and, for HTTP, the
+// response status
+func (r *probeRunner) check(ctx context.Context, p *probe) (time.Duration, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	start := time.Now()
+	switch p.kind {
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.target, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Header.Set("User-Agent", "monitoring-agent-probe/"+currentBuild().Version)
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return 0, 0, err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		latency := time.Since(start)
+		if resp.StatusCode >= 400 {
+			return latency, resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return latency, resp.StatusCode, nil
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", p.target)
+		if err != nil {
+			return 0, 0, err
+		}
+		conn.Close()
+		return time.Since(start), 0, nil
+	default:
+		latency, err := pingICMP(ctx, p.target)
+		return latency, 0, err
+	}
+}
+
+// record adds a check's outcome to p's window and history
+func (r *probeRunner) record(p *probe, at time.Time, latency time.Duration, status int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := r.states[p.name]
+	w := &state.window
+	w.Checks++
+	w.StatusCode = status
+	w.Up = err == nil
+	if err != nil {
+		w.Failures++
+		w.LastError = err.Error()
+		w.failing++
+	} else {
+		ms := durationMs(latency)
+		state.latencyMs += ms
+		w.MaxLatencyMs = max(w.MaxLatencyMs, ms)
+		w.failing = 0
+	}
+
+	cutoff := at.Add(-probeHistory)
+	drop := 0
+	for drop < len(state.history) && state.history[drop].at.Before(cutoff) {
+		drop++
+	}
+	state.history = append(state.history[drop:], probeResult{at, err == nil})
+}
+
+// runOnce checks every probe concurrently
+func (r *probeRunner) runOnce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range r.probes {
+		wg.Add(1)
+		go func(p *probe) {
+			defer wg.Done()
+			defer reportPanic()
+			at := time.Now()
+			latency, status, err := r.check(ctx, p)
+			if ctx.Err() != nil {
+				return
+			}
+			r.record(p, at, latency, status, err)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// uptimeRatio is the share of successful checks since the given time, or
+// -1 without any
+func uptimeRatio(history []probeResult, since time.Time) float64 {
+	checks, ok := 0, 0
+	for _, result := range history {
+		if result.at.Before(since) {
+			continue
+		}
+		checks++
+		if result.ok {
+			ok++
+		}
+	}
+	if checks == 0 {
+		return -1
+	}
+	return float64(ok) / float64(checks)
+}
+
+// take returns the windows of probes checked at least once, in --probes
+// order, and starts new ones
+func (r *probeRunner) take(now time.Time) []ProbeMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var metrics []ProbeMetrics
+	for _, p := range r.probes {
+		state := r.states[p.name]
+		if len(state.history) == 0 {
+			continue
+		}
+		w := state.window
+		if ok := w.Checks - w.Failures; ok > 0 {
+			w.LatencyMs = state.latencyMs / float64(ok)
+		}
+		// Probes checked less often than the ratio's period fall back to the
+		// last check's outcome
+		last := 0.0
+		if w.Up {
+			last = 1
+		}
+		if w.Uptime24h = uptimeRatio(state.history, now.Add(-probeHistory)); w.Uptime24h < 0 {
+			w.Uptime24h = last
+		}
+		if w.Uptime1h = uptimeRatio(state.history, now.Add(-time.Hour)); w.Uptime1h < 0 {
+			w.Uptime1h = last
+		}
+		metrics = append(metrics, w)
+
+		// The last check's outcome carries over into the next window
+		state.window = ProbeMetrics{Name: w.Name, Type: w.Type, Target: w.Target, StatusCode: w.StatusCode,
+			Up: w.Up, LastError: w.LastError, failing: w.failing}
+		state.latencyMs = 0
+	}
+	return metrics
+}
+
+// runProbes checks every probe at start and then every --probe-interval
+// seconds until ctx is done
+func (a *Agent) runProbes(ctx context.Context) {
+	defer reportPanic()
+
+	ticker := time.NewTicker(time.Duration(a.config.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		a.probes.runOnce(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectProbeMetrics summarizes the probe checks since the previous payload
+// and raises PROBE_FAILED:<name> while a probe's last --probe-failures
+// checks all failed
+func (a *Agent) collectProbeMetrics() []ProbeMetrics {
+	if a.probes == nil {
+		return nil
+	}
+	defer a.selfMetrics.Detector("probes").Since(time.Now())
+
+	metrics := a.probes.take(time.Now())
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+	for _, m := range metrics {
+		if m.failing < a.config.ProbeFailures {
+			continue
+		}
+		alert := "PROBE_FAILED:" + m.Name
+		detail := fmt.Sprintf("last %d %s checks of %s failed: %s (uptime %.1f%% over 1h, %.1f%% over 24h)",
+			m.failing, m.Type, m.Target, m.LastError, m.Uptime1h*100, m.Uptime24h*100)
+		if a.raiseAlert(alert) {
+			log.Printf("Probe %s failed: %s", m.Name, detail)
+		}
+		a.alertStates[alert].Detail = detail
+	}
+	return metrics
+}
+
+// pingICMP sends one ICMP echo request to host and waits for its reply. It
+// uses an unprivileged ICMP socket where the OS allows one (Linux with
+// net.ipv4.ping_group_range, macOS) and a raw socket otherwise, which needs
+// root or CAP_NET_RAW.
+func pingICMP(ctx context.Context, host string) (time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return 0, err
+	}
+	ip := addrs[0].IP
+
+	network, rawNetwork, protocol := "udp4", "ip4:icmp", 1
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if ip.To4() == nil {
+		network, rawNetwork, protocol = "udp6", "ip6:ipv6-icmp", 58
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	raw := false
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		if conn, err = icmp.ListenPacket(rawNetwork, ""); err != nil {
+			return 0, fmt.Errorf("no ICMP socket (needs net.ipv4.ping_group_range or CAP_NET_RAW): %w", err)
+		}
+		raw = true
+	}
+	defer conn.Close()
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	// Unprivileged sockets replace the ID with their own, so replies are
+	// matched on it only over raw sockets
+	id, seq := rand.IntN(0xffff), rand.IntN(0xffff)
+	request, err := (&icmp.Message{Type: requestType, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("monitoring-agent")}}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+
+	start := time.Now()
+	if _, err := conn.WriteTo(request, dst); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, fmt.Errorf("no echo reply from %s", ip)
+			}
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (raw && echo.ID != id) || !peerIP(peer).Equal(ip) {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
+
+// peerIP returns the IP of an ICMP reply's sender
+func peerIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParseProbes tests --probes targets, names and errors
+func TestParseProbes(t *testing.T) {
+	probes, err := parseProbes("api=https://api.example.com/health?full=1, tcp://db:5432,icmp://10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []probe{
+		{"api", "http", "https://api.example.com/health?full=1"},
+		{"db:5432", "tcp", "db:5432"},
+		{"10.0.0.1", "icmp", "10.0.0.1"},
+	}
+	if len(probes) != len(want) {
+		t.Fatalf("Expected %d probes, got %d", len(want), len(probes))
+	}
+	for i, p := range probes {
+		if *p != want[i] {
+			t.Errorf("Probe %d: expected %+v, got %+v", i, want[i], *p)
+		}
+	}
+
+	for _, spec := range []string{"db:5432", "tcp://db", "ftp://files", "https://", "a=tcp://x:1,a=tcp://y:1", "icmp://host/path"} {
+		if _, err := parseProbes(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+// TestProbeChecks tests HTTP and TCP checks, their metrics and uptime ratios
+func TestProbeChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	probes, err := parseProbes("web=" + server.URL + ",tcp://" + listener.Addr().String() + ",down=tcp://" + closed.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := newProbeRunner(probes, 2*time.Second)
+	runner.runOnce(context.Background())
+	healthy.Store(false)
+	runner.runOnce(context.Background())
+
+	metrics := runner.take(time.Now())
+	if len(metrics) != 3 {
+		t.Fatalf("Expected 3 probe metrics, got %+v", metrics)
+	}
+	web, tcp, down := metrics[0], metrics[1], metrics[2]
+	if web.Checks != 2 || web.Failures != 1 || web.Up || web.StatusCode != 503 || web.Uptime1h != 0.5 || web.LatencyMs <= 0 {
+		t.Errorf("Unexpected HTTP probe metrics %+v", web)
+	}
+	if tcp.Checks != 2 || tcp.Failures != 0 || !tcp.Up || tcp.Uptime24h != 1 {
+		t.Errorf("Unexpected TCP probe metrics %+v", tcp)
+	}
+	if down.Failures != 2 || down.Up || down.LastError == "" || down.Uptime1h != 0 || down.failing != 2 {
+		t.Errorf("Unexpected failing TCP probe metrics %+v", down)
+	}
+
+	// The next window starts empty but keeps the probes' history
+	healthy.Store(true)
+	runner.runOnce(context.Background())
+	web = runner.take(time.Now())[0]
+	if web.Checks != 1 || !web.Up || web.Uptime1h < 0.66 || web.Uptime1h > 0.67 {
+		t.Errorf("Expected 1 new check and 2 of 3 up over the hour, got %+v", web)
+	}
+}
+
+// TestProbeFailedAlert tests that PROBE_FAILED is raised only after
+// --probe-failures consecutive failed checks
+func TestProbeFailedAlert(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	agent, err := NewAgent(Config{Probes: "db=tcp://" + closed.Addr().String(), ProbeInterval: 30, ProbeTimeout: 1, ProbeFailures: 2})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.probes.runOnce(context.Background())
+	agent.collectProbeMetrics()
+	if agent.containsAlert("PROBE_FAILED:db") {
+		t.Fatal("Expected no alert after a single failed check")
+	}
+
+	agent.probes.runOnce(context.Background())
+	metrics := agent.collectProbeMetrics()
+	if len(metrics) != 1 || !agent.containsAlert("PROBE_FAILED:db") {
+		t.Fatalf("Expected PROBE_FAILED:db after 2 failed checks, got %v", agent.localAlerts)
+	}
+	if detail := agent.alertStates["PROBE_FAILED:db"].Detail; !strings.Contains(detail, "last 2 tcp checks") {
+		t.Errorf("Unexpected alert detail %q", detail)
+	}
+
+	if _, err := NewAgent(Config{Probes: "tcp://db:5432"}); err == nil {
+		t.Error("Expected probes without --probe-interval to be rejected")
+	}
+}
+
+// TestPingICMP tests an ICMP echo to the loopback address where the sandbox
+// allows ICMP sockets
+func TestPingICMP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	latency, err := pingICMP(ctx, "127.0.0.1")
+	if err != nil && strings.Contains(err.Error(), "no ICMP socket") {
+		t.Skipf("ICMP sockets not permitted: %v", err)
+	}
+	if err != nil || latency <= 0 {
+		t.Errorf("Expected an echo reply from 127.0.0.1, got %v, %v", latency, err)
+	}
+}
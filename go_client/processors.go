@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"unicode/utf8"
+)
+
+// Message length kept when no truncate processor applies to a source
+const defaultMaxMessageLength = 1024
+
+// LogProcessor is one step of the chain applied to log entries after
+// masking and parsing, before they are buffered
+type LogProcessor struct {
+	// Type is add_fields, drop, rename or truncate
+	Type string `json:"type"`
+	// Containers limits the processor to sources matching these path.Match
+	// globs; empty applies it to every source
+	Containers []string `json:"containers,omitempty"`
+	// Fields are the values to add (add_fields) or old to new names (rename)
+	Fields map[string]any `json:"fields,omitempty"`
+	// Pattern drops entries whose message, or Field, matches it (drop)
+	Pattern string `json:"pattern,omitempty"`
+	// Field is the field to match (drop) or shorten (truncate) instead of the message
+	Field string `json:"field,omitempty"`
+	// MaxLength is the longest value kept in bytes, 0 for no limit (truncate)
+	MaxLength int `json:"max_length,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile prepares the i-th processor for use
+func (p *LogProcessor) compile(i int) error {
+	for _, pattern := range p.Containers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("processor %d: container pattern %q: %w", i, pattern, err)
+		}
+	}
+	switch p.Type {
+	case "add_fields":
+		if len(p.Fields) == 0 {
+			return fmt.Errorf("processor %d: add_fields needs fields", i)
+		}
+	case "rename":
+		if len(p.Fields) == 0 {
+			return fmt.Errorf("processor %d: rename needs fields", i)
+		}
+		for from, to := range p.Fields {
+			if name, ok := to.(string); !ok || name == "" {
+				return fmt.Errorf("processor %d: rename of %s needs a field name", i, from)
+			}
+		}
+	case "drop":
+		if p.Pattern == "" {
+			return fmt.Errorf("processor %d: drop needs a pattern", i)
+		}
+		var err error
+		if p.re, err = regexp.Compile(p.Pattern); err != nil {
+			return fmt.Errorf("processor %d: %w", i, err)
+		}
+	case "truncate":
+		if p.MaxLength < 0 {
+			return fmt.Errorf("processor %d: negative max_length", i)
+		}
+	default:
+		return fmt.Errorf("processor %d: unknown type %q (add_fields, drop, rename or truncate)", i, p.Type)
+	}
+	return nil
+}
+
+// appliesTo reports whether the processor handles a source's entries
+func (p *LogProcessor) appliesTo(source string) bool {
+	if len(p.Containers) == 0 {
+		return true
+	}
+	for _, pattern := range p.Containers {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply runs the processor on entry, returning false if it is dropped
+func (p *LogProcessor) apply(entry *LogEntry) bool {
+	switch p.Type {
+	case "add_fields":
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]any, len(p.Fields))
+		}
+		for name, value := range p.Fields {
+			entry.Fields[name] = value
+		}
+	case "rename":
+		for from, to := range p.Fields {
+			if value, ok := entry.Fields[from]; ok {
+				delete(entry.Fields, from)
+				entry.Fields[to.(string)] = value
+			}
+		}
+	case "drop":
+		subject := entry.Message
+		if p.Field != "" {
+			value, ok := entry.Fields[p.Field]
+			if !ok {
+				return true
+			}
+			subject = fmt.Sprint(value)
+		}
+		return !p.re.MatchString(subject)
+	case "truncate":
+		if p.Field == "" {
+			entry.Message = truncateText(entry.Message, p.MaxLength)
+		} else if value, ok := entry.Fields[p.Field].(string); ok {
+			entry.Fields[p.Field] = truncateText(value, p.MaxLength)
+		}
+	}
+	return true
+}
+
+// truncateText shortens s to at most limit bytes, ending in "..." and without
+// splitting a UTF-8 character; limit 0 keeps it whole
+func truncateText(s string, limit int) string {
+	if limit == 0 || len(s) <= limit {
+		return s
+	}
+	suffix := "..."
+	if limit <= len(suffix) {
+		suffix = ""
+	}
+	cut := limit - len(suffix)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + suffix
+}
+
+// process runs the processor chain on an entry from source, returning false
+// if it is dropped. Messages of sources without a message truncate
+// processor are cut at 1024 bytes.
+func (p *logPipeline) process(source string, entry *LogEntry) bool {
+	truncated := false
+	for _, processor := range p.processors {
+		if !processor.appliesTo(source) {
+			continue
+		}
+		if !processor.apply(entry) {
+			return false
+		}
+		truncated = truncated || (processor.Type == "truncate" && processor.Field == "")
+	}
+	if !truncated {
+		entry.Message = truncateText(entry.Message, defaultMaxMessageLength)
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestLogProcessors tests add_fields, rename, drop and truncate processors
+func TestLogProcessors(t *testing.T) {
+	pipeline, err := loadLogPipeline(writeParseRules(t, `{
+  "parsers": [{"name": "api", "containers": ["api"], "pattern": "lvl=%{WORD:lvl} path=%{PATH:path}"}],
+  "processors": [
+    {"type": "drop", "pattern": "GET /health"},
+    {"type": "drop", "containers": ["api"], "field": "lvl", "pattern": "^debug$"},
+    {"type": "rename", "fields": {"lvl": "level"}},
+    {"type": "add_fields", "fields": {"env": "prod", "tier": 2}},
+    {"type": "truncate", "field": "path", "max_length": 8},
+    {"type": "truncate", "containers": ["batch-*"], "max_length": 0}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Failed to load parse rules: %v", err)
+	}
+
+	process := func(source, message string) (LogEntry, bool) {
+		entry := LogEntry{Container: source, Message: message}
+		entry.Fields, _ = pipeline.apply(source, message)
+		return entry, pipeline.process(source, &entry)
+	}
+
+	if _, kept := process("web", "GET /health HTTP/1.1 200"); kept {
+		t.Error("Expected the health check line to be dropped")
+	}
+	if _, kept := process("api", "lvl=debug path=/"); kept {
+		t.Error("Expected the debug line to be dropped")
+	}
+	entry, kept := process("api", "lvl=error path=/orders/12345")
+	if !kept {
+		t.Fatal("Expected the error line to be kept")
+	}
+	want := map[string]any{"level": "error", "path": "/orde...", "env": "prod", "tier": float64(2)}
+	if len(entry.Fields) != len(want) {
+		t.Fatalf("Unexpected fields %v", entry.Fields)
+	}
+	for name, value := range want {
+		if entry.Fields[name] != value {
+			t.Errorf("Field %s = %#v, want %#v", name, entry.Fields[name], value)
+		}
+	}
+
+	long := strings.Repeat("x", 2000)
+	if entry, _ := process("web", long); len(entry.Message) != defaultMaxMessageLength || !strings.HasSuffix(entry.Message, "...") {
+		t.Errorf("Expected the default truncation to %d bytes, got %d", defaultMaxMessageLength, len(entry.Message))
+	}
+	if entry, _ := process("batch-7", long); entry.Message != long {
+		t.Errorf("Expected max_length 0 to keep the message whole, got %d bytes", len(entry.Message))
+	}
+}
+
+// TestTruncateText tests that truncation respects the limit and UTF-8 characters
+func TestTruncateText(t *testing.T) {
+	cases := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"abcdefghij", 8, "abcde..."},
+		{"héllo wörld", 5, "h..."},
+		{"abcdef", 2, "ab"},
+		{"abcdef", 0, "abcdef"},
+	}
+	for _, c := range cases {
+		if got := truncateText(c.s, c.limit); got != c.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", c.s, c.limit, got, c.want)
+		}
+	}
+}
+
+// TestLogProcessorErrors tests that invalid processors are rejected
+func TestLogProcessorErrors(t *testing.T) {
+	cases := map[string]string{
+		`{"processors": [{"type": "uppercase"}]}`:                     "unknown type",
+		`{"processors": [{"type": "drop"}]}`:                          "needs a pattern",
+		`{"processors": [{"type": "drop", "pattern": "("}]}`:          "missing closing",
+		`{"processors": [{"type": "rename", "fields": {"a": 1}}]}`:    "needs a field name",
+		`{"processors": [{"type": "add_fields"}]}`:                    "needs fields",
+		`{"processors": [{"type": "truncate", "max_length": -1}]}`:    "negative max_length",
+		`{"processors": [{"type": "truncate", "containers": ["["]}]}`: "container pattern",
+	}
+	for rules, want := range cases {
+		if _, err := loadLogPipeline(writeParseRules(t, rules)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q for %s, got %v", want, rules, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profiles are the bundled defaults --profile applies: thresholds, intervals
+// and buffer sizes tuned per environment. A config file, flags and
+// environment variables still override any of them.
+var profiles = map[string]map[string]string{
+	// Production: short intervals, large buffers and a long warm-up so
+	// alerts fire on real incidents rather than deploys
+	"prod": {
+		"interval":              "10",
+		"heartbeat-interval":    "5",
+		"tail-lines":            "100",
+		"max-log-entries":       "1000",
+		"memory-budget-mb":      "128",
+		"baseline-samples":      "30",
+		"warmup-seconds":        "300",
+		"cpu-spike-pct":         "85",
+		"failed-auth-threshold": "10",
+		"auth-window-seconds":   "300",
+		"http-5xx-pct":          "5",
+		"notify-rate-limit":     "30",
+	},
+	// Staging: the production detectors at a relaxed pace and sensitivity
+	"staging": {
+		"interval":              "30",
+		"heartbeat-interval":    "15",
+		"tail-lines":            "50",
+		"max-log-entries":       "500",
+		"memory-budget-mb":      "64",
+		"baseline-samples":      "12",
+		"warmup-seconds":        "120",
+		"cpu-spike-pct":         "90",
+		"failed-auth-threshold": "20",
+		"auth-window-seconds":   "300",
+		"http-5xx-pct":          "10",
+		"notify-rate-limit":     "10",
+	},
+	// Development: quiet, small and cheap; no heartbeats or warm-up, and
+	// only blatant problems alert
+	"dev": {
+		"interval":              "60",
+		"heartbeat-interval":    "0",
+		"tail-lines":            "20",
+		"max-log-entries":       "200",
+		"memory-budget-mb":      "32",
+		"baseline-samples":      "5",
+		"warmup-seconds":        "0",
+		"cpu-spike-pct":         "95",
+		"failed-auth-threshold": "50",
+		"auth-window-seconds":   "120",
+		"http-5xx-pct":          "25",
+		"log-workers":           "10",
+		"notify-rate-limit":     "5",
+	},
+}
+
+// profileNames lists the bundled profiles
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets a profile's flags, except those in set (given on the
+// command line or in the config file). Like config file values they are set
+// as defaults, so the flag set only visits command line flags.
+func applyProfile(fs *flag.FlagSet, name string, set map[string]bool) error {
+	values, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q (%s)", name, strings.Join(profileNames(), ", "))
+	}
+	for flagName, value := range values {
+		if set[flagName] {
+			continue
+		}
+		if err := fs.Lookup(flagName).Value.Set(value); err != nil {
+			return fmt.Errorf("profile %s: %s: %w", name, flagName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+// parseProfileConfig parses args with flag errors discarded
+func parseProfileConfig(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseConfig(fs, args)
+}
+
+// TestProfiles tests that every bundled profile sets existing flags to
+// values the agent accepts
+func TestProfiles(t *testing.T) {
+	for _, name := range profileNames() {
+		config, err := parseProfileConfig(t, "--profile", name)
+		if err != nil {
+			t.Fatalf("Profile %s: %v", name, err)
+		}
+		if problems, _ := thresholdProblems(config); len(problems) > 0 {
+			t.Errorf("Profile %s has invalid thresholds: %v", name, problems)
+		}
+	}
+	if _, err := parseProfileConfig(t, "--profile", "qa"); err == nil {
+		t.Error("Expected an unknown profile to be rejected")
+	}
+}
+
+// TestProfilePrecedence tests that the config file, flags and environment
+// variables override profile values
+func TestProfilePrecedence(t *testing.T) {
+	config, err := parseProfileConfig(t, "--profile", "dev", "--interval", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != 5 || config.TailLines != 20 || config.CPUSpikePct != 95 {
+		t.Errorf("Expected dev defaults under the --interval flag, got interval %d, tail %d, cpu %v",
+			config.Interval, config.TailLines, config.CPUSpikePct)
+	}
+
+	path := writeConfigFile(t, "agent.yaml", "profile: staging\ntail-lines: 75\n")
+	t.Setenv("CPU_SPIKE_PCT", "99")
+	config, err = parseProfileConfig(t, "--config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Profile != "staging" || config.Interval != 30 || config.TailLines != 75 || config.CPUSpikePct != 99 {
+		t.Errorf("Expected staging from the config file under its own and environment settings, got %s, interval %d, tail %d, cpu %v",
+			config.Profile, config.Interval, config.TailLines, config.CPUSpikePct)
+	}
+
+	t.Setenv("PROFILE", "prod")
+	if config, err = parseProfileConfig(t, "--config", path); err != nil || config.Interval != 10 || config.TailLines != 75 {
+		t.Errorf("Expected PROFILE to pick the profile, got %v %+v", err, config)
+	}
+}
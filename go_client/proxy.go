@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// parseProxyURL parses --proxy-url: an http:// or https:// proxy, optionally
+// with user:password for Basic proxy authentication
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid proxy URL %q (valid: http://host:port or https://host:port)", redactURL(raw))
+	}
+	return u, nil
+}
+
+// redactURL hides the password in a URL for logs and the redacted config.
+// A URL that doesn't parse is hidden entirely.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[REDACTED]"
+	}
+	return u.Redacted()
+}
+
+// proxyFunc picks the proxy for an outbound request URL: --proxy-url when
+// set, HTTP_PROXY or HTTPS_PROXY otherwise. NO_PROXY exempts hosts either
+// way, and loopback addresses never go through a proxy. A nil URL means a
+// direct connection.
+func proxyFunc(config Config) (func(*url.URL) (*url.URL, error), error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if config.ProxyURL != "" {
+		if _, err := parseProxyURL(config.ProxyURL); err != nil {
+			return nil, err
+		}
+		proxyConfig.HTTPProxy = config.ProxyURL
+		proxyConfig.HTTPSProxy = config.ProxyURL
+	}
+	return proxyConfig.ProxyFunc(), nil
+}
+
+// newOutboundTransport returns a transport like http.DefaultTransport that
+// goes through the configured proxy
+func newOutboundTransport(config Config) (*http.Transport, error) {
+	proxy, err := proxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+	return transport, nil
+}
+
+// newOutboundClient returns a client for requests leaving the host, such as
+// webhooks, Vault and Sentry, going through the configured proxy
+func newOutboundClient(config Config, timeout time.Duration) (*http.Client, error) {
+	transport, err := newOutboundTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// proxyDialer returns a gRPC dialer that tunnels to the address through the
+// configured proxy with HTTP CONNECT, or dials it directly when NO_PROXY
+// exempts it
+func proxyDialer(config Config) (func(context.Context, string) (net.Conn, error), error) {
+	proxy, err := proxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		proxyURL, err := proxy(&url.URL{Scheme: "https", Host: addr})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+		return dialConnect(ctx, proxyURL, addr)
+	}, nil
+}
+
+// dialConnect opens a tunnel to addr through an HTTP CONNECT proxy
+func dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy %s: %w", proxyAddr, err)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed TLS handshake with proxy %s: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy: %w", err)
+	}
+	// The body of a CONNECT response is the tunnel itself, so it isn't closed
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	// The server speaks only after the client, so nothing is read past the response
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent unexpected data after CONNECT to %s", addr)
+	}
+	return conn, nil
+}
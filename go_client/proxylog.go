@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// HAProxy HTTP log format (option httplog), with or without the syslog
+	// header: client, accept date, frontend, backend/server, the five timers,
+	// status, bytes, captured cookies, termination state, connection counts
+	// ending with retries, and queues
+	haproxyLinePattern = regexp.MustCompile(`(?:^|\s)\S+:\d+ \[\d{2}/\w{3}/\d{4}:[^\]]+\] \S+ ([^/\s]+)/\S+ -?\d+/-?\d+/-?\d+/-?\d+/\+?-?\d+ (-?\d+) \+?\d+ \S+ \S+ (\S{4}) \d+/\d+/\d+/\d+/\+?(\d+) \d+/\d+`)
+	// Envoy default text format, also with the response details and
+	// transport failure fields Istio adds, and Istio's trailing upstream cluster
+	envoyLinePattern = regexp.MustCompile(`^\[[^\]]+\] "\S+ \S+ [^"]*" (\d+) (\S+) (?:\S+ \S+ "[^"]*" )?\d+ \d+ \d+ \S+ "[^"]*" "[^"]*" "([^"]*)" "([^"]*)" "([^"]*)"(?: (\S+))?`)
+)
+
+// Intervals of error rates kept as a backend's baseline
+const upstreamBaselineIntervals = 12
+
+// proxyRecord is one request from an HAProxy or Envoy access log
+type proxyRecord struct {
+	Proxy     string // haproxy or envoy
+	Backend   string
+	Status    int
+	Retries   int
+	Timeout   bool
+	RequestID string
+}
+
+// parseHAProxyLine parses an HAProxy HTTP log line. Retries are the last
+// connection count and a termination state starting with "s" is a server
+// timeout.
+func parseHAProxyLine(line string) (proxyRecord, bool) {
+	matches := haproxyLinePattern.FindStringSubmatch(line)
+	if matches == nil {
+		return proxyRecord{}, false
+	}
+	status, _ := strconv.Atoi(matches[2])
+	retries, _ := strconv.Atoi(matches[4])
+	return proxyRecord{
+		Proxy:   "haproxy",
+		Backend: matches[1],
+		Status:  status,
+		Retries: retries,
+		Timeout: matches[3][0] == 's' || status == 504,
+	}, true
+}
+
+// parseEnvoyLine parses an Envoy text access log line. The backend is the
+// upstream cluster when logged, else the authority, else the upstream host;
+// the UT response flag is an upstream timeout. The default format has no
+// retry count but logs x-request-id.
+func parseEnvoyLine(line string) (proxyRecord, bool) {
+	matches := envoyLinePattern.FindStringSubmatch(line)
+	if matches == nil {
+		return proxyRecord{}, false
+	}
+	status, _ := strconv.Atoi(matches[1])
+	record := proxyRecord{
+		Proxy:   "envoy",
+		Backend: firstSet(matches[6], matches[4], matches[5]),
+		Status:  status,
+		Timeout: envoyTimeout(matches[2], status),
+	}
+	if matches[3] != "-" {
+		record.RequestID = matches[3]
+	}
+	return record, true
+}
+
+// parseEnvoyJSONLine parses an Envoy JSON access log line using the
+// command operator names as keys (response_code, response_flags,
+// upstream_cluster, upstream_request_attempt_count...)
+func parseEnvoyJSONLine(line string) (proxyRecord, bool) {
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return proxyRecord{}, false
+	}
+	status, ok := jsonInt(entry["response_code"])
+	if !ok {
+		return proxyRecord{}, false
+	}
+	text := func(key string) string {
+		value, _ := entry[key].(string)
+		return value
+	}
+	record := proxyRecord{
+		Proxy:   "envoy",
+		Backend: firstSet(text("upstream_cluster"), text("authority"), text("upstream_host")),
+		Status:  status,
+		Timeout: envoyTimeout(text("response_flags"), status),
+	}
+	if attempts, ok := jsonInt(entry["upstream_request_attempt_count"]); ok && attempts > 1 {
+		record.Retries = attempts - 1
+	}
+	return record, true
+}
+
+// parseProxyLine parses an HAProxy or Envoy access log line, returning false for anything else
+func parseProxyLine(line string) (proxyRecord, bool) {
+	switch {
+	case strings.HasPrefix(line, "{"):
+		if strings.Contains(line, `"response_code"`) {
+			return parseEnvoyJSONLine(line)
+		}
+	case strings.HasPrefix(line, "["):
+		return parseEnvoyLine(line)
+	case strings.Contains(line, "] "):
+		return parseHAProxyLine(line)
+	}
+	return proxyRecord{}, false
+}
+
+// envoyTimeout reports whether response flags (comma-separated, "-" for
+// none) or the status show an upstream timeout
+func envoyTimeout(flags string, status int) bool {
+	for _, flag := range strings.Split(flags, ",") {
+		if flag == "UT" {
+			return true
+		}
+	}
+	return status == 504
+}
+
+// firstSet returns the first value that is neither empty nor "-"
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" && value != "-" {
+			return value
+		}
+	}
+	return "unknown"
+}
+
+// jsonInt reads a JSON number, or a number logged as a string
+func jsonInt(value any) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// UpstreamMetrics summarizes one backend behind a proxy since the previous payload
+type UpstreamMetrics struct {
+	Source    string  `json:"source"`
+	Proxy     string  `json:"proxy"`
+	Backend   string  `json:"backend"`
+	Requests  int     `json:"requests"`
+	Errors5xx int     `json:"errors_5xx"`
+	ErrorPct  float64 `json:"error_pct"`
+	Retries   int     `json:"retries"`
+	Timeouts  int     `json:"timeouts"`
+
+	errorIDs []string // request IDs of recent 5xx responses
+}
+
+// upstreamKey identifies a backend as seen by one proxy
+type upstreamKey struct {
+	source  string
+	backend string
+}
+
+// proxyLogStats collects per-backend windows from HAProxy and Envoy logs,
+// keyed by source (a container name or a log file's base name) and backend,
+// and each backend's recent error rates
+type proxyLogStats struct {
+	mu      sync.Mutex
+	windows map[upstreamKey]*UpstreamMetrics
+	history map[upstreamKey][]float64 // error percentages in recent intervals
+}
+
+func newProxyLogStats() *proxyLogStats {
+	return &proxyLogStats{
+		windows: make(map[upstreamKey]*UpstreamMetrics),
+		history: make(map[upstreamKey][]float64),
+	}
+}
+
+// observe records line if it is an HAProxy or Envoy access log line, with
+// the request's correlation ID if the line has none of its own
+func (s *proxyLogStats) observe(source, line, requestID string) {
+	record, ok := parseProxyLine(line)
+	if !ok {
+		return
+	}
+	if record.RequestID == "" {
+		record.RequestID = requestID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := upstreamKey{source, record.Backend}
+	window, ok := s.windows[key]
+	if !ok {
+		window = &UpstreamMetrics{Source: source, Proxy: record.Proxy, Backend: record.Backend}
+		s.windows[key] = window
+	}
+	window.Requests++
+	if record.Status >= 500 {
+		window.Errors5xx++
+		window.errorIDs = addCorrelationID(window.errorIDs, record.RequestID)
+	}
+	window.Retries += record.Retries
+	if record.Timeout {
+		window.Timeouts++
+	}
+}
+
+// take returns the windows collected since the previous call, sorted by
+// source and backend, and starts new ones
+func (s *proxyLogStats) take() []UpstreamMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := make([]UpstreamMetrics, 0, len(s.windows))
+	for _, window := range s.windows {
+		window.ErrorPct = float64(window.Errors5xx) * 100 / float64(window.Requests)
+		metrics = append(metrics, *window)
+	}
+	s.windows = make(map[upstreamKey]*UpstreamMetrics)
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Source != metrics[j].Source {
+			return metrics[i].Source < metrics[j].Source
+		}
+		return metrics[i].Backend < metrics[j].Backend
+	})
+	return metrics
+}
+
+// baseline returns a backend's average error percentage over recent
+// intervals with traffic and adds pct to them; ok is false until the
+// backend has a full baseline
+func (s *proxyLogStats) baseline(key upstreamKey, pct float64) (mean float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.history[key]
+	if len(history) >= upstreamBaselineIntervals {
+		for _, p := range history {
+			mean += p
+		}
+		mean /= float64(len(history))
+		ok = true
+		history = history[1:]
+	}
+	s.history[key] = append(history, pct)
+	return mean, ok
+}
+
+// collectUpstreamMetrics summarizes the proxy logs seen since the previous
+// payload and raises UPSTREAM_ERROR_SPIKE:<backend> when at least
+// --upstream-error-pct of a backend's requests (and --http-min-requests of
+// them) failed, at --upstream-spike-factor times its usual error rate once
+// that is known, with the request IDs of recent failed requests
+func (a *Agent) collectUpstreamMetrics() []UpstreamMetrics {
+	defer a.selfMetrics.Detector("proxy_log").Since(time.Now())
+
+	metrics := a.proxyLogs.take()
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+	for _, m := range metrics {
+		usual, known := a.proxyLogs.baseline(upstreamKey{m.Source, m.Backend}, m.ErrorPct)
+		if a.warmingUp() || m.Requests < a.config.HTTPMinRequests || m.ErrorPct < a.config.UpstreamErrorPct ||
+			(known && m.ErrorPct < a.config.UpstreamSpikeFactor*usual) {
+			continue
+		}
+
+		alert := "UPSTREAM_ERROR_SPIKE:" + m.Backend
+		detail := fmt.Sprintf("%d of %d requests through %s returned 5xx (%.1f%%", m.Errors5xx, m.Requests, m.Source, m.ErrorPct)
+		if known {
+			detail += fmt.Sprintf(", usually %.1f%%", usual)
+		}
+		detail += fmt.Sprintf("), %d timeouts, %d retries", m.Timeouts, m.Retries)
+		if a.raiseAlert(alert) {
+			log.Printf("Upstream error spike for %s: %s", m.Backend, detail)
+		}
+		a.alertStates[alert].Detail = detail
+		a.alertStates[alert].CorrelationIDs = m.errorIDs
+	}
+	return metrics
+}
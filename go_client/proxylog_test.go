@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestParseProxyLine tests HAProxy, Envoy text and Envoy JSON lines
+func TestParseProxyLine(t *testing.T) {
+	cases := map[string]proxyRecord{
+		`Oct 10 13:55:36 lb-1 haproxy[1234]: 10.0.0.1:51234 [10/Oct/2026:13:55:36.123] www~ api_back/api-2 0/0/1/-1/30001 504 194 - - sH-- 12/12/3/1/2 0/0 "GET /api/orders HTTP/1.1"`: {
+			Proxy: "haproxy", Backend: "api_back", Status: 504, Retries: 2, Timeout: true},
+		`10.0.0.1:51234 [10/Oct/2026:13:55:36.123] www static/<NOSRV> 0/-1/-1/-1/0 503 217 - - SC-- 1/1/0/0/+3 0/0 {example.com} "GET / HTTP/1.1"`: {
+			Proxy: "haproxy", Backend: "static", Status: 503, Retries: 3},
+		`[2026-10-10T13:55:36.123Z] "GET /api/orders HTTP/1.1" 200 - 0 512 23 21 "10.0.0.1" "curl/8.0" "5f1c" "orders.internal" "10.0.1.5:8080"`: {
+			Proxy: "envoy", Backend: "orders.internal", Status: 200, RequestID: "5f1c"},
+		`[2026-10-10T13:55:36.123Z] "POST /pay HTTP/2" 504 UT response_timeout - "-" 120 24 15000 - "-" "okhttp/4" "7a2b" "payments:8080" "10.0.1.9:8080" outbound|8080||payments.default.svc.cluster.local 10.0.2.3:40812 10.96.0.12:8080 10.0.2.3:40810 - default`: {
+			Proxy: "envoy", Backend: "outbound|8080||payments.default.svc.cluster.local", Status: 504, Timeout: true, RequestID: "7a2b"},
+		`{"start_time":"2026-10-10T13:55:36.123Z","method":"GET","path":"/","response_code":503,"response_flags":"URX,UF","upstream_cluster":"web","upstream_request_attempt_count":3}`: {
+			Proxy: "envoy", Backend: "web", Status: 503, Retries: 2},
+		`{"response_code":"200","authority":"shop.example.com","response_flags":"-"}`: {
+			Proxy: "envoy", Backend: "shop.example.com", Status: 200},
+	}
+	for line, want := range cases {
+		if got, ok := parseProxyLine(line); !ok || got != want {
+			t.Errorf("parseProxyLine(%q) = %+v, %v, want %+v", line, got, ok, want)
+		}
+	}
+
+	for _, line := range []string{
+		`10.0.0.1 - - [10/Oct/2026:13:55:36 +0000] "GET / HTTP/1.1" 200 612 "-" "curl/8.0"`,
+		`[2026-10-10 13:55:36] INFO starting worker`,
+		`{"level":"info","msg":"listening"}`,
+	} {
+		if record, ok := parseProxyLine(line); ok {
+			t.Errorf("Expected %q not to be a proxy line, got %+v", line, record)
+		}
+	}
+}
+
+// TestUpstreamErrorSpike tests per-backend metrics and UPSTREAM_ERROR_SPIKE on first sight and against the baseline
+func TestUpstreamErrorSpike(t *testing.T) {
+	agent, err := NewAgent(Config{HTTPMinRequests: 20, UpstreamErrorPct: 5, UpstreamSpikeFactor: 3, MaxLogEntries: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	requests := func(backend string, n, failed int) {
+		for i := 0; i < n; i++ {
+			status, state := 200, "----"
+			if i < failed {
+				status, state = 503, "sC--"
+			}
+			agent.processLogLine("/haproxy", fmt.Sprintf(`10.0.0.%d:5%04d [10/Oct/2026:13:55:36.123] www %s/srv1 0/0/1/2/3 %d 100 - - %s 1/1/0/0/1 0/0 "GET / HTTP/1.1"`,
+				i%250, i, backend, status, state))
+		}
+	}
+
+	requests("api", 40, 8)
+	requests("static", 40, 1)
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Metrics.Upstreams) != 2 {
+		t.Fatalf("Expected two backends, got %+v", payload.Metrics.Upstreams)
+	}
+	api := payload.Metrics.Upstreams[0]
+	if api.Backend != "api" || api.Source != "haproxy" || api.Proxy != "haproxy" || api.Requests != 40 || api.Errors5xx != 8 ||
+		api.ErrorPct != 20 || api.Retries != 40 || api.Timeouts != 8 {
+		t.Errorf("Unexpected api metrics %+v", api)
+	}
+	if alerts := strings.Join(payload.LocalAlerts, ","); alerts != "UPSTREAM_ERROR_SPIKE:api" {
+		t.Fatalf("Expected UPSTREAM_ERROR_SPIKE:api only, got %s", alerts)
+	}
+	if detail := payload.AlertDetails["UPSTREAM_ERROR_SPIKE:api"]; detail != "8 of 40 requests through haproxy returned 5xx (20.0%), 8 timeouts, 40 retries" {
+		t.Errorf("Unexpected detail %q", detail)
+	}
+
+	// A backend that usually fails this often isn't spiking
+	key := upstreamKey{"haproxy", "api"}
+	agent.proxyLogs.history[key] = nil
+	for i := 0; i < upstreamBaselineIntervals; i++ {
+		agent.proxyLogs.baseline(key, 15)
+	}
+	agent.alertMutex.Lock()
+	agent.localAlerts = nil
+	agent.alertMutex.Unlock()
+	requests("api", 40, 8)
+	payload, _ = agent.createPayload()
+	if len(payload.LocalAlerts) != 0 {
+		t.Errorf("Expected no alert at the usual error rate, got %v", payload.LocalAlerts)
+	}
+}
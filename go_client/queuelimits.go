@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// queueDirectory returns --queue-dir. Agents built without a config (replay,
+// tests) use the default directory.
+func (a *Agent) queueDirectory() string {
+	if a.config.QueueDir != "" {
+		return a.config.QueueDir
+	}
+	return queueDir
+}
+
+// queueLimit returns --queue-max-payloads
+func (a *Agent) queueLimit() int {
+	if a.config.QueueMaxPayloads > 0 {
+		return a.config.QueueMaxPayloads
+	}
+	return maxQueuedPayloads
+}
+
+// queueCutoff returns the collection time before which queued payloads are
+// dropped, and whether --queue-max-age-hours is set at all
+func (a *Agent) queueCutoff() (time.Time, bool) {
+	if a.config.QueueMaxAgeHours <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(a.config.QueueMaxAgeHours) * time.Hour), true
+}
+
+// dropExpiredPayloads drops queued payloads collected before the
+// --queue-max-age-hours cutoff, removing their queue files once nothing else
+// in them is queued. Must be called with queueMutex held.
+func (a *Agent) dropExpiredPayloads() {
+	cutoff, expires := a.queueCutoff()
+	if !expires {
+		return
+	}
+	// The queue is kept in collection order, so expired payloads are in front
+	for len(a.payloadQueue) > 0 && a.payloadQueue[0].Timestamp.Before(cutoff) {
+		expired := a.payloadQueue[0]
+		a.recordEvent(EventQueueDropped, expired.ID, "older than %dh, dropped", a.config.QueueMaxAgeHours)
+		a.queuedPayloadAcked(expired.ID)
+		a.payloadQueue = dropOldest(a.queueMemory, a.payloadQueue, &a.queueBytes, payloadSize)
+		a.selfMetrics.QueueDropped.Add(1)
+	}
+}
+
+// defaultQueueDirectory is where the queue commands look for queue files:
+// QUEUE_DIR, or the agent's default --queue-dir
+func defaultQueueDirectory() string {
+	if dir := getenv("QUEUE_DIR"); dir != "" {
+		return dir
+	}
+	return queueDir
+}
+
+// checkQueueDir checks that payloads can be persisted in dir, creating it
+// like the agent would
+func checkQueueDir(dir string) error {
+	if dir == "" {
+		dir = queueDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("queue directory not writable: %w", err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
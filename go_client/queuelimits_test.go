@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestQueueLimits tests the configured queue directory, payload count and
+// retention of queued payloads
+func TestQueueLimits(t *testing.T) {
+	server := newBackfillServer(t)
+	dir := filepath.Join(t.TempDir(), "volume", "queue")
+
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret", QueueDir: dir, QueueMaxPayloads: 2, QueueMaxAgeHours: 1})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("Expected the queue directory to be created: %v", err)
+	}
+
+	expired := Payload{ID: "expired", Timestamp: time.Now().Add(-2 * time.Hour)}
+	if err := agent.persistPayload(expired); err != nil {
+		t.Fatal(err)
+	}
+	agent.queueMutex.Lock()
+	agent.enqueuePayload(expired)
+	agent.enqueuePayload(Payload{ID: "fresh", Timestamp: time.Now()})
+	agent.queueMutex.Unlock()
+	for agent.queueLength() > 0 {
+		if err := agent.processQueue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received := server.received(); len(received) != 1 || received[0].ID != "fresh" {
+		t.Errorf("Expected only the payload inside --queue-max-age-hours delivered, got %+v", received)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "queue_*.jsonl")); len(files) != 0 {
+		t.Errorf("Expected the expired payload's queue file removed, got %v", files)
+	}
+
+	agent.queueMutex.Lock()
+	for _, id := range []string{"first", "second", "third"} {
+		agent.enqueuePayload(Payload{ID: id, Timestamp: time.Now()})
+	}
+	agent.queueMutex.Unlock()
+	if summary := agent.queueSummary(); summary.Length != 2 || summary.Limit != 2 || summary.Payloads[0].ID != "second" {
+		t.Errorf("Expected --queue-max-payloads 2 to keep the 2 newest payloads, got %+v", summary)
+	}
+}
+
+// TestQueueFileRotation tests removing queue files by age, count and total size
+func TestQueueFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	agent := &Agent{config: Config{QueueDir: dir, QueueMaxPayloads: 4, QueueMaxMB: 1, QueueMaxAgeHours: 24}}
+
+	now := time.Now()
+	write := func(name string, age time.Duration, size int) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	write("queue_1.jsonl", 48*time.Hour, 10)     // past --queue-max-age-hours
+	write("queue_2.jsonl", 5*time.Hour, 10)      // beyond --queue-max-payloads files
+	write("queue_3.jsonl", 4*time.Hour, 700<<10) // over --queue-max-mb with queue_5
+	write("queue_4.jsonl", 3*time.Hour, 10)
+	write("queue_5.jsonl", 2*time.Hour, 400<<10)
+	write("queue_6.jsonl", time.Hour, 10)
+
+	agent.rotateQueueFiles()
+	var left []string
+	files, _ := filepath.Glob(filepath.Join(dir, "queue_*.jsonl"))
+	for _, file := range files {
+		left = append(left, filepath.Base(file))
+	}
+	if len(left) != 3 || left[0] != "queue_4.jsonl" || left[2] != "queue_6.jsonl" {
+		t.Errorf("Expected queue_4 to queue_6 to remain, got %v", left)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Largest request body the test receiver accepts
+const maxReceiveBytes = 32 << 20
+
+// receiver is a stand-in for the backend ingest endpoint. It checks signatures
+// the way the server does and prints what it receives, over HTTP and, as an
+// AgentStream server, over gRPC.
+type receiver struct {
+	secret   string
+	maxSkew  time.Duration
+	commands []string // pushed to each agent that subscribes over gRPC
+	settings string   // sent with pushed set_config commands
+	throttle uint32   // throttle_ms sent with each stream ack
+	out      io.Writer
+	mu       sync.Mutex // serializes output
+}
+
+// verifySignature checks an X-Agent-Signature value against the secret, the
+// X-Agent-Timestamp value and the raw body
+func verifySignature(secret, timestamp string, body []byte, signature string) error {
+	provided, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || signature == "" {
+		return fmt.Errorf("malformed signature %q", signature)
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "." + string(body)))
+	if !hmac.Equal(provided, h.Sum(nil)) {
+		return fmt.Errorf("signature mismatch (wrong secret or modified body)")
+	}
+	return nil
+}
+
+func (rv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxReceiveBytes))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	// Signatures cover the uncompressed body (--compression)
+	if body, err = decompressBody(r.Header.Get("Content-Encoding"), body, maxReceiveBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/heartbeat") {
+		rv.serveHeartbeat(w, r, body)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/batch") {
+		rv.serveBatch(w, r, body)
+		return
+	}
+
+	id := r.Header.Get("X-Agent-Payload-Id")
+	payload, status, err := rv.verify(id, r.Header.Get("X-Agent-Timestamp"), r.Header.Get("X-Agent-Signature"), body)
+	if err != nil {
+		rv.printf("REJECTED %s from %s: %v\n", id, r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	rv.printPayload(payload, body)
+
+	writeJSON(w, map[string]interface{}{"status": "ok", "payload_id": payload.ID, "ack": newAck(rv.secret, payload.ID, AckStored)})
+}
+
+// verify checks a payload's timestamp and signature, returning the HTTP
+// status to reject it with on error
+func (rv *receiver) verify(id, timestamp, signature string, body []byte) (Payload, int, error) {
+	var payload Payload
+	if status, err := rv.verifySigned(timestamp, signature, body); err != nil {
+		return payload, status, err
+	}
+
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return payload, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", err)
+	}
+	if id != "" && payload.ID != id {
+		return payload, http.StatusBadRequest, fmt.Errorf("X-Agent-Payload-Id %s does not match body payload_id %s", id, payload.ID)
+	}
+	return payload, http.StatusOK, nil
+}
+
+// verifySigned checks a request's timestamp and signature, returning the
+// HTTP status to reject it with on error
+func (rv *receiver) verifySigned(timestamp, signature string, body []byte) (int, error) {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid X-Agent-Timestamp %q", timestamp)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > rv.maxSkew || skew < -rv.maxSkew {
+		return http.StatusBadRequest, fmt.Errorf("timestamp skew %v exceeds %v", skew.Truncate(time.Second), rv.maxSkew)
+	}
+	if err := verifySignature(rv.secret, timestamp, body, signature); err != nil {
+		return http.StatusUnauthorized, err
+	}
+	return http.StatusOK, nil
+}
+
+// serveHeartbeat verifies a heartbeat and prints it on one line
+func (rv *receiver) serveHeartbeat(w http.ResponseWriter, r *http.Request, body []byte) {
+	var heartbeat Heartbeat
+	status, err := rv.verifySigned(r.Header.Get("X-Agent-Timestamp"), r.Header.Get("X-Agent-Signature"), body)
+	if err == nil {
+		if err = json.Unmarshal(body, &heartbeat); err != nil {
+			status, err = http.StatusBadRequest, fmt.Errorf("invalid heartbeat: %v", err)
+		}
+	}
+	if err != nil {
+		rv.printf("REJECTED heartbeat from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	rv.printf("--- heartbeat from %s (agent %s) - signature OK, score %.1f, next in %ds\n",
+		heartbeat.Host, heartbeat.AgentVersion, heartbeat.Score, heartbeat.Interval)
+	writeJSON(w, map[string]interface{}{"status": "ok", "timestamp": time.Now().UTC()})
+}
+
+// serveBatch verifies a batch signed as a whole, then prints and acks each
+// payload in it
+func (rv *receiver) serveBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	if status, err := rv.verifySigned(r.Header.Get("X-Agent-Timestamp"), r.Header.Get("X-Agent-Signature"), body); err != nil {
+		rv.printf("REJECTED batch from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	acks := []batchAck{}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var payload Payload
+		if err := json.Unmarshal(line, &payload); err != nil || payload.ID == "" {
+			rv.printf("REJECTED batched payload from %s: invalid payload: %v\n", r.RemoteAddr, err)
+			acks = append(acks, batchAck{Ack: Ack{PayloadID: payload.ID, Status: AckRejected}, Error: "invalid payload"})
+			continue
+		}
+		rv.printPayload(payload, line)
+		acks = append(acks, batchAck{Ack: newAck(rv.secret, payload.ID, AckStored)})
+	}
+	rv.printf("--- batch of %d payload(s) from %s\n", len(acks), r.RemoteAddr)
+	writeJSON(w, map[string]interface{}{"status": "ok", "acks": acks})
+}
+
+// printf writes a line of output
+func (rv *receiver) printf(format string, args ...interface{}) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	fmt.Fprintf(rv.out, format, args...)
+}
+
+// printPayload prints a verified payload
+func (rv *receiver) printPayload(payload Payload, body []byte) {
+	var pretty bytes.Buffer
+	json.Indent(&pretty, body, "", "  ")
+
+	rv.mu.Lock()
+	fmt.Fprintf(rv.out, "=== payload %s from %s (agent %s) - signature OK, %d bytes, %d logs, %d events, alerts [%s]\n",
+		payload.ID, payload.Host, payload.AgentVersion, len(body), len(payload.Logs), len(payload.DockerEvents),
+		strings.Join(payload.LocalAlerts, ", "))
+	fmt.Fprintf(rv.out, "%s\n", pretty.Bytes())
+	rv.mu.Unlock()
+}
+
+// peerAddr returns the remote address of a gRPC stream
+func peerAddr(stream grpc.ServerStream) string {
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// StreamPayloads verifies streamed payloads like POSTed ones and acks each
+func (rv *receiver) StreamPayloads(stream grpc.ServerStream) error {
+	for {
+		var frame PayloadFrame
+		if err := stream.RecvMsg(&frame); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ack := &PayloadAck{PayloadID: frame.PayloadID, ThrottleMS: rv.throttle}
+		payload, _, err := rv.verify(frame.PayloadID, frame.Timestamp, frame.Signature, frame.Body)
+		if err != nil {
+			rv.printf("REJECTED %s from %s: %v\n", frame.PayloadID, peerAddr(stream), err)
+			ack.Status, ack.Error = AckRejected, err.Error()
+		} else {
+			rv.printPayload(payload, frame.Body)
+			signed := newAck(rv.secret, payload.ID, AckStored)
+			ack.Status, ack.Signature = signed.Status, signed.Signature
+		}
+		if err := stream.SendMsg(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// PushCommands pushes --command to each subscribing agent once, then holds
+// the stream open until the agent hangs up
+func (rv *receiver) PushCommands(stream grpc.ServerStream) error {
+	var subscription CommandSubscription
+	if err := stream.RecvMsg(&subscription); err != nil {
+		return err
+	}
+	body := []byte("commands." + subscription.ServerID)
+	if _, err := strconv.ParseInt(subscription.Timestamp, 10, 64); err != nil {
+		rv.printf("REJECTED command subscription of %s from %s: invalid timestamp\n", subscription.ServerID, peerAddr(stream))
+		return status.Error(codes.InvalidArgument, "invalid timestamp")
+	}
+	if err := verifySignature(rv.secret, subscription.Timestamp, body, subscription.Signature); err != nil {
+		rv.printf("REJECTED command subscription of %s from %s: %v\n", subscription.ServerID, peerAddr(stream), err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	rv.printf("=== agent %s subscribed to commands from %s\n", subscription.ServerID, peerAddr(stream))
+
+	for _, name := range rv.commands {
+		command := &Command{ID: newUUID(), Name: name}
+		if name == "set_config" {
+			command.Settings = rv.settings
+		}
+		command.Signature = commandSignature(rv.secret, command.ID, command.Name, command.Settings)
+		if err := stream.SendMsg(command); err != nil {
+			return err
+		}
+		rv.printf("pushed command %s %s to %s\n", command.Name, command.ID, subscription.ServerID)
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// AckStream prints command results
+func (rv *receiver) AckStream(stream grpc.ServerStream) error {
+	var count uint32
+	for {
+		var result CommandResult
+		if err := stream.RecvMsg(&result); err == io.EOF {
+			return stream.SendMsg(&CommandResultsReceived{Count: count})
+		} else if err != nil {
+			return err
+		}
+		expected := resultSignature(rv.secret, result.CommandID, result.Status, result.Output)
+		if !hmac.Equal([]byte(result.Signature), []byte(expected)) {
+			rv.printf("REJECTED result of command %s from %s: signature mismatch\n", result.CommandID, peerAddr(stream))
+			continue
+		}
+		count++
+		rv.printf("result of command %s: %s %s\n", result.CommandID, result.Status, result.Output)
+	}
+}
+
+func cmdReceive(args []string) error {
+	fs := newFlagSet("receive", "receive [--listen ADDR] [--grpc-listen ADDR [--command NAME,...] [--settings JSON]] --secret SECRET [--max-skew SECONDS]")
+	listen := fs.String("listen", "127.0.0.1:8000", "Address to accept payloads on")
+	grpcListen := fs.String("grpc-listen", "", "Also accept gRPC streams from agents with --grpc-addr --grpc-insecure on this address")
+	commands := fs.String("command", "", "Comma-separated commands to push to each agent subscribing over gRPC (ping, send, flush_queue, set_config)")
+	settings := fs.String("settings", "", `Settings pushed with set_config, as a JSON object such as {"interval":60}`)
+	secret := fs.String("secret", getenv("SECRET"), "Shared secret the agent signs with (SECRET)")
+	maxSkew := fs.Int("max-skew", 3600, "Maximum accepted timestamp difference in seconds")
+	throttle := fs.Uint("throttle-ms", 0, "Ask agents streaming over gRPC to pause this long after each payload, to try out backpressure")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *secret == "" {
+		return fmt.Errorf("--secret is required")
+	}
+
+	rv := &receiver{secret: *secret, maxSkew: time.Duration(*maxSkew) * time.Second, commands: strings.FieldsFunc(*commands, func(r rune) bool { return r == ',' || r == ' ' }), settings: *settings, throttle: uint32(*throttle), out: os.Stdout}
+	server := &http.Server{Addr: *listen, Handler: rv}
+
+	var grpcServer *grpc.Server
+	if *grpcListen != "" {
+		listener, err := net.Listen("tcp", *grpcListen)
+		if err != nil {
+			return err
+		}
+		grpcServer = grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+		grpcServer.RegisterService(&agentStreamDesc, rv)
+		go grpcServer.Serve(listener)
+		log.Printf("Receiving gRPC streams on %s (point the agent's --grpc-addr here, with --grpc-insecure)", listener.Addr())
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		server.Close()
+	}()
+
+	log.Printf("Receiving payloads on http://%s/ (point the agent's --server-url here)", *listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
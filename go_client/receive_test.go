@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReceiverVerifiesAgentPayloads tests the receive endpoint against real agent sends
+func TestReceiverVerifiesAgentPayloads(t *testing.T) {
+	var out strings.Builder
+	server := httptest.NewServer(&receiver{secret: "shared", maxSkew: time.Hour, out: &out})
+	defer server.Close()
+
+	agent := &Agent{config: Config{ServerURL: server.URL, Secret: "shared"}, httpClient: server.Client()}
+	payload := Payload{ID: newUUID(), Host: "web-01", Timestamp: time.Now(), LocalAlerts: []string{"CPU_SPIKE"}}
+	if err := agent.postPayload(payload); err != nil {
+		t.Fatalf("Expected correctly signed payload to be accepted: %v", err)
+	}
+	if !strings.Contains(out.String(), "payload "+payload.ID+" from web-01") || !strings.Contains(out.String(), `"local_alerts": [`) {
+		t.Errorf("Expected pretty-printed payload, got:\n%s", out.String())
+	}
+
+	wrong := &Agent{config: Config{ServerURL: server.URL, Secret: "other"}, httpClient: server.Client()}
+	if err := wrong.postPayload(payload); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected wrong secret to be rejected with 401, got %v", err)
+	}
+	if !strings.Contains(out.String(), "REJECTED "+payload.ID) {
+		t.Errorf("Expected rejection to be printed, got:\n%s", out.String())
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// replayStats counts the outcome of a queue replay
+type replayStats struct {
+	Sent   int
+	Failed int
+	Files  int
+}
+
+// replayQueue re-sends every payload persisted in dir to config.ServerURL,
+// or over the gRPC stream with config.GRPCAddr.
+// Payloads are re-signed with config.Secret at send time, so a backlog queued
+// against the wrong endpoint or secret, or older than the server's timestamp
+// tolerance, can still be delivered; they are marked as backfill. Fully
+// delivered files are removed unless keep is set; files with failures are
+// rewritten with only the undelivered payloads so the replay can be repeated.
+func replayQueue(w io.Writer, dir string, config Config, keep bool) (replayStats, error) {
+	var stats replayStats
+
+	files, err := filepath.Glob(filepath.Join(dir, "queue_*.jsonl"))
+	if err != nil {
+		return stats, err
+	}
+	sort.Strings(files)
+
+	httpClient, err := newServerHTTPClient(config, 30*time.Second)
+	if err != nil {
+		return stats, err
+	}
+	a := &Agent{
+		config:      config,
+		httpClient:  httpClient,
+		selfMetrics: NewSelfMetrics(),
+		servers:     newServerEndpoints(config.ServerURL, config.ServerFailover),
+	}
+	if config.GRPCAddr != "" {
+		stream, err := newStreamClient(a)
+		if err != nil {
+			return stats, err
+		}
+		defer stream.Close()
+		a.stream = stream
+	}
+
+	for _, file := range files {
+		payloads, err := readQueueFile(file)
+		if err != nil {
+			fmt.Fprintf(w, "warning: %s: %v\n", file, err)
+			continue
+		}
+		stats.Files++
+
+		var undelivered []Payload
+		for _, payload := range payloads {
+			payload.Backfill = true
+			if err := a.postPayload(payload); err != nil {
+				fmt.Fprintf(w, "FAILED %s %s: %v\n", filepath.Base(file), payload.ID, err)
+				undelivered = append(undelivered, payload)
+				stats.Failed++
+				continue
+			}
+			fmt.Fprintf(w, "sent   %s %s\n", filepath.Base(file), payload.ID)
+			stats.Sent++
+		}
+
+		if keep {
+			continue
+		}
+		if len(undelivered) == 0 {
+			if err := os.Remove(file); err != nil {
+				return stats, err
+			}
+		} else if len(undelivered) < len(payloads) {
+			if err := rewriteQueueFile(file, undelivered); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// postPayload makes a single delivery attempt, signed at the current time,
+// without the retries and queueing of sendPayload. Like sendPayload it
+// checks the server's ack, if the server sends one.
+func (a *Agent) postPayload(payload Payload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return a.sendOnce(payloadBytes, payload.ID, time.Now())
+}
+
+// rewriteQueueFile atomically replaces a queue file with the given payloads
+func rewriteQueueFile(filename string, payloads []Payload) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, payload := range payloads {
+		if err := encoder.Encode(payload); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQueueReplay tests re-sending persisted queue files with fresh signatures
+func TestQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-72 * time.Hour)
+	if err := rewriteQueueFile(filepath.Join(dir, "queue_1.jsonl"), []Payload{{ID: "a", Timestamp: old}, {ID: "b", Timestamp: old}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rewriteQueueFile(filepath.Join(dir, "queue_2.jsonl"), []Payload{{ID: "c", Timestamp: old}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h := hmac.New(sha256.New, []byte("new-secret"))
+		h.Write([]byte(r.Header.Get("X-Agent-Timestamp") + "." + string(body)))
+		if r.Header.Get("X-Agent-Signature") != "sha256="+hex.EncodeToString(h.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Re-signed at send time, not with the payload's own stale timestamp
+		if ts, _ := strconv.ParseInt(r.Header.Get("X-Agent-Timestamp"), 10, 64); time.Since(time.Unix(ts, 0)) > time.Minute {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := r.Header.Get("X-Agent-Payload-Id")
+		if id == "b" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received = append(received, id)
+	}))
+	defer server.Close()
+
+	var out strings.Builder
+	stats, err := replayQueue(&out, dir, Config{ServerURL: server.URL, Secret: "new-secret"}, false)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if stats.Sent != 2 || stats.Failed != 1 || stats.Files != 2 {
+		t.Errorf("Unexpected stats %+v\n%s", stats, out.String())
+	}
+	if strings.Join(received, ",") != "a,c" {
+		t.Errorf("Expected a,c delivered, got %v", received)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "queue_2.jsonl")); !os.IsNotExist(err) {
+		t.Error("Expected fully delivered queue file to be removed")
+	}
+	remaining, err := readQueueFile(filepath.Join(dir, "queue_1.jsonl"))
+	if err != nil || len(remaining) != 1 || remaining[0].ID != "b" {
+		t.Errorf("Expected only undelivered payload b to remain, got %v (%v)", remaining, err)
+	}
+}
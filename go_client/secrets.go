@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// recordSecretHits raises SECRET_IN_LOGS:<container> when masking rules caught
+// credentials in a container's logs. Only rule names and counts are recorded,
+// never the values themselves.
+func (a *Agent) recordSecretHits(containerName string, hits []ruleHit) {
+	container := strings.TrimPrefix(containerName, "/")
+	alert := "SECRET_IN_LOGS:" + container
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+
+	counts, ok := a.secretHits[container]
+	if !ok {
+		counts = make(map[string]int)
+		a.secretHits[container] = counts
+	}
+	for _, hit := range hits {
+		counts[hit.Rule] += hit.Count
+	}
+
+	// The detail is rendered from counts when read (alertDetail), not per line
+	if a.raiseAlert(alert) {
+		log.Printf("Credentials detected in logs of container %s (%s)", container, formatRuleCounts(counts))
+	}
+}
+
+// alertDetail returns an alert's current detail. Must be called with
+// alertMutex held (read lock suffices).
+func (a *Agent) alertDetail(alert string, state *AlertState) string {
+	if container, ok := strings.CutPrefix(alert, "SECRET_IN_LOGS:"); ok {
+		if counts := a.secretHits[container]; len(counts) > 0 {
+			return formatRuleCounts(counts)
+		}
+	}
+	return state.Detail
+}
+
+// formatRuleCounts renders rule counts as "rule=n" pairs sorted by rule name
+func formatRuleCounts(counts map[string]int) string {
+	rules := make([]string, 0, len(counts))
+	for rule := range counts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%s=%d", rule, counts[rule])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSecretInLogsAlert tests that masked credentials raise an alert with rule counts but no values
+func TestSecretInLogsAlert(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 10, PIIMask: "email"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	agent.processLogLine("/payments", "login password=hunter2 token=abc")
+	agent.processLogLine("/payments", "Authorization: Bearer xyz")
+	agent.processLogLine("/web", "contact ops@example.com") // PII only, no credentials
+
+	payload, _ := agent.createPayload()
+
+	alert := "SECRET_IN_LOGS:payments"
+	found := false
+	for _, a := range payload.LocalAlerts {
+		if a == alert {
+			found = true
+		}
+		if a == "SECRET_IN_LOGS:web" {
+			t.Error("Expected PII masking not to raise SECRET_IN_LOGS")
+		}
+	}
+	if !found {
+		t.Fatalf("Expected %s alert, got %v", alert, payload.LocalAlerts)
+	}
+
+	detail := payload.AlertDetails[alert]
+	if detail != "authorization_header=1, key_value=2" {
+		t.Errorf("Unexpected alert detail: %q", detail)
+	}
+	if strings.Contains(detail, "hunter2") || strings.Contains(detail, "xyz") {
+		t.Error("Alert detail must never contain secret values")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest a Vault read may take
+const vaultTimeout = 10 * time.Second
+
+// secretSource keeps the HMAC secret read from --secret-file or Vault, and
+// re-reads it so rotations apply without a restart
+type secretSource struct {
+	mu     sync.RWMutex
+	secret string
+
+	describe string // where the secret comes from, for logs
+	read     func() (string, error)
+}
+
+// secretConfigured reports whether any source of the HMAC secret is set
+func secretConfigured(config Config) bool {
+	return config.Secret != "" || config.SecretFile != "" || config.VaultAddr != ""
+}
+
+// validateSecretSource checks that at most one source of the secret is set
+func validateSecretSource(config Config) error {
+	sources := 0
+	for _, set := range []bool{config.Secret != "", config.SecretFile != "", config.VaultAddr != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("--secret, --secret-file and --vault-addr are exclusive")
+	}
+	if config.VaultAddr != "" && config.VaultPath == "" {
+		return fmt.Errorf("--vault-addr needs --vault-path")
+	}
+	if config.SecretRefresh < 0 {
+		return fmt.Errorf("--secret-refresh must not be negative")
+	}
+	return nil
+}
+
+// newSecretSource reads the secret from --secret-file or Vault. It returns
+// nil when the secret is given directly.
+func newSecretSource(config Config) (*secretSource, error) {
+	if err := validateSecretSource(config); err != nil {
+		return nil, err
+	}
+
+	var source *secretSource
+	switch {
+	case config.SecretFile != "":
+		source = &secretSource{
+			describe: config.SecretFile,
+			read:     func() (string, error) { return readSecretFile(config.SecretFile) },
+		}
+	case config.VaultAddr != "":
+		client, err := newOutboundClient(config, vaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+		source = &secretSource{
+			describe: strings.TrimSuffix(config.VaultAddr, "/") + "/v1/" + strings.TrimPrefix(config.VaultPath, "/"),
+			read:     func() (string, error) { return readVaultSecret(client, config) },
+		}
+	default:
+		return nil, nil
+	}
+
+	secret, err := source.read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secret: %w", err)
+	}
+	source.secret = secret
+	return source, nil
+}
+
+// current returns the last secret read
+func (s *secretSource) current() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secret
+}
+
+// refresh re-reads the secret, keeping the last one if that fails
+func (s *secretSource) refresh() error {
+	secret, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	changed := secret != s.secret
+	s.secret = secret
+	s.mu.Unlock()
+
+	if changed {
+		log.Printf("HMAC secret from %s changed; signing with the new secret", s.describe)
+	}
+	return nil
+}
+
+// readSecretFile reads a secret file, ignoring surrounding whitespace such
+// as the trailing newline most editors and `echo` add
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// readVaultSecret reads --vault-field of the secret at --vault-path. Both
+// KV v1 ({"data": {field}}) and KV v2 ({"data": {"data": {field}}})
+// responses are understood.
+func readVaultSecret(client *http.Client, config Config) (string, error) {
+	token := getenv("VAULT_TOKEN")
+	if config.VaultTokenFile != "" {
+		var err error
+		if token, err = readSecretFile(config.VaultTokenFile); err != nil {
+			return "", fmt.Errorf("failed to read Vault token: %w", err)
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no Vault token (set VAULT_TOKEN or --vault-token-file)")
+	}
+
+	url := strings.TrimSuffix(config.VaultAddr, "/") + "/v1/" + strings.TrimPrefix(config.VaultPath, "/")
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var response struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("invalid Vault response: %w", err)
+	}
+	data := response.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	secret, _ := data[config.VaultField].(string)
+	if secret == "" {
+		return "", fmt.Errorf("vault secret %s has no field %q", config.VaultPath, config.VaultField)
+	}
+	return secret, nil
+}
+
+// secret returns the HMAC secret payloads, acks and commands are signed with
+func (a *Agent) secret() string {
+	if a.signingSecret != nil {
+		return a.signingSecret.current()
+	}
+	return a.config.Secret
+}
+
+// runSecretRefresh re-reads the secret every --secret-refresh seconds
+func (a *Agent) runSecretRefresh(ctx context.Context) {
+	defer reportPanic()
+
+	ticker := time.NewTicker(time.Duration(a.config.SecretRefresh) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.signingSecret.refresh(); err != nil {
+				log.Printf("Warning: Failed to re-read secret from %s, keeping the current one: %v", a.signingSecret.describe, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSecretFileRotation tests reading the secret from a file and picking up
+// a rotation, and keeping the last secret when the file goes away
+func TestSecretFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("first-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := NewAgent(Config{SecretFile: path, SecretRefresh: 300})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	if agent.secret() != "first-secret" {
+		t.Fatalf("Expected the file's secret without the newline, got %q", agent.secret())
+	}
+	before := agent.signPayload([]byte("{}"), agent.startTime)
+
+	if err := os.WriteFile(path, []byte("second-secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.signingSecret.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if agent.secret() != "second-secret" || agent.signPayload([]byte("{}"), agent.startTime) == before {
+		t.Errorf("Expected payloads to be signed with the rotated secret, got %q", agent.secret())
+	}
+
+	os.Remove(path)
+	if err := agent.signingSecret.refresh(); err == nil || agent.secret() != "second-secret" {
+		t.Errorf("Expected a failed re-read to keep the last secret, got %v %q", err, agent.secret())
+	}
+}
+
+// TestVaultSecret tests KV v1 and v2 responses and the token header
+func TestVaultSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/richardops":
+			w.Write([]byte(`{"data": {"data": {"secret": "kv2-secret"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/richardops":
+			w.Write([]byte(`{"data": {"hmac": "kv1-secret"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	source, err := newSecretSource(Config{VaultAddr: server.URL, VaultPath: "secret/data/richardops", VaultField: "secret"})
+	if err != nil || source.current() != "kv2-secret" {
+		t.Errorf("Expected the KV v2 secret, got %v", err)
+	}
+	source, err = newSecretSource(Config{VaultAddr: server.URL + "/", VaultPath: "/kv/richardops", VaultField: "hmac"})
+	if err != nil || source.current() != "kv1-secret" {
+		t.Errorf("Expected the KV v1 secret, got %v", err)
+	}
+
+	for config, want := range map[Config]string{
+		{VaultAddr: server.URL, VaultPath: "secret/data/richardops", VaultField: "other"}: `no field "other"`,
+		{VaultAddr: server.URL, VaultPath: "secret/data/missing", VaultField: "secret"}:   "404",
+		{VaultAddr: server.URL, VaultPath: "secret/data/richardops", VaultField: "secret",
+			VaultTokenFile: filepath.Join(t.TempDir(), "missing")}: "Vault token",
+	} {
+		if _, err := newSecretSource(config); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %+v to fail with %q, got %v", config, want, err)
+		}
+	}
+}
+
+// TestSecretSourceExclusive tests that only one secret source may be set
+func TestSecretSourceExclusive(t *testing.T) {
+	if err := validateConfig(Config{ServerURL: "http://localhost/ingest", Secret: "s", SecretFile: "/run/secrets/x"}); err == nil {
+		t.Error("Expected --secret and --secret-file together to be rejected")
+	}
+	if err := validateConfig(Config{ServerURL: "http://localhost/ingest", VaultAddr: "http://vault:8200"}); err == nil {
+		t.Error("Expected --vault-addr without --vault-path to be rejected")
+	}
+	if err := validateConfig(Config{ServerURL: "http://localhost/ingest", SecretFile: "/run/secrets/x"}); err != nil {
+		t.Errorf("Expected --secret-file to satisfy the secret requirement, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// Maximum security events buffered between payloads
+const maxSecurityEvents = 200
+
+// SecurityEvent is a kernel mandatory access control decision (SELinux AVC,
+// AppArmor) reported alongside Docker events
+type SecurityEvent struct {
+	Type        string    `json:"type"`
+	Action      string    `json:"action"`
+	Subject     string    `json:"subject"`
+	Target      string    `json:"target,omitempty"`
+	Class       string    `json:"class,omitempty"`
+	Permissions []string  `json:"permissions,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	Permissive  bool      `json:"permissive,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// recordSecurityEvent buffers a security event for the next payload
+func (a *Agent) recordSecurityEvent(event SecurityEvent) {
+	a.eventMutex.Lock()
+	defer a.eventMutex.Unlock()
+
+	a.securityEvents = append(a.securityEvents, event)
+	if len(a.securityEvents) > maxSecurityEvents {
+		a.securityEvents = a.securityEvents[1:]
+	}
+}
+
+// recordDenial counts a denial reason (or infrastructure failure) under alert
+// and raises it, keeping per-reason counts in alert_details until the alert
+// is delivered
+func (a *Agent) recordDenial(alert, reason string) bool {
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+
+	counts, ok := a.denialCounts[alert]
+	if !ok {
+		counts = make(map[string]int)
+		a.denialCounts[alert] = counts
+	}
+	counts[reason]++
+
+	raised := a.raiseAlert(alert)
+	a.alertStates[alert].Detail = formatRuleCounts(counts)
+	return raised
+}
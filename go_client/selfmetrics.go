@@ -0,0 +1,322 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default latency buckets (seconds) used for agent self-metrics
+var defaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Histogram is a fixed-bucket latency histogram safe for concurrent use
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // one per bound plus a trailing +Inf bucket
+	sum    float64
+	count  uint64
+	max    float64
+}
+
+// HistogramSnapshot is a point-in-time view of a Histogram
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum_seconds"`
+	Max     float64           `json:"max_seconds"`
+	P50     float64           `json:"p50_seconds"`
+	P95     float64           `json:"p95_seconds"`
+	P99     float64           `json:"p99_seconds"`
+	Buckets map[string]uint64 `json:"buckets,omitempty"`
+}
+
+// NewHistogram creates a histogram with the given upper bounds in seconds
+func NewHistogram(bounds []float64) *Histogram {
+	sorted := make([]float64, len(bounds))
+	copy(sorted, bounds)
+	sort.Float64s(sorted)
+	return &Histogram{
+		bounds: sorted,
+		counts: make([]uint64, len(sorted)+1),
+	}
+}
+
+// Observe records a single duration
+func (h *Histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	idx := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	h.counts[idx]++
+	h.sum += v
+	h.count++
+	if v > h.max {
+		h.max = v
+	}
+	h.mu.Unlock()
+}
+
+// Since records the time elapsed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Snapshot returns cumulative bucket counts and estimated quantiles
+func (h *Histogram) Snapshot(withBuckets bool) HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := HistogramSnapshot{
+		Count: h.count,
+		Sum:   h.sum,
+		Max:   h.max,
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+	}
+
+	if withBuckets {
+		snap.Buckets = make(map[string]uint64, len(h.counts))
+		var cumulative uint64
+		for i, c := range h.counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+			}
+			snap.Buckets[le] = cumulative
+		}
+	}
+
+	return snap
+}
+
+// quantile estimates the q-th quantile as the upper bound of the bucket containing it.
+// Must be called with h.mu held.
+func (h *Histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.count))
+	if rank == 0 {
+		rank = 1
+	}
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		if cumulative >= rank {
+			if i < len(h.bounds) {
+				return h.bounds[i]
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// SelfMetrics instruments the agent itself so the server can spot sick agents
+type SelfMetrics struct {
+	PayloadBuild *Histogram
+	PayloadSend  *Histogram
+
+	detectorMutex sync.Mutex
+	detectors     map[string]*Histogram
+
+	SendAttempts  atomic.Uint64
+	SendRetries   atomic.Uint64
+	SendSuccesses atomic.Uint64
+	SendFailures  atomic.Uint64
+
+	ServerFailovers atomic.Uint64
+	ServerThrottles atomic.Uint64
+	BatchesSent     atomic.Uint64
+
+	Heartbeats        atomic.Uint64
+	HeartbeatFailures atomic.Uint64
+
+	QueueEnqueued  atomic.Uint64
+	QueueDequeued  atomic.Uint64
+	QueueDropped   atomic.Uint64
+	QueuePersisted atomic.Uint64
+	QueueLoaded    atomic.Uint64
+}
+
+// BufferOccupancy reports current length and capacity limit of an agent buffer
+type BufferOccupancy struct {
+	Length int   `json:"length"`
+	Limit  int   `json:"limit"`
+	Bytes  int64 `json:"bytes,omitempty"` // approximate, for buffers under the memory budget
+}
+
+// MemoryBudgetStats reports buffer memory against --memory-budget-mb
+type MemoryBudgetStats struct {
+	LimitBytes int64  `json:"limit_bytes"`
+	UsedBytes  int64  `json:"used_bytes"`
+	Evicted    uint64 `json:"evicted"` // entries dropped to make room
+	Dropped    uint64 `json:"dropped"` // new entries that didn't fit
+}
+
+// AgentStats is the serialized form of agent self-metrics
+type AgentStats struct {
+	Goroutines   int                          `json:"goroutines"`
+	HeapBytes    uint64                       `json:"heap_bytes"`
+	PayloadBuild HistogramSnapshot            `json:"payload_build"`
+	PayloadSend  HistogramSnapshot            `json:"payload_send"`
+	Detectors    map[string]HistogramSnapshot `json:"detectors"`
+	Send         SendStats                    `json:"send"`
+	Queue        QueueStats                   `json:"queue"`
+	Buffers      map[string]BufferOccupancy   `json:"buffers"`
+	Memory       MemoryBudgetStats            `json:"memory_budget"`
+}
+
+// SendStats holds delivery counters
+type SendStats struct {
+	Attempts  uint64 `json:"attempts"`
+	Retries   uint64 `json:"retries"`
+	Successes uint64 `json:"successes"`
+	Failures  uint64 `json:"failures"`
+
+	// With several --server-url endpoints: switches to another endpoint,
+	// and the one payloads currently go to
+	Failovers uint64 `json:"failovers,omitempty"`
+	Server    string `json:"server,omitempty"`
+
+	// Acks on the --grpc-addr stream asking the agent to pause
+	Throttles uint64 `json:"throttles,omitempty"`
+
+	// Requests carrying several payloads with --batch-size
+	Batches uint64 `json:"batches,omitempty"`
+
+	Heartbeats        uint64 `json:"heartbeats,omitempty"`
+	HeartbeatFailures uint64 `json:"heartbeat_failures,omitempty"`
+}
+
+// QueueStats holds queue operation counters
+type QueueStats struct {
+	Enqueued  uint64 `json:"enqueued"`
+	Dequeued  uint64 `json:"dequeued"`
+	Dropped   uint64 `json:"dropped"`
+	Persisted uint64 `json:"persisted"`
+	Loaded    uint64 `json:"loaded"`
+}
+
+// NewSelfMetrics creates an empty set of agent self-metrics
+func NewSelfMetrics() *SelfMetrics {
+	return &SelfMetrics{
+		PayloadBuild: NewHistogram(defaultLatencyBuckets),
+		PayloadSend:  NewHistogram(defaultLatencyBuckets),
+		detectors:    make(map[string]*Histogram),
+	}
+}
+
+// Detector returns the evaluation-time histogram for the named detector
+func (m *SelfMetrics) Detector(name string) *Histogram {
+	m.detectorMutex.Lock()
+	defer m.detectorMutex.Unlock()
+
+	h, ok := m.detectors[name]
+	if !ok {
+		h = NewHistogram(defaultLatencyBuckets)
+		m.detectors[name] = h
+	}
+	return h
+}
+
+// Snapshot captures the current self-metrics. Bucket detail is only included
+// when withBuckets is set, keeping the per-payload summary small.
+func (m *SelfMetrics) Snapshot(withBuckets bool) AgentStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	stats := AgentStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapBytes:    memStats.HeapAlloc,
+		PayloadBuild: m.PayloadBuild.Snapshot(withBuckets),
+		PayloadSend:  m.PayloadSend.Snapshot(withBuckets),
+		Detectors:    make(map[string]HistogramSnapshot),
+		Send: SendStats{
+			Attempts:  m.SendAttempts.Load(),
+			Retries:   m.SendRetries.Load(),
+			Successes: m.SendSuccesses.Load(),
+			Failures:  m.SendFailures.Load(),
+			Failovers: m.ServerFailovers.Load(),
+			Throttles: m.ServerThrottles.Load(),
+			Batches:   m.BatchesSent.Load(),
+
+			Heartbeats:        m.Heartbeats.Load(),
+			HeartbeatFailures: m.HeartbeatFailures.Load(),
+		},
+		Queue: QueueStats{
+			Enqueued:  m.QueueEnqueued.Load(),
+			Dequeued:  m.QueueDequeued.Load(),
+			Dropped:   m.QueueDropped.Load(),
+			Persisted: m.QueuePersisted.Load(),
+			Loaded:    m.QueueLoaded.Load(),
+		},
+	}
+
+	m.detectorMutex.Lock()
+	for name, h := range m.detectors {
+		stats.Detectors[name] = h.Snapshot(withBuckets)
+	}
+	m.detectorMutex.Unlock()
+
+	return stats
+}
+
+// agentStats snapshots self-metrics together with current buffer occupancy
+func (a *Agent) agentStats(withBuckets bool) AgentStats {
+	stats := a.selfMetrics.Snapshot(withBuckets)
+
+	a.eventMutex.RLock()
+	events, eventBytes := len(a.eventBuffer), a.eventBytes
+	a.eventMutex.RUnlock()
+
+	a.logMutex.RLock()
+	logs, logBytes := len(a.logBuffer), a.logBytes
+	a.logMutex.RUnlock()
+
+	a.alertMutex.RLock()
+	authFailures := len(a.authFailures)
+	alerts := len(a.localAlerts)
+	a.alertMutex.RUnlock()
+
+	a.cpuMutex.RLock()
+	cpuSamples := len(a.cpuSamples)
+	a.cpuMutex.RUnlock()
+
+	a.queueMutex.Lock()
+	queued, queueBytes := len(a.payloadQueue), a.queueBytes
+	a.queueMutex.Unlock()
+
+	if a.servers != nil && len(a.servers.urls) > 1 {
+		stats.Send.Server = a.servers.current()
+	}
+
+	streams, waiting := 0, 0
+	if a.logPool != nil {
+		streams, waiting = a.logPool.Running(), a.logPool.Waiting()
+	}
+
+	stats.Buffers = map[string]BufferOccupancy{
+		"docker_events": {Length: events, Limit: maxEventBuffer, Bytes: eventBytes},
+		"logs":          {Length: logs, Limit: a.config.MaxLogEntries, Bytes: logBytes},
+		"auth_failures": {Length: authFailures, Limit: maxAuthFailures},
+		"local_alerts":  {Length: alerts},
+		"cpu_samples":   {Length: cpuSamples, Limit: a.config.BaselineSamples},
+		"payload_queue": {Length: queued, Limit: a.queueLimit(), Bytes: queueBytes},
+		"log_streams":   {Length: streams, Limit: a.config.LogWorkers},
+		"log_waiting":   {Length: waiting},
+	}
+	stats.Memory = MemoryBudgetStats{
+		LimitBytes: a.liveMemory.limit + a.queueMemory.limit,
+		UsedBytes:  a.liveMemory.Used() + a.queueMemory.Used(),
+		Evicted:    a.liveMemory.evicted.Load() + a.queueMemory.evicted.Load(),
+		Dropped:    a.liveMemory.dropped.Load() + a.queueMemory.dropped.Load(),
+	}
+
+	return stats
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHistogramSnapshot tests bucket accounting and quantile estimation
+func TestHistogramSnapshot(t *testing.T) {
+	h := NewHistogram([]float64{0.01, 0.1, 1})
+
+	for i := 0; i < 90; i++ {
+		h.Observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(500 * time.Millisecond)
+	}
+
+	snap := h.Snapshot(true)
+	if snap.Count != 100 {
+		t.Errorf("Expected count 100, got %d", snap.Count)
+	}
+	if snap.P50 != 0.01 {
+		t.Errorf("Expected p50 in 0.01 bucket, got %v", snap.P50)
+	}
+	if snap.P95 != 1 {
+		t.Errorf("Expected p95 in 1s bucket, got %v", snap.P95)
+	}
+	if snap.Buckets["0.1"] != 90 || snap.Buckets["+Inf"] != 100 {
+		t.Errorf("Unexpected cumulative buckets: %v", snap.Buckets)
+	}
+
+	if summary := h.Snapshot(false); summary.Buckets != nil {
+		t.Error("Expected bucket detail to be omitted from summary snapshot")
+	}
+}
+
+// TestAgentStatsInPayload tests that self-metrics are summarized in each payload
+func TestAgentStatsInPayload(t *testing.T) {
+	agent, err := NewAgent(Config{MaxLogEntries: 10, BaselineSamples: 5})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	agent.checkBruteForceAttacks()
+	stats := agent.agentStats(false)
+
+	if stats.Goroutines == 0 {
+		t.Error("Expected goroutine count to be reported")
+	}
+	if stats.Detectors["brute_force"].Count != 1 {
+		t.Errorf("Expected one brute_force evaluation, got %d", stats.Detectors["brute_force"].Count)
+	}
+	if occ := stats.Buffers["logs"]; occ.Limit != 10 {
+		t.Errorf("Expected log buffer limit 10, got %d", occ.Limit)
+	}
+}
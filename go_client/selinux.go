@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit log written by auditd; dmesg is used when it is absent
+const auditdLog = "/var/log/audit/audit.log"
+
+var (
+	avcDeniedPattern = regexp.MustCompile(`avc:\s+denied\s+\{\s*([^}]*?)\s*\}\s+for\s+(.*)`)
+	avcFieldPattern  = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+	auditTimePattern = regexp.MustCompile(`audit\((\d+)\.(\d+):\d+\)`)
+)
+
+// parseAVCDenial extracts an SELinux AVC denial from an audit.log or kernel
+// log line, returning false for anything else
+func parseAVCDenial(line string) (SecurityEvent, bool) {
+	matches := avcDeniedPattern.FindStringSubmatch(line)
+	if matches == nil {
+		return SecurityEvent{}, false
+	}
+
+	fields := make(map[string]string)
+	for _, field := range avcFieldPattern.FindAllStringSubmatch(matches[2], -1) {
+		fields[field[1]] = strings.Trim(field[2], `"`)
+	}
+
+	event := SecurityEvent{
+		Type:        "selinux_avc",
+		Action:      "denied",
+		Subject:     selinuxType(fields["scontext"]),
+		Target:      selinuxType(fields["tcontext"]),
+		Class:       fields["tclass"],
+		Permissions: strings.Fields(matches[1]),
+		Process:     fields["comm"],
+		Path:        fields["path"],
+		Permissive:  fields["permissive"] == "1",
+		Timestamp:   time.Now(),
+	}
+	if event.Path == "" {
+		event.Path = fields["name"]
+	}
+	if ts := auditTimePattern.FindStringSubmatch(line); ts != nil {
+		sec, _ := strconv.ParseInt(ts[1], 10, 64)
+		msec, _ := strconv.ParseInt(ts[2], 10, 64)
+		event.Timestamp = time.Unix(sec, msec*int64(time.Millisecond))
+	}
+	return event, true
+}
+
+// selinuxType returns the type field of a user:role:type:level context
+func selinuxType(context string) string {
+	parts := strings.Split(context, ":")
+	if len(parts) < 3 {
+		return context
+	}
+	return parts[2]
+}
+
+// handleDenialLine dispatches an audit or kernel log line to the SELinux and AppArmor parsers
+func (a *Agent) handleDenialLine(line string) {
+	a.handleSELinuxLine(line)
+	a.handleAppArmorLine(line)
+}
+
+// handleSELinuxLine records AVC denials as security events and raises
+// SELINUX_DENIAL:<domain> with per-target counts
+func (a *Agent) handleSELinuxLine(line string) {
+	event, ok := parseAVCDenial(line)
+	if !ok {
+		return
+	}
+	a.recordSecurityEvent(event)
+
+	alert := "SELINUX_DENIAL:" + event.Subject
+	if a.recordDenial(alert, event.Target+":"+event.Class) {
+		log.Printf("SELinux denied %s %v on %s:%s (%s)", event.Subject, event.Permissions, event.Target, event.Class, event.Process)
+	}
+}
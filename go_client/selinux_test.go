@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestAVCDenialParsing tests parsing of audit.log and kernel log AVC denials
+func TestAVCDenialParsing(t *testing.T) {
+	auditLine := `type=AVC msg=audit(1736937000.123:456): avc:  denied  { read write } for  pid=1234 comm="httpd" name="id_rsa" dev="dm-0" ino=42 scontext=system_u:system_r:httpd_t:s0 tcontext=unconfined_u:object_r:user_home_t:s0 tclass=file permissive=0`
+
+	event, ok := parseAVCDenial(auditLine)
+	if !ok {
+		t.Fatal("Expected AVC denial to be parsed")
+	}
+	if event.Subject != "httpd_t" || event.Target != "user_home_t" || event.Class != "file" {
+		t.Errorf("Unexpected domain/target/class: %+v", event)
+	}
+	if !reflect.DeepEqual(event.Permissions, []string{"read", "write"}) || event.Process != "httpd" || event.Path != "id_rsa" {
+		t.Errorf("Unexpected permissions/process/path: %+v", event)
+	}
+	if event.Timestamp.Unix() != 1736937000 {
+		t.Errorf("Expected audit timestamp, got %v", event.Timestamp)
+	}
+
+	kernelLine := `[ 12.345] audit: type=1400 audit(1736937001.000:457): avc:  denied  { name_connect } for  pid=99 comm="php-fpm" dest=5432 scontext=system_u:system_r:httpd_t:s0 tcontext=system_u:object_r:postgresql_port_t:s0 tclass=tcp_socket permissive=1`
+	if event, ok := parseAVCDenial(kernelLine); !ok || event.Target != "postgresql_port_t" || !event.Permissive {
+		t.Errorf("Unexpected kernel log parse: %+v (ok=%v)", event, ok)
+	}
+
+	if _, ok := parseAVCDenial(`type=SYSCALL msg=audit(1736937000.123:456): arch=c000003e syscall=2`); ok {
+		t.Error("Expected non-AVC line to be ignored")
+	}
+}
+
+// TestSELinuxDenialAlert tests that denials raise SELINUX_DENIAL with per-target counts
+func TestSELinuxDenialAlert(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	line := `type=AVC msg=audit(1736937000.123:456): avc:  denied  { read } for  pid=1 comm="httpd" scontext=system_u:system_r:httpd_t:s0 tcontext=system_u:object_r:shadow_t:s0 tclass=file permissive=0`
+	agent.handleSELinuxLine(line)
+	agent.handleSELinuxLine(line)
+
+	if !agent.containsAlert("SELINUX_DENIAL:httpd_t") {
+		t.Fatalf("Expected SELINUX_DENIAL:httpd_t, got %v", agent.localAlerts)
+	}
+	if detail := agent.alertStates["SELINUX_DENIAL:httpd_t"].Detail; detail != "shadow_t:file=2" {
+		t.Errorf("Unexpected alert detail %q", detail)
+	}
+	if len(agent.securityEvents) != 2 {
+		t.Errorf("Expected 2 security events, got %d", len(agent.securityEvents))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Window in which --sentry-error-threshold repeats of a log error report it
+const sentryErrorWindow = 10 * time.Minute
+
+// Distinct errors counted at once; the oldest are forgotten beyond this
+const maxSentryErrors = 1000
+
+// Log lines containing these (lowercased) are counted as agent errors
+var sentryErrorWords = []string{"error", "failed", "failure", "panic"}
+
+// Numbers and IDs that make otherwise identical errors differ
+var sentryVariablePattern = regexp.MustCompile(`\b[0-9a-f-]{8,}\b|\d+`)
+
+// sentryReporter sends the agent's own panics and repeated log errors to
+// Sentry. It is an io.Writer teed into the log package's output, so every
+// log.Printf about a failure is counted without changing its call site.
+type sentryReporter struct {
+	endpoint  string
+	dsn       string
+	auth      string
+	tags      map[string]string
+	threshold int
+	client    *http.Client
+
+	mu      sync.Mutex
+	partial []byte
+	errors  map[string]*sentryErrorCount // fingerprint -> occurrences in window
+}
+
+type sentryErrorCount struct {
+	since    time.Time
+	count    int
+	reported bool
+}
+
+// sentry reports for the running agent; nil without --sentry-dsn
+var sentry *sentryReporter
+
+// parseSentryDSN returns the envelope endpoint and public key of a DSN of the
+// form https://<key>@<host>/<project>
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Sentry DSN: %w", err)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if u.Scheme == "" || u.Host == "" || u.User == nil || u.User.Username() == "" || slash < 0 || path[slash+1:] == "" {
+		return "", "", fmt.Errorf("invalid Sentry DSN: expected https://<key>@<host>/<project>")
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:slash], path[slash+1:])
+	return endpoint, u.User.Username(), nil
+}
+
+// newSentryReporter returns nil when no DSN is configured
+func newSentryReporter(config Config) (*sentryReporter, error) {
+	if config.SentryDSN == "" {
+		return nil, nil
+	}
+	endpoint, key, err := parseSentryDSN(config.SentryDSN)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	tags := map[string]string{"host": hostname, "os": runtime.GOOS, "arch": runtime.GOARCH}
+	for name, value := range map[string]string{"env": config.Env, "owner_team": config.OwnerTeam, "server_id": config.ServerID} {
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	client, err := newOutboundClient(config, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	threshold := config.SentryErrorThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &sentryReporter{
+		endpoint:  endpoint,
+		dsn:       config.SentryDSN,
+		auth:      fmt.Sprintf("Sentry sentry_version=7, sentry_client=monitoring-agent/%s, sentry_key=%s", currentBuild().Version, key),
+		tags:      tags,
+		threshold: threshold,
+		client:    client,
+		errors:    make(map[string]*sentryErrorCount),
+	}, nil
+}
+
+// Write counts the error lines of the agent's log output
+func (s *sentryReporter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		s.countLine(string(data[:i]), time.Now())
+		data = data[i+1:]
+	}
+	s.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// countLine reports an error line once it repeats threshold times in the
+// window, then stays quiet about it until the window ends
+func (s *sentryReporter) countLine(line string, now time.Time) {
+	lower := strings.ToLower(line)
+	isError := false
+	for _, word := range sentryErrorWords {
+		if strings.Contains(lower, word) {
+			isError = true
+			break
+		}
+	}
+	if !isError {
+		return
+	}
+
+	// Drop the log package's date and time prefix
+	if len(line) > 20 && line[4] == '/' && line[19] == ' ' {
+		line = line[20:]
+	}
+	fingerprint := sentryVariablePattern.ReplaceAllString(line, "#")
+	counted := s.errors[fingerprint]
+	if counted == nil || now.Sub(counted.since) >= sentryErrorWindow {
+		if counted == nil && len(s.errors) >= maxSentryErrors {
+			s.forgetOldest()
+		}
+		counted = &sentryErrorCount{since: now}
+		s.errors[fingerprint] = counted
+	}
+	counted.count++
+	if counted.count < s.threshold || counted.reported {
+		return
+	}
+	counted.reported = true
+	event := s.event("error", line)
+	event["fingerprint"] = []string{fingerprint}
+	event["extra"] = map[string]any{"occurrences": counted.count, "window": sentryErrorWindow.String()}
+	go s.send(event)
+}
+
+func (s *sentryReporter) forgetOldest() {
+	var oldest string
+	for fingerprint, counted := range s.errors {
+		if oldest == "" || counted.since.Before(s.errors[oldest].since) {
+			oldest = fingerprint
+		}
+	}
+	delete(s.errors, oldest)
+}
+
+// capturePanic reports a panic and waits for it to be sent, as the process
+// is about to exit
+func (s *sentryReporter) capturePanic(value any, stack []byte) {
+	event := s.event("fatal", fmt.Sprintf("panic: %v", value))
+	event["exception"] = map[string]any{"values": []map[string]any{{"type": "panic", "value": fmt.Sprint(value)}}}
+	event["extra"] = map[string]any{"stack": string(stack)}
+	s.send(event)
+}
+
+func (s *sentryReporter) event(level, message string) map[string]any {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       level,
+		"logger":      "monitoring-agent",
+		"server_name": s.tags["host"],
+		"release":     "monitoring-agent@" + currentBuild().Version,
+		"environment": s.tags["env"],
+		"tags":        s.tags,
+		"message":     map[string]string{"formatted": message},
+	}
+}
+
+// send posts an event as a Sentry envelope. Failures go to stderr rather
+// than the log, which would count them as errors again.
+func (s *sentryReporter) send(event map[string]any) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	header, _ := json.Marshal(map[string]string{
+		"event_id": event["event_id"].(string),
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+		"dsn":      s.dsn,
+	})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(body)})
+	var envelope bytes.Buffer
+	for _, part := range [][]byte{header, item, body} {
+		envelope.Write(part)
+		envelope.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, &envelope)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Sentry report failed: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Sentry report failed: status %d\n", resp.StatusCode)
+	}
+}
+
+// reportPanic is deferred at the top of the agent's goroutines: it reports a
+// panic to Sentry and panics again, so the agent still crashes and is
+// restarted by its service manager
+func reportPanic() {
+	if sentry == nil {
+		return
+	}
+	if value := recover(); value != nil {
+		sentry.capturePanic(value, debug.Stack())
+		panic(value)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseSentryDSN tests that DSNs map to their envelope endpoint and key
+func TestParseSentryDSN(t *testing.T) {
+	endpoint, key, err := parseSentryDSN("https://abc123@o42.ingest.sentry.io/4501")
+	if err != nil || endpoint != "https://o42.ingest.sentry.io/api/4501/envelope/" || key != "abc123" {
+		t.Errorf("Unexpected endpoint %q, key %q, error %v", endpoint, key, err)
+	}
+	endpoint, _, err = parseSentryDSN("http://key@sentry.internal:9000/sentry/7")
+	if err != nil || endpoint != "http://sentry.internal:9000/sentry/api/7/envelope/" {
+		t.Errorf("Expected the path prefix to be kept, got %q, %v", endpoint, err)
+	}
+	for _, dsn := range []string{"https://sentry.io/1", "https://key@sentry.io/", "not a dsn"} {
+		if _, _, err := parseSentryDSN(dsn); err == nil {
+			t.Errorf("Expected %q to be rejected", dsn)
+		}
+	}
+}
+
+// sentryEvents starts a fake Sentry and returns a reporter sending to it and
+// the events it receives
+func sentryEvents(t *testing.T, threshold int) (*sentryReporter, chan map[string]any) {
+	events := make(chan map[string]any, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/1/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			t.Errorf("Unexpected request to %s with auth %q", r.URL.Path, r.Header.Get("X-Sentry-Auth"))
+		}
+		lines := bufio.NewScanner(r.Body)
+		var parts []map[string]any
+		for lines.Scan() {
+			var part map[string]any
+			if err := json.Unmarshal(lines.Bytes(), &part); err != nil {
+				t.Errorf("Invalid envelope line %q: %v", lines.Text(), err)
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) != 3 || parts[1]["type"] != "event" {
+			t.Errorf("Expected an envelope with one event, got %v", parts)
+			return
+		}
+		events <- parts[2]
+	}))
+	t.Cleanup(server.Close)
+
+	dsn := strings.Replace(server.URL, "http://", "http://public@", 1) + "/1"
+	reporter, err := newSentryReporter(Config{SentryDSN: dsn, SentryErrorThreshold: threshold, Env: "prod"})
+	if err != nil {
+		t.Fatalf("Failed to create reporter: %v", err)
+	}
+	return reporter, events
+}
+
+// TestSentryRepeatedErrors tests that an error is reported once it repeats threshold times
+func TestSentryRepeatedErrors(t *testing.T) {
+	reporter, events := sentryEvents(t, 3)
+
+	reporter.Write([]byte("2026/01/02 10:00:00 Created payload 1234 (0 events)\n"))
+	for i := 0; i < 2; i++ {
+		reporter.Write([]byte("2026/01/02 10:00:00 Error sending payload 7f9c2b1e-aaaa: connection refused on attempt " + string(rune('1'+i)) + "\n"))
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Expected no report below the threshold, got %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Written in pieces, like a log line split across writes
+	reporter.Write([]byte("2026/01/02 10:00:00 Error sending payload 0a1b2c3d-bbbb: "))
+	reporter.Write([]byte("connection refused on attempt 3\n"))
+	select {
+	case event := <-events:
+		if event["level"] != "error" || event["environment"] != "prod" {
+			t.Errorf("Unexpected event %v", event)
+		}
+		message := event["message"].(map[string]any)["formatted"].(string)
+		if !strings.HasPrefix(message, "Error sending payload 0a1b2c3d-bbbb") {
+			t.Errorf("Expected the log line without its timestamp, got %q", message)
+		}
+		if tags := event["tags"].(map[string]any); tags["env"] != "prod" || tags["host"] == "" {
+			t.Errorf("Expected host and env tags, got %v", tags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the repeated error to be reported")
+	}
+
+	// Further repeats in the window aren't reported again
+	reporter.Write([]byte("2026/01/02 10:00:01 Error sending payload 99999999-cccc: connection refused on attempt 4\n"))
+	select {
+	case event := <-events:
+		t.Fatalf("Expected one report per window, got %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestSentryPanic tests that panics are reported and then re-raised
+func TestSentryPanic(t *testing.T) {
+	reporter, events := sentryEvents(t, 5)
+	sentry = reporter
+	defer func() { sentry = nil }()
+
+	func() {
+		defer func() {
+			if value := recover(); value != "boom" {
+				t.Errorf("Expected the panic to continue, got %v", value)
+			}
+		}()
+		defer reportPanic()
+		panic("boom")
+	}()
+
+	select {
+	case event := <-events:
+		if event["level"] != "fatal" || !strings.Contains(event["extra"].(map[string]any)["stack"].(string), "TestSentryPanic") {
+			t.Errorf("Expected a fatal event with the stack, got %v", event)
+		}
+	default:
+		t.Fatal("Expected the panic to be reported before re-panicking")
+	}
+}
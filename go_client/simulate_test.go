@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseSimulations tests scenario, group and "all" selection
+func TestParseSimulations(t *testing.T) {
+	scenarios, err := parseSimulations("oom, attack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range scenarios {
+		names = append(names, s.name)
+	}
+	if got := strings.Join(names, ","); got != "brute-force,cpu-spike,shell,oom" {
+		t.Errorf("Expected canonical order brute-force,cpu-spike,shell,oom, got %s", got)
+	}
+
+	all, _ := parseSimulations("all")
+	if len(all) != len(simulationScenarios) {
+		t.Errorf("Expected all %d scenarios, got %d", len(simulationScenarios), len(all))
+	}
+
+	if _, err := parseSimulations("disk-ful"); err == nil || !strings.Contains(err.Error(), "disk-full") {
+		t.Errorf("Expected unknown scenario error listing available ones, got %v", err)
+	}
+
+	if spec := simulationSpec(Config{SimulateAttack: true}); spec != "attack" {
+		t.Errorf("Expected --simulate-attack to select the attack group, got %q", spec)
+	}
+}
+
+// TestSimulationScenarios tests that every scenario reaches its detector or payload field
+func TestSimulationScenarios(t *testing.T) {
+	agent, err := NewAgent(Config{Simulate: "all", FailedAuthThreshold: 20, AuthWindowSeconds: 300,
+		CPUSpikePct: 85, BaselineSamples: 12, MaxLogEntries: 5000})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := strings.Join(payload.LocalAlerts, " ")
+	for _, want := range []string{"BRUTE_FORCE:192.0.2.1", "CPU_SPIKE", "SHELL_IN_CONTAINER", "SECRET_IN_LOGS:payments-api",
+		"SELINUX_DENIAL:httpd_t", "APPARMOR_DENIAL:docker-default", "NEW_SERVICE:updsvc", "KERNEL_ERROR:fs_readonly",
+		"DOCKER_STORAGE_ERROR", "DOCKER_API_THROTTLED", "UPSTREAM_ERROR_SPIKE:payments.internal"} {
+		if !strings.Contains(alerts, want) {
+			t.Errorf("Expected %s in alerts %v", want, payload.LocalAlerts)
+		}
+	}
+
+	if payload.Metrics.DiskUsage != 97.8 || payload.Metrics.MemoryUsage != 96.5 || payload.Metrics.TCPConns < 900 {
+		t.Errorf("Expected disk-full, oom and port-scan metrics, got %+v", payload.Metrics)
+	}
+
+	actions := make(map[string]int)
+	for _, ev := range payload.DockerEvents {
+		actions[ev.Container+" "+ev.Action]++
+	}
+	if actions["orders-worker oom"] != 1 || actions["checkout-api die"] != 5 {
+		t.Errorf("Expected oom and crashloop container events, got %v", actions)
+	}
+
+	var flood int
+	for _, entry := range payload.Logs {
+		if entry.Container == "chatty-service" {
+			flood++
+		}
+		if strings.Contains(entry.Message, "Sup3rS3cret") {
+			t.Errorf("Expected simulated secret to be masked: %s", entry.Message)
+		}
+	}
+	if flood < 1000 {
+		t.Errorf("Expected log flood lines, got %d", flood)
+	}
+
+	if len(payload.Simulation) != len(simulationScenarios) {
+		t.Errorf("Expected payload tagged with all scenarios, got %v", payload.Simulation)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultSlackTemplate renders an AlertMessage as the message text (Slack mrkdwn)
+const defaultSlackTemplate = `{{if eq .Severity "critical"}}:rotating_light:{{else}}:warning:{{end}} *{{.Severity}}* on *{{.Host}}*` +
+	`{{with .Env}} ({{.}}){{end}}: {{join .Alerts ", "}} (score {{printf "%.2f" .Score}})` +
+	`{{range $alert, $detail := .Details}}` + "\n" + `• {{$alert}}: {{$detail}}{{end}}`
+
+// newSlackNotifier returns nil when no webhook is configured
+func newSlackNotifier(config Config) (*alertNotifier, error) {
+	if config.SlackWebhook == "" && config.SlackCriticalWebhook == "" {
+		return nil, nil
+	}
+	options := serviceOptions(config, config.SlackTemplate, config.SlackMinSeverity, config.SlackRepeatMinutes)
+	if options.Template == "" {
+		options.Template = defaultSlackTemplate
+	}
+	client, err := newOutboundClient(config, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	post := func(webhook string, message AlertMessage) error {
+		return postSlack(client, webhook, message)
+	}
+	return newAlertNotifier("Slack", severityWebhooks(config.SlackWebhook, config.SlackCriticalWebhook), options, post)
+}
+
+// postSlack sends a message's rendered text to an incoming webhook
+func postSlack(client *http.Client, webhook string, message AlertMessage) error {
+	body, err := json.Marshal(map[string]string{"text": message.Text})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// slackRecorder is a fake incoming webhook keeping the texts posted to it
+type slackRecorder struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (s *slackRecorder) server(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Text string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+		s.mu.Lock()
+		s.texts = append(s.texts, body.Text)
+		s.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *slackRecorder) posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.texts...)
+}
+
+// TestSlackNotifier tests that alerts are posted to the webhook of their severity once per repeat window
+func TestSlackNotifier(t *testing.T) {
+	var warnings, criticals slackRecorder
+	notifier, err := newSlackNotifier(Config{
+		SlackWebhook:         warnings.server(t).URL,
+		SlackCriticalWebhook: criticals.server(t).URL,
+		SlackRepeatMinutes:   60,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	payload := Payload{
+		Host:         "web-1",
+		Env:          "prod",
+		LocalAlerts:  []string{"CPU_SPIKE", "SHELL_IN_CONTAINER:api"},
+		AlertDetails: map[string]string{"SHELL_IN_CONTAINER:api": "bash started in api"},
+		Score:        0.9,
+	}
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+
+	critical := criticals.posted()
+	if len(critical) != 1 || !strings.Contains(critical[0], "SHELL_IN_CONTAINER:api") || strings.Contains(critical[0], "CPU_SPIKE") {
+		t.Fatalf("Expected one critical message with the shell alert, got %q", critical)
+	}
+	for _, want := range []string{"web-1", "(prod)", "0.90", "bash started in api"} {
+		if !strings.Contains(critical[0], want) {
+			t.Errorf("Expected critical message to contain %q, got %q", want, critical[0])
+		}
+	}
+	if warning := warnings.posted(); len(warning) != 1 || !strings.Contains(warning[0], "CPU_SPIKE") {
+		t.Fatalf("Expected one warning message with the CPU alert, got %q", warning)
+	}
+
+	// Still raised alerts aren't repeated, new ones are
+	payload.LocalAlerts = append(payload.LocalAlerts, "HTTP_5XX_SPIKE")
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if len(criticals.posted()) != 1 {
+		t.Errorf("Expected no repeated critical message, got %q", criticals.posted())
+	}
+	if warning := warnings.posted(); len(warning) != 2 || strings.Contains(warning[1], "CPU_SPIKE") || !strings.Contains(warning[1], "HTTP_5XX_SPIKE") {
+		t.Errorf("Expected a second warning message with only the new alert, got %q", warning)
+	}
+}
+
+// TestSlackNotifierConfig tests the default webhook, custom templates and failed posts
+func TestSlackNotifierConfig(t *testing.T) {
+	if notifier, err := newSlackNotifier(Config{}); notifier != nil || err != nil {
+		t.Fatalf("Expected no notifier without a webhook, got %v, %v", notifier, err)
+	}
+	if _, err := newSlackNotifier(Config{SlackWebhook: "http://example.com", SlackTemplate: "{{.Host"}); err == nil {
+		t.Fatal("Expected an invalid template to be rejected")
+	}
+
+	var messages slackRecorder
+	notifier, err := newSlackNotifier(Config{
+		SlackWebhook:       messages.server(t).URL,
+		SlackTemplate:      "{{.Severity}} {{.Host}}: {{join .Alerts \"+\"}}",
+		SlackRepeatMinutes: 60,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	if err := notifier.notify(Payload{Host: "db-1", LocalAlerts: []string{"BRUTE_FORCE", "NEW_SERVICE:redis"}}); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+	if got := messages.posted(); len(got) != 1 || got[0] != "critical db-1: BRUTE_FORCE+NEW_SERVICE:redis" {
+		t.Fatalf("Expected critical alerts on the default webhook, got %q", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	notifier.webhooks[SeverityWarning] = failing.URL
+	payload := Payload{Host: "db-1", LocalAlerts: []string{"CPU_SPIKE"}}
+	if err := notifier.notify(payload); err == nil {
+		t.Fatal("Expected a failed post to be reported")
+	}
+	// Failed alerts are retried with the next payload
+	notifier.webhooks[SeverityWarning] = messages.server(t).URL
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected retry to succeed, got %v", err)
+	}
+	if got := messages.posted(); len(got) != 2 || !strings.Contains(got[1], "CPU_SPIKE") {
+		t.Errorf("Expected the failed alert to be posted again, got %q", got)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// PostgreSQL log_min_duration_statement lines; lines with a duration but
+	// no statement (log_duration, auto_explain plans) are skipped
+	postgresSlowPattern = regexp.MustCompile(`duration: (\d+(?:\.\d+)?) ms\s+(?:statement|(?:execute|parse|bind) [^:]*): (.+)$`)
+	// MySQL slow query log entry header; the statement follows on the next lines
+	mysqlQueryTimePattern = regexp.MustCompile(`^# Query_time: (\d+(?:\.\d+)?)`)
+
+	sqlStringPattern = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	sqlNumberPattern = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlListPattern   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	sqlSpacePattern  = regexp.MustCompile(`\s+`)
+)
+
+const (
+	// Distinct statements counted per source and interval, others are "other"
+	maxSlowStatements = 500
+	// Statements reported per source, by total time
+	topSlowStatementCount = 5
+	// Lines a MySQL statement may span before it is cut off
+	maxMySQLStatementLines = 20
+	// Intervals of slow query rates kept as a source's baseline
+	slowQueryBaselineIntervals = 12
+)
+
+// slowQuery is one statement from a slow query log
+type slowQuery struct {
+	Engine    string // mysql or postgresql
+	Duration  time.Duration
+	Statement string // normalized
+}
+
+// normalizeStatement folds literals so executions of one statement with
+// different values are counted together: strings and numbers become ?,
+// lists of them (?), whitespace is collapsed and the result lowercased
+func normalizeStatement(statement string) string {
+	statement = sqlStringPattern.ReplaceAllString(statement, "?")
+	statement = sqlNumberPattern.ReplaceAllString(statement, "?")
+	statement = sqlListPattern.ReplaceAllString(statement, "(?)")
+	statement = strings.ToLower(strings.TrimSpace(sqlSpacePattern.ReplaceAllString(statement, " ")))
+	statement = strings.TrimSuffix(statement, ";")
+	if len(statement) > 200 {
+		statement = statement[:200] + "..."
+	}
+	return statement
+}
+
+// parsePostgresSlowLine parses a PostgreSQL slow statement line, returning
+// false for anything else
+func parsePostgresSlowLine(line string) (slowQuery, bool) {
+	if !strings.Contains(line, "duration: ") {
+		return slowQuery{}, false
+	}
+	matches := postgresSlowPattern.FindStringSubmatch(line)
+	if matches == nil {
+		return slowQuery{}, false
+	}
+	ms, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return slowQuery{}, false
+	}
+	return slowQuery{
+		Engine:    "postgresql",
+		Duration:  time.Duration(ms * float64(time.Millisecond)),
+		Statement: normalizeStatement(matches[2]),
+	}, true
+}
+
+// mysqlSlowEntry is a MySQL slow log entry whose statement is being read
+type mysqlSlowEntry struct {
+	duration time.Duration
+	lines    []string
+}
+
+// mysqlSlowParser reads MySQL slow query log entries, which span lines:
+// comment lines with the query time, then the statement ending in ;
+type mysqlSlowParser struct {
+	entry *mysqlSlowEntry
+}
+
+// line takes the next line of a source, returning a query once its statement is complete
+func (p *mysqlSlowParser) line(line string) (slowQuery, bool) {
+	if matches := mysqlQueryTimePattern.FindStringSubmatch(line); matches != nil {
+		seconds, _ := strconv.ParseFloat(matches[1], 64)
+		p.entry = &mysqlSlowEntry{duration: time.Duration(seconds * float64(time.Second))}
+		return slowQuery{}, false
+	}
+	if p.entry == nil {
+		return slowQuery{}, false
+	}
+	trimmed := strings.TrimSpace(line)
+	lower := strings.ToLower(trimmed)
+	// Session statements MySQL writes before the query itself
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(lower, "set timestamp=") || strings.HasPrefix(lower, "use ") {
+		return slowQuery{}, false
+	}
+	p.entry.lines = append(p.entry.lines, trimmed)
+	if !strings.HasSuffix(trimmed, ";") && len(p.entry.lines) < maxMySQLStatementLines {
+		return slowQuery{}, false
+	}
+	query := slowQuery{
+		Engine:    "mysql",
+		Duration:  p.entry.duration,
+		Statement: normalizeStatement(strings.Join(p.entry.lines, " ")),
+	}
+	p.entry = nil
+	return query, true
+}
+
+// SlowQueryMetrics summarizes one source's slow queries since the previous payload
+type SlowQueryMetrics struct {
+	Source        string          `json:"source"`
+	Engine        string          `json:"engine"`
+	Count         int             `json:"count"`
+	PerMinute     float64         `json:"per_minute"`
+	MaxMs         float64         `json:"max_ms"`
+	TotalMs       float64         `json:"total_ms"`
+	TopStatements []SlowStatement `json:"top_statements,omitempty"`
+}
+
+// SlowStatement is a normalized statement's slow executions
+type SlowStatement struct {
+	Statement string  `json:"statement"`
+	Count     int     `json:"count"`
+	TotalMs   float64 `json:"total_ms"`
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// slowQueryWindow accumulates one source's slow queries between payloads
+type slowQueryWindow struct {
+	engine     string
+	count      int
+	total      time.Duration
+	max        time.Duration
+	statements map[string]*SlowStatement
+}
+
+func (w *slowQueryWindow) add(query slowQuery) {
+	w.engine = query.Engine
+	w.count++
+	w.total += query.Duration
+	w.max = max(w.max, query.Duration)
+
+	statement := query.Statement
+	if _, ok := w.statements[statement]; !ok && len(w.statements) >= maxSlowStatements {
+		statement = "other"
+	}
+	s, ok := w.statements[statement]
+	if !ok {
+		s = &SlowStatement{Statement: statement}
+		w.statements[statement] = s
+	}
+	ms := durationMs(query.Duration)
+	s.Count++
+	s.TotalMs += ms
+	s.MaxMs = max(s.MaxMs, ms)
+}
+
+// metrics summarizes the window, which lasted elapsed
+func (w *slowQueryWindow) metrics(source string, elapsed time.Duration) SlowQueryMetrics {
+	m := SlowQueryMetrics{
+		Source:  source,
+		Engine:  w.engine,
+		Count:   w.count,
+		MaxMs:   durationMs(w.max),
+		TotalMs: durationMs(w.total),
+	}
+	if elapsed > 0 {
+		m.PerMinute = float64(w.count) / elapsed.Minutes()
+	}
+	for _, s := range w.statements {
+		m.TopStatements = append(m.TopStatements, *s)
+	}
+	sort.Slice(m.TopStatements, func(i, j int) bool {
+		a, b := m.TopStatements[i], m.TopStatements[j]
+		if a.TotalMs != b.TotalMs {
+			return a.TotalMs > b.TotalMs
+		}
+		return a.Statement < b.Statement
+	})
+	if len(m.TopStatements) > topSlowStatementCount {
+		m.TopStatements = m.TopStatements[:topSlowStatementCount]
+	}
+	return m
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// slowQueryStats collects slow query windows per source, a container name
+// or a log file's base name, and each source's recent rates
+type slowQueryStats struct {
+	mu      sync.Mutex
+	since   time.Time
+	windows map[string]*slowQueryWindow
+	mysql   map[string]*mysqlSlowParser
+	history map[string][]float64 // source -> slow queries per minute in recent intervals
+}
+
+func newSlowQueryStats() *slowQueryStats {
+	return &slowQueryStats{
+		since:   time.Now(),
+		windows: make(map[string]*slowQueryWindow),
+		mysql:   make(map[string]*mysqlSlowParser),
+		history: make(map[string][]float64),
+	}
+}
+
+// observe records line if it completes a slow query
+func (s *slowQueryStats) observe(source, line string) {
+	query, ok := parsePostgresSlowLine(line)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok {
+		// MySQL entries span lines, so their parser keeps state per source
+		parser := s.mysql[source]
+		if parser == nil {
+			if !mysqlQueryTimePattern.MatchString(line) {
+				return
+			}
+			parser = &mysqlSlowParser{}
+			s.mysql[source] = parser
+		}
+		if query, ok = parser.line(line); !ok {
+			return
+		}
+	}
+	window, exists := s.windows[source]
+	if !exists {
+		window = &slowQueryWindow{statements: make(map[string]*SlowStatement)}
+		s.windows[source] = window
+	}
+	window.add(query)
+}
+
+// take returns the windows collected since the previous call and starts new ones
+func (s *slowQueryStats) take() (map[string]*slowQueryWindow, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	windows, elapsed := s.windows, time.Since(s.since)
+	s.windows, s.since = make(map[string]*slowQueryWindow), time.Now()
+	return windows, elapsed
+}
+
+// baseline returns a source's average rate over recent intervals and adds
+// rate to them; ok is false until the source has a full baseline
+func (s *slowQueryStats) baseline(source string, rate float64) (mean float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.history[source]
+	if len(history) >= slowQueryBaselineIntervals {
+		for _, r := range history {
+			mean += r
+		}
+		mean /= float64(len(history))
+		ok = true
+		history = history[1:]
+	}
+	s.history[source] = append(history, rate)
+	return mean, ok
+}
+
+// sources returns the sources with a rate history
+func (s *slowQueryStats) sources() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sources := make([]string, 0, len(s.history))
+	for source := range s.history {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// setupSlowQueryLogMonitoring follows the host slow query log files in --slow-query-logs
+func (a *Agent) setupSlowQueryLogMonitoring() {
+	for _, path := range strings.Split(a.config.SlowQueryLogs, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		source := filepath.Base(path)
+		tailer, err := newFileTailer(path, false, func(line string) { a.slowQueries.observe(source, line) })
+		if err != nil {
+			log.Printf("Warning: Failed to follow slow query log %s: %v", path, err)
+			continue
+		}
+		a.logSources = append(a.logSources, tailer)
+		log.Printf("Monitoring slow query log: %s", path)
+	}
+}
+
+// collectSlowQueryMetrics summarizes the slow queries seen since the
+// previous payload and raises SLOW_QUERY_SPIKE:<source> when a source logged
+// at least --slow-query-min-count of them at --slow-query-spike-factor
+// times its usual rate (any rate until the baseline is known)
+func (a *Agent) collectSlowQueryMetrics() []SlowQueryMetrics {
+	defer a.selfMetrics.Detector("slow_query").Since(time.Now())
+
+	windows, elapsed := a.slowQueries.take()
+	// Sources that were quiet this interval still add a zero rate to their baseline
+	for _, source := range a.slowQueries.sources() {
+		if _, ok := windows[source]; !ok {
+			a.slowQueries.baseline(source, 0)
+		}
+	}
+	sources := make([]string, 0, len(windows))
+	for source := range windows {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+	var metrics []SlowQueryMetrics
+	for _, source := range sources {
+		m := windows[source].metrics(source, elapsed)
+		metrics = append(metrics, m)
+		usual, known := a.slowQueries.baseline(source, m.PerMinute)
+		if a.warmingUp() || m.Count < a.config.SlowQueryMinCount || (known && m.PerMinute < a.config.SlowQuerySpikeFactor*usual) {
+			continue
+		}
+
+		alert := "SLOW_QUERY_SPIKE:" + source
+		detail := fmt.Sprintf("%d slow queries (%.1f/min", m.Count, m.PerMinute)
+		if known {
+			detail += fmt.Sprintf(", usually %.1f/min", usual)
+		}
+		detail += fmt.Sprintf("), slowest %.0f ms", m.MaxMs)
+		if len(m.TopStatements) > 0 {
+			detail += ", most time in: " + m.TopStatements[0].Statement
+		}
+		if a.raiseAlert(alert) {
+			log.Printf("Slow query spike in %s: %s", source, detail)
+		}
+		a.alertStates[alert].Detail = detail
+	}
+	return metrics
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNormalizeStatement tests that literals are folded and whitespace collapsed
+func TestNormalizeStatement(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM orders WHERE id = 42;":                           "select * from orders where id = ?",
+		"select *\n  from users where email = 'a@b.c' and t1.age > 3.5": "select * from users where email = ? and t1.age > ?",
+		"DELETE FROM carts WHERE id IN (1, 2, 3) AND note = 'it''s'":    "delete from carts where id in (?) and note = ?",
+		"UPDATE jobs SET state = $1 WHERE queue = $2":                   "update jobs set state = $? where queue = $?",
+	}
+	for statement, want := range cases {
+		if got := normalizeStatement(statement); got != want {
+			t.Errorf("normalizeStatement(%q) = %q, want %q", statement, got, want)
+		}
+	}
+}
+
+// TestParsePostgresSlowLine tests log_min_duration_statement lines
+func TestParsePostgresSlowLine(t *testing.T) {
+	query, ok := parsePostgresSlowLine(`2026-10-10 13:55:36.123 UTC [1234] LOG:  duration: 2345.678 ms  statement: SELECT 1 FROM pg_sleep(2)`)
+	if !ok || query.Engine != "postgresql" || query.Duration != 2345678*time.Microsecond || query.Statement != "select ? from pg_sleep(?)" {
+		t.Fatalf("Unexpected query %+v, %v", query, ok)
+	}
+	query, ok = parsePostgresSlowLine(`LOG:  duration: 812.000 ms  execute <unnamed>: SELECT * FROM items WHERE sku = $1`)
+	if !ok || query.Statement != "select * from items where sku = $?" {
+		t.Errorf("Expected an extended protocol statement, got %+v, %v", query, ok)
+	}
+	for _, line := range []string{
+		`LOG:  duration: 0.512 ms`,
+		`LOG:  checkpoint complete: wrote 12 buffers`,
+	} {
+		if _, ok := parsePostgresSlowLine(line); ok {
+			t.Errorf("Expected %q not to be a slow query", line)
+		}
+	}
+}
+
+// TestSlowQueryStatsMySQL tests that multi-line MySQL entries are read per source
+func TestSlowQueryStatsMySQL(t *testing.T) {
+	stats := newSlowQueryStats()
+	lines := []string{
+		"/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:",
+		"# Time: 2026-10-10T13:55:36.123456Z",
+		"# User@Host: app[app] @  [10.0.0.5]  Id:    12",
+		"# Query_time: 3.500000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 250000",
+		"use shop;",
+		"SET timestamp=1791640536;",
+		"SELECT * FROM orders",
+		"  WHERE customer_id = 7;",
+		"# Time: 2026-10-10T13:55:40.000000Z",
+		"# Query_time: 1.250000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 90000",
+		"SET timestamp=1791640540;",
+		"SELECT * FROM orders WHERE customer_id = 8;",
+	}
+	for _, line := range lines {
+		stats.observe("mysql-slow.log", line)
+		// Another source's lines don't interleave with this one's entries
+		stats.observe("web", "GET /health 200")
+	}
+
+	windows, _ := stats.take()
+	if len(windows) != 1 {
+		t.Fatalf("Expected one source, got %d", len(windows))
+	}
+	m := windows["mysql-slow.log"].metrics("mysql-slow.log", time.Minute)
+	if m.Engine != "mysql" || m.Count != 2 || m.PerMinute != 2 || m.MaxMs != 3500 || m.TotalMs != 4750 {
+		t.Fatalf("Unexpected metrics %+v", m)
+	}
+	if len(m.TopStatements) != 1 || m.TopStatements[0] != (SlowStatement{Statement: "select * from orders where customer_id = ?", Count: 2, TotalMs: 4750, MaxMs: 3500}) {
+		t.Errorf("Unexpected top statements %+v", m.TopStatements)
+	}
+}
+
+// TestSlowQuerySpike tests that SLOW_QUERY_SPIKE is raised on a burst and then against the baseline
+func TestSlowQuerySpike(t *testing.T) {
+	agent, err := NewAgent(Config{SlowQueryMinCount: 5, SlowQuerySpikeFactor: 3, MaxLogEntries: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	slow := func(n int) {
+		for i := 0; i < n; i++ {
+			agent.processLogLine("/db", fmt.Sprintf(`LOG:  duration: %d.000 ms  statement: SELECT * FROM orders WHERE id = %d`, 1000+i, i))
+		}
+	}
+
+	slow(4)
+	payload, err := agent.createPayload()
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	if len(payload.Metrics.SlowQueries) != 1 || payload.Metrics.SlowQueries[0].Count != 4 {
+		t.Fatalf("Expected slow query metrics for db, got %+v", payload.Metrics.SlowQueries)
+	}
+	if len(payload.LocalAlerts) != 0 {
+		t.Fatalf("Expected no alert below --slow-query-min-count, got %v", payload.LocalAlerts)
+	}
+
+	slow(6)
+	payload, _ = agent.createPayload()
+	detail := payload.AlertDetails["SLOW_QUERY_SPIKE:db"]
+	if !strings.Contains(strings.Join(payload.LocalAlerts, ","), "SLOW_QUERY_SPIKE:db") || !strings.Contains(detail, "6 slow queries") ||
+		!strings.Contains(detail, "slowest 1005 ms") || !strings.Contains(detail, "select * from orders where id = ?") {
+		t.Fatalf("Expected SLOW_QUERY_SPIKE:db with details, got %v %q", payload.LocalAlerts, detail)
+	}
+
+	// With a full baseline, the usual rate isn't a spike
+	stats := agent.slowQueries
+	stats.history["db"] = nil
+	for i := 0; i < slowQueryBaselineIntervals; i++ {
+		stats.baseline("db", 1e6)
+	}
+	agent.alertMutex.Lock()
+	agent.localAlerts = nil
+	agent.alertMutex.Unlock()
+	slow(6)
+	payload, _ = agent.createPayload()
+	if len(payload.LocalAlerts) != 0 {
+		t.Errorf("Expected no alert at the usual rate, got %v", payload.LocalAlerts)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// SNMP OIDs polled on every device
+const (
+	oidSysName   = ".1.3.6.1.2.1.1.5.0"
+	oidSysUpTime = ".1.3.6.1.2.1.1.3.0"
+
+	// IF-MIB ifTable and ifXTable columns, indexed by ifIndex
+	oidIfDescr       = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfAdminStatus = ".1.3.6.1.2.1.2.2.1.7"
+	oidIfOperStatus  = ".1.3.6.1.2.1.2.2.1.8"
+	oidIfInErrors    = ".1.3.6.1.2.1.2.2.1.14"
+	oidIfOutErrors   = ".1.3.6.1.2.1.2.2.1.20"
+	oidIfName        = ".1.3.6.1.2.1.31.1.1.1.1"
+	oidIfHCInOctets  = ".1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCOutOctets = ".1.3.6.1.2.1.31.1.1.1.10"
+	oidIfHighSpeed   = ".1.3.6.1.2.1.31.1.1.1.15"
+
+	// HOST-RESOURCES-MIB hrProcessorLoad, one row per CPU
+	oidHrProcessorLoad = ".1.3.6.1.2.1.25.3.3.1.2"
+
+	// UPS-MIB (RFC 1628) scalars, absent on anything but a UPS
+	oidUPSBatteryStatus    = ".1.3.6.1.2.1.33.1.2.1.0"
+	oidUPSMinutesRemaining = ".1.3.6.1.2.1.33.1.2.3.0"
+	oidUPSChargeRemaining  = ".1.3.6.1.2.1.33.1.2.4.0"
+	oidUPSOutputSource     = ".1.3.6.1.2.1.33.1.4.1.0"
+)
+
+// Longest an SNMP request may take, per try
+const snmpTimeout = 5 * time.Second
+
+// UPS-MIB values
+const (
+	upsBatteryLow      = 3
+	upsBatteryDepleted = 4
+	upsOutputBattery   = 5
+)
+
+// IF-MIB ifAdminStatus/ifOperStatus up(1)
+const ifStatusUp = 1
+
+// SNMPConfig is the format of the --snmp-file JSON document
+type SNMPConfig struct {
+	Devices []SNMPDevice `json:"devices"`
+}
+
+// SNMPDevice is a switch, UPS, firewall or other device polled over SNMP
+type SNMPDevice struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port uint16 `json:"port,omitempty"` // default 161
+	// Version is 2c (default) or 3
+	Version   string `json:"version,omitempty"`
+	Community string `json:"community,omitempty"` // v2c, default "public"
+	// v3 user-based security; auth_protocol is md5, sha, sha256 or sha512
+	// and priv_protocol des, aes or aes256, each off without a password
+	User         string `json:"user,omitempty"`
+	AuthProtocol string `json:"auth_protocol,omitempty"`
+	AuthPassword string `json:"auth_password,omitempty"`
+	PrivProtocol string `json:"priv_protocol,omitempty"`
+	PrivPassword string `json:"priv_password,omitempty"`
+}
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"md5": gosnmp.MD5, "sha": gosnmp.SHA, "sha256": gosnmp.SHA256, "sha512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"des": gosnmp.DES, "aes": gosnmp.AES, "aes256": gosnmp.AES256,
+}
+
+// loadSNMPDevices reads and checks an --snmp-file; an empty path yields no
+// devices. FIPS mode refuses MD5 and DES.
+func loadSNMPDevices(path string, fips bool) ([]SNMPDevice, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SNMP devices: %w", err)
+	}
+	var cfg SNMPConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to load SNMP devices: parse %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Devices {
+		d := &cfg.Devices[i]
+		if d.Host == "" {
+			return nil, fmt.Errorf("invalid SNMP device %d: host is required", i)
+		}
+		if d.Name == "" {
+			d.Name = d.Host
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("invalid SNMP device %s: duplicate name", d.Name)
+		}
+		seen[d.Name] = true
+		if d.Port == 0 {
+			d.Port = 161
+		}
+		switch d.Version {
+		case "", "2c":
+			d.Version = "2c"
+			if d.Community == "" {
+				d.Community = "public"
+			}
+		case "3":
+			if d.User == "" {
+				return nil, fmt.Errorf("invalid SNMP device %s: v3 needs a user", d.Name)
+			}
+			d.AuthProtocol = strings.ToLower(d.AuthProtocol)
+			d.PrivProtocol = strings.ToLower(d.PrivProtocol)
+			if d.AuthPassword != "" {
+				if _, ok := snmpAuthProtocols[d.AuthProtocol]; !ok {
+					return nil, fmt.Errorf("invalid SNMP device %s: unknown auth protocol %q (md5, sha, sha256 or sha512)", d.Name, d.AuthProtocol)
+				}
+			}
+			if d.PrivPassword != "" {
+				if d.AuthPassword == "" {
+					return nil, fmt.Errorf("invalid SNMP device %s: privacy needs authentication", d.Name)
+				}
+				if _, ok := snmpPrivProtocols[d.PrivProtocol]; !ok {
+					return nil, fmt.Errorf("invalid SNMP device %s: unknown priv protocol %q (des, aes or aes256)", d.Name, d.PrivProtocol)
+				}
+			}
+			if fips && (d.AuthProtocol == "md5" || d.PrivProtocol == "des") {
+				return nil, fmt.Errorf("invalid SNMP device %s: FIPS mode does not allow MD5 or DES", d.Name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid SNMP device %s: unknown version %q (2c or 3)", d.Name, d.Version)
+		}
+	}
+	return cfg.Devices, nil
+}
+
+// client returns an unconnected gosnmp client for d
+func (d *SNMPDevice) client(timeout time.Duration) *gosnmp.GoSNMP {
+	g := &gosnmp.GoSNMP{
+		Target:             d.Host,
+		Port:               d.Port,
+		Transport:          "udp",
+		Timeout:            timeout,
+		Retries:            1,
+		ExponentialTimeout: false,
+		MaxOids:            gosnmp.MaxOids,
+		MaxRepetitions:     25,
+	}
+	if d.Version == "2c" {
+		g.Version = gosnmp.Version2c
+		g.Community = d.Community
+		return g
+	}
+
+	g.Version = gosnmp.Version3
+	g.SecurityModel = gosnmp.UserSecurityModel
+	params := &gosnmp.UsmSecurityParameters{UserName: d.User}
+	g.MsgFlags = gosnmp.NoAuthNoPriv
+	if d.AuthPassword != "" {
+		g.MsgFlags = gosnmp.AuthNoPriv
+		params.AuthenticationProtocol = snmpAuthProtocols[d.AuthProtocol]
+		params.AuthenticationPassphrase = d.AuthPassword
+	}
+	if d.PrivPassword != "" {
+		g.MsgFlags = gosnmp.AuthPriv
+		params.PrivacyProtocol = snmpPrivProtocols[d.PrivProtocol]
+		params.PrivacyPassphrase = d.PrivPassword
+	}
+	g.SecurityParameters = params
+	return g
+}
+
+// SNMPDeviceMetrics is a device's health and interface counters at its last poll
+type SNMPDeviceMetrics struct {
+	Name          string  `json:"name"`
+	Host          string  `json:"host"`
+	SysName       string  `json:"sys_name,omitempty"`
+	Up            bool    `json:"up"` // the last poll answered
+	LastError     string  `json:"last_error,omitempty"`
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+	CPUPercent    float64 `json:"cpu_percent,omitempty"` // average hrProcessorLoad
+	// UPS-MIB readings, only from a UPS
+	UPS        *UPSMetrics            `json:"ups,omitempty"`
+	Interfaces []SNMPInterfaceMetrics `json:"interfaces,omitempty"`
+
+	polledAt time.Time
+}
+
+// UPSMetrics is the battery state of a UPS
+type UPSMetrics struct {
+	OnBattery        bool    `json:"on_battery"`
+	BatteryLow       bool    `json:"battery_low"`
+	ChargePercent    float64 `json:"charge_percent"`
+	MinutesRemaining float64 `json:"minutes_remaining"`
+}
+
+// SNMPInterfaceMetrics is one administratively up interface. Rates and
+// error counts cover the time since the previous poll and are absent on the
+// first one.
+type SNMPInterfaceMetrics struct {
+	Name           string  `json:"name"`
+	Up             bool    `json:"up"` // ifOperStatus
+	SpeedMbps      uint64  `json:"speed_mbps,omitempty"`
+	InBytesPerSec  float64 `json:"in_bytes_per_sec"`
+	OutBytesPerSec float64 `json:"out_bytes_per_sec"`
+	InErrors       uint64  `json:"in_errors"`
+	OutErrors      uint64  `json:"out_errors"`
+
+	wasUp bool // up at this or an earlier poll
+}
+
+// snmpCounters are an interface's raw counters at a poll
+type snmpCounters struct {
+	inOctets, outOctets, inErrors, outErrors uint64
+	wasUp                                    bool // oper status was up at some poll
+}
+
+// snmpDeviceState is a device's last metrics and the counters they came from
+type snmpDeviceState struct {
+	metrics  SNMPDeviceMetrics
+	counters map[string]snmpCounters // by ifIndex
+	polled   bool
+}
+
+// snmpPoller polls the --snmp-file devices
+type snmpPoller struct {
+	devices []SNMPDevice
+	timeout time.Duration
+
+	mu     sync.Mutex
+	states map[string]*snmpDeviceState
+}
+
+func newSNMPPoller(devices []SNMPDevice, timeout time.Duration) *snmpPoller {
+	p := &snmpPoller{devices: devices, timeout: timeout, states: make(map[string]*snmpDeviceState, len(devices))}
+	for _, d := range devices {
+		p.states[d.Name] = &snmpDeviceState{counters: make(map[string]snmpCounters)}
+	}
+	return p
+}
+
+// snmpWalk is what one poll of a device returned: scalars by OID and table
+// columns by OID, then row index
+type snmpWalk struct {
+	scalars map[string]gosnmp.SnmpPDU
+	columns map[string]map[string]gosnmp.SnmpPDU
+}
+
+// query polls one device
+func (p *snmpPoller) query(ctx context.Context, d *SNMPDevice) (snmpWalk, error) {
+	g := d.client(p.timeout)
+	g.Context = ctx
+	if err := g.Connect(); err != nil {
+		return snmpWalk{}, err
+	}
+	defer g.Conn.Close()
+
+	walk := snmpWalk{scalars: make(map[string]gosnmp.SnmpPDU), columns: make(map[string]map[string]gosnmp.SnmpPDU)}
+	packet, err := g.Get([]string{oidSysName, oidSysUpTime, oidUPSBatteryStatus, oidUPSMinutesRemaining, oidUPSChargeRemaining, oidUPSOutputSource})
+	if err != nil {
+		return walk, err
+	}
+	for _, pdu := range packet.Variables {
+		walk.scalars[pdu.Name] = pdu
+	}
+
+	for _, column := range []string{oidIfDescr, oidIfName, oidIfAdminStatus, oidIfOperStatus, oidIfInErrors,
+		oidIfOutErrors, oidIfHCInOctets, oidIfHCOutOctets, oidIfHighSpeed, oidHrProcessorLoad} {
+		pdus, err := g.BulkWalkAll(column)
+		if err != nil {
+			return walk, fmt.Errorf("walk %s: %w", column, err)
+		}
+		rows := make(map[string]gosnmp.SnmpPDU, len(pdus))
+		for _, pdu := range pdus {
+			rows[strings.TrimPrefix(pdu.Name, column+".")] = pdu
+		}
+		walk.columns[column] = rows
+	}
+	return walk, nil
+}
+
+// snmpValue returns a PDU's value as a number and whether the device had it
+func snmpValue(pdu gosnmp.SnmpPDU) (uint64, bool) {
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		return 0, false
+	}
+	return gosnmp.ToBigInt(pdu.Value).Uint64(), true
+}
+
+// snmpString returns a PDU's value as a string
+func snmpString(pdu gosnmp.SnmpPDU) string {
+	if b, ok := pdu.Value.([]byte); ok {
+		return string(b)
+	}
+	if s, ok := pdu.Value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// record turns a poll of a device into its metrics, with interface rates
+// against the previous poll
+func (p *snmpPoller) record(d *SNMPDevice, at time.Time, walk snmpWalk, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.states[d.Name]
+	m := &state.metrics
+	previous := m.polledAt
+	*m = SNMPDeviceMetrics{Name: d.Name, Host: d.Host, SysName: m.SysName, polledAt: at}
+	state.polled = true
+	if err != nil {
+		m.LastError = err.Error()
+		return
+	}
+	m.Up = true
+
+	if name := snmpString(walk.scalars[oidSysName]); name != "" {
+		m.SysName = name
+	}
+	if ticks, ok := snmpValue(walk.scalars[oidSysUpTime]); ok {
+		m.UptimeSeconds = float64(ticks) / 100
+	}
+	if status, ok := snmpValue(walk.scalars[oidUPSBatteryStatus]); ok {
+		source, _ := snmpValue(walk.scalars[oidUPSOutputSource])
+		minutes, _ := snmpValue(walk.scalars[oidUPSMinutesRemaining])
+		charge, _ := snmpValue(walk.scalars[oidUPSChargeRemaining])
+		m.UPS = &UPSMetrics{
+			OnBattery:        source == upsOutputBattery,
+			BatteryLow:       status == upsBatteryLow || status == upsBatteryDepleted,
+			ChargePercent:    float64(charge),
+			MinutesRemaining: float64(minutes),
+		}
+	}
+	if loads := walk.columns[oidHrProcessorLoad]; len(loads) > 0 {
+		var sum uint64
+		for _, pdu := range loads {
+			load, _ := snmpValue(pdu)
+			sum += load
+		}
+		m.CPUPercent = float64(sum) / float64(len(loads))
+	}
+
+	elapsed := at.Sub(previous).Seconds()
+	// Interfaces in ifIndex order
+	indexes := make([]string, 0, len(walk.columns[oidIfAdminStatus]))
+	for index := range walk.columns[oidIfAdminStatus] {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		a, _ := strconv.Atoi(indexes[i])
+		b, _ := strconv.Atoi(indexes[j])
+		return a < b
+	})
+
+	counters := make(map[string]snmpCounters, len(indexes))
+	for _, index := range indexes {
+		if admin, _ := snmpValue(walk.columns[oidIfAdminStatus][index]); admin != ifStatusUp {
+			continue
+		}
+		oper, _ := snmpValue(walk.columns[oidIfOperStatus][index])
+		now := snmpCounters{wasUp: oper == ifStatusUp}
+		now.inOctets, _ = snmpValue(walk.columns[oidIfHCInOctets][index])
+		now.outOctets, _ = snmpValue(walk.columns[oidIfHCOutOctets][index])
+		now.inErrors, _ = snmpValue(walk.columns[oidIfInErrors][index])
+		now.outErrors, _ = snmpValue(walk.columns[oidIfOutErrors][index])
+
+		iface := SNMPInterfaceMetrics{Name: snmpString(walk.columns[oidIfName][index]), Up: oper == ifStatusUp}
+		if iface.Name == "" {
+			iface.Name = snmpString(walk.columns[oidIfDescr][index])
+		}
+		if iface.Name == "" {
+			iface.Name = "if" + index
+		}
+		iface.SpeedMbps, _ = snmpValue(walk.columns[oidIfHighSpeed][index])
+
+		// Counters that went backwards were reset by a reboot or wrapped
+		if last, ok := state.counters[index]; ok {
+			now.wasUp = now.wasUp || last.wasUp
+			if elapsed > 0 && now.inOctets >= last.inOctets && now.outOctets >= last.outOctets {
+				iface.InBytesPerSec = float64(now.inOctets-last.inOctets) / elapsed
+				iface.OutBytesPerSec = float64(now.outOctets-last.outOctets) / elapsed
+			}
+			if now.inErrors >= last.inErrors && now.outErrors >= last.outErrors {
+				iface.InErrors = now.inErrors - last.inErrors
+				iface.OutErrors = now.outErrors - last.outErrors
+			}
+		}
+		iface.wasUp = now.wasUp
+		counters[index] = now
+		m.Interfaces = append(m.Interfaces, iface)
+	}
+	state.counters = counters
+}
+
+// runOnce polls every device concurrently
+func (p *snmpPoller) runOnce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range p.devices {
+		wg.Add(1)
+		go func(d *SNMPDevice) {
+			defer wg.Done()
+			defer reportPanic()
+			at := time.Now()
+			walk, err := p.query(ctx, d)
+			if ctx.Err() != nil {
+				return
+			}
+			p.record(d, at, walk, err)
+		}(&p.devices[i])
+	}
+	wg.Wait()
+}
+
+// snapshot returns the last metrics of devices polled at least once, in
+// --snmp-file order
+func (p *snmpPoller) snapshot() []SNMPDeviceMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var metrics []SNMPDeviceMetrics
+	for _, d := range p.devices {
+		if state := p.states[d.Name]; state.polled {
+			metrics = append(metrics, state.metrics)
+		}
+	}
+	return metrics
+}
+
+// runSNMP polls every device at start and then every --snmp-interval
+// seconds until ctx is done
+func (a *Agent) runSNMP(ctx context.Context) {
+	defer reportPanic()
+
+	ticker := time.NewTicker(time.Duration(a.config.SNMPInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		a.snmp.runOnce(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectSNMPMetrics returns the devices' last polls and raises
+// SNMP_UNREACHABLE:<device>, INTERFACE_DOWN:<device>/<interface> for
+// interfaces that were up before, UPS_ON_BATTERY:<device> and
+// UPS_BATTERY_LOW:<device>
+func (a *Agent) collectSNMPMetrics() []SNMPDeviceMetrics {
+	if a.snmp == nil {
+		return nil
+	}
+	defer a.selfMetrics.Detector("snmp").Since(time.Now())
+
+	metrics := a.snmp.snapshot()
+
+	a.alertMutex.Lock()
+	defer a.alertMutex.Unlock()
+	for _, m := range metrics {
+		if !m.Up {
+			alert := "SNMP_UNREACHABLE:" + m.Name
+			if a.raiseAlert(alert) {
+				log.Printf("SNMP device %s (%s) unreachable: %s", m.Name, m.Host, m.LastError)
+			}
+			a.alertStates[alert].Detail = fmt.Sprintf("%s did not answer: %s", m.Host, m.LastError)
+			continue
+		}
+		for _, iface := range m.Interfaces {
+			// Unused ports are never up and never alert
+			if iface.Up || !iface.wasUp {
+				continue
+			}
+			alert := "INTERFACE_DOWN:" + m.Name + "/" + iface.Name
+			if a.raiseAlert(alert) {
+				log.Printf("Interface %s of %s is down", iface.Name, m.Name)
+			}
+		}
+		if m.UPS == nil {
+			continue
+		}
+		detail := fmt.Sprintf("charge %.0f%%, %.0f minutes remaining", m.UPS.ChargePercent, m.UPS.MinutesRemaining)
+		if m.UPS.OnBattery {
+			alert := "UPS_ON_BATTERY:" + m.Name
+			if a.raiseAlert(alert) {
+				log.Printf("UPS %s is on battery: %s", m.Name, detail)
+			}
+			a.alertStates[alert].Detail = detail
+		}
+		if m.UPS.BatteryLow {
+			alert := "UPS_BATTERY_LOW:" + m.Name
+			if a.raiseAlert(alert) {
+				log.Printf("UPS %s battery is low: %s", m.Name, detail)
+			}
+			a.alertStates[alert].Detail = detail
+		}
+	}
+	return metrics
+}
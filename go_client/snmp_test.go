@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// writeSNMPFile writes an --snmp-file to a temporary file
+func writeSNMPFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snmp.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadSNMPDevices tests defaults and rejected device definitions
+func TestLoadSNMPDevices(t *testing.T) {
+	devices, err := loadSNMPDevices(writeSNMPFile(t, `{"devices": [
+		{"host": "10.0.0.2"},
+		{"name": "ups-a", "host": "10.0.0.9", "port": 1161, "version": "3", "user": "monitor",
+		 "auth_protocol": "SHA256", "auth_password": "authpass1", "priv_protocol": "aes", "priv_password": "privpass1"}
+	]}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := devices[0]; d.Name != "10.0.0.2" || d.Port != 161 || d.Version != "2c" || d.Community != "public" {
+		t.Errorf("Unexpected defaults %+v", d)
+	}
+	g := devices[1].client(time.Second)
+	params := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if g.Version != gosnmp.Version3 || g.MsgFlags != gosnmp.AuthPriv || params.AuthenticationProtocol != gosnmp.SHA256 ||
+		params.PrivacyProtocol != gosnmp.AES || g.Port != 1161 {
+		t.Errorf("Unexpected v3 client %+v %+v", g, params)
+	}
+
+	for content, want := range map[string]string{
+		`{"devices": [{"name": "x"}]}`:                                                                             "host is required",
+		`{"devices": [{"host": "a"}, {"host": "a"}]}`:                                                              "duplicate name",
+		`{"devices": [{"host": "a", "version": "1"}]}`:                                                             "unknown version",
+		`{"devices": [{"host": "a", "version": "3"}]}`:                                                             "needs a user",
+		`{"devices": [{"host": "a", "version": "3", "user": "u", "priv_password": "p"}]}`:                          "privacy needs authentication",
+		`{"devices": [{"host": "a", "version": "3", "user": "u", "auth_protocol": "sha1", "auth_password": "p"}]}`: "unknown auth protocol",
+	} {
+		if _, err := loadSNMPDevices(writeSNMPFile(t, content), false); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s to fail with %q, got %v", content, want, err)
+		}
+	}
+	md5 := `{"devices": [{"host": "a", "version": "3", "user": "u", "auth_protocol": "md5", "auth_password": "p"}]}`
+	if _, err := loadSNMPDevices(writeSNMPFile(t, md5), true); err == nil || !strings.Contains(err.Error(), "FIPS") {
+		t.Errorf("Expected MD5 to be refused in FIPS mode, got %v", err)
+	}
+}
+
+// snmpTestWalk builds a poll result with one interface per entry of octets
+// (in, out); ifIndex 3 is administratively down
+func snmpTestWalk(operUp []bool, octets [][2]uint64) snmpWalk {
+	walk := snmpWalk{
+		scalars: map[string]gosnmp.SnmpPDU{
+			oidSysName:   {Name: oidSysName, Type: gosnmp.OctetString, Value: []byte("core-sw1")},
+			oidSysUpTime: {Name: oidSysUpTime, Type: gosnmp.TimeTicks, Value: uint32(123400)},
+			// A switch answers noSuchObject for the UPS-MIB
+			oidUPSBatteryStatus: {Name: oidUPSBatteryStatus, Type: gosnmp.NoSuchObject},
+		},
+		columns: make(map[string]map[string]gosnmp.SnmpPDU),
+	}
+	set := func(column, index string, pdu gosnmp.SnmpPDU) {
+		if walk.columns[column] == nil {
+			walk.columns[column] = make(map[string]gosnmp.SnmpPDU)
+		}
+		walk.columns[column][index] = pdu
+	}
+	for i := range octets {
+		index := []string{"10", "2", "3"}[i]
+		oper := 2
+		if operUp[i] {
+			oper = ifStatusUp
+		}
+		admin := ifStatusUp
+		if index == "3" {
+			admin = 2
+		}
+		set(oidIfName, index, gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("Gi0/" + index)})
+		set(oidIfAdminStatus, index, gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: admin})
+		set(oidIfOperStatus, index, gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: oper})
+		set(oidIfHCInOctets, index, gosnmp.SnmpPDU{Type: gosnmp.Counter64, Value: octets[i][0]})
+		set(oidIfHCOutOctets, index, gosnmp.SnmpPDU{Type: gosnmp.Counter64, Value: octets[i][1]})
+		set(oidIfInErrors, index, gosnmp.SnmpPDU{Type: gosnmp.Counter32, Value: uint(octets[i][0] / 1000)})
+		set(oidIfOutErrors, index, gosnmp.SnmpPDU{Type: gosnmp.Counter32, Value: uint(0)})
+		set(oidIfHighSpeed, index, gosnmp.SnmpPDU{Type: gosnmp.Gauge32, Value: uint(1000)})
+	}
+	set(oidHrProcessorLoad, "1", gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 20})
+	set(oidHrProcessorLoad, "2", gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 40})
+	return walk
+}
+
+// TestSNMPInterfaceRates tests interface rates, ordering and the
+// INTERFACE_DOWN alert for interfaces that were up before
+func TestSNMPInterfaceRates(t *testing.T) {
+	agent, err := NewAgent(Config{SNMPFile: writeSNMPFile(t, `{"devices": [{"name": "core", "host": "10.0.0.2"}]}`), SNMPInterval: 60})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	devices := agent.snmp.devices
+
+	start := time.Now()
+	agent.snmp.record(&devices[0], start, snmpTestWalk([]bool{true, false, false}, [][2]uint64{{1000, 500}, {0, 0}, {0, 0}}), nil)
+	metrics := agent.collectSNMPMetrics()
+	if len(metrics) != 1 || metrics[0].SysName != "core-sw1" || metrics[0].UptimeSeconds != 1234 || metrics[0].CPUPercent != 30 || metrics[0].UPS != nil {
+		t.Fatalf("Unexpected device metrics %+v", metrics)
+	}
+	if ifaces := metrics[0].Interfaces; len(ifaces) != 2 || ifaces[0].Name != "Gi0/2" || ifaces[1].Name != "Gi0/10" || ifaces[1].InBytesPerSec != 0 {
+		t.Errorf("Expected the two admin-up interfaces in ifIndex order without rates, got %+v", ifaces)
+	}
+	if len(agent.localAlerts) != 0 {
+		t.Errorf("Expected no alert for a port that was never up, got %v", agent.localAlerts)
+	}
+
+	agent.snmp.record(&devices[0], start.Add(10*time.Second), snmpTestWalk([]bool{false, false, false}, [][2]uint64{{11000, 2500}, {0, 0}, {0, 0}}), nil)
+	metrics = agent.collectSNMPMetrics()
+	gi10 := metrics[0].Interfaces[1]
+	if gi10.InBytesPerSec != 1000 || gi10.OutBytesPerSec != 200 || gi10.InErrors != 10 {
+		t.Errorf("Expected rates against the previous poll, got %+v", gi10)
+	}
+	if strings.Join(agent.localAlerts, ",") != "INTERFACE_DOWN:core/Gi0/10" {
+		t.Errorf("Expected INTERFACE_DOWN for the port that went down, got %v", agent.localAlerts)
+	}
+
+	// Counters that went backwards give no rate
+	agent.snmp.record(&devices[0], start.Add(20*time.Second), snmpTestWalk([]bool{true, false, false}, [][2]uint64{{10, 10}, {0, 0}, {0, 0}}), nil)
+	if gi10 := agent.collectSNMPMetrics()[0].Interfaces[1]; gi10.InBytesPerSec != 0 || gi10.InErrors != 0 {
+		t.Errorf("Expected no rate after a counter reset, got %+v", gi10)
+	}
+}
+
+// TestSNMPUPSAlerts tests UPS-MIB readings and the UPS and unreachable alerts
+func TestSNMPUPSAlerts(t *testing.T) {
+	agent, err := NewAgent(Config{SNMPFile: writeSNMPFile(t, `{"devices": [
+		{"name": "ups-a", "host": "10.0.0.9"}, {"name": "fw", "host": "10.0.0.1"}
+	]}`), SNMPInterval: 60})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	devices := agent.snmp.devices
+
+	walk := snmpWalk{scalars: map[string]gosnmp.SnmpPDU{
+		oidUPSBatteryStatus:    {Type: gosnmp.Integer, Value: upsBatteryLow},
+		oidUPSOutputSource:     {Type: gosnmp.Integer, Value: upsOutputBattery},
+		oidUPSChargeRemaining:  {Type: gosnmp.Integer, Value: 18},
+		oidUPSMinutesRemaining: {Type: gosnmp.Integer, Value: 4},
+	}}
+	agent.snmp.record(&devices[0], time.Now(), walk, nil)
+	agent.snmp.record(&devices[1], time.Now(), snmpWalk{}, context.DeadlineExceeded)
+
+	metrics := agent.collectSNMPMetrics()
+	if ups := metrics[0].UPS; ups == nil || !ups.OnBattery || !ups.BatteryLow || ups.ChargePercent != 18 {
+		t.Errorf("Unexpected UPS metrics %+v", metrics[0].UPS)
+	}
+	if metrics[1].Up || metrics[1].LastError == "" {
+		t.Errorf("Expected the firewall to be down, got %+v", metrics[1])
+	}
+	for _, alert := range []string{"UPS_ON_BATTERY:ups-a", "UPS_BATTERY_LOW:ups-a", "SNMP_UNREACHABLE:fw"} {
+		if _, ok := agent.alertStates[alert]; !ok {
+			t.Errorf("Expected %s, got %v", alert, agent.localAlerts)
+		}
+	}
+	if detail := agent.alertStates["UPS_ON_BATTERY:ups-a"].Detail; detail != "charge 18%, 4 minutes remaining" {
+		t.Errorf("Unexpected detail %q", detail)
+	}
+}
+
+// TestSNMPPollUnreachable tests that a device that does not answer is
+// recorded as down
+func TestSNMPPollUnreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	devices := []SNMPDevice{{Name: "silent", Host: "127.0.0.1", Port: port, Version: "2c", Community: "public"}}
+	poller := newSNMPPoller(devices, 100*time.Millisecond)
+	poller.runOnce(context.Background())
+	metrics := poller.snapshot()
+	if len(metrics) != 1 || metrics[0].Up || metrics[0].LastError == "" {
+		t.Errorf("Expected the silent device to be down, got %+v", metrics)
+	}
+}
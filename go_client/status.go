@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// AgentStatus is what status reads from a running agent. Queue and alert
+// details come from the admin API and are left out without a token.
+type AgentStatus struct {
+	Addr    string        `json:"addr"`
+	Health  HealthStatus  `json:"health"`
+	Metrics MetricsStatus `json:"metrics"`
+	Queue   *QueueSummary `json:"queue,omitempty"`
+	Alerts  []AlertState  `json:"alerts,omitempty"`
+	Errors  []string      `json:"errors,omitempty"`
+}
+
+// fetchStatus reads a running agent's health and metrics, and with an admin
+// token its queue and alerts. Only an unreachable health endpoint fails.
+func fetchStatus(client *topClient, addr string) (AgentStatus, error) {
+	status := AgentStatus{Addr: addr}
+	if err := client.get("/healthz", &status.Health); err != nil {
+		return status, fmt.Errorf("agent unreachable at %s: %w", addr, err)
+	}
+	if err := client.get("/metrics", &status.Metrics); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	}
+	if client.token == "" {
+		return status, nil
+	}
+
+	var queue QueueSummary
+	if err := client.get("/admin/queue", &queue); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	} else {
+		status.Queue = &queue
+	}
+	if err := client.get("/admin/alerts", &status.Alerts); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	}
+	return status, nil
+}
+
+// writeStatus prints a short summary of a running agent
+func writeStatus(w io.Writer, status AgentStatus, now time.Time) {
+	agent := status.Metrics.Agent
+	fmt.Fprintf(w, "Agent at %s: up %s, last send %s\n", status.Addr,
+		time.Duration(status.Health.UptimeSeconds)*time.Second, sinceLabel(status.Health.LastSendOK, now))
+	fmt.Fprintf(w, "CPU %.1f%%  Memory %.1f%%  Goroutines %d  Heap %.1f MiB\n",
+		status.Metrics.CPU, status.Metrics.Memory, agent.Goroutines, float64(agent.HeapBytes)/(1<<20))
+
+	send := fmt.Sprintf("Send: %d ok, %d failed, %d retries", agent.Send.Successes, agent.Send.Failures, agent.Send.Retries)
+	if agent.Send.Server != "" {
+		send += fmt.Sprintf(", to %s (%d failover(s))", agent.Send.Server, agent.Send.Failovers)
+	}
+	fmt.Fprintln(w, send)
+
+	if q := status.Queue; q != nil {
+		fmt.Fprintf(w, "Queue: %d/%d in memory, %d file(s) %d bytes on disk", q.Length, q.Limit, len(q.DiskFiles), q.TotalBytes)
+		if !q.Oldest.IsZero() {
+			fmt.Fprintf(w, ", oldest collected %s", sinceLabel(q.Oldest, now))
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintf(w, "Queue: %d payload(s)\n", status.Health.QueueLength)
+	}
+
+	if status.Alerts != nil {
+		alerts := make([]string, 0, len(status.Alerts))
+		for _, alert := range status.Alerts {
+			alerts = append(alerts, fmt.Sprintf("%s (%s, seen %s)", alert.Alert, alert.State, sinceLabel(alert.LastSeen, now)))
+		}
+		fmt.Fprintf(w, "Alerts: %d %s\n", len(alerts), strings.Join(alerts, ", "))
+	} else if len(status.Metrics.LocalAlerts) > 0 {
+		fmt.Fprintf(w, "Alerts: %s\n", strings.Join(status.Metrics.LocalAlerts, ", "))
+	}
+
+	for _, err := range status.Errors {
+		fmt.Fprintf(w, "warning: %s\n", err)
+	}
+}
+
+func cmdStatus(args []string) error {
+	fs := newFlagSet("status", "status [--addr ADDR] [--admin-token TOKEN] [--json]")
+	addr := fs.String("addr", defaultAgentAddr(), "Agent health server address (host:port, https:// URL or unix:/path; default HEALTH_ADDR)")
+	token := fs.String("admin-token", getenv("ADMIN_TOKEN"), "Admin API bearer token, adds queue and alert details (ADMIN_TOKEN)")
+	caFile := fs.String("ca-file", "", "CA bundle for a TLS health server")
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newTopClient(*addr, *token, *caFile)
+	if err != nil {
+		return err
+	}
+	status, err := fetchStatus(client, *addr)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	writeStatus(os.Stdout, status, time.Now())
+	return nil
+}
+
+// flushRemoteQueue asks a running agent to deliver its queued payloads now
+func flushRemoteQueue(w io.Writer, client *topClient) error {
+	var result QueueFlushResult
+	if err := client.post("/admin/queue/flush", &result); err != nil {
+		return fmt.Errorf("failed to flush queue: %w", err)
+	}
+	fmt.Fprintf(w, "%d payload(s) sent, %d still queued\n", result.Sent, result.Remaining)
+	if result.Error != "" {
+		return fmt.Errorf("flush stopped: %s", result.Error)
+	}
+	return nil
+}
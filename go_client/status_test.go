@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatusAndQueueFlush tests reading a running agent's status and having
+// it deliver its queue through the admin API
+func TestStatusAndQueueFlush(t *testing.T) {
+	defer func(old string) { queueDir = old }(queueDir)
+	queueDir = t.TempDir()
+	server := newBackfillServer(t)
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := NewAgent(Config{ServerURL: server.URL, Secret: "s3cret", HealthAddr: "unix:" + socketPath, AdminToken: "admin-secret"})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	defer agent.healthServer.Close()
+	for i := 0; i < 3; i++ {
+		agent.enqueuePayload(Payload{ID: newUUID(), Timestamp: time.Now().Add(-time.Hour)})
+	}
+
+	client, err := newTopClient("unix:"+socketPath, "admin-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := fetchStatus(client, "unix:"+socketPath)
+	if err != nil || len(status.Errors) > 0 {
+		t.Fatalf("Unexpected status errors: %v %v", err, status.Errors)
+	}
+	var out bytes.Buffer
+	writeStatus(&out, status, time.Now())
+	if !strings.Contains(out.String(), "Queue: 3/") || !strings.Contains(out.String(), "oldest collected 1h") {
+		t.Errorf("Unexpected status:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := flushRemoteQueue(&out, client); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "3 payload(s) sent, 0 still queued\n" || len(server.received()) != 3 || agent.queueLength() != 0 {
+		t.Errorf("Expected the whole queue delivered, got %q and %d received", out.String(), len(server.received()))
+	}
+
+	readOnly, _ := newTopClient("unix:"+socketPath, "", "")
+	if err := flushRemoteQueue(&out, readOnly); err == nil {
+		t.Error("Expected flush to require the admin token")
+	}
+	if _, err := client.fetch("/admin/queue/flush"); err == nil {
+		t.Error("Expected flush to reject GET")
+	}
+	unreachable, _ := newTopClient("unix:"+filepath.Join(t.TempDir(), "none.sock"), "", "")
+	if _, err := fetchStatus(unreachable, "none"); err == nil {
+		t.Error("Expected an unreachable agent to fail status")
+	}
+}
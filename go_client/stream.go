@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Methods of the AgentStream service in proto/agent_stream.proto
+const (
+	methodStreamPayloads = "/richardops.agent.v1.AgentStream/StreamPayloads"
+	methodPushCommands   = "/richardops.agent.v1.AgentStream/PushCommands"
+	methodAckStream      = "/richardops.agent.v1.AgentStream/AckStream"
+)
+
+// PayloadAck statuses besides those of HTTP acks: a payload the server
+// refused, and one it was too busy to take, which stays queued
+const (
+	AckRejected  = "rejected"
+	AckThrottled = "throttled"
+)
+
+// errServerThrottled is returned while the server asked for no payloads and
+// for payloads it was too busy to take. Retrying right away would only be
+// throttled again, so such payloads are queued instead.
+var errServerThrottled = errors.New("payload throttled by the server")
+
+// Command result statuses
+const (
+	CommandOK          = "ok"
+	CommandFailed      = "failed"
+	CommandUnsupported = "unsupported"
+	CommandRejected    = "rejected"
+)
+
+const (
+	// How long a streamed payload waits for its ack before the stream is reopened
+	streamAckTimeout = 30 * time.Second
+	// Longest wait between attempts to resubscribe to commands
+	maxCommandBackoff = time.Minute
+	// Longest pause a server can ask for with throttle_ms
+	maxStreamThrottle = 5 * time.Minute
+)
+
+// PayloadFrame carries one signed payload on StreamPayloads
+type PayloadFrame struct {
+	PayloadID string
+	KeyID     string
+	Timestamp string
+	Signature string
+	Body      []byte
+}
+
+// PayloadAck answers a PayloadFrame
+type PayloadAck struct {
+	PayloadID  string
+	Status     string
+	Signature  string
+	Error      string
+	ThrottleMS uint32
+}
+
+// CommandSubscription opens PushCommands for an agent
+type CommandSubscription struct {
+	ServerID  string
+	KeyID     string
+	Timestamp string
+	Signature string
+}
+
+// Command is a remote command pushed by the server. Settings is the JSON
+// object of a set_config command.
+type Command struct {
+	ID        string
+	Name      string
+	Signature string
+	Settings  string
+}
+
+// CommandResult reports the outcome of a Command on AckStream
+type CommandResult struct {
+	CommandID string
+	KeyID     string
+	Status    string
+	Output    string
+	Signature string
+}
+
+// CommandResultsReceived closes AckStream
+type CommandResultsReceived struct {
+	Count uint32
+}
+
+// wireMessage is a message of agent_stream.proto. They are encoded by hand
+// with protowire, which keeps protoc out of the build.
+type wireMessage interface {
+	marshalWire() []byte
+	unmarshalWire([]byte) error
+}
+
+// wireCodec is the gRPC codec for wireMessages. It is named "proto" since
+// the encoding is standard protobuf, so generated clients and servers
+// interoperate with it.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("cannot decode into %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+func (wireCodec) Name() string { return "proto" }
+
+// appendWireString appends a length-delimited field, omitted when empty as in proto3
+func appendWireString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consumeWire calls field for each length-delimited field and varint for
+// each varint field in b, skipping fields of other types
+func consumeWire(b []byte, field func(protowire.Number, []byte), varint func(protowire.Number, uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case typ == protowire.BytesType && field != nil:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, v)
+			b = b[n:]
+		case typ == protowire.VarintType && varint != nil:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			varint(num, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (m *PayloadFrame) marshalWire() []byte {
+	b := appendWireString(nil, 1, m.PayloadID)
+	b = appendWireString(b, 2, m.KeyID)
+	b = appendWireString(b, 3, m.Timestamp)
+	b = appendWireString(b, 4, m.Signature)
+	if len(m.Body) > 0 {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Body)
+	}
+	return b
+}
+
+func (m *PayloadFrame) unmarshalWire(b []byte) error {
+	return consumeWire(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.PayloadID = string(v)
+		case 2:
+			m.KeyID = string(v)
+		case 3:
+			m.Timestamp = string(v)
+		case 4:
+			m.Signature = string(v)
+		case 5:
+			m.Body = append([]byte(nil), v...)
+		}
+	}, nil)
+}
+
+func (m *PayloadAck) marshalWire() []byte {
+	b := appendWireString(nil, 1, m.PayloadID)
+	b = appendWireString(b, 2, m.Status)
+	b = appendWireString(b, 3, m.Signature)
+	b = appendWireString(b, 4, m.Error)
+	if m.ThrottleMS > 0 {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ThrottleMS))
+	}
+	return b
+}
+
+func (m *PayloadAck) unmarshalWire(b []byte) error {
+	return consumeWire(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.PayloadID = string(v)
+		case 2:
+			m.Status = string(v)
+		case 3:
+			m.Signature = string(v)
+		case 4:
+			m.Error = string(v)
+		}
+	}, func(num protowire.Number, v uint64) {
+		if num == 5 {
+			m.ThrottleMS = uint32(v)
+		}
+	})
+}
+
+func (m *CommandSubscription) marshalWire() []byte {
+	b := appendWireString(nil, 1, m.ServerID)
+	b = appendWireString(b, 2, m.KeyID)
+	b = appendWireString(b, 3, m.Timestamp)
+	return appendWireString(b, 4, m.Signature)
+}
+
+func (m *CommandSubscription) unmarshalWire(b []byte) error {
+	return consumeWire(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.ServerID = string(v)
+		case 2:
+			m.KeyID = string(v)
+		case 3:
+			m.Timestamp = string(v)
+		case 4:
+			m.Signature = string(v)
+		}
+	}, nil)
+}
+
+func (m *Command) marshalWire() []byte {
+	b := appendWireString(nil, 1, m.ID)
+	b = appendWireString(b, 2, m.Name)
+	b = appendWireString(b, 3, m.Signature)
+	return appendWireString(b, 4, m.Settings)
+}
+
+func (m *Command) unmarshalWire(b []byte) error {
+	return consumeWire(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.ID = string(v)
+		case 2:
+			m.Name = string(v)
+		case 3:
+			m.Signature = string(v)
+		case 4:
+			m.Settings = string(v)
+		}
+	}, nil)
+}
+
+func (m *CommandResult) marshalWire() []byte {
+	b := appendWireString(nil, 1, m.CommandID)
+	b = appendWireString(b, 2, m.KeyID)
+	b = appendWireString(b, 3, m.Status)
+	b = appendWireString(b, 4, m.Output)
+	return appendWireString(b, 5, m.Signature)
+}
+
+func (m *CommandResult) unmarshalWire(b []byte) error {
+	return consumeWire(b, func(num protowire.Number, v []byte) {
+		switch num {
+		case 1:
+			m.CommandID = string(v)
+		case 2:
+			m.KeyID = string(v)
+		case 3:
+			m.Status = string(v)
+		case 4:
+			m.Output = string(v)
+		case 5:
+			m.Signature = string(v)
+		}
+	}, nil)
+}
+
+func (m *CommandResultsReceived) marshalWire() []byte {
+	if m.Count == 0 {
+		return nil
+	}
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(m.Count))
+}
+
+func (m *CommandResultsReceived) unmarshalWire(b []byte) error {
+	return consumeWire(b, nil, func(num protowire.Number, v uint64) {
+		if num == 1 {
+			m.Count = uint32(v)
+		}
+	})
+}
+
+// agentStreamServer is implemented by servers of the AgentStream service
+type agentStreamServer interface {
+	StreamPayloads(grpc.ServerStream) error
+	PushCommands(grpc.ServerStream) error
+	AckStream(grpc.ServerStream) error
+}
+
+// agentStreamDesc describes the AgentStream service, as protoc would generate it
+var agentStreamDesc = grpc.ServiceDesc{
+	ServiceName: "richardops.agent.v1.AgentStream",
+	HandlerType: (*agentStreamServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamPayloads",
+			Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(agentStreamServer).StreamPayloads(stream) },
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PushCommands",
+			Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(agentStreamServer).PushCommands(stream) },
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "AckStream",
+			Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(agentStreamServer).AckStream(stream) },
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/agent_stream.proto",
+}
+
+// commandSignature signs a pushed command: "command.<id>.<name>", followed
+// by ".<settings>" when it has settings
+func commandSignature(secret, id, name, settings string) string {
+	if settings == "" {
+		return signFields(secret, "command", id, name)
+	}
+	return signFields(secret, "command", id, name, settings)
+}
+
+// resultSignature signs a command result: "result.<command_id>.<status>.<output>"
+func resultSignature(secret, commandID, status, output string) string {
+	return signFields(secret, "result", commandID, status, output)
+}
+
+// streamClient is the agent's gRPC transport (--grpc-addr). Payloads go out
+// one at a time on a StreamPayloads stream that is reopened after an error,
+// so the HTTP retry and queueing logic applies unchanged.
+type streamClient struct {
+	agent *Agent
+	conn  *grpc.ClientConn
+
+	mu       sync.Mutex // serializes deliveries
+	payloads grpc.ClientStream
+	cancel   context.CancelFunc
+	// Until when the server asked for no payloads (throttle_ms)
+	pausedUntil time.Time
+
+	resultsMu     sync.Mutex
+	results       grpc.ClientStream
+	resultsCancel context.CancelFunc
+}
+
+// newStreamClient prepares the connection to --grpc-addr; it is dialed on first use
+func newStreamClient(a *Agent) (*streamClient, error) {
+	creds := insecure.NewCredentials()
+	if !a.config.GRPCInsecure {
+		tlsConfig, err := serverTLSConfig(a.config)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	options := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{})),
+	}
+	target := a.config.GRPCAddr
+	if a.config.ProxyURL != "" {
+		// gRPC only follows HTTPS_PROXY by itself. The name is passed through
+		// so the proxy resolves it, like it does for HTTPS_PROXY.
+		dialer, err := proxyDialer(a.config)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.WithContextDialer(dialer))
+		if !strings.Contains(target, "://") {
+			target = "passthrough:///" + target
+		}
+	}
+	conn, err := grpc.NewClient(target, options...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gRPC address %q: %w", a.config.GRPCAddr, err)
+	}
+	return &streamClient{agent: a, conn: conn}, nil
+}
+
+// deliver sends an encoded payload, signed over signedAt, and waits for its ack
+func (s *streamClient) deliver(payloadBytes []byte, id string, signedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A paused payload is queued and backfilled once the pause is over
+	if wait := time.Until(s.pausedUntil); wait > 0 {
+		return fmt.Errorf("%w, paused for another %v", errServerThrottled, wait.Round(time.Millisecond))
+	}
+
+	if s.payloads == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := s.conn.NewStream(ctx, &agentStreamDesc.Streams[0], methodStreamPayloads)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.payloads, s.cancel = stream, cancel
+	}
+
+	frame := &PayloadFrame{
+		PayloadID: id,
+		KeyID:     s.agent.config.KeyID,
+		Timestamp: strconv.FormatInt(signedAt.Unix(), 10),
+		Signature: "sha256=" + s.agent.signPayload(payloadBytes, signedAt),
+		Body:      payloadBytes,
+	}
+	if err := s.payloads.SendMsg(frame); err != nil {
+		s.resetPayloads()
+		return err
+	}
+
+	ack := new(PayloadAck)
+	received := make(chan error, 1)
+	go func(stream grpc.ClientStream) { received <- stream.RecvMsg(ack) }(s.payloads)
+	select {
+	case err := <-received:
+		if err != nil {
+			s.resetPayloads()
+			return err
+		}
+	case <-time.After(streamAckTimeout):
+		// A late ack would be taken for the next payload's, so start over
+		s.resetPayloads()
+		return fmt.Errorf("no ack within %v", streamAckTimeout)
+	}
+
+	if ack.ThrottleMS > 0 {
+		pause := min(time.Duration(ack.ThrottleMS)*time.Millisecond, maxStreamThrottle)
+		s.pausedUntil = time.Now().Add(pause)
+		if s.agent.selfMetrics != nil {
+			s.agent.selfMetrics.ServerThrottles.Add(1)
+		}
+		log.Printf("Server asked to pause payloads for %v", pause)
+	}
+	switch ack.Status {
+	case AckRejected:
+		return fmt.Errorf("server rejected payload: %s", ack.Error)
+	case AckThrottled:
+		return fmt.Errorf("%w, server too busy: %s", errServerThrottled, ack.Error)
+	}
+	return s.agent.checkAck(&Ack{PayloadID: ack.PayloadID, Status: ack.Status, Signature: ack.Signature}, id)
+}
+
+// resetPayloads drops the payload stream; the next delivery opens a new one.
+// Must be called with mu held.
+func (s *streamClient) resetPayloads() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.payloads, s.cancel = nil, nil
+}
+
+// receiveCommands subscribes to PushCommands and passes verified commands to
+// commands until ctx is done, resubscribing with backoff when the stream ends
+func (s *streamClient) receiveCommands(ctx context.Context, commands chan<- Command) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := s.subscribe(ctx, commands)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxCommandBackoff {
+			backoff = time.Second
+		}
+		log.Printf("Command stream ended: %v (resubscribing in %v)", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxCommandBackoff)
+	}
+}
+
+// subscribe holds one PushCommands stream open
+func (s *streamClient) subscribe(ctx context.Context, commands chan<- Command) error {
+	stream, err := s.conn.NewStream(ctx, &agentStreamDesc.Streams[1], methodPushCommands, grpc.WaitForReady(true))
+	if err != nil {
+		return err
+	}
+
+	config := s.agent.config
+	now := time.Now()
+	subscription := &CommandSubscription{
+		ServerID:  config.ServerID,
+		KeyID:     config.KeyID,
+		Timestamp: strconv.FormatInt(now.Unix(), 10),
+		Signature: "sha256=" + s.agent.signPayload([]byte("commands."+config.ServerID), now),
+	}
+	if err := stream.SendMsg(subscription); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var command Command
+		if err := stream.RecvMsg(&command); err != nil {
+			return err
+		}
+		select {
+		case commands <- command:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// report sends a command result on AckStream, reopening it once if it broke
+func (s *streamClient) report(result *CommandResult) error {
+	s.resultsMu.Lock()
+	defer s.resultsMu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.results == nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			stream, openErr := s.conn.NewStream(ctx, &agentStreamDesc.Streams[2], methodAckStream)
+			if openErr != nil {
+				cancel()
+				return openErr
+			}
+			s.results, s.resultsCancel = stream, cancel
+		}
+		if err = s.results.SendMsg(result); err == nil {
+			return nil
+		}
+		s.resultsCancel()
+		s.results, s.resultsCancel = nil, nil
+	}
+	return err
+}
+
+// Close ends the streams and the connection
+func (s *streamClient) Close() error {
+	s.mu.Lock()
+	s.resetPayloads()
+	s.mu.Unlock()
+
+	s.resultsMu.Lock()
+	if s.results != nil {
+		s.results.CloseSend()
+		s.resultsCancel()
+		s.results, s.resultsCancel = nil, nil
+	}
+	s.resultsMu.Unlock()
+
+	return s.conn.Close()
+}
+
+// runCommand carries out a pushed command on the main loop, so it doesn't
+// race payload creation, and reports the result
+func (a *Agent) runCommand(command Command) {
+	status, output := CommandRejected, "invalid command signature"
+	expected := commandSignature(a.secret(), command.ID, command.Name, command.Settings)
+	if hmac.Equal([]byte(command.Signature), []byte(expected)) {
+		a.audit(AuditRemoteCommand, a.config.GRPCAddr, "%s (command %s)", command.Name, command.ID)
+		status, output = a.executeCommand(command)
+	} else {
+		a.audit(AuditRemoteCommand, a.config.GRPCAddr, "rejected %s (command %s): invalid signature", command.Name, command.ID)
+	}
+	log.Printf("Remote command %s %s: %s %s", command.Name, command.ID, status, output)
+
+	result := &CommandResult{
+		CommandID: command.ID,
+		KeyID:     a.config.KeyID,
+		Status:    status,
+		Output:    output,
+		Signature: resultSignature(a.secret(), command.ID, status, output),
+	}
+	if err := a.stream.report(result); err != nil {
+		log.Printf("Failed to report result of command %s: %v", command.ID, err)
+	}
+}
+
+// executeCommand runs one of the remote commands
+func (a *Agent) executeCommand(command Command) (status, output string) {
+	switch command.Name {
+	case "ping":
+		return CommandOK, "pong"
+
+	case "send":
+		payload, err := a.createPayload()
+		if err != nil {
+			return CommandFailed, err.Error()
+		}
+		if err := a.sendPayload(payload); err != nil {
+			return CommandFailed, err.Error()
+		}
+		return CommandOK, "sent payload " + payload.ID
+
+	case "flush_queue":
+		queued := a.queueLength()
+		for queued > 0 {
+			a.processQueue()
+			remaining := a.queueLength()
+			if remaining >= queued {
+				break
+			}
+			queued = remaining
+		}
+		if queued > 0 {
+			return CommandFailed, fmt.Sprintf("%d payloads still queued", queued)
+		}
+		return CommandOK, "queue empty"
+
+	case "set_config":
+		applied, err := a.applySettings(command.Settings)
+		if err != nil {
+			return CommandFailed, err.Error()
+		}
+		return CommandOK, applied
+
+	default:
+		return CommandUnsupported, "unknown command " + command.Name
+	}
+}
+
+// applySettings applies the settings of a set_config command, a JSON object
+// of flag names and values. Only --interval can be set so far; the pushed
+// value lasts until the agent restarts. Nothing is applied if any setting is
+// invalid.
+func (a *Agent) applySettings(settings string) (string, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(settings), &values); err != nil || len(values) == 0 {
+		return "", fmt.Errorf("settings must be a JSON object of flag names and values")
+	}
+	var interval int
+	for name, value := range values {
+		switch name {
+		case "interval":
+			if err := json.Unmarshal(value, &interval); err != nil || interval <= 0 {
+				return "", fmt.Errorf("--interval must be a positive number of seconds, got %s", value)
+			}
+		default:
+			return "", fmt.Errorf("--%s cannot be set remotely", name)
+		}
+	}
+
+	a.pushedInterval.Store(int64(interval))
+	a.audit(AuditConfigApplied, a.config.GRPCAddr, "interval %ds pushed by the server", interval)
+	return fmt.Sprintf("interval %ds", interval), nil
+}
+
+// sendInterval returns the time between payloads: --interval, unless the
+// server pushed another
+func (a *Agent) sendInterval() time.Duration {
+	if pushed := a.pushedInterval.Load(); pushed > 0 {
+		return time.Duration(pushed) * time.Second
+	}
+	return time.Duration(a.config.Interval) * time.Second
+}
+
+// queueLength returns the number of payloads queued in memory
+func (a *Agent) queueLength() int {
+	a.queueMutex.Lock()
+	defer a.queueMutex.Unlock()
+	return len(a.payloadQueue)
+}
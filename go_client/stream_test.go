@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// TestStreamTransport tests payload delivery, acks and a remote command over
+// the gRPC stream against the receiver's AgentStream server
+func TestStreamTransport(t *testing.T) {
+	var out strings.Builder
+	rv := &receiver{secret: "shared", maxSkew: time.Hour, commands: []string{"ping"}, out: &out}
+	output := func() string {
+		rv.mu.Lock()
+		defer rv.mu.Unlock()
+		return out.String()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	server.RegisterService(&agentStreamDesc, rv)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	newStreamAgent := func(secret string) *Agent {
+		agent := &Agent{
+			config:   Config{Secret: secret, ServerID: "srv-1", GRPCAddr: listener.Addr().String(), GRPCInsecure: true},
+			commands: make(chan Command),
+		}
+		stream, err := newStreamClient(agent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent.stream = stream
+		return agent
+	}
+	agent := newStreamAgent("shared")
+	defer agent.stream.Close()
+
+	for i := 0; i < 2; i++ {
+		payload := Payload{ID: newUUID(), Host: "web-01", Timestamp: time.Now()}
+		if err := agent.postPayload(payload); err != nil {
+			t.Fatalf("Expected streamed payload %d to be acknowledged: %v", i, err)
+		}
+		if !strings.Contains(output(), "payload "+payload.ID+" from web-01") {
+			t.Errorf("Expected streamed payload to be printed, got:\n%s", output())
+		}
+	}
+
+	wrong := newStreamAgent("other")
+	defer wrong.stream.Close()
+	if err := wrong.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Expected wrong secret to be rejected, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.stream.receiveCommands(ctx, agent.commands)
+	select {
+	case command := <-agent.commands:
+		agent.runCommand(command)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a pushed command, got:\n%s", output())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output(), ": ok pong") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(output(), "agent srv-1 subscribed") || !strings.Contains(output(), ": ok pong") {
+		t.Errorf("Expected the ping command to be answered, got:\n%s", output())
+	}
+
+	// A command not signed by the server is refused
+	forged := Command{ID: "c1", Name: "send", Signature: commandSignature("other", "c1", "send", "")}
+	agent.runCommand(forged)
+	for !strings.Contains(output(), "c1: rejected") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(output(), "c1: rejected") {
+		t.Errorf("Expected a forged command to be rejected, got:\n%s", output())
+	}
+}
+
+// TestSetConfigCommand tests --interval pushed by the server, settings
+// covered by the command signature, and invalid settings left unapplied
+func TestSetConfigCommand(t *testing.T) {
+	agent := &Agent{config: Config{Interval: 30}}
+	if status, output := agent.executeCommand(Command{Name: "set_config", Settings: `{"interval":60}`}); status != CommandOK || agent.sendInterval() != time.Minute {
+		t.Errorf("Expected the pushed interval applied, got %s %s (%v)", status, output, agent.sendInterval())
+	}
+	for _, settings := range []string{"", "[60]", `{"interval":0}`, `{"interval":"5"}`, `{"interval":5,"secret":"x"}`} {
+		if status, _ := agent.executeCommand(Command{Name: "set_config", Settings: settings}); status != CommandFailed || agent.sendInterval() != time.Minute {
+			t.Errorf("Expected settings %q refused, got %s (%v)", settings, status, agent.sendInterval())
+		}
+	}
+
+	if commandSignature("shared", "c1", "set_config", `{"interval":60}`) == commandSignature("shared", "c1", "set_config", `{"interval":1}`) {
+		t.Error("Expected the signature to cover the settings")
+	}
+	var command Command
+	encoded := (&Command{ID: "c1", Name: "set_config", Settings: `{"interval":60}`}).marshalWire()
+	if err := command.unmarshalWire(encoded); err != nil || command.Settings != `{"interval":60}` {
+		t.Errorf("Expected settings to round-trip, got %+v: %v", command, err)
+	}
+}
+
+// TestStreamThrottle tests that an ack's throttle_ms pauses streamed
+// payloads, which fail like an unreachable server until the pause is over
+func TestStreamThrottle(t *testing.T) {
+	rv := &receiver{secret: "shared", maxSkew: time.Hour, throttle: 300, out: &strings.Builder{}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	server.RegisterService(&agentStreamDesc, rv)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	agent := &Agent{
+		config:      Config{Secret: "shared", GRPCAddr: listener.Addr().String(), GRPCInsecure: true},
+		selfMetrics: NewSelfMetrics(),
+		agentEvents: newEventRing(maxAgentEvents),
+	}
+	if agent.stream, err = newStreamClient(agent); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.stream.Close()
+
+	if err := agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Expected the first payload acknowledged: %v", err)
+	}
+	if err := agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err == nil || !strings.Contains(err.Error(), "pause") {
+		t.Errorf("Expected a payload during the pause to fail, got %v", err)
+	}
+	// It fails without the retry delays, which would hold up the payload loop
+	start := time.Now()
+	if err := agent.deliverPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); !errors.Is(err, errServerThrottled) || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Expected a throttled payload to fail at once, got %v after %v", err, time.Since(start))
+	}
+	time.Sleep(350 * time.Millisecond)
+	if err := agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err != nil {
+		t.Errorf("Expected payloads accepted after the pause: %v", err)
+	}
+	if throttles := agent.selfMetrics.Snapshot(false).Send.Throttles; throttles != 2 {
+		t.Errorf("Expected 2 throttling acks counted, got %d", throttles)
+	}
+
+	var ack PayloadAck
+	encoded := (&PayloadAck{PayloadID: "p1", Status: AckThrottled, ThrottleMS: 70000}).marshalWire()
+	if err := ack.unmarshalWire(encoded); err != nil || ack.Status != AckThrottled || ack.ThrottleMS != 70000 {
+		t.Errorf("Expected throttle_ms to round-trip, got %+v: %v", ack, err)
+	}
+}
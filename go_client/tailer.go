@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Interval of the fallback poll that catches rotations fsnotify missed
+const tailerPollInterval = 10 * time.Second
+
+// Leading bytes hashed to recognise a file across agent restarts
+const tailerFingerprintBytes = 1024
+
+// fileTailer follows a log file across logrotate rotations. It watches the
+// parent directory so renames and re-creations are seen, tracks the file's
+// identity and offset, resets on truncation (copytruncate) and, when the file
+// was replaced, finishes reading the old file from its ".1" name first.
+type fileTailer struct {
+	path    string
+	handle  func(line string)
+	watcher *fsnotify.Watcher
+
+	mu     sync.Mutex
+	info   os.FileInfo // identity of the file the offset refers to
+	offset int64
+
+	// Position persistence (newStatefulFileTailer)
+	statePath  string
+	persist    bool
+	saved      int64
+	saveFailed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newFileTailer starts following path. Existing content is read when
+// fromStart is set, otherwise only lines written from now on are handled.
+func newFileTailer(path string, fromStart bool, handle func(line string)) (*fileTailer, error) {
+	t, err := openFileTailer(path, handle)
+	if err != nil {
+		return nil, err
+	}
+	if !fromStart {
+		if info, err := os.Stat(path); err == nil {
+			t.info = info
+			t.offset = info.Size()
+		}
+	}
+
+	go t.run()
+	return t, nil
+}
+
+// newStatefulFileTailer follows path like newFileTailer, resuming from the
+// position a previous run saved in statePath so no line is handled twice
+// across restarts. Lines written to the old file after the saved position are
+// read first when it was rotated to path.1 in the meantime. Without a usable
+// saved position the file is read from the start. The position is saved after
+// every read unless persist is unset (dry-run).
+func newStatefulFileTailer(path, statePath string, persist bool, handle func(line string)) (*fileTailer, error) {
+	t, err := openFileTailer(path, handle)
+	if err != nil {
+		return nil, err
+	}
+	t.statePath = statePath
+	t.persist = persist
+	t.resume()
+
+	go t.run()
+	return t, nil
+}
+
+func openFileTailer(path string, handle func(line string)) (*fileTailer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	return &fileTailer{
+		path:    path,
+		handle:  handle,
+		watcher: watcher,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (t *fileTailer) run() {
+	defer reportPanic()
+	defer close(t.done)
+
+	t.poll()
+
+	ticker := time.NewTicker(tailerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(t.path) {
+				t.poll()
+			}
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Tailer watcher error for %s: %v", t.path, err)
+		case <-ticker.C:
+			t.poll()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// poll reads any new complete lines, handling rotation and truncation
+func (t *fileTailer) poll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, err := os.Open(t.path)
+	if err != nil {
+		// Between rename and re-create; the next event or poll picks it up
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	if t.info != nil && !os.SameFile(t.info, info) {
+		// Replaced: drain what was written to the old file before rotation
+		t.drainRotated()
+		t.offset = 0
+	} else if info.Size() < t.offset {
+		// Truncated in place
+		log.Printf("Log file %s truncated, reading from start", t.path)
+		t.offset = 0
+	}
+	t.info = info
+
+	t.offset = t.readLines(file, t.offset)
+	if t.persist && t.offset != t.saved {
+		t.saveState(file)
+	}
+}
+
+// drainRotated reads the remainder of the previous file if it now lives at path.1
+func (t *fileTailer) drainRotated() {
+	rotated := t.path + ".1"
+	file, err := os.Open(rotated)
+	if err != nil {
+		log.Printf("Log file %s rotated, previous file not found", t.path)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !os.SameFile(t.info, info) {
+		log.Printf("Log file %s rotated, previous file not found", t.path)
+		return
+	}
+
+	log.Printf("Log file %s rotated, catching up from %s", t.path, rotated)
+	t.readLines(file, t.offset)
+}
+
+// readLines handles every complete line after offset and returns the offset
+// just past the last one. A trailing partial line is left for the next read.
+func (t *fileTailer) readLines(file *os.File, offset int64) int64 {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// EOF (possibly mid-line) or read error: stop at the last full line
+			return offset
+		}
+		offset += int64(len(line))
+		t.handle(string(bytes.TrimRight(line, "\r\n")))
+	}
+}
+
+// tailerState is the saved read position of a stateful fileTailer. The file is
+// recognised by a hash of its leading bytes rather than its inode, which
+// survives renames but is reused once a rotated file is deleted.
+type tailerState struct {
+	Path           string `json:"path"`
+	Offset         int64  `json:"offset"`
+	Fingerprint    string `json:"fingerprint"`
+	FingerprintLen int64  `json:"fingerprint_len"`
+}
+
+// fileFingerprint hashes the first n bytes of file
+func fileFingerprint(file *os.File, n int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, n)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// openSaved opens path if it is the file state was saved for, i.e. it is at
+// least as long as the saved offset and starts with the same bytes
+func openSaved(path string, state tailerState) (*os.File, os.FileInfo, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() < state.Offset || info.Size() < state.FingerprintLen {
+		file.Close()
+		return nil, nil, false
+	}
+	if fingerprint, err := fileFingerprint(file, state.FingerprintLen); err != nil || fingerprint != state.Fingerprint {
+		file.Close()
+		return nil, nil, false
+	}
+	return file, info, true
+}
+
+// resume restores the saved position before the tailer starts
+func (t *fileTailer) resume() {
+	data, err := os.ReadFile(t.statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Failed to read tailer state %s: %v", t.statePath, err)
+		}
+		return
+	}
+	var state tailerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Warning: Ignoring corrupt tailer state %s: %v", t.statePath, err)
+		return
+	}
+	if state.Path != t.path {
+		return
+	}
+
+	if file, info, ok := openSaved(t.path, state); ok {
+		file.Close()
+		t.info = info
+		t.offset = state.Offset
+		t.saved = state.Offset
+		log.Printf("Resuming %s at offset %d", t.path, state.Offset)
+		return
+	}
+
+	// Rotated while the agent was stopped
+	rotated := t.path + ".1"
+	if file, _, ok := openSaved(rotated, state); ok {
+		log.Printf("Log file %s rotated since last run, catching up from %s", t.path, rotated)
+		t.readLines(file, state.Offset)
+		file.Close()
+		return
+	}
+	log.Printf("Log file %s changed since last run, reading from start", t.path)
+}
+
+// saveState records the position within file. Must be called with mu held.
+func (t *fileTailer) saveState(file *os.File) {
+	state := tailerState{Path: t.path, Offset: t.offset, FingerprintLen: min(t.offset, tailerFingerprintBytes)}
+	fingerprint, err := fileFingerprint(file, state.FingerprintLen)
+	if err == nil {
+		state.Fingerprint = fingerprint
+		err = writeTailerState(t.statePath, state)
+	}
+	if err != nil {
+		if !t.saveFailed {
+			log.Printf("Warning: Failed to save tailer state %s: %v", t.statePath, err)
+		}
+		t.saveFailed = true
+		return
+	}
+	t.saved = t.offset
+	t.saveFailed = false
+}
+
+// writeTailerState atomically replaces the state file
+func writeTailerState(path string, state tailerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Offset returns the read position within the current file
+func (t *fileTailer) Offset() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.offset
+}
+
+// Close stops following the file
+func (t *fileTailer) Close() error {
+	close(t.stop)
+	err := t.watcher.Close()
+	<-t.done
+	return err
+}
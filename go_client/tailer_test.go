@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestFileTailerRotation tests following a file through rename and truncate rotations
+func TestFileTailerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendFile := func(p, data string) {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	appendFile(path, "one\ntwo\n")
+	tailer, err := newFileTailer(path, true, func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Failed to start tailer: %v", err)
+	}
+	defer tailer.Close()
+
+	// Partial lines are held back until complete
+	appendFile(path, "thr")
+	tailer.poll()
+	appendFile(path, "ee\n")
+	tailer.poll()
+
+	// Lines written just before a rename rotation are read from path.1
+	appendFile(path, "four\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "five\n")
+	tailer.poll()
+
+	// copytruncate rotation
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "six\n")
+	tailer.poll()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"one", "two", "three", "four", "five", "six"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+}
+
+// TestStatefulFileTailerResume tests that a restarted tailer continues from
+// the saved position, including when the file was rotated in between
+func TestStatefulFileTailerResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.log")
+	statePath := filepath.Join(dir, "state", "auth_offset.json")
+	appendFile := func(p, data string) {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	run := func(persist bool) {
+		tailer, err := newStatefulFileTailer(path, statePath, persist, func(line string) {
+			mu.Lock()
+			lines = append(lines, line)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatalf("Failed to start tailer: %v", err)
+		}
+		tailer.poll()
+		tailer.Close()
+	}
+	expect := func(expected ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("Expected %v, got %v", expected, lines)
+		}
+		lines = nil
+	}
+
+	appendFile(path, "one\ntwo\n")
+	run(true)
+	expect("one", "two")
+
+	// Restart: only new lines
+	appendFile(path, "three\n")
+	run(true)
+	expect("three")
+
+	// Dry-run reads but doesn't move the saved position
+	appendFile(path, "four\n")
+	run(false)
+	expect("four")
+	run(true)
+	expect("four")
+
+	// Rotated while stopped: rest of the old file, then the new one
+	appendFile(path, "five\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "six\n")
+	run(true)
+	expect("five", "six")
+
+	// Unrecognised file: read from the start
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "seven\n")
+	run(true)
+	expect("seven")
+}
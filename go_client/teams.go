@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Adaptive Card text colors per severity
+var teamsColors = map[string]string{
+	SeverityCritical: "Attention",
+	SeverityWarning:  "Warning",
+}
+
+// newTeamsNotifier returns nil when no webhook is configured
+func newTeamsNotifier(config Config) (*alertNotifier, error) {
+	if config.TeamsWebhook == "" && config.TeamsCriticalWebhook == "" {
+		return nil, nil
+	}
+	client, err := newOutboundClient(config, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	post := func(webhook string, message AlertMessage) error {
+		return postTeams(client, webhook, message)
+	}
+	options := serviceOptions(config, config.TeamsTemplate, config.TeamsMinSeverity, config.TeamsRepeatMinutes)
+	return newAlertNotifier("Teams", severityWebhooks(config.TeamsWebhook, config.TeamsCriticalWebhook), options, post)
+}
+
+// teamsCard formats a message as an Adaptive Card: a title colored by
+// severity, the host's identity and score as facts, then the rendered
+// template or each alert with its details
+func teamsCard(message AlertMessage) map[string]any {
+	facts := []map[string]string{{"title": "Host", "value": message.Host}}
+	for _, fact := range [][2]string{{"Env", message.Env}, {"Team", message.OwnerTeam}, {"Server ID", message.ServerID}} {
+		if fact[1] != "" {
+			facts = append(facts, map[string]string{"title": fact[0], "value": fact[1]})
+		}
+	}
+	facts = append(facts, map[string]string{"title": "Score", "value": fmt.Sprintf("%.2f", message.Score)})
+	if !message.Time.IsZero() {
+		facts = append(facts, map[string]string{"title": "Time", "value": message.Time.UTC().Format(time.RFC3339)})
+	}
+
+	body := []map[string]any{
+		{
+			"type":   "TextBlock",
+			"text":   fmt.Sprintf("%s: %d alert(s) on %s", strings.ToUpper(message.Severity), len(message.Alerts), message.Host),
+			"size":   "Large",
+			"weight": "Bolder",
+			"color":  teamsColors[message.Severity],
+			"wrap":   true,
+		},
+		{"type": "FactSet", "facts": facts},
+	}
+	if message.Text != "" {
+		body = append(body, map[string]any{"type": "TextBlock", "text": message.Text, "wrap": true})
+	} else {
+		for _, alert := range message.Alerts {
+			text := "**" + alert + "**"
+			if detail := message.Details[alert]; detail != "" {
+				text += ": " + detail
+			}
+			body = append(body, map[string]any{"type": "TextBlock", "text": text, "wrap": true, "spacing": "Small"})
+		}
+	}
+	return map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+}
+
+// postTeams sends a message to a Teams incoming webhook or Workflows webhook
+func postTeams(client *http.Client, webhook string, message AlertMessage) error {
+	body, err := json.Marshal(map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     teamsCard(message),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Workflows webhooks answer 202 Accepted
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
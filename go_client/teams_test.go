@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTeamsNotifier tests that alerts are posted as Adaptive Cards
+func TestTeamsNotifier(t *testing.T) {
+	var posted map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	notifier, err := newTeamsNotifier(Config{TeamsWebhook: server.URL, TeamsRepeatMinutes: 60})
+	if err != nil || notifier == nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	payload := Payload{Host: "erp-db", Env: "prod", LocalAlerts: []string{"CPU_SPIKE"}, Score: 0.4}
+	if err := notifier.notify(payload); err != nil {
+		t.Fatalf("Expected notification to succeed, got %v", err)
+	}
+
+	attachment := posted["attachments"].([]any)[0].(map[string]any)
+	if attachment["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("Expected an Adaptive Card, got %v", attachment["contentType"])
+	}
+	body := attachment["content"].(map[string]any)["body"].([]any)
+	title := body[0].(map[string]any)
+	if title["text"] != "WARNING: 1 alert(s) on erp-db" || title["color"] != "Warning" {
+		t.Errorf("Unexpected title %v", title)
+	}
+	facts := body[1].(map[string]any)["facts"].([]any)
+	if len(facts) != 3 || facts[1].(map[string]any)["value"] != "prod" {
+		t.Errorf("Expected host, env and score facts, got %v", facts)
+	}
+	if alert := body[2].(map[string]any); alert["text"] != "**CPU_SPIKE**" {
+		t.Errorf("Unexpected alert block %v", alert)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Values accepted by --tls-min-version
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// serverTLSConfig builds the TLS config for connections to --server-url and
+// --grpc-addr: the --client-cert presented for mutual TLS, the --server-ca
+// bundle trusted instead of the system roots, and --tls-min-version
+func serverTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.FIPS {
+		applyFIPSTLS(tlsConfig)
+	}
+	if config.TLSMinVersion != "" {
+		version, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS min version %q (valid: 1.2, 1.3)", config.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return nil, fmt.Errorf("--client-cert and --client-key must be set together")
+	}
+	if config.ClientCert != "" {
+		loader := &clientCertLoader{certFile: config.ClientCert, keyFile: config.ClientKey}
+		if _, err := loader.load(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loader.load()
+		}
+	}
+
+	if config.ServerCA != "" {
+		caPEM, err := os.ReadFile(config.ServerCA)
+		if err != nil {
+			return nil, fmt.Errorf("read server CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ServerCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// newServerHTTPClient returns the client payloads, heartbeats and enrollment
+// use to reach --server-url
+func newServerHTTPClient(config Config, timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newOutboundTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// clientCertLoader reads the --client-cert key pair, again whenever either
+// file changes, so renewed short-lived certificates are used without a
+// restart
+type clientCertLoader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// load returns the current key pair. A renewal that fails to load (such as a
+// certificate written before its key) keeps the previous pair in use.
+func (l *clientCertLoader) load() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modified := latestModTime(l.certFile, l.keyFile)
+	if l.cert != nil && !modified.After(l.modified) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("load client certificate: %w", err)
+	}
+	l.cert, l.modified = &cert, modified
+	return l.cert, nil
+}
+
+// latestModTime returns the newest modification time of the files that exist
+func latestModTime(paths ...string) time.Time {
+	var latest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for mutual TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate and key signed by the CA to certFile and keyFile
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage, certFile, keyFile string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if certFile != "" {
+		os.WriteFile(certFile, certPEM, 0600)
+		os.WriteFile(keyFile, keyPEM, 0600)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// TestMutualTLS tests presenting a client certificate to a server that
+// requires one, trusting --server-ca and enforcing --tls-min-version
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.pem, 0644)
+	certFile, keyFile := filepath.Join(dir, "agent.pem"), filepath.Join(dir, "agent-key.pem")
+	ca.issue(t, "agent-1", x509.ExtKeyUsageClientAuth, certFile, keyFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	var clients []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients = append(clients, r.TLS.PeerCertificates[0].Subject.CommonName)
+		writeJSON(w, map[string]interface{}{"status": "success", "ack": newAck("s3cret", r.Header.Get("X-Agent-Payload-Id"), AckStored)})
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth, "", "")},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MaxVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	config := Config{ServerURL: server.URL, Secret: "s3cret", ClientCert: certFile, ClientKey: keyFile, ServerCA: caFile}
+	send := func(config Config) error {
+		client, err := newServerHTTPClient(config, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		agent := &Agent{config: config, httpClient: client}
+		return agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()})
+	}
+	if err := send(config); err != nil {
+		t.Fatalf("Expected mutual TLS send to succeed: %v", err)
+	}
+
+	// A renewed certificate is picked up without a restart
+	later := time.Now().Add(time.Minute)
+	ca.issue(t, "agent-1-renewed", x509.ExtKeyUsageClientAuth, certFile, keyFile)
+	os.Chtimes(certFile, later, later)
+	client, _ := newServerHTTPClient(config, 5*time.Second)
+	agent := &Agent{config: config, httpClient: client}
+	agent.httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	if err := agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(keyFile, []byte("half-written"), 0600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if err := agent.postPayload(Payload{ID: newUUID(), Timestamp: time.Now()}); err != nil {
+		t.Errorf("Expected a broken renewal to keep the previous certificate: %v", err)
+	}
+	if strings.Join(clients, ",") != "agent-1,agent-1-renewed,agent-1-renewed" {
+		t.Errorf("Expected the renewed certificate presented, got %v", clients)
+	}
+
+	noCert := config
+	noCert.ClientCert, noCert.ClientKey = "", ""
+	if err := send(noCert); err == nil {
+		t.Error("Expected the server to refuse a connection without a client certificate")
+	}
+	noCA := config
+	noCA.ServerCA = ""
+	if err := send(noCA); err == nil {
+		t.Error("Expected the test CA to be untrusted without --server-ca")
+	}
+	tls13 := config
+	tls13.TLSMinVersion = "1.3"
+	if err := send(tls13); err == nil {
+		t.Error("Expected --tls-min-version 1.3 to refuse a TLS 1.2 server")
+	}
+
+	for _, bad := range []Config{
+		{ClientCert: certFile},
+		{ClientCert: certFile, ClientKey: filepath.Join(dir, "missing.pem")},
+		{ServerCA: keyFile},
+		{TLSMinVersion: "1.1"},
+	} {
+		if _, err := NewAgent(bad); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
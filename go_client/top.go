@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// ANSI sequence moving the cursor home and clearing the screen
+const clearScreen = "\033[H\033[2J"
+
+// topClient reads the local agent's health and admin endpoints
+type topClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// topSnapshot is one refresh of the dashboard
+type topSnapshot struct {
+	Taken      time.Time
+	Health     HealthStatus
+	Metrics    MetricsStatus
+	Containers []*MonitoredContainer
+	Alerts     []AlertState
+	Queue      QueueSummary
+	Errors     []string
+	Reachable  bool // at least one endpoint answered
+}
+
+// defaultAgentAddr is where the CLI finds the local agent: its --health-addr
+// from the environment, over https when the health server has a certificate
+func defaultAgentAddr() string {
+	addr, _ := lookupEnv("HEALTH_ADDR")
+	if addr = normalizeHealthAddr(addr); addr == "" {
+		return "localhost:8081"
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	if !strings.HasPrefix(addr, "unix:") && getenv("HEALTH_TLS_CERT") != "" {
+		addr = "https://" + addr
+	}
+	return addr
+}
+
+// newTopClient connects to addr, which may be host:port, an http(s) URL or unix:/path
+func newTopClient(addr, token, caFile string) (*topClient, error) {
+	transport := &http.Transport{}
+	base := addr
+
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		socket := strings.TrimPrefix(addr, "unix:")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		base = "http://agent"
+	case !strings.Contains(addr, "://"):
+		base = "http://" + addr
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &topClient{
+		base:  strings.TrimRight(base, "/"),
+		token: token,
+		http:  &http.Client{Transport: transport, Timeout: 5 * time.Second},
+	}, nil
+}
+
+// fetch returns the body of an endpoint
+func (c *topClient) fetch(path string) ([]byte, error) {
+	return c.do(http.MethodGet, path)
+}
+
+// do sends an empty request and returns the response body
+func (c *topClient) do(method, path string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// get decodes a JSON endpoint into v
+func (c *topClient) get(path string, v interface{}) error {
+	data, err := c.fetch(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// post invokes an admin action and decodes its JSON response into v
+func (c *topClient) post(path string, v interface{}) error {
+	data, err := c.do(http.MethodPost, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// snapshot fetches every endpoint, collecting errors instead of failing so a
+// partially reachable agent is still displayed
+func (c *topClient) snapshot() topSnapshot {
+	s := topSnapshot{Taken: time.Now()}
+	endpoints := []struct {
+		path string
+		into interface{}
+	}{
+		{"/healthz", &s.Health},
+		{"/metrics", &s.Metrics},
+		{"/admin/containers", &s.Containers},
+		{"/admin/alerts", &s.Alerts},
+		{"/admin/queue", &s.Queue},
+	}
+	for _, e := range endpoints {
+		if err := c.get(e.path, e.into); err != nil {
+			s.Errors = append(s.Errors, err.Error())
+			continue
+		}
+		s.Reachable = true
+	}
+	return s
+}
+
+// renderTop draws one dashboard frame. Container line rates are computed
+// against the previous snapshot when there is one.
+func renderTop(w io.Writer, cur topSnapshot, prev *topSnapshot) {
+	fmt.Fprintf(w, "monitoring-agent top - %s  uptime %s  last send %s\n\n",
+		cur.Taken.Format("15:04:05"),
+		time.Duration(cur.Health.UptimeSeconds)*time.Second,
+		sinceLabel(cur.Health.LastSendOK, cur.Taken))
+
+	agent := cur.Metrics.Agent
+	fmt.Fprintf(w, "CPU %5.1f%%   Memory %5.1f%%   Goroutines %d   Heap %.1f MiB\n",
+		cur.Metrics.CPU, cur.Metrics.Memory, agent.Goroutines, float64(agent.HeapBytes)/(1<<20))
+	fmt.Fprintf(w, "Send  ok %d  failed %d  retries %d  p95 %.3fs\n",
+		agent.Send.Successes, agent.Send.Failures, agent.Send.Retries, agent.PayloadSend.P95)
+	fmt.Fprintf(w, "Queue %d/%d in memory, %d file(s) %d bytes on disk\n\n",
+		cur.Queue.Length, cur.Queue.Limit, len(cur.Queue.DiskFiles), cur.Queue.TotalBytes)
+
+	fmt.Fprintf(w, "ALERTS (%d)\n", len(cur.Alerts))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ALERT\tSTATE\tCOUNT\tLAST SEEN\tDETAIL\n")
+	for _, alert := range cur.Alerts {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", alert.Alert, alert.State, alert.Count,
+			sinceLabel(alert.LastSeen, cur.Taken), truncate(alert.Detail, 60))
+	}
+	tw.Flush()
+
+	previous := make(map[string]uint64)
+	var elapsed float64
+	if prev != nil {
+		elapsed = cur.Taken.Sub(prev.Taken).Seconds()
+		for _, c := range prev.Containers {
+			previous[c.ID] = c.LinesRead
+		}
+	}
+	containers := append([]*MonitoredContainer(nil), cur.Containers...)
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+
+	fmt.Fprintf(w, "\nCONTAINERS (%d)\n", len(containers))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tIMAGE\tLINES\tLINES/S\tMONITORED\n")
+	for _, c := range containers {
+		rate := "-"
+		if last, ok := previous[c.ID]; ok && elapsed > 0 && c.LinesRead >= last {
+			rate = fmt.Sprintf("%.1f", float64(c.LinesRead-last)/elapsed)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", c.Name, c.Image, c.LinesRead, rate, sinceLabel(c.Since, cur.Taken))
+	}
+	tw.Flush()
+
+	for _, err := range cur.Errors {
+		fmt.Fprintf(w, "\nerror: %s", err)
+	}
+	if len(cur.Errors) > 0 {
+		fmt.Fprintln(w)
+	}
+}
+
+// sinceLabel formats how long ago t was
+func sinceLabel(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Truncate(time.Second).String() + " ago"
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func cmdTop(args []string) error {
+	fs := newFlagSet("top", "top [--addr ADDR] [--admin-token TOKEN] [--refresh SECONDS] [--once]")
+	addr := fs.String("addr", defaultAgentAddr(), "Agent health server address (host:port, https:// URL or unix:/path; default HEALTH_ADDR)")
+	token := fs.String("admin-token", getenv("ADMIN_TOKEN"), "Admin API bearer token (ADMIN_TOKEN)")
+	caFile := fs.String("ca-file", "", "CA bundle for a TLS health server")
+	refresh := fs.Int("refresh", 2, "Seconds between refreshes")
+	once := fs.Bool("once", false, "Print a single frame and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := newTopClient(*addr, *token, *caFile)
+	if err != nil {
+		return err
+	}
+
+	if *once {
+		snap := client.snapshot()
+		renderTop(os.Stdout, snap, nil)
+		if !snap.Reachable {
+			return fmt.Errorf("agent unreachable at %s", *addr)
+		}
+		return nil
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Duration(*refresh) * time.Second)
+	defer ticker.Stop()
+
+	var prev *topSnapshot
+	for {
+		snap := client.snapshot()
+		fmt.Print(clearScreen)
+		renderTop(os.Stdout, snap, prev)
+		prev = &snap
+
+		select {
+		case <-sigChan:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
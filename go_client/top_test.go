@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTopDashboard tests rendering a dashboard frame from a live admin API
+func TestTopDashboard(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	agent, err := NewAgent(Config{HealthAddr: "unix:" + socketPath, AdminToken: "admin-secret", MaxLogEntries: 10, BaselineSamples: 5})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	monitored := agent.trackContainer("abc123", "/web", "nginx:latest")
+	monitored.linesRead.Store(10)
+	agent.alertMutex.Lock()
+	agent.raiseAlert("CPU_SPIKE")
+	agent.alertMutex.Unlock()
+
+	defer agent.healthServer.Close()
+
+	client, err := newTopClient("unix:"+socketPath, "admin-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := client.snapshot()
+	if len(first.Errors) > 0 {
+		t.Fatalf("Unexpected errors: %v", first.Errors)
+	}
+
+	monitored.linesRead.Store(30)
+	second := client.snapshot()
+	second.Taken = first.Taken.Add(2 * time.Second)
+
+	var out bytes.Buffer
+	renderTop(&out, second, &first)
+	frame := out.String()
+	for _, want := range []string{"CPU_SPIKE", "web", "nginx:latest", "10.0"} {
+		if !strings.Contains(frame, want) {
+			t.Errorf("Expected %q in frame:\n%s", want, frame)
+		}
+	}
+
+	unauthorized, _ := newTopClient("unix:"+socketPath, "wrong", "")
+	if snap := unauthorized.snapshot(); len(snap.Errors) == 0 {
+		t.Error("Expected admin endpoints to reject a wrong token")
+	}
+}
+
+// TestDefaultAgentAddr tests that the CLI finds the agent at its configured
+// health address
+func TestDefaultAgentAddr(t *testing.T) {
+	for _, tc := range []struct{ addr, cert, want string }{
+		{"", "", "localhost:8081"},
+		{":9090", "", "localhost:9090"},
+		{"9091", "", "localhost:9091"},
+		{"off", "", "localhost:8081"},
+		{"unix:/run/agent.sock", "/etc/agent/cert.pem", "unix:/run/agent.sock"},
+		{"10.0.0.5:8081", "/etc/agent/cert.pem", "https://10.0.0.5:8081"},
+	} {
+		t.Setenv("RICHARDOPS_HEALTH_ADDR", tc.addr)
+		t.Setenv("HEALTH_TLS_CERT", tc.cert)
+		if got := defaultAgentAddr(); got != tc.want {
+			t.Errorf("HEALTH_ADDR %q: expected %s, got %s", tc.addr, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+// Arguments for following sshd authentication failures in the macOS unified log
+var unifiedLogArgs = []string{
+	"stream", "--style", "ndjson", "--level", "info",
+	"--predicate", `process == "sshd" AND (eventMessage CONTAINS "Failed" OR eventMessage CONTAINS "authentication error")`,
+}
+
+// sshd failure messages as logged through PAM on macOS
+var unifiedLogFailurePattern = regexp.MustCompile(`(?:Failed \S+|authentication error) for .* from (\d+\.\d+\.\d+\.\d+)`)
+
+// unifiedLogEntry is the subset of a `log stream --style ndjson` record the agent uses
+type unifiedLogEntry struct {
+	Timestamp    string `json:"timestamp"`
+	Process      string `json:"processImagePath"`
+	EventMessage string `json:"eventMessage"`
+}
+
+// handleUnifiedLogLine records sshd authentication failures from the unified log
+func (a *Agent) handleUnifiedLogLine(line string) {
+	var entry unifiedLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		// log stream prints a non-JSON banner line first
+		return
+	}
+
+	matches := unifiedLogFailurePattern.FindStringSubmatch(entry.EventMessage)
+	if len(matches) < 2 {
+		return
+	}
+
+	timestamp, err := time.Parse("2006-01-02 15:04:05.000000-0700", entry.Timestamp)
+	if err != nil {
+		timestamp = time.Now()
+	}
+	a.recordAuthFailure(matches[1], timestamp)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestUnifiedLogParsing tests extraction of sshd failures from log stream output
+func TestUnifiedLogParsing(t *testing.T) {
+	agent, err := NewAgent(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	agent.authFailures = agent.authFailures[:0]
+
+	lines := []string{
+		`Filtering the log data using "process == \"sshd\""`,
+		`{"timestamp":"2025-01-15 10:30:00.123456+0000","processImagePath":"/usr/sbin/sshd","eventMessage":"Failed keyboard-interactive/pam for invalid user admin from 198.51.100.4 port 52144 ssh2"}`,
+		`{"timestamp":"2025-01-15 10:30:01.000000+0000","processImagePath":"/usr/sbin/sshd","eventMessage":"Connection closed by 198.51.100.4 port 52144"}`,
+	}
+	for _, line := range lines {
+		agent.handleUnifiedLogLine(line)
+	}
+
+	if len(agent.authFailures) != 1 {
+		t.Fatalf("Expected 1 auth failure, got %d", len(agent.authFailures))
+	}
+	if failure := agent.authFailures[0]; failure.IP != "198.51.100.4" || failure.Timestamp.Year() != 2025 {
+		t.Errorf("Unexpected auth failure %+v", failure)
+	}
+}
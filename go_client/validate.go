@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Longest check-config waits for the server to answer
+const reachabilityTimeout = 5 * time.Second
+
+// Config check outcomes
+const (
+	CheckOK      = "ok"
+	CheckWarning = "warning"
+	CheckError   = "error"
+	CheckSkipped = "skipped"
+)
+
+// ConfigCheck is the outcome of one check-config check
+type ConfigCheck struct {
+	Name   string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ConfigReport is what check-config found; OK is false if any check failed
+type ConfigReport struct {
+	OK     bool          `json:"ok"`
+	Checks []ConfigCheck `json:"checks"`
+	Config Config        `json:"config"` // redacted
+}
+
+// configChecker collects check outcomes
+type configChecker struct {
+	report ConfigReport
+}
+
+func (c *configChecker) add(name, status, detail string) {
+	c.report.Checks = append(c.report.Checks, ConfigCheck{Name: name, Status: status, Detail: detail})
+	if status == CheckError {
+		c.report.OK = false
+	}
+}
+
+// check records err as the outcome of a check
+func (c *configChecker) check(name string, err error) {
+	if err != nil {
+		c.add(name, CheckError, err.Error())
+		return
+	}
+	c.add(name, CheckOK, "")
+}
+
+// checkIf runs a check only for a configured setting
+func (c *configChecker) checkIf(name string, configured bool, run func() error) {
+	if !configured {
+		c.add(name, CheckSkipped, "not configured")
+		return
+	}
+	c.check(name, run())
+}
+
+// checkConfig validates everything NewAgent would, without starting
+// monitors or binding the health server. With connect, it also checks that
+// the server answers.
+func checkConfig(config Config, connect bool) ConfigReport {
+	probe := &Agent{config: config}
+	c := &configChecker{report: ConfigReport{OK: true, Config: probe.redactedConfig()}}
+
+	c.check("required settings", validateConfig(config))
+	c.checkIf("secret source", config.SecretFile != "" || config.VaultAddr != "", func() error {
+		_, err := newSecretSource(config)
+		return err
+	})
+	c.checkIf("fips", config.FIPS, func() error { return checkFIPSMode(config) })
+	c.checkIf("auth source", config.AuthSource != "", func() error {
+		if !authSourceModes[config.AuthSource] {
+			return fmt.Errorf("invalid auth source %q (auto, file, journald or none)", config.AuthSource)
+		}
+		return nil
+	})
+	c.checkIf("server tls", config.ClientCert != "" || config.ClientKey != "" || config.ServerCA != "" || config.TLSMinVersion != "", func() error {
+		_, err := serverTLSConfig(config)
+		return err
+	})
+	c.checkIf("proxy", config.ProxyURL != "", func() error {
+		_, err := parseProxyURL(config.ProxyURL)
+		return err
+	})
+	c.checkIf("compression", config.Compression != "" && config.Compression != "none", func() error {
+		return checkCompression(config.Compression)
+	})
+	c.check("auth log format", func() error {
+		_, err := newAuthLogParser(config)
+		return err
+	}())
+	if paths := configuredAuthLogs(config); len(paths) > 0 {
+		var missing []string
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				missing = append(missing, path)
+			}
+		}
+		if len(missing) > 0 {
+			c.add("auth logs", CheckWarning, "not found (yet): "+strings.Join(missing, ", "))
+		} else {
+			c.add("auth logs", CheckOK, "")
+		}
+	}
+	c.checkIf("alert weights", config.AlertWeights != "", func() error {
+		_, err := parseAlertWeights(config.AlertWeights)
+		return err
+	})
+	c.check("masking rules", func() error {
+		_, err := buildMasker(config)
+		return err
+	}())
+	c.checkIf("parse rules", config.ParseRulesFile != "", func() error {
+		_, err := loadLogPipeline(config.ParseRulesFile)
+		return err
+	})
+	c.checkIf("probes", config.Probes != "", func() error {
+		probes, err := parseProbes(config.Probes)
+		if err == nil && len(probes) > 0 && config.ProbeInterval <= 0 {
+			err = fmt.Errorf("--probe-interval must be positive")
+		}
+		return err
+	})
+	c.checkIf("snmp devices", config.SNMPFile != "", func() error {
+		devices, err := loadSNMPDevices(config.SNMPFile, config.FIPS)
+		if err == nil && len(devices) > 0 && config.SNMPInterval <= 0 {
+			err = fmt.Errorf("--snmp-interval must be positive")
+		}
+		return err
+	})
+	c.checkIf("detectors", config.Detectors != "", func() error {
+		detectors, err := loadDetectors(config.Detectors)
+		for _, detector := range detectors {
+			detector.Close()
+		}
+		return err
+	})
+	c.checkIf("hooks", config.Hooks != "", func() error {
+		hooks, err := loadHooks(config.Hooks)
+		if err != nil {
+			return fmt.Errorf("hooks %s: %w", config.Hooks, err)
+		}
+		return hooks.Close()
+	})
+	c.check("notifications", func() error {
+		_, err := newAlertNotifiers(config)
+		return err
+	}())
+	c.checkIf("simulations", simulationSpec(config) != "", func() error {
+		_, err := parseSimulations(simulationSpec(config))
+		return err
+	})
+	c.checkIf("health server", config.HealthAddr != "", func() error {
+		if err := probe.validateHealthSecurity(); err != nil {
+			return err
+		}
+		if config.HealthTLSCert != "" && config.HealthTLSKey != "" {
+			_, err := probe.healthTLSConfig()
+			return err
+		}
+		return nil
+	})
+	c.checkIf("queue directory", !config.DryRun && !config.Exporter, func() error {
+		return checkQueueDir(config.QueueDir)
+	})
+	c.checkIf("integrity manifest", config.IntegrityManifest != "", func() error {
+		_, err := loadIntegrityManifest(config.IntegrityManifest)
+		return err
+	})
+
+	problems, warnings := thresholdProblems(config)
+	switch {
+	case len(problems) > 0:
+		c.add("thresholds", CheckError, strings.Join(problems, "; "))
+	case len(warnings) > 0:
+		c.add("thresholds", CheckWarning, strings.Join(warnings, "; "))
+	default:
+		c.add("thresholds", CheckOK, "")
+	}
+
+	switch {
+	case config.DryRun || config.Exporter || (config.ServerURL == "" && config.GRPCAddr == ""):
+		c.add("server reachable", CheckSkipped, "nothing is sent")
+	case !connect:
+		c.add("server reachable", CheckSkipped, "--no-connect")
+	case config.GRPCAddr != "":
+		c.check("server reachable", checkGRPCReachable(config.GRPCAddr))
+	default:
+		urls := serverURLs(config.ServerURL)
+		// Present the client certificate, so servers requiring mutual TLS
+		// answer; a broken TLS setup is reported by its own check
+		client, err := newServerHTTPClient(config, reachabilityTimeout)
+		if err != nil {
+			client = &http.Client{Timeout: reachabilityTimeout}
+		}
+		var unreachable []string
+		for _, serverURL := range urls {
+			if err := checkURLReachable(client, serverURL); err != nil {
+				unreachable = append(unreachable, err.Error())
+			}
+		}
+		switch {
+		case len(unreachable) == 0:
+			c.add("server reachable", CheckOK, "")
+		case len(unreachable) < len(urls):
+			c.add("server reachable", CheckWarning, strings.Join(unreachable, "; "))
+		default:
+			c.add("server reachable", CheckError, strings.Join(unreachable, "; "))
+		}
+	}
+	return c.report
+}
+
+// thresholdProblems returns settings no agent could run with, and settings
+// that are legal but likely mistakes
+func thresholdProblems(config Config) (problems, warnings []string) {
+	positive := []struct {
+		flag  string
+		value float64
+	}{
+		{"--interval", float64(config.Interval)},
+		{"--auth-window-seconds", float64(config.AuthWindowSeconds)},
+		{"--failed-auth-threshold", float64(config.FailedAuthThreshold)},
+		{"--baseline-samples", float64(config.BaselineSamples)},
+		{"--max-log-entries", float64(config.MaxLogEntries)},
+		{"--upstream-spike-factor", config.UpstreamSpikeFactor},
+		{"--slow-query-spike-factor", config.SlowQuerySpikeFactor},
+		{"--queue-max-payloads", float64(config.QueueMaxPayloads)},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive, got %v", p.flag, p.value))
+		}
+	}
+	notNegative := []struct {
+		flag  string
+		value float64
+	}{
+		{"--backfill-rate", config.BackfillRate},
+		{"--heartbeat-interval", float64(config.HeartbeatInterval)},
+		{"--tail-lines", float64(config.TailLines)},
+		{"--warmup-seconds", float64(config.WarmupSeconds)},
+		{"--http-min-requests", float64(config.HTTPMinRequests)},
+		{"--queue-max-mb", float64(config.QueueMaxMB)},
+		{"--queue-max-age-hours", float64(config.QueueMaxAgeHours)},
+		{"--batch-size", float64(config.BatchSize)},
+		{"--log-workers", float64(config.LogWorkers)},
+		{"--memory-budget-mb", float64(config.MemoryBudgetMB)},
+		{"--max-payload-kb", float64(config.MaxPayloadKB)},
+		{"--batch-max-kb", float64(config.BatchMaxKB)},
+	}
+	for _, p := range notNegative {
+		if p.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative, got %v", p.flag, p.value))
+		}
+	}
+	percentages := []struct {
+		flag  string
+		value float64
+	}{
+		{"--cpu-spike-pct", config.CPUSpikePct},
+		{"--http-5xx-pct", config.HTTP5xxPct},
+		{"--upstream-error-pct", config.UpstreamErrorPct},
+	}
+	for _, p := range percentages {
+		if p.value <= 0 || p.value > 100 {
+			problems = append(problems, fmt.Sprintf("%s must be a percentage above 0 and at most 100, got %v", p.flag, p.value))
+		}
+	}
+
+	if config.BaselineSamples > 0 && config.BaselineSamples < 3 {
+		warnings = append(warnings, fmt.Sprintf("--baseline-samples %d is too few for a stable CPU baseline", config.BaselineSamples))
+	}
+	if config.HeartbeatInterval > 0 && config.Interval > 0 && config.HeartbeatInterval >= config.Interval {
+		warnings = append(warnings, fmt.Sprintf("--heartbeat-interval %ds is not shorter than --interval %ds", config.HeartbeatInterval, config.Interval))
+	}
+	if config.Interval > 0 && config.AuthWindowSeconds > 0 && config.AuthWindowSeconds < config.Interval {
+		warnings = append(warnings, fmt.Sprintf("--auth-window-seconds %d is shorter than --interval %d", config.AuthWindowSeconds, config.Interval))
+	}
+	if config.BatchSize > 1 && config.GRPCAddr != "" {
+		warnings = append(warnings, fmt.Sprintf("--batch-size %d has no effect with --grpc-addr", config.BatchSize))
+	}
+	return problems, warnings
+}
+
+// checkGRPCReachable connects to the gRPC address
+func checkGRPCReachable(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, reachabilityTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot reach %s: %w", addr, err)
+	}
+	return conn.Close()
+}
+
+// checkURLReachable makes a HEAD request to a server URL. Any HTTP response
+// counts: the server only has to be reachable, not accept an unsigned request.
+func checkURLReachable(client *http.Client, serverURL string) error {
+	resp, err := client.Head(serverURL)
+	if err != nil {
+		return fmt.Errorf("cannot reach %s: %w", serverURL, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// writeConfigReport prints a report: as JSON on stdout, or as one line per
+// check on stderr with the effective config on stdout, so piping check-config
+// still yields the config
+func writeConfigReport(stdout, stderr io.Writer, report ConfigReport, asJSON bool) {
+	if asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Fprintln(stdout, string(data))
+		return
+	}
+	data, _ := json.MarshalIndent(report.Config, "", "  ")
+	fmt.Fprintln(stdout, string(data))
+	for _, check := range report.Checks {
+		line := fmt.Sprintf("%-8s %s", check.Status, check.Name)
+		if check.Detail != "" {
+			line += ": " + check.Detail
+		}
+		fmt.Fprintln(stderr, line)
+	}
+	if report.OK {
+		fmt.Fprintln(stderr, "configuration OK")
+	}
+}
+
+// runConfigCheck checks config and prints the report, failing if any check did
+func runConfigCheck(stdout, stderr io.Writer, config Config, asJSON, connect bool) error {
+	report := checkConfig(config, connect)
+	writeConfigReport(stdout, stderr, report, asJSON)
+	if report.OK {
+		return nil
+	}
+	failed := 0
+	for _, check := range report.Checks {
+		if check.Status == CheckError {
+			failed++
+		}
+	}
+	return fmt.Errorf("%d configuration problem(s)", failed)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkStatuses maps check names to their status
+func checkStatuses(report ConfigReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+// defaultTestConfig parses flags over the agent defaults
+func defaultTestConfig(t *testing.T, args ...string) Config {
+	t.Helper()
+	config, err := parseConfig(newFlagSet("check-config", "check-config"), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// TestCheckConfigReachable tests a valid config against a server that
+// answers, even with an error status
+func TestCheckConfigReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	report := checkConfig(defaultTestConfig(t, "--server-url", server.URL, "--secret", "s3cret"), true)
+	statuses := checkStatuses(report)
+	if !report.OK || statuses["server reachable"] != CheckOK || statuses["thresholds"] != CheckOK || statuses["snmp devices"] != CheckSkipped {
+		t.Errorf("Expected a passing report, got %+v", report.Checks)
+	}
+	if report.Config.Secret == "s3cret" {
+		t.Error("Expected the reported config to be redacted")
+	}
+
+	if report := checkConfig(defaultTestConfig(t, "--server-url", server.URL, "--secret", "s3cret"), false); checkStatuses(report)["server reachable"] != CheckSkipped {
+		t.Errorf("Expected --no-connect to skip reachability, got %+v", report.Checks)
+	}
+}
+
+// TestCheckConfigProblems tests that bad settings fail their checks and are
+// reported together
+func TestCheckConfigProblems(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + listener.Addr().String()
+	listener.Close()
+
+	rules := filepath.Join(t.TempDir(), "mask.json")
+	if err := os.WriteFile(rules, []byte(`{"rules": [{"name": "broken", "pattern": "([a-z"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := defaultTestConfig(t, "--server-url", closed, "--secret", "s3cret",
+		"--mask-rules-file", rules, "--cpu-spike-pct", "150", "--interval", "0")
+	report := checkConfig(config, true)
+	statuses := checkStatuses(report)
+	if report.OK {
+		t.Fatal("Expected the report to fail")
+	}
+	for _, name := range []string{"masking rules", "thresholds", "server reachable"} {
+		if statuses[name] != CheckError {
+			t.Errorf("Expected %s to fail, got %+v", name, report.Checks)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := runConfigCheck(&stdout, &stderr, config, true, false); err == nil || !strings.Contains(err.Error(), "configuration problem(s)") {
+		t.Errorf("Expected a failure count, got %v", err)
+	}
+	var decoded ConfigReport
+	if err := json.Unmarshal(stdout.Bytes(), &decoded); err != nil || decoded.OK || len(decoded.Checks) != len(report.Checks) {
+		t.Errorf("Expected the JSON report on stdout, got %v:\n%s", err, stdout.String())
+	}
+}
+
+// TestThresholdProblems tests threshold errors and warnings
+func TestThresholdProblems(t *testing.T) {
+	config := defaultTestConfig(t)
+	if problems, warnings := thresholdProblems(config); len(problems) != 0 || len(warnings) != 0 {
+		t.Errorf("Expected the defaults to be sane, got %v %v", problems, warnings)
+	}
+
+	// 0 means no limit for these
+	config.LogWorkers, config.MemoryBudgetMB, config.MaxPayloadKB = 0, 0, 0
+	if problems, _ := thresholdProblems(config); len(problems) != 0 {
+		t.Errorf("Expected 0 accepted as no limit, got %v", problems)
+	}
+
+	config.HTTP5xxPct = 0
+	config.BackfillRate = -1
+	config.HeartbeatInterval = config.Interval
+	problems, warnings := thresholdProblems(config)
+	if len(problems) != 2 || !strings.Contains(strings.Join(problems, ";"), "--http-5xx-pct") {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "--heartbeat-interval") {
+		t.Errorf("Unexpected warnings %v", warnings)
+	}
+}